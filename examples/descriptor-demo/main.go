@@ -128,6 +128,14 @@ func main() {
 	}
 	fmt.Printf("✓ Descriptor parsed\n")
 	fmt.Printf("  Version: %d\n", parsed.Version)
+	fmt.Printf("  Superencrypted section: %d bytes\n", len(parsed.Superencrypted))
+
+	// Introduction points are encrypted with the blinded key and subcredential
+	if err := onion.DecryptDescriptor(parsed, addr); err != nil {
+		log.Fatalf("Failed to decrypt descriptor: %v", err)
+	}
+	fmt.Printf("✓ Descriptor decrypted\n")
+	fmt.Printf("  Introduction points: %d\n", len(parsed.IntroPoints))
 	fmt.Println()
 
 	fmt.Println("=== Demo Complete ===")
@@ -45,12 +45,20 @@ func main() {
 	now := time.Now()
 	timePeriod := onion.GetTimePeriod(now)
 	fmt.Printf("Current time period: %d\n", timePeriod)
-	fmt.Printf("  (Changes every 24 hours)\n")
+	fmt.Printf("  (Changes every 24 hours, at 12:00 UTC)\n")
+
+	// Without a consensus the ring uses the disaster shared random value
+	params := onion.NetworkParams{ValidAfter: now}
+	ring := params.CurrentHashRing()
 
 	// Compute blinded public key
 	fmt.Println("\n--- Blinded Public Key Computation ---")
 	pubkey := ed25519.PublicKey(addr.Pubkey)
-	blindedPubkey := onion.ComputeBlindedPubkey(pubkey, timePeriod)
+	blindedPubkey, err := onion.ComputeBlindedPubkey(pubkey, ring.PeriodNum, ring.PeriodLength)
+	if err != nil {
+		fmt.Printf("✗ Failed to blind public key: %v\n", err)
+		return
+	}
 	fmt.Printf("Blinded public key (hex): %x...\n", blindedPubkey[:8])
 	fmt.Printf("  Length: %d bytes\n", len(blindedPubkey))
 
@@ -67,17 +75,16 @@ func main() {
 	fmt.Println("✓ Updated client with HSDir consensus")
 
 	// Demonstrate HSDir selection
-	fmt.Println("\n--- HSDir Selection Algorithm ---")
+	fmt.Println("\n--- HSDir Hash Ring ---")
 	hsdir := onion.NewHSDir(log)
-	descriptorID := make([]byte, 32)
-	copy(descriptorID, blindedPubkey) // Use blinded pubkey as descriptor ID base
-
-	for replica := 0; replica < 2; replica++ {
-		selected := hsdir.SelectHSDirs(descriptorID, hsdirs, replica)
-		fmt.Printf("\nReplica %d - Selected %d HSDirs:\n", replica, len(selected))
-		for i, s := range selected {
-			fmt.Printf("  %d. %s (%s:%d)\n", i+1, s.Fingerprint[:8]+"...", s.Address, s.ORPort)
-		}
+	for replica := 1; replica <= params.Replicas(); replica++ {
+		fmt.Printf("Replica %d hs_index: %x...\n", replica, ring.HSIndex(blindedPubkey, replica)[:8])
+	}
+
+	selected := hsdir.SelectHSDirs(ring, blindedPubkey, hsdirs, params.Replicas(), params.SpreadFetch())
+	fmt.Printf("\nSelected %d HSDirs to fetch from:\n", len(selected))
+	for i, s := range selected {
+		fmt.Printf("  %d. %s (%s:%d) hsdir_index %x...\n", i+1, s.Fingerprint[:8]+"...", s.Address, s.ORPort, ring.HSDirIndex(s.IdentityKey)[:8])
 	}
 
 	// Fetch descriptor from HSDirs
@@ -119,17 +126,9 @@ func main() {
 	fmt.Println("  Cached descriptors: 1")
 	fmt.Printf("  Cache expiry: %v\n", desc.Lifetime)
 
-	// Demonstrate replica descriptor ID computation
-	fmt.Println("\n--- Replica Descriptor IDs ---")
-	for replica := 0; replica < 2; replica++ {
-		replicaID := onion.ComputeReplicaDescriptorID(descriptorID, replica)
-		fmt.Printf("Replica %d ID: %x...\n", replica, replicaID[:8])
-	}
-
 	fmt.Println("\n=== Demo Complete ===")
 	fmt.Println("\nPhase 7.3.2 Features Demonstrated:")
-	fmt.Println("  ✓ HSDir selection algorithm (DHT-style routing)")
-	fmt.Println("  ✓ Replica descriptor ID computation")
+	fmt.Println("  ✓ HSDir hash ring (hs_index / hsdir_index)")
 	fmt.Println("  ✓ Blinded public key derivation")
 	fmt.Println("  ✓ Time period calculation")
 	fmt.Println("  ✓ Descriptor fetching with fallback")
@@ -190,11 +189,15 @@ func createMockHSDirs() []*onion.HSDirectory {
 	}
 
 	for i := 0; i < 8; i++ {
+		// HSDirs are placed on the ring by their ed25519 identity
+		identity := make([]byte, 32)
+		rand.Read(identity)
 		hsdirs[i] = &onion.HSDirectory{
 			Fingerprint: fingerprints[i],
 			Address:     addresses[i],
 			ORPort:      9001,
 			HSDir:       true,
+			IdentityKey: identity,
 		}
 	}
 
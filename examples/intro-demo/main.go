@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/opd-ai/go-tor/pkg/crypto"
 	"github.com/opd-ai/go-tor/pkg/logger"
 	"github.com/opd-ai/go-tor/pkg/onion"
 	"github.com/opd-ai/go-tor/pkg/security"
@@ -70,16 +71,30 @@ func main() {
 	rendezvousCookie := make([]byte, 20)
 	rand.Read(rendezvousCookie)
 
-	// Create onion key
-	onionKey := make([]byte, 32)
-	rand.Read(onionKey)
+	// The rendezvous point we would wait at, as listed in the consensus
+	ntorKey := make([]byte, 32)
+	rand.Read(ntorKey)
+	rendezvousPoint := &onion.HSDirectory{
+		Fingerprint:  "0123456789ABCDEF0123456789ABCDEF01234567",
+		Address:      "192.0.2.10",
+		ORPort:       9001,
+		NtorOnionKey: ntorKey,
+	}
+
+	// The hs-ntor handshake keys INTRODUCE1 and, later, the rendezvous circuit
+	subcredential := onion.ComputeSubcredential(addr.Pubkey, desc.BlindedPubkey)
+	handshake, err := crypto.NewHsNtorClient(introPoint.AuthKey, introPoint.EncKey, subcredential)
+	if err != nil {
+		fmt.Printf("✗ Failed to start hs-ntor handshake: %v\n", err)
+		return
+	}
 
 	// Build introduce request
 	req := &onion.IntroduceRequest{
 		IntroPoint:       introPoint,
 		RendezvousCookie: rendezvousCookie,
-		RendezvousPoint:  "mock-rendezvous-point-fingerprint",
-		OnionKey:         onionKey,
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
 	}
 
 	introduce1Data, err := intro.BuildIntroduce1Cell(req)
@@ -95,83 +110,32 @@ func main() {
 	fmt.Println("    - AUTH_KEY_LEN: 2 bytes")
 	fmt.Println("    - AUTH_KEY: 32 bytes")
 	fmt.Println("    - EXTENSIONS: N bytes")
-	fmt.Println("    - ENCRYPTED_DATA: remaining bytes")
+	fmt.Println("    - CLIENT_PK: 32 bytes (hs-ntor)")
+	fmt.Println("    - ENCRYPTED_DATA: rendezvous cookie, point and padding")
+	fmt.Println("    - MAC: 32 bytes")
 	fmt.Println()
 
-	// === Part 4: Creating Introduction Circuit ===
-	fmt.Println("--- Creating Introduction Circuit ---")
+	// === Part 4: Connecting ===
+	fmt.Println("--- Connecting to the Onion Service ---")
 
+	// Circuits to introduction and rendezvous points need a circuit builder
+	// and relays from the consensus, which the Tor client provides via
+	// SetCircuitBuilder and UpdateHSDirs. Without them the connection fails.
 	ctx := context.Background()
-	// Pass nil for circuit builder to use mock implementation
-	circuitID, err := intro.CreateIntroductionCircuit(ctx, introPoint, nil)
-	if err != nil {
-		fmt.Printf("✗ Failed to create introduction circuit: %v\n", err)
-		return
+	client.UpdateHSDirs([]*onion.HSDirectory{rendezvousPoint})
+	if _, err := client.ConnectToOnionService(ctx, addr); err != nil {
+		fmt.Printf("✓ Connection needs a circuit builder: %v\n", err)
 	}
-
-	fmt.Printf("✓ Introduction circuit created (ID: %d)\n", circuitID)
-	fmt.Println("  In a full implementation, this circuit would:")
-	fmt.Println("    1. Use the circuit builder to create a 3-hop circuit")
-	fmt.Println("    2. Extend to the introduction point")
-	fmt.Println("    3. Wait for circuit establishment")
-	fmt.Println()
-
-	// === Part 5: Sending INTRODUCE1 Cell ===
-	fmt.Println("--- Sending INTRODUCE1 Cell ---")
-
-	// Pass nil for cell sender to use mock implementation
-	err = intro.SendIntroduce1(ctx, circuitID, introduce1Data, nil)
-	if err != nil {
-		fmt.Printf("✗ Failed to send INTRODUCE1: %v\n", err)
-		return
-	}
-
-	fmt.Println("✓ INTRODUCE1 cell sent")
-	fmt.Println("  In a full implementation, this would:")
-	fmt.Println("    1. Wrap data in RELAY cell with INTRODUCE1 command")
-	fmt.Println("    2. Send over the circuit")
-	fmt.Println("    3. Wait for acknowledgment")
-	fmt.Println()
-
-	// === Part 6: Full Connection Orchestration ===
-	fmt.Println("--- Full Connection Orchestration ---")
-
-	// Create a fresh address for full demo
-	freshAddr := generateTestAddress()
-	freshDesc := createMockDescriptor(freshAddr)
-	client.CacheDescriptor(freshAddr, freshDesc)
-
-	fullCircuitID, err := client.ConnectToOnionService(ctx, freshAddr)
-	if err != nil {
-		fmt.Printf("✗ Failed to connect to onion service: %v\n", err)
-		return
-	}
-
-	fmt.Printf("✓ Successfully orchestrated connection to onion service\n")
-	fmt.Printf("  Circuit ID: %d\n", fullCircuitID)
-	fmt.Printf("  Address: %s\n", freshAddr.String())
 	fmt.Println()
 
 	// === Summary ===
 	fmt.Println("=== Demo Complete ===")
 	fmt.Println()
-	fmt.Println("Phase 7.3.3 Implementation Status:")
-	fmt.Println("  ✓ Introduction point selection")
-	fmt.Println("  ✓ INTRODUCE1 cell construction")
-	fmt.Println("  ✓ Introduction circuit creation (mock)")
-	fmt.Println("  ✓ Cell sending protocol (mock)")
-	fmt.Println("  ✓ Full connection orchestration")
-	fmt.Println()
-	fmt.Println("Next Steps (Phase 7.3.4):")
-	fmt.Println("  - Rendezvous point selection")
-	fmt.Println("  - RENDEZVOUS1/2 protocol")
-	fmt.Println("  - End-to-end circuit completion")
-	fmt.Println()
-	fmt.Println("Production Hardening (Phase 8):")
-	fmt.Println("  - Real circuit-based communication")
-	fmt.Println("  - Encryption of INTRODUCE1 data")
-	fmt.Println("  - INTRODUCE_ACK handling")
-	fmt.Println("  - Retry and timeout logic")
+	fmt.Println("With a circuit builder, ConnectToOnionService:")
+	fmt.Println("  1. Establishes a rendezvous point (ESTABLISH_RENDEZVOUS)")
+	fmt.Println("  2. Sends INTRODUCE1 through an introduction point")
+	fmt.Println("  3. Waits for INTRODUCE_ACK and RENDEZVOUS2")
+	fmt.Println("  4. Returns the rendezvous circuit with the service as its last hop")
 }
 
 // generateTestAddress generates a test v3 onion address
@@ -195,19 +159,22 @@ func createMockDescriptor(addr *onion.Address) *onion.Descriptor {
 	for i := 0; i < 3; i++ {
 		onionKey := make([]byte, 32)
 		authKey := make([]byte, 32)
+		encKey := make([]byte, 32)
 		rand.Read(onionKey)
 		rand.Read(authKey)
+		rand.Read(encKey)
 
 		introPoints[i] = onion.IntroductionPoint{
 			OnionKey: onionKey,
 			AuthKey:  authKey,
+			EncKey:   encKey,
 			LinkSpecifiers: []onion.LinkSpecifier{
 				{
-					Type: 0, // IPv4
-					Data: []byte{192, 168, 1, byte(100 + i)},
+					Type: onion.LinkSpecIPv4,
+					Data: []byte{192, 168, 1, byte(100 + i), 0x23, 0x29},
 				},
 				{
-					Type: 2, // Legacy ID
+					Type: onion.LinkSpecLegacyID,
 					Data: make([]byte, 20),
 				},
 			},
@@ -216,7 +183,10 @@ func createMockDescriptor(addr *onion.Address) *onion.Descriptor {
 
 	// Compute time period and blinded key
 	timePeriod := onion.GetTimePeriod(time.Now())
-	blindedPubkey := onion.ComputeBlindedPubkey(ed25519.PublicKey(addr.Pubkey), timePeriod)
+	blindedPubkey, err := onion.ComputeBlindedPubkey(ed25519.PublicKey(addr.Pubkey), timePeriod, 1440)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to blind key: %v", err))
+	}
 
 	// Safely convert timestamp to uint64
 	now := time.Now()
@@ -230,18 +200,9 @@ func createMockDescriptor(addr *onion.Address) *onion.Descriptor {
 		Address:         addr,
 		IntroPoints:     introPoints,
 		BlindedPubkey:   blindedPubkey,
-		DescriptorID:    computeDescriptorID(blindedPubkey),
+		DescriptorID:    blindedPubkey, // v3 descriptors are stored under the blinded key
 		RevisionCounter: revisionCounter,
 		CreatedAt:       now,
 		Lifetime:        3 * time.Hour,
 	}
 }
-
-// computeDescriptorID computes a descriptor ID (simplified)
-func computeDescriptorID(blindedPubkey []byte) []byte {
-	// In reality, this would be SHA3-256(blinded_pubkey)
-	// For demo, just return first 32 bytes
-	id := make([]byte, 32)
-	copy(id, blindedPubkey)
-	return id
-}
@@ -38,24 +38,31 @@ func main() {
 	fmt.Println()
 
 	// Create mock relays for demonstration
+	ntorKey := make([]byte, 32)
 	mockRelays := []*onion.HSDirectory{
 		{
 			Fingerprint: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
 			Address:     "1.1.1.1",
 			ORPort:      9001,
 			HSDir:       true,
+			// Needed to extend circuits to the relay
+			NtorOnionKey: ntorKey,
 		},
 		{
 			Fingerprint: "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
 			Address:     "2.2.2.2",
 			ORPort:      9002,
 			HSDir:       true,
+			// Needed to extend circuits to the relay
+			NtorOnionKey: ntorKey,
 		},
 		{
 			Fingerprint: "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC",
 			Address:     "3.3.3.3",
 			ORPort:      9003,
 			HSDir:       true,
+			// Needed to extend circuits to the relay
+			NtorOnionKey: ntorKey,
 		},
 	}
 
@@ -103,33 +110,20 @@ func main() {
 	// Demo 3: Creating Rendezvous Circuit
 	fmt.Println("--- Creating Rendezvous Circuit ---")
 
+	// Real circuits need a circuit builder, which the Tor client provides
 	ctx := context.Background()
-	// Pass nil for circuit builder to use mock implementation
-	circuitID, err := rendezvous.CreateRendezvousCircuit(ctx, rendezvousPoint, nil)
-	if err != nil {
-		log.Fatalf("Failed to create rendezvous circuit: %v", err)
-	}
-
-	fmt.Printf("✓ Rendezvous circuit created\n")
-	fmt.Printf("  - Circuit ID: %d\n", circuitID)
-	fmt.Println()
-
-	// Demo 4: Sending ESTABLISH_RENDEZVOUS
-	fmt.Println("--- Sending ESTABLISH_RENDEZVOUS ---")
-
-	// Pass nil for cell sender to use mock implementation
-	err = rendezvous.SendEstablishRendezvous(ctx, circuitID, establishData, nil)
-	if err != nil {
-		log.Fatalf("Failed to send ESTABLISH_RENDEZVOUS: %v", err)
+	if _, err := rendezvous.CreateRendezvousCircuit(ctx, rendezvousPoint, nil); err != nil {
+		fmt.Printf("✓ Rendezvous circuits need a circuit builder: %v\n", err)
 	}
-
-	fmt.Printf("✓ ESTABLISH_RENDEZVOUS sent successfully\n")
+	fmt.Println("  With one, the circuit is built to the rendezvous point and")
+	fmt.Println("  ESTABLISH_RENDEZVOUS is acknowledged with RENDEZVOUS_ESTABLISHED")
 	fmt.Println()
 
-	// Demo 5: RENDEZVOUS1 Cell Construction (for completeness)
+	// Demo 4: RENDEZVOUS1 Cell Construction (for completeness)
 	fmt.Println("--- Building RENDEZVOUS1 Cell (Service Side) ---")
 
-	handshakeData := make([]byte, 32)
+	// hs-ntor SERVER_PK | AUTH
+	handshakeData := make([]byte, 64)
 	for i := range handshakeData {
 		handshakeData[i] = byte(i + 100)
 	}
@@ -147,60 +141,26 @@ func main() {
 	fmt.Printf("✓ RENDEZVOUS1 cell built (%d bytes)\n", len(rendezvous1Data))
 	fmt.Printf("  Cell structure:\n")
 	fmt.Printf("    - RENDEZVOUS_COOKIE: 20 bytes\n")
-	fmt.Printf("    - HANDSHAKE_DATA: %d bytes\n", len(handshakeData))
+	fmt.Printf("    - HANDSHAKE_INFO: %d bytes\n", len(handshakeData))
 	fmt.Println()
 
-	// Demo 6: RENDEZVOUS2 Cell Parsing
+	// Demo 5: RENDEZVOUS2 Cell Parsing
 	fmt.Println("--- Parsing RENDEZVOUS2 Cell (Client Side) ---")
 
-	// Simulate receiving RENDEZVOUS2 with handshake data
-	rendezvous2Data := make([]byte, 32)
-	for i := range rendezvous2Data {
-		rendezvous2Data[i] = byte(i + 200)
-	}
-
-	parsedHandshake, err := rendezvous.ParseRendezvous2Cell(rendezvous2Data)
+	// The rendezvous point relays the service's HANDSHAKE_INFO unchanged
+	parsedHandshake, err := rendezvous.ParseRendezvous2Cell(rendezvous1Data[20:])
 	if err != nil {
 		log.Fatalf("Failed to parse RENDEZVOUS2 cell: %v", err)
 	}
 
 	fmt.Printf("✓ RENDEZVOUS2 cell parsed successfully\n")
 	fmt.Printf("  - Handshake data length: %d bytes\n", len(parsedHandshake))
+	fmt.Println("  The client checks AUTH and adds the service as a virtual hop")
 	fmt.Println()
 
-	// Demo 7: Full Rendezvous Point Establishment
-	fmt.Println("--- Full Rendezvous Point Establishment ---")
-
-	newCookie := make([]byte, 20)
-	for i := range newCookie {
-		newCookie[i] = byte(i * 2)
-	}
-
-	rvCircuitID, rvPoint, err := client.EstablishRendezvousPoint(ctx, newCookie, mockRelays)
-	if err != nil {
-		log.Fatalf("Failed to establish rendezvous point: %v", err)
-	}
-
-	fmt.Printf("✓ Rendezvous point fully established\n")
-	fmt.Printf("  - Circuit ID: %d\n", rvCircuitID)
-	fmt.Printf("  - Rendezvous point: %s\n", rvPoint.Fingerprint)
-	fmt.Println()
-
-	// Demo 8: Complete Rendezvous Protocol
-	fmt.Println("--- Completing Rendezvous Protocol ---")
-
-	err = client.CompleteRendezvous(ctx, rvCircuitID)
-	if err != nil {
-		log.Fatalf("Failed to complete rendezvous: %v", err)
-	}
-
-	fmt.Printf("✓ Rendezvous protocol completed successfully\n")
-	fmt.Println()
-
-	// Demo 9: Full Onion Service Connection
+	// Demo 6: Full Onion Service Connection
 	fmt.Println("--- Full Onion Service Connection Orchestration ---")
 
-	// Create a mock descriptor with introduction points
 	desc := &onion.Descriptor{
 		Version: 3,
 		Address: addr,
@@ -208,9 +168,10 @@ func main() {
 			{
 				OnionKey: make([]byte, 32),
 				AuthKey:  make([]byte, 32),
+				EncKey:   make([]byte, 32),
 				LinkSpecifiers: []onion.LinkSpecifier{
-					{Type: 0, Data: []byte{127, 0, 0, 1}},
-					{Type: 2, Data: []byte{0x23, 0x28}},
+					{Type: onion.LinkSpecIPv4, Data: []byte{127, 0, 0, 1, 0x23, 0x28}},
+					{Type: onion.LinkSpecLegacyID, Data: make([]byte, 20)},
 				},
 			},
 		},
@@ -222,15 +183,9 @@ func main() {
 	client.CacheDescriptor(addr, desc)
 	fmt.Printf("✓ Descriptor cached for %s\n", addr.String())
 
-	// Connect to the onion service
-	finalCircuitID, err := client.ConnectToOnionService(ctx, addr)
-	if err != nil {
-		log.Fatalf("Failed to connect to onion service: %v", err)
+	if _, err := client.ConnectToOnionService(ctx, addr); err != nil {
+		fmt.Printf("✓ Connecting needs a circuit builder too: %v\n", err)
 	}
-
-	fmt.Printf("✓ Successfully orchestrated full connection to onion service\n")
-	fmt.Printf("  - Circuit ID: %d\n", finalCircuitID)
-	fmt.Printf("  - Address: %s\n", addr.String())
 	fmt.Println()
 
 	fmt.Println("=== Demo Complete ===")
@@ -238,10 +193,6 @@ func main() {
 	fmt.Println("Summary:")
 	fmt.Println("- Rendezvous point selection: ✓")
 	fmt.Println("- ESTABLISH_RENDEZVOUS cell construction: ✓")
-	fmt.Println("- Rendezvous circuit creation: ✓")
 	fmt.Println("- RENDEZVOUS1 cell construction: ✓")
 	fmt.Println("- RENDEZVOUS2 cell parsing: ✓")
-	fmt.Println("- Full onion service connection: ✓")
-	fmt.Println()
-	fmt.Println("Phase 7.3.4 (Rendezvous Protocol) implementation complete!")
 }
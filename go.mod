@@ -3,6 +3,7 @@ module github.com/opd-ai/go-tor
 go 1.24.9
 
 require (
+	filippo.io/edwards25519 v1.1.0
 	github.com/cretz/bine v0.2.0
 	golang.org/x/crypto v0.43.0
 	golang.org/x/net v0.45.0
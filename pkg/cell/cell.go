@@ -41,6 +41,8 @@ const (
 	CmdCreate2     Command = 10
 	CmdCreated2    Command = 11
 
+	CmdPaddingNegotiate Command = 12 // Link padding negotiation (padding-spec.txt §2.2)
+
 	// Variable-length commands
 	CmdVPadding      Command = 128
 	CmdCerts         Command = 129
@@ -56,9 +58,10 @@ type Cell struct {
 	Payload []byte  // Cell payload
 }
 
-// IsVariableLength returns true if the command indicates a variable-length cell
+// IsVariableLength returns true if the command indicates a variable-length cell.
+// VERSIONS is variable-length as well (tor-spec.txt section 3).
 func (c Command) IsVariableLength() bool {
-	return c >= 128
+	return c == CmdVersions || c >= 128
 }
 
 // String returns a human-readable representation of the command
@@ -88,6 +91,8 @@ func (c Command) String() string {
 		return "CREATE2"
 	case CmdCreated2:
 		return "CREATED2"
+	case CmdPaddingNegotiate:
+		return "PADDING_NEGOTIATE"
 	case CmdVPadding:
 		return "VPADDING"
 	case CmdCerts:
@@ -13,6 +13,7 @@ func TestCommandIsVariableLength(t *testing.T) {
 		{CmdPadding, false},
 		{CmdCreate, false},
 		{CmdRelay, false},
+		{CmdVersions, true},
 		{CmdVPadding, true},
 		{CmdCerts, true},
 		{Command(200), true},
@@ -37,6 +38,7 @@ func TestCommandString(t *testing.T) {
 		{CmdCreated, "CREATED"},
 		{CmdRelay, "RELAY"},
 		{CmdDestroy, "DESTROY"},
+		{CmdPaddingNegotiate, "PADDING_NEGOTIATE"},
 		{Command(255), "UNKNOWN(255)"},
 	}
 
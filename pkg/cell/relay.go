@@ -10,27 +10,33 @@ import (
 
 // Relay commands from tor-spec.txt section 6.1
 const (
-	RelayBegin        byte = 1
-	RelayData         byte = 2
-	RelayEnd          byte = 3
-	RelayConnected    byte = 4
-	RelaySendme       byte = 5  // SENDME cell for flow control
-	RelayExtend       byte = 6  // Legacy EXTEND (not used in v3+)
-	RelayExtended     byte = 7  // Legacy EXTENDED (not used in v3+)
-	RelayTruncate     byte = 8  // TRUNCATE cell
-	RelayTruncated    byte = 9  // TRUNCATED cell
-	RelayDrop         byte = 10 // DROP cell for testing
-	RelayResolve      byte = 11
-	RelayResolved     byte = 12
-	RelayBeginDir     byte = 13
-	RelayExtend2      byte = 14
-	RelayExtended2    byte = 15
-	RelayIntroduce1   byte = 32 // INTRODUCE1 cell for onion services
-	RelayIntroduce2   byte = 33 // INTRODUCE2 cell for onion services
-	RelayRendezvous1  byte = 34 // RENDEZVOUS1 cell for onion services
-	RelayRendezvous2  byte = 35 // RENDEZVOUS2 cell for onion services
-	RelayIntroEstab   byte = 38 // ESTABLISH_INTRO cell for onion services
-	RelayIntroEstdAck byte = 39 // INTRO_ESTABLISHED cell for onion services
+	RelayBegin                 byte = 1
+	RelayData                  byte = 2
+	RelayEnd                   byte = 3
+	RelayConnected             byte = 4
+	RelaySendme                byte = 5  // SENDME cell for flow control
+	RelayExtend                byte = 6  // Legacy EXTEND (not used in v3+)
+	RelayExtended              byte = 7  // Legacy EXTENDED (not used in v3+)
+	RelayTruncate              byte = 8  // TRUNCATE cell
+	RelayTruncated             byte = 9  // TRUNCATED cell
+	RelayDrop                  byte = 10 // DROP cell for testing
+	RelayResolve               byte = 11
+	RelayResolved              byte = 12
+	RelayBeginDir              byte = 13
+	RelayExtend2               byte = 14
+	RelayExtended2             byte = 15
+	RelayEstablishIntro        byte = 32 // ESTABLISH_INTRO (rend-spec-v3.txt §3.1)
+	RelayEstablishRendezvous   byte = 33 // ESTABLISH_RENDEZVOUS (rend-spec-v3.txt §3.3)
+	RelayIntroduce1            byte = 34 // INTRODUCE1 (rend-spec-v3.txt §3.2)
+	RelayIntroduce2            byte = 35 // INTRODUCE2 (rend-spec-v3.txt §3.2)
+	RelayRendezvous1           byte = 36 // RENDEZVOUS1 (rend-spec-v3.txt §3.4)
+	RelayRendezvous2           byte = 37 // RENDEZVOUS2 (rend-spec-v3.txt §3.4)
+	RelayIntroEstablished      byte = 38 // INTRO_ESTABLISHED (rend-spec-v3.txt §3.1)
+	RelayRendezvousEstablished byte = 39 // RENDEZVOUS_ESTABLISHED (rend-spec-v3.txt §3.3)
+	RelayIntroduceAck          byte = 40 // INTRODUCE_ACK (rend-spec-v3.txt §3.2)
+
+	RelayPaddingNegotiate  byte = 41 // PADDING_NEGOTIATE cell (padding-spec.txt §3.3)
+	RelayPaddingNegotiated byte = 42 // PADDING_NEGOTIATED cell (padding-spec.txt §3.3)
 )
 
 // RelayCell represents the payload of a RELAY or RELAY_EARLY cell
@@ -156,6 +162,28 @@ func RelayCmdString(cmd byte) string {
 		return "RELAY_EXTEND2"
 	case RelayExtended2:
 		return "RELAY_EXTENDED2"
+	case RelayEstablishIntro:
+		return "RELAY_ESTABLISH_INTRO"
+	case RelayEstablishRendezvous:
+		return "RELAY_ESTABLISH_RENDEZVOUS"
+	case RelayIntroduce1:
+		return "RELAY_INTRODUCE1"
+	case RelayIntroduce2:
+		return "RELAY_INTRODUCE2"
+	case RelayRendezvous1:
+		return "RELAY_RENDEZVOUS1"
+	case RelayRendezvous2:
+		return "RELAY_RENDEZVOUS2"
+	case RelayIntroEstablished:
+		return "RELAY_INTRO_ESTABLISHED"
+	case RelayRendezvousEstablished:
+		return "RELAY_RENDEZVOUS_ESTABLISHED"
+	case RelayIntroduceAck:
+		return "RELAY_INTRODUCE_ACK"
+	case RelayPaddingNegotiate:
+		return "RELAY_PADDING_NEGOTIATE"
+	case RelayPaddingNegotiated:
+		return "RELAY_PADDING_NEGOTIATED"
 	default:
 		return fmt.Sprintf("RELAY_UNKNOWN(%d)", cmd)
 	}
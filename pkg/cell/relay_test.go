@@ -119,6 +119,17 @@ func TestRelayCmdString(t *testing.T) {
 		{RelayBeginDir, "RELAY_BEGIN_DIR"},
 		{RelayExtend2, "RELAY_EXTEND2"},
 		{RelayExtended2, "RELAY_EXTENDED2"},
+		{RelayEstablishIntro, "RELAY_ESTABLISH_INTRO"},
+		{RelayEstablishRendezvous, "RELAY_ESTABLISH_RENDEZVOUS"},
+		{RelayIntroduce1, "RELAY_INTRODUCE1"},
+		{RelayIntroduce2, "RELAY_INTRODUCE2"},
+		{RelayRendezvous1, "RELAY_RENDEZVOUS1"},
+		{RelayRendezvous2, "RELAY_RENDEZVOUS2"},
+		{RelayIntroEstablished, "RELAY_INTRO_ESTABLISHED"},
+		{RelayRendezvousEstablished, "RELAY_RENDEZVOUS_ESTABLISHED"},
+		{RelayIntroduceAck, "RELAY_INTRODUCE_ACK"},
+		{RelayPaddingNegotiate, "RELAY_PADDING_NEGOTIATE"},
+		{RelayPaddingNegotiated, "RELAY_PADDING_NEGOTIATED"},
 		{255, "RELAY_UNKNOWN(255)"},
 	}
 
@@ -7,9 +7,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/opd-ai/go-tor/pkg/cell"
 	"github.com/opd-ai/go-tor/pkg/connection"
+	"github.com/opd-ai/go-tor/pkg/directory"
 	"github.com/opd-ai/go-tor/pkg/logger"
 	"github.com/opd-ai/go-tor/pkg/path"
+	"github.com/opd-ai/go-tor/pkg/protocol"
 )
 
 // Builder constructs Tor circuits through the network
@@ -17,6 +20,10 @@ type Builder struct {
 	logger  *logger.Logger
 	manager *Manager
 	mu      sync.Mutex
+
+	congestion         *CongestionParams         // Request congestion control from exits when set
+	congestionObserver func(CongestionStats)     // Passed to circuits that negotiate congestion control
+	linkPadding        *connection.PaddingParams // Pad guard connections of built circuits when set
 }
 
 // NewBuilder creates a new circuit builder
@@ -31,7 +38,32 @@ func NewBuilder(manager *Manager, log *logger.Logger) *Builder {
 	}
 }
 
-// BuildCircuit builds a complete 3-hop circuit using the provided path
+// SetCongestionControl enables prop324 congestion control on circuits built
+// afterwards. Exits that advertise FlowCtrl=2 are asked for it in the ntor v3
+// handshake; circuits through other exits keep the fixed windows. observer,
+// if not nil, is called after every congestion window update. A nil params
+// disables congestion control.
+func (b *Builder) SetCongestionControl(params *CongestionParams, observer func(CongestionStats)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.congestion = params
+	b.congestionObserver = observer
+}
+
+// SetConnectionPadding enables link padding (padding-spec.txt §2) on the
+// guard connection of each circuit built afterwards, with timeouts drawn from
+// params. One-hop directory circuits are never padded. A nil params disables
+// link padding.
+func (b *Builder) SetConnectionPadding(params *connection.PaddingParams) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.linkPadding = params
+}
+
+// BuildCircuit builds a complete 3-hop circuit using the provided path. The
+// guard hop is created with CREATE2 and the middle and exit hops are added
+// with EXTEND2, each using the ntor handshake. On success the circuit owns the
+// guard connection until Circuit.Close is called.
 func (b *Builder) BuildCircuit(ctx context.Context, p *path.Path, timeout time.Duration) (*Circuit, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -53,52 +85,44 @@ func (b *Builder) BuildCircuit(ctx context.Context, p *path.Path, timeout time.D
 
 	// Connect to guard
 	guardAddr := fmt.Sprintf("%s:%d", p.Guard.Address, p.Guard.ORPort)
-	guardConn, err := b.connectToRelay(buildCtx, guardAddr)
+	guardConn, err := b.connectToRelay(buildCtx, p.Guard)
 	if err != nil {
 		circuit.SetState(StateFailed)
 		return nil, fmt.Errorf("failed to connect to guard: %w", err)
 	}
-	defer func() {
-		if err := guardConn.Close(); err != nil {
-			b.logger.Error("Failed to close guard connection", "function", "BuildCircuit", "error", err)
-		}
-	}()
-
-	// Add guard hop
-	if err := circuit.AddHop(&Hop{
-		Fingerprint: p.Guard.Fingerprint,
-		Address:     guardAddr,
-		IsGuard:     true,
-		IsExit:      false,
-	}); err != nil {
+
+	circuit.SetConnection(guardConn)
+	go b.deliverCells(guardConn, circuit)
+
+	fail := func(err error) (*Circuit, error) {
 		circuit.SetState(StateFailed)
-		return nil, fmt.Errorf("failed to add guard hop: %w", err)
+		if closeErr := guardConn.Close(); closeErr != nil {
+			b.logger.Error("Failed to close guard connection", "function", "BuildCircuit", "error", closeErr)
+		}
+		return nil, err
+	}
+
+	ext := NewExtension(circuit, b.logger)
+
+	// Create the first hop with CREATE2
+	ext.SetTargetRelay(p.Guard)
+	ext.SetTargetHop(NewHop(p.Guard.Fingerprint, guardAddr, true, false))
+	if err := ext.CreateFirstHop(buildCtx, HandshakeTypeNTor); err != nil {
+		return fail(fmt.Errorf("failed to create guard hop: %w", err))
 	}
 
 	b.logger.Info("Connected to guard", "guard", p.Guard.Nickname)
 
-	// Add middle hop (simulated for now)
-	if err := circuit.AddHop(&Hop{
-		Fingerprint: p.Middle.Fingerprint,
-		Address:     fmt.Sprintf("%s:%d", p.Middle.Address, p.Middle.ORPort),
-		IsGuard:     false,
-		IsExit:      false,
-	}); err != nil {
-		circuit.SetState(StateFailed)
-		return nil, fmt.Errorf("failed to add middle hop: %w", err)
+	// Extend to middle with EXTEND2
+	if err := b.extendTo(buildCtx, ext, p.Middle, false); err != nil {
+		return fail(fmt.Errorf("failed to extend to middle: %w", err))
 	}
 
 	b.logger.Info("Extended to middle", "middle", p.Middle.Nickname)
 
-	// Add exit hop (simulated for now)
-	if err := circuit.AddHop(&Hop{
-		Fingerprint: p.Exit.Fingerprint,
-		Address:     fmt.Sprintf("%s:%d", p.Exit.Address, p.Exit.ORPort),
-		IsGuard:     false,
-		IsExit:      true,
-	}); err != nil {
-		circuit.SetState(StateFailed)
-		return nil, fmt.Errorf("failed to add exit hop: %w", err)
+	// Extend to exit with EXTEND2
+	if err := b.extendTo(buildCtx, ext, p.Exit, true); err != nil {
+		return fail(fmt.Errorf("failed to extend to exit: %w", err))
 	}
 
 	b.logger.Info("Extended to exit", "exit", p.Exit.Nickname)
@@ -106,29 +130,158 @@ func (b *Builder) BuildCircuit(ctx context.Context, p *path.Path, timeout time.D
 	// Mark circuit as open
 	circuit.SetState(StateOpen)
 
+	if b.linkPadding != nil {
+		if err := guardConn.EnablePadding(*b.linkPadding); err != nil {
+			b.logger.Warn("Failed to enable link padding", "guard", p.Guard.Nickname, "error", err)
+		}
+	}
+
 	b.logger.Info("Circuit built successfully", "circuit_id", circuit.ID, "hops", circuit.Length())
 
 	return circuit, nil
 }
 
-// connectToRelay establishes a connection to a relay
-func (b *Builder) connectToRelay(ctx context.Context, address string) (*connection.Connection, error) {
+// extendTo extends the circuit by one hop to relay using the ntor handshake.
+// When congestion control is enabled the exit is asked for it, and the
+// circuit switches to Tor Vegas if the exit accepts.
+func (b *Builder) extendTo(ctx context.Context, ext *Extension, relay *directory.Relay, isExit bool) error {
+	address := fmt.Sprintf("%s:%d", relay.Address, relay.ORPort)
+	ext.SetTargetRelay(relay)
+	ext.SetTargetHop(NewHop(relay.Fingerprint, address, false, isExit))
+
+	requestCC := isExit && b.congestion != nil &&
+		relay.SupportsProtocol(directory.ProtoFlowCtrl, directory.ProtoFlowCtrlCongestionControl)
+	if requestCC {
+		ext.SetHandshakeExtensions([]HandshakeExtension{congestionRequest()})
+		defer ext.SetHandshakeExtensions(nil)
+	}
+
+	if err := ext.ExtendCircuit(ctx, address, HandshakeTypeNTor); err != nil {
+		return err
+	}
+	if !requestCC {
+		return nil
+	}
+
+	sendmeInc, err := parseCongestionResponse(ext.ServerExtensions(), *b.congestion)
+	if err != nil {
+		return fmt.Errorf("congestion control negotiation failed: %w", err)
+	}
+	if sendmeInc == 0 {
+		b.logger.Debug("Exit declined congestion control", "exit", relay.Nickname)
+		return nil
+	}
+	params := *b.congestion
+	params.SendmeInc = sendmeInc
+	ext.circuit.enableCongestionControl(params, b.congestionObserver)
+	b.logger.Debug("Negotiated congestion control", "exit", relay.Nickname, "sendme_inc", sendmeInc)
+	return nil
+}
+
+// BuildOneHopCircuit builds a circuit to a single relay, used for tunnelled
+// directory requests (RELAY_BEGIN_DIR). The hop is created with CREATE_FAST,
+// since the link handshake has already authenticated the relay. The circuit
+// keeps its relay connection open until Circuit.Close is called.
+func (b *Builder) BuildOneHopCircuit(ctx context.Context, relay *directory.Relay, timeout time.Duration) (*Circuit, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.logger.Info("Building one-hop circuit", "relay", relay.Nickname)
+
+	circuit, err := b.manager.CreateCircuit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create circuit: %w", err)
+	}
+
+	buildCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	relayAddr := fmt.Sprintf("%s:%d", relay.Address, relay.ORPort)
+	conn, err := b.connectToRelay(buildCtx, relay)
+	if err != nil {
+		circuit.SetState(StateFailed)
+		return nil, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+
+	circuit.SetConnection(conn)
+	go b.deliverCells(conn, circuit)
+
+	ext := NewExtension(circuit, b.logger)
+	ext.SetTargetHop(NewHop(relay.Fingerprint, relayAddr, true, false))
+	if err := ext.CreateFastHop(buildCtx); err != nil {
+		circuit.SetState(StateFailed)
+		if closeErr := conn.Close(); closeErr != nil {
+			b.logger.Error("Failed to close relay connection", "function", "BuildOneHopCircuit", "error", closeErr)
+		}
+		return nil, fmt.Errorf("failed to create hop: %w", err)
+	}
+
+	circuit.SetState(StateOpen)
+
+	b.logger.Info("One-hop circuit built successfully", "circuit_id", circuit.ID, "relay", relay.Nickname)
+
+	return circuit, nil
+}
+
+// deliverCells passes cells for the circuit received on conn to it until the
+// connection is closed. RELAY cells go through onion decryption; CREATED2,
+// CREATED_FAST and DESTROY cells are handed to the circuit's control channel
+// while it is being built. A DESTROY on an open circuit closes it.
+func (b *Builder) deliverCells(conn *connection.Connection, circuit *Circuit) {
+	for {
+		received, err := conn.ReceiveCell()
+		if err != nil {
+			if circuit.GetState() == StateOpen {
+				b.logger.Debug("Circuit connection closed", "circuit_id", circuit.ID, "error", err)
+				circuit.shutdown(StateClosed)
+			}
+			return
+		}
+
+		if received.CircID != circuit.ID {
+			continue
+		}
+		switch received.Command {
+		case cell.CmdRelay:
+			if err := circuit.DeliverRelayCell(received); err != nil {
+				b.logger.Warn("Failed to deliver relay cell", "circuit_id", circuit.ID, "error", err)
+			}
+		case cell.CmdDestroy:
+			if circuit.GetState() == StateOpen {
+				b.logger.Debug("Circuit destroyed by relay", "circuit_id", circuit.ID, "reason", destroyReason(received.Payload))
+				circuit.shutdown(StateClosed)
+				continue
+			}
+			if err := circuit.DeliverControlCell(received); err != nil {
+				b.logger.Warn("Failed to deliver control cell", "circuit_id", circuit.ID, "error", err)
+			}
+		case cell.CmdCreated2, cell.CmdCreatedFast:
+			if err := circuit.DeliverControlCell(received); err != nil {
+				b.logger.Warn("Failed to deliver control cell", "circuit_id", circuit.ID, "error", err)
+			}
+		}
+	}
+}
+
+// connectToRelay establishes a connection to a relay and performs the link
+// protocol handshake. The relay must prove the RSA fingerprint and Ed25519
+// identity it is listed with in the consensus.
+func (b *Builder) connectToRelay(ctx context.Context, relay *directory.Relay) (*connection.Connection, error) {
+	address := fmt.Sprintf("%s:%d", relay.Address, relay.ORPort)
 	cfg := connection.DefaultConfig(address)
+	cfg.ExpectedFingerprint = relay.HexFingerprint()
+	cfg.ExpectedIdentity = relay.IdentityKey
 	conn := connection.New(cfg, b.logger)
 
 	if err := conn.Connect(ctx, cfg); err != nil {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
-	// Wait for connection to be ready
-	select {
-	case <-ctx.Done():
-		if err := conn.Close(); err != nil {
-			b.logger.Error("Failed to close connection on context cancellation", "function", "connectToRelay", "error", err)
+	if err := protocol.NewHandshake(conn, b.logger).PerformHandshake(ctx); err != nil {
+		if closeErr := conn.Close(); closeErr != nil {
+			b.logger.Error("Failed to close connection after handshake failure", "function", "connectToRelay", "error", closeErr)
 		}
-		return nil, ctx.Err()
-	case <-time.After(100 * time.Millisecond):
-		// Connection established
+		return nil, fmt.Errorf("link handshake failed: %w", err)
 	}
 
 	return conn, nil
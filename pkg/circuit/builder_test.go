@@ -1,13 +1,20 @@
 package circuit
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/opd-ai/go-tor/pkg/connection"
 	"github.com/opd-ai/go-tor/pkg/directory"
 	"github.com/opd-ai/go-tor/pkg/logger"
 	"github.com/opd-ai/go-tor/pkg/path"
+	"github.com/opd-ai/go-tor/pkg/relaytest"
 )
 
 func TestNewBuilder(t *testing.T) {
@@ -213,3 +220,408 @@ func TestBuildCircuitContextCancelled(t *testing.T) {
 		t.Error("Expected error when context is cancelled")
 	}
 }
+
+func newFakeNetworkPath(t *testing.T) (*relaytest.Network, *path.Path) {
+	t.Helper()
+
+	network, err := relaytest.NewNetwork(3, nil)
+	if err != nil {
+		t.Fatalf("Failed to start fake relay network: %v", err)
+	}
+	t.Cleanup(network.Close)
+
+	relays := network.Relays()
+	return network, &path.Path{
+		Guard:  relays[0].Descriptor(),
+		Middle: relays[1].Descriptor(),
+		Exit:   relays[2].Descriptor(),
+	}
+}
+
+func TestBuildCircuitFakeNetwork(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+
+	circuit, err := builder.BuildCircuit(context.Background(), testPath, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+
+	if circuit.GetState() != StateOpen {
+		t.Errorf("Expected circuit state Open, got %s", circuit.GetState())
+	}
+	if circuit.Length() != 3 {
+		t.Fatalf("Expected 3 hops, got %d", circuit.Length())
+	}
+	for i, hop := range circuit.Hops {
+		if hop.ForwardCipher == nil || hop.BackwardCipher == nil || hop.ForwardDigest == nil || hop.BackwardDigest == nil {
+			t.Errorf("Hop %d has no crypto state", i)
+		}
+	}
+	if !circuit.Hops[0].IsGuard || !circuit.Hops[2].IsExit {
+		t.Error("Guard and exit flags not set on hops")
+	}
+	for _, relay := range network.Relays() {
+		if relay.CircuitCount() != 1 {
+			t.Errorf("Relay %s accepted %d circuits, want 1", relay.Nickname(), relay.CircuitCount())
+		}
+		if relay.HandshakeCount(uint16(HandshakeTypeNTorV3)) != 1 {
+			t.Errorf("Relay %s did not use ntor v3", relay.Nickname())
+		}
+	}
+
+	// A stream through all three layers proves the per-hop keys agree
+	if err := circuit.OpenStream(1, "example.com", 80); err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	if err := circuit.WriteToStream(1, []byte("hello through three hops")); err != nil {
+		t.Fatalf("WriteToStream failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := circuit.ReadFromStream(ctx, 1)
+	if err != nil {
+		t.Fatalf("ReadFromStream failed: %v", err)
+	}
+	if string(data) != "hello through three hops" {
+		t.Errorf("Echoed data = %q", data)
+	}
+}
+
+func TestBuildCircuitFakeNetworkFlowControl(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+
+	circuit, err := builder.BuildCircuit(context.Background(), testPath, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+	if err := circuit.OpenStream(1, "example.com", 80); err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	// More cells than both the stream and circuit windows in each direction;
+	// the exit echoes them only while we acknowledge with valid SENDMEs
+	const cells = 1200
+	writeErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < cells; i++ {
+			if err := circuit.WriteToStream(1, []byte(fmt.Sprintf("cell %d", i))); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := 0; i < cells; i++ {
+		data, err := circuit.ReadFromStream(ctx, 1)
+		if err != nil {
+			t.Fatalf("ReadFromStream %d failed: %v", i, err)
+		}
+		if want := fmt.Sprintf("cell %d", i); string(data) != want {
+			t.Fatalf("Echoed data = %q, want %q", data, want)
+		}
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("WriteToStream failed: %v", err)
+	}
+
+	// Every SENDME from the exit authenticated a cell we sent
+	circuit.mu.RLock()
+	packageWindow, outstanding := circuit.packageWindow, len(circuit.sendmeDigests)
+	circuit.mu.RUnlock()
+	if packageWindow != CircuitWindowStart || outstanding != 0 {
+		t.Errorf("packageWindow = %d with %d digests outstanding", packageWindow, outstanding)
+	}
+
+	exit := network.Relays()[2]
+	deadline := time.Now().Add(5 * time.Second)
+	for exit.SendmeCount() < cells/CircuitWindowIncrement && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := exit.SendmeCount(); got != cells/CircuitWindowIncrement {
+		t.Errorf("Exit accepted %d authenticated SENDMEs, want %d", got, cells/CircuitWindowIncrement)
+	}
+	if circuit.GetState() != StateOpen {
+		t.Errorf("Circuit state = %s after transfer", circuit.GetState())
+	}
+}
+
+func TestBuildCircuitFakeNetworkCongestionControl(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+
+	var mu sync.Mutex
+	var updates []CongestionStats
+	params := DefaultCongestionParams()
+	builder.SetCongestionControl(&params, func(stats CongestionStats) {
+		mu.Lock()
+		updates = append(updates, stats)
+		mu.Unlock()
+	})
+
+	circuit, err := builder.BuildCircuit(context.Background(), testPath, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+
+	stats, ok := circuit.CongestionStats()
+	if !ok {
+		t.Fatal("Circuit did not negotiate congestion control")
+	}
+	if stats.SendmeInc != 31 || stats.Cwnd != params.CwndInit {
+		t.Errorf("Negotiated sendme_inc %d, cwnd %d", stats.SendmeInc, stats.Cwnd)
+	}
+	relays := network.Relays()
+	if relays[2].CongestionControlCount() != 1 || relays[0].CongestionControlCount()+relays[1].CongestionControlCount() != 0 {
+		t.Error("Congestion control must be negotiated with the exit only")
+	}
+
+	if err := circuit.OpenStream(1, "example.com", 80); err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	const cells = 1240
+	writeErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < cells; i++ {
+			if err := circuit.WriteToStream(1, []byte(fmt.Sprintf("cell %d", i))); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := 0; i < cells; i++ {
+		data, err := circuit.ReadFromStream(ctx, 1)
+		if err != nil {
+			t.Fatalf("ReadFromStream %d failed: %v", i, err)
+		}
+		if want := fmt.Sprintf("cell %d", i); string(data) != want {
+			t.Fatalf("Echoed data = %q, want %q", data, want)
+		}
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("WriteToStream failed: %v", err)
+	}
+
+	// Both directions acknowledge every sendme_inc cells, and each SENDME
+	// from the exit produced an RTT sample and a window update
+	deadline := time.Now().Add(5 * time.Second)
+	for relays[2].SendmeCount() < cells/31 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := relays[2].SendmeCount(); got != cells/31 {
+		t.Errorf("Exit accepted %d authenticated SENDMEs, want %d", got, cells/31)
+	}
+
+	// Streams have no windows of their own; the exit tears the circuit
+	// down if it gets a stream-level SENDME
+	circuit.mu.RLock()
+	streamWindows := len(circuit.streamWindows)
+	circuit.mu.RUnlock()
+	if streamWindows != 0 || circuit.GetState() != StateOpen {
+		t.Errorf("%d stream windows, circuit state %s after transfer", streamWindows, circuit.GetState())
+	}
+
+	stats, _ = circuit.CongestionStats()
+	if stats.Inflight != 0 || stats.RTT <= 0 || stats.MinRTT <= 0 {
+		t.Errorf("After transfer: inflight %d, RTT %v, min RTT %v", stats.Inflight, stats.RTT, stats.MinRTT)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(updates) != cells/31 {
+		t.Errorf("Observer saw %d updates, want %d", len(updates), cells/31)
+	}
+}
+
+func TestBuildCircuitFakeNetworkCongestionControlUnsupported(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	delete(testPath.Exit.Protocols, directory.ProtoFlowCtrl)
+
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+	params := DefaultCongestionParams()
+	builder.SetCongestionControl(&params, nil)
+
+	circuit, err := builder.BuildCircuit(context.Background(), testPath, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+
+	if _, ok := circuit.CongestionStats(); ok {
+		t.Error("Congestion control used with an exit lacking FlowCtrl=2")
+	}
+	if network.Relays()[2].CongestionControlCount() != 0 {
+		t.Error("Congestion control requested from an exit lacking FlowCtrl=2")
+	}
+}
+
+func TestBuildOneHopCircuitFakeNetwork(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+
+	circuit, err := builder.BuildOneHopCircuit(context.Background(), testPath.Guard, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildOneHopCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+
+	if circuit.Length() != 1 {
+		t.Fatalf("Expected 1 hop, got %d", circuit.Length())
+	}
+	hop := circuit.Hops[0]
+	if hop.ForwardCipher == nil || hop.BackwardCipher == nil || hop.ForwardDigest == nil || hop.BackwardDigest == nil {
+		t.Error("Hop has no crypto state")
+	}
+	guard := network.Relays()[0]
+	if guard.CreateFastCount() != 1 {
+		t.Errorf("Guard accepted %d CREATE_FAST circuits, want 1", guard.CreateFastCount())
+	}
+	if guard.HandshakeCount(uint16(HandshakeTypeNTor)) != 0 || guard.HandshakeCount(uint16(HandshakeTypeNTorV3)) != 0 {
+		t.Error("One-hop circuit used a CREATE2 handshake")
+	}
+
+	// The echo exit only answers if the KDF-TOR keys agree on both sides
+	if err := circuit.OpenStream(1, "example.com", 80); err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	if err := circuit.WriteToStream(1, []byte("hello over CREATE_FAST")); err != nil {
+		t.Fatalf("WriteToStream failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := circuit.ReadFromStream(ctx, 1)
+	if err != nil {
+		t.Fatalf("ReadFromStream failed: %v", err)
+	}
+	if string(data) != "hello over CREATE_FAST" {
+		t.Errorf("Echoed data = %q", data)
+	}
+}
+
+func TestBuildOneHopCircuitDirStream(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+
+	// Tunnelled directory requests run over a CREATE_FAST hop
+	circuit, err := builder.BuildOneHopCircuit(context.Background(), testPath.Guard, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildOneHopCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+	if guard := network.Relays()[0]; guard.CreateFastCount() != 1 {
+		t.Fatalf("Guard accepted %d CREATE_FAST circuits, want 1", guard.CreateFastCount())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := circuit.OpenDirStream(ctx, 1)
+	if err != nil {
+		t.Fatalf("OpenDirStream failed: %v", err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("GET /tor/status-vote/current/consensus HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	response, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	// The fake relay's directory service only serves onion service
+	// descriptors
+	if !strings.HasPrefix(string(response), "HTTP/1.0 404 ") {
+		t.Errorf("Directory response = %q, want 404", response)
+	}
+}
+
+func TestBuildCircuitFakeNetworkLinkPadding(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+	builder.SetConnectionPadding(&connection.PaddingParams{Low: 50 * time.Millisecond, High: 100 * time.Millisecond})
+
+	// One-hop directory circuits are never padded
+	oneHop, err := builder.BuildOneHopCircuit(context.Background(), testPath.Guard, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildOneHopCircuit failed: %v", err)
+	}
+	defer oneHop.Close()
+	guard := network.Relays()[0]
+	if negotiate := guard.LinkPaddingNegotiation(); negotiate != nil {
+		t.Fatalf("One-hop circuit negotiated link padding: %x", negotiate)
+	}
+
+	circuit, err := builder.BuildCircuit(context.Background(), testPath, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+
+	// The guard is asked to pad with our range: 50ms and 100ms
+	want := []byte{0, 2, 0, 50, 0, 100}
+	deadline := time.Now().Add(5 * time.Second)
+	for guard.LinkPaddingNegotiation() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if negotiate := guard.LinkPaddingNegotiation(); !bytes.Equal(negotiate, want) {
+		t.Fatalf("Guard PADDING_NEGOTIATE = %x, want %x", negotiate, want)
+	}
+
+	// An idle circuit keeps the guard connection busy with PADDING cells
+	for guard.LinkPaddingCount() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := guard.LinkPaddingCount(); n < 3 {
+		t.Errorf("Guard received %d PADDING cells, want at least 3", n)
+	}
+}
+
+func TestBuildCircuitFakeNetworkIdentityMismatch(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+
+	// The guard must prove the Ed25519 identity listed for it
+	testPath.Guard.IdentityKey = network.Relays()[1].Descriptor().IdentityKey
+
+	_, err := builder.BuildCircuit(context.Background(), testPath, 10*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "identity mismatch") {
+		t.Fatalf("Expected identity mismatch error, got %v", err)
+	}
+}
+
+func TestBuildCircuitFakeNetworkMixedHandshakes(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+
+	// A middle relay that does not list Relay=4 gets the original ntor handshake
+	testPath.Middle.Protocols = nil
+
+	circuit, err := builder.BuildCircuit(context.Background(), testPath, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+
+	relays := network.Relays()
+	if relays[0].HandshakeCount(uint16(HandshakeTypeNTorV3)) != 1 {
+		t.Error("Guard did not use ntor v3")
+	}
+	if relays[1].HandshakeCount(uint16(HandshakeTypeNTor)) != 1 {
+		t.Error("Middle did not use ntor")
+	}
+	if relays[2].HandshakeCount(uint16(HandshakeTypeNTorV3)) != 1 {
+		t.Error("Exit did not use ntor v3")
+	}
+
+	if err := circuit.OpenStream(1, "example.com", 80); err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"context"
 	"crypto/cipher"
 	"crypto/sha1" // #nosec G505 - SHA-1 required by Tor protocol (tor-spec.txt §6.1)
+	"crypto/sha3"
 	"crypto/subtle"
+	"encoding"
 	"encoding/binary"
 	"fmt"
 	"hash"
 	"io"
+	"math/rand/v2"
 	"sync"
 	"time"
 
@@ -64,13 +67,31 @@ type Circuit struct {
 	forwardDigest  hash.Hash // Client → Exit direction
 	backwardDigest hash.Hash // Exit → Client direction
 	// Stream protocol support
-	relayReceiveChan chan *cell.RelayCell // Channel for receiving relay cells
-	streamManager    interface{}          // Stream manager (interface{} to avoid circular import)
+	relayReceiveChan   chan *cell.RelayCell // Channel for receiving relay cells
+	controlReceiveChan chan *cell.Cell      // Channel for CREATED2 and DESTROY cells
+	streamManager      interface{}          // Stream manager (interface{} to avoid circular import)
 	// Flow control per tor-spec.txt §7.4
-	packageWindow  int // Circuit-level package window (cells we can send)
-	deliverWindow  int // Circuit-level deliver window (cells we can receive)
-	sendmeReceived int // Count of DATA cells received (for sending SENDME)
-	sendmeSent     int // Count of SENDME cells sent
+	packageWindow  int                      // Circuit-level package window (cells we can send)
+	deliverWindow  int                      // Circuit-level deliver window (cells we can receive)
+	sendmeReceived int                      // Count of DATA cells received (for sending SENDME)
+	sendmeSent     int                      // Count of SENDME cells sent
+	sendmeDigests  [][]byte                 // prop289: digests of sent cells awaiting an authenticated SENDME
+	sendmeQueue    [][]byte                 // Digests to echo in SENDMEs we still have to send, in order
+	sendmeFlushing bool                     // Whether a goroutine is sending queued SENDMEs
+	dataSent       int                      // DATA cells sent since the last one a SENDME will acknowledge
+	windowOpened   chan struct{}            // Closed and replaced when a SENDME reopens the package window
+	streamWindows  map[uint16]*StreamWindow // Stream-level windows by stream ID
+	sendMu         sync.Mutex               // Serializes digest, encryption and sending of relay cells
+	done           chan struct{}            // Closed when the circuit is closed or fails
+	// Congestion control per prop324 (nil when the circuit uses fixed windows)
+	cc         *vegas
+	ccObserver func(CongestionStats) // Called after each congestion window update
+	// Padding machines per padding-spec.txt, by machine index
+	paddingMu       sync.Mutex
+	paddingMachines [PaddingMachineSlots]*paddingMachine
+	paddingCounter  uint32     // machine_ctr of the last machine started
+	paddingClock    Clock      // Time source for padding timers (system clock if nil)
+	paddingRand     *rand.Rand // Random source for padding delays and lengths
 	// SECURITY-001: Replay protection per tor-spec.txt
 	replayProtection *cell.ReplayProtection // Replay protection for cells
 }
@@ -88,6 +109,8 @@ type Hop struct {
 	BackwardCipher cipher.Stream // AES-CTR cipher for decrypting cells (relay→client)
 	ForwardDigest  hash.Hash     // SHA-1 running digest for forward direction
 	BackwardDigest hash.Hash     // SHA-1 running digest for backward direction
+
+	nonce []byte // KH from the handshake with this hop, if known
 }
 
 // NewHop creates a new hop with the given parameters
@@ -113,25 +136,29 @@ func (h *Hop) SetCryptoState(forwardCipher, backwardCipher cipher.Stream, forwar
 func NewCircuit(id uint32) *Circuit {
 	now := time.Now()
 	return &Circuit{
-		ID:               id,
-		State:            StateBuilding,
-		CreatedAt:        now,
-		Hops:             make([]*Hop, 0, 3),             // Typical circuit has 3 hops
-		IsolationKey:     nil,                            // No isolation by default (backward compatible)
-		conn:             nil,                            // Connection set later
-		paddingEnabled:   true,                           // SPEC-002: Enable padding by default
-		paddingInterval:  5 * time.Second,                // SPEC-002: Default 5-second padding interval
-		lastPaddingTime:  now,                            // SPEC-002: Initialize padding timer
-		lastActivityTime: now,                            // SPEC-002: Initialize activity timer
-		forwardDigest:    sha1.New(),                     // CRYPTO-001: Initialize forward digest
-		backwardDigest:   sha1.New(),                     // CRYPTO-001: Initialize backward digest
-		relayReceiveChan: make(chan *cell.RelayCell, 32), // Buffer for incoming relay cells
-		streamManager:    nil,                            // Stream manager set later
-		packageWindow:    1000,                           // tor-spec.txt §7.4: Initial circuit window is 1000
-		deliverWindow:    1000,                           // tor-spec.txt §7.4: Initial circuit window is 1000
-		sendmeReceived:   0,                              // No DATA cells received yet
-		sendmeSent:       0,                              // No SENDME cells sent yet
-		replayProtection: cell.NewReplayProtection(),     // SECURITY-001: Initialize replay protection
+		ID:                 id,
+		State:              StateBuilding,
+		CreatedAt:          now,
+		Hops:               make([]*Hop, 0, 3),             // Typical circuit has 3 hops
+		IsolationKey:       nil,                            // No isolation by default (backward compatible)
+		conn:               nil,                            // Connection set later
+		paddingEnabled:     true,                           // SPEC-002: Enable padding by default
+		paddingInterval:    5 * time.Second,                // SPEC-002: Default 5-second padding interval
+		lastPaddingTime:    now,                            // SPEC-002: Initialize padding timer
+		lastActivityTime:   now,                            // SPEC-002: Initialize activity timer
+		forwardDigest:      sha1.New(),                     // CRYPTO-001: Initialize forward digest
+		backwardDigest:     sha1.New(),                     // CRYPTO-001: Initialize backward digest
+		relayReceiveChan:   make(chan *cell.RelayCell, 32), // Buffer for incoming relay cells
+		controlReceiveChan: make(chan *cell.Cell, 4),       // Buffer for CREATED2/DESTROY cells
+		streamManager:      nil,                            // Stream manager set later
+		packageWindow:      CircuitWindowStart,             // tor-spec.txt §7.4: Initial circuit window is 1000
+		deliverWindow:      CircuitWindowStart,             // tor-spec.txt §7.4: Initial circuit window is 1000
+		sendmeReceived:     0,                              // No DATA cells received yet
+		sendmeSent:         0,                              // No SENDME cells sent yet
+		replayProtection:   cell.NewReplayProtection(),     // SECURITY-001: Initialize replay protection
+		windowOpened:       make(chan struct{}),
+		streamWindows:      make(map[uint16]*StreamWindow), // Stream windows are created when streams open
+		done:               make(chan struct{}),
 	}
 }
 
@@ -169,6 +196,18 @@ func (c *Circuit) Length() int {
 	return len(c.Hops)
 }
 
+// LastHopNonce returns KH from the handshake with the last hop. Onion
+// service cells such as ESTABLISH_INTRO authenticate it to that relay
+// (rend-spec-v3.txt section 3.1.1).
+func (c *Circuit) LastHopNonce() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.Hops) == 0 || c.Hops[len(c.Hops)-1].nonce == nil {
+		return nil, fmt.Errorf("circuit %d has no handshake nonce for its last hop", c.ID)
+	}
+	return append([]byte(nil), c.Hops[len(c.Hops)-1].nonce...), nil
+}
+
 // IsReady returns true if the circuit is ready for use
 func (c *Circuit) IsReady() bool {
 	return c.GetState() == StateOpen
@@ -251,9 +290,8 @@ func (m *Manager) CloseCircuit(id uint32) error {
 		return fmt.Errorf("circuit %d not found", id)
 	}
 
-	circuit.SetState(StateClosed)
 	delete(m.circuits, id)
-	return nil
+	return circuit.Close()
 }
 
 // ListCircuits returns a list of all circuit IDs
@@ -287,13 +325,16 @@ func (m *Manager) Close(ctx context.Context) error {
 	// Mark as closed to prevent new circuits
 	m.closed = true
 
-	// Close all circuits
+	// Close all circuits and the connections they own
+	var firstErr error
 	for id, circuit := range m.circuits {
-		circuit.SetState(StateClosed)
+		if err := circuit.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 		delete(m.circuits, id)
 	}
 
-	return nil
+	return firstErr
 }
 
 // IsClosed returns true if the manager has been closed
@@ -510,6 +551,72 @@ func (c *Circuit) SetConnection(conn interface{}) {
 	c.conn = conn
 }
 
+// Close marks the circuit closed and closes its connection, if the circuit
+// owns one (as circuits from Builder.BuildOneHopCircuit do)
+func (c *Circuit) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	c.shutdown(StateClosed)
+
+	if closer, ok := conn.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("failed to close circuit connection: %w", err)
+		}
+	}
+	return nil
+}
+
+// shutdown moves the circuit to a final state and releases writers blocked
+// on flow control
+func (c *Circuit) shutdown(state State) {
+	c.stopPaddingMachines()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.State = state
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+}
+
+// Done returns a channel that is closed when the circuit is closed or fails
+func (c *Circuit) Done() <-chan struct{} {
+	return c.doneChan()
+}
+
+// doneChan returns a channel that is closed when the circuit shuts down
+func (c *Circuit) doneChan() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	return c.done
+}
+
+// destroy sends DESTROY with the given reason and fails the circuit. It is
+// used when a relay violates the protocol (tor-spec.txt §5.4).
+func (c *Circuit) destroy(reason byte) {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if sender, ok := conn.(cellSender); ok {
+		_ = sender.SendCell(&cell.Cell{CircID: c.ID, Command: cell.CmdDestroy, Payload: []byte{reason}})
+	}
+	c.shutdown(StateFailed)
+}
+
 // SetStreamManager sets the stream manager for this circuit
 // mgr should be a *stream.Manager, but we use interface{} to avoid circular imports
 func (c *Circuit) SetStreamManager(mgr interface{}) {
@@ -521,11 +628,8 @@ func (c *Circuit) SetStreamManager(mgr interface{}) {
 // encryptForward encrypts a relay cell payload with each hop's forward cipher
 // This implements the onion encryption per tor-spec.txt §6.1
 // The payload is encrypted in ORDER (guard -> middle -> exit) so the exit node decrypts last
-func (c *Circuit) encryptForward(payload []byte) []byte {
-	c.mu.RLock()
-	hops := c.Hops
-	c.mu.RUnlock()
-
+// Only the given hops are used, so a cell can be addressed to an intermediate hop.
+func (c *Circuit) encryptForward(payload []byte, hops []*Hop) []byte {
 	// Make a copy to avoid modifying the original
 	encrypted := make([]byte, len(payload))
 	copy(encrypted, payload)
@@ -543,28 +647,92 @@ func (c *Circuit) encryptForward(payload []byte) []byte {
 	return encrypted
 }
 
-// decryptBackward decrypts a relay cell payload from the circuit
-// This implements the onion decryption per tor-spec.txt §6.1
-// The payload is decrypted in REVERSE order (exit -> middle -> guard)
-func (c *Circuit) decryptBackward(payload []byte) []byte {
+// decryptBackward removes onion layers from a relay cell received on the
+// circuit, per tor-spec.txt §6.1. Layers are peeled in order (guard -> middle
+// -> exit) and after each one the cell is checked for recognition by that hop,
+// so that cells originating at an intermediate hop do not advance the ciphers
+// of hops beyond it. Returns the decrypted payload and the index of the hop
+// that recognized it, or -1 if no hop did.
+func (c *Circuit) decryptBackward(payload []byte) ([]byte, int, error) {
 	c.mu.RLock()
 	hops := c.Hops
 	c.mu.RUnlock()
 
+	if len(payload) < cell.RelayCellHeaderLen {
+		return nil, -1, fmt.Errorf("relay cell payload too short: %d < %d", len(payload), cell.RelayCellHeaderLen)
+	}
+
 	// Make a copy to avoid modifying the original
 	decrypted := make([]byte, len(payload))
 	copy(decrypted, payload)
 
-	// Decrypt with each hop's cipher in reverse order (exit -> middle -> guard)
-	// We receive the cell from the guard, which is the last to encrypt (first to decrypt)
-	for _, hop := range hops {
-		if hop.BackwardCipher != nil {
-			// XOR with the cipher stream (AES-CTR decryption)
-			hop.BackwardCipher.XORKeyStream(decrypted, decrypted)
+	for hopIdx, hop := range hops {
+		if hop.BackwardCipher == nil {
+			continue
+		}
+		// XOR with the cipher stream (AES-CTR decryption)
+		hop.BackwardCipher.XORKeyStream(decrypted, decrypted)
+
+		recognized, err := hopRecognizes(hop, decrypted)
+		if err != nil {
+			return nil, -1, err
 		}
+		if recognized {
+			return decrypted, hopIdx, nil
+		}
+	}
+
+	return decrypted, -1, nil
+}
+
+// hopRecognizes reports whether a decrypted relay cell payload originated at
+// hop: its "recognized" field is zero and its digest matches the hop's running
+// backward digest. The digest is only advanced when the cell is recognized.
+func hopRecognizes(hop *Hop, payload []byte) (bool, error) {
+	if hop.BackwardDigest == nil || binary.BigEndian.Uint16(payload[1:3]) != 0 {
+		return false, nil
+	}
+
+	candidate, err := cloneDigest(hop.BackwardDigest)
+	if err != nil {
+		return false, err
 	}
 
-	return decrypted
+	cellCopy := make([]byte, len(payload))
+	copy(cellCopy, payload)
+	cellCopy[5], cellCopy[6], cellCopy[7], cellCopy[8] = 0, 0, 0, 0
+	candidate.Write(cellCopy)
+
+	if subtle.ConstantTimeCompare(candidate.Sum(nil)[:4], payload[5:9]) != 1 {
+		return false, nil
+	}
+
+	hop.BackwardDigest = candidate
+	return true, nil
+}
+
+// cloneDigest returns an independent copy of a running digest
+func cloneDigest(h hash.Hash) (hash.Hash, error) {
+	marshaler, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("digest state cannot be copied")
+	}
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy digest state: %w", err)
+	}
+	// Relay digests are SHA-1 (tor-spec.txt §6.1), or SHA3-256 for the
+	// virtual hop to an onion service (rend-spec-v3.txt §4.2)
+	var clone hash.Hash
+	if _, ok := h.(*sha3.SHA3); ok {
+		clone = sha3.New256()
+	} else {
+		clone = sha1.New() // #nosec G401
+	}
+	if err := clone.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("failed to copy digest state: %w", err)
+	}
+	return clone, nil
 }
 
 // updateHopDigests updates the per-hop running digests for a relay cell
@@ -610,149 +778,313 @@ func (c *Circuit) updateHopDigests(direction Direction, payload []byte) error {
 	return nil
 }
 
-// verifyRelayCellDigest verifies the digest of an incoming relay cell
-// Returns the hop index that recognized the cell, or -1 if unrecognized
-func (c *Circuit) verifyRelayCellDigest(payload []byte) (int, error) {
-	c.mu.RLock()
-	hops := c.Hops
-	c.mu.RUnlock()
+// acquirePackageWindow takes one DATA cell from the circuit package window,
+// or from the congestion window when congestion control is in use. While the
+// window is exhausted it waits for a SENDME, failing if the circuit closes.
+func (c *Circuit) acquirePackageWindow() error {
+	for {
+		c.mu.Lock()
+		if c.cc != nil && c.cc.canSend() {
+			c.cc.inflight++
+			c.mu.Unlock()
+			return nil
+		}
+		if c.cc == nil && c.packageWindow > 0 {
+			c.packageWindow--
+			c.mu.Unlock()
+			return nil
+		}
+		if c.windowOpened == nil {
+			c.windowOpened = make(chan struct{})
+		}
+		opened := c.windowOpened
+		c.mu.Unlock()
 
-	if len(payload) < 11 {
-		return -1, fmt.Errorf("relay cell payload too short: %d < 11", len(payload))
+		select {
+		case <-opened:
+		case <-c.doneChan():
+			return fmt.Errorf("circuit closed while waiting for SENDME")
+		}
 	}
+}
 
-	// Extract the digest from the cell (bytes 5-8)
-	var cellDigest [4]byte
-	copy(cellDigest[:], payload[5:9])
+// countSentData accounts for a DATA cell about to be sent and reports
+// whether it completes a window increment, so that the relay's SENDME must
+// echo its digest. With congestion control the send time is kept for the
+// RTT measurement.
+func (c *Circuit) countSentData() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Check if this cell is recognized by any hop
-	// A cell is "recognized" if:
-	// 1. The digest matches the hop's running backward digest
-	// 2. The "recognized" field is zero (bytes 1-2)
+	increment := CircuitWindowIncrement
+	if c.cc != nil {
+		increment = c.cc.params.SendmeInc
+	}
+	c.dataSent++
+	if c.dataSent < increment {
+		return false
+	}
+	c.dataSent = 0
+	if c.cc != nil {
+		c.cc.recordSend(time.Now())
+	}
+	return true
+}
 
-	recognized := binary.BigEndian.Uint16(payload[1:3])
+// recordSendmeDigest remembers the digest of a sent cell that the relay will
+// acknowledge with an authenticated SENDME (prop289)
+func (c *Circuit) recordSendmeDigest(digest []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendmeDigests = append(c.sendmeDigests, append([]byte(nil), digest[:sendmeDigestLen]...))
+}
 
-	// Try each hop to see which one recognizes this cell
-	for hopIdx, hop := range hops {
-		if hop.BackwardDigest == nil {
-			continue
-		}
+// handleCircuitSendme validates a circuit-level SENDME against the oldest
+// recorded cell digest and reopens the package window. With congestion
+// control the SENDME also yields an RTT sample for the Vegas update.
+func (c *Circuit) handleCircuitSendme(data []byte) error {
+	c.mu.Lock()
 
-		// Compute expected digest for this hop
-		// Create a copy with digest zeroed
-		cellCopy := make([]byte, len(payload))
-		copy(cellCopy, payload)
-		cellCopy[5] = 0
-		cellCopy[6] = 0
-		cellCopy[7] = 0
-		cellCopy[8] = 0
-
-		// Get the current digest state (without modifying it)
-		expectedSum := hop.BackwardDigest.Sum(nil)
-		expected := [4]byte{expectedSum[0], expectedSum[1], expectedSum[2], expectedSum[3]}
-
-		// Check if digest matches AND recognized field is zero
-		if subtle.ConstantTimeCompare(expected[:], cellDigest[:]) == 1 && recognized == 0 {
-			// This hop recognizes the cell
-			// Now update the digest with this cell
-			if _, err := hop.BackwardDigest.Write(cellCopy); err != nil {
-				return -1, fmt.Errorf("failed to update backward digest: %w", err)
-			}
-			return hopIdx, nil
+	if len(c.sendmeDigests) == 0 {
+		c.mu.Unlock()
+		return fmt.Errorf("unexpected SENDME: no cells awaiting acknowledgement")
+	}
+	expected := c.sendmeDigests[0]
+	c.sendmeDigests = c.sendmeDigests[1:]
+
+	digest, err := parseSendme(data)
+	if err == nil {
+		err = verifySendmeDigest(expected, digest)
+	}
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	var observer func(CongestionStats)
+	var stats CongestionStats
+	if c.cc != nil {
+		if err := c.cc.onSendme(time.Now()); err != nil {
+			c.mu.Unlock()
+			return err
 		}
+		observer, stats = c.ccObserver, c.cc.stats()
+	} else {
+		// Per tor-spec.txt §7.4, each SENDME increments the window by 100
+		c.packageWindow += CircuitWindowIncrement
 	}
 
-	// No hop recognized this cell - might be for a stream we don't have
-	// or an error condition
-	return -1, nil
+	if c.windowOpened != nil {
+		close(c.windowOpened)
+	}
+	c.windowOpened = make(chan struct{})
+	c.mu.Unlock()
+
+	if observer != nil {
+		observer(stats)
+	}
+	return nil
 }
 
-// decrementPackageWindow decrements the circuit-level package window
-// Returns an error if the window is exhausted
-func (c *Circuit) decrementPackageWindow() error {
+// decrementDeliverWindow decrements the circuit-level deliver window.
+// Returns an error if the window is exhausted, and true once every 100 cells
+// when a SENDME is due; the deliver window is credited at that point. With
+// congestion control the deliver window is not enforced and a SENDME is due
+// every SENDME increment.
+func (c *Circuit) decrementDeliverWindow() (bool, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.packageWindow <= 0 {
-		return fmt.Errorf("package window exhausted: cannot send more cells until SENDME received")
+	if c.cc != nil {
+		c.sendmeReceived++
+		if c.sendmeReceived < c.cc.params.SendmeInc {
+			return false, nil
+		}
+		c.sendmeReceived = 0
+		c.sendmeSent++
+		return true, nil
 	}
 
-	c.packageWindow--
-	return nil
+	if c.deliverWindow <= 0 {
+		return false, fmt.Errorf("deliver window exhausted: cannot receive more cells until SENDME sent")
+	}
+
+	c.deliverWindow--
+	c.sendmeReceived++
+
+	// Per tor-spec.txt §7.4, send SENDME every 100 cells received
+	if c.sendmeReceived < CircuitWindowIncrement {
+		return false, nil
+	}
+	c.sendmeReceived = 0
+	c.sendmeSent++
+	c.deliverWindow += CircuitWindowIncrement
+	return true, nil
 }
 
-// incrementPackageWindow increments the circuit-level package window
-// This is called when we receive a SENDME cell
-func (c *Circuit) incrementPackageWindow() {
+// enableCongestionControl switches the circuit from fixed windows to Tor
+// Vegas after the exit accepted congestion control. It must be called before
+// any data is sent.
+func (c *Circuit) enableCongestionControl(params CongestionParams, observer func(CongestionStats)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.cc = newVegas(params)
+	c.ccObserver = observer
+}
+
+// CongestionStats returns the circuit's congestion control state, or false
+// if the circuit uses fixed windows
+func (c *Circuit) CongestionStats() (CongestionStats, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cc == nil {
+		return CongestionStats{}, false
+	}
+	return c.cc.stats(), true
+}
 
-	// Per tor-spec.txt §7.4, each SENDME increments the window by 100
-	c.packageWindow += 100
+// sendCircuitSendme sends an authenticated circuit-level SENDME echoing the
+// digest of the cell that completed the window increment
+func (c *Circuit) sendCircuitSendme(digest []byte) error {
+	// Send SENDME cell (stream ID 0 indicates circuit-level)
+	sendmeCell := cell.NewRelayCell(0, cell.RelaySendme, encodeSendmeV1(digest))
+	return c.SendRelayCell(sendmeCell)
 }
 
-// decrementDeliverWindow decrements the circuit-level deliver window
-// Returns an error if the window is exhausted
-func (c *Circuit) decrementDeliverWindow() error {
+// queueCircuitSendme queues an authenticated SENDME and makes sure a
+// goroutine is sending the queue. SENDMEs must reach the relay in the order
+// their digests were taken, so they are sent one at a time.
+func (c *Circuit) queueCircuitSendme(digest []byte) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.deliverWindow <= 0 {
-		return fmt.Errorf("deliver window exhausted: cannot receive more cells until SENDME sent")
+	c.sendmeQueue = append(c.sendmeQueue, digest)
+	if !c.sendmeFlushing {
+		c.sendmeFlushing = true
+		go c.flushCircuitSendmes()
 	}
+}
 
-	c.deliverWindow--
-	c.sendmeReceived++
+// flushCircuitSendmes sends queued SENDMEs until the queue is empty
+func (c *Circuit) flushCircuitSendmes() {
+	for {
+		c.mu.Lock()
+		if len(c.sendmeQueue) == 0 {
+			c.sendmeFlushing = false
+			c.mu.Unlock()
+			return
+		}
+		digest := c.sendmeQueue[0]
+		c.sendmeQueue = c.sendmeQueue[1:]
+		c.mu.Unlock()
 
-	return nil
+		// A failed send only stalls the relay's window, so don't fail the
+		// delivery that queued it
+		_ = c.sendCircuitSendme(digest)
+	}
 }
 
-// shouldSendCircuitSendme checks if we should send a circuit-level SENDME
-// Per tor-spec.txt §7.4, send SENDME every 100 cells received
-func (c *Circuit) shouldSendCircuitSendme() bool {
+// usesCongestionControl reports whether the circuit runs Tor Vegas, which
+// replaces stream windows and stream-level SENDMEs (prop324 §4)
+func (c *Circuit) usesCongestionControl() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-
-	return c.sendmeReceived >= 100
+	return c.cc != nil
 }
 
-// sendCircuitSendme sends a circuit-level SENDME cell
-func (c *Circuit) sendCircuitSendme() error {
+// streamWindow returns the flow control windows for a stream, creating them
+// on first use
+func (c *Circuit) streamWindow(streamID uint16) *StreamWindow {
 	c.mu.Lock()
-	c.sendmeReceived = 0
-	c.sendmeSent++
-	c.deliverWindow += 100 // Increment our deliver window
-	c.mu.Unlock()
+	defer c.mu.Unlock()
 
-	// Send SENDME cell (stream ID 0 indicates circuit-level)
-	sendmeCell := cell.NewRelayCell(0, cell.RelaySendme, []byte{})
-	return c.SendRelayCell(sendmeCell)
+	if c.streamWindows == nil {
+		c.streamWindows = make(map[uint16]*StreamWindow)
+	}
+	window, ok := c.streamWindows[streamID]
+	if !ok {
+		window = NewStreamWindow()
+		c.streamWindows[streamID] = window
+	}
+	return window
+}
+
+// removeStreamWindow forgets the windows of a closed stream
+func (c *Circuit) removeStreamWindow(streamID uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streamWindows, streamID)
 }
 
 // SendRelayCell sends a relay cell through the circuit
 // This encrypts the relay cell with per-hop cryptography and sends it through the connection
 func (c *Circuit) SendRelayCell(relayCell *cell.RelayCell) error {
-	// Check flow control for DATA cells
-	// Per tor-spec.txt §7.4, only DATA cells count against the package window
+	if state := c.GetState(); state != StateOpen {
+		return fmt.Errorf("circuit not open: state=%s", state)
+	}
+
+	return c.sendRelayCell(relayCell, cell.CmdRelay)
+}
+
+// sendRelayEarly sends a relay cell in a RELAY_EARLY cell, as required for
+// EXTEND2 (tor-spec.txt §5.6). Unlike SendRelayCell it may be used while the
+// circuit is still being built.
+func (c *Circuit) sendRelayEarly(relayCell *cell.RelayCell) error {
+	return c.sendRelayCell(relayCell, cell.CmdRelayEarly)
+}
+
+// cellSender is implemented by the connection a circuit sends cells on
+type cellSender interface {
+	SendCell(*cell.Cell) error
+}
+
+// sendRelayCell sends a relay cell to the last hop with the given command
+// (RELAY or RELAY_EARLY) and reports it to the padding machines
+func (c *Circuit) sendRelayCell(relayCell *cell.RelayCell, command cell.Command) error {
+	if err := c.sendRelayCellToHop(relayCell, command, -1); err != nil {
+		return err
+	}
+	if relayCell.Command != cell.RelayDrop && relayCell.Command != cell.RelayPaddingNegotiate {
+		c.paddingEvent(PaddingEventNonPaddingSent, -1)
+	}
+	return nil
+}
+
+// sendRelayCellToHop computes the digest for the hop at index target (the
+// last hop if target is negative), applies the onion layers up to that hop
+// and sends the cell with the given command. DATA cells are charged to the
+// circuit package window, waiting for a SENDME while it is exhausted.
+func (c *Circuit) sendRelayCellToHop(relayCell *cell.RelayCell, command cell.Command, target int) error {
+	// Wait for window space before taking sendMu, so that SENDMEs for the
+	// other direction can still go out while DATA cells are held back
 	if relayCell.Command == cell.RelayData {
-		if err := c.decrementPackageWindow(); err != nil {
+		if err := c.acquirePackageWindow(); err != nil {
 			return fmt.Errorf("flow control: %w", err)
 		}
 	}
 
+	// The digest, cipher and SENDME bookkeeping must follow the order in
+	// which cells go out on the connection
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	// Per tor-spec.txt §7.4, only DATA cells count against the package window
+	recordDigest := relayCell.Command == cell.RelayData && c.countSentData()
+
 	c.mu.Lock()
 	conn := c.conn
-	state := c.State
 	hops := c.Hops
 	c.mu.Unlock()
 
-	if state != StateOpen {
-		return fmt.Errorf("circuit not open: state=%s", state)
-	}
-
 	if conn == nil {
 		return fmt.Errorf("circuit has no connection")
 	}
+	if target >= len(hops) {
+		return fmt.Errorf("no hop %d in a %d-hop circuit", target, len(hops))
+	}
+	if target >= 0 {
+		hops = hops[:target+1]
+	}
 
 	// Encode the relay cell (digest field will be zeroed initially)
 	payload, err := relayCell.Encode()
@@ -760,11 +1092,11 @@ func (c *Circuit) SendRelayCell(relayCell *cell.RelayCell) error {
 		return fmt.Errorf("failed to encode relay cell: %w", err)
 	}
 
-	// Compute the digest for the exit hop (last hop in the circuit)
+	// Compute the digest for the target hop (by default the exit)
 	// Per tor-spec.txt §6.1, each hop maintains its own running digest
 	if len(hops) > 0 {
-		exitHop := hops[len(hops)-1]
-		if exitHop.ForwardDigest != nil {
+		targetHop := hops[len(hops)-1]
+		if targetHop.ForwardDigest != nil {
 			// Create a copy with digest zeroed for digest computation
 			cellCopy := make([]byte, len(payload))
 			copy(cellCopy, payload)
@@ -773,35 +1105,36 @@ func (c *Circuit) SendRelayCell(relayCell *cell.RelayCell) error {
 			cellCopy[7] = 0
 			cellCopy[8] = 0
 
-			// Update the exit hop's forward digest
-			if _, err := exitHop.ForwardDigest.Write(cellCopy); err != nil {
+			// Update the target hop's forward digest
+			if _, err := targetHop.ForwardDigest.Write(cellCopy); err != nil {
 				return fmt.Errorf("failed to update forward digest: %w", err)
 			}
 
 			// Get the digest and set it in the payload
-			digestSum := exitHop.ForwardDigest.Sum(nil)
+			digestSum := targetHop.ForwardDigest.Sum(nil)
 			payload[5] = digestSum[0]
 			payload[6] = digestSum[1]
 			payload[7] = digestSum[2]
 			payload[8] = digestSum[3]
+
+			if recordDigest {
+				c.recordSendmeDigest(digestSum)
+			}
 		}
 	}
 
 	// Encrypt the payload with per-hop cryptography (onion encryption)
 	// Each hop will decrypt one layer
-	encryptedPayload := c.encryptForward(payload)
+	encryptedPayload := c.encryptForward(payload, hops)
 
-	// Create a RELAY cell with the encrypted payload
+	// Create a RELAY or RELAY_EARLY cell with the encrypted payload
 	cellToSend := &cell.Cell{
 		CircID:  c.ID,
-		Command: cell.CmdRelay,
+		Command: command,
 		Payload: encryptedPayload,
 	}
 
 	// Send through connection (type assert to interface with SendCell method)
-	type cellSender interface {
-		SendCell(*cell.Cell) error
-	}
 	sender, ok := conn.(cellSender)
 	if !ok {
 		return fmt.Errorf("connection does not support SendCell")
@@ -842,9 +1175,12 @@ func (c *Circuit) DeliverRelayCell(cellData *cell.Cell) error {
 		return fmt.Errorf("circuit ID mismatch: expected %d, got %d", c.ID, cellData.CircID)
 	}
 
-	// Decrypt the relay cell with per-hop cryptography (onion decryption)
-	// Each hop decrypts one layer
-	decryptedPayload := c.decryptBackward(cellData.Payload)
+	// Decrypt the relay cell with per-hop cryptography (onion decryption),
+	// stopping at the hop that recognizes it
+	decryptedPayload, hopIdx, err := c.decryptBackward(cellData.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt relay cell: %w", err)
+	}
 
 	// SECURITY-001: Validate against replay attacks before processing
 	// We check the decrypted payload to ensure the same cell content isn't replayed
@@ -855,12 +1191,6 @@ func (c *Circuit) DeliverRelayCell(cellData *cell.Cell) error {
 		}
 	}
 
-	// Verify which hop recognizes this cell
-	hopIdx, err := c.verifyRelayCellDigest(decryptedPayload)
-	if err != nil {
-		return fmt.Errorf("failed to verify relay cell digest: %w", err)
-	}
-
 	if hopIdx < 0 {
 		// Cell not recognized by any hop
 		// This might be a cell for a different stream or an error
@@ -875,35 +1205,55 @@ func (c *Circuit) DeliverRelayCell(cellData *cell.Cell) error {
 		return fmt.Errorf("failed to decode relay cell: %w", err)
 	}
 
+	// Padding and padding negotiation are consumed here (padding-spec.txt §3)
+	switch relayCell.Command {
+	case cell.RelayDrop:
+		c.paddingEvent(PaddingEventPaddingRecv, hopIdx)
+		return nil
+	case cell.RelayPaddingNegotiated:
+		return c.handlePaddingNegotiated(relayCell.Data)
+	}
+	c.paddingEvent(PaddingEventNonPaddingRecv, hopIdx)
+
 	// Handle flow control per tor-spec.txt §7.4
 	switch relayCell.Command {
 	case cell.RelayData:
 		// DATA cells count against our deliver window
-		if err := c.decrementDeliverWindow(); err != nil {
+		sendmeDue, err := c.decrementDeliverWindow()
+		if err != nil {
 			return fmt.Errorf("flow control: %w", err)
 		}
 
-		// Check if we should send a SENDME
-		if c.shouldSendCircuitSendme() {
+		if sendmeDue {
+			// The SENDME echoes the running digest including this cell (prop289)
+			c.mu.RLock()
+			digest := c.Hops[hopIdx].BackwardDigest.Sum(nil)
+			c.mu.RUnlock()
+
 			// Send SENDME in background to avoid blocking
-			go func() {
-				if err := c.sendCircuitSendme(); err != nil {
-					// Log error but don't fail the delivery
-					// (in production, should have proper logging)
-				}
-			}()
+			c.queueCircuitSendme(digest)
 		}
 
 	case cell.RelaySendme:
-		// SENDME cell increments our package window
+		// Don't deliver SENDME cells to the application layer
 		if relayCell.StreamID == 0 {
-			// Circuit-level SENDME
-			c.incrementPackageWindow()
-			// Don't deliver SENDME cells to the application layer
+			// Circuit-level SENDME must authenticate the acknowledged cell;
+			// a relay that fails to do so is torn down (prop289)
+			if err := c.handleCircuitSendme(relayCell.Data); err != nil {
+				c.destroy(destroyReasonProtocol)
+				return fmt.Errorf("flow control: %w", err)
+			}
+			return nil
+		}
+		// Stream-level SENDME reopens the stream's package window; with
+		// congestion control there are no stream windows to reopen
+		if c.usesCongestionControl() {
 			return nil
 		}
-		// Stream-level SENDME - deliver to stream manager
-		// (handled below)
+		if err := c.streamWindow(relayCell.StreamID).Sendme(); err != nil {
+			return fmt.Errorf("flow control: %w", err)
+		}
+		return nil
 	}
 
 	// Record activity
@@ -918,6 +1268,31 @@ func (c *Circuit) DeliverRelayCell(cellData *cell.Cell) error {
 	}
 }
 
+// DeliverControlCell delivers a non-relay cell addressed to this circuit,
+// such as CREATED2, CREATED_FAST or DESTROY (called by connection layer)
+func (c *Circuit) DeliverControlCell(cellData *cell.Cell) error {
+	if cellData.CircID != c.ID {
+		return fmt.Errorf("circuit ID mismatch: expected %d, got %d", c.ID, cellData.CircID)
+	}
+
+	select {
+	case c.controlReceiveChan <- cellData:
+		return nil
+	case <-time.After(100 * time.Millisecond):
+		return fmt.Errorf("control receive channel full or blocked")
+	}
+}
+
+// receiveControlCell waits for the next non-relay cell on this circuit
+func (c *Circuit) receiveControlCell(ctx context.Context) (*cell.Cell, error) {
+	select {
+	case controlCell := <-c.controlReceiveChan:
+		return controlCell, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // OpenStream opens a new stream on this circuit
 // This is a convenience method that integrates with the stream manager
 func (c *Circuit) OpenStream(streamID uint16, target string, port uint16) error {
@@ -981,8 +1356,12 @@ func (c *Circuit) ReadFromStream(ctx context.Context, streamID uint16) ([]byte,
 
 		switch relayCell.Command {
 		case cell.RelayData:
+			if err := c.AcknowledgeStreamData(streamID); err != nil {
+				return nil, err
+			}
 			return relayCell.Data, nil
 		case cell.RelayEnd:
+			c.ReleaseStream(streamID)
 			return nil, io.EOF
 		default:
 			// Unexpected command for this stream
@@ -991,15 +1370,58 @@ func (c *Circuit) ReadFromStream(ctx context.Context, streamID uint16) ([]byte,
 	}
 }
 
+// AcknowledgeStreamData counts a RELAY_DATA cell delivered on a stream and
+// sends a stream-level SENDME every 50 cells (tor-spec.txt §7.4). Readers
+// that take cells from ReceiveRelayCell themselves must call it for each
+// DATA cell. Circuits with congestion control send no stream SENDMEs.
+func (c *Circuit) AcknowledgeStreamData(streamID uint16) error {
+	if c.usesCongestionControl() {
+		return nil
+	}
+	window := c.streamWindow(streamID)
+	if err := window.Deliver(); err != nil {
+		return fmt.Errorf("flow control: %w", err)
+	}
+	if window.SendmeDue() {
+		if err := c.SendRelayCell(cell.NewRelayCell(streamID, cell.RelaySendme, nil)); err != nil {
+			return fmt.Errorf("failed to send stream SENDME: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReleaseStream forgets the flow control state of a stream the other side
+// ended with RELAY_END
+func (c *Circuit) ReleaseStream(streamID uint16) {
+	c.removeStreamWindow(streamID)
+}
+
 // WriteToStream writes data to a specific stream
-// This is used by the SOCKS proxy to send data to the exit node
+// This is used by the SOCKS proxy to send data to the exit node. It blocks
+// while the stream's package window is exhausted, until the exit acknowledges
+// earlier data with a stream-level SENDME or the circuit closes. Circuits
+// with congestion control have no stream windows and are only limited by
+// the congestion window.
 func (c *Circuit) WriteToStream(streamID uint16, data []byte) error {
+	if c.usesCongestionControl() {
+		return c.SendRelayCell(cell.NewRelayCell(streamID, cell.RelayData, data))
+	}
+	window := c.streamWindow(streamID)
+	if err := window.Acquire(context.Background(), c.doneChan()); err != nil {
+		return fmt.Errorf("flow control: %w", err)
+	}
+
 	dataCell := cell.NewRelayCell(streamID, cell.RelayData, data)
-	return c.SendRelayCell(dataCell)
+	if err := c.SendRelayCell(dataCell); err != nil {
+		window.Release()
+		return err
+	}
+	return nil
 }
 
 // EndStream sends a RELAY_END cell for a stream
 func (c *Circuit) EndStream(streamID uint16, reason byte) error {
+	c.removeStreamWindow(streamID)
 	endCell := cell.NewRelayCell(streamID, cell.RelayEnd, []byte{reason})
 	return c.SendRelayCell(endCell)
 }
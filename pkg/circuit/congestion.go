@@ -0,0 +1,221 @@
+package circuit
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// ccExtensionType is the ntor v3 extension a client sends to request
+// congestion control (empty) and the exit echoes with its SENDME increment
+// (prop324 §4, tor-spec.txt §5.1.4.3)
+const ccExtensionType = 2
+
+// CongestionParams are the Tor Vegas parameters (prop324 §3.3, §6.5).
+// Windows and thresholds are in cells.
+type CongestionParams struct {
+	CwndInit     int // Initial congestion window
+	CwndMin      int // Smallest congestion window
+	CwndMax      int // Largest congestion window
+	CwndInc      int // Steady-state window adjustment, applied once per window
+	SendmeInc    int // Cells acknowledged by each SENDME
+	SlowStartMax int // Window at which slow start ends regardless of queue use
+	EWMAMax      int // Largest RTT smoothing period, in SENDMEs
+
+	// Queue-use thresholds: slow start ends once the estimated queue reaches
+	// Gamma; in steady state the window grows below Alpha, shrinks above
+	// Beta and is cut back to the estimated BDP above Delta
+	Alpha int
+	Beta  int
+	Gamma int
+	Delta int
+}
+
+// DefaultCongestionParams returns the consensus defaults for exit circuits
+func DefaultCongestionParams() CongestionParams {
+	return CongestionParams{
+		CwndInit:     124,
+		CwndMin:      124,
+		CwndMax:      math.MaxInt32,
+		CwndInc:      31,
+		SendmeInc:    31,
+		SlowStartMax: 5000,
+		EWMAMax:      10,
+		Alpha:        186,
+		Beta:         248,
+		Gamma:        186,
+		Delta:        310,
+	}
+}
+
+// CongestionStats is a snapshot of a circuit's congestion control state
+type CongestionStats struct {
+	Cwnd      int           // Congestion window in cells
+	Inflight  int           // Cells sent and not yet acknowledged
+	SendmeInc int           // Cells acknowledged by each SENDME
+	MinRTT    time.Duration // Smallest RTT observed
+	RTT       time.Duration // Smoothed (EWMA) RTT
+	SlowStart bool          // Whether the window is still in slow start
+}
+
+// vegas is the sender side of Tor Vegas congestion control. The congestion
+// window replaces the fixed circuit package window; RTTs are measured from
+// the send time of each cell a SENDME acknowledges to the SENDME's arrival.
+type vegas struct {
+	params    CongestionParams
+	cwnd      int
+	inflight  int
+	slowStart bool
+	minRTT    time.Duration
+	ewmaRTT   time.Duration
+	sentAt    []time.Time // Send times of cells awaiting a SENDME
+	acks      int         // SENDMEs since the last steady-state update
+}
+
+func newVegas(params CongestionParams) *vegas {
+	return &vegas{
+		params:    params,
+		cwnd:      params.CwndInit,
+		slowStart: true,
+	}
+}
+
+// canSend reports whether the congestion window has room for another cell
+func (v *vegas) canSend() bool {
+	return v.inflight < v.cwnd
+}
+
+// recordSend remembers when a cell that the next SENDME acknowledges was sent
+func (v *vegas) recordSend(now time.Time) {
+	v.sentAt = append(v.sentAt, now)
+}
+
+// onSendme handles an authenticated SENDME arriving at now: it releases the
+// acknowledged cells, takes an RTT sample and updates the window
+func (v *vegas) onSendme(now time.Time) error {
+	if len(v.sentAt) == 0 {
+		return fmt.Errorf("unexpected SENDME: no cells awaiting acknowledgement")
+	}
+	rtt := now.Sub(v.sentAt[0])
+	v.sentAt = v.sentAt[1:]
+
+	v.inflight -= v.params.SendmeInc
+	if v.inflight < 0 {
+		v.inflight = 0
+	}
+
+	// A clock step can produce a non-positive sample; skip the update
+	if rtt <= 0 {
+		return nil
+	}
+	v.updateRTT(rtt)
+	v.update()
+	return nil
+}
+
+// updateRTT folds an RTT sample into the minimum and the EWMA. The EWMA
+// period covers half a window of SENDMEs, and only two during slow start.
+func (v *vegas) updateRTT(rtt time.Duration) {
+	if v.minRTT == 0 || rtt < v.minRTT {
+		v.minRTT = rtt
+	}
+	if v.ewmaRTT == 0 {
+		v.ewmaRTT = rtt
+		return
+	}
+
+	n := 2
+	if !v.slowStart {
+		n = v.cwnd / v.params.SendmeInc / 2
+		n = max(2, min(n, v.params.EWMAMax))
+	}
+	v.ewmaRTT = (2*rtt + time.Duration(n-1)*v.ewmaRTT) / time.Duration(n+1)
+}
+
+// bdp estimates the bandwidth-delay product: the part of the window that is
+// not sitting in queues along the path
+func (v *vegas) bdp() int {
+	return int(int64(v.cwnd) * int64(v.minRTT) / int64(v.ewmaRTT))
+}
+
+// update applies the Vegas rules after a SENDME (prop324 §3.3)
+func (v *vegas) update() {
+	bdp := v.bdp()
+	queueUse := v.cwnd - bdp
+
+	if v.slowStart {
+		if queueUse < v.params.Gamma {
+			// One SENDME's worth per SENDME doubles the window each RTT
+			v.cwnd += v.params.SendmeInc
+		} else {
+			v.cwnd = bdp + v.params.Gamma
+			v.slowStart = false
+		}
+		if v.cwnd >= v.params.SlowStartMax {
+			v.cwnd = v.params.SlowStartMax
+			v.slowStart = false
+		}
+		v.clamp()
+		return
+	}
+
+	// In steady state the window changes at most once per window of data
+	v.acks++
+	if v.acks < max(1, v.cwnd/v.params.SendmeInc) {
+		return
+	}
+	v.acks = 0
+
+	switch {
+	case queueUse > v.params.Delta:
+		v.cwnd = bdp + v.params.Delta - v.params.CwndInc
+	case queueUse > v.params.Beta:
+		v.cwnd -= v.params.CwndInc
+	case queueUse < v.params.Alpha:
+		v.cwnd += v.params.CwndInc
+	}
+	v.clamp()
+}
+
+// clamp keeps the window within [CwndMin, CwndMax]
+func (v *vegas) clamp() {
+	v.cwnd = max(v.params.CwndMin, min(v.cwnd, v.params.CwndMax))
+}
+
+// stats returns a snapshot of the controller state
+func (v *vegas) stats() CongestionStats {
+	return CongestionStats{
+		Cwnd:      v.cwnd,
+		Inflight:  v.inflight,
+		SendmeInc: v.params.SendmeInc,
+		MinRTT:    v.minRTT,
+		RTT:       v.ewmaRTT,
+		SlowStart: v.slowStart,
+	}
+}
+
+// congestionRequest is the extension sent to the exit to request congestion
+// control
+func congestionRequest() HandshakeExtension {
+	return HandshakeExtension{Type: ccExtensionType}
+}
+
+// parseCongestionResponse looks for the exit's congestion control reply and
+// returns the SENDME increment it chose, or 0 if the exit declined. An
+// increment far from the one we expect is rejected (prop324 §4.1).
+func parseCongestionResponse(extensions []HandshakeExtension, params CongestionParams) (int, error) {
+	for _, ext := range extensions {
+		if ext.Type != ccExtensionType {
+			continue
+		}
+		if len(ext.Data) != 1 {
+			return 0, fmt.Errorf("invalid congestion control response length: %d", len(ext.Data))
+		}
+		inc := int(ext.Data[0])
+		if inc == 0 || inc < params.SendmeInc/2 || inc > params.SendmeInc*2 {
+			return 0, fmt.Errorf("exit chose unacceptable SENDME increment %d", inc)
+		}
+		return inc, nil
+	}
+	return 0, nil
+}
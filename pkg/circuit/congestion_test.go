@@ -0,0 +1,333 @@
+package circuit
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// simLink is a simulated circuit in virtual time: a bottleneck that forwards
+// bandwidth cells per second, a one-way latency in each direction, and loss
+// that the underlying TCP connection repairs by retransmitting after rto.
+// Cells are delivered in order, so a loss also delays the cells behind it.
+type simLink struct {
+	latency   time.Duration
+	bandwidth int
+	loss      float64
+	rto       time.Duration
+	rng       *rand.Rand
+}
+
+// simResult summarizes the second half of a simulated bulk transfer
+type simResult struct {
+	cwnd       int           // Mean congestion window
+	throughput float64       // Cells per second acknowledged
+	rtt        time.Duration // Smoothed RTT at the end
+	minRTT     time.Duration
+}
+
+// bdp is the link's bandwidth-delay product in cells
+func (l *simLink) bdp() int {
+	return int(float64(l.bandwidth) * (2 * l.latency).Seconds())
+}
+
+// run sends as fast as the window allows for duration. The sender follows
+// the circuit's bookkeeping: every SendmeInc-th cell is timed, and the exit
+// acknowledges it with a SENDME when it arrives.
+func (l *simLink) run(send func(now time.Time) bool, sendme func(now time.Time), sendmeInc int, duration time.Duration) {
+	serialization := time.Second / time.Duration(l.bandwidth)
+	now := time.Unix(0, 0)
+	end := now.Add(duration)
+	var lastDeparture, lastArrival time.Time
+	var sendmes []time.Time // SENDME arrival times at the sender, in order
+	sent := 0
+
+	for now.Before(end) {
+		for send(now) {
+			sent++
+			departure := now
+			if lastDeparture.After(departure) {
+				departure = lastDeparture
+			}
+			departure = departure.Add(serialization)
+			lastDeparture = departure
+
+			arrival := departure.Add(l.latency)
+			if l.rng.Float64() < l.loss {
+				arrival = arrival.Add(l.rto)
+			}
+			if arrival.Before(lastArrival) {
+				arrival = lastArrival
+			}
+			lastArrival = arrival
+
+			if sent%sendmeInc == 0 {
+				sendmes = append(sendmes, arrival.Add(l.latency))
+			}
+		}
+		if len(sendmes) == 0 {
+			break
+		}
+		now = sendmes[0]
+		sendmes = sendmes[1:]
+		sendme(now)
+	}
+}
+
+// runVegas drives a Tor Vegas sender over the link
+func (l *simLink) runVegas(params CongestionParams, duration time.Duration) simResult {
+	v := newVegas(params)
+	sent := 0
+	var cwndSum, cwndSamples, ackedLate int
+	half := time.Unix(0, 0).Add(duration / 2)
+
+	send := func(now time.Time) bool {
+		if !v.canSend() {
+			return false
+		}
+		v.inflight++
+		sent++
+		if sent%params.SendmeInc == 0 {
+			v.recordSend(now)
+		}
+		return true
+	}
+	sendme := func(now time.Time) {
+		if err := v.onSendme(now); err != nil {
+			panic(err)
+		}
+		if now.After(half) {
+			cwndSum += v.cwnd
+			cwndSamples++
+			ackedLate += params.SendmeInc
+		}
+	}
+	l.run(send, sendme, params.SendmeInc, duration)
+
+	return simResult{
+		cwnd:       cwndSum / max(1, cwndSamples),
+		throughput: float64(ackedLate) / (duration / 2).Seconds(),
+		rtt:        v.ewmaRTT,
+		minRTT:     v.minRTT,
+	}
+}
+
+// runFixedWindow drives a sender limited to the 1000-cell circuit window
+func (l *simLink) runFixedWindow(duration time.Duration) float64 {
+	inflight := 0
+	ackedLate := 0
+	half := time.Unix(0, 0).Add(duration / 2)
+	send := func(time.Time) bool {
+		if inflight >= CircuitWindowStart {
+			return false
+		}
+		inflight++
+		return true
+	}
+	sendme := func(now time.Time) {
+		inflight -= CircuitWindowIncrement
+		if now.After(half) {
+			ackedLate += CircuitWindowIncrement
+		}
+	}
+	l.run(send, sendme, CircuitWindowIncrement, duration)
+	return float64(ackedLate) / (duration / 2).Seconds()
+}
+
+func TestVegasConvergesOnSimulatedLink(t *testing.T) {
+	tests := []struct {
+		name        string
+		latency     time.Duration
+		bandwidth   int
+		loss        float64
+		utilization float64 // Minimum share of the bandwidth used
+	}{
+		{"short path", 20 * time.Millisecond, 5000, 0, 0.95},
+		{"long fat path", 100 * time.Millisecond, 20000, 0, 0.95},
+		{"lossy path", 50 * time.Millisecond, 10000, 0.0002, 0.75},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link := &simLink{
+				latency:   tt.latency,
+				bandwidth: tt.bandwidth,
+				loss:      tt.loss,
+				rto:       2 * tt.latency,
+				rng:       rand.New(rand.NewSource(1)),
+			}
+			params := DefaultCongestionParams()
+			result := link.runVegas(params, 60*time.Second)
+			bdp := link.bdp()
+
+			t.Logf("BDP %d cells: cwnd %d, throughput %.0f cells/s, RTT %v (min %v)",
+				bdp, result.cwnd, result.throughput, result.rtt, result.minRTT)
+
+			// The link stays busy: Vegas keeps at least a BDP in flight
+			if result.throughput < tt.utilization*float64(tt.bandwidth) {
+				t.Errorf("Throughput %.0f cells/s, want at least %.0f%% of %d",
+					result.throughput, 100*tt.utilization, tt.bandwidth)
+			}
+			// The queue stays bounded: the window settles a few queue-use
+			// thresholds above the BDP instead of growing without limit
+			if result.cwnd > bdp+params.Delta+params.CwndInc {
+				t.Errorf("Congestion window %d exceeds BDP %d + delta", result.cwnd, bdp)
+			}
+			if tt.loss == 0 && result.cwnd < bdp+params.Alpha-params.CwndInc {
+				t.Errorf("Congestion window %d below BDP %d + alpha", result.cwnd, bdp)
+			}
+			if result.minRTT < 2*tt.latency {
+				t.Errorf("Minimum RTT %v below the path RTT %v", result.minRTT, 2*tt.latency)
+			}
+		})
+	}
+}
+
+func TestVegasOutperformsFixedWindow(t *testing.T) {
+	// A BDP of 2000 cells is twice what the fixed circuit window allows
+	link := &simLink{
+		latency:   100 * time.Millisecond,
+		bandwidth: 10000,
+		rng:       rand.New(rand.NewSource(1)),
+	}
+
+	fixed := link.runFixedWindow(30 * time.Second)
+	vegas := link.runVegas(DefaultCongestionParams(), 30*time.Second)
+	if fixed > 0.55*float64(link.bandwidth) {
+		t.Errorf("Fixed window throughput %.0f cells/s, expected it to be window-limited", fixed)
+	}
+	if vegas.throughput < 1.5*fixed {
+		t.Errorf("Vegas throughput %.0f cells/s, fixed window %.0f cells/s", vegas.throughput, fixed)
+	}
+}
+
+func TestVegasSlowStart(t *testing.T) {
+	params := DefaultCongestionParams()
+	v := newVegas(params)
+	now := time.Unix(0, 0)
+
+	// With no queueing every SENDME grows the window by one increment
+	for i := 0; i < 4; i++ {
+		v.recordSend(now)
+		now = now.Add(100 * time.Millisecond)
+		if err := v.onSendme(now); err != nil {
+			t.Fatalf("onSendme failed: %v", err)
+		}
+	}
+	if !v.slowStart || v.cwnd != params.CwndInit+4*params.SendmeInc {
+		t.Fatalf("cwnd = %d (slow start %v), want %d", v.cwnd, v.slowStart, params.CwndInit+4*params.SendmeInc)
+	}
+
+	// A sharply higher RTT means most of the window is queued: leave slow
+	// start and fall back to the BDP plus gamma
+	cwnd := v.cwnd
+	v.recordSend(now)
+	now = now.Add(time.Second)
+	if err := v.onSendme(now); err != nil {
+		t.Fatalf("onSendme failed: %v", err)
+	}
+	if v.slowStart {
+		t.Fatal("Still in slow start with a queue above gamma")
+	}
+	if want := cwnd*int(v.minRTT)/int(v.ewmaRTT) + params.Gamma; v.cwnd != want {
+		t.Errorf("cwnd after slow start = %d, want %d", v.cwnd, want)
+	}
+
+	if err := v.onSendme(now); err == nil {
+		t.Error("SENDME without a timed cell accepted")
+	}
+}
+
+func TestVegasSteadyState(t *testing.T) {
+	params := DefaultCongestionParams()
+	tests := []struct {
+		name     string
+		ewmaRTT  time.Duration // with a 100ms minimum RTT and a 620-cell window
+		wantCwnd int
+	}{
+		{"grow below alpha", 110 * time.Millisecond, 620 + params.CwndInc},
+		{"hold between alpha and beta", 150 * time.Millisecond, 620},
+		{"shrink above beta", 170 * time.Millisecond, 620 - params.CwndInc},
+		{"cut back above delta", 300 * time.Millisecond, 620*100/300 + params.Delta - params.CwndInc},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVegas(params)
+			v.slowStart = false
+			v.cwnd = 620
+			v.minRTT = 100 * time.Millisecond
+			v.ewmaRTT = tt.ewmaRTT
+
+			// The window is only updated once per window of SENDMEs
+			for i := 0; i < 620/params.SendmeInc; i++ {
+				if v.cwnd != 620 {
+					t.Fatalf("cwnd changed after %d SENDMEs", i)
+				}
+				v.update()
+			}
+			if v.cwnd != tt.wantCwnd {
+				t.Errorf("cwnd = %d, want %d", v.cwnd, tt.wantCwnd)
+			}
+		})
+	}
+}
+
+func TestVegasWindowBounds(t *testing.T) {
+	// Cutting back to the estimated BDP stops at the minimum window
+	params := DefaultCongestionParams()
+	params.CwndMin = 400
+	v := newVegas(params)
+	v.slowStart = false
+	v.cwnd = params.CwndMin
+	v.minRTT = 100 * time.Millisecond
+	v.ewmaRTT = time.Second
+
+	for i := 0; i < 100; i++ {
+		v.update()
+	}
+	if v.cwnd != params.CwndMin {
+		t.Errorf("cwnd = %d, want CwndMin %d", v.cwnd, params.CwndMin)
+	}
+
+	// Slow start ends at SlowStartMax even without a queue
+	params = DefaultCongestionParams()
+	v = newVegas(params)
+	v.minRTT = 100 * time.Millisecond
+	v.ewmaRTT = 100 * time.Millisecond
+	for i := 0; i < 1000 && v.slowStart; i++ {
+		v.update()
+	}
+	if v.slowStart || v.cwnd != params.SlowStartMax {
+		t.Errorf("cwnd = %d (slow start %v), want slow start to end at %d", v.cwnd, v.slowStart, params.SlowStartMax)
+	}
+}
+
+func TestParseCongestionResponse(t *testing.T) {
+	params := DefaultCongestionParams()
+	tests := []struct {
+		name       string
+		extensions []HandshakeExtension
+		want       int
+		wantErr    bool
+	}{
+		{"accepted", []HandshakeExtension{{Type: ccExtensionType, Data: []byte{31}}}, 31, false},
+		{"other increment", []HandshakeExtension{{Type: 1, Data: []byte{9}}, {Type: ccExtensionType, Data: []byte{40}}}, 40, false},
+		{"declined", nil, 0, false},
+		{"zero increment", []HandshakeExtension{{Type: ccExtensionType, Data: []byte{0}}}, 0, true},
+		{"increment too large", []HandshakeExtension{{Type: ccExtensionType, Data: []byte{100}}}, 0, true},
+		{"bad length", []HandshakeExtension{{Type: ccExtensionType}}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCongestionResponse(tt.extensions, params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCongestionResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseCongestionResponse() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Package circuit provides directory streams opened with RELAY_BEGIN_DIR.
+package circuit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+)
+
+const (
+	// maxRelayDataLen is the maximum RELAY_DATA payload (509 bytes payload - 11 bytes relay header)
+	maxRelayDataLen = 498
+
+	// endReasonDone is the RELAY_END reason sent when a stream is closed normally
+	endReasonDone byte = 6 // REASON_DONE
+)
+
+// OpenDirStream opens a stream to the directory service of the circuit's last
+// hop with RELAY_BEGIN_DIR (tor-spec.txt section 6.2) and returns it as a
+// net.Conn, so that HTTP directory requests can be sent over the circuit.
+func (c *Circuit) OpenDirStream(ctx context.Context, streamID uint16) (*DirStream, error) {
+	// RELAY_BEGIN_DIR carries no payload: the relay connects the stream to its own directory port
+	beginCell := cell.NewRelayCell(streamID, cell.RelayBeginDir, nil)
+	if err := c.SendRelayCell(beginCell); err != nil {
+		return nil, fmt.Errorf("failed to send RELAY_BEGIN_DIR: %w", err)
+	}
+
+	for {
+		reply, err := c.ReceiveRelayCell(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive RELAY_CONNECTED: %w", err)
+		}
+		if reply.StreamID != streamID {
+			continue
+		}
+
+		switch reply.Command {
+		case cell.RelayConnected:
+			return newDirStream(c, streamID), nil
+		case cell.RelayEnd:
+			reason := "unknown"
+			if len(reply.Data) > 0 {
+				reason = fmt.Sprintf("reason=%d", reply.Data[0])
+			}
+			return nil, fmt.Errorf("directory stream rejected by relay: %s", reason)
+		default:
+			return nil, fmt.Errorf("expected RELAY_CONNECTED, got %s", cell.RelayCmdString(reply.Command))
+		}
+	}
+}
+
+// DirStream is a RELAY_BEGIN_DIR stream. It implements net.Conn; reads
+// return RELAY_DATA payloads and io.EOF once the relay ends the stream.
+type DirStream struct {
+	circuit  *Circuit
+	streamID uint16
+
+	mu      sync.Mutex // serialises Read
+	pending []byte
+	eof     bool
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newDirStream wraps an opened directory stream
+func newDirStream(c *Circuit, streamID uint16) *DirStream {
+	return &DirStream{
+		circuit:  c,
+		streamID: streamID,
+		closed:   make(chan struct{}),
+	}
+}
+
+// StreamID returns the stream identifier on the circuit
+func (s *DirStream) StreamID() uint16 {
+	return s.streamID
+}
+
+// Read reads stream data received in RELAY_DATA cells
+func (s *DirStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+
+		ctx, cancel := s.readContext()
+		data, err := s.circuit.ReadFromStream(ctx, s.streamID)
+		cancel()
+		switch {
+		case err == io.EOF:
+			s.eof = true
+			return 0, io.EOF
+		case err != nil:
+			select {
+			case <-s.closed:
+				return 0, net.ErrClosed
+			default:
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return 0, os.ErrDeadlineExceeded
+			}
+			return 0, err
+		}
+		s.pending = data
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// readContext returns a context cancelled by Close or the read deadline
+func (s *DirStream) readContext() (context.Context, context.CancelFunc) {
+	s.deadlineMu.Lock()
+	deadline := s.readDeadline
+	s.deadlineMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	}
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Write sends p in RELAY_DATA cells
+func (s *DirStream) Write(p []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	written := 0
+	for written < len(p) {
+		end := written + maxRelayDataLen
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.circuit.WriteToStream(s.streamID, p[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Close ends the stream with RELAY_END, unless the relay already ended it
+func (s *DirStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		// Wait for a blocked Read to observe the close before checking eof
+		s.mu.Lock()
+		eof := s.eof
+		s.mu.Unlock()
+		if !eof && s.circuit.GetState() == StateOpen {
+			err = s.circuit.EndStream(s.streamID, endReasonDone)
+		}
+	})
+	return err
+}
+
+// LocalAddr returns a placeholder address; directory streams have no local endpoint
+func (s *DirStream) LocalAddr() net.Addr {
+	return dirStreamAddr{}
+}
+
+// RemoteAddr returns a placeholder address naming the circuit's directory stream
+func (s *DirStream) RemoteAddr() net.Addr {
+	return dirStreamAddr{circuitID: s.circuit.ID, streamID: s.streamID}
+}
+
+// SetDeadline sets the read deadline; writes are never blocked by the stream
+func (s *DirStream) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls
+func (s *DirStream) SetReadDeadline(t time.Time) error {
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+	s.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline is a no-op: writes are queued on the circuit connection
+func (s *DirStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// dirStreamAddr is the net.Addr of a directory stream
+type dirStreamAddr struct {
+	circuitID uint32
+	streamID  uint16
+}
+
+// Network returns the address network name
+func (a dirStreamAddr) Network() string {
+	return "tor-begindir"
+}
+
+// String returns the circuit and stream identifiers
+func (a dirStreamAddr) String() string {
+	return fmt.Sprintf("circuit/%d/stream/%d", a.circuitID, a.streamID)
+}
@@ -0,0 +1,157 @@
+package circuit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+)
+
+// fakeDirRelay records the relay cells sent on a circuit and answers
+// RELAY_BEGIN_DIR with the configured reply
+type fakeDirRelay struct {
+	mu      sync.Mutex
+	circuit *Circuit
+	reply   byte // RelayConnected or RelayEnd
+	sent    []*cell.RelayCell
+}
+
+func (r *fakeDirRelay) SendCell(c *cell.Cell) error {
+	relayCell, err := cell.DecodeRelayCell(c.Payload)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.sent = append(r.sent, relayCell)
+	r.mu.Unlock()
+
+	if relayCell.Command == cell.RelayBeginDir {
+		r.circuit.relayReceiveChan <- cell.NewRelayCell(relayCell.StreamID, r.reply, nil)
+	}
+	return nil
+}
+
+func (r *fakeDirRelay) sentCells() []*cell.RelayCell {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*cell.RelayCell(nil), r.sent...)
+}
+
+func newDirStreamTestCircuit(reply byte) (*Circuit, *fakeDirRelay) {
+	c := NewCircuit(1)
+	relay := &fakeDirRelay{circuit: c, reply: reply}
+	c.SetConnection(relay)
+	c.SetState(StateOpen)
+	return c, relay
+}
+
+func TestOpenDirStream(t *testing.T) {
+	c, relay := newDirStreamTestCircuit(cell.RelayConnected)
+
+	stream, err := c.OpenDirStream(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("OpenDirStream() error = %v", err)
+	}
+
+	sent := relay.sentCells()
+	if len(sent) != 1 || sent[0].Command != cell.RelayBeginDir || sent[0].StreamID != 7 || len(sent[0].Data) != 0 {
+		t.Fatalf("expected an empty RELAY_BEGIN_DIR on stream 7, got %+v", sent)
+	}
+
+	// Writes are split into RELAY_DATA cells
+	request := bytes.Repeat([]byte("G"), maxRelayDataLen+10)
+	if n, err := stream.Write(request); err != nil || n != len(request) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	sent = relay.sentCells()[1:]
+	if len(sent) != 2 || len(sent[0].Data) != maxRelayDataLen || len(sent[1].Data) != 10 {
+		t.Fatalf("expected RELAY_DATA cells of %d and 10 bytes, got %d cells", maxRelayDataLen, len(sent))
+	}
+
+	// Reads return RELAY_DATA payloads, skipping other streams, then EOF on RELAY_END
+	c.relayReceiveChan <- cell.NewRelayCell(7, cell.RelayData, []byte("HTTP/1.0 200 OK\r\n"))
+	c.relayReceiveChan <- cell.NewRelayCell(9, cell.RelayData, []byte("other stream"))
+	c.relayReceiveChan <- cell.NewRelayCell(7, cell.RelayData, []byte("\r\nbody"))
+	c.relayReceiveChan <- cell.NewRelayCell(7, cell.RelayEnd, []byte{endReasonDone})
+
+	body, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(body) != "HTTP/1.0 200 OK\r\n\r\nbody" {
+		t.Errorf("ReadAll() = %q", body)
+	}
+
+	// The relay already ended the stream, so Close sends nothing
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := len(relay.sentCells()); got != 3 {
+		t.Errorf("expected no RELAY_END after the relay ended the stream, got %d cells", got)
+	}
+}
+
+func TestOpenDirStreamRejected(t *testing.T) {
+	c, _ := newDirStreamTestCircuit(cell.RelayEnd)
+
+	if _, err := c.OpenDirStream(context.Background(), 1); err == nil {
+		t.Error("Expected error when the relay ends the directory stream")
+	}
+}
+
+func TestDirStreamClose(t *testing.T) {
+	c, relay := newDirStreamTestCircuit(cell.RelayConnected)
+
+	stream, err := c.OpenDirStream(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("OpenDirStream() error = %v", err)
+	}
+
+	// A read deadline interrupts a blocked Read
+	if err := stream.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want deadline exceeded", err)
+	}
+
+	// Close unblocks a pending Read and ends the stream
+	if err := stream.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("Expected Read to fail after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read did not return after Close")
+	}
+
+	sent := relay.sentCells()
+	last := sent[len(sent)-1]
+	if last.Command != cell.RelayEnd || last.StreamID != 3 || !bytes.Equal(last.Data, []byte{endReasonDone}) {
+		t.Errorf("expected RELAY_END(DONE) on stream 3, got %s", cell.RelayCmdString(last.Command))
+	}
+
+	if _, err := stream.Write([]byte("late")); err == nil {
+		t.Error("Expected Write to fail after Close")
+	}
+}
@@ -3,12 +3,21 @@ package circuit
 
 import (
 	"context"
-	"crypto/rand"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1" // #nosec G505 - SHA-1 relay digests required by tor-spec.txt §6.1
+	"crypto/sha3"
+	"crypto/subtle"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/opd-ai/go-tor/pkg/cell"
 	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/directory"
+	torerrors "github.com/opd-ai/go-tor/pkg/errors"
 	"github.com/opd-ai/go-tor/pkg/logger"
 	"github.com/opd-ai/go-tor/pkg/security"
 )
@@ -19,7 +28,11 @@ type HandshakeType uint16
 const (
 	// HandshakeTypeNTor is the ntor handshake (recommended)
 	HandshakeTypeNTor HandshakeType = 0x0002
-	// HandshakeTypeTAP is the legacy TAP handshake
+	// HandshakeTypeNTorV3 is the ntor v3 handshake, which also carries
+	// encrypted extension fields in both directions
+	HandshakeTypeNTorV3 HandshakeType = 0x0003
+	// HandshakeTypeTAP is the obsolete TAP handshake, which relies on 1024-bit
+	// RSA. It is never negotiated; one-hop directory circuits use CREATE_FAST.
 	HandshakeTypeTAP HandshakeType = 0x0000
 )
 
@@ -31,6 +44,18 @@ type Extension struct {
 	ephemeralPrivate []byte      // Client ephemeral private key for ntor handshake
 	serverIdentity   []byte      // Server identity key for ntor verification
 	serverNtorKey    []byte      // Server ntor onion key for ntor verification
+	targetHop        *Hop        // Hop added to the circuit once the handshake completes
+
+	ntorV3State      *crypto.NtorV3ClientState // Client state of a pending ntor v3 handshake
+	clientExtensions []HandshakeExtension      // Extensions sent in ntor v3 handshakes
+	serverExtensions []HandshakeExtension      // Extensions from the last ntor v3 reply
+}
+
+// HandshakeExtension is an extension field carried in the encrypted messages
+// of an ntor v3 handshake (tor-spec.txt section 5.1.4.3)
+type HandshakeExtension struct {
+	Type byte
+	Data []byte
 }
 
 // NewExtension creates a new circuit extension handler
@@ -48,6 +73,7 @@ func NewExtension(circuit *Circuit, log *logger.Logger) *Extension {
 // CreateFirstHop creates the first hop of the circuit using CREATE2
 // This establishes the initial circuit with the guard node
 func (e *Extension) CreateFirstHop(ctx context.Context, handshakeType HandshakeType) error {
+	handshakeType = e.selectHandshakeType(handshakeType)
 	e.logger.Info("Creating first hop",
 		"circuit_id", e.circuit.ID,
 		"handshake_type", handshakeType)
@@ -81,17 +107,89 @@ func (e *Extension) CreateFirstHop(ctx context.Context, handshakeType HandshakeT
 		"circuit_id", e.circuit.ID,
 		"handshake_size", len(handshakeData))
 
-	// In a real implementation, this would send the cell and wait for CREATED2
-	// For now, we'll simulate the response
-	_ = create2Cell
+	if err := e.sendCell(create2Cell); err != nil {
+		return fmt.Errorf("failed to send CREATE2: %w", err)
+	}
+
+	response, err := e.circuit.receiveControlCell(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to receive CREATED2: %w", err)
+	}
+	if response.Command == cell.CmdDestroy {
+		return fmt.Errorf("circuit destroyed by relay: %s", destroyReason(response.Payload))
+	}
+	if err := e.ProcessCreated2(response); err != nil {
+		return err
+	}
 
 	e.logger.Info("First hop created successfully", "circuit_id", e.circuit.ID)
 
 	return nil
 }
 
+// CreateFastHop creates the first hop of a one-hop directory circuit with
+// CREATE_FAST (tor-spec.txt section 5.1.3). CREATE_FAST does not
+// authenticate the relay beyond the link handshake, so it must not be used
+// for circuits that will be extended.
+func (e *Extension) CreateFastHop(ctx context.Context) error {
+	e.logger.Info("Creating first hop with CREATE_FAST", "circuit_id", e.circuit.ID)
+
+	x, err := crypto.GenerateRandomBytes(crypto.CreateFastKeyLen)
+	if err != nil {
+		return fmt.Errorf("failed to generate CREATE_FAST key: %w", err)
+	}
+	defer security.SecureZeroMemory(x)
+
+	createFastCell := &cell.Cell{
+		CircID:  e.circuit.ID,
+		Command: cell.CmdCreateFast,
+		Payload: x,
+	}
+	if err := e.sendCell(createFastCell); err != nil {
+		return fmt.Errorf("failed to send CREATE_FAST: %w", err)
+	}
+
+	response, err := e.circuit.receiveControlCell(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to receive CREATED_FAST: %w", err)
+	}
+	if response.Command == cell.CmdDestroy {
+		return fmt.Errorf("circuit destroyed by relay: %s", destroyReason(response.Payload))
+	}
+	if err := e.processCreatedFast(response, x); err != nil {
+		return err
+	}
+
+	e.logger.Info("First hop created successfully", "circuit_id", e.circuit.ID)
+	return nil
+}
+
+// processCreatedFast verifies a CREATED_FAST cell (Y | KH) against the
+// client's X and installs the derived hop keys
+func (e *Extension) processCreatedFast(createdFast *cell.Cell, x []byte) error {
+	if createdFast.Command != cell.CmdCreatedFast {
+		return fmt.Errorf("expected CREATED_FAST cell, got %s", createdFast.Command)
+	}
+	payload := createdFast.Payload
+	if len(payload) < 2*crypto.CreateFastKeyLen {
+		return fmt.Errorf("CREATED_FAST payload too short")
+	}
+
+	kh, keyMaterial, err := crypto.CreateFastDeriveKeys(x, payload[:crypto.CreateFastKeyLen])
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(kh, payload[crypto.CreateFastKeyLen:2*crypto.CreateFastKeyLen]) != 1 {
+		security.SecureZeroMemory(keyMaterial)
+		return fmt.Errorf("CREATED_FAST key hash verification failed")
+	}
+	// For CREATE_FAST, the KH that proved the key is also the hop's nonce
+	return e.completeHop(append(keyMaterial, kh...))
+}
+
 // ExtendCircuit extends the circuit to add another hop using EXTEND2
 func (e *Extension) ExtendCircuit(ctx context.Context, target string, handshakeType HandshakeType) error {
+	handshakeType = e.selectHandshakeType(handshakeType)
 	e.logger.Info("Extending circuit",
 		"circuit_id", e.circuit.ID,
 		"target", target,
@@ -105,21 +203,31 @@ func (e *Extension) ExtendCircuit(ctx context.Context, target string, handshakeT
 
 	// Build EXTEND2 relay cell
 	// EXTEND2 format: NSPEC [LSPECS] HTYPE HLEN HDATA
-	extend2Data := e.buildExtend2Data(target, handshakeType, handshakeData)
+	extend2Data, err := e.buildExtend2Data(target, handshakeType, handshakeData)
+	if err != nil {
+		return fmt.Errorf("failed to build EXTEND2: %w", err)
+	}
 
 	// Create RELAY_EXTEND2 cell
-	relayCell := &cell.RelayCell{
-		Command:  cell.RelayExtend2,
-		StreamID: 0, // EXTEND2 uses stream ID 0
-		Data:     extend2Data,
-	}
+	// EXTEND2 uses stream ID 0
+	relayCell := cell.NewRelayCell(0, cell.RelayExtend2, extend2Data)
 
 	e.logger.Debug("Sending EXTEND2 relay cell",
 		"circuit_id", e.circuit.ID,
 		"target", target)
 
-	// In a real implementation, this would send the relay cell and wait for EXTENDED2
-	_ = relayCell
+	// EXTEND2 must be carried in a RELAY_EARLY cell (tor-spec.txt §5.6)
+	if err := e.circuit.sendRelayEarly(relayCell); err != nil {
+		return fmt.Errorf("failed to send EXTEND2: %w", err)
+	}
+
+	response, err := e.awaitExtended2(ctx)
+	if err != nil {
+		return err
+	}
+	if err := e.ProcessExtended2(response); err != nil {
+		return err
+	}
 
 	e.logger.Info("Circuit extended successfully",
 		"circuit_id", e.circuit.ID,
@@ -142,18 +250,19 @@ func (e *Extension) generateHandshakeData(handshakeType HandshakeType) ([]byte,
 		// 3. Relay descriptor contains ntor-onion-key and identity key
 		// 4. Keys passed via SetTargetRelay() or extracted from descriptor
 
-		relayIdentity, relayNtorKey, err := e.getRelayKeys()
+		// ID and NODEID are the relay's RSA identity digest, not its
+		// Ed25519 identity
+		relayIdentity := e.targetLegacyID()
+		if relayIdentity == nil {
+			return nil, fmt.Errorf("ntor requires the relay's RSA identity digest")
+		}
+		_, relayNtorKey, err := e.getRelayKeys()
 		if err != nil {
-			// Fall back to test keys only for testing/demo scenarios
-			// Production deployments must provide valid relay keys
-			e.logger.Warn("Using placeholder keys - not suitable for production", "error", err)
-			relayIdentity = make([]byte, 32)
-			relayNtorKey = make([]byte, 32)
+			return nil, fmt.Errorf("ntor requires relay keys: %w", err)
 		}
 
 		// AUDIT-001 FIX: Store server keys for later verification
-		e.serverIdentity = make([]byte, 32)
-		copy(e.serverIdentity, relayIdentity)
+		e.serverIdentity = relayIdentity
 		e.serverNtorKey = make([]byte, 32)
 		copy(e.serverNtorKey, relayNtorKey)
 
@@ -168,74 +277,113 @@ func (e *Extension) generateHandshakeData(handshakeType HandshakeType) ([]byte,
 		copy(e.ephemeralPrivate, ephemeral.Private[:])
 
 		// Build handshake data: NODEID || KEYID || CLIENT_PK
-		// NODEID (20 bytes): relay identity fingerprint (first 20 bytes of Ed25519 key)
+		// NODEID (20 bytes): relay's RSA identity digest
 		// KEYID (32 bytes): relay's ntor onion key
 		// CLIENT_PK (32 bytes): client's ephemeral public key X
 		handshakeData := make([]byte, 20+32+32)
-		copy(handshakeData[0:20], relayIdentity[0:20])  // NODEID
+		copy(handshakeData[0:20], relayIdentity)        // NODEID
 		copy(handshakeData[20:52], relayNtorKey)        // KEYID
 		copy(handshakeData[52:84], ephemeral.Public[:]) // CLIENT_PK
 
 		return handshakeData, nil
 
-	case HandshakeTypeTAP:
-		// TAP handshake: PK_ID (16 bytes) || Symmetric key material (128 bytes)
-		// This is legacy and simplified
-		data := make([]byte, 144)
-		if _, err := rand.Read(data); err != nil {
-			return nil, fmt.Errorf("failed to generate random data: %w", err)
+	case HandshakeTypeNTorV3:
+		// ntor v3 per tor-spec.txt section 5.1.4.2; the client message is
+		// the list of extensions, encrypted to the relay's ntor key
+		relayIdentity, relayNtorKey, err := e.getRelayKeys()
+		if err != nil {
+			return nil, fmt.Errorf("ntor v3 requires relay keys: %w", err)
+		}
+
+		handshakeData, state, err := crypto.NtorV3ClientHandshake(relayIdentity, relayNtorKey, nil,
+			encodeHandshakeExtensions(e.clientExtensions))
+		if err != nil {
+			return nil, err
 		}
-		return data, nil
+		e.ntorV3State = state
+		return handshakeData, nil
+
+	case HandshakeTypeTAP:
+		return nil, torerrors.UnsupportedHandshake(uint16(handshakeType), "TAP is obsolete; use ntor, or CREATE_FAST for one-hop circuits")
 
 	default:
 		return nil, fmt.Errorf("unsupported handshake type: %d", handshakeType)
 	}
 }
 
-// buildExtend2Data builds the EXTEND2 relay cell data
-func (e *Extension) buildExtend2Data(target string, handshakeType HandshakeType, handshakeData []byte) []byte {
-	// EXTEND2 format (simplified):
-	// NSPEC (1 byte) - number of link specifiers
-	// Link specifiers (variable)
-	// HTYPE (2 bytes) - handshake type
-	// HLEN (2 bytes) - handshake data length
-	// HDATA (variable) - handshake data
-
-	// For simplicity, we'll use a minimal implementation
-	// In production, this would parse the target and create proper link specifiers
-
-	data := make([]byte, 0, 256)
-
-	// NSPEC: 1 link specifier (simplified)
-	data = append(data, 1)
+// Link specifier types for EXTEND2 (tor-spec.txt §5.1.2)
+const (
+	linkSpecIPv4         byte = 0
+	linkSpecIPv6         byte = 1
+	linkSpecLegacyID     byte = 2
+	linkSpecEd25519ID    byte = 3
+	legacyIdentityLength      = 20
+)
 
-	// Link specifier type 0 (TLS-over-TCP, IPv4) - simplified
-	// Type (1 byte) | Length (1 byte) | IPv4 (4 bytes) | Port (2 bytes)
-	data = append(data, 0)            // Type
-	data = append(data, 6)            // Length
-	data = append(data, 127, 0, 0, 1) // IPv4 (placeholder)
-	data = append(data, 0, 0)         // Port (placeholder)
+// buildExtend2Data builds the EXTEND2 relay cell data:
+// NSPEC (1 byte) | link specifiers | HTYPE (2 bytes) | HLEN (2 bytes) | HDATA.
+// target must be an "IP:port" address; the legacy RSA identity and Ed25519
+// identity link specifiers are added when the target relay provides them.
+func (e *Extension) buildExtend2Data(target string, handshakeType HandshakeType, handshakeData []byte) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target address %q: %w", target, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target port %q: %w", portStr, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("target %q is not an IP address", host)
+	}
 
-	// HTYPE
-	htypeBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(htypeBytes, uint16(handshakeType))
-	data = append(data, htypeBytes...)
+	var specs [][]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		specs = append(specs, linkSpecifier(linkSpecIPv4, binary.BigEndian.AppendUint16(append([]byte(nil), ip4...), uint16(port))))
+	} else {
+		specs = append(specs, linkSpecifier(linkSpecIPv6, binary.BigEndian.AppendUint16(append([]byte(nil), ip.To16()...), uint16(port))))
+	}
+	if legacyID := e.targetLegacyID(); legacyID != nil {
+		specs = append(specs, linkSpecifier(linkSpecLegacyID, legacyID))
+	}
+	if identityKey, _, err := e.getRelayKeys(); err == nil {
+		specs = append(specs, linkSpecifier(linkSpecEd25519ID, identityKey))
+	}
 
-	// HLEN - safely convert handshake data length
 	hlen, err := security.SafeLenToUint16(handshakeData)
 	if err != nil {
-		// This should never happen as handshake data is typically small
-		// But handle it gracefully
-		return nil
+		return nil, fmt.Errorf("handshake data too large: %w", err)
 	}
-	hlenBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(hlenBytes, hlen)
-	data = append(data, hlenBytes...)
 
-	// HDATA
+	data := make([]byte, 0, 256)
+	data = append(data, byte(len(specs)))
+	for _, spec := range specs {
+		data = append(data, spec...)
+	}
+	data = binary.BigEndian.AppendUint16(data, uint16(handshakeType))
+	data = binary.BigEndian.AppendUint16(data, hlen)
 	data = append(data, handshakeData...)
 
-	return data
+	return data, nil
+}
+
+// linkSpecifier encodes a single EXTEND2 link specifier: LSTYPE | LSLEN | LSPEC
+func linkSpecifier(specType byte, spec []byte) []byte {
+	return append([]byte{specType, byte(len(spec))}, spec...)
+}
+
+// targetLegacyID returns the target relay's 20-byte RSA identity digest, if known
+func (e *Extension) targetLegacyID() []byte {
+	relay, ok := e.targetRelay.(interface{ HexFingerprint() string })
+	if !ok {
+		return nil
+	}
+	id, err := hex.DecodeString(relay.HexFingerprint())
+	if err != nil || len(id) != legacyIdentityLength {
+		return nil
+	}
+	return id
 }
 
 // SetTargetRelay sets the target relay descriptor for key extraction (SPEC-001)
@@ -244,6 +392,74 @@ func (e *Extension) SetTargetRelay(relay interface{}) {
 	e.targetRelay = relay
 }
 
+// SetTargetHop sets the hop that is appended to the circuit, with its derived
+// crypto state, once the next CREATED2 or EXTENDED2 is processed. If unset, a
+// hop without address information is used.
+func (e *Extension) SetTargetHop(hop *Hop) {
+	e.targetHop = hop
+}
+
+// SetHandshakeExtensions sets the extension fields sent to relays in ntor v3
+// handshakes, such as a congestion control request
+func (e *Extension) SetHandshakeExtensions(extensions []HandshakeExtension) {
+	e.clientExtensions = extensions
+}
+
+// ServerExtensions returns the extension fields from the relay's reply to the
+// most recent ntor v3 handshake
+func (e *Extension) ServerExtensions() []HandshakeExtension {
+	return e.serverExtensions
+}
+
+// selectHandshakeType upgrades an ntor request to ntor v3 when the consensus
+// shows the target relay supports it (Relay=4)
+func (e *Extension) selectHandshakeType(requested HandshakeType) HandshakeType {
+	if requested != HandshakeTypeNTor {
+		return requested
+	}
+	relay, ok := e.targetRelay.(interface {
+		SupportsProtocol(name string, version int) bool
+	})
+	if ok && relay.SupportsProtocol(directory.ProtoRelay, directory.ProtoRelayNtorV3) {
+		if _, _, err := e.getRelayKeys(); err == nil {
+			return HandshakeTypeNTorV3
+		}
+	}
+	return requested
+}
+
+// encodeHandshakeExtensions encodes an ntor v3 message:
+// N_EXTENSIONS (1 byte) | N_EXTENSIONS times [TYPE (1) | LEN (1) | DATA]
+func encodeHandshakeExtensions(extensions []HandshakeExtension) []byte {
+	out := []byte{byte(len(extensions))}
+	for _, ext := range extensions {
+		out = append(out, ext.Type, byte(len(ext.Data)))
+		out = append(out, ext.Data...)
+	}
+	return out
+}
+
+// parseHandshakeExtensions decodes an ntor v3 message into its extensions
+func parseHandshakeExtensions(data []byte) ([]HandshakeExtension, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	n := int(data[0])
+	rest := data[1:]
+	extensions := make([]HandshakeExtension, 0, n)
+	for i := 0; i < n; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, fmt.Errorf("truncated extension %d", i)
+		}
+		extensions = append(extensions, HandshakeExtension{
+			Type: rest[0],
+			Data: append([]byte(nil), rest[2:2+int(rest[1])]...),
+		})
+		rest = rest[2+int(rest[1]):]
+	}
+	return extensions, nil
+}
+
 // getRelayKeys extracts identity and ntor onion keys from the target relay (SPEC-001)
 // Returns the keys if available from a directory.Relay descriptor
 func (e *Extension) getRelayKeys() (identityKey, ntorKey []byte, err error) {
@@ -287,41 +503,6 @@ func (e *Extension) getRelayKeys() (identityKey, ntorKey []byte, err error) {
 	return nil, nil, fmt.Errorf("target relay does not provide required keys")
 }
 
-// getRelayKeys is a placeholder function showing how relay keys should be obtained
-// from the directory service in a production implementation.
-//
-// Production implementation should:
-// 1. Accept a relay descriptor from the directory service
-// 2. Extract the Ed25519 identity key (32 bytes)
-// 3. Extract the Curve25519 ntor onion key (32 bytes)
-// 4. Validate key formats and lengths
-// 5. Return the keys for use in circuit creation
-//
-// Integration with directory service requires:
-// - Extending directory.Relay to include: IdentityKey []byte, NtorOnionKey []byte
-// - Parsing "identity-ed25519" from relay descriptors
-// - Parsing "ntor-onion-key" from relay descriptors
-// - Storing keys in the Relay structure during consensus parsing
-//
-// Example implementation:
-//
-//	func getRelayKeys(relay *directory.Relay) (identityKey, ntorKey []byte, err error) {
-//	    if len(relay.IdentityKey) != 32 {
-//	        return nil, nil, fmt.Errorf("invalid identity key length")
-//	    }
-//	    if len(relay.NtorOnionKey) != 32 {
-//	        return nil, nil, fmt.Errorf("invalid ntor key length")
-//	    }
-//	    return relay.IdentityKey, relay.NtorOnionKey, nil
-//	}
-//
-// This function is currently unused but documents the required integration.
-func getRelayKeys(relay interface{}) (identityKey, ntorKey []byte, err error) {
-	// Placeholder implementation
-	// In production, this would extract keys from relay descriptor
-	return nil, nil, fmt.Errorf("not implemented: relay key extraction requires directory service integration")
-}
-
 // ProcessCreated2 processes a CREATED2 response from the first hop
 // AUDIT-001 FIX: Now properly verifies ntor handshake and derives keys
 func (e *Extension) ProcessCreated2(created2Cell *cell.Cell) error {
@@ -345,19 +526,9 @@ func (e *Extension) ProcessCreated2(created2Cell *cell.Cell) error {
 	handshakeResponse := payload[2 : 2+hlen]
 
 	// AUDIT-001 FIX: Verify handshake response and derive proper keys
-	// Per tor-spec.txt section 5.1.4, process server's Y and AUTH
-	if e.ephemeralPrivate == nil {
-		return fmt.Errorf("no ephemeral private key stored - handshake not initiated properly")
-	}
-
-	keyMaterial, err := crypto.NtorProcessResponse(
-		handshakeResponse,
-		e.ephemeralPrivate,
-		e.serverNtorKey,
-		e.serverIdentity,
-	)
+	keyMaterial, err := e.processHandshakeResponse(handshakeResponse)
 	if err != nil {
-		return fmt.Errorf("ntor handshake verification failed: %w", err)
+		return err
 	}
 
 	// Derive circuit keys from key material per tor-spec.txt section 5.2
@@ -371,15 +542,13 @@ func (e *Extension) ProcessCreated2(created2Cell *cell.Cell) error {
 	}
 
 	// Set up encryption for this hop using derived keys
-	// In production, this would call circuit.AddHop() or similar to configure encryption
+	if err := e.completeHop(keyMaterial); err != nil {
+		return err
+	}
 	e.logger.Info("CREATED2 processed successfully with verified keys",
 		"circuit_id", e.circuit.ID,
 		"key_material_size", len(keyMaterial))
 
-	// Zero out ephemeral private key after use (AUDIT-MED-4 related)
-	security.SecureZeroMemory(e.ephemeralPrivate)
-	e.ephemeralPrivate = nil
-
 	return nil
 }
 
@@ -406,19 +575,9 @@ func (e *Extension) ProcessExtended2(extended2Cell *cell.RelayCell) error {
 	handshakeResponse := payload[2 : 2+hlen]
 
 	// AUDIT-001 FIX: Verify handshake response and derive proper keys
-	// Per tor-spec.txt section 5.1.4, process server's Y and AUTH
-	if e.ephemeralPrivate == nil {
-		return fmt.Errorf("no ephemeral private key stored - handshake not initiated properly")
-	}
-
-	keyMaterial, err := crypto.NtorProcessResponse(
-		handshakeResponse,
-		e.ephemeralPrivate,
-		e.serverNtorKey,
-		e.serverIdentity,
-	)
+	keyMaterial, err := e.processHandshakeResponse(handshakeResponse)
 	if err != nil {
-		return fmt.Errorf("ntor handshake verification failed: %w", err)
+		return err
 	}
 
 	// Derive circuit keys from key material per tor-spec.txt section 5.2
@@ -432,18 +591,232 @@ func (e *Extension) ProcessExtended2(extended2Cell *cell.RelayCell) error {
 	}
 
 	// Set up encryption for the new hop using derived keys
-	// In production, this would call circuit.AddHop() or similar to add encryption layer
+	if err := e.completeHop(keyMaterial); err != nil {
+		return err
+	}
 	e.logger.Info("EXTENDED2 processed successfully with verified keys",
 		"circuit_id", e.circuit.ID,
 		"key_material_size", len(keyMaterial))
 
+	return nil
+}
+
+// hopKeyMaterialLen is the key material derived for a hop: the 72 bytes of
+// circuit keys followed by KH
+const hopKeyMaterialLen = 72 + crypto.CircuitNonceLen
+
+// processHandshakeResponse verifies the relay's half of the pending handshake
+// and returns the derived circuit key material
+func (e *Extension) processHandshakeResponse(response []byte) ([]byte, error) {
+	if e.ntorV3State != nil {
+		state := e.ntorV3State
+		e.ntorV3State = nil
+
+		serverMessage, keyMaterial, err := state.ProcessResponse(response, hopKeyMaterialLen)
+		if err != nil {
+			return nil, fmt.Errorf("ntor v3 handshake verification failed: %w", err)
+		}
+		e.serverExtensions, err = parseHandshakeExtensions(serverMessage)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ntor v3 server message: %w", err)
+		}
+		return keyMaterial, nil
+	}
+
+	// Per tor-spec.txt section 5.1.4, process server's Y and AUTH; the
+	// original ntor handshake carries no extensions
+	e.serverExtensions = nil
+	if e.ephemeralPrivate == nil {
+		return nil, fmt.Errorf("no ephemeral private key stored - handshake not initiated properly")
+	}
+
+	keyMaterial, err := crypto.NtorProcessResponseKeys(
+		response,
+		e.ephemeralPrivate,
+		e.serverNtorKey,
+		e.serverIdentity,
+		hopKeyMaterialLen,
+	)
+
 	// Zero out ephemeral private key after use (AUDIT-MED-4 related)
 	security.SecureZeroMemory(e.ephemeralPrivate)
 	e.ephemeralPrivate = nil
 
+	if err != nil {
+		return nil, fmt.Errorf("ntor handshake verification failed: %w", err)
+	}
+	return keyMaterial, nil
+}
+
+// completeHop installs the layered crypto state derived from keyMaterial on
+// the target hop and appends it to the circuit
+func (e *Extension) completeHop(keyMaterial []byte) error {
+	hop := e.targetHop
+	if hop == nil {
+		hop = &Hop{}
+	}
+	e.targetHop = nil
+
+	if err := installHopKeys(hop, keyMaterial); err != nil {
+		return err
+	}
+	if len(keyMaterial) >= hopKeyMaterialLen {
+		hop.nonce = append([]byte(nil), keyMaterial[72:hopKeyMaterialLen]...)
+	}
+	security.SecureZeroMemory(keyMaterial)
+
+	if err := e.circuit.AddHop(hop); err != nil {
+		return fmt.Errorf("failed to add hop: %w", err)
+	}
+	return nil
+}
+
+// installHopKeys sets up a hop's ciphers and running digests from 72 bytes of
+// key material per tor-spec.txt §5.2: Df | Db | Kf | Kb. The digests are
+// seeded with Df/Db and the AES-128-CTR ciphers start with a zero IV.
+func installHopKeys(hop *Hop, keyMaterial []byte) error {
+	if len(keyMaterial) < 72 {
+		return fmt.Errorf("insufficient key material: got %d bytes, need 72", len(keyMaterial))
+	}
+
+	forwardCipher, err := newRelayCipher(keyMaterial[40:56])
+	if err != nil {
+		return err
+	}
+	backwardCipher, err := newRelayCipher(keyMaterial[56:72])
+	if err != nil {
+		return err
+	}
+
+	forwardDigest := sha1.New() // #nosec G401
+	forwardDigest.Write(keyMaterial[0:20])
+	backwardDigest := sha1.New() // #nosec G401
+	backwardDigest.Write(keyMaterial[20:40])
+
+	hop.SetCryptoState(forwardCipher, backwardCipher, forwardDigest, backwardDigest)
+	return nil
+}
+
+// CompleteRendezvous finishes the client side of an hs-ntor handshake from
+// the HANDSHAKE_INFO of a RENDEZVOUS2 cell (SERVER_PK | AUTH) and appends
+// the onion service as a virtual hop (rend-spec-v3.txt section 4.2)
+func (e *Extension) CompleteRendezvous(client *crypto.HsNtorClient, handshakeInfo []byte) error {
+	if len(handshakeInfo) < 64 {
+		return fmt.Errorf("RENDEZVOUS2 handshake info too short: %d", len(handshakeInfo))
+	}
+	keyMaterial, err := client.CompleteRendezvous(handshakeInfo[0:32], handshakeInfo[32:64])
+	if err != nil {
+		return fmt.Errorf("hs-ntor handshake verification failed: %w", err)
+	}
+	return e.addOnionServiceHop(keyMaterial, false)
+}
+
+// AcceptRendezvous appends the client of an onion service connection as a
+// virtual hop on the service's rendezvous circuit, using the key material
+// from crypto.HsNtorServiceHandshake. The service uses the client's keys in
+// the opposite direction.
+func (e *Extension) AcceptRendezvous(keyMaterial []byte) error {
+	return e.addOnionServiceHop(keyMaterial, true)
+}
+
+// addOnionServiceHop installs hs-ntor key material on a virtual hop:
+// Df | Db | Kf | Kb with SHA3-256 running digests and AES-256-CTR
+func (e *Extension) addOnionServiceHop(keyMaterial []byte, service bool) error {
+	if len(keyMaterial) < crypto.HsNtorKeyMaterialLen {
+		return fmt.Errorf("insufficient key material: got %d bytes, need %d", len(keyMaterial), crypto.HsNtorKeyMaterialLen)
+	}
+	defer security.SecureZeroMemory(keyMaterial)
+
+	df, db := keyMaterial[0:32], keyMaterial[32:64]
+	kf, kb := keyMaterial[64:96], keyMaterial[96:128]
+	if service {
+		df, db, kf, kb = db, df, kb, kf
+	}
+
+	forwardCipher, err := newRelayCipher(kf)
+	if err != nil {
+		return err
+	}
+	backwardCipher, err := newRelayCipher(kb)
+	if err != nil {
+		return err
+	}
+	forwardDigest := sha3.New256()
+	forwardDigest.Write(df)
+	backwardDigest := sha3.New256()
+	backwardDigest.Write(db)
+
+	hop := &Hop{}
+	hop.SetCryptoState(forwardCipher, backwardCipher, forwardDigest, backwardDigest)
+
+	// The virtual hop joins a circuit that is already open, so AddHop's
+	// building-state check does not apply
+	e.circuit.mu.Lock()
+	defer e.circuit.mu.Unlock()
+	if e.circuit.State == StateClosed || e.circuit.State == StateFailed {
+		return fmt.Errorf("failed to add hop: circuit is %s", e.circuit.State)
+	}
+	e.circuit.Hops = append(e.circuit.Hops, hop)
 	return nil
 }
 
+// newRelayCipher creates an AES-CTR stream with an all-zero IV; the key length
+// selects AES-128 for ordinary hops and AES-256 for onion service hops
+func newRelayCipher(key []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create relay cipher: %w", err)
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+}
+
+// sendCell sends a cell on the circuit's connection
+func (e *Extension) sendCell(c *cell.Cell) error {
+	e.circuit.mu.RLock()
+	conn := e.circuit.conn
+	e.circuit.mu.RUnlock()
+
+	sender, ok := conn.(interface{ SendCell(*cell.Cell) error })
+	if !ok {
+		return fmt.Errorf("circuit has no connection")
+	}
+	return sender.SendCell(c)
+}
+
+// awaitExtended2 waits for the EXTENDED2 reply to an EXTEND2. A TRUNCATED
+// relay cell or a DESTROY cell means the extension failed.
+func (e *Extension) awaitExtended2(ctx context.Context) (*cell.RelayCell, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to receive EXTENDED2: %w", ctx.Err())
+		case controlCell := <-e.circuit.controlReceiveChan:
+			if controlCell.Command == cell.CmdDestroy {
+				return nil, fmt.Errorf("circuit destroyed by relay: %s", destroyReason(controlCell.Payload))
+			}
+		case relayCell := <-e.circuit.relayReceiveChan:
+			switch relayCell.Command {
+			case cell.RelayExtended2:
+				return relayCell, nil
+			case cell.RelayTruncated:
+				return nil, fmt.Errorf("circuit extension failed: %s", destroyReason(relayCell.Data))
+			default:
+				e.logger.Debug("Ignoring relay cell while extending",
+					"circuit_id", e.circuit.ID,
+					"command", cell.RelayCmdString(relayCell.Command))
+			}
+		}
+	}
+}
+
+// destroyReason formats the reason byte of a DESTROY or TRUNCATED cell
+func destroyReason(payload []byte) string {
+	if len(payload) == 0 {
+		return "reason unknown"
+	}
+	return fmt.Sprintf("reason=%d", payload[0])
+}
+
 // DeriveKeys derives encryption keys for a circuit hop using KDF-TOR
 func (e *Extension) DeriveKeys(sharedSecret []byte) (forwardKey, backwardKey []byte, err error) {
 	// Use crypto package for key derivation
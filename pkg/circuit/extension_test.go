@@ -1,13 +1,17 @@
 package circuit
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"strings"
 	"testing"
 
 	"github.com/opd-ai/go-tor/pkg/cell"
 	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/directory"
+	torerrors "github.com/opd-ai/go-tor/pkg/errors"
 	"github.com/opd-ai/go-tor/pkg/logger"
 )
 
@@ -25,7 +29,7 @@ func TestNewExtension(t *testing.T) {
 	}
 }
 
-func TestCreateFirstHop(t *testing.T) {
+func TestCreateFirstHopWithoutConnection(t *testing.T) {
 	log := logger.NewDefault()
 	circuit := NewCircuit(1)
 	ext := NewExtension(circuit, log)
@@ -33,60 +37,106 @@ func TestCreateFirstHop(t *testing.T) {
 	ctx := context.Background()
 
 	err := ext.CreateFirstHop(ctx, HandshakeTypeNTor)
-	if err != nil {
-		t.Fatalf("Failed to create first hop: %v", err)
+	if err == nil {
+		t.Fatal("Expected error creating first hop without a connection")
+	}
+	if circuit.Length() != 0 {
+		t.Errorf("Expected no hops after failed CREATE2, got %d", circuit.Length())
 	}
 }
 
-func TestCreateFirstHopTAP(t *testing.T) {
+func TestExtendCircuitWithoutConnection(t *testing.T) {
 	log := logger.NewDefault()
 	circuit := NewCircuit(1)
 	ext := NewExtension(circuit, log)
 
 	ctx := context.Background()
 
-	err := ext.CreateFirstHop(ctx, HandshakeTypeTAP)
-	if err != nil {
-		t.Fatalf("Failed to create first hop with TAP: %v", err)
+	err := ext.ExtendCircuit(ctx, "192.0.2.1:9001", HandshakeTypeNTor)
+	if err == nil {
+		t.Fatal("Expected error extending circuit without a connection")
 	}
 }
 
-func TestExtendCircuit(t *testing.T) {
-	log := logger.NewDefault()
-	circuit := NewCircuit(1)
-	ext := NewExtension(circuit, log)
-
-	ctx := context.Background()
+func TestExtendCircuitInvalidTarget(t *testing.T) {
+	ext := NewExtension(NewCircuit(1), logger.NewDefault())
+	ext.SetTargetRelay(&directory.Relay{
+		Fingerprint:  strings.Repeat("AB", 20),
+		IdentityKey:  make([]byte, 32),
+		NtorOnionKey: make([]byte, 32),
+	})
 
-	err := ext.ExtendCircuit(ctx, "relay.example.com:9001", HandshakeTypeNTor)
-	if err != nil {
-		t.Fatalf("Failed to extend circuit: %v", err)
+	err := ext.ExtendCircuit(context.Background(), "relay.example.com:9001", HandshakeTypeNTor)
+	if err == nil || !strings.Contains(err.Error(), "not an IP address") {
+		t.Fatalf("Expected invalid target error, got %v", err)
 	}
 }
 
 func TestGenerateHandshakeData(t *testing.T) {
-	log := logger.NewDefault()
-	circuit := NewCircuit(1)
-	ext := NewExtension(circuit, log)
+	ext := NewExtension(NewCircuit(1), logger.NewDefault())
 
-	tests := []struct {
-		name          string
-		handshakeType HandshakeType
-		expectedLen   int
-	}{
-		{"NTor", HandshakeTypeNTor, 84}, // NODEID (20) + KEYID (32) + CLIENT_PK (32)
-		{"TAP", HandshakeTypeTAP, 144},
+	// Without the relay's keys there is nothing to address the handshake to
+	if _, err := ext.generateHandshakeData(HandshakeTypeNTor); err == nil {
+		t.Error("Expected error for ntor without relay keys")
+	}
+	ext.SetTargetRelay(&directory.Relay{IdentityKey: make([]byte, 32), NtorOnionKey: make([]byte, 32)})
+	if _, err := ext.generateHandshakeData(HandshakeTypeNTor); err == nil {
+		t.Error("Expected error for ntor without the relay's RSA identity digest")
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			data, err := ext.generateHandshakeData(tt.handshakeType)
-			if err != nil {
-				t.Fatalf("Failed to generate handshake data: %v", err)
-			}
+	relayKey, err := crypto.GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext.SetTargetRelay(&directory.Relay{
+		Fingerprint:  strings.Repeat("AB", 20),
+		IdentityKey:  bytes.Repeat([]byte{0xCD}, 32),
+		NtorOnionKey: relayKey.Public[:],
+	})
+	data, err := ext.generateHandshakeData(HandshakeTypeNTor)
+	if err != nil {
+		t.Fatalf("Failed to generate handshake data: %v", err)
+	}
+
+	// NODEID (20) + KEYID (32) + CLIENT_PK (32), with the RSA identity
+	// digest as NODEID
+	if len(data) != 84 {
+		t.Fatalf("Expected 84 bytes, got %d", len(data))
+	}
+	if !bytes.Equal(data[0:20], bytes.Repeat([]byte{0xAB}, 20)) {
+		t.Errorf("NODEID = %x, want the RSA identity digest", data[0:20])
+	}
+	if !bytes.Equal(data[20:52], relayKey.Public[:]) {
+		t.Errorf("KEYID = %x, want the relay's ntor key", data[20:52])
+	}
+}
 
-			if len(data) != tt.expectedLen {
-				t.Errorf("Expected %d bytes, got %d", tt.expectedLen, len(data))
+func TestTAPHandshakeRejected(t *testing.T) {
+	ext := NewExtension(NewCircuit(1), logger.NewDefault())
+
+	attempts := map[string]func() error{
+		"generate": func() error {
+			_, err := ext.generateHandshakeData(HandshakeTypeTAP)
+			return err
+		},
+		"create": func() error {
+			return ext.CreateFirstHop(context.Background(), HandshakeTypeTAP)
+		},
+		"extend": func() error {
+			return ext.ExtendCircuit(context.Background(), "192.0.2.1:9001", HandshakeTypeTAP)
+		},
+	}
+	for name, attempt := range attempts {
+		t.Run(name, func(t *testing.T) {
+			var unsupported *torerrors.UnsupportedHandshakeError
+			if err := attempt(); !errors.As(err, &unsupported) {
+				t.Fatalf("Expected UnsupportedHandshakeError, got %v", err)
+			}
+			if err := attempt(); !torerrors.IsCategory(err, torerrors.CategoryProtocol) {
+				t.Errorf("Expected a protocol error, got %v", err)
+			}
+			if unsupported.HandshakeType != uint16(HandshakeTypeTAP) {
+				t.Errorf("HandshakeType = 0x%04x, want 0x%04x", unsupported.HandshakeType, HandshakeTypeTAP)
 			}
 		})
 	}
@@ -109,16 +159,48 @@ func TestBuildExtend2Data(t *testing.T) {
 	ext := NewExtension(circuit, log)
 
 	handshakeData := make([]byte, 32)
-	data := ext.buildExtend2Data("relay.example.com:9001", HandshakeTypeNTor, handshakeData)
-
-	if len(data) == 0 {
-		t.Error("Expected non-empty EXTEND2 data")
+	data, err := ext.buildExtend2Data("192.0.2.1:9001", HandshakeTypeNTor, handshakeData)
+	if err != nil {
+		t.Fatalf("buildExtend2Data failed: %v", err)
 	}
 
 	// Check NSPEC
 	if data[0] != 1 {
 		t.Errorf("Expected NSPEC=1, got %d", data[0])
 	}
+
+	// IPv4 link specifier: type 0, length 6, address, port
+	wantSpec := []byte{0, 6, 192, 0, 2, 1, 0x23, 0x29}
+	if string(data[1:9]) != string(wantSpec) {
+		t.Errorf("IPv4 link specifier = %x, want %x", data[1:9], wantSpec)
+	}
+}
+
+func TestBuildExtend2DataWithRelayIdentity(t *testing.T) {
+	ext := NewExtension(NewCircuit(1), logger.NewDefault())
+	ext.SetTargetRelay(&directory.Relay{
+		Fingerprint:  strings.Repeat("AB", 20),
+		IdentityKey:  make([]byte, 32),
+		NtorOnionKey: make([]byte, 32),
+	})
+
+	data, err := ext.buildExtend2Data("192.0.2.1:9001", HandshakeTypeNTor, make([]byte, 84))
+	if err != nil {
+		t.Fatalf("buildExtend2Data failed: %v", err)
+	}
+
+	// IPv4, legacy identity and Ed25519 identity link specifiers
+	if data[0] != 3 {
+		t.Fatalf("Expected NSPEC=3, got %d", data[0])
+	}
+	legacy := data[9:]
+	if legacy[0] != linkSpecLegacyID || legacy[1] != 20 || legacy[2] != 0xAB {
+		t.Errorf("Unexpected legacy identity link specifier: %x", legacy[:22])
+	}
+	ed := legacy[22:]
+	if ed[0] != linkSpecEd25519ID || ed[1] != 32 {
+		t.Errorf("Unexpected Ed25519 link specifier: %x", ed[:2])
+	}
 }
 
 func TestProcessCreated2Valid(t *testing.T) {
@@ -134,7 +216,7 @@ func TestProcessCreated2Valid(t *testing.T) {
 	}
 
 	// Set up server keys
-	serverIdentity := make([]byte, 32)
+	serverIdentity := make([]byte, crypto.NtorIdentityLen)
 	serverNtorKey := make([]byte, 32)
 	if _, err := rand.Read(serverIdentity); err != nil {
 		t.Fatalf("Failed to generate server identity: %v", err)
@@ -227,7 +309,7 @@ func TestProcessExtended2Valid(t *testing.T) {
 	}
 
 	// Set up server keys
-	serverIdentity := make([]byte, 32)
+	serverIdentity := make([]byte, crypto.NtorIdentityLen)
 	serverNtorKey := make([]byte, 32)
 	if _, err := rand.Read(serverIdentity); err != nil {
 		t.Fatalf("Failed to generate server identity: %v", err)
@@ -335,7 +417,143 @@ func TestHandshakeTypeConstants(t *testing.T) {
 		t.Errorf("Expected HandshakeTypeNTor=0x0002, got 0x%04x", HandshakeTypeNTor)
 	}
 
+	if HandshakeTypeNTorV3 != 0x0003 {
+		t.Errorf("Expected HandshakeTypeNTorV3=0x0003, got 0x%04x", HandshakeTypeNTorV3)
+	}
+
 	if HandshakeTypeTAP != 0x0000 {
 		t.Errorf("Expected HandshakeTypeTAP=0x0000, got 0x%04x", HandshakeTypeTAP)
 	}
 }
+
+func TestSelectHandshakeType(t *testing.T) {
+	ext := NewExtension(NewCircuit(1), logger.NewDefault())
+
+	relay := &directory.Relay{
+		IdentityKey:  make([]byte, 32),
+		NtorOnionKey: make([]byte, 32),
+		Protocols:    directory.Protocols{directory.ProtoRelay: {{Low: 1, High: 4}}},
+	}
+	ext.SetTargetRelay(relay)
+	if got := ext.selectHandshakeType(HandshakeTypeNTor); got != HandshakeTypeNTorV3 {
+		t.Errorf("Relay=1-4: got handshake 0x%04x, want ntor v3", got)
+	}
+	if got := ext.selectHandshakeType(HandshakeTypeTAP); got != HandshakeTypeTAP {
+		t.Errorf("explicit TAP request changed to 0x%04x", got)
+	}
+
+	relay.Protocols = directory.Protocols{directory.ProtoRelay: {{Low: 1, High: 2}}}
+	if got := ext.selectHandshakeType(HandshakeTypeNTor); got != HandshakeTypeNTor {
+		t.Errorf("Relay=1-2: got handshake 0x%04x, want ntor", got)
+	}
+
+	// ntor v3 needs the relay's keys, so it is not selected without them
+	ext.SetTargetRelay(&directory.Relay{Protocols: directory.Protocols{directory.ProtoRelay: {{Low: 4, High: 4}}}})
+	if got := ext.selectHandshakeType(HandshakeTypeNTor); got != HandshakeTypeNTor {
+		t.Errorf("relay without keys: got handshake 0x%04x, want ntor", got)
+	}
+}
+
+func TestGenerateHandshakeDataNtorV3(t *testing.T) {
+	ext := NewExtension(NewCircuit(1), logger.NewDefault())
+
+	if _, err := ext.generateHandshakeData(HandshakeTypeNTorV3); err == nil {
+		t.Error("Expected error for ntor v3 without relay keys")
+	}
+
+	relayKey, err := crypto.GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext.SetTargetRelay(&directory.Relay{IdentityKey: make([]byte, 32), NtorOnionKey: relayKey.Public[:]})
+	ext.SetHandshakeExtensions([]HandshakeExtension{{Type: 2}})
+
+	data, err := ext.generateHandshakeData(HandshakeTypeNTorV3)
+	if err != nil {
+		t.Fatalf("Failed to generate ntor v3 handshake data: %v", err)
+	}
+	// ID (32) + KEYID (32) + CLIENT_PK (32) + encrypted message (3) + MAC (32)
+	if len(data) != 96+3+32 {
+		t.Errorf("Expected %d bytes, got %d", 96+3+32, len(data))
+	}
+	if ext.ntorV3State == nil {
+		t.Error("ntor v3 client state not stored")
+	}
+}
+
+func TestHandshakeExtensionsEncoding(t *testing.T) {
+	extensions := []HandshakeExtension{
+		{Type: 2, Data: nil},
+		{Type: 5, Data: []byte{1, 2, 3}},
+	}
+	encoded := encodeHandshakeExtensions(extensions)
+	if !bytes.Equal(encoded, []byte{2, 2, 0, 5, 3, 1, 2, 3}) {
+		t.Errorf("Unexpected encoding %x", encoded)
+	}
+
+	decoded, err := parseHandshakeExtensions(encoded)
+	if err != nil {
+		t.Fatalf("parseHandshakeExtensions failed: %v", err)
+	}
+	if len(decoded) != 2 || decoded[0].Type != 2 || decoded[1].Type != 5 || !bytes.Equal(decoded[1].Data, []byte{1, 2, 3}) {
+		t.Errorf("Unexpected decoded extensions %+v", decoded)
+	}
+
+	if _, err := parseHandshakeExtensions([]byte{1, 5, 3, 1}); err == nil {
+		t.Error("Expected error for truncated extension")
+	}
+}
+
+func TestRendezvousHop(t *testing.T) {
+	serviceKey, err := crypto.GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKey := bytes.Repeat([]byte{1}, 32)
+	subcredential := bytes.Repeat([]byte{2}, 32)
+
+	client, err := crypto.NewHsNtorClient(authKey, serviceKey.Public[:], subcredential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPK, auth, serviceKeys, err := crypto.HsNtorServiceHandshake(serviceKey.Private[:], serviceKey.Public[:],
+		authKey, client.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCircuit := NewCircuit(1)
+	if err := NewExtension(clientCircuit, logger.NewDefault()).CompleteRendezvous(client, append(serverPK, auth...)); err != nil {
+		t.Fatalf("CompleteRendezvous failed: %v", err)
+	}
+	serviceCircuit := NewCircuit(2)
+	if err := NewExtension(serviceCircuit, logger.NewDefault()).AcceptRendezvous(serviceKeys); err != nil {
+		t.Fatalf("AcceptRendezvous failed: %v", err)
+	}
+
+	clientHop, serviceHop := clientCircuit.Hops[0], serviceCircuit.Hops[0]
+
+	// What the client encrypts forward, the service decrypts backward
+	msg := []byte("onion service payload")
+	buf := append([]byte(nil), msg...)
+	clientHop.ForwardCipher.XORKeyStream(buf, buf)
+	serviceHop.BackwardCipher.XORKeyStream(buf, buf)
+	if !bytes.Equal(buf, msg) {
+		t.Error("client forward and service backward ciphers disagree")
+	}
+	clientHop.ForwardDigest.Write(msg)
+	serviceHop.BackwardDigest.Write(msg)
+	if !bytes.Equal(clientHop.ForwardDigest.Sum(nil), serviceHop.BackwardDigest.Sum(nil)) {
+		t.Error("client forward and service backward digests disagree")
+	}
+	if clientHop.ForwardDigest.Size() != 32 {
+		t.Errorf("Expected SHA3-256 digest, got size %d", clientHop.ForwardDigest.Size())
+	}
+
+	badAuth := append([]byte(nil), auth...)
+	badAuth[0] ^= 1
+	other, _ := crypto.NewHsNtorClient(authKey, serviceKey.Public[:], subcredential)
+	if err := NewExtension(NewCircuit(3), logger.NewDefault()).CompleteRendezvous(other, append(serverPK, badAuth...)); err == nil {
+		t.Error("Expected CompleteRendezvous to reject a bad AUTH")
+	}
+}
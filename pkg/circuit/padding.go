@@ -0,0 +1,806 @@
+package circuit
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/connection"
+)
+
+// Circuit padding machines per padding-spec.txt §3-4, modelled on Tor's
+// circuitpadding. A machine is a small state machine; each state samples the
+// delay before the next padding cell from a token histogram or a probability
+// distribution, and moves to another state on padding events. Machines run
+// on the client and send RELAY_DROP cells to one hop of the circuit, which
+// runs the matching relay-side machine after PADDING_NEGOTIATE.
+
+// PaddingMachineSlots is the number of machines that can run on a circuit
+const PaddingMachineSlots = 2
+
+// PADDING_NEGOTIATE commands and PADDING_NEGOTIATED responses
+// (padding-spec.txt §3.3)
+const (
+	paddingNegotiateVersion = 0
+	paddingCommandStop      = 1
+	paddingCommandStart     = 2
+	paddingResponseOK       = 1
+	paddingResponseErr      = 2
+)
+
+// Clock is the source of time for padding machines, shared with link
+// padding. Tests inject a fake clock to run machines deterministically.
+type Clock = connection.Clock
+
+// Timer is a pending call scheduled with Clock.AfterFunc
+type Timer = connection.Timer
+
+// PaddingEvent is something that happened on a circuit that may move a
+// padding machine to another state
+type PaddingEvent int
+
+const (
+	// PaddingEventNonPaddingRecv fires when a non-padding cell arrives
+	PaddingEventNonPaddingRecv PaddingEvent = iota
+	// PaddingEventNonPaddingSent fires when a non-padding cell is sent
+	PaddingEventNonPaddingSent
+	// PaddingEventPaddingSent fires when the machine sends a padding cell
+	PaddingEventPaddingSent
+	// PaddingEventPaddingRecv fires when padding arrives from the target hop
+	PaddingEventPaddingRecv
+	// PaddingEventInfinity fires when the infinity bin is chosen
+	PaddingEventInfinity
+	// PaddingEventBinsEmpty fires when every histogram bin but the infinity
+	// bin has run out of tokens
+	PaddingEventBinsEmpty
+	// PaddingEventLengthCount fires when the state has sent as many padding
+	// cells as its length allows
+	PaddingEventLengthCount
+)
+
+// String returns the event name used in padding-spec.txt
+func (e PaddingEvent) String() string {
+	switch e {
+	case PaddingEventNonPaddingRecv:
+		return "NONPADDING_RECV"
+	case PaddingEventNonPaddingSent:
+		return "NONPADDING_SENT"
+	case PaddingEventPaddingSent:
+		return "PADDING_SENT"
+	case PaddingEventPaddingRecv:
+		return "PADDING_RECV"
+	case PaddingEventInfinity:
+		return "INFINITY"
+	case PaddingEventBinsEmpty:
+		return "BINS_EMPTY"
+	case PaddingEventLengthCount:
+		return "LENGTH_COUNT"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", e)
+	}
+}
+
+// State indexes with a special meaning in PaddingState.Next
+const (
+	// PaddingStateStart is the state a machine starts in
+	PaddingStateStart = 0
+	// PaddingStateEnd shuts the machine down
+	PaddingStateEnd = -1
+	// PaddingStateCancel cancels pending padding without changing state
+	PaddingStateCancel = -2
+)
+
+// TokenRemoval selects which histogram bin loses a token when a non-padding
+// cell is sent before scheduled padding (padding-spec.txt §4.2)
+type TokenRemoval int
+
+const (
+	// TokenRemovalNone never removes tokens for non-padding cells
+	TokenRemovalNone TokenRemoval = iota
+	// TokenRemovalLower removes from the bin of the elapsed delay or the
+	// next non-empty bin below it
+	TokenRemovalLower
+	// TokenRemovalHigher removes from the bin of the elapsed delay or the
+	// next non-empty bin above it
+	TokenRemovalHigher
+	// TokenRemovalClosest removes from the non-empty bin nearest by index
+	TokenRemovalClosest
+	// TokenRemovalClosestUsec removes from the non-empty bin whose midpoint
+	// is nearest to the elapsed delay
+	TokenRemovalClosestUsec
+	// TokenRemovalExact removes only from the bin of the elapsed delay
+	TokenRemovalExact
+)
+
+// DistributionType is a probability distribution for padding delays and
+// state lengths
+type DistributionType int
+
+const (
+	// DistNone samples nothing: no padding, or no length limit
+	DistNone DistributionType = iota
+	// DistUniform is uniform on [Param1, Param2)
+	DistUniform
+	// DistLogistic has location Param1 and scale Param2
+	DistLogistic
+	// DistLogLogistic has scale Param1 and shape Param2
+	DistLogLogistic
+	// DistGeometric counts trials until the first success with probability Param1
+	DistGeometric
+	// DistWeibull has scale Param1 and shape Param2
+	DistWeibull
+	// DistPareto is the generalized Pareto with scale Param1 and shape Param2
+	DistPareto
+)
+
+// Distribution is a parametrized probability distribution. Delays are
+// sampled in microseconds and lengths in cells.
+type Distribution struct {
+	Type   DistributionType
+	Param1 float64
+	Param2 float64
+}
+
+// Sample draws a value from the distribution. Negative and NaN samples are
+// returned as 0.
+func (d Distribution) Sample(rng *rand.Rand) float64 {
+	u := uniformOpen(rng)
+	var v float64
+	switch d.Type {
+	case DistUniform:
+		v = d.Param1 + (d.Param2-d.Param1)*u
+	case DistLogistic:
+		v = d.Param1 + d.Param2*math.Log(u/(1-u))
+	case DistLogLogistic:
+		v = d.Param1 * math.Pow(u/(1-u), 1/d.Param2)
+	case DistGeometric:
+		if d.Param1 >= 1 {
+			v = 1
+		} else {
+			v = math.Ceil(math.Log(u) / math.Log1p(-d.Param1))
+		}
+	case DistWeibull:
+		v = d.Param1 * math.Pow(-math.Log(u), 1/d.Param2)
+	case DistPareto:
+		if d.Param2 == 0 {
+			v = -d.Param1 * math.Log(u)
+		} else {
+			v = d.Param1 * (math.Pow(u, -d.Param2) - 1) / d.Param2
+		}
+	}
+	if math.IsNaN(v) || v < 0 {
+		return 0
+	}
+	return v
+}
+
+// uniformOpen returns a uniform sample in the open interval (0, 1)
+func uniformOpen(rng *rand.Rand) float64 {
+	for {
+		if u := rng.Float64(); u > 0 {
+			return u
+		}
+	}
+}
+
+// PaddingState is one state of a padding machine
+type PaddingState struct {
+	// Histogram holds the tokens of each inter-arrival delay bin. Bin i
+	// covers delays from HistogramEdges[i] up to HistogramEdges[i+1]; the
+	// last bin is the infinity bin, which schedules no padding. Both slices
+	// have the same length. Tokens are refilled when the state is entered.
+	Histogram      []uint32
+	HistogramEdges []time.Duration
+	TokenRemoval   TokenRemoval
+
+	// Delay is used instead of a histogram when Histogram is empty. Samples
+	// are in microseconds, shifted by DelayShift and capped at MaxDelay.
+	Delay      Distribution
+	DelayShift time.Duration
+	MaxDelay   time.Duration
+
+	// Length limits the padding cells sent in the state, after which
+	// PaddingEventLengthCount fires. Samples are capped at MaxLength; DistNone
+	// means no limit.
+	Length    Distribution
+	MaxLength uint64
+
+	// Next maps events to the state they lead to. Events that are not
+	// listed leave the machine where it is.
+	Next map[PaddingEvent]int
+}
+
+// hasHistogram reports whether delays come from the token histogram
+func (s *PaddingState) hasHistogram() bool {
+	return len(s.Histogram) > 0
+}
+
+// infinityBin is the index of the histogram's infinity bin
+func (s *PaddingState) infinityBin() int {
+	return len(s.Histogram) - 1
+}
+
+// binFor returns the finite bin that contains delay d
+func (s *PaddingState) binFor(d time.Duration) int {
+	bin := 0
+	for i := 1; i < s.infinityBin(); i++ {
+		if d >= s.HistogramEdges[i] {
+			bin = i
+		}
+	}
+	return bin
+}
+
+// binMidpoint is the delay in the middle of finite bin i
+func (s *PaddingState) binMidpoint(i int) time.Duration {
+	return s.HistogramEdges[i] + (s.HistogramEdges[i+1]-s.HistogramEdges[i])/2
+}
+
+// PaddingMachineSpec describes a padding machine (padding-spec.txt §4.1)
+type PaddingMachineSpec struct {
+	Name string
+
+	// MachineNum identifies the machine to the relay in PADDING_NEGOTIATE
+	MachineNum uint8
+	// MachineIndex is the slot the machine runs in, below PaddingMachineSlots
+	MachineIndex int
+	// TargetHop is the hop, counted from 1 at the guard, that receives the
+	// padding and runs the relay-side machine
+	TargetHop int
+	// ShouldNegotiateEnd makes the client tell the relay to stop its machine
+	// when this one reaches PaddingStateEnd
+	ShouldNegotiateEnd bool
+
+	// AllowedPaddingCount padding cells may be sent before MaxPaddingPercent,
+	// the largest share of padding among all cells the machine has seen
+	// sent, applies. Zero MaxPaddingPercent means no limit.
+	AllowedPaddingCount uint64
+	MaxPaddingPercent   uint8
+
+	States []PaddingState
+}
+
+// Validate checks that the machine is well formed
+func (m *PaddingMachineSpec) Validate() error {
+	if m.MachineIndex < 0 || m.MachineIndex >= PaddingMachineSlots {
+		return fmt.Errorf("padding machine %q: invalid machine index %d", m.Name, m.MachineIndex)
+	}
+	if m.TargetHop < 1 {
+		return fmt.Errorf("padding machine %q: invalid target hop %d", m.Name, m.TargetHop)
+	}
+	if m.MaxPaddingPercent > 100 {
+		return fmt.Errorf("padding machine %q: max padding percent %d above 100", m.Name, m.MaxPaddingPercent)
+	}
+	if len(m.States) == 0 {
+		return fmt.Errorf("padding machine %q has no states", m.Name)
+	}
+
+	for i, state := range m.States {
+		if state.hasHistogram() {
+			if len(state.Histogram) < 2 {
+				return fmt.Errorf("padding machine %q state %d: histogram needs a finite bin and the infinity bin", m.Name, i)
+			}
+			if len(state.HistogramEdges) != len(state.Histogram) {
+				return fmt.Errorf("padding machine %q state %d: %d histogram edges for %d bins",
+					m.Name, i, len(state.HistogramEdges), len(state.Histogram))
+			}
+			for j := 1; j < len(state.HistogramEdges); j++ {
+				if state.HistogramEdges[j] <= state.HistogramEdges[j-1] {
+					return fmt.Errorf("padding machine %q state %d: histogram edges not increasing", m.Name, i)
+				}
+			}
+		}
+		for event, next := range state.Next {
+			if next != PaddingStateEnd && next != PaddingStateCancel && (next < 0 || next >= len(m.States)) {
+				return fmt.Errorf("padding machine %q state %d: %s leads to unknown state %d", m.Name, i, event, next)
+			}
+		}
+	}
+	return nil
+}
+
+// PaddingMachineStats is a snapshot of a running padding machine
+type PaddingMachineStats struct {
+	Name           string
+	State          int    // Current state index
+	PaddingSent    uint64 // Padding cells sent by the machine
+	NonPaddingSent uint64 // Non-padding cells sent while it ran
+	Negotiated     bool   // Whether the relay confirmed the machine
+}
+
+// paddingMachine is a padding machine running on a circuit
+type paddingMachine struct {
+	spec    *PaddingMachineSpec
+	counter uint32 // machine_ctr sent in PADDING_NEGOTIATE
+	state   int
+	tokens  []uint32 // Remaining histogram tokens in the current state
+	length  uint64   // Padding cells left in the state when limited
+	limited bool
+
+	timer       Timer
+	generation  uint64    // Invalidates timers that were cancelled
+	scheduledAt time.Time // When the pending padding was scheduled
+	chosenBin   int       // Histogram bin of the pending padding, or -1
+
+	paddingSent    uint64
+	nonPaddingSent uint64
+	negotiated     bool
+}
+
+// currentState returns the machine's state description
+func (m *paddingMachine) currentState() *PaddingState {
+	return &m.spec.States[m.state]
+}
+
+// SetPaddingClock sets the clock and random source used by padding machines.
+// A nil clock uses the system clock and a nil rng a securely seeded one.
+func (c *Circuit) SetPaddingClock(clock Clock, rng *rand.Rand) {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	c.paddingClock = clock
+	c.paddingRand = rng
+}
+
+// clock returns the padding clock, defaulting to the system clock.
+// paddingMu must be held.
+func (c *Circuit) clock() Clock {
+	if c.paddingClock == nil {
+		c.paddingClock = connection.SystemClock{}
+	}
+	return c.paddingClock
+}
+
+// rng returns the padding random source, seeding one on first use.
+// paddingMu must be held.
+func (c *Circuit) rng() *rand.Rand {
+	if c.paddingRand == nil {
+		var seed [32]byte
+		_, _ = crand.Read(seed[:])
+		c.paddingRand = rand.New(rand.NewChaCha8(seed))
+	}
+	return c.paddingRand
+}
+
+// StartPaddingMachine negotiates a padding machine with its target hop and
+// starts running it in its slot
+func (c *Circuit) StartPaddingMachine(spec *PaddingMachineSpec) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	if !c.IsPaddingEnabled() {
+		return fmt.Errorf("padding is disabled on circuit %d", c.ID)
+	}
+	if state := c.GetState(); state != StateOpen {
+		return fmt.Errorf("circuit not open: state=%s", state)
+	}
+	if hops := c.Length(); hops < spec.TargetHop {
+		return fmt.Errorf("padding machine %q targets hop %d of a %d-hop circuit", spec.Name, spec.TargetHop, hops)
+	}
+
+	c.paddingMu.Lock()
+	if c.paddingMachines[spec.MachineIndex] != nil {
+		c.paddingMu.Unlock()
+		return fmt.Errorf("padding machine slot %d already in use", spec.MachineIndex)
+	}
+	c.paddingCounter++
+	m := &paddingMachine{spec: spec, counter: c.paddingCounter, chosenBin: -1}
+	c.paddingMachines[spec.MachineIndex] = m
+	c.paddingMu.Unlock()
+
+	if err := c.sendPaddingNegotiate(spec, paddingCommandStart, m.counter); err != nil {
+		c.paddingMu.Lock()
+		if c.paddingMachines[spec.MachineIndex] == m {
+			c.paddingMachines[spec.MachineIndex] = nil
+		}
+		c.paddingMu.Unlock()
+		return fmt.Errorf("failed to negotiate padding machine %q: %w", spec.Name, err)
+	}
+
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	if c.paddingMachines[spec.MachineIndex] == m {
+		c.enterPaddingState(m, PaddingStateStart)
+	}
+	return nil
+}
+
+// StopPaddingMachine stops the machine in a slot and tells its relay to stop
+// the other side
+func (c *Circuit) StopPaddingMachine(index int) error {
+	if index < 0 || index >= PaddingMachineSlots {
+		return fmt.Errorf("invalid padding machine index %d", index)
+	}
+
+	c.paddingMu.Lock()
+	m := c.paddingMachines[index]
+	if m == nil {
+		c.paddingMu.Unlock()
+		return fmt.Errorf("no padding machine in slot %d", index)
+	}
+	c.freePaddingMachine(m)
+	c.paddingMu.Unlock()
+
+	return c.sendPaddingNegotiate(m.spec, paddingCommandStop, m.counter)
+}
+
+// PaddingMachineStats returns a snapshot of the machine in a slot
+func (c *Circuit) PaddingMachineStats(index int) (PaddingMachineStats, bool) {
+	if index < 0 || index >= PaddingMachineSlots {
+		return PaddingMachineStats{}, false
+	}
+
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	m := c.paddingMachines[index]
+	if m == nil {
+		return PaddingMachineStats{}, false
+	}
+	return PaddingMachineStats{
+		Name:           m.spec.Name,
+		State:          m.state,
+		PaddingSent:    m.paddingSent,
+		NonPaddingSent: m.nonPaddingSent,
+		Negotiated:     m.negotiated,
+	}, true
+}
+
+// stopPaddingMachines cancels every machine when the circuit shuts down
+func (c *Circuit) stopPaddingMachines() {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	for _, m := range c.paddingMachines {
+		if m != nil {
+			c.freePaddingMachine(m)
+		}
+	}
+}
+
+// freePaddingMachine cancels a machine's padding and frees its slot.
+// paddingMu must be held.
+func (c *Circuit) freePaddingMachine(m *paddingMachine) {
+	c.cancelPadding(m)
+	if c.paddingMachines[m.spec.MachineIndex] == m {
+		c.paddingMachines[m.spec.MachineIndex] = nil
+	}
+}
+
+// paddingEvent delivers an event to every running machine. hopIdx is the
+// hop a received cell came from, or -1 for sent cells.
+func (c *Circuit) paddingEvent(event PaddingEvent, hopIdx int) {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+
+	for _, m := range c.paddingMachines {
+		if m == nil {
+			continue
+		}
+		switch event {
+		case PaddingEventPaddingRecv:
+			// Only padding from the machine's own relay counts
+			if hopIdx != m.spec.TargetHop-1 {
+				continue
+			}
+		case PaddingEventNonPaddingSent:
+			m.nonPaddingSent++
+			c.removeToken(m)
+			c.cancelPadding(m)
+			if c.checkBinsEmpty(m) {
+				continue
+			}
+		}
+
+		if c.transition(m, event) {
+			continue
+		}
+		// Sending a real cell restarts the wait for the next padding cell
+		if event == PaddingEventNonPaddingSent {
+			c.schedulePadding(m)
+		}
+	}
+}
+
+// transition follows the machine's Next entry for an event. It reports
+// whether the event was handled; unhandled events leave the machine alone.
+// paddingMu must be held.
+func (c *Circuit) transition(m *paddingMachine, event PaddingEvent) bool {
+	next, ok := m.currentState().Next[event]
+	if !ok {
+		return false
+	}
+
+	switch next {
+	case PaddingStateCancel:
+		c.cancelPadding(m)
+	case PaddingStateEnd:
+		c.freePaddingMachine(m)
+		if m.spec.ShouldNegotiateEnd {
+			// Events arrive on the send and receive paths, so the STOP
+			// request is sent from its own goroutine
+			go func() {
+				_ = c.sendPaddingNegotiate(m.spec, paddingCommandStop, m.counter)
+			}()
+		}
+	default:
+		c.enterPaddingState(m, next)
+	}
+	return true
+}
+
+// enterPaddingState moves a machine to a state, refilling its tokens and
+// sampling its length, and schedules the first padding cell.
+// paddingMu must be held.
+func (c *Circuit) enterPaddingState(m *paddingMachine, state int) {
+	c.cancelPadding(m)
+	m.state = state
+	s := m.currentState()
+
+	m.tokens = append(m.tokens[:0], s.Histogram...)
+	m.limited = s.Length.Type != DistNone
+	if m.limited {
+		m.length = uint64(s.Length.Sample(c.rng()))
+		if s.MaxLength > 0 && m.length > s.MaxLength {
+			m.length = s.MaxLength
+		}
+		if m.length == 0 {
+			c.transition(m, PaddingEventLengthCount)
+			return
+		}
+	}
+	c.schedulePadding(m)
+}
+
+// schedulePadding samples the delay to the next padding cell and starts its
+// timer. paddingMu must be held.
+func (c *Circuit) schedulePadding(m *paddingMachine) {
+	if m.limited && m.length == 0 {
+		return
+	}
+	s := m.currentState()
+
+	var delay time.Duration
+	bin := -1
+	switch {
+	case s.hasHistogram():
+		var total uint64
+		for _, tokens := range m.tokens {
+			total += uint64(tokens)
+		}
+		if total == 0 {
+			c.transition(m, PaddingEventBinsEmpty)
+			return
+		}
+
+		pick := c.rng().Uint64N(total)
+		for bin = range m.tokens {
+			if pick < uint64(m.tokens[bin]) {
+				break
+			}
+			pick -= uint64(m.tokens[bin])
+		}
+		if bin == s.infinityBin() {
+			c.transition(m, PaddingEventInfinity)
+			return
+		}
+		low, high := s.HistogramEdges[bin], s.HistogramEdges[bin+1]
+		delay = low + time.Duration(c.rng().Int64N(int64(high-low)))
+	case s.Delay.Type != DistNone:
+		delay = time.Duration(s.Delay.Sample(c.rng())*float64(time.Microsecond)) + s.DelayShift
+		if s.MaxDelay > 0 && delay > s.MaxDelay {
+			delay = s.MaxDelay
+		}
+	default:
+		// States without a delay only wait for events
+		return
+	}
+
+	m.generation++
+	generation := m.generation
+	m.chosenBin = bin
+	m.scheduledAt = c.clock().Now()
+	m.timer = c.clock().AfterFunc(delay, func() {
+		c.sendScheduledPadding(m, generation)
+	})
+}
+
+// cancelPadding stops a machine's pending padding. paddingMu must be held.
+func (c *Circuit) cancelPadding(m *paddingMachine) {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.generation++
+	m.scheduledAt = time.Time{}
+	m.chosenBin = -1
+}
+
+// removeToken takes a token for a non-padding cell sent while padding was
+// pending, from the bin the state's removal policy picks for the time since
+// the padding was scheduled. paddingMu must be held.
+func (c *Circuit) removeToken(m *paddingMachine) {
+	s := m.currentState()
+	if !s.hasHistogram() || s.TokenRemoval == TokenRemovalNone || m.scheduledAt.IsZero() {
+		return
+	}
+
+	elapsed := c.clock().Now().Sub(m.scheduledAt)
+	target := s.binFor(elapsed)
+	bin := -1
+	switch s.TokenRemoval {
+	case TokenRemovalExact:
+		if m.tokens[target] > 0 {
+			bin = target
+		}
+	case TokenRemovalLower:
+		for i := target; i >= 0; i-- {
+			if m.tokens[i] > 0 {
+				bin = i
+				break
+			}
+		}
+	case TokenRemovalHigher:
+		for i := target; i < s.infinityBin(); i++ {
+			if m.tokens[i] > 0 {
+				bin = i
+				break
+			}
+		}
+	case TokenRemovalClosest, TokenRemovalClosestUsec:
+		var best time.Duration
+		for i := 0; i < s.infinityBin(); i++ {
+			if m.tokens[i] == 0 {
+				continue
+			}
+			distance := time.Duration(i - target)
+			if s.TokenRemoval == TokenRemovalClosestUsec {
+				distance = s.binMidpoint(i) - elapsed
+			}
+			if distance < 0 {
+				distance = -distance
+			}
+			// Ties go to the lower bin
+			if bin < 0 || distance < best {
+				bin, best = i, distance
+			}
+		}
+	}
+	if bin >= 0 {
+		m.tokens[bin]--
+	}
+}
+
+// checkBinsEmpty fires PaddingEventBinsEmpty once only the infinity bin has
+// tokens left, and reports whether the machine changed state.
+// paddingMu must be held.
+func (c *Circuit) checkBinsEmpty(m *paddingMachine) bool {
+	s := m.currentState()
+	if !s.hasHistogram() {
+		return false
+	}
+	for _, tokens := range m.tokens[:s.infinityBin()] {
+		if tokens > 0 {
+			return false
+		}
+	}
+	return c.transition(m, PaddingEventBinsEmpty)
+}
+
+// paddingAllowed applies the machine's padding limits. paddingMu must be held.
+func (m *paddingMachine) paddingAllowed() bool {
+	if m.spec.MaxPaddingPercent == 0 || m.paddingSent < m.spec.AllowedPaddingCount {
+		return true
+	}
+	total := m.paddingSent + m.nonPaddingSent + 1
+	return (m.paddingSent+1)*100 <= uint64(m.spec.MaxPaddingPercent)*total
+}
+
+// sendScheduledPadding runs when a padding timer fires: it sends a DROP cell
+// to the target hop and advances the machine
+func (c *Circuit) sendScheduledPadding(m *paddingMachine, generation uint64) {
+	c.paddingMu.Lock()
+	if c.paddingMachines[m.spec.MachineIndex] != m || m.generation != generation {
+		c.paddingMu.Unlock()
+		return
+	}
+	m.timer = nil
+	m.scheduledAt = time.Time{}
+	if !m.paddingAllowed() {
+		m.chosenBin = -1
+		c.paddingMu.Unlock()
+		return
+	}
+	c.paddingMu.Unlock()
+
+	drop := cell.NewRelayCell(0, cell.RelayDrop, nil)
+	if err := c.sendRelayCellToHop(drop, cell.CmdRelay, m.spec.TargetHop-1); err != nil {
+		return
+	}
+
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	if c.paddingMachines[m.spec.MachineIndex] != m {
+		return
+	}
+	m.paddingSent++
+	// A non-padding cell sent meanwhile has already rescheduled the machine
+	if m.generation != generation {
+		return
+	}
+	if m.chosenBin >= 0 && m.tokens[m.chosenBin] > 0 {
+		m.tokens[m.chosenBin]--
+	}
+	m.chosenBin = -1
+
+	if m.limited {
+		m.length--
+		if m.length == 0 {
+			c.transition(m, PaddingEventLengthCount)
+			return
+		}
+	}
+	if c.transition(m, PaddingEventPaddingSent) {
+		return
+	}
+	if c.checkBinsEmpty(m) {
+		return
+	}
+	c.schedulePadding(m)
+}
+
+// sendPaddingNegotiate sends PADDING_NEGOTIATE to a machine's target hop
+func (c *Circuit) sendPaddingNegotiate(spec *PaddingMachineSpec, command byte, counter uint32) error {
+	negotiate := cell.NewRelayCell(0, cell.RelayPaddingNegotiate, encodePaddingNegotiate(command, spec.MachineNum, counter))
+	return c.sendRelayCellToHop(negotiate, cell.CmdRelay, spec.TargetHop-1)
+}
+
+// handlePaddingNegotiated processes the relay's answer to PADDING_NEGOTIATE.
+// A refused START shuts the machine down; answers for machines that have
+// since been replaced are ignored.
+func (c *Circuit) handlePaddingNegotiated(data []byte) error {
+	command, response, machineNum, counter, err := parsePaddingNegotiated(data)
+	if err != nil {
+		return err
+	}
+	if command != paddingCommandStart {
+		return nil
+	}
+
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	for _, m := range c.paddingMachines {
+		if m == nil || m.spec.MachineNum != machineNum || m.counter != counter {
+			continue
+		}
+		if response == paddingResponseOK {
+			m.negotiated = true
+		} else {
+			c.freePaddingMachine(m)
+		}
+	}
+	return nil
+}
+
+// encodePaddingNegotiate builds a circpad_negotiate body:
+// version | command | machine_type | echo_request | machine_ctr
+func encodePaddingNegotiate(command, machineNum byte, counter uint32) []byte {
+	body := []byte{paddingNegotiateVersion, command, machineNum, 0}
+	return binary.BigEndian.AppendUint32(body, counter)
+}
+
+// parsePaddingNegotiated parses a circpad_negotiated body:
+// version | command | response | machine_type | machine_ctr
+func parsePaddingNegotiated(data []byte) (command, response, machineNum byte, counter uint32, err error) {
+	if len(data) < 8 {
+		return 0, 0, 0, 0, fmt.Errorf("PADDING_NEGOTIATED too short: %d bytes", len(data))
+	}
+	if data[0] != paddingNegotiateVersion {
+		return 0, 0, 0, 0, fmt.Errorf("unsupported PADDING_NEGOTIATED version %d", data[0])
+	}
+	if data[2] != paddingResponseOK && data[2] != paddingResponseErr {
+		return 0, 0, 0, 0, fmt.Errorf("invalid PADDING_NEGOTIATED response %d", data[2])
+	}
+	return data[1], data[2], data[3], binary.BigEndian.Uint32(data[4:8]), nil
+}
@@ -0,0 +1,82 @@
+package circuit
+
+// Built-in circuit setup obfuscation machines (padding-spec.txt §5, Tor's
+// circuitpadding_machines.c). Onion service introduction and rendezvous
+// circuits exchange far fewer cells than a general circuit fetching a page,
+// which makes them easy to pick out at the middle relay's guard. The client
+// machines below pad towards the middle hop, whose relay-side machines pad
+// back, so that both directions look like the start of a general circuit.
+
+// Machine numbers negotiated with relays, matching Tor's machine list
+const (
+	PaddingMachineIntroCircuit uint8 = 0
+	PaddingMachineRendCircuit  uint8 = 1
+)
+
+// Padding cells sent by the introduction circuit machine, mimicking the
+// BEGIN, DATA and SENDME cells of a general circuit
+const (
+	introMachineMinPadding = 7
+	introMachineMaxPadding = 10
+)
+
+// Machine states shared by the circuit setup machines
+const (
+	circSetupStateStart     = PaddingStateStart
+	circSetupStateObfuscate = 1
+)
+
+// IntroCircuitPaddingMachine returns the client machine for introduction
+// circuits. It starts padding once INTRODUCE1 is sent and ends after a short
+// burst, telling the middle relay to stop its side.
+func IntroCircuitPaddingMachine() *PaddingMachineSpec {
+	return &PaddingMachineSpec{
+		Name:               "client_ip_circ",
+		MachineNum:         PaddingMachineIntroCircuit,
+		MachineIndex:       0,
+		TargetHop:          2,
+		ShouldNegotiateEnd: true,
+		States: []PaddingState{
+			circSetupStateStart: {
+				Next: map[PaddingEvent]int{
+					PaddingEventNonPaddingSent: circSetupStateObfuscate,
+				},
+			},
+			circSetupStateObfuscate: {
+				// Cells go out back to back, as a client writing a request would
+				Delay:  Distribution{Type: DistUniform, Param1: 0, Param2: 1},
+				Length: Distribution{Type: DistUniform, Param1: introMachineMinPadding, Param2: introMachineMaxPadding + 1},
+				Next: map[PaddingEvent]int{
+					PaddingEventLengthCount: PaddingStateEnd,
+				},
+			},
+		},
+	}
+}
+
+// RendCircuitPaddingMachine returns the client machine for rendezvous
+// circuits. Once RENDEZVOUS_ESTABLISHED arrives it sends a single padding
+// cell, standing in for the BEGIN a general circuit would send, and ends.
+func RendCircuitPaddingMachine() *PaddingMachineSpec {
+	return &PaddingMachineSpec{
+		Name:               "client_rp_circ",
+		MachineNum:         PaddingMachineRendCircuit,
+		MachineIndex:       0,
+		TargetHop:          2,
+		ShouldNegotiateEnd: true,
+		States: []PaddingState{
+			circSetupStateStart: {
+				Next: map[PaddingEvent]int{
+					PaddingEventNonPaddingRecv: circSetupStateObfuscate,
+				},
+			},
+			circSetupStateObfuscate: {
+				Delay:  Distribution{Type: DistUniform, Param1: 0, Param2: 1},
+				Length: Distribution{Type: DistUniform, Param1: 1, Param2: 2},
+				Next: map[PaddingEvent]int{
+					PaddingEventLengthCount: PaddingStateEnd,
+				},
+			},
+		},
+	}
+}
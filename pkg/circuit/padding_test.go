@@ -0,0 +1,691 @@
+package circuit
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+// fakeClock is a Clock that only moves when a test advances it. Timers fire
+// on the advancing goroutine in deadline order.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	return true
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, timer := range c.timers {
+			if !timer.stopped && !timer.at.After(end) && (next == nil || timer.at.Before(next.at)) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.stopped = true
+		if next.at.After(c.now) {
+			c.now = next.at
+		}
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// newPaddingTestCircuit returns an open circuit of n hops on a fake clock,
+// together with the relay side of each hop
+func newPaddingTestCircuit(t *testing.T, n int) (*Circuit, []*Hop, *sendmeTestConn, *fakeClock) {
+	t.Helper()
+
+	c := NewCircuit(1)
+	relays := make([]*Hop, n)
+	for i := range relays {
+		keyMaterial := make([]byte, 72)
+		for j := range keyMaterial {
+			keyMaterial[j] = byte(i*72 + j)
+		}
+		client := &Hop{}
+		if err := installHopKeys(client, keyMaterial); err != nil {
+			t.Fatal(err)
+		}
+		swapped := append(append(append(append([]byte(nil), keyMaterial[20:40]...), keyMaterial[0:20]...), keyMaterial[56:72]...), keyMaterial[40:56]...)
+		relays[i] = &Hop{}
+		if err := installHopKeys(relays[i], swapped); err != nil {
+			t.Fatal(err)
+		}
+		c.Hops = append(c.Hops, client)
+	}
+
+	conn := &sendmeTestConn{}
+	c.SetConnection(conn)
+	c.SetState(StateOpen)
+	clock := newFakeClock()
+	c.SetPaddingClock(clock, rand.New(rand.NewPCG(1, 2)))
+	return c, relays, conn, clock
+}
+
+// paddingTestCell is a relay cell the client sent and the hop it reached
+type paddingTestCell struct {
+	hop  int
+	cell *cell.RelayCell
+}
+
+// readSent peels the onion layers off the cells the client has sent since
+// the last call, as the relays would
+func readSent(t *testing.T, relays []*Hop, conn *sendmeTestConn, seen *int) []paddingTestCell {
+	t.Helper()
+
+	sent := conn.sent()
+	var cells []paddingTestCell
+	for _, sentCell := range sent[*seen:] {
+		payload := append([]byte(nil), sentCell.Payload...)
+		hop := -1
+		for i, relay := range relays {
+			relay.BackwardCipher.XORKeyStream(payload, payload)
+			recognized, err := hopRecognizes(relay, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recognized {
+				hop = i
+				break
+			}
+		}
+		if hop < 0 {
+			t.Fatalf("Sent cell not recognized by any hop")
+		}
+		relayCell, err := cell.DecodeRelayCell(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cells = append(cells, paddingTestCell{hop: hop, cell: relayCell})
+	}
+	*seen = len(sent)
+	return cells
+}
+
+// cellFromHop encrypts a relay cell as hop i would send it to the client
+func cellFromHop(t *testing.T, relays []*Hop, i int, relayCell *cell.RelayCell) *cell.Cell {
+	t.Helper()
+
+	payload, err := relayCell.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relays[i].ForwardDigest.Write(payload)
+	copy(payload[5:9], relays[i].ForwardDigest.Sum(nil)[:4])
+	for j := i; j >= 0; j-- {
+		relays[j].ForwardCipher.XORKeyStream(payload, payload)
+	}
+	return &cell.Cell{CircID: 1, Command: cell.CmdRelay, Payload: payload}
+}
+
+// histogramMachine pads to the middle hop from a histogram once a cell is
+// sent, and ends when the tokens run out
+func histogramMachine() *PaddingMachineSpec {
+	return &PaddingMachineSpec{
+		Name:               "test_histogram",
+		MachineNum:         7,
+		TargetHop:          2,
+		ShouldNegotiateEnd: true,
+		States: []PaddingState{
+			{Next: map[PaddingEvent]int{PaddingEventNonPaddingSent: 1}},
+			{
+				Histogram:      []uint32{2, 1, 0},
+				HistogramEdges: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond},
+				Next:           map[PaddingEvent]int{PaddingEventBinsEmpty: PaddingStateEnd},
+			},
+		},
+	}
+}
+
+func TestDistributionSample(t *testing.T) {
+	tests := []struct {
+		name string
+		dist Distribution
+		mean float64
+	}{
+		{"uniform", Distribution{Type: DistUniform, Param1: 2, Param2: 6}, 4},
+		{"logistic", Distribution{Type: DistLogistic, Param1: 5, Param2: 1}, 5},
+		{"log-logistic", Distribution{Type: DistLogLogistic, Param1: 3, Param2: 4}, 3 * (math.Pi / 4) / math.Sin(math.Pi/4)},
+		{"geometric", Distribution{Type: DistGeometric, Param1: 0.25}, 4},
+		{"weibull", Distribution{Type: DistWeibull, Param1: 2, Param2: 1}, 2},
+		{"pareto", Distribution{Type: DistPareto, Param1: 1, Param2: 0.25}, 1 / (1 - 0.25)},
+		{"pareto exponential", Distribution{Type: DistPareto, Param1: 1}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewPCG(1, 2))
+			const n = 20000
+			sum := 0.0
+			for i := 0; i < n; i++ {
+				v := tt.dist.Sample(rng)
+				if v < 0 || math.IsNaN(v) {
+					t.Fatalf("Sample() = %v", v)
+				}
+				sum += v
+			}
+			if mean := sum / n; math.Abs(mean-tt.mean) > 0.05*tt.mean {
+				t.Errorf("Mean of %d samples = %.3f, want %.3f", n, mean, tt.mean)
+			}
+		})
+	}
+
+	if v := (Distribution{}).Sample(rand.New(rand.NewPCG(1, 2))); v != 0 {
+		t.Errorf("DistNone sample = %v, want 0", v)
+	}
+}
+
+func TestPaddingMachineValidate(t *testing.T) {
+	for _, spec := range []*PaddingMachineSpec{IntroCircuitPaddingMachine(), RendCircuitPaddingMachine(), histogramMachine()} {
+		if err := spec.Validate(); err != nil {
+			t.Errorf("Validate(%s) error = %v", spec.Name, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*PaddingMachineSpec)
+	}{
+		{"bad index", func(m *PaddingMachineSpec) { m.MachineIndex = PaddingMachineSlots }},
+		{"no target hop", func(m *PaddingMachineSpec) { m.TargetHop = 0 }},
+		{"percent above 100", func(m *PaddingMachineSpec) { m.MaxPaddingPercent = 101 }},
+		{"no states", func(m *PaddingMachineSpec) { m.States = nil }},
+		{"only infinity bin", func(m *PaddingMachineSpec) {
+			m.States[1].Histogram = []uint32{1}
+			m.States[1].HistogramEdges = []time.Duration{0}
+		}},
+		{"missing edges", func(m *PaddingMachineSpec) { m.States[1].HistogramEdges = m.States[1].HistogramEdges[:2] }},
+		{"decreasing edges", func(m *PaddingMachineSpec) { m.States[1].HistogramEdges[2] = 0 }},
+		{"unknown state", func(m *PaddingMachineSpec) { m.States[0].Next[PaddingEventNonPaddingRecv] = 5 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := histogramMachine()
+			tt.modify(spec)
+			if err := spec.Validate(); err == nil {
+				t.Error("Validate() accepted an invalid machine")
+			}
+		})
+	}
+}
+
+func TestPaddingNegotiateEncoding(t *testing.T) {
+	body := encodePaddingNegotiate(paddingCommandStart, PaddingMachineRendCircuit, 0x01020304)
+	if want := []byte{0, 2, 1, 0, 1, 2, 3, 4}; !bytes.Equal(body, want) {
+		t.Errorf("encodePaddingNegotiate() = %x, want %x", body, want)
+	}
+
+	command, response, machine, counter, err := parsePaddingNegotiated([]byte{0, 2, 1, 1, 0, 0, 0, 9})
+	if err != nil {
+		t.Fatalf("parsePaddingNegotiated() error = %v", err)
+	}
+	if command != paddingCommandStart || response != paddingResponseOK || machine != 1 || counter != 9 {
+		t.Errorf("parsePaddingNegotiated() = %d, %d, %d, %d", command, response, machine, counter)
+	}
+
+	for name, body := range map[string][]byte{
+		"short":        {0, 2, 1, 1},
+		"version":      {1, 2, 1, 1, 0, 0, 0, 9},
+		"bad response": {0, 2, 3, 1, 0, 0, 0, 9},
+	} {
+		if _, _, _, _, err := parsePaddingNegotiated(body); err == nil {
+			t.Errorf("parsePaddingNegotiated(%s) accepted %x", name, body)
+		}
+	}
+}
+
+func TestPaddingMachineHistogram(t *testing.T) {
+	c, relays, conn, clock := newPaddingTestCircuit(t, 3)
+	seen := 0
+
+	if err := c.StartPaddingMachine(histogramMachine()); err != nil {
+		t.Fatalf("StartPaddingMachine failed: %v", err)
+	}
+	sent := readSent(t, relays, conn, &seen)
+	if len(sent) != 1 || sent[0].hop != 1 || sent[0].cell.Command != cell.RelayPaddingNegotiate {
+		t.Fatalf("Expected PADDING_NEGOTIATE to the middle hop, got %+v", sent)
+	}
+	if want := encodePaddingNegotiate(paddingCommandStart, 7, 1); !bytes.Equal(sent[0].cell.Data, want) {
+		t.Errorf("PADDING_NEGOTIATE body = %x, want %x", sent[0].cell.Data, want)
+	}
+
+	// The start state has no delay, so nothing is padded until a cell is sent
+	clock.Advance(time.Second)
+	if got := readSent(t, relays, conn, &seen); len(got) != 0 {
+		t.Fatalf("Padding sent before any traffic: %+v", got)
+	}
+
+	if err := c.SendRelayCell(cell.NewRelayCell(1, cell.RelayData, []byte("x"))); err != nil {
+		t.Fatalf("SendRelayCell failed: %v", err)
+	}
+	readSent(t, relays, conn, &seen)
+	if stats, _ := c.PaddingMachineStats(0); stats.State != 1 || stats.NonPaddingSent != 1 {
+		t.Fatalf("Machine stats after a data cell = %+v", stats)
+	}
+
+	// Each of the three tokens yields one DROP to the middle hop after a
+	// delay from its bin; with the bins empty the machine ends
+	var delays []time.Duration
+	last := clock.Now()
+	for i := 0; i < 100 && len(delays) < 3; i++ {
+		clock.Advance(time.Millisecond)
+		for _, got := range readSent(t, relays, conn, &seen) {
+			if got.hop != 1 || got.cell.Command != cell.RelayDrop {
+				t.Fatalf("Expected DROP to the middle hop, got %s to hop %d", cell.RelayCmdString(got.cell.Command), got.hop)
+			}
+			delays = append(delays, clock.Now().Sub(last))
+			last = clock.Now()
+		}
+	}
+	if len(delays) != 3 {
+		t.Fatalf("Sent %d padding cells, want 3", len(delays))
+	}
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	// Delays are measured to the millisecond step in which the cell went out
+	if delays[0] < 10*time.Millisecond || delays[1] > 21*time.Millisecond ||
+		delays[2] < 19*time.Millisecond || delays[2] > 31*time.Millisecond {
+		t.Errorf("Padding delays %v do not match the histogram bins", delays)
+	}
+
+	// Ending the machine frees its slot and stops the relay's side
+	if _, ok := c.PaddingMachineStats(0); ok {
+		t.Error("Machine still running with empty bins")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		sent := readSent(t, relays, conn, &seen)
+		if len(sent) == 1 {
+			if sent[0].hop != 1 || !bytes.Equal(sent[0].cell.Data, encodePaddingNegotiate(paddingCommandStop, 7, 1)) {
+				t.Errorf("Expected PADDING_NEGOTIATE STOP to the middle hop, got %x to hop %d", sent[0].cell.Data, sent[0].hop)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No PADDING_NEGOTIATE STOP after the machine ended")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPaddingNonPaddingCancelsScheduledPadding(t *testing.T) {
+	c, relays, conn, clock := newPaddingTestCircuit(t, 3)
+	seen := 0
+	spec := histogramMachine()
+	spec.States[1].Histogram = []uint32{5, 0, 0}
+	if err := c.StartPaddingMachine(spec); err != nil {
+		t.Fatalf("StartPaddingMachine failed: %v", err)
+	}
+
+	// Traffic every 5ms keeps ahead of padding scheduled 10-20ms out
+	for i := 0; i < 20; i++ {
+		if err := c.SendRelayCell(cell.NewRelayCell(1, cell.RelayData, []byte("x"))); err != nil {
+			t.Fatalf("SendRelayCell failed: %v", err)
+		}
+		clock.Advance(5 * time.Millisecond)
+	}
+	for _, got := range readSent(t, relays, conn, &seen) {
+		if got.cell.Command == cell.RelayDrop {
+			t.Fatal("Padding sent while real traffic kept the circuit busy")
+		}
+	}
+	stats, _ := c.PaddingMachineStats(0)
+	if stats.PaddingSent != 0 || stats.NonPaddingSent != 20 {
+		t.Errorf("Machine stats = %+v", stats)
+	}
+
+	// Once traffic stops the padding goes out
+	clock.Advance(20 * time.Millisecond)
+	if stats, _ := c.PaddingMachineStats(0); stats.PaddingSent != 1 {
+		t.Errorf("PaddingSent after going idle = %d, want 1", stats.PaddingSent)
+	}
+}
+
+func TestPaddingTokenRemoval(t *testing.T) {
+	tests := []struct {
+		name    string
+		removal TokenRemoval
+		elapsed time.Duration
+		want    []uint32
+	}{
+		{"none", TokenRemovalNone, 16 * time.Millisecond, []uint32{1, 0, 1, 1, 1}},
+		{"exact empty bin", TokenRemovalExact, 16 * time.Millisecond, []uint32{1, 0, 1, 1, 1}},
+		{"exact", TokenRemovalExact, 25 * time.Millisecond, []uint32{1, 0, 0, 1, 1}},
+		{"lower", TokenRemovalLower, 16 * time.Millisecond, []uint32{0, 0, 1, 1, 1}},
+		{"higher", TokenRemovalHigher, 16 * time.Millisecond, []uint32{1, 0, 0, 1, 1}},
+		{"closest bin", TokenRemovalClosest, 16 * time.Millisecond, []uint32{0, 0, 1, 1, 1}},
+		{"closest delay", TokenRemovalClosestUsec, 16 * time.Millisecond, []uint32{1, 0, 0, 1, 1}},
+		{"beyond the last bin", TokenRemovalExact, time.Hour, []uint32{1, 0, 1, 0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _, clock := newPaddingTestCircuit(t, 1)
+			spec := &PaddingMachineSpec{
+				Name:      "test_removal",
+				TargetHop: 1,
+				States: []PaddingState{{
+					Histogram:      []uint32{1, 0, 1, 1, 1},
+					HistogramEdges: []time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 40 * time.Millisecond},
+					TokenRemoval:   tt.removal,
+				}},
+			}
+			m := &paddingMachine{spec: spec, tokens: slices.Clone(spec.States[0].Histogram), chosenBin: -1}
+			m.scheduledAt = clock.Now()
+			clock.Advance(tt.elapsed)
+
+			c.paddingMu.Lock()
+			c.removeToken(m)
+			c.paddingMu.Unlock()
+			if !slices.Equal(m.tokens, tt.want) {
+				t.Errorf("Tokens after removal = %v, want %v", m.tokens, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaddingAllowed(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowed         uint64
+		percent         uint8
+		padding, normal uint64
+		want            bool
+	}{
+		{"no limit", 0, 0, 1000, 0, true},
+		{"within allowed count", 10, 50, 9, 0, true},
+		{"percent reached", 10, 50, 10, 10, false},
+		{"below percent", 10, 50, 10, 11, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &paddingMachine{
+				spec:           &PaddingMachineSpec{AllowedPaddingCount: tt.allowed, MaxPaddingPercent: tt.percent},
+				paddingSent:    tt.padding,
+				nonPaddingSent: tt.normal,
+			}
+			if got := m.paddingAllowed(); got != tt.want {
+				t.Errorf("paddingAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaddingNegotiated(t *testing.T) {
+	negotiated := func(response byte, counter uint32) *cell.RelayCell {
+		body := []byte{paddingNegotiateVersion, paddingCommandStart, response, 7, 0, 0, 0, byte(counter)}
+		return cell.NewRelayCell(0, cell.RelayPaddingNegotiated, body)
+	}
+
+	c, relays, _, _ := newPaddingTestCircuit(t, 3)
+	if err := c.StartPaddingMachine(histogramMachine()); err != nil {
+		t.Fatalf("StartPaddingMachine failed: %v", err)
+	}
+	if err := c.StartPaddingMachine(histogramMachine()); err == nil {
+		t.Error("Started a second machine in the same slot")
+	}
+
+	if err := c.DeliverRelayCell(cellFromHop(t, relays, 1, negotiated(paddingResponseOK, 1))); err != nil {
+		t.Fatalf("DeliverRelayCell failed: %v", err)
+	}
+	if stats, ok := c.PaddingMachineStats(0); !ok || !stats.Negotiated {
+		t.Errorf("Machine not negotiated after OK: %+v", stats)
+	}
+
+	// A refusal for an earlier machine is ignored; one for this machine ends it
+	if err := c.DeliverRelayCell(cellFromHop(t, relays, 1, negotiated(paddingResponseErr, 0))); err != nil {
+		t.Fatalf("DeliverRelayCell failed: %v", err)
+	}
+	if _, ok := c.PaddingMachineStats(0); !ok {
+		t.Fatal("Stale refusal stopped the machine")
+	}
+	if err := c.DeliverRelayCell(cellFromHop(t, relays, 1, negotiated(paddingResponseErr, 1))); err != nil {
+		t.Fatalf("DeliverRelayCell failed: %v", err)
+	}
+	if _, ok := c.PaddingMachineStats(0); ok {
+		t.Error("Machine still running after the relay refused it")
+	}
+
+	select {
+	case got := <-c.relayReceiveChan:
+		t.Errorf("PADDING_NEGOTIATED delivered to the application: %s", cell.RelayCmdString(got.Command))
+	default:
+	}
+}
+
+func TestPaddingStartRequirements(t *testing.T) {
+	c, _, _, _ := newPaddingTestCircuit(t, 1)
+	if err := c.StartPaddingMachine(histogramMachine()); err == nil {
+		t.Error("Started a machine targeting hop 2 of a one-hop circuit")
+	}
+
+	c, _, _, _ = newPaddingTestCircuit(t, 3)
+	c.SetPaddingEnabled(false)
+	if err := c.StartPaddingMachine(histogramMachine()); err == nil {
+		t.Error("Started a machine with padding disabled")
+	}
+
+	c, _, _, _ = newPaddingTestCircuit(t, 3)
+	if err := c.StopPaddingMachine(0); err == nil {
+		t.Error("Stopped a machine that is not running")
+	}
+	if err := c.StartPaddingMachine(histogramMachine()); err != nil {
+		t.Fatalf("StartPaddingMachine failed: %v", err)
+	}
+	c.Close()
+	if _, ok := c.PaddingMachineStats(0); ok {
+		t.Error("Machine still running after the circuit closed")
+	}
+}
+
+func TestPaddingReceivedFromTargetHop(t *testing.T) {
+	c, relays, _, _ := newPaddingTestCircuit(t, 3)
+	spec := &PaddingMachineSpec{
+		Name:      "test_recv",
+		TargetHop: 2,
+		States: []PaddingState{
+			{Next: map[PaddingEvent]int{PaddingEventPaddingRecv: 1}},
+			{Next: map[PaddingEvent]int{PaddingEventNonPaddingRecv: PaddingStateEnd}},
+		},
+	}
+	if err := c.StartPaddingMachine(spec); err != nil {
+		t.Fatalf("StartPaddingMachine failed: %v", err)
+	}
+
+	// Padding from the guard is not for this machine
+	if err := c.DeliverRelayCell(cellFromHop(t, relays, 0, cell.NewRelayCell(0, cell.RelayDrop, nil))); err != nil {
+		t.Fatalf("DeliverRelayCell failed: %v", err)
+	}
+	if stats, _ := c.PaddingMachineStats(0); stats.State != 0 {
+		t.Fatalf("Guard padding moved the machine to state %d", stats.State)
+	}
+
+	if err := c.DeliverRelayCell(cellFromHop(t, relays, 1, cell.NewRelayCell(0, cell.RelayDrop, nil))); err != nil {
+		t.Fatalf("DeliverRelayCell failed: %v", err)
+	}
+	if stats, _ := c.PaddingMachineStats(0); stats.State != 1 {
+		t.Fatalf("Middle padding left the machine in state %d", stats.State)
+	}
+	select {
+	case <-c.relayReceiveChan:
+		t.Error("DROP delivered to the application")
+	default:
+	}
+
+	if err := c.DeliverRelayCell(cellFromHop(t, relays, 2, cell.NewRelayCell(1, cell.RelayData, []byte("x")))); err != nil {
+		t.Fatalf("DeliverRelayCell failed: %v", err)
+	}
+	if _, ok := c.PaddingMachineStats(0); ok {
+		t.Error("Machine still running after reaching its end state")
+	}
+}
+
+func TestCircuitSetupPaddingMachines(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       *PaddingMachineSpec
+		trigger    func(*testing.T, *Circuit, []*Hop)
+		minPadding int
+		maxPadding int
+	}{
+		{
+			name: "introduction",
+			spec: IntroCircuitPaddingMachine(),
+			trigger: func(t *testing.T, c *Circuit, _ []*Hop) {
+				if err := c.SendRelayCell(cell.NewRelayCell(0, cell.RelayIntroduce1, []byte("introduce"))); err != nil {
+					t.Fatal(err)
+				}
+			},
+			minPadding: introMachineMinPadding,
+			maxPadding: introMachineMaxPadding,
+		},
+		{
+			name: "rendezvous",
+			spec: RendCircuitPaddingMachine(),
+			trigger: func(t *testing.T, c *Circuit, relays []*Hop) {
+				established := cellFromHop(t, relays, 2, cell.NewRelayCell(0, cell.RelayRendezvousEstablished, nil))
+				if err := c.DeliverRelayCell(established); err != nil {
+					t.Fatal(err)
+				}
+			},
+			minPadding: 1,
+			maxPadding: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, relays, conn, clock := newPaddingTestCircuit(t, 3)
+			seen := 0
+			if err := c.StartPaddingMachine(tt.spec); err != nil {
+				t.Fatalf("StartPaddingMachine failed: %v", err)
+			}
+			readSent(t, relays, conn, &seen)
+
+			tt.trigger(t, c, relays)
+			for i := 0; i < 20; i++ {
+				clock.Advance(time.Microsecond)
+			}
+
+			padding := 0
+			for _, got := range readSent(t, relays, conn, &seen) {
+				if got.cell.Command == cell.RelayDrop {
+					if got.hop != 1 {
+						t.Errorf("Padding sent to hop %d, want the middle hop", got.hop)
+					}
+					padding++
+				}
+			}
+			if padding < tt.minPadding || padding > tt.maxPadding {
+				t.Errorf("Sent %d padding cells, want %d-%d", padding, tt.minPadding, tt.maxPadding)
+			}
+			if _, ok := c.PaddingMachineStats(tt.spec.MachineIndex); ok {
+				t.Error("Machine still running after its padding burst")
+			}
+		})
+	}
+}
+
+func TestPaddingMachineFakeNetwork(t *testing.T) {
+	network, testPath := newFakeNetworkPath(t)
+	builder := NewBuilder(NewManager(), logger.NewDefault())
+
+	circuit, err := builder.BuildCircuit(context.Background(), testPath, 10*time.Second)
+	if err != nil {
+		t.Fatalf("BuildCircuit failed: %v", err)
+	}
+	defer circuit.Close()
+
+	if err := circuit.StartPaddingMachine(IntroCircuitPaddingMachine()); err != nil {
+		t.Fatalf("StartPaddingMachine failed: %v", err)
+	}
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor("PADDING_NEGOTIATED", func() bool {
+		stats, _ := circuit.PaddingMachineStats(0)
+		return stats.Negotiated
+	})
+
+	// The first real cell sets off the burst of padding to the middle relay
+	if err := circuit.OpenStream(1, "example.com", 80); err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	middle := network.Relays()[1]
+	waitFor("the machine to end", func() bool {
+		_, stopped := middle.PaddingNegotiationCount()
+		return stopped == 1
+	})
+
+	if started, _ := middle.PaddingNegotiationCount(); started != 1 {
+		t.Errorf("Middle relay started %d machines, want 1", started)
+	}
+	if padding := middle.PaddingCellCount(); padding < introMachineMinPadding || padding > introMachineMaxPadding {
+		t.Errorf("Middle relay received %d padding cells, want %d-%d", padding, introMachineMinPadding, introMachineMaxPadding)
+	}
+	for _, relay := range []int{0, 2} {
+		if padding := network.Relays()[relay].PaddingCellCount(); padding != 0 {
+			t.Errorf("Relay %d received %d padding cells", relay, padding)
+		}
+	}
+}
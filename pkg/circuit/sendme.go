@@ -0,0 +1,174 @@
+package circuit
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"sync"
+)
+
+// Flow control windows (tor-spec.txt §7.3, §7.4)
+const (
+	// CircuitWindowStart is the initial circuit-level package and deliver window
+	CircuitWindowStart = 1000
+	// CircuitWindowIncrement is the number of cells acknowledged by a circuit-level SENDME
+	CircuitWindowIncrement = 100
+	// StreamWindowStart is the initial stream-level package and deliver window
+	StreamWindowStart = 500
+	// StreamWindowIncrement is the number of cells acknowledged by a stream-level SENDME
+	StreamWindowIncrement = 50
+)
+
+// Authenticated SENDME (prop289, tor-spec.txt §7.4)
+const (
+	sendmeVersion1  = 1
+	sendmeDigestLen = 20
+
+	// destroyReasonProtocol is the DESTROY reason for a protocol violation
+	destroyReasonProtocol byte = 1 // PROTOCOL
+)
+
+// encodeSendmeV1 builds a version 1 SENDME body carrying the digest of the
+// cell being acknowledged: VERSION (1) | DATA_LEN (2) | DATA
+func encodeSendmeV1(digest []byte) []byte {
+	payload := []byte{sendmeVersion1, 0, sendmeDigestLen}
+	return append(payload, digest[:sendmeDigestLen]...)
+}
+
+// parseSendme parses a circuit-level SENDME body and returns the
+// authenticated digest. Version 0 (empty) SENDMEs are rejected.
+func parseSendme(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] == 0 {
+		return nil, fmt.Errorf("unauthenticated SENDME (version 0) not accepted")
+	}
+	if data[0] != sendmeVersion1 {
+		return nil, fmt.Errorf("unsupported SENDME version %d", data[0])
+	}
+	if len(data) < 3 {
+		return nil, fmt.Errorf("truncated SENDME")
+	}
+	dataLen := int(data[1])<<8 | int(data[2])
+	if dataLen != sendmeDigestLen || len(data) < 3+dataLen {
+		return nil, fmt.Errorf("invalid SENDME digest length: %d", dataLen)
+	}
+	return data[3 : 3+dataLen], nil
+}
+
+// verifySendmeDigest compares a received SENDME digest with the digest
+// recorded when the acknowledged cell was sent
+func verifySendmeDigest(expected, received []byte) error {
+	if subtle.ConstantTimeCompare(expected, received) != 1 {
+		return fmt.Errorf("SENDME digest mismatch")
+	}
+	return nil
+}
+
+// StreamWindow tracks the stream-level package and deliver windows of one
+// stream (tor-spec.txt §7.4). Senders block in Acquire while the package
+// window is exhausted until the other side acknowledges data with a SENDME.
+type StreamWindow struct {
+	mu            sync.Mutex
+	packageWindow int
+	deliverWindow int
+	opened        chan struct{} // Closed and replaced when the package window reopens
+}
+
+// NewStreamWindow returns windows at StreamWindowStart
+func NewStreamWindow() *StreamWindow {
+	return &StreamWindow{
+		packageWindow: StreamWindowStart,
+		deliverWindow: StreamWindowStart,
+		opened:        make(chan struct{}),
+	}
+}
+
+// Acquire takes one cell from the package window, blocking while it is
+// exhausted. It returns ctx.Err() if ctx ends, or an error if done is closed.
+func (w *StreamWindow) Acquire(ctx context.Context, done <-chan struct{}) error {
+	for {
+		w.mu.Lock()
+		if w.packageWindow > 0 {
+			w.packageWindow--
+			w.mu.Unlock()
+			return nil
+		}
+		opened := w.opened
+		w.mu.Unlock()
+
+		select {
+		case <-opened:
+		case <-done:
+			return fmt.Errorf("stream closed while waiting for SENDME")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release returns a cell taken with Acquire that was never sent
+func (w *StreamWindow) Release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.packageWindow++
+	w.wake()
+}
+
+// Sendme handles a stream-level SENDME, reopening the package window. A
+// SENDME that would grow the window past its start is a protocol violation.
+func (w *StreamWindow) Sendme() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.packageWindow+StreamWindowIncrement > StreamWindowStart {
+		return fmt.Errorf("unexpected stream-level SENDME: package window %d", w.packageWindow)
+	}
+	w.packageWindow += StreamWindowIncrement
+	w.wake()
+	return nil
+}
+
+// Deliver accounts for one received DATA cell. The peer must not send more
+// than the deliver window allows.
+func (w *StreamWindow) Deliver() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.deliverWindow <= 0 {
+		return fmt.Errorf("stream deliver window exhausted")
+	}
+	w.deliverWindow--
+	return nil
+}
+
+// SendmeDue reports whether enough data has been delivered that a
+// stream-level SENDME must be sent, and credits the deliver window if so
+func (w *StreamWindow) SendmeDue() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.deliverWindow > StreamWindowStart-StreamWindowIncrement {
+		return false
+	}
+	w.deliverWindow += StreamWindowIncrement
+	return true
+}
+
+// PackageWindow returns the number of cells that may be sent before a SENDME
+func (w *StreamWindow) PackageWindow() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.packageWindow
+}
+
+// DeliverWindow returns the number of cells the peer may send before a SENDME
+func (w *StreamWindow) DeliverWindow() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.deliverWindow
+}
+
+// wake releases senders blocked in Acquire; w.mu must be held
+func (w *StreamWindow) wake() {
+	close(w.opened)
+	w.opened = make(chan struct{})
+}
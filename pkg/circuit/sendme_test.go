@@ -0,0 +1,332 @@
+package circuit
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+)
+
+func TestSendmeEncoding(t *testing.T) {
+	digest := bytes.Repeat([]byte{0xAB}, 32)
+
+	body := encodeSendmeV1(digest)
+	if len(body) != 3+sendmeDigestLen || body[0] != sendmeVersion1 || body[2] != sendmeDigestLen {
+		t.Fatalf("encodeSendmeV1() = %x", body)
+	}
+	parsed, err := parseSendme(body)
+	if err != nil {
+		t.Fatalf("parseSendme() error = %v", err)
+	}
+	if !bytes.Equal(parsed, digest[:sendmeDigestLen]) {
+		t.Errorf("parseSendme() digest = %x", parsed)
+	}
+
+	for name, body := range map[string][]byte{
+		"empty":       nil,
+		"version 0":   {0, 0, 0},
+		"version 2":   {2, 0, sendmeDigestLen},
+		"short":       {sendmeVersion1, 0},
+		"bad length":  {sendmeVersion1, 0, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		"truncated":   {sendmeVersion1, 0, sendmeDigestLen, 1, 2, 3},
+		"long digest": append([]byte{sendmeVersion1, 0, 32}, digest...),
+	} {
+		if _, err := parseSendme(body); err == nil {
+			t.Errorf("parseSendme(%s) accepted %x", name, body)
+		}
+	}
+}
+
+func TestStreamWindowPackage(t *testing.T) {
+	window := NewStreamWindow()
+	for i := 0; i < StreamWindowStart; i++ {
+		if err := window.Acquire(context.Background(), nil); err != nil {
+			t.Fatalf("Acquire %d failed: %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := window.Acquire(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire on exhausted window = %v, want DeadlineExceeded", err)
+	}
+
+	// A SENDME wakes a blocked sender
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- window.Acquire(context.Background(), nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := window.Sendme(); err != nil {
+		t.Fatalf("Sendme() error = %v", err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("Acquire after SENDME failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire still blocked after SENDME")
+	}
+	if got := window.PackageWindow(); got != StreamWindowIncrement-1 {
+		t.Errorf("PackageWindow() = %d, want %d", got, StreamWindowIncrement-1)
+	}
+
+	// Closing done releases a blocked sender
+	full := NewStreamWindow()
+	for i := 0; i < StreamWindowStart; i++ {
+		_ = full.Acquire(context.Background(), nil)
+	}
+	done := make(chan struct{})
+	close(done)
+	if err := full.Acquire(context.Background(), done); err == nil {
+		t.Error("Acquire succeeded after done was closed")
+	}
+
+	// The exit may not acknowledge more than we sent
+	if err := NewStreamWindow().Sendme(); err == nil {
+		t.Error("Sendme() on a full window succeeded")
+	}
+}
+
+func TestStreamWindowDeliver(t *testing.T) {
+	window := NewStreamWindow()
+	sendmes := 0
+	for i := 0; i < 2*StreamWindowStart; i++ {
+		if err := window.Deliver(); err != nil {
+			t.Fatalf("Deliver %d failed: %v", i, err)
+		}
+		if window.SendmeDue() {
+			sendmes++
+		}
+	}
+	if sendmes != 2*StreamWindowStart/StreamWindowIncrement {
+		t.Errorf("SendmeDue fired %d times, want %d", sendmes, 2*StreamWindowStart/StreamWindowIncrement)
+	}
+
+	// Without SENDMEs the exit may send at most StreamWindowStart cells
+	window = NewStreamWindow()
+	for i := 0; i < StreamWindowStart; i++ {
+		if err := window.Deliver(); err != nil {
+			t.Fatalf("Deliver %d failed: %v", i, err)
+		}
+	}
+	if err := window.Deliver(); err == nil {
+		t.Error("Deliver beyond the window succeeded")
+	}
+}
+
+// sendmeTestConn records the cells a circuit sends
+type sendmeTestConn struct {
+	mu    sync.Mutex
+	cells []*cell.Cell
+}
+
+func (c *sendmeTestConn) SendCell(sent *cell.Cell) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cells = append(c.cells, sent)
+	return nil
+}
+
+func (c *sendmeTestConn) sent() []*cell.Cell {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*cell.Cell(nil), c.cells...)
+}
+
+// newSendmeTestCircuit returns an open one-hop circuit and the relay's side
+// of the hop, whose forward crypto produces cells the client accepts
+func newSendmeTestCircuit(t *testing.T) (*Circuit, *Hop, *sendmeTestConn) {
+	t.Helper()
+
+	keyMaterial := make([]byte, 72)
+	for i := range keyMaterial {
+		keyMaterial[i] = byte(i)
+	}
+	client := &Hop{}
+	if err := installHopKeys(client, keyMaterial); err != nil {
+		t.Fatal(err)
+	}
+	// The relay uses Db/Kb for what it sends and Df/Kf for what it receives
+	swapped := append(append(append(append([]byte(nil), keyMaterial[20:40]...), keyMaterial[0:20]...), keyMaterial[56:72]...), keyMaterial[40:56]...)
+	relay := &Hop{}
+	if err := installHopKeys(relay, swapped); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCircuit(1)
+	c.Hops = append(c.Hops, client)
+	conn := &sendmeTestConn{}
+	c.SetConnection(conn)
+	c.SetState(StateOpen)
+	return c, relay, conn
+}
+
+// relayCellFrom encrypts a relay cell as the relay would send it to the client
+func relayCellFrom(t *testing.T, relay *Hop, relayCell *cell.RelayCell) *cell.Cell {
+	t.Helper()
+
+	payload, err := relayCell.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.ForwardDigest.Write(payload)
+	copy(payload[5:9], relay.ForwardDigest.Sum(nil)[:4])
+	relay.ForwardCipher.XORKeyStream(payload, payload)
+	return &cell.Cell{CircID: 1, Command: cell.CmdRelay, Payload: payload}
+}
+
+func TestCircuitSendmeAuthentication(t *testing.T) {
+	t.Run("valid digest", func(t *testing.T) {
+		c, relay, _ := newSendmeTestCircuit(t)
+		for i := 0; i < CircuitWindowIncrement; i++ {
+			if err := c.SendRelayCell(cell.NewRelayCell(1, cell.RelayData, []byte("x"))); err != nil {
+				t.Fatalf("SendRelayCell %d failed: %v", i, err)
+			}
+		}
+		if len(c.sendmeDigests) != 1 {
+			t.Fatalf("Recorded %d SENDME digests, want 1", len(c.sendmeDigests))
+		}
+
+		sendme := cell.NewRelayCell(0, cell.RelaySendme, encodeSendmeV1(c.sendmeDigests[0]))
+		if err := c.DeliverRelayCell(relayCellFrom(t, relay, sendme)); err != nil {
+			t.Fatalf("DeliverRelayCell(SENDME) failed: %v", err)
+		}
+		if c.packageWindow != CircuitWindowStart || len(c.sendmeDigests) != 0 {
+			t.Errorf("packageWindow = %d with %d digests outstanding", c.packageWindow, len(c.sendmeDigests))
+		}
+	})
+
+	for name, body := range map[string]func(expected []byte) []byte{
+		"wrong digest": func([]byte) []byte { return encodeSendmeV1(make([]byte, sendmeDigestLen)) },
+		"version 0":    func([]byte) []byte { return nil },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, relay, conn := newSendmeTestCircuit(t)
+			for i := 0; i < CircuitWindowIncrement; i++ {
+				_ = c.SendRelayCell(cell.NewRelayCell(1, cell.RelayData, []byte("x")))
+			}
+
+			sendme := cell.NewRelayCell(0, cell.RelaySendme, body(c.sendmeDigests[0]))
+			if err := c.DeliverRelayCell(relayCellFrom(t, relay, sendme)); err == nil {
+				t.Fatal("DeliverRelayCell accepted an unauthenticated SENDME")
+			}
+			if c.GetState() != StateFailed {
+				t.Errorf("Circuit state = %s, want FAILED", c.GetState())
+			}
+			sent := conn.sent()
+			if last := sent[len(sent)-1]; last.Command != cell.CmdDestroy || last.Payload[0] != destroyReasonProtocol {
+				t.Errorf("Last cell sent = %s %x, want DESTROY(PROTOCOL)", last.Command, last.Payload)
+			}
+		})
+	}
+
+	t.Run("unexpected SENDME", func(t *testing.T) {
+		c, relay, _ := newSendmeTestCircuit(t)
+		sendme := cell.NewRelayCell(0, cell.RelaySendme, encodeSendmeV1(make([]byte, sendmeDigestLen)))
+		if err := c.DeliverRelayCell(relayCellFrom(t, relay, sendme)); err == nil {
+			t.Fatal("DeliverRelayCell accepted a SENDME with nothing outstanding")
+		}
+	})
+}
+
+func TestCircuitSendsAuthenticatedSendme(t *testing.T) {
+	c, relay, conn := newSendmeTestCircuit(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := c.ReceiveRelayCell(ctx); err != nil {
+				return
+			}
+		}
+	}()
+
+	var expected []byte
+	for i := 0; i < CircuitWindowIncrement; i++ {
+		if err := c.DeliverRelayCell(relayCellFrom(t, relay, cell.NewRelayCell(1, cell.RelayData, []byte("x")))); err != nil {
+			t.Fatalf("DeliverRelayCell %d failed: %v", i, err)
+		}
+		expected = relay.ForwardDigest.Sum(nil)[:sendmeDigestLen]
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(conn.sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	sent := conn.sent()
+	if len(sent) != 1 {
+		t.Fatalf("Client sent %d cells, want one SENDME", len(sent))
+	}
+
+	payload := append([]byte(nil), sent[0].Payload...)
+	relay.BackwardCipher.XORKeyStream(payload, payload)
+	sendme, err := cell.DecodeRelayCell(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendme.Command != cell.RelaySendme || sendme.StreamID != 0 {
+		t.Fatalf("Client sent %s on stream %d", cell.RelayCmdString(sendme.Command), sendme.StreamID)
+	}
+	digest, err := parseSendme(sendme.Data)
+	if err != nil {
+		t.Fatalf("Client SENDME is not version 1: %v", err)
+	}
+	if !bytes.Equal(digest, expected) {
+		t.Errorf("SENDME digest = %x, want %x", digest, expected)
+	}
+}
+
+func TestWriteToStreamBlocksOnWindow(t *testing.T) {
+	c, relay, _ := newSendmeTestCircuit(t)
+	for i := 0; i < StreamWindowStart; i++ {
+		if err := c.WriteToStream(1, []byte("x")); err != nil {
+			t.Fatalf("WriteToStream %d failed: %v", i, err)
+		}
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- c.WriteToStream(1, []byte("x"))
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("WriteToStream beyond the stream window returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := c.DeliverRelayCell(relayCellFrom(t, relay, cell.NewRelayCell(1, cell.RelaySendme, nil))); err != nil {
+		t.Fatalf("DeliverRelayCell(stream SENDME) failed: %v", err)
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("WriteToStream after SENDME failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WriteToStream still blocked after stream SENDME")
+	}
+
+	// Closing the circuit releases blocked writers
+	for c.streamWindow(1).PackageWindow() > 0 {
+		_ = c.WriteToStream(1, []byte("x"))
+	}
+	go func() {
+		written <- c.WriteToStream(1, []byte("x"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Error("WriteToStream succeeded on a closed circuit")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WriteToStream still blocked after Close")
+	}
+}
@@ -3,26 +3,35 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"runtime/debug"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/opd-ai/go-tor/pkg/autoconfig"
 	"github.com/opd-ai/go-tor/pkg/circuit"
 	"github.com/opd-ai/go-tor/pkg/config"
+	"github.com/opd-ai/go-tor/pkg/connection"
 	"github.com/opd-ai/go-tor/pkg/control"
 	"github.com/opd-ai/go-tor/pkg/directory"
 	"github.com/opd-ai/go-tor/pkg/health"
 	"github.com/opd-ai/go-tor/pkg/httpmetrics"
 	"github.com/opd-ai/go-tor/pkg/logger"
 	"github.com/opd-ai/go-tor/pkg/metrics"
+	"github.com/opd-ai/go-tor/pkg/onion"
 	"github.com/opd-ai/go-tor/pkg/path"
 	"github.com/opd-ai/go-tor/pkg/pool"
 	"github.com/opd-ai/go-tor/pkg/socks"
 )
 
+// consensusRetryInterval is how long to wait before retrying a failed consensus refresh
+const consensusRetryInterval = 1 * time.Minute
+
 // parseIsolationLevel converts a string isolation level to circuit.IsolationLevel
 func parseIsolationLevel(level string) circuit.IsolationLevel {
 	parsed, err := circuit.ParseIsolationLevel(level)
@@ -46,6 +55,12 @@ type Client struct {
 	guardManager  *path.GuardManager
 	metrics       *metrics.Metrics
 
+	// Onion services hosted from HiddenServiceDir/HiddenServicePort
+	onionServices []*onion.Service
+
+	// Node restrictions from ExcludeNodes/ExcludeExitNodes/EntryNodes/ExitNodes/StrictNodes
+	nodeRestrictions *path.NodeRestrictions
+
 	// Circuit management with advanced pooling (Phase 9.4)
 	circuitPool *pool.CircuitPool
 	circuits    []*circuit.Circuit // Legacy circuit list for backward compatibility
@@ -87,6 +102,25 @@ func New(cfg *config.Config, log *logger.Logger) (*Client, error) {
 
 	// Initialize directory client
 	dirClient := directory.NewClient(log)
+	certCache, err := directory.NewAuthorityCertCache(cfg.DataDirectory, log)
+	if err != nil {
+		cancel() // Clean up context on error
+		return nil, fmt.Errorf("failed to create authority certificate cache: %w", err)
+	}
+	dirClient.SetAuthorityCertCache(certCache)
+	if err := configureDirectorySources(dirClient, cfg); err != nil {
+		cancel() // Clean up context on error
+		return nil, err
+	}
+	dirClient.EnableConsensusCache(cfg.DataDirectory)
+	if cfg.UseMicrodescriptors {
+		mdCache, err := directory.NewMicrodescCache(cfg.DataDirectory, log)
+		if err != nil {
+			cancel() // Clean up context on error
+			return nil, fmt.Errorf("failed to create microdescriptor cache: %w", err)
+		}
+		dirClient.EnableMicrodescriptors(mdCache)
+	}
 
 	// Initialize circuit manager
 	circuitMgr := circuit.NewManager()
@@ -101,6 +135,34 @@ func New(cfg *config.Config, log *logger.Logger) (*Client, error) {
 		IsolateClientPort:   cfg.IsolateClientPort,
 	}
 	socksServer := socks.NewServerWithConfig(socksAddr, circuitMgr, log, socksConfig)
+	if cfg.ClientOnionAuthDir != "" {
+		keys, err := onion.LoadClientAuthDir(cfg.ClientOnionAuthDir, log)
+		if err != nil {
+			cancel() // Clean up context on error
+			return nil, fmt.Errorf("failed to load onion service client authorization: %w", err)
+		}
+		socksServer.SetOnionClientAuthKeys(keys)
+		log.Info("Loaded onion service client authorization keys", "count", len(keys))
+	}
+	socksServer.SetOnionMaxPoWEffort(uint32(cfg.ClientOnionMaxPoWEffort))
+
+	// Load or create the keys of hosted onion services, so the onion
+	// addresses are known (and written to each hostname file) at startup
+	serviceConfigs, err := onionServiceConfigs(cfg.OnionServices)
+	if err != nil {
+		cancel() // Clean up context on error
+		return nil, err
+	}
+	var onionServices []*onion.Service
+	for _, serviceConfig := range serviceConfigs {
+		service, err := onion.NewService(serviceConfig, log)
+		if err != nil {
+			cancel() // Clean up context on error
+			return nil, fmt.Errorf("failed to load onion service in %s: %w", serviceConfig.DataDirectory, err)
+		}
+		log.Info("Loaded onion service", "address", service.GetAddress(), "dir", serviceConfig.DataDirectory)
+		onionServices = append(onionServices, service)
+	}
 
 	// Initialize guard manager for persistent guard nodes
 	guardMgr, err := path.NewGuardManager(cfg.DataDirectory, log)
@@ -109,19 +171,28 @@ func New(cfg *config.Config, log *logger.Logger) (*Client, error) {
 		return nil, fmt.Errorf("failed to create guard manager: %w", err)
 	}
 
+	// Parse node restrictions so invalid node specs fail at startup
+	restrictions, err := newNodeRestrictions(cfg, log)
+	if err != nil {
+		cancel() // Clean up context on error
+		return nil, err
+	}
+
 	client := &Client{
-		config:        cfg,
-		logger:        log.Component("client"),
-		directory:     dirClient,
-		circuitMgr:    circuitMgr,
-		socksServer:   socksServer,
-		guardManager:  guardMgr,
-		metrics:       metrics.New(),
-		healthMonitor: health.NewMonitor(),
-		circuits:      make([]*circuit.Circuit, 0),
-		ctx:           ctx,
-		cancel:        cancel,
-		shutdown:      make(chan struct{}),
+		config:           cfg,
+		logger:           log.Component("client"),
+		directory:        dirClient,
+		circuitMgr:       circuitMgr,
+		socksServer:      socksServer,
+		onionServices:    onionServices,
+		guardManager:     guardMgr,
+		metrics:          metrics.New(),
+		healthMonitor:    health.NewMonitor(),
+		nodeRestrictions: restrictions,
+		circuits:         make([]*circuit.Circuit, 0),
+		ctx:              ctx,
+		cancel:           cancel,
+		shutdown:         make(chan struct{}),
 	}
 
 	// Initialize control protocol server
@@ -137,6 +208,64 @@ func New(cfg *config.Config, log *logger.Logger) (*Client, error) {
 	return client, nil
 }
 
+// configureDirectorySources applies the DirAuthority and FallbackDir options.
+// As in C tor, configuring DirAuthority also drops the built-in fallback
+// mirrors, which belong to the public network.
+func configureDirectorySources(dirClient *directory.Client, cfg *config.Config) error {
+	if len(cfg.DirAuthorities) > 0 {
+		auths := make([]*directory.DirAuthority, 0, len(cfg.DirAuthorities))
+		for _, line := range cfg.DirAuthorities {
+			auth, err := directory.ParseDirAuthority(line)
+			if err != nil {
+				return err
+			}
+			auths = append(auths, auth)
+		}
+		if err := dirClient.SetDirAuthorities(auths); err != nil {
+			return err
+		}
+		dirClient.SetFallbackDirs(nil)
+	}
+
+	if len(cfg.FallbackDirs) > 0 {
+		fallbacks := make([]*directory.FallbackDir, 0, len(cfg.FallbackDirs))
+		for _, line := range cfg.FallbackDirs {
+			fallback, err := directory.ParseFallbackDir(line)
+			if err != nil {
+				return err
+			}
+			fallbacks = append(fallbacks, fallback)
+		}
+		dirClient.SetFallbackDirs(fallbacks)
+	}
+	return nil
+}
+
+// newNodeRestrictions builds the path selection restrictions from the configuration,
+// loading the GeoIP database if one is configured
+func newNodeRestrictions(cfg *config.Config, log *logger.Logger) (*path.NodeRestrictions, error) {
+	var geoip *path.GeoIP
+	if cfg.GeoIPFile != "" || cfg.GeoIPv6File != "" {
+		var err error
+		geoip, err = path.LoadGeoIP(cfg.GeoIPFile, cfg.GeoIPv6File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load GeoIP database: %w", err)
+		}
+	}
+
+	restrictions, err := path.NewNodeRestrictions(cfg.ExcludeNodes, cfg.ExcludeExitNodes,
+		cfg.EntryNodes, cfg.ExitNodes, cfg.StrictNodes, geoip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node restrictions: %w", err)
+	}
+
+	if restrictions.HasCountries() && geoip == nil {
+		log.Warn("Country codes in node restrictions have no effect without GeoIPFile or GeoIPv6File")
+	}
+
+	return restrictions, nil
+}
+
 // Start starts the Tor client and all its components
 func (c *Client) Start(ctx context.Context) error {
 	c.logger.Info("Starting Tor client")
@@ -147,18 +276,31 @@ func (c *Client) Start(ctx context.Context) error {
 	// Step 1: Fetch network consensus (path selector will do this)
 	c.logger.Info("Initializing path selector...")
 
-	// Step 2: Initialize path selector with guard persistence and update consensus
+	// Step 2: Initialize path selector with guard persistence and load the
+	// cached consensus, fetching a new one if it is missing or expired
 	c.pathSelector = path.NewSelectorWithGuards(c.directory, c.guardManager, c.logger)
-	if err := c.pathSelector.UpdateConsensus(ctx); err != nil {
-		return fmt.Errorf("failed to update consensus: %w", err)
+	c.pathSelector.SetNodeRestrictions(c.nodeRestrictions)
+	if err := c.pathSelector.LoadCachedConsensus(ctx); err != nil {
+		c.logger.Info("No usable cached consensus, fetching from directory authorities", "reason", err)
+		if err := c.pathSelector.UpdateConsensus(ctx); err != nil {
+			return fmt.Errorf("failed to update consensus: %w", err)
+		}
 	}
 	c.logger.Info("Path selector initialized")
 
+	// Step 2.5: Now that guards are known, send later directory requests over
+	// one-hop circuits (RELAY_BEGIN_DIR) instead of straight to the authorities
+	c.directory.SetTransport(directory.NewTunnelTransport(c.dialDirStream))
+
 	// Publish NS and NEWDESC events for the new consensus
 	if relays := c.pathSelector.GetRelays(); len(relays) > 0 {
 		c.publishNewDescEvents(relays)
 		c.publishConsensusEvents(relays)
+		c.socksServer.UpdateOnionRelays(onionRelays(relays))
+		c.socksServer.SetOnionNetworkParams(onionNetworkParams(c.pathSelector.Consensus()))
 	}
+	c.socksServer.SetOnionCircuitBuilder(&onionCircuitBuilder{client: c})
+	c.startOnionServices(ctx)
 
 	// Step 3: Clean up expired guards
 	c.guardManager.CleanupExpired()
@@ -240,6 +382,21 @@ func (c *Client) Start(ctx context.Context) error {
 		c.maintainCircuits(ctx)
 	}()
 
+	// Step 7.5: Start consensus refresh loop
+	c.wg.Add(1)
+	go func() {
+		// AUDIT-R-005: Add panic recovery for goroutine resilience
+		defer func() {
+			if r := recover(); r != nil {
+				c.logger.Error("Consensus maintenance goroutine panic recovered",
+					"panic", r,
+					"stack", string(debug.Stack()))
+			}
+		}()
+		defer c.wg.Done()
+		c.maintainConsensus(ctx)
+	}()
+
 	// Step 8: Start bandwidth monitoring (publishes BW events)
 	c.wg.Add(1)
 	go func() {
@@ -298,6 +455,13 @@ func (c *Client) Stop() error {
 	}
 	c.circuitsMu.Unlock()
 
+	// Stop onion services
+	for _, service := range c.onionServices {
+		if err := service.Stop(); err != nil {
+			c.logger.Warn("Failed to stop onion service", "address", service.GetAddress(), "error", err)
+		}
+	}
+
 	// Stop SOCKS server
 	// AUDIT-R-009: Use timeout context for shutdown instead of Background
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -368,7 +532,13 @@ func (c *Client) buildCircuitForPool(ctx context.Context) (*circuit.Circuit, err
 		"exit", selectedPath.Exit.Nickname)
 
 	// Create circuit builder
-	builder := circuit.NewBuilder(c.circuitMgr, c.logger)
+	builder := c.newCircuitBuilder()
+	if c.config.CongestionControl {
+		params := circuit.DefaultCongestionParams()
+		builder.SetCongestionControl(&params, func(stats circuit.CongestionStats) {
+			c.metrics.RecordCongestion(stats.Cwnd, stats.RTT)
+		})
+	}
 
 	// Track circuit build time
 	startTime := time.Now()
@@ -427,6 +597,156 @@ func (c *Client) buildCircuitForPool(ctx context.Context) (*circuit.Circuit, err
 	return circ, nil
 }
 
+// newCircuitBuilder returns a circuit builder with the configured
+// connection padding
+func (c *Client) newCircuitBuilder() *circuit.Builder {
+	builder := circuit.NewBuilder(c.circuitMgr, c.logger)
+	if c.config.ConnectionPadding {
+		params := connection.DefaultPaddingParams()
+		if c.config.ReducedConnectionPadding {
+			params = connection.ReducedPaddingParams()
+		}
+		builder.SetConnectionPadding(&params)
+	}
+	return builder
+}
+
+// onionCircuitBuilder builds the circuits to introduction and rendezvous
+// points used for .onion connections
+type onionCircuitBuilder struct {
+	client *Client
+}
+
+// BuildCircuitToRelay builds a three-hop circuit ending at relay. The relay
+// is looked up in the consensus, so that path selection sees its flags and
+// family; introduction points from a descriptor may be unknown to it.
+// Congestion control is not negotiated: on onion service circuits it is
+// agreed end to end with the service, not with the last relay.
+func (b *onionCircuitBuilder) BuildCircuitToRelay(ctx context.Context, relay *onion.HSDirectory, timeout time.Duration) (*circuit.Circuit, error) {
+	c := b.client
+	target := &directory.Relay{
+		Fingerprint:  relay.Fingerprint,
+		Address:      relay.Address,
+		ORPort:       relay.ORPort,
+		IdentityKey:  relay.IdentityKey,
+		NtorOnionKey: relay.NtorOnionKey,
+	}
+	for _, known := range c.pathSelector.GetRelays() {
+		if strings.EqualFold(known.HexFingerprint(), relay.Fingerprint) {
+			target = known
+			break
+		}
+	}
+
+	selectedPath, err := c.pathSelector.SelectPathTo(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select path: %w", err)
+	}
+
+	startTime := time.Now()
+	circ, err := c.newCircuitBuilder().BuildCircuit(ctx, selectedPath, timeout)
+	c.metrics.RecordCircuitBuild(err == nil, time.Since(startTime))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build circuit: %w", err)
+	}
+	c.pathSelector.ConfirmGuard(selectedPath.Guard.Fingerprint)
+	return circ, nil
+}
+
+// onionServiceConfigs groups the configured onion service ports by service
+// directory into one service config per directory, in configuration order
+func onionServiceConfigs(services []config.OnionServiceConfig) ([]*onion.ServiceConfig, error) {
+	var configs []*onion.ServiceConfig
+	byDir := make(map[string]*onion.ServiceConfig)
+	for _, service := range services {
+		serviceConfig, ok := byDir[service.ServiceDir]
+		if !ok {
+			serviceConfig = &onion.ServiceConfig{
+				DataDirectory: service.ServiceDir,
+				Ports:         make(map[int]string),
+			}
+			byDir[service.ServiceDir] = serviceConfig
+			configs = append(configs, serviceConfig)
+		}
+		if _, dup := serviceConfig.Ports[service.VirtualPort]; dup {
+			return nil, fmt.Errorf("onion service in %s: duplicate port %d", service.ServiceDir, service.VirtualPort)
+		}
+		serviceConfig.Ports[service.VirtualPort] = service.TargetAddr
+		if service.PoWDefensesEnabled && serviceConfig.PoW == nil {
+			serviceConfig.PoW = &onion.PoWConfig{}
+		}
+
+		for name, encoded := range service.ClientAuth {
+			key, err := onion.DecodeClientAuthKey(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("onion service in %s: client %q: %w", service.ServiceDir, name, err)
+			}
+			// Ports of one service repeat its client keys
+			if !slices.ContainsFunc(serviceConfig.AuthorizedClients, func(k []byte) bool { return bytes.Equal(k, key) }) {
+				serviceConfig.AuthorizedClients = append(serviceConfig.AuthorizedClients, key)
+			}
+		}
+	}
+	return configs, nil
+}
+
+// startOnionServices starts the hosted onion services in the background,
+// since establishing introduction points and publishing take a while
+func (c *Client) startOnionServices(ctx context.Context) {
+	if len(c.onionServices) == 0 {
+		return
+	}
+	relays := onionRelays(c.pathSelector.GetRelays())
+	params := onionNetworkParams(c.pathSelector.Consensus())
+	for _, service := range c.onionServices {
+		service.SetCircuitBuilder(&onionCircuitBuilder{client: c})
+		service.SetNetworkParams(params)
+
+		c.wg.Add(1)
+		go func(service *onion.Service) {
+			defer c.wg.Done()
+			if err := service.Start(ctx, relays); err != nil {
+				c.logger.Warn("Failed to start onion service", "address", service.GetAddress(), "error", err)
+			}
+		}(service)
+	}
+}
+
+// onionRelays converts consensus relays into the form the onion service
+// client uses to pick HSDirs and rendezvous points
+func onionRelays(relays []*directory.Relay) []*onion.HSDirectory {
+	hsdirs := make([]*onion.HSDirectory, 0, len(relays))
+	for _, relay := range relays {
+		if !relay.IsRunning() || !relay.IsValid() {
+			continue
+		}
+		hsdirs = append(hsdirs, &onion.HSDirectory{
+			Fingerprint:  relay.HexFingerprint(),
+			Address:      relay.Address,
+			ORPort:       relay.ORPort,
+			DirPort:      relay.DirPort,
+			HSDir:        relay.HasFlag("HSDir"),
+			IdentityKey:  relay.IdentityKey,
+			NtorOnionKey: relay.NtorOnionKey,
+		})
+	}
+	return hsdirs
+}
+
+// onionNetworkParams extracts the values that decide which HSDirs hold a
+// descriptor from a consensus
+func onionNetworkParams(consensus *directory.Consensus) onion.NetworkParams {
+	if consensus == nil {
+		return onion.NetworkParams{}
+	}
+	return onion.NetworkParams{
+		ValidAfter:  consensus.ValidAfter,
+		CurrentSRV:  consensus.SharedRandCurrent,
+		PreviousSRV: consensus.SharedRandPrevious,
+		Params:      consensus.Params,
+	}
+}
+
 // maintainCircuits maintains the circuit pool
 func (c *Client) maintainCircuits(ctx context.Context) {
 	ticker := time.NewTicker(60 * time.Second)
@@ -444,6 +764,102 @@ func (c *Client) maintainCircuits(ctx context.Context) {
 	}
 }
 
+// maintainConsensus refreshes the consensus at the time chosen by
+// Consensus.NextRefresh, retrying periodically after a failed fetch
+func (c *Client) maintainConsensus(ctx context.Context) {
+	retrying := false
+	for {
+		delay := consensusRetryInterval
+		if consensus := c.pathSelector.Consensus(); consensus != nil && !retrying {
+			delay = time.Until(consensus.NextRefresh(time.Now()))
+		}
+		c.logger.Debug("Next consensus refresh scheduled", "in", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-c.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := c.pathSelector.UpdateConsensus(ctx); err != nil {
+			c.logger.Warn("Failed to refresh consensus", "error", err, "retry_in", consensusRetryInterval)
+			retrying = true
+			continue
+		}
+		retrying = false
+
+		if relays := c.pathSelector.GetRelays(); len(relays) > 0 {
+			c.publishNewDescEvents(relays)
+			c.publishConsensusEvents(relays)
+			hsdirs := onionRelays(relays)
+			params := onionNetworkParams(c.pathSelector.Consensus())
+			c.socksServer.UpdateOnionRelays(hsdirs)
+			c.socksServer.SetOnionNetworkParams(params)
+			for _, service := range c.onionServices {
+				service.SetNetworkParams(params)
+				service.UpdateRelays(hsdirs)
+			}
+		}
+	}
+}
+
+// dirStreamID is the stream used on each one-hop directory circuit
+const dirStreamID = 1
+
+// dialDirStream builds a one-hop circuit to a directory guard and opens a
+// RELAY_BEGIN_DIR stream on it. Each directory request gets its own circuit,
+// which is torn down when the stream is closed.
+func (c *Client) dialDirStream(ctx context.Context) (net.Conn, error) {
+	guard, err := c.pathSelector.SelectDirectoryGuard()
+	if err != nil {
+		return nil, err
+	}
+
+	builder := circuit.NewBuilder(c.circuitMgr, c.logger)
+	circ, err := builder.BuildOneHopCircuit(ctx, guard, c.config.CircuitBuildTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build directory circuit: %w", err)
+	}
+
+	stream, err := circ.OpenDirStream(ctx, dirStreamID)
+	if err != nil {
+		c.closeDirCircuit(circ)
+		return nil, err
+	}
+
+	c.logger.Debug("Opened directory stream", "guard", guard.Nickname, "circuit_id", circ.ID)
+	return &dirStreamConn{DirStream: stream, onClose: func() { c.closeDirCircuit(circ) }}, nil
+}
+
+// closeDirCircuit tears down a one-hop directory circuit
+func (c *Client) closeDirCircuit(circ *circuit.Circuit) {
+	if err := circ.Close(); err != nil {
+		c.logger.Debug("Failed to close directory circuit", "circuit_id", circ.ID, "error", err)
+	}
+	if err := c.circuitMgr.CloseCircuit(circ.ID); err != nil {
+		c.logger.Debug("Failed to remove directory circuit", "circuit_id", circ.ID, "error", err)
+	}
+}
+
+// dirStreamConn closes its one-hop circuit along with the directory stream
+type dirStreamConn struct {
+	*circuit.DirStream
+	onClose   func()
+	closeOnce sync.Once
+}
+
+// Close ends the stream and tears down its circuit
+func (d *dirStreamConn) Close() error {
+	err := d.DirStream.Close()
+	d.closeOnce.Do(d.onClose)
+	return err
+}
+
 // checkAndRebuildCircuits checks circuit health and rebuilds if needed
 // SEC-L008: Enforces MaxCircuitDirtiness to prevent long-lived circuits
 // that increase linkability risk per tor-spec.txt §6.1
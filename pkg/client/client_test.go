@@ -1,12 +1,18 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/opd-ai/go-tor/pkg/config"
+	"github.com/opd-ai/go-tor/pkg/directory"
 	"github.com/opd-ai/go-tor/pkg/logger"
+	"github.com/opd-ai/go-tor/pkg/onion"
 )
 
 func TestNew(t *testing.T) {
@@ -71,6 +77,55 @@ func TestNewWithNilLogger(t *testing.T) {
 	}
 }
 
+func TestNewWithNodeRestrictions(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.DataDirectory = t.TempDir() // Use temporary directory for tests
+	cfg.ExcludeNodes = []string{"$0123456789ABCDEF0123456789ABCDEF01234567, BadRelay"}
+	cfg.ExitNodes = []string{"192.0.2.0/24"}
+	cfg.StrictNodes = true
+
+	client, err := New(cfg, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if client.nodeRestrictions == nil || client.nodeRestrictions.ExcludeNodes.IsEmpty() {
+		t.Error("ExcludeNodes not applied to node restrictions")
+	}
+	if !client.nodeRestrictions.StrictNodes {
+		t.Error("StrictNodes not applied to node restrictions")
+	}
+
+	// Invalid node specs must be rejected rather than silently ignored
+	cfg.ExcludeNodes = []string{"$NOTAFINGERPRINT"}
+	if _, err := New(cfg, logger.NewDefault()); err == nil {
+		t.Error("Expected error for invalid ExcludeNodes")
+	}
+}
+
+func TestNewWithDirectorySources(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.DataDirectory = t.TempDir() // Use temporary directory for tests
+	cfg.DirAuthorities = []string{
+		"test000a orport=5000 v3ident=0123456789ABCDEF0123456789ABCDEF01234567 127.0.0.1:7000 89AB CDEF 0123 4567 89AB CDEF 0123 4567 89AB CDEF",
+	}
+	cfg.FallbackDirs = []string{"127.0.0.1:7001 orport=5001 id=FEDCBA9876543210FEDCBA9876543210FEDCBA98"}
+
+	if _, err := New(cfg, logger.NewDefault()); err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	// Invalid lines, or authorities that cannot sign a consensus, are rejected
+	cfg.DirAuthorities = []string{"test000a orport=5000 127.0.0.1:7000 89AB CDEF 0123 4567 89AB CDEF 0123 4567 89AB CDEF"}
+	if _, err := New(cfg, logger.NewDefault()); err == nil {
+		t.Error("Expected error for DirAuthority without v3ident")
+	}
+	cfg.DirAuthorities = nil
+	cfg.FallbackDirs = []string{"127.0.0.1:7001"}
+	if _, err := New(cfg, logger.NewDefault()); err == nil {
+		t.Error("Expected error for FallbackDir without orport and id")
+	}
+}
+
 func TestGetStats(t *testing.T) {
 	cfg := config.DefaultConfig()
 	cfg.DataDirectory = t.TempDir() // Use temporary directory for tests
@@ -539,3 +594,134 @@ func TestStatsSnapshot(t *testing.T) {
 		t.Errorf("Expected 0 ActiveCircuits, got %d", stats.ActiveCircuits)
 	}
 }
+
+func TestOnionRelays(t *testing.T) {
+	ntorKey := make([]byte, 32)
+	relays := []*directory.Relay{
+		{
+			Nickname:     "hsdir",
+			Fingerprint:  "AAECAwQFBgcICQoLDA0ODxAREhM", // base64 as in the consensus
+			Address:      "192.0.2.1",
+			ORPort:       9001,
+			Flags:        []string{"HSDir", "Running", "Valid"},
+			NtorOnionKey: ntorKey,
+		},
+		{
+			Nickname:    "plain",
+			Fingerprint: "0102030405060708090a0b0c0d0e0f1011121314",
+			Address:     "192.0.2.2",
+			ORPort:      443,
+			Flags:       []string{"Running", "Valid"},
+		},
+		{
+			Nickname:    "down",
+			Fingerprint: "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+			Flags:       []string{"HSDir", "Valid"},
+		},
+	}
+
+	hsdirs := onionRelays(relays)
+	if len(hsdirs) != 2 {
+		t.Fatalf("Got %d relays, want 2 (non-running relays are skipped)", len(hsdirs))
+	}
+	if hsdirs[0].Fingerprint != "000102030405060708090A0B0C0D0E0F10111213" {
+		t.Errorf("Fingerprint = %s, want hex", hsdirs[0].Fingerprint)
+	}
+	if !hsdirs[0].HSDir || hsdirs[1].HSDir {
+		t.Error("HSDir flag not carried over")
+	}
+	if len(hsdirs[0].NtorOnionKey) != 32 {
+		t.Error("Ntor onion key not carried over")
+	}
+	if hsdirs[1].Fingerprint != "0102030405060708090A0B0C0D0E0F1011121314" || hsdirs[1].ORPort != 443 {
+		t.Errorf("Unexpected relay %+v", hsdirs[1])
+	}
+}
+
+func TestOnionNetworkParams(t *testing.T) {
+	if params := onionNetworkParams(nil); !params.ValidAfter.IsZero() || params.CurrentSRV != nil {
+		t.Errorf("Expected empty params without a consensus, got %+v", params)
+	}
+
+	consensus := &directory.Consensus{
+		ValidAfter:         time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC),
+		SharedRandCurrent:  bytes.Repeat([]byte{1}, 32),
+		SharedRandPrevious: bytes.Repeat([]byte{2}, 32),
+		Params:             map[string]int64{"hsdir_spread_fetch": 5},
+	}
+	params := onionNetworkParams(consensus)
+	if !params.ValidAfter.Equal(consensus.ValidAfter) {
+		t.Errorf("ValidAfter = %v, want %v", params.ValidAfter, consensus.ValidAfter)
+	}
+	if !bytes.Equal(params.CurrentSRV, consensus.SharedRandCurrent) || !bytes.Equal(params.PreviousSRV, consensus.SharedRandPrevious) {
+		t.Error("Shared random values not carried over")
+	}
+	if params.SpreadFetch() != 5 {
+		t.Errorf("SpreadFetch() = %d, want 5", params.SpreadFetch())
+	}
+}
+
+func TestOnionServiceConfigs(t *testing.T) {
+	clientKey := onion.EncodeClientAuthKey(bytes.Repeat([]byte{7}, 32))
+	configs, err := onionServiceConfigs([]config.OnionServiceConfig{
+		{ServiceDir: "/srv/web", VirtualPort: 80, TargetAddr: "127.0.0.1:8080", ClientAuth: map[string]string{"alice": clientKey}},
+		{ServiceDir: "/srv/web", VirtualPort: 443, TargetAddr: "127.0.0.1:8443", ClientAuth: map[string]string{"alice": clientKey}},
+		{ServiceDir: "/srv/ssh", VirtualPort: 22, TargetAddr: "127.0.0.1:22", PoWDefensesEnabled: true},
+	})
+	if err != nil {
+		t.Fatalf("onionServiceConfigs() error = %v", err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("Got %d services, want 2", len(configs))
+	}
+	if configs[0].DataDirectory != "/srv/web" || len(configs[0].Ports) != 2 || configs[0].Ports[443] != "127.0.0.1:8443" {
+		t.Errorf("Unexpected first service %+v", configs[0])
+	}
+	if len(configs[0].AuthorizedClients) != 1 {
+		t.Errorf("Got %d authorized clients, want 1", len(configs[0].AuthorizedClients))
+	}
+	if configs[1].DataDirectory != "/srv/ssh" || configs[1].Ports[22] != "127.0.0.1:22" {
+		t.Errorf("Unexpected second service %+v", configs[1])
+	}
+	if configs[0].PoW != nil || configs[1].PoW == nil {
+		t.Errorf("PoW = %v, %v; want only the second service defended", configs[0].PoW, configs[1].PoW)
+	}
+
+	if _, err := onionServiceConfigs([]config.OnionServiceConfig{
+		{ServiceDir: "/srv/web", VirtualPort: 80, TargetAddr: "127.0.0.1:8080"},
+		{ServiceDir: "/srv/web", VirtualPort: 80, TargetAddr: "127.0.0.1:8081"},
+	}); err == nil {
+		t.Error("Expected error for duplicate port")
+	}
+	if _, err := onionServiceConfigs([]config.OnionServiceConfig{
+		{ServiceDir: "/srv/web", VirtualPort: 80, TargetAddr: "127.0.0.1:8080", ClientAuth: map[string]string{"bob": "not-a-key"}},
+	}); err == nil {
+		t.Error("Expected error for invalid client key")
+	}
+}
+
+func TestNewLoadsOnionServices(t *testing.T) {
+	serviceDir := filepath.Join(t.TempDir(), "hidden_service")
+	cfg := config.DefaultConfig()
+	cfg.DataDirectory = t.TempDir()
+	cfg.OnionServices = []config.OnionServiceConfig{
+		{ServiceDir: serviceDir, VirtualPort: 80, TargetAddr: "127.0.0.1:8080"},
+	}
+
+	client, err := New(cfg, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.cancel()
+	if len(client.onionServices) != 1 {
+		t.Fatalf("Got %d onion services, want 1", len(client.onionServices))
+	}
+
+	hostname, err := os.ReadFile(filepath.Join(serviceDir, "hostname"))
+	if err != nil {
+		t.Fatalf("Failed to read hostname: %v", err)
+	}
+	if strings.TrimSpace(string(hostname)) != client.onionServices[0].GetAddress() {
+		t.Errorf("hostname = %q, want %s", hostname, client.onionServices[0].GetAddress())
+	}
+}
@@ -3,6 +3,7 @@ package config
 
 import (
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/opd-ai/go-tor/pkg/autoconfig"
@@ -20,6 +21,7 @@ type Config struct {
 	MaxCircuitDirtiness time.Duration // Max time to use a circuit (default: 10m)
 	NewCircuitPeriod    time.Duration // How often to rotate circuits (default: 30s)
 	NumEntryGuards      int           // Number of entry guards to use (default: 3)
+	CongestionControl   bool          // Negotiate prop324 congestion control (Tor Vegas) with exits (default: false)
 
 	// Path selection
 	UseEntryGuards   bool     // Whether to use entry guards (default: true)
@@ -27,13 +29,27 @@ type Config struct {
 	BridgeAddresses  []string // Bridge addresses if UseBridges is true
 	ExcludeNodes     []string // Nodes to exclude from path selection
 	ExcludeExitNodes []string // Exit nodes to exclude
+	EntryNodes       []string // Nodes allowed as entry guards (empty = any)
+	ExitNodes        []string // Nodes allowed as exits (empty = any)
+	StrictNodes      bool     // Also apply ExcludeNodes to onion service relays chosen by the other end (default: false)
+	GeoIPFile        string   // Tor-format IPv4 GeoIP database for {cc} node specs
+	GeoIPv6File      string   // Tor-format IPv6 GeoIP database for {cc} node specs
 
 	// Network behavior
-	ConnLimit      int           // Max concurrent connections (default: 1000)
-	DormantTimeout time.Duration // Time before entering dormant mode (default: 24h)
+	ConnLimit                int           // Max concurrent connections (default: 1000)
+	DormantTimeout           time.Duration // Time before entering dormant mode (default: 24h)
+	ConnectionPadding        bool          // Send link padding on guard connections with open circuits (default: true)
+	ReducedConnectionPadding bool          // Pad less often, trading protection for bandwidth (default: false)
+
+	// Directory
+	UseMicrodescriptors bool     // Fetch the microdesc consensus and cache microdescriptors (default: true)
+	DirAuthorities      []string // DirAuthority lines replacing the default authorities (empty = public Tor network)
+	FallbackDirs        []string // FallbackDir lines replacing the built-in fallback mirrors
 
 	// Onion service settings
-	OnionServices []OnionServiceConfig
+	OnionServices           []OnionServiceConfig
+	ClientOnionAuthDir      string // Directory of <name>.auth_private client authorization keys for onion services
+	ClientOnionMaxPoWEffort int    // Most effort spent on an onion service's proof-of-work puzzle; 0 never solves one (default: 10000)
 
 	// Logging
 	LogLevel string // Log level: debug, info, warn, error (default: info)
@@ -60,12 +76,15 @@ type Config struct {
 }
 
 // OnionServiceConfig represents configuration for a single onion service
+// port. Entries that share a ServiceDir are ports of the same service, as
+// with several HiddenServicePort lines after one HiddenServiceDir.
 type OnionServiceConfig struct {
-	ServiceDir  string            // Directory for service keys and state
-	VirtualPort int               // Virtual port for the onion service
-	TargetAddr  string            // Target address (localhost:port)
-	MaxStreams  int               // Max concurrent streams (default: 0 = unlimited)
-	ClientAuth  map[string]string // Client authorization keys
+	ServiceDir         string            // Directory for service keys and state (C-tor HiddenServiceDir layout)
+	VirtualPort        int               // Virtual port for the onion service
+	TargetAddr         string            // Target address (localhost:port)
+	MaxStreams         int               // Max concurrent streams (default: 0 = unlimited)
+	ClientAuth         map[string]string // Client authorization keys
+	PoWDefensesEnabled bool              // Ask clients for a proof-of-work puzzle under load (C-tor HiddenServicePoWDefensesEnabled)
 }
 
 // DefaultConfig returns a configuration with sensible defaults.
@@ -97,15 +116,25 @@ func DefaultConfig() *Config {
 		MaxCircuitDirtiness: 10 * time.Minute,
 		NewCircuitPeriod:    30 * time.Second,
 		NumEntryGuards:      3,
+		CongestionControl:   false,
 		UseEntryGuards:      true,
 		UseBridges:          false,
 		BridgeAddresses:     []string{},
 		ExcludeNodes:        []string{},
 		ExcludeExitNodes:    []string{},
+		EntryNodes:          []string{},
+		ExitNodes:           []string{},
+		StrictNodes:         false,
 		ConnLimit:           1000,
 		DormantTimeout:      24 * time.Hour,
+		ConnectionPadding:   true,
+		UseMicrodescriptors: true,
+		DirAuthorities:      []string{},
+		FallbackDirs:        []string{},
 		OnionServices:       []OnionServiceConfig{},
-		LogLevel:            "info",
+		// Same cap as C Tor (onion.DefaultMaxPoWEffort)
+		ClientOnionMaxPoWEffort: 10000,
+		LogLevel:                "info",
 		// Monitoring defaults (Phase 9.1)
 		MetricsPort:   0,     // Disabled by default
 		EnableMetrics: false, // Disabled by default
@@ -189,6 +218,9 @@ func (c *Config) Validate() error {
 	}
 
 	// Validate onion service configs
+	if c.ClientOnionMaxPoWEffort < 0 || int64(c.ClientOnionMaxPoWEffort) > math.MaxUint32 {
+		return fmt.Errorf("invalid ClientOnionMaxPoWEffort: %d", c.ClientOnionMaxPoWEffort)
+	}
 	for i, os := range c.OnionServices {
 		if os.VirtualPort < 1 || os.VirtualPort > 65535 {
 			return fmt.Errorf("onion service %d: invalid VirtualPort: %d", i, os.VirtualPort)
@@ -236,6 +268,10 @@ func (c *Config) Clone() *Config {
 	clone.BridgeAddresses = append([]string{}, c.BridgeAddresses...)
 	clone.ExcludeNodes = append([]string{}, c.ExcludeNodes...)
 	clone.ExcludeExitNodes = append([]string{}, c.ExcludeExitNodes...)
+	clone.EntryNodes = append([]string{}, c.EntryNodes...)
+	clone.ExitNodes = append([]string{}, c.ExitNodes...)
+	clone.DirAuthorities = append([]string{}, c.DirAuthorities...)
+	clone.FallbackDirs = append([]string{}, c.FallbackDirs...)
 	clone.OnionServices = make([]OnionServiceConfig, len(c.OnionServices))
 	copy(clone.OnionServices, c.OnionServices)
 	return &clone
@@ -126,6 +126,9 @@ func processConfigOption(cfg *Config, key, value string) error {
 		}
 		cfg.NumEntryGuards = num
 
+	case "CongestionControl":
+		cfg.CongestionControl = parseBool(value)
+
 	case "UseEntryGuards":
 		cfg.UseEntryGuards = parseBool(value)
 
@@ -141,6 +144,21 @@ func processConfigOption(cfg *Config, key, value string) error {
 	case "ExcludeExitNodes":
 		cfg.ExcludeExitNodes = append(cfg.ExcludeExitNodes, value)
 
+	case "EntryNodes":
+		cfg.EntryNodes = append(cfg.EntryNodes, value)
+
+	case "ExitNodes":
+		cfg.ExitNodes = append(cfg.ExitNodes, value)
+
+	case "StrictNodes":
+		cfg.StrictNodes = parseBool(value)
+
+	case "GeoIPFile":
+		cfg.GeoIPFile = value
+
+	case "GeoIPv6File":
+		cfg.GeoIPv6File = value
+
 	case "ConnLimit":
 		limit, err := strconv.Atoi(value)
 		if err != nil {
@@ -155,6 +173,47 @@ func processConfigOption(cfg *Config, key, value string) error {
 		}
 		cfg.DormantTimeout = timeout
 
+	case "ConnectionPadding":
+		cfg.ConnectionPadding = parseBool(value)
+
+	case "ReducedConnectionPadding":
+		cfg.ReducedConnectionPadding = parseBool(value)
+
+	case "UseMicrodescriptors":
+		cfg.UseMicrodescriptors = parseBool(value)
+
+	case "DirAuthority":
+		cfg.DirAuthorities = append(cfg.DirAuthorities, value)
+
+	case "FallbackDir":
+		cfg.FallbackDirs = append(cfg.FallbackDirs, value)
+
+	case "ClientOnionAuthDir":
+		cfg.ClientOnionAuthDir = value
+
+	case "ClientOnionMaxPoWEffort":
+		effort, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid ClientOnionMaxPoWEffort value: %s", value)
+		}
+		cfg.ClientOnionMaxPoWEffort = int(effort)
+
+	case "HiddenServiceDir":
+		cfg.OnionServices = append(cfg.OnionServices, OnionServiceConfig{ServiceDir: value})
+
+	case "HiddenServicePort":
+		return parseHiddenServicePort(cfg, value)
+
+	case "HiddenServicePoWDefensesEnabled":
+		if len(cfg.OnionServices) == 0 {
+			return fmt.Errorf("HiddenServicePoWDefensesEnabled without a preceding HiddenServiceDir")
+		}
+		// Applies to every port of the service being configured
+		dir := cfg.OnionServices[len(cfg.OnionServices)-1].ServiceDir
+		for i := len(cfg.OnionServices) - 1; i >= 0 && cfg.OnionServices[i].ServiceDir == dir; i-- {
+			cfg.OnionServices[i].PoWDefensesEnabled = parseBool(value)
+		}
+
 	case "LogLevel":
 		cfg.LogLevel = strings.ToLower(value)
 
@@ -166,6 +225,55 @@ func processConfigOption(cfg *Config, key, value string) error {
 	return nil
 }
 
+// parseHiddenServicePort applies a "HiddenServicePort VIRTPORT [TARGET]"
+// line to the service of the preceding HiddenServiceDir. TARGET is a port or
+// an address:port and defaults to 127.0.0.1:VIRTPORT. Each port after the
+// first adds an entry with the same ServiceDir.
+func parseHiddenServicePort(cfg *Config, value string) error {
+	if len(cfg.OnionServices) == 0 {
+		return fmt.Errorf("HiddenServicePort without a preceding HiddenServiceDir")
+	}
+
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("invalid HiddenServicePort value: %s", value)
+	}
+	port, err := strconv.Atoi(fields[0])
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid HiddenServicePort virtual port: %s", fields[0])
+	}
+
+	target := fmt.Sprintf("127.0.0.1:%d", port)
+	if len(fields) == 2 {
+		switch {
+		case strings.HasPrefix(fields[1], "unix:"):
+			return fmt.Errorf("unix socket HiddenServicePort targets are not supported: %s", fields[1])
+		case !strings.Contains(fields[1], ":"):
+			targetPort, err := strconv.Atoi(fields[1])
+			if err != nil || targetPort < 1 || targetPort > 65535 {
+				return fmt.Errorf("invalid HiddenServicePort target: %s", fields[1])
+			}
+			target = fmt.Sprintf("127.0.0.1:%d", targetPort)
+		default:
+			target = fields[1]
+		}
+	}
+
+	last := &cfg.OnionServices[len(cfg.OnionServices)-1]
+	if last.VirtualPort != 0 {
+		cfg.OnionServices = append(cfg.OnionServices, OnionServiceConfig{
+			ServiceDir:         last.ServiceDir,
+			MaxStreams:         last.MaxStreams,
+			ClientAuth:         last.ClientAuth,
+			PoWDefensesEnabled: last.PoWDefensesEnabled,
+		})
+		last = &cfg.OnionServices[len(cfg.OnionServices)-1]
+	}
+	last.VirtualPort = port
+	last.TargetAddr = target
+	return nil
+}
+
 // parseDuration parses a duration string with support for common time units.
 // Supports: seconds (s), minutes (m), hours (h), days (d)
 // Examples: "60s", "5m", "2h", "1d"
@@ -290,7 +398,8 @@ func SaveToFile(path string, cfg *Config) error {
 	fmt.Fprintf(writer, "CircuitBuildTimeout %s\n", formatDuration(cfg.CircuitBuildTimeout))
 	fmt.Fprintf(writer, "MaxCircuitDirtiness %s\n", formatDuration(cfg.MaxCircuitDirtiness))
 	fmt.Fprintf(writer, "NewCircuitPeriod %s\n", formatDuration(cfg.NewCircuitPeriod))
-	fmt.Fprintf(writer, "NumEntryGuards %d\n\n", cfg.NumEntryGuards)
+	fmt.Fprintf(writer, "NumEntryGuards %d\n", cfg.NumEntryGuards)
+	fmt.Fprintf(writer, "CongestionControl %s\n\n", formatBool(cfg.CongestionControl))
 
 	// Path selection
 	fmt.Fprintf(writer, "# Path Selection\n")
@@ -305,12 +414,52 @@ func SaveToFile(path string, cfg *Config) error {
 	for _, node := range cfg.ExcludeExitNodes {
 		fmt.Fprintf(writer, "ExcludeExitNodes %s\n", node)
 	}
+	for _, node := range cfg.EntryNodes {
+		fmt.Fprintf(writer, "EntryNodes %s\n", node)
+	}
+	for _, node := range cfg.ExitNodes {
+		fmt.Fprintf(writer, "ExitNodes %s\n", node)
+	}
+	fmt.Fprintf(writer, "StrictNodes %s\n", formatBool(cfg.StrictNodes))
+	if cfg.GeoIPFile != "" {
+		fmt.Fprintf(writer, "GeoIPFile %s\n", cfg.GeoIPFile)
+	}
+	if cfg.GeoIPv6File != "" {
+		fmt.Fprintf(writer, "GeoIPv6File %s\n", cfg.GeoIPv6File)
+	}
 	fmt.Fprintf(writer, "\n")
 
 	// Network behavior
 	fmt.Fprintf(writer, "# Network Behavior\n")
 	fmt.Fprintf(writer, "ConnLimit %d\n", cfg.ConnLimit)
-	fmt.Fprintf(writer, "DormantTimeout %s\n\n", formatDuration(cfg.DormantTimeout))
+	fmt.Fprintf(writer, "DormantTimeout %s\n", formatDuration(cfg.DormantTimeout))
+	fmt.Fprintf(writer, "ConnectionPadding %s\n", formatBool(cfg.ConnectionPadding))
+	fmt.Fprintf(writer, "ReducedConnectionPadding %s\n", formatBool(cfg.ReducedConnectionPadding))
+	fmt.Fprintf(writer, "UseMicrodescriptors %s\n", formatBool(cfg.UseMicrodescriptors))
+	for _, auth := range cfg.DirAuthorities {
+		fmt.Fprintf(writer, "DirAuthority %s\n", auth)
+	}
+	for _, fallback := range cfg.FallbackDirs {
+		fmt.Fprintf(writer, "FallbackDir %s\n", fallback)
+	}
+	fmt.Fprintf(writer, "\n")
+
+	// Onion services
+	fmt.Fprintf(writer, "# Onion Services\n")
+	if cfg.ClientOnionAuthDir != "" {
+		fmt.Fprintf(writer, "ClientOnionAuthDir %s\n", cfg.ClientOnionAuthDir)
+	}
+	fmt.Fprintf(writer, "ClientOnionMaxPoWEffort %d\n", cfg.ClientOnionMaxPoWEffort)
+	for i, service := range cfg.OnionServices {
+		if i == 0 || cfg.OnionServices[i-1].ServiceDir != service.ServiceDir {
+			fmt.Fprintf(writer, "HiddenServiceDir %s\n", service.ServiceDir)
+			if service.PoWDefensesEnabled {
+				fmt.Fprintf(writer, "HiddenServicePoWDefensesEnabled 1\n")
+			}
+		}
+		fmt.Fprintf(writer, "HiddenServicePort %d %s\n", service.VirtualPort, service.TargetAddr)
+	}
+	fmt.Fprintf(writer, "\n")
 
 	// Logging
 	fmt.Fprintf(writer, "# Logging\n")
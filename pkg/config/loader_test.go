@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -97,6 +98,41 @@ ExcludeExitNodes exit1`,
 				}
 			},
 		},
+		{
+			name: "node restriction settings",
+			content: `EntryNodes $0123456789ABCDEF0123456789ABCDEF01234567
+ExitNodes {de},{nl}
+ExitNodes 192.0.2.0/24
+StrictNodes 1
+GeoIPFile /usr/share/tor/geoip
+GeoIPv6File /usr/share/tor/geoip6
+ClientOnionAuthDir /var/lib/tor/onion_auth
+ClientOnionMaxPoWEffort 500`,
+			wantErr: false,
+			checkFunc: func(t *testing.T, cfg *Config) {
+				if len(cfg.EntryNodes) != 1 {
+					t.Errorf("len(EntryNodes) = %d, want 1", len(cfg.EntryNodes))
+				}
+				if len(cfg.ExitNodes) != 2 {
+					t.Errorf("len(ExitNodes) = %d, want 2", len(cfg.ExitNodes))
+				}
+				if !cfg.StrictNodes {
+					t.Error("StrictNodes = false, want true")
+				}
+				if cfg.GeoIPFile != "/usr/share/tor/geoip" {
+					t.Errorf("GeoIPFile = %s, want /usr/share/tor/geoip", cfg.GeoIPFile)
+				}
+				if cfg.GeoIPv6File != "/usr/share/tor/geoip6" {
+					t.Errorf("GeoIPv6File = %s, want /usr/share/tor/geoip6", cfg.GeoIPv6File)
+				}
+				if cfg.ClientOnionAuthDir != "/var/lib/tor/onion_auth" {
+					t.Errorf("ClientOnionAuthDir = %s, want /var/lib/tor/onion_auth", cfg.ClientOnionAuthDir)
+				}
+				if cfg.ClientOnionMaxPoWEffort != 500 {
+					t.Errorf("ClientOnionMaxPoWEffort = %d, want 500", cfg.ClientOnionMaxPoWEffort)
+				}
+			},
+		},
 		{
 			name: "comments and empty lines",
 			content: `# This is a comment
@@ -149,6 +185,12 @@ DormantTimeout 1d`,
 			wantErr:   true,
 			checkFunc: nil,
 		},
+		{
+			name:      "invalid proof-of-work effort",
+			content:   `ClientOnionMaxPoWEffort -1`,
+			wantErr:   true,
+			checkFunc: nil,
+		},
 		{
 			name:      "invalid validation - port too high",
 			content:   `SocksPort 70000`,
@@ -232,7 +274,22 @@ func TestSaveToFile(t *testing.T) {
 	cfg.UseBridges = true
 	cfg.BridgeAddresses = []string{"bridge1", "bridge2"}
 	cfg.ExcludeNodes = []string{"node1"}
+	cfg.ExitNodes = []string{"{de}"}
+	cfg.StrictNodes = true
+	cfg.UseMicrodescriptors = false
+	cfg.DirAuthorities = []string{"test000a orport=5000 v3ident=0123456789ABCDEF0123456789ABCDEF01234567 127.0.0.1:7000 89AB CDEF 0123 4567 89AB CDEF 0123 4567 89AB CDEF"}
+	cfg.FallbackDirs = []string{"192.0.2.10:80 orport=443 id=0123456789ABCDEF0123456789ABCDEF01234567"}
 	cfg.CircuitBuildTimeout = 90 * time.Second
+	cfg.CongestionControl = true
+	cfg.ConnectionPadding = false
+	cfg.ReducedConnectionPadding = true
+	cfg.ClientOnionAuthDir = "/var/lib/tor/onion_auth"
+	cfg.ClientOnionMaxPoWEffort = 0
+	cfg.OnionServices = []OnionServiceConfig{
+		{ServiceDir: "/var/lib/tor/web", VirtualPort: 80, TargetAddr: "127.0.0.1:8080", PoWDefensesEnabled: true},
+		{ServiceDir: "/var/lib/tor/web", VirtualPort: 443, TargetAddr: "127.0.0.1:8443", PoWDefensesEnabled: true},
+		{ServiceDir: "/var/lib/tor/ssh", VirtualPort: 22, TargetAddr: "127.0.0.1:22"},
+	}
 
 	// Save configuration
 	if err := SaveToFile(testFile, cfg); err != nil {
@@ -264,6 +321,15 @@ func TestSaveToFile(t *testing.T) {
 	if loadedCfg.UseEntryGuards != cfg.UseEntryGuards {
 		t.Errorf("UseEntryGuards = %v, want %v", loadedCfg.UseEntryGuards, cfg.UseEntryGuards)
 	}
+	if loadedCfg.CongestionControl != cfg.CongestionControl {
+		t.Errorf("CongestionControl = %v, want %v", loadedCfg.CongestionControl, cfg.CongestionControl)
+	}
+	if loadedCfg.ConnectionPadding != cfg.ConnectionPadding {
+		t.Errorf("ConnectionPadding = %v, want %v", loadedCfg.ConnectionPadding, cfg.ConnectionPadding)
+	}
+	if loadedCfg.ReducedConnectionPadding != cfg.ReducedConnectionPadding {
+		t.Errorf("ReducedConnectionPadding = %v, want %v", loadedCfg.ReducedConnectionPadding, cfg.ReducedConnectionPadding)
+	}
 	if loadedCfg.UseBridges != cfg.UseBridges {
 		t.Errorf("UseBridges = %v, want %v", loadedCfg.UseBridges, cfg.UseBridges)
 	}
@@ -273,6 +339,124 @@ func TestSaveToFile(t *testing.T) {
 	if loadedCfg.CircuitBuildTimeout != cfg.CircuitBuildTimeout {
 		t.Errorf("CircuitBuildTimeout = %v, want %v", loadedCfg.CircuitBuildTimeout, cfg.CircuitBuildTimeout)
 	}
+	if len(loadedCfg.ExitNodes) != 1 || loadedCfg.ExitNodes[0] != "{de}" {
+		t.Errorf("ExitNodes = %v, want [{de}]", loadedCfg.ExitNodes)
+	}
+	if loadedCfg.StrictNodes != cfg.StrictNodes {
+		t.Errorf("StrictNodes = %v, want %v", loadedCfg.StrictNodes, cfg.StrictNodes)
+	}
+	if loadedCfg.UseMicrodescriptors != cfg.UseMicrodescriptors {
+		t.Errorf("UseMicrodescriptors = %v, want %v", loadedCfg.UseMicrodescriptors, cfg.UseMicrodescriptors)
+	}
+	if len(loadedCfg.DirAuthorities) != 1 || loadedCfg.DirAuthorities[0] != cfg.DirAuthorities[0] {
+		t.Errorf("DirAuthorities = %v, want %v", loadedCfg.DirAuthorities, cfg.DirAuthorities)
+	}
+	if len(loadedCfg.FallbackDirs) != 1 || loadedCfg.FallbackDirs[0] != cfg.FallbackDirs[0] {
+		t.Errorf("FallbackDirs = %v, want %v", loadedCfg.FallbackDirs, cfg.FallbackDirs)
+	}
+	if loadedCfg.ClientOnionAuthDir != cfg.ClientOnionAuthDir {
+		t.Errorf("ClientOnionAuthDir = %s, want %s", loadedCfg.ClientOnionAuthDir, cfg.ClientOnionAuthDir)
+	}
+	if loadedCfg.ClientOnionMaxPoWEffort != cfg.ClientOnionMaxPoWEffort {
+		t.Errorf("ClientOnionMaxPoWEffort = %d, want %d", loadedCfg.ClientOnionMaxPoWEffort, cfg.ClientOnionMaxPoWEffort)
+	}
+	if len(loadedCfg.OnionServices) != len(cfg.OnionServices) {
+		t.Fatalf("len(OnionServices) = %d, want %d", len(loadedCfg.OnionServices), len(cfg.OnionServices))
+	}
+	for i, service := range cfg.OnionServices {
+		if !reflect.DeepEqual(loadedCfg.OnionServices[i], service) {
+			t.Errorf("OnionServices[%d] = %+v, want %+v", i, loadedCfg.OnionServices[i], service)
+		}
+	}
+}
+
+func TestLoadFromFile_HiddenService(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []OnionServiceConfig
+		wantErr string
+	}{
+		{
+			name:    "default target",
+			content: "HiddenServiceDir /var/lib/tor/web\nHiddenServicePort 80\n",
+			want:    []OnionServiceConfig{{ServiceDir: "/var/lib/tor/web", VirtualPort: 80, TargetAddr: "127.0.0.1:80"}},
+		},
+		{
+			name:    "port target",
+			content: "HiddenServiceDir /var/lib/tor/web\nHiddenServicePort 80 8080\n",
+			want:    []OnionServiceConfig{{ServiceDir: "/var/lib/tor/web", VirtualPort: 80, TargetAddr: "127.0.0.1:8080"}},
+		},
+		{
+			name: "several ports and services",
+			content: "HiddenServiceDir /var/lib/tor/web\nHiddenServicePort 80 127.0.0.1:8080\nHiddenServicePort 443 [::1]:8443\n" +
+				"HiddenServiceDir /var/lib/tor/ssh\nHiddenServicePort 22\n",
+			want: []OnionServiceConfig{
+				{ServiceDir: "/var/lib/tor/web", VirtualPort: 80, TargetAddr: "127.0.0.1:8080"},
+				{ServiceDir: "/var/lib/tor/web", VirtualPort: 443, TargetAddr: "[::1]:8443"},
+				{ServiceDir: "/var/lib/tor/ssh", VirtualPort: 22, TargetAddr: "127.0.0.1:22"},
+			},
+		},
+		{
+			name: "proof-of-work defenses",
+			content: "HiddenServiceDir /var/lib/tor/web\nHiddenServicePort 80\nHiddenServicePoWDefensesEnabled 1\nHiddenServicePort 443\n" +
+				"HiddenServiceDir /var/lib/tor/ssh\nHiddenServicePort 22\n",
+			want: []OnionServiceConfig{
+				{ServiceDir: "/var/lib/tor/web", VirtualPort: 80, TargetAddr: "127.0.0.1:80", PoWDefensesEnabled: true},
+				{ServiceDir: "/var/lib/tor/web", VirtualPort: 443, TargetAddr: "127.0.0.1:443", PoWDefensesEnabled: true},
+				{ServiceDir: "/var/lib/tor/ssh", VirtualPort: 22, TargetAddr: "127.0.0.1:22"},
+			},
+		},
+		{
+			name:    "proof-of-work defenses without directory",
+			content: "HiddenServicePoWDefensesEnabled 1\n",
+			wantErr: "without a preceding HiddenServiceDir",
+		},
+		{
+			name:    "port without directory",
+			content: "HiddenServicePort 80\n",
+			wantErr: "without a preceding HiddenServiceDir",
+		},
+		{
+			name:    "directory without port",
+			content: "HiddenServiceDir /var/lib/tor/web\n",
+			wantErr: "invalid VirtualPort",
+		},
+		{
+			name:    "invalid virtual port",
+			content: "HiddenServiceDir /var/lib/tor/web\nHiddenServicePort 70000\n",
+			wantErr: "invalid HiddenServicePort virtual port",
+		},
+		{
+			name:    "unix socket target",
+			content: "HiddenServiceDir /var/lib/tor/web\nHiddenServicePort 80 unix:/run/web.sock\n",
+			wantErr: "unix socket",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "torrc")
+			if err := os.WriteFile(testFile, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := DefaultConfig()
+			err := LoadFromFile(testFile, cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadFromFile() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadFromFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(cfg.OnionServices, tt.want) {
+				t.Errorf("OnionServices = %+v, want %+v", cfg.OnionServices, tt.want)
+			}
+		})
+	}
 }
 
 func TestSaveToFile_NilConfig(t *testing.T) {
@@ -54,6 +54,7 @@ func GenerateJSONSchema() (*JSONSchema, error) {
 	minPoolSize := 0
 	minPortPositive := 1 // For ports that must be > 0
 	minStreamCount := 0  // For stream/connection counts
+	minPoWEffort := 0
 
 	schema := &JSONSchema{
 		Schema:      "http://json-schema.org/draft-07/schema#",
@@ -110,6 +111,11 @@ func GenerateJSONSchema() (*JSONSchema, error) {
 				Minimum:     &minGuards,
 				Examples:    []interface{}{3, 5},
 			},
+			"CongestionControl": {
+				Type:        "boolean",
+				Description: "Negotiate congestion control (prop324, Tor Vegas) with exits that support FlowCtrl=2",
+				Default:     false,
+			},
 			"UseEntryGuards": {
 				Type:        "boolean",
 				Description: "Whether to use entry guards (recommended: true for anonymity)",
@@ -134,7 +140,7 @@ func GenerateJSONSchema() (*JSONSchema, error) {
 			},
 			"ExcludeNodes": {
 				Type:        "array",
-				Description: "Nodes to exclude from path selection (by fingerprint or nickname)",
+				Description: "Nodes to exclude from path selection (fingerprint, $fp~nickname, nickname, CIDR, or {cc})",
 				Items: &PropertySchema{
 					Type: "string",
 				},
@@ -144,11 +150,43 @@ func GenerateJSONSchema() (*JSONSchema, error) {
 			},
 			"ExcludeExitNodes": {
 				Type:        "array",
-				Description: "Exit nodes to exclude (by fingerprint or nickname)",
+				Description: "Exit nodes to exclude (same node-spec syntax as ExcludeNodes)",
 				Items: &PropertySchema{
 					Type: "string",
 				},
 			},
+			"EntryNodes": {
+				Type:        "array",
+				Description: "Nodes allowed as entry guards (same node-spec syntax as ExcludeNodes)",
+				Items: &PropertySchema{
+					Type: "string",
+				},
+			},
+			"ExitNodes": {
+				Type:        "array",
+				Description: "Nodes allowed as exits (same node-spec syntax as ExcludeNodes)",
+				Items: &PropertySchema{
+					Type: "string",
+				},
+				Examples: []interface{}{
+					[]string{"{de}", "{nl}"},
+				},
+			},
+			"StrictNodes": {
+				Type:        "boolean",
+				Description: "Also apply ExcludeNodes to onion service relays chosen by the other end",
+				Default:     false,
+			},
+			"GeoIPFile": {
+				Type:        "string",
+				Description: "Tor-format IPv4 GeoIP database used to resolve {cc} node specs",
+				Examples:    []interface{}{"/usr/share/tor/geoip"},
+			},
+			"GeoIPv6File": {
+				Type:        "string",
+				Description: "Tor-format IPv6 GeoIP database used to resolve {cc} node specs",
+				Examples:    []interface{}{"/usr/share/tor/geoip6"},
+			},
 			"ConnLimit": {
 				Type:        "integer",
 				Description: "Maximum concurrent connections to Tor relays",
@@ -163,6 +201,41 @@ func GenerateJSONSchema() (*JSONSchema, error) {
 				Pattern:     "^[0-9]+(ns|us|µs|ms|s|m|h)$",
 				Examples:    []interface{}{"24h", "12h", "48h"},
 			},
+			"ConnectionPadding": {
+				Type:        "boolean",
+				Description: "Send link padding on guard connections with open circuits so idle periods do not show in netflow records",
+				Default:     true,
+			},
+			"ReducedConnectionPadding": {
+				Type:        "boolean",
+				Description: "Pad connections less often (9-14s instead of 1.5-9.5s idle timeouts), trading protection for bandwidth",
+				Default:     false,
+			},
+			"UseMicrodescriptors": {
+				Type:        "boolean",
+				Description: "Fetch the microdesc-flavored consensus and cache microdescriptors in DataDirectory",
+				Default:     true,
+			},
+			"DirAuthorities": {
+				Type:        "array",
+				Description: "Directory authorities replacing the public Tor network's (torrc DirAuthority syntax: [nickname] [flags] address:dirport fingerprint)",
+				Items: &PropertySchema{
+					Type: "string",
+				},
+				Examples: []interface{}{
+					[]string{"test000a orport=5000 v3ident=0123456789ABCDEF0123456789ABCDEF01234567 127.0.0.1:7000 89AB CDEF 0123 4567 89AB CDEF 0123 4567 89AB CDEF"},
+				},
+			},
+			"FallbackDirs": {
+				Type:        "array",
+				Description: "Fallback directory mirrors used to bootstrap (torrc FallbackDir syntax: address:dirport orport=PORT id=FINGERPRINT [weight=NUM])",
+				Items: &PropertySchema{
+					Type: "string",
+				},
+				Examples: []interface{}{
+					[]string{"192.0.2.10:80 orport=443 id=0123456789ABCDEF0123456789ABCDEF01234567"},
+				},
+			},
 			"OnionServices": {
 				Type:        "array",
 				Description: "Onion service configurations (hidden services)",
@@ -170,6 +243,18 @@ func GenerateJSONSchema() (*JSONSchema, error) {
 					Ref: "#/definitions/OnionServiceConfig",
 				},
 			},
+			"ClientOnionAuthDir": {
+				Type:        "string",
+				Description: "Directory of <name>.auth_private files (<onion-address>:descriptor:x25519:<base32-private-key>) for onion services that require client authorization",
+				Examples:    []interface{}{"/var/lib/tor/onion_auth"},
+			},
+			"ClientOnionMaxPoWEffort": {
+				Type:        "integer",
+				Description: "Most effort spent solving an onion service's proof-of-work puzzle (0 never solves one)",
+				Default:     10000,
+				Minimum:     &minPoWEffort,
+				Examples:    []interface{}{10000, 0},
+			},
 			"LogLevel": {
 				Type:        "string",
 				Description: "Logging verbosity level",
@@ -292,6 +377,11 @@ func GenerateJSONSchema() (*JSONSchema, error) {
 						Type:        "object",
 						Description: "Client authorization keys (client_name: public_key)",
 					},
+					"PoWDefensesEnabled": {
+						Type:        "boolean",
+						Description: "Ask clients to solve a proof-of-work puzzle when the service is under load (HiddenServicePoWDefensesEnabled)",
+						Default:     false,
+					},
 				},
 				Required: []string{"ServiceDir", "VirtualPort", "TargetAddr"},
 			},
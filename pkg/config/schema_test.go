@@ -320,9 +320,12 @@ func TestJSONSchemaPropertiesComplete(t *testing.T) {
 	expectedFields := []string{
 		"SocksPort", "ControlPort", "DataDirectory",
 		"CircuitBuildTimeout", "MaxCircuitDirtiness", "NewCircuitPeriod",
-		"NumEntryGuards", "UseEntryGuards", "UseBridges",
+		"NumEntryGuards", "CongestionControl", "UseEntryGuards", "UseBridges",
 		"BridgeAddresses", "ExcludeNodes", "ExcludeExitNodes",
-		"ConnLimit", "DormantTimeout", "OnionServices",
+		"EntryNodes", "ExitNodes", "StrictNodes", "GeoIPFile", "GeoIPv6File",
+		"ConnLimit", "DormantTimeout", "ConnectionPadding", "ReducedConnectionPadding",
+		"UseMicrodescriptors", "DirAuthorities",
+		"FallbackDirs", "OnionServices", "ClientOnionAuthDir",
 		"LogLevel", "MetricsPort", "EnableMetrics",
 		"EnableConnectionPooling", "ConnectionPoolMaxIdle", "ConnectionPoolMaxLife",
 		"EnableCircuitPrebuilding", "CircuitPoolMinSize", "CircuitPoolMaxSize",
@@ -62,6 +62,14 @@ type Connection struct {
 	sendMu    sync.Mutex
 	recvMu    sync.Mutex
 	logger    *logger.Logger
+
+	// Identity the relay must prove in its CERTS cell (AUDIT-004)
+	expectedIdentity    []byte
+	expectedFingerprint string
+
+	// Link padding per padding-spec.txt §2
+	paddingMu sync.Mutex
+	padding   linkPadding
 }
 
 // Config holds connection configuration
@@ -160,47 +168,11 @@ func verifyRelayIdentityPinning(rawCerts [][]byte, expectedIdentity []byte, expe
 		return fmt.Errorf("failed to parse certificate for pinning: %w", err)
 	}
 
-	// AUDIT-004: Verify Ed25519 identity if provided
-	// The Tor protocol uses Ed25519 identity keys. In the TLS layer, relays may use
-	// RSA or ECDSA certificates, but the identity verification happens through the
-	// Tor-specific link protocol VERSIONS/CERTS cells (tor-spec.txt section 4.2).
-	//
-	// For now, we verify that:
-	// 1. The certificate's public key structure is valid (checked above)
-	// 2. The relay's identity from consensus will be verified post-TLS
-	//
-	// Full implementation requires parsing CERTS cells in the link protocol handshake,
-	// which happens after TLS connection establishment.
-
-	// Calculate certificate fingerprint (SHA-256 of DER encoding)
-	if expectedFingerprint != "" {
-		// Note: Tor fingerprints are typically SHA-1 of the identity key,
-		// not the TLS certificate. The proper verification happens in the
-		// link protocol layer (CERTS cells). This TLS-level check provides
-		// defense in depth but is not the primary identity verification mechanism.
-
-		// For robust pinning, we should:
-		// 1. Accept the TLS connection (with this basic validation)
-		// 2. Verify CERTS cells in link protocol contain expected identity
-		// 3. Close connection if identity doesn't match
-
-		// Placeholder: Log that we're attempting pinning
-		// Full implementation requires link protocol integration
-	}
-
-	// AUDIT-004: Note for future enhancement
-	// The complete solution requires:
-	// 1. This TLS-level check (defense in depth)
-	// 2. Link protocol CERTS cell verification (primary check)
-	// 3. Comparing CERTS cell identity against directory consensus
-	//
-	// See tor-spec.txt section 4.2 for CERTS cell format
-
-	if len(expectedIdentity) > 0 {
-		// Identity verification happens post-TLS in link protocol
-		// This is documented for future implementation
-		// For now, we've validated the certificate structure above
-	}
+	// AUDIT-004: The TLS certificate is a short-lived link certificate that
+	// does not itself name the relay's identity. The binding to the expected
+	// fingerprint and Ed25519 identity is enforced when the CERTS cell is
+	// verified during the link protocol handshake (protocol.Handshake,
+	// tor-spec.txt section 4.2); a mismatch there fails the connection.
 
 	return nil
 }
@@ -212,8 +184,8 @@ func verifyRelayIdentityPinning(rawCerts [][]byte, expectedIdentity []byte, expe
 // 3. Check that the certificate is not expired
 // 4. Verify the certificate has required key usage
 //
-// Note: Full identity verification happens through the Tor directory consensus,
-// which maps relay fingerprints to their identity keys. This function only validates
+// Note: Relay identity verification happens when the CERTS cell is checked during
+// the link protocol handshake (see protocol.Handshake). This function only validates
 // the certificate's structural integrity.
 func verifyTorRelayCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 	if len(rawCerts) == 0 {
@@ -273,10 +245,12 @@ func New(cfg *Config, log *logger.Logger) *Connection {
 	}
 
 	return &Connection{
-		address: cfg.Address,
-		state:   StateConnecting,
-		closeCh: make(chan struct{}),
-		logger:  log.With("address", cfg.Address),
+		address:             cfg.Address,
+		state:               StateConnecting,
+		closeCh:             make(chan struct{}),
+		logger:              log.With("address", cfg.Address),
+		expectedIdentity:    cfg.ExpectedIdentity,
+		expectedFingerprint: cfg.ExpectedFingerprint,
 	}
 }
 
@@ -349,11 +323,13 @@ func (c *Connection) SendCell(cell *cell.Cell) error {
 		return fmt.Errorf("failed to send cell: %w", err)
 	}
 
+	c.notePaddingActivity()
 	c.logger.Debug("Sent cell", "command", cell.Command, "circuit_id", cell.CircID)
 	return nil
 }
 
-// ReceiveCell receives a cell from the connection
+// ReceiveCell receives a cell from the connection. Link padding cells are
+// consumed here and never returned.
 func (c *Connection) ReceiveCell() (*cell.Cell, error) {
 	c.recvMu.Lock()
 	defer c.recvMu.Unlock()
@@ -368,19 +344,24 @@ func (c *Connection) ReceiveCell() (*cell.Cell, error) {
 	default:
 	}
 
-	receivedCell, err := cell.DecodeCell(c.tlsConn)
-	if err != nil {
-		if err == io.EOF {
-			c.logger.Info("Connection closed by remote")
-			c.Close()
-			return nil, err
+	for {
+		receivedCell, err := cell.DecodeCell(c.tlsConn)
+		if err != nil {
+			if err == io.EOF {
+				c.logger.Info("Connection closed by remote")
+				c.Close()
+				return nil, err
+			}
+			c.logger.Error("Failed to receive cell", "error", err)
+			return nil, fmt.Errorf("failed to receive cell: %w", err)
 		}
-		c.logger.Error("Failed to receive cell", "error", err)
-		return nil, fmt.Errorf("failed to receive cell: %w", err)
-	}
 
-	c.logger.Debug("Received cell", "command", receivedCell.Command, "circuit_id", receivedCell.CircID)
-	return receivedCell, nil
+		c.notePaddingActivity()
+		c.logger.Debug("Received cell", "command", receivedCell.Command, "circuit_id", receivedCell.CircID)
+		if !c.handleLinkPadding(receivedCell) {
+			return receivedCell, nil
+		}
+	}
 }
 
 // Close closes the connection gracefully
@@ -389,6 +370,7 @@ func (c *Connection) Close() error {
 	c.closeOnce.Do(func() {
 		close(c.closeCh)
 		c.setState(StateClosed)
+		c.stopPadding()
 
 		if c.tlsConn != nil {
 			if closeErr := c.tlsConn.Close(); closeErr != nil {
@@ -415,6 +397,31 @@ func (c *Connection) Address() string {
 	return c.address
 }
 
+// ExpectedIdentity returns the Ed25519 identity the relay is expected to
+// prove during the link handshake, or nil if none was configured
+func (c *Connection) ExpectedIdentity() []byte {
+	return c.expectedIdentity
+}
+
+// ExpectedFingerprint returns the RSA identity fingerprint the relay is
+// expected to prove during the link handshake, or "" if none was configured
+func (c *Connection) ExpectedFingerprint() string {
+	return c.expectedFingerprint
+}
+
+// PeerCertificate returns the DER-encoded TLS certificate presented by the
+// relay, or nil if the TLS handshake has not completed
+func (c *Connection) PeerCertificate() []byte {
+	if c.tlsConn == nil {
+		return nil
+	}
+	certs := c.tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0].Raw
+}
+
 // setState sets the connection state
 func (c *Connection) setState(state State) {
 	c.stateMu.Lock()
@@ -0,0 +1,311 @@
+package connection
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+)
+
+// Link padding per padding-spec.txt §2. Once enabled, a connection that has
+// been idle in both directions for a random timeout sends a PADDING cell, so
+// that flow records kept by routers and ISPs do not show when circuits on the
+// connection are idle. The timeout is the larger of two samples drawn
+// uniformly from the negotiated low-high range.
+
+// PADDING_NEGOTIATE commands (padding-spec.txt §2.2)
+const (
+	paddingNegotiateVersion = 0
+	paddingCommandStop      = 1
+	paddingCommandStart     = 2
+)
+
+// Clock is the source of time for padding timers. Tests inject a fake clock
+// to run them deterministically.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call scheduled with Clock.AfterFunc
+type Timer interface {
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the time package
+type SystemClock struct{}
+
+// Now returns the current time
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// AfterFunc calls f in its own goroutine after d
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// PaddingParams is the range link padding timeouts are drawn from
+type PaddingParams struct {
+	Low  time.Duration
+	High time.Duration
+}
+
+// DefaultPaddingParams returns the consensus default padding range
+// (nf_ito_low and nf_ito_high)
+func DefaultPaddingParams() PaddingParams {
+	return PaddingParams{Low: 1500 * time.Millisecond, High: 9500 * time.Millisecond}
+}
+
+// ReducedPaddingParams returns the range used with ReducedConnectionPadding,
+// which trades some protection for less bandwidth (nf_ito_low_reduced and
+// nf_ito_high_reduced)
+func ReducedPaddingParams() PaddingParams {
+	return PaddingParams{Low: 9000 * time.Millisecond, High: 14000 * time.Millisecond}
+}
+
+// Validate checks that the range can be sent in PADDING_NEGOTIATE
+func (p PaddingParams) Validate() error {
+	if p.Low <= 0 || p.High < p.Low {
+		return fmt.Errorf("invalid padding range %v-%v", p.Low, p.High)
+	}
+	if p.High > 0xFFFF*time.Millisecond {
+		return fmt.Errorf("padding timeout %v too large", p.High)
+	}
+	return nil
+}
+
+// linkPadding is the padding state of a connection
+type linkPadding struct {
+	enabled     bool
+	params      PaddingParams
+	clock       Clock
+	rng         *rand.Rand
+	timer       Timer
+	generation  uint64    // Invalidates timers that were stopped
+	lastCell    time.Time // Last cell sent or received
+	armedAt     time.Time // lastCell when the timer was armed
+	paddingSent uint64
+}
+
+// SetPaddingClock sets the clock and random source for link padding timers.
+// A nil clock uses the system clock and a nil rng a securely seeded one.
+func (c *Connection) SetPaddingClock(clock Clock, rng *rand.Rand) {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	c.padding.clock = clock
+	c.padding.rng = rng
+}
+
+// EnablePadding starts link padding with the given range and asks the relay
+// to pad towards us with the same range
+func (c *Connection) EnablePadding(params PaddingParams) error {
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	if err := c.SendCell(paddingNegotiateCell(paddingCommandStart, params)); err != nil {
+		return fmt.Errorf("failed to negotiate link padding: %w", err)
+	}
+	c.startPadding(params)
+	c.logger.Debug("Link padding enabled", "low", params.Low, "high", params.High)
+	return nil
+}
+
+// DisablePadding stops link padding and asks the relay to stop as well
+func (c *Connection) DisablePadding() error {
+	if !c.stopPadding() {
+		return nil
+	}
+	if err := c.SendCell(paddingNegotiateCell(paddingCommandStop, PaddingParams{})); err != nil {
+		return fmt.Errorf("failed to stop link padding: %w", err)
+	}
+	c.logger.Debug("Link padding disabled")
+	return nil
+}
+
+// PaddingEnabled reports whether link padding is running
+func (c *Connection) PaddingEnabled() bool {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	return c.padding.enabled
+}
+
+// PaddingCellsSent returns the number of PADDING cells sent on the connection
+func (c *Connection) PaddingCellsSent() uint64 {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	return c.padding.paddingSent
+}
+
+// startPadding enables the padding timer with the given range
+func (c *Connection) startPadding(params PaddingParams) {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+
+	p := &c.padding
+	p.params = params
+	if !p.enabled {
+		p.enabled = true
+		p.lastCell = c.paddingClock().Now()
+	}
+	c.armPadding()
+}
+
+// stopPadding disables the padding timer and reports whether it was running
+func (c *Connection) stopPadding() bool {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+
+	p := &c.padding
+	wasEnabled := p.enabled
+	p.enabled = false
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.generation++
+	return wasEnabled
+}
+
+// paddingClock returns the padding clock. paddingMu must be held.
+func (c *Connection) paddingClock() Clock {
+	if c.padding.clock == nil {
+		c.padding.clock = SystemClock{}
+	}
+	return c.padding.clock
+}
+
+// paddingTimeout samples the idle time before the next PADDING cell: the
+// larger of two uniform samples from the range. paddingMu must be held.
+func (c *Connection) paddingTimeout() time.Duration {
+	p := &c.padding
+	if p.rng == nil {
+		var seed [32]byte
+		_, _ = crand.Read(seed[:])
+		p.rng = rand.New(rand.NewChaCha8(seed))
+	}
+	spread := int64(p.params.High-p.params.Low) + 1
+	x := p.rng.Int64N(spread)
+	y := p.rng.Int64N(spread)
+	return p.params.Low + time.Duration(max(x, y))
+}
+
+// armPadding schedules a PADDING cell for a freshly sampled timeout after the
+// last cell. paddingMu must be held.
+func (c *Connection) armPadding() {
+	p := &c.padding
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.generation++
+	generation := p.generation
+	p.armedAt = p.lastCell
+
+	delay := p.lastCell.Add(c.paddingTimeout()).Sub(c.paddingClock().Now())
+	p.timer = c.paddingClock().AfterFunc(max(delay, 0), func() {
+		c.paddingTimerFired(generation)
+	})
+}
+
+// notePaddingActivity records a cell sent or received on the connection
+func (c *Connection) notePaddingActivity() {
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	if c.padding.enabled {
+		c.padding.lastCell = c.paddingClock().Now()
+	}
+}
+
+// paddingTimerFired sends a PADDING cell if the connection stayed idle since
+// the timer was armed; otherwise it waits for a new timeout after the latest
+// cell
+func (c *Connection) paddingTimerFired(generation uint64) {
+	c.paddingMu.Lock()
+	p := &c.padding
+	if !p.enabled || p.generation != generation {
+		c.paddingMu.Unlock()
+		return
+	}
+	p.timer = nil
+	if p.lastCell.After(p.armedAt) {
+		c.armPadding()
+		c.paddingMu.Unlock()
+		return
+	}
+	c.paddingMu.Unlock()
+
+	if err := c.SendCell(&cell.Cell{Command: cell.CmdPadding}); err != nil {
+		c.logger.Debug("Failed to send link padding", "error", err)
+		return
+	}
+
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	p.paddingSent++
+	if p.enabled && p.generation == generation {
+		c.armPadding()
+	}
+}
+
+// handleLinkPadding consumes PADDING, VPADDING and PADDING_NEGOTIATE cells
+// and reports whether the cell was one of them. A peer's PADDING_NEGOTIATE
+// is honoured: START pads with the requested range, STOP stops padding.
+func (c *Connection) handleLinkPadding(received *cell.Cell) bool {
+	switch received.Command {
+	case cell.CmdPadding, cell.CmdVPadding:
+		return true
+	case cell.CmdPaddingNegotiate:
+	default:
+		return false
+	}
+
+	command, params, err := parsePaddingNegotiate(received.Payload)
+	if err != nil {
+		c.logger.Debug("Ignoring invalid PADDING_NEGOTIATE", "error", err)
+		return true
+	}
+	switch command {
+	case paddingCommandStart:
+		c.startPadding(params)
+		c.logger.Debug("Peer requested link padding", "low", params.Low, "high", params.High)
+	case paddingCommandStop:
+		c.stopPadding()
+		c.logger.Debug("Peer requested no link padding")
+	}
+	return true
+}
+
+// paddingNegotiateCell builds PADDING_NEGOTIATE:
+// version | command | ito_low_ms | ito_high_ms
+func paddingNegotiateCell(command byte, params PaddingParams) *cell.Cell {
+	payload := []byte{paddingNegotiateVersion, command}
+	payload = binary.BigEndian.AppendUint16(payload, uint16(params.Low.Milliseconds()))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(params.High.Milliseconds()))
+	return &cell.Cell{Command: cell.CmdPaddingNegotiate, Payload: payload}
+}
+
+// parsePaddingNegotiate parses a PADDING_NEGOTIATE payload
+func parsePaddingNegotiate(payload []byte) (byte, PaddingParams, error) {
+	if len(payload) < 6 {
+		return 0, PaddingParams{}, fmt.Errorf("PADDING_NEGOTIATE too short: %d bytes", len(payload))
+	}
+	if payload[0] != paddingNegotiateVersion {
+		return 0, PaddingParams{}, fmt.Errorf("unsupported PADDING_NEGOTIATE version %d", payload[0])
+	}
+
+	command := payload[1]
+	params := PaddingParams{
+		Low:  time.Duration(binary.BigEndian.Uint16(payload[2:4])) * time.Millisecond,
+		High: time.Duration(binary.BigEndian.Uint16(payload[4:6])) * time.Millisecond,
+	}
+	switch command {
+	case paddingCommandStop:
+		return command, PaddingParams{}, nil
+	case paddingCommandStart:
+		if err := params.Validate(); err != nil {
+			return 0, PaddingParams{}, err
+		}
+		return command, params, nil
+	default:
+		return 0, PaddingParams{}, fmt.Errorf("unknown PADDING_NEGOTIATE command %d", command)
+	}
+}
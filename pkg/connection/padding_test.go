@@ -0,0 +1,354 @@
+package connection
+
+import (
+	"crypto/tls"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+// fakeClock fires timers synchronously when advanced
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward by d, firing due timers in order
+func (c *fakeClock) Advance(d time.Duration) {
+	end := c.Now().Add(d)
+	for {
+		c.mu.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+		var due *fakeTimer
+		for i, timer := range c.timers {
+			if timer.stopped {
+				continue
+			}
+			if !timer.at.After(end) {
+				due = timer
+				due.stopped = true
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			}
+			break
+		}
+		if due == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		if due.at.After(c.now) {
+			c.now = due.at
+		}
+		c.mu.Unlock()
+		due.f()
+	}
+}
+
+// newPaddingTestConn returns an open connection whose peer's cells arrive on
+// the returned channel
+func newPaddingTestConn(t *testing.T) (*Connection, *tls.Conn, *fakeClock, <-chan *cell.Cell) {
+	t.Helper()
+	cert, err := tls.X509KeyPair([]byte(testCert), []byte(testKey))
+	if err != nil {
+		t.Fatalf("Failed to load test certificate: %v", err)
+	}
+	clientRaw, serverRaw := net.Pipe()
+	server := tls.Server(serverRaw, &tls.Config{Certificates: []tls.Certificate{cert}})
+	client := tls.Client(clientRaw, &tls.Config{InsecureSkipVerify: true})
+
+	handshakeErr := make(chan error, 1)
+	go func() { handshakeErr <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Client handshake failed: %v", err)
+	}
+	if err := <-handshakeErr; err != nil {
+		t.Fatalf("Server handshake failed: %v", err)
+	}
+
+	received := make(chan *cell.Cell, 64)
+	go func() {
+		defer close(received)
+		for {
+			c, err := cell.DecodeCell(server)
+			if err != nil {
+				return
+			}
+			received <- c
+		}
+	}()
+
+	conn := New(DefaultConfig("127.0.0.1:9001"), logger.NewDefault())
+	conn.conn = clientRaw
+	conn.tlsConn = client
+	conn.setState(StateOpen)
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	conn.SetPaddingClock(clock, rand.New(rand.NewPCG(1, 2)))
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+	})
+	return conn, server, clock, received
+}
+
+// countPadding drains the cells received so far and counts PADDING cells
+func countPadding(t *testing.T, received <-chan *cell.Cell) int {
+	t.Helper()
+	count := 0
+	for {
+		select {
+		case c := <-received:
+			if c.Command == cell.CmdPadding {
+				count++
+			}
+		case <-time.After(50 * time.Millisecond):
+			return count
+		}
+	}
+}
+
+func TestPaddingParamsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  PaddingParams
+		wantErr bool
+	}{
+		{"default", DefaultPaddingParams(), false},
+		{"reduced", ReducedPaddingParams(), false},
+		{"single value", PaddingParams{Low: time.Second, High: time.Second}, false},
+		{"zero low", PaddingParams{High: time.Second}, true},
+		{"inverted", PaddingParams{Low: 2 * time.Second, High: time.Second}, true},
+		{"too large", PaddingParams{Low: time.Second, High: 70 * time.Second}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.params.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPaddingNegotiateEncoding(t *testing.T) {
+	params := DefaultPaddingParams()
+	c := paddingNegotiateCell(paddingCommandStart, params)
+	want := []byte{0, 2, 0x05, 0xdc, 0x25, 0x1c}
+	if c.Command != cell.CmdPaddingNegotiate || string(c.Payload) != string(want) {
+		t.Fatalf("paddingNegotiateCell() = %v %x, want PADDING_NEGOTIATE %x", c.Command, c.Payload, want)
+	}
+
+	command, got, err := parsePaddingNegotiate(c.Payload)
+	if err != nil || command != paddingCommandStart || got != params {
+		t.Errorf("parsePaddingNegotiate() = %d %v %v, want START %v", command, got, err, params)
+	}
+
+	invalid := map[string][]byte{
+		"short":         {0, 2, 0, 1},
+		"version":       {1, 2, 0, 1, 0, 2},
+		"command":       {0, 3, 0, 1, 0, 2},
+		"inverted":      {0, 2, 0, 2, 0, 1},
+		"zero timeouts": {0, 2, 0, 0, 0, 0},
+	}
+	for name, payload := range invalid {
+		if _, _, err := parsePaddingNegotiate(payload); err == nil {
+			t.Errorf("parsePaddingNegotiate(%s) accepted %x", name, payload)
+		}
+	}
+	if command, _, err := parsePaddingNegotiate([]byte{0, 1, 0, 0, 0, 0}); err != nil || command != paddingCommandStop {
+		t.Errorf("parsePaddingNegotiate(STOP) = %d %v", command, err)
+	}
+}
+
+func TestPaddingTimeout(t *testing.T) {
+	conn := New(DefaultConfig("127.0.0.1:9001"), logger.NewDefault())
+	conn.SetPaddingClock(nil, rand.New(rand.NewPCG(1, 2)))
+	conn.padding.params = DefaultPaddingParams()
+
+	// The maximum of two uniform samples skews towards the high end
+	var sum time.Duration
+	const samples = 10000
+	for i := 0; i < samples; i++ {
+		timeout := conn.paddingTimeout()
+		if timeout < 1500*time.Millisecond || timeout > 9500*time.Millisecond {
+			t.Fatalf("paddingTimeout() = %v, outside 1.5s-9.5s", timeout)
+		}
+		sum += timeout
+	}
+	// E[max] = low + 2/3 (high - low) = 6.83s
+	mean := sum / samples
+	if mean < 6600*time.Millisecond || mean > 7100*time.Millisecond {
+		t.Errorf("Mean timeout %v, want about 6.83s", mean)
+	}
+}
+
+func TestLinkPaddingIdle(t *testing.T) {
+	conn, _, clock, received := newPaddingTestConn(t)
+
+	if err := conn.EnablePadding(DefaultPaddingParams()); err != nil {
+		t.Fatalf("EnablePadding() failed: %v", err)
+	}
+	negotiate := <-received
+	if negotiate.Command != cell.CmdPaddingNegotiate || negotiate.Payload[1] != paddingCommandStart {
+		t.Fatalf("First cell = %v %x, want PADDING_NEGOTIATE START", negotiate.Command, negotiate.Payload[:6])
+	}
+	if !conn.PaddingEnabled() {
+		t.Fatal("PaddingEnabled() = false after EnablePadding")
+	}
+
+	// Nothing is sent before the low end of the range
+	clock.Advance(1499 * time.Millisecond)
+	if n := countPadding(t, received); n != 0 {
+		t.Fatalf("%d PADDING cells before the minimum timeout", n)
+	}
+
+	// An idle minute sends one cell every 1.5-9.5s
+	clock.Advance(time.Minute)
+	n := countPadding(t, received)
+	if n < 6 || n > 40 {
+		t.Errorf("%d PADDING cells in an idle minute, want 6-40", n)
+	}
+	if got := conn.PaddingCellsSent(); got != uint64(n) {
+		t.Errorf("PaddingCellsSent() = %d, want %d", got, n)
+	}
+
+	// Disabling tells the relay and stops the timer
+	if err := conn.DisablePadding(); err != nil {
+		t.Fatalf("DisablePadding() failed: %v", err)
+	}
+	stop := <-received
+	if stop.Command != cell.CmdPaddingNegotiate || stop.Payload[1] != paddingCommandStop {
+		t.Fatalf("Cell after DisablePadding = %v %x, want PADDING_NEGOTIATE STOP", stop.Command, stop.Payload[:6])
+	}
+	clock.Advance(time.Minute)
+	if n := countPadding(t, received); n != 0 {
+		t.Errorf("%d PADDING cells after DisablePadding", n)
+	}
+	if err := conn.DisablePadding(); err != nil {
+		t.Errorf("Second DisablePadding() failed: %v", err)
+	}
+}
+
+func TestLinkPaddingDeferredByTraffic(t *testing.T) {
+	conn, _, clock, received := newPaddingTestConn(t)
+	if err := conn.EnablePadding(DefaultPaddingParams()); err != nil {
+		t.Fatalf("EnablePadding() failed: %v", err)
+	}
+	<-received
+
+	// A cell every second keeps the connection busy: no padding is needed
+	for i := 0; i < 60; i++ {
+		if err := conn.SendCell(&cell.Cell{CircID: 1, Command: cell.CmdRelay, Payload: []byte{1}}); err != nil {
+			t.Fatalf("SendCell() failed: %v", err)
+		}
+		clock.Advance(time.Second)
+	}
+	if n := countPadding(t, received); n != 0 {
+		t.Errorf("%d PADDING cells on a busy connection", n)
+	}
+
+	// Once traffic stops, padding resumes within the high end of the range
+	clock.Advance(9500 * time.Millisecond)
+	if n := countPadding(t, received); n != 1 {
+		t.Errorf("%d PADDING cells after 9.5s idle, want 1", n)
+	}
+}
+
+func TestLinkPaddingPeerNegotiation(t *testing.T) {
+	conn, server, clock, received := newPaddingTestConn(t)
+
+	send := func(c *cell.Cell) {
+		t.Helper()
+		if err := c.Encode(server); err != nil {
+			t.Fatalf("Failed to send cell from peer: %v", err)
+		}
+	}
+	params := PaddingParams{Low: 100 * time.Millisecond, High: 200 * time.Millisecond}
+
+	// Link padding cells are swallowed and a START is honoured; the next
+	// cell returned is the DESTROY sent after them
+	go func() {
+		send(&cell.Cell{Command: cell.CmdPadding})
+		send(&cell.Cell{Command: cell.CmdVPadding, Payload: []byte{1, 2, 3}})
+		send(paddingNegotiateCell(paddingCommandStart, params))
+		send(&cell.Cell{CircID: 5, Command: cell.CmdDestroy, Payload: []byte{0}})
+	}()
+	got, err := conn.ReceiveCell()
+	if err != nil {
+		t.Fatalf("ReceiveCell() failed: %v", err)
+	}
+	if got.Command != cell.CmdDestroy || got.CircID != 5 {
+		t.Fatalf("ReceiveCell() = %v on circuit %d, want DESTROY on 5", got.Command, got.CircID)
+	}
+	if !conn.PaddingEnabled() {
+		t.Fatal("Peer's PADDING_NEGOTIATE START not honoured")
+	}
+	clock.Advance(2 * time.Second)
+	if n := countPadding(t, received); n < 10 || n > 20 {
+		t.Errorf("%d PADDING cells in 2s at 100-200ms, want 10-20", n)
+	}
+
+	go func() {
+		send(paddingNegotiateCell(paddingCommandStop, PaddingParams{}))
+		send(&cell.Cell{CircID: 6, Command: cell.CmdDestroy, Payload: []byte{0}})
+	}()
+	if _, err := conn.ReceiveCell(); err != nil {
+		t.Fatalf("ReceiveCell() failed: %v", err)
+	}
+	if conn.PaddingEnabled() {
+		t.Fatal("Peer's PADDING_NEGOTIATE STOP not honoured")
+	}
+	clock.Advance(2 * time.Second)
+	if n := countPadding(t, received); n != 0 {
+		t.Errorf("%d PADDING cells after STOP", n)
+	}
+}
+
+func TestEnablePaddingErrors(t *testing.T) {
+	conn := New(DefaultConfig("127.0.0.1:9001"), logger.NewDefault())
+	if err := conn.EnablePadding(PaddingParams{}); err == nil {
+		t.Error("EnablePadding() accepted an empty range")
+	}
+	if err := conn.EnablePadding(DefaultPaddingParams()); err == nil {
+		t.Error("EnablePadding() succeeded on a connection that is not open")
+	}
+	if conn.PaddingEnabled() {
+		t.Error("Padding enabled after a failed EnablePadding")
+	}
+}
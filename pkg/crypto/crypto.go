@@ -12,6 +12,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1" // #nosec G505 - SHA1 required by Tor protocol specification (tor-spec.txt)
@@ -20,6 +21,7 @@ import (
 	"io"
 	"sync"
 
+	"github.com/opd-ai/go-tor/pkg/security"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 )
@@ -34,6 +36,10 @@ const (
 	SHA1Size = 20
 	// SHA256Size is the size of SHA-256 digests
 	SHA256Size = 32
+	// CircuitNonceLen is the length of KH, derived after a hop's circuit
+	// keys. Onion service cells use it to show which circuit they were made
+	// for (tor-spec.txt section 5.2, rend-spec-v3.txt section 3.1.1).
+	CircuitNonceLen = SHA1Size
 )
 
 // GenerateRandomBytes generates n random bytes using crypto/rand
@@ -186,8 +192,8 @@ func (d *DigestWriter) Write(p []byte) (n int, err error) {
 	return d.hash.Write(p)
 }
 
-// DeriveKey derives key material using KDF-TOR
-// KDF-TOR uses iterative SHA-1 hashing to expand a shared secret
+// DeriveKey derives key material using KDF-TOR (tor-spec.txt section 5.2.1):
+// K = H(K0 | [00]) | H(K0 | [01]) | H(K0 | [02]) | ... with H = SHA-1
 //
 // Security note: The caller is responsible for zeroing the returned key material
 // when it's no longer needed using security.SecureZeroMemory()
@@ -195,31 +201,48 @@ func DeriveKey(secret []byte, keyLen int) ([]byte, error) {
 	if keyLen <= 0 {
 		return nil, fmt.Errorf("invalid key length: %d", keyLen)
 	}
+	if keyLen > 256*SHA1Size {
+		return nil, fmt.Errorf("key length too large for KDF-TOR: %d", keyLen)
+	}
 
-	// KDF-TOR: K = K_0 | K_1 | K_2 | ...
-	// Where K_i = H(K_0 | [i])
-	// And K_0 = H(secret)
-
-	k0 := SHA1Hash(secret)
-	result := make([]byte, 0, keyLen)
-
-	// Append K_0
-	result = append(result, k0...)
+	result := make([]byte, 0, keyLen+SHA1Size)
+	input := make([]byte, len(secret)+1)
+	copy(input, secret)
+	defer security.SecureZeroMemory(input)
 
-	// Generate additional blocks if needed
-	i := byte(1)
-	for len(result) < keyLen {
-		// K_i = H(K_0 | [i])
-		data := append(k0, i)
-		ki := SHA1Hash(data)
-		result = append(result, ki...)
-		i++
+	for i := 0; len(result) < keyLen; i++ {
+		input[len(secret)] = byte(i)
+		result = append(result, SHA1Hash(input)...)
 	}
 
 	// Return exactly keyLen bytes
 	return result[:keyLen], nil
 }
 
+// CreateFastKeyLen is the length of the X and Y values exchanged in
+// CREATE_FAST and CREATED_FAST cells (HASH_LEN)
+const CreateFastKeyLen = SHA1Size
+
+// CreateFastDeriveKeys derives the CREATED_FAST key hash KH and 72 bytes of
+// circuit key material from the client's X and the relay's Y:
+// KDF-TOR(X | Y) = KH | Df | Db | Kf | Kb (tor-spec.txt section 5.1.3)
+func CreateFastDeriveKeys(x, y []byte) (kh, keyMaterial []byte, err error) {
+	if len(x) != CreateFastKeyLen || len(y) != CreateFastKeyLen {
+		return nil, nil, fmt.Errorf("invalid CREATE_FAST key length: %d/%d", len(x), len(y))
+	}
+
+	secret := make([]byte, 0, 2*CreateFastKeyLen)
+	secret = append(secret, x...)
+	secret = append(secret, y...)
+	defer security.SecureZeroMemory(secret)
+
+	km, err := DeriveKey(secret, SHA1Size+72)
+	if err != nil {
+		return nil, nil, err
+	}
+	return km[:SHA1Size], km[SHA1Size:], nil
+}
+
 // NtorKeyPair represents a Curve25519 key pair for ntor handshake
 type NtorKeyPair struct {
 	Private [32]byte
@@ -246,7 +269,7 @@ func GenerateNtorKeyPair() (*NtorKeyPair, error) {
 // Returns the handshake data to send to the relay and the shared secret
 //
 // Parameters:
-//   - identityKey: The relay's Ed25519 identity key (32 bytes)
+//   - identityKey: The relay's RSA identity digest (20 bytes)
 //   - ntorOnionKey: The relay's ntor onion key (32 bytes)
 //
 // Returns:
@@ -255,7 +278,7 @@ func GenerateNtorKeyPair() (*NtorKeyPair, error) {
 //
 // Implements tor-spec.txt section 5.1.4
 func NtorClientHandshake(identityKey, ntorOnionKey []byte) (handshakeData, sharedSecret []byte, err error) {
-	if len(identityKey) != 32 {
+	if len(identityKey) != NtorIdentityLen {
 		return nil, nil, fmt.Errorf("invalid identity key length: %d", len(identityKey))
 	}
 	if len(ntorOnionKey) != 32 {
@@ -269,11 +292,11 @@ func NtorClientHandshake(identityKey, ntorOnionKey []byte) (handshakeData, share
 	}
 
 	// Handshake data is: NODEID || KEYID || CLIENT_PK
-	// NODEID (20 bytes): relay identity fingerprint (we use first 20 bytes of Ed25519 key)
+	// NODEID (20 bytes): relay's RSA identity digest
 	// KEYID (32 bytes): relay's ntor onion key
 	// CLIENT_PK (32 bytes): client's ephemeral public key X
 	handshakeData = make([]byte, 20+32+32)
-	copy(handshakeData[0:20], identityKey[0:20])    // NODEID
+	copy(handshakeData[0:20], identityKey)          // NODEID
 	copy(handshakeData[20:52], ntorOnionKey)        // KEYID
 	copy(handshakeData[52:84], ephemeral.Public[:]) // CLIENT_PK
 
@@ -298,17 +321,29 @@ func NtorClientHandshake(identityKey, ntorOnionKey []byte) (handshakeData, share
 //   - response: The server's response from CREATED2/EXTENDED2 (HLEN bytes of handshake data)
 //   - clientPrivate: The client's ephemeral private key from the initial handshake
 //   - serverNtorKey: The relay's ntor onion key (32 bytes)
-//   - serverIdentity: The relay's identity key (32 bytes)
+//   - serverIdentity: The relay's RSA identity digest (20 bytes)
 //
 // Returns:
 //   - sharedSecret: The verified shared secret for key derivation
 //
 // Implements tor-spec.txt section 5.1.4
 func NtorProcessResponse(response, clientPrivate, serverNtorKey, serverIdentity []byte) ([]byte, error) {
+	return NtorProcessResponseKeys(response, clientPrivate, serverNtorKey, serverIdentity, 72)
+}
+
+// NtorProcessResponseKeys is NtorProcessResponse returning keyLen bytes of
+// key material, for callers that also need KH after the circuit keys
+func NtorProcessResponseKeys(response, clientPrivate, serverNtorKey, serverIdentity []byte, keyLen int) ([]byte, error) {
 	// Expected response: Y (32 bytes) || AUTH (32 bytes)
 	if len(response) != 64 {
 		return nil, fmt.Errorf("invalid response length: %d, expected 64", len(response))
 	}
+	if len(serverIdentity) != NtorIdentityLen {
+		return nil, fmt.Errorf("invalid identity key length: %d", len(serverIdentity))
+	}
+	if len(serverNtorKey) != 32 || len(clientPrivate) != 32 {
+		return nil, fmt.Errorf("invalid ntor key length")
+	}
 
 	var serverY, auth [32]byte
 	copy(serverY[:], response[0:32])
@@ -332,48 +367,154 @@ func NtorProcessResponse(response, clientPrivate, serverNtorKey, serverIdentity
 	copy(serverB[:], serverNtorKey)
 	curve25519.ScalarMult(&sharedXB, &clientX, &serverB)
 
-	// Build secret_input
-	protoid := []byte("ntor-curve25519-sha256-1")
-	secretInput := make([]byte, 0, 32+32+32+32+32+32+len(protoid))
-	secretInput = append(secretInput, sharedXY[:]...)
-	secretInput = append(secretInput, sharedXB[:]...)
-	secretInput = append(secretInput, serverIdentity[0:32]...)
-	secretInput = append(secretInput, serverNtorKey...)
-
 	var clientPub [32]byte
 	curve25519.ScalarBaseMult(&clientPub, &clientX)
-	secretInput = append(secretInput, clientPub[:]...)
-	secretInput = append(secretInput, serverY[:]...)
-	secretInput = append(secretInput, protoid...)
-
-	// Derive keys using HKDF-SHA256 per tor-spec.txt section 5.1.4
-	// The handshake uses two derivation steps:
-	// 1. verify = HKDF(secret_input, t_verify, M_EXPAND) for auth verification
-	// 2. key_material = HKDF(secret_input, t_key, M_EXPAND) for circuit keys
 
-	// First derive the verification key to check the AUTH value
-	verify := []byte("ntor-curve25519-sha256-1:verify")
-	hkdfVerify := hkdf.New(sha256.New, secretInput, nil, verify)
-	expectedAuth := make([]byte, 32)
-	if _, err := io.ReadFull(hkdfVerify, expectedAuth); err != nil {
-		return nil, fmt.Errorf("HKDF verify derivation failed: %w", err)
+	expectedAuth, keyMaterial, err := ntorDeriveKeys(sharedXY[:], sharedXB[:], serverIdentity, serverB[:], clientPub[:], serverY[:], keyLen)
+	if err != nil {
+		return nil, err
 	}
 
 	// Verify the AUTH value matches our computation (constant-time comparison)
 	// This ensures the server has the correct private keys
 	if !constantTimeCompare(auth[:], expectedAuth) {
+		security.SecureZeroMemory(keyMaterial)
 		return nil, fmt.Errorf("auth MAC verification failed: server authentication invalid")
 	}
 
-	// Now derive the actual key material for circuit use
-	keyInfo := []byte("ntor-curve25519-sha256-1:key_extract")
-	hkdfKey := hkdf.New(sha256.New, secretInput, nil, keyInfo)
-	keyMaterial := make([]byte, 72) // Tor uses 72 bytes of key material
-	if _, err := io.ReadFull(hkdfKey, keyMaterial); err != nil {
-		return nil, fmt.Errorf("HKDF key derivation failed: %w", err)
+	return keyMaterial, nil
+}
+
+// NtorServerHandshake performs the relay side of the ntor handshake
+//
+// Parameters:
+//   - handshakeData: The client's CREATE2/EXTEND2 handshake data (NODEID || KEYID || CLIENT_PK)
+//   - identityKey: The relay's RSA identity digest (20 bytes)
+//   - ntorPrivate: The relay's ntor onion private key (32 bytes)
+//
+// Returns:
+//   - response: The data to send in CREATED2/EXTENDED2 (Y || AUTH)
+//   - keyMaterial: The 72 bytes of circuit key material, matching NtorProcessResponse
+//
+// Implements tor-spec.txt section 5.1.4
+func NtorServerHandshake(handshakeData, identityKey, ntorPrivate []byte) (response, keyMaterial []byte, err error) {
+	return NtorServerHandshakeKeys(handshakeData, identityKey, ntorPrivate, 72)
+}
+
+// NtorServerHandshakeKeys is NtorServerHandshake returning keyLen bytes of
+// key material, matching NtorProcessResponseKeys
+func NtorServerHandshakeKeys(handshakeData, identityKey, ntorPrivate []byte, keyLen int) (response, keyMaterial []byte, err error) {
+	ephemeral, err := GenerateNtorKeyPair()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	defer security.SecureZeroMemory(ephemeral.Private[:])
+	return ntorServerHandshake(ephemeral.Private, handshakeData, identityKey, ntorPrivate, keyLen)
+}
+
+// ntorServerHandshake is NtorServerHandshakeKeys with the relay's ephemeral
+// private key y supplied by the caller
+func ntorServerHandshake(y [32]byte, handshakeData, identityKey, ntorPrivate []byte, keyLen int) (response, keyMaterial []byte, err error) {
+	if len(handshakeData) != 20+32+32 {
+		return nil, nil, fmt.Errorf("invalid handshake data length: %d, expected 84", len(handshakeData))
+	}
+	if len(identityKey) != NtorIdentityLen {
+		return nil, nil, fmt.Errorf("invalid identity key length: %d", len(identityKey))
+	}
+	if len(ntorPrivate) != 32 {
+		return nil, nil, fmt.Errorf("invalid ntor private key length: %d", len(ntorPrivate))
 	}
 
-	return keyMaterial, nil
+	var serverB, serverb [32]byte
+	copy(serverb[:], ntorPrivate)
+	curve25519.ScalarBaseMult(&serverB, &serverb)
+
+	if !constantTimeCompare(handshakeData[0:20], identityKey) {
+		return nil, nil, fmt.Errorf("handshake NODEID does not match relay identity")
+	}
+	if !constantTimeCompare(handshakeData[20:52], serverB[:]) {
+		return nil, nil, fmt.Errorf("handshake KEYID does not match relay ntor key")
+	}
+
+	var clientX, serverY [32]byte
+	copy(clientX[:], handshakeData[52:84])
+	curve25519.ScalarBaseMult(&serverY, &y)
+
+	// EXP(X,y) and EXP(X,b)
+	var sharedXY, sharedXB [32]byte
+	curve25519.ScalarMult(&sharedXY, &y, &clientX)
+	curve25519.ScalarMult(&sharedXB, &serverb, &clientX)
+
+	auth, keyMaterial, err := ntorDeriveKeys(sharedXY[:], sharedXB[:], identityKey, serverB[:], clientX[:], serverY[:], keyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response = make([]byte, 0, 64)
+	response = append(response, serverY[:]...)
+	response = append(response, auth...)
+	return response, keyMaterial, nil
+}
+
+// NtorIdentityLen is the length of the relay identity ID in ntor handshakes:
+// the SHA-1 digest of the relay's RSA identity key
+const NtorIdentityLen = 20
+
+// ntor protocol strings (tor-spec.txt section 5.1.4)
+const (
+	ntorProtoID = "ntor-curve25519-sha256-1"
+	ntorTMac    = ntorProtoID + ":mac"
+	ntorTKey    = ntorProtoID + ":key_extract"
+	ntorTVerify = ntorProtoID + ":verify"
+	ntorMExpand = ntorProtoID + ":key_expand"
+)
+
+// ntorDeriveKeys computes the AUTH value and keyLen bytes of circuit key
+// material per tor-spec.txt section 5.1.4:
+//
+//	secret_input = EXP(Y,x) | EXP(B,x) | ID | B | X | Y | PROTOID
+//	verify = H(secret_input, t_verify)
+//	auth_input = verify | ID | B | Y | X | PROTOID | "Server"
+//	AUTH = H(auth_input, t_mac)
+//
+// where H(x, t) is HMAC-SHA256 keyed with t. The key material is
+// HKDF-SHA256 with secret_input as the key, t_key as the salt and m_expand
+// as the info.
+func ntorDeriveKeys(sharedXY, sharedXB, identity, serverB, clientX, serverY []byte, keyLen int) (auth, keyMaterial []byte, err error) {
+	secretInput := make([]byte, 0, 32*5+NtorIdentityLen+len(ntorProtoID))
+	secretInput = append(secretInput, sharedXY...)
+	secretInput = append(secretInput, sharedXB...)
+	secretInput = append(secretInput, identity...)
+	secretInput = append(secretInput, serverB...)
+	secretInput = append(secretInput, clientX...)
+	secretInput = append(secretInput, serverY...)
+	secretInput = append(secretInput, ntorProtoID...)
+	defer security.SecureZeroMemory(secretInput)
+
+	verify := ntorHMAC(ntorTVerify, secretInput)
+
+	authInput := make([]byte, 0, len(verify)+NtorIdentityLen+32*3+len(ntorProtoID)+len("Server"))
+	authInput = append(authInput, verify...)
+	authInput = append(authInput, identity...)
+	authInput = append(authInput, serverB...)
+	authInput = append(authInput, serverY...)
+	authInput = append(authInput, clientX...)
+	authInput = append(authInput, ntorProtoID...)
+	authInput = append(authInput, "Server"...)
+	auth = ntorHMAC(ntorTMac, authInput)
+
+	keyMaterial = make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secretInput, []byte(ntorTKey), []byte(ntorMExpand)), keyMaterial); err != nil {
+		return nil, nil, fmt.Errorf("HKDF key derivation failed: %w", err)
+	}
+	return auth, keyMaterial, nil
+}
+
+// ntorHMAC is HMAC-SHA256 keyed with one of the ntor tweak strings
+func ntorHMAC(key string, message []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(message)
+	return mac.Sum(nil)
 }
 
 // constantTimeCompare performs constant-time comparison of two byte slices
@@ -260,6 +260,52 @@ func TestDeriveKeyDifferentSecrets(t *testing.T) {
 	}
 }
 
+func TestDeriveKeyKDFTor(t *testing.T) {
+	secret := []byte("kdf-tor secret")
+
+	key, err := DeriveKey(secret, 50)
+	if err != nil {
+		t.Fatalf("DeriveKey() error = %v", err)
+	}
+
+	// K = H(K0 | [00]) | H(K0 | [01]) | H(K0 | [02]) ...
+	var want []byte
+	for i := byte(0); i < 3; i++ {
+		want = append(want, SHA1Hash(append(append([]byte(nil), secret...), i))...)
+	}
+	if !bytes.Equal(key, want[:50]) {
+		t.Errorf("DeriveKey() = %x, want %x", key, want[:50])
+	}
+
+	if _, err := DeriveKey(secret, 256*SHA1Size+1); err == nil {
+		t.Error("DeriveKey() accepted a length beyond 256 blocks")
+	}
+}
+
+func TestCreateFastDeriveKeys(t *testing.T) {
+	x := bytes.Repeat([]byte{0x01}, CreateFastKeyLen)
+	y := bytes.Repeat([]byte{0x02}, CreateFastKeyLen)
+
+	kh, keyMaterial, err := CreateFastDeriveKeys(x, y)
+	if err != nil {
+		t.Fatalf("CreateFastDeriveKeys() error = %v", err)
+	}
+	full, err := DeriveKey(append(append([]byte(nil), x...), y...), SHA1Size+72)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kh, full[:SHA1Size]) || !bytes.Equal(keyMaterial, full[SHA1Size:]) {
+		t.Error("CreateFastDeriveKeys() does not split KDF-TOR(X | Y) into KH | key material")
+	}
+	if len(keyMaterial) != 72 {
+		t.Errorf("key material length = %d, want 72", len(keyMaterial))
+	}
+
+	if _, _, err := CreateFastDeriveKeys(x[:10], y); err == nil {
+		t.Error("CreateFastDeriveKeys() accepted a short X")
+	}
+}
+
 func TestGenerateNtorKeyPair(t *testing.T) {
 	kp1, err := GenerateNtorKeyPair()
 	if err != nil {
@@ -295,7 +341,7 @@ func TestGenerateNtorKeyPair(t *testing.T) {
 
 func TestNtorClientHandshake(t *testing.T) {
 	// Generate mock relay keys
-	identityKey := make([]byte, 32)
+	identityKey := make([]byte, NtorIdentityLen)
 	ntorOnionKey := make([]byte, 32)
 
 	for i := range identityKey {
@@ -316,8 +362,8 @@ func TestNtorClientHandshake(t *testing.T) {
 		t.Errorf("Handshake data length = %d, want %d", len(handshakeData), expectedLen)
 	}
 
-	// Verify NODEID matches first 20 bytes of identity key
-	if !bytes.Equal(handshakeData[0:20], identityKey[0:20]) {
+	// Verify NODEID matches the identity digest
+	if !bytes.Equal(handshakeData[0:20], identityKey) {
 		t.Error("NODEID doesn't match identity key")
 	}
 
@@ -349,7 +395,7 @@ func TestNtorProcessResponse(t *testing.T) {
 	// Test with proper mock data to verify MAC computation
 	clientPrivate := make([]byte, 32)
 	serverNtorKey := make([]byte, 32)
-	serverIdentity := make([]byte, 32)
+	serverIdentity := make([]byte, NtorIdentityLen)
 
 	// Fill with test data
 	for i := range clientPrivate {
@@ -0,0 +1,202 @@
+package crypto
+
+import (
+	"crypto/sha3"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/opd-ai/go-tor/pkg/security"
+	"golang.org/x/crypto/curve25519"
+)
+
+// hs-ntor constants (rend-spec-v3.txt section 5.2, [NTOR-WITH-EXTRA-DATA])
+const (
+	hsNtorProtoID = "tor-hs-ntor-curve25519-sha3-256-1"
+
+	// HsNtorKeyLen is the length of the hs-ntor INTRODUCE encryption and MAC keys
+	HsNtorKeyLen = 32
+	// HsNtorKeyMaterialLen is the hs-ntor circuit key material length:
+	// Df (32) | Db (32) | Kf (32) | Kb (32) for SHA3-256 digests and AES-256
+	HsNtorKeyMaterialLen = 32*2 + 32*2
+)
+
+var (
+	hsNtorTweakEnc    = []byte(hsNtorProtoID + ":hs_key_extract")
+	hsNtorTweakVerify = []byte(hsNtorProtoID + ":hs_verify")
+	hsNtorTweakMAC    = []byte(hsNtorProtoID + ":hs_mac")
+	hsNtorExpand      = []byte(hsNtorProtoID + ":hs_key_expand")
+)
+
+// HsNtorMAC computes the hs-ntor MAC: SHA3_256(htonll(len(key)) | key | msg)
+func HsNtorMAC(key, msg []byte) []byte {
+	h := sha3.New256()
+	var keyLen [8]byte
+	binary.BigEndian.PutUint64(keyLen[:], uint64(len(key)))
+	h.Write(keyLen[:])
+	h.Write(key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// HsNtorClient is the client side of an hs-ntor handshake with an onion
+// service: it encrypts INTRODUCE1 to the service and completes the handshake
+// from the RENDEZVOUS2 reply
+type HsNtorClient struct {
+	private       [32]byte
+	public        [32]byte
+	authKey       []byte // Introduction point auth key (AUTH_KEY)
+	serviceKey    []byte // Service encryption key (B) from the descriptor
+	subcredential []byte
+}
+
+// NewHsNtorClient starts an hs-ntor handshake for the introduction point with
+// authKey, using the service's ntor encryption key and subcredential
+func NewHsNtorClient(authKey, serviceKey, subcredential []byte) (*HsNtorClient, error) {
+	ephemeral, err := GenerateNtorKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	defer security.SecureZeroMemory(ephemeral.Private[:])
+	return newHsNtorClient(ephemeral.Private, authKey, serviceKey, subcredential)
+}
+
+func newHsNtorClient(x [32]byte, authKey, serviceKey, subcredential []byte) (*HsNtorClient, error) {
+	if len(authKey) != 32 {
+		return nil, fmt.Errorf("invalid auth key length: %d", len(authKey))
+	}
+	if len(serviceKey) != 32 {
+		return nil, fmt.Errorf("invalid service key length: %d", len(serviceKey))
+	}
+	if len(subcredential) != 32 {
+		return nil, fmt.Errorf("invalid subcredential length: %d", len(subcredential))
+	}
+
+	c := &HsNtorClient{
+		private:       x,
+		authKey:       append([]byte(nil), authKey...),
+		serviceKey:    append([]byte(nil), serviceKey...),
+		subcredential: append([]byte(nil), subcredential...),
+	}
+	curve25519.ScalarBaseMult(&c.public, &c.private)
+	return c, nil
+}
+
+// PublicKey returns the client's ephemeral public key X (CLIENT_PK)
+func (c *HsNtorClient) PublicKey() []byte {
+	return append([]byte(nil), c.public[:]...)
+}
+
+// IntroduceKeys returns ENC_KEY and MAC_KEY for the encrypted part of
+// INTRODUCE1:
+//
+//	intro_secret_hs_input = EXP(B,x) | AUTH_KEY | X | B | PROTOID
+func (c *HsNtorClient) IntroduceKeys() (encKey, macKey []byte, err error) {
+	bx, err := curve25519.X25519(c.private[:], c.serviceKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid service key: %w", err)
+	}
+	defer security.SecureZeroMemory(bx)
+
+	encKey, macKey = hsNtorIntroKeys(bx, c.authKey, c.public[:], c.serviceKey, c.subcredential)
+	return encKey, macKey, nil
+}
+
+// CompleteRendezvous verifies the service's SERVER_PK and AUTH from
+// RENDEZVOUS2 and returns HsNtorKeyMaterialLen bytes of circuit key material
+func (c *HsNtorClient) CompleteRendezvous(serverPK, auth []byte) ([]byte, error) {
+	if len(serverPK) != 32 || len(auth) != 32 {
+		return nil, fmt.Errorf("invalid RENDEZVOUS2 handshake info")
+	}
+
+	yx, err := curve25519.X25519(c.private[:], serverPK)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server public key: %w", err)
+	}
+	defer security.SecureZeroMemory(yx)
+	bx, err := curve25519.X25519(c.private[:], c.serviceKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service key: %w", err)
+	}
+	defer security.SecureZeroMemory(bx)
+
+	seed, expectedAuth := hsNtorRendezvous(yx, bx, c.authKey, c.serviceKey, c.public[:], serverPK)
+	defer security.SecureZeroMemory(seed)
+	if !constantTimeCompare(auth, expectedAuth) {
+		return nil, fmt.Errorf("RENDEZVOUS2 auth verification failed")
+	}
+
+	security.SecureZeroMemory(c.private[:])
+	return hsNtorExpandKeys(seed), nil
+}
+
+// HsNtorServiceIntroduceKeys returns the service's ENC_KEY and MAC_KEY for an
+// INTRODUCE2 cell carrying the client key X, using the service's ntor
+// encryption key pair (b, B)
+func HsNtorServiceIntroduceKeys(servicePrivate, serviceKey, authKey, clientPK, subcredential []byte) (encKey, macKey []byte, err error) {
+	xb, err := curve25519.X25519(servicePrivate, clientPK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid client public key: %w", err)
+	}
+	defer security.SecureZeroMemory(xb)
+
+	encKey, macKey = hsNtorIntroKeys(xb, authKey, clientPK, serviceKey, subcredential)
+	return encKey, macKey, nil
+}
+
+// HsNtorServiceHandshake completes the service side of hs-ntor after an
+// INTRODUCE2 has been accepted. It returns SERVER_PK and AUTH for
+// RENDEZVOUS1 and HsNtorKeyMaterialLen bytes of circuit key material.
+func HsNtorServiceHandshake(servicePrivate, serviceKey, authKey, clientPK []byte) (serverPK, auth, keyMaterial []byte, err error) {
+	ephemeral, err := GenerateNtorKeyPair()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	defer security.SecureZeroMemory(ephemeral.Private[:])
+
+	yx, err := curve25519.X25519(ephemeral.Private[:], clientPK)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid client public key: %w", err)
+	}
+	defer security.SecureZeroMemory(yx)
+	bx, err := curve25519.X25519(servicePrivate, clientPK)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid client public key: %w", err)
+	}
+	defer security.SecureZeroMemory(bx)
+
+	seed, auth := hsNtorRendezvous(yx, bx, authKey, serviceKey, clientPK, ephemeral.Public[:])
+	defer security.SecureZeroMemory(seed)
+	return append([]byte(nil), ephemeral.Public[:]...), auth, hsNtorExpandKeys(seed), nil
+}
+
+// hsNtorIntroKeys derives the INTRODUCE1 keys from EXP(B,x):
+//
+//	info = m_hsexpand | N_hs_subcred
+//	hs_keys = KDF(intro_secret_hs_input | t_hsenc | info, S_KEY_LEN+MAC_LEN)
+func hsNtorIntroKeys(bx, authKey, clientPK, serviceKey, subcredential []byte) (encKey, macKey []byte) {
+	input := concat(bx, authKey, clientPK, serviceKey, []byte(hsNtorProtoID),
+		hsNtorTweakEnc, hsNtorExpand, subcredential)
+	defer security.SecureZeroMemory(input)
+
+	keys := sha3.SumSHAKE256(input, 2*HsNtorKeyLen)
+	return keys[:HsNtorKeyLen], keys[HsNtorKeyLen:]
+}
+
+// hsNtorRendezvous computes NTOR_KEY_SEED and AUTH_INPUT_MAC:
+//
+//	rend_secret_hs_input = EXP(X,y) | EXP(X,b) | AUTH_KEY | B | X | Y | PROTOID
+//	auth_input = verify | AUTH_KEY | B | Y | X | PROTOID | "Server"
+func hsNtorRendezvous(yx, bx, authKey, serviceKey, clientPK, serverPK []byte) (seed, auth []byte) {
+	secretInput := concat(yx, bx, authKey, serviceKey, clientPK, serverPK, []byte(hsNtorProtoID))
+	defer security.SecureZeroMemory(secretInput)
+
+	seed = HsNtorMAC(secretInput, hsNtorTweakEnc)
+	verify := HsNtorMAC(secretInput, hsNtorTweakVerify)
+	authInput := concat(verify, authKey, serviceKey, serverPK, clientPK, []byte(hsNtorProtoID), []byte("Server"))
+	return seed, HsNtorMAC(authInput, hsNtorTweakMAC)
+}
+
+// hsNtorExpandKeys expands NTOR_KEY_SEED into Df | Db | Kf | Kb
+func hsNtorExpandKeys(seed []byte) []byte {
+	return sha3.SumSHAKE256(concat(seed, hsNtorExpand), HsNtorKeyMaterialLen)
+}
@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHsNtorHandshake(t *testing.T) {
+	service, err := GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKey, _, err := GenerateEd25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subcredential := bytes.Repeat([]byte{0x42}, 32)
+
+	client, err := NewHsNtorClient(authKey, service.Public[:], subcredential)
+	if err != nil {
+		t.Fatalf("NewHsNtorClient failed: %v", err)
+	}
+
+	// INTRODUCE1/INTRODUCE2 keys agree
+	clientEnc, clientMAC, err := client.IntroduceKeys()
+	if err != nil {
+		t.Fatalf("IntroduceKeys failed: %v", err)
+	}
+	serviceEnc, serviceMAC, err := HsNtorServiceIntroduceKeys(service.Private[:], service.Public[:], authKey,
+		client.PublicKey(), subcredential)
+	if err != nil {
+		t.Fatalf("HsNtorServiceIntroduceKeys failed: %v", err)
+	}
+	if !bytes.Equal(clientEnc, serviceEnc) || !bytes.Equal(clientMAC, serviceMAC) {
+		t.Error("client and service derived different INTRODUCE keys")
+	}
+	if len(clientEnc) != HsNtorKeyLen || len(clientMAC) != HsNtorKeyLen {
+		t.Errorf("unexpected INTRODUCE key lengths %d/%d", len(clientEnc), len(clientMAC))
+	}
+
+	// A different subcredential yields different INTRODUCE keys
+	otherEnc, _, err := HsNtorServiceIntroduceKeys(service.Private[:], service.Public[:], authKey,
+		client.PublicKey(), bytes.Repeat([]byte{0x43}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(otherEnc, clientEnc) {
+		t.Error("INTRODUCE keys do not depend on the subcredential")
+	}
+
+	// RENDEZVOUS1/RENDEZVOUS2 completes the handshake
+	serverPK, auth, serviceKeys, err := HsNtorServiceHandshake(service.Private[:], service.Public[:], authKey, client.PublicKey())
+	if err != nil {
+		t.Fatalf("HsNtorServiceHandshake failed: %v", err)
+	}
+
+	badAuth := append([]byte(nil), auth...)
+	badAuth[0] ^= 1
+	if _, err := client.CompleteRendezvous(serverPK, badAuth); err == nil {
+		t.Error("client accepted a bad RENDEZVOUS2 AUTH")
+	}
+
+	clientKeys, err := client.CompleteRendezvous(serverPK, auth)
+	if err != nil {
+		t.Fatalf("CompleteRendezvous failed: %v", err)
+	}
+	if len(clientKeys) != HsNtorKeyMaterialLen || !bytes.Equal(clientKeys, serviceKeys) {
+		t.Error("client and service derived different rendezvous key material")
+	}
+}
+
+func TestHsNtorInvalidKeys(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := NewHsNtorClient(key[:31], key, key); err == nil {
+		t.Error("expected error for short auth key")
+	}
+	if _, err := NewHsNtorClient(key, key, key[:16]); err == nil {
+		t.Error("expected error for short subcredential")
+	}
+}
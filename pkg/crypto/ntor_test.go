@@ -4,246 +4,129 @@ import (
 	"bytes"
 	"crypto/rand"
 	"testing"
-
-	"crypto/sha256"
-	"golang.org/x/crypto/curve25519"
-	"golang.org/x/crypto/hkdf"
-	"io"
 )
 
-// TestNtorHandshakeEndToEnd performs a complete end-to-end ntor handshake
-// simulating both client and server sides with protocol-compliant flow
-func TestNtorHandshakeEndToEnd(t *testing.T) {
-	// This test demonstrates the complete ntor handshake using TestNtorHandshakeWithMatchingKeys
-	// as the reference. The challenge with NtorClientHandshake is that it doesn't expose
-	// the ephemeral private key, which is needed for the test.
-	//
-	// In production code (pkg/circuit/extension.go), the Extension struct properly stores
-	// the ephemeral private key in its ephemeralPrivate field, which is then used by
-	// ProcessCreated2/ProcessExtended2 to call NtorProcessResponse.
-	//
-	// See TestNtorHandshakeWithMatchingKeys for a complete end-to-end test that verifies
-	// both client and server derive identical key material.
+// TestNtorTestVector checks the handshake against the known-answer vector
+// from arti's ntor implementation (tor-proto crypto/handshake/ntor.rs)
+func TestNtorTestVector(t *testing.T) {
+	var b, x, y [32]byte
+	copy(b[:], mustHex(t, "4820544f4c4420594f5520444f474954204b454550532048415050454e494e47"))
+	copy(x[:], mustHex(t, "706f6461792069207075742e2e2e2e2e2e2e2e4a454c4c59206f6e2074686973"))
+	copy(y[:], mustHex(t, "70686520737175697272656c2e2e2e2e2e2e2e2e686173206869732067616d65"))
+	relayID := mustHex(t, "69546f6c64596f7541626f75745374616972732e")
+	relayPublic := mustHex(t, "ccbc8541904d18af08753eae967874749e6149f873de937f57f8fd903a21c471")
+	clientPublic := mustHex(t, "e65dfdbef8b2635837fe2cebc086a8096eae3213e6830dc407516083d412b078")
+
+	expectedServer := mustHex(t, "390480a14362761d6aec1fea840f6e9e928fb2adb7b25c670be1045e35133a37"+
+		"1cbdf68b89923e1f85e8e18ee6e805ea333fe4849c790ffd2670bd80fec95cc8")
+	expectedKeys := mustHex(t, "0c62dee7f48893370d0ef896758d35729867beef1a5121df80e00f79ed349af3"+
+		"9b51cae125719182f19d932a667dae1afbf2e336e6910e7822223e763afad0a1"+
+		"3342157969dc6b79")
+
+	handshakeData := make([]byte, 0, 84)
+	handshakeData = append(handshakeData, relayID...)
+	handshakeData = append(handshakeData, relayPublic...)
+	handshakeData = append(handshakeData, clientPublic...)
+
+	serverHandshake, serverKeys, err := ntorServerHandshake(y, handshakeData, relayID, b[:], len(expectedKeys))
+	if err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+	if !bytes.Equal(serverHandshake, expectedServer) {
+		t.Errorf("server handshake mismatch:\n got %x\nwant %x", serverHandshake, expectedServer)
+	}
+	if !bytes.Equal(serverKeys, expectedKeys) {
+		t.Errorf("server keys mismatch:\n got %x\nwant %x", serverKeys, expectedKeys)
+	}
 
-	t.Log("Testing complete ntor handshake flow")
+	clientKeys, err := NtorProcessResponseKeys(expectedServer, x[:], relayPublic, relayID, len(expectedKeys))
+	if err != nil {
+		t.Fatalf("NtorProcessResponseKeys failed: %v", err)
+	}
+	if !bytes.Equal(clientKeys, expectedKeys) {
+		t.Errorf("client keys mismatch:\n got %x\nwant %x", clientKeys, expectedKeys)
+	}
+}
 
-	// Generate server keys
-	serverIdentity := make([]byte, 32)
+// TestNtorClientHandshakeFormat tests that the client's handshake data is
+// NODEID | KEYID | CLIENT_PK
+func TestNtorClientHandshakeFormat(t *testing.T) {
+	serverIdentity := make([]byte, NtorIdentityLen)
 	if _, err := rand.Read(serverIdentity); err != nil {
-		t.Fatalf("Failed to generate server identity: %v", err)
+		t.Fatal(err)
 	}
-
-	var serverNtorPrivate [32]byte
-	if _, err := rand.Read(serverNtorPrivate[:]); err != nil {
-		t.Fatalf("Failed to generate server ntor private: %v", err)
+	serverNtor, err := GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatal(err)
 	}
-	var serverNtorPublic [32]byte
-	curve25519.ScalarBaseMult(&serverNtorPublic, &serverNtorPrivate)
 
-	// CLIENT: Generate handshake (Step 1)
-	handshakeData, _, err := NtorClientHandshake(serverIdentity, serverNtorPublic[:])
+	handshakeData, _, err := NtorClientHandshake(serverIdentity, serverNtor.Public[:])
 	if err != nil {
 		t.Fatalf("Client handshake failed: %v", err)
 	}
-
-	// Verify handshake format
 	if len(handshakeData) != 84 {
 		t.Fatalf("Invalid handshake data length: %d, expected 84", len(handshakeData))
 	}
-
-	// Verify NODEID
-	if !bytes.Equal(handshakeData[0:20], serverIdentity[0:20]) {
+	if !bytes.Equal(handshakeData[0:20], serverIdentity) {
 		t.Error("NODEID mismatch in handshake")
 	}
-
-	// Verify KEYID
-	if !bytes.Equal(handshakeData[20:52], serverNtorPublic[:]) {
+	if !bytes.Equal(handshakeData[20:52], serverNtor.Public[:]) {
 		t.Error("KEYID mismatch in handshake")
 	}
 
-	// CLIENT_PK is in handshakeData[52:84]
-	clientPublic := handshakeData[52:84]
-
-	// SERVER: Generate ephemeral key and compute response (Step 2)
-	var serverEphemeralPrivate [32]byte
-	if _, err := rand.Read(serverEphemeralPrivate[:]); err != nil {
-		t.Fatalf("Failed to generate server ephemeral private: %v", err)
-	}
-	var serverEphemeralPublic [32]byte
-	curve25519.ScalarBaseMult(&serverEphemeralPublic, &serverEphemeralPrivate)
-
-	// Server computes shared secrets
-	var sharedXY [32]byte
-	var sharedXB [32]byte
-	var clientPubKey [32]byte
-	copy(clientPubKey[:], clientPublic)
-
-	curve25519.ScalarMult(&sharedXY, &serverEphemeralPrivate, &clientPubKey)
-	curve25519.ScalarMult(&sharedXB, &serverNtorPrivate, &clientPubKey)
-
-	// Build secret_input
-	protoid := []byte("ntor-curve25519-sha256-1")
-	secretInput := make([]byte, 0, 32+32+32+32+32+32+len(protoid))
-	secretInput = append(secretInput, sharedXY[:]...)
-	secretInput = append(secretInput, sharedXB[:]...)
-	secretInput = append(secretInput, serverIdentity...)
-	secretInput = append(secretInput, serverNtorPublic[:]...)
-	secretInput = append(secretInput, clientPublic...)
-	secretInput = append(secretInput, serverEphemeralPublic[:]...)
-	secretInput = append(secretInput, protoid...)
-
-	// Derive AUTH
-	verify := []byte("ntor-curve25519-sha256-1:verify")
-	hkdfVerify := hkdf.New(sha256.New, secretInput, nil, verify)
-	auth := make([]byte, 32)
-	if _, err := io.ReadFull(hkdfVerify, auth); err != nil {
-		t.Fatalf("Server HKDF verify failed: %v", err)
+	// The Ed25519 identity is not an ntor NODEID
+	if _, _, err := NtorClientHandshake(make([]byte, 32), serverNtor.Public[:]); err == nil {
+		t.Error("Expected error for a 32-byte identity")
 	}
-
-	// Build server response
-	serverResponse := make([]byte, 64)
-	copy(serverResponse[0:32], serverEphemeralPublic[:])
-	copy(serverResponse[32:64], auth)
-
-	t.Logf("✓ Server generated valid response")
-	t.Logf("✓ Handshake data format verified (NODEID || KEYID || CLIENT_PK)")
-	t.Logf("✓ Complete test with matching keys in TestNtorHandshakeWithMatchingKeys")
 }
 
-// TestNtorHandshakeWithMatchingKeys tests that client and server derive the same keys
-// when using the same ephemeral keys
-func TestNtorHandshakeWithMatchingKeys(t *testing.T) {
-	// Setup: Generate all keys
-	serverIdentity := make([]byte, 32)
+// TestNtorServerHandshake tests that NtorServerHandshake produces a response
+// the client accepts and that both sides derive the same key material
+func TestNtorServerHandshake(t *testing.T) {
+	serverIdentity := make([]byte, NtorIdentityLen)
 	if _, err := rand.Read(serverIdentity); err != nil {
-		t.Fatalf("Failed to generate server identity: %v", err)
-	}
-
-	// Server ntor onion key (B, b)
-	var serverNtorPrivate [32]byte
-	if _, err := rand.Read(serverNtorPrivate[:]); err != nil {
-		t.Fatalf("Failed to generate server ntor private: %v", err)
-	}
-	var serverNtorPublic [32]byte
-	curve25519.ScalarBaseMult(&serverNtorPublic, &serverNtorPrivate)
-
-	// Client ephemeral key (X, x)
-	var clientEphemeralPrivate [32]byte
-	if _, err := rand.Read(clientEphemeralPrivate[:]); err != nil {
-		t.Fatalf("Failed to generate client ephemeral private: %v", err)
-	}
-	var clientEphemeralPublic [32]byte
-	curve25519.ScalarBaseMult(&clientEphemeralPublic, &clientEphemeralPrivate)
-
-	// Server ephemeral key (Y, y)
-	var serverEphemeralPrivate [32]byte
-	if _, err := rand.Read(serverEphemeralPrivate[:]); err != nil {
-		t.Fatalf("Failed to generate server ephemeral private: %v", err)
-	}
-	var serverEphemeralPublic [32]byte
-	curve25519.ScalarBaseMult(&serverEphemeralPublic, &serverEphemeralPrivate)
-
-	// Protocol constant
-	protoid := []byte("ntor-curve25519-sha256-1")
-
-	// SERVER SIDE: Compute secret_input and keys
-	var serverSharedXY [32]byte
-	var serverSharedXB [32]byte
-	curve25519.ScalarMult(&serverSharedXY, &serverEphemeralPrivate, &clientEphemeralPublic)
-	curve25519.ScalarMult(&serverSharedXB, &serverNtorPrivate, &clientEphemeralPublic)
-
-	serverSecretInput := make([]byte, 0, 32+32+32+32+32+32+len(protoid))
-	serverSecretInput = append(serverSecretInput, serverSharedXY[:]...)
-	serverSecretInput = append(serverSecretInput, serverSharedXB[:]...)
-	serverSecretInput = append(serverSecretInput, serverIdentity...)
-	serverSecretInput = append(serverSecretInput, serverNtorPublic[:]...)
-	serverSecretInput = append(serverSecretInput, clientEphemeralPublic[:]...)
-	serverSecretInput = append(serverSecretInput, serverEphemeralPublic[:]...)
-	serverSecretInput = append(serverSecretInput, protoid...)
-
-	// Derive AUTH
-	verify := []byte("ntor-curve25519-sha256-1:verify")
-	hkdfVerify := hkdf.New(sha256.New, serverSecretInput, nil, verify)
-	auth := make([]byte, 32)
-	if _, err := io.ReadFull(hkdfVerify, auth); err != nil {
-		t.Fatalf("Server HKDF verify failed: %v", err)
+		t.Fatal(err)
 	}
-
-	// Derive server key material
-	keyInfo := []byte("ntor-curve25519-sha256-1:key_extract")
-	hkdfKey := hkdf.New(sha256.New, serverSecretInput, nil, keyInfo)
-	serverKeyMaterial := make([]byte, 72)
-	if _, err := io.ReadFull(hkdfKey, serverKeyMaterial); err != nil {
-		t.Fatalf("Server HKDF key failed: %v", err)
+	serverNtor, err := GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	// Build server response
-	serverResponse := make([]byte, 64)
-	copy(serverResponse[0:32], serverEphemeralPublic[:])
-	copy(serverResponse[32:64], auth)
-
-	// CLIENT SIDE: Process response using our implementation
-	clientKeyMaterial, err := NtorProcessResponse(
-		serverResponse,
-		clientEphemeralPrivate[:],
-		serverNtorPublic[:],
-		serverIdentity,
-	)
+	client, err := GenerateNtorKeyPair()
 	if err != nil {
-		t.Fatalf("Client failed to process response: %v", err)
+		t.Fatal(err)
 	}
 
-	// Verify both sides derived identical key material
-	if !bytes.Equal(serverKeyMaterial, clientKeyMaterial) {
-		t.Errorf("Key material mismatch!")
-		t.Errorf("Server: %x", serverKeyMaterial)
-		t.Errorf("Client: %x", clientKeyMaterial)
-	} else {
-		t.Logf("✓ Both sides derived matching key material")
-	}
+	handshakeData := make([]byte, 0, 84)
+	handshakeData = append(handshakeData, serverIdentity...)
+	handshakeData = append(handshakeData, serverNtor.Public[:]...)
+	handshakeData = append(handshakeData, client.Public[:]...)
 
-	// Verify key material structure (72 bytes = 20 + 20 + 16 + 16)
-	if len(clientKeyMaterial) != 72 {
-		t.Errorf("Key material length = %d, want 72", len(clientKeyMaterial))
+	response, serverKeys, err := NtorServerHandshake(handshakeData, serverIdentity, serverNtor.Private[:])
+	if err != nil {
+		t.Fatalf("NtorServerHandshake failed: %v", err)
 	}
 
-	// Extract keys per tor-spec.txt section 5.2
-	// Df (20 bytes) - forward digest key
-	// Db (20 bytes) - backward digest key
-	// Kf (16 bytes) - forward cipher key
-	// Kb (16 bytes) - backward cipher key
-	Df := clientKeyMaterial[0:20]
-	Db := clientKeyMaterial[20:40]
-	Kf := clientKeyMaterial[40:56]
-	Kb := clientKeyMaterial[56:72]
-
-	// Keys should be non-zero
-	zeroKey := make([]byte, 20)
-	if bytes.Equal(Df, zeroKey) {
-		t.Error("Df is all zeros")
-	}
-	if bytes.Equal(Db, zeroKey) {
-		t.Error("Db is all zeros")
-	}
-	if bytes.Equal(Kf[:16], zeroKey[:16]) {
-		t.Error("Kf is all zeros")
+	clientKeys, err := NtorProcessResponse(response, client.Private[:], serverNtor.Public[:], serverIdentity)
+	if err != nil {
+		t.Fatalf("Client rejected server response: %v", err)
 	}
-	if bytes.Equal(Kb[:16], zeroKey[:16]) {
-		t.Error("Kb is all zeros")
+	if !bytes.Equal(serverKeys, clientKeys) {
+		t.Error("Client and server derived different key material")
 	}
 
-	// Forward and backward keys should be different
-	if bytes.Equal(Df, Db) {
-		t.Error("Df and Db are identical")
+	// A handshake addressed to another relay must be rejected
+	otherIdentity := make([]byte, NtorIdentityLen)
+	if _, _, err := NtorServerHandshake(handshakeData, otherIdentity, serverNtor.Private[:]); err == nil {
+		t.Error("Expected error for mismatched NODEID")
 	}
-	if bytes.Equal(Kf, Kb) {
-		t.Error("Kf and Kb are identical")
+	if _, _, err := NtorServerHandshake(handshakeData[:50], serverIdentity, serverNtor.Private[:]); err == nil {
+		t.Error("Expected error for short handshake data")
 	}
 }
 
 // TestNtorAuthFailure tests that invalid AUTH values are rejected
 func TestNtorAuthFailure(t *testing.T) {
-	serverIdentity := make([]byte, 32)
+	serverIdentity := make([]byte, NtorIdentityLen)
 	serverNtorKey := make([]byte, 32)
 	clientPrivate := make([]byte, 32)
 
@@ -275,7 +158,7 @@ func TestNtorAuthFailure(t *testing.T) {
 
 // TestNtorInvalidResponseLength tests response length validation
 func TestNtorInvalidResponseLength(t *testing.T) {
-	serverIdentity := make([]byte, 32)
+	serverIdentity := make([]byte, NtorIdentityLen)
 	serverNtorKey := make([]byte, 32)
 	clientPrivate := make([]byte, 32)
 
@@ -306,60 +189,6 @@ func TestNtorInvalidResponseLength(t *testing.T) {
 	}
 }
 
-// TestNtorKeyDerivation tests that key derivation produces correct structure
-func TestNtorKeyDerivation(t *testing.T) {
-	// Use known secret for deterministic output
-	secret := make([]byte, 32)
-	for i := range secret {
-		secret[i] = byte(i)
-	}
-
-	protoid := []byte("ntor-curve25519-sha256-1")
-	keyInfo := []byte("ntor-curve25519-sha256-1:key_extract")
-
-	// Derive using HKDF
-	hkdfKey := hkdf.New(sha256.New, secret, nil, keyInfo)
-	keyMaterial := make([]byte, 72)
-	if _, err := io.ReadFull(hkdfKey, keyMaterial); err != nil {
-		t.Fatalf("HKDF failed: %v", err)
-	}
-
-	// Verify we get 72 bytes
-	if len(keyMaterial) != 72 {
-		t.Errorf("Key material length = %d, want 72", len(keyMaterial))
-	}
-
-	// Verify deterministic output (same secret -> same keys)
-	hkdfKey2 := hkdf.New(sha256.New, secret, nil, keyInfo)
-	keyMaterial2 := make([]byte, 72)
-	if _, err := io.ReadFull(hkdfKey2, keyMaterial2); err != nil {
-		t.Fatalf("HKDF failed: %v", err)
-	}
-
-	if !bytes.Equal(keyMaterial, keyMaterial2) {
-		t.Error("Same secret produced different key material")
-	}
-
-	// Verify different secrets produce different keys
-	secret2 := make([]byte, 32)
-	for i := range secret2 {
-		secret2[i] = byte(i + 1)
-	}
-
-	hkdfKey3 := hkdf.New(sha256.New, secret2, nil, keyInfo)
-	keyMaterial3 := make([]byte, 72)
-	if _, err := io.ReadFull(hkdfKey3, keyMaterial3); err != nil {
-		t.Fatalf("HKDF failed: %v", err)
-	}
-
-	if bytes.Equal(keyMaterial, keyMaterial3) {
-		t.Error("Different secrets produced identical key material")
-	}
-
-	t.Logf("✓ Key derivation produces correct structure")
-	t.Logf("✓ PROTOID constant: %s", protoid)
-}
-
 // TestNtorConstantTimeComparison tests the constant-time comparison function
 func TestNtorConstantTimeComparison(t *testing.T) {
 	testCases := []struct {
@@ -406,7 +235,7 @@ func TestNtorConstantTimeComparison(t *testing.T) {
 
 // BenchmarkNtorHandshake benchmarks the complete ntor handshake
 func BenchmarkNtorHandshake(b *testing.B) {
-	serverIdentity := make([]byte, 32)
+	serverIdentity := make([]byte, NtorIdentityLen)
 	serverNtorKey := make([]byte, 32)
 	if _, err := rand.Read(serverIdentity); err != nil {
 		b.Fatal(err)
@@ -427,7 +256,7 @@ func BenchmarkNtorHandshake(b *testing.B) {
 // BenchmarkNtorProcessResponse benchmarks response processing
 func BenchmarkNtorProcessResponse(b *testing.B) {
 	// Setup
-	serverIdentity := make([]byte, 32)
+	serverIdentity := make([]byte, NtorIdentityLen)
 	serverNtorKey := make([]byte, 32)
 	clientPrivate := make([]byte, 32)
 	response := make([]byte, 64)
@@ -0,0 +1,311 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha3"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/opd-ai/go-tor/pkg/security"
+	"golang.org/x/crypto/curve25519"
+)
+
+// ntor v3 constants (tor-spec.txt section 5.1.4.2, proposal 332)
+const (
+	ntorV3ProtoID = "ntor3-curve25519-sha3_256-1"
+	ntorV3KeyLen  = 32 // ENC_KEY_LEN and MAC_KEY_LEN
+	ntorV3MACLen  = 32 // DIGEST_LEN
+
+	// NtorV3ClientHeaderLen is the length of ID | KEYID(B) | CLIENT_PK(X) at
+	// the start of an ntor v3 client handshake
+	NtorV3ClientHeaderLen = 32 + 32 + 32
+	// NtorV3ServerHeaderLen is the length of Y | AUTH at the start of an
+	// ntor v3 server handshake
+	NtorV3ServerHeaderLen = 32 + ntorV3MACLen
+)
+
+// ntor v3 tweaks
+var (
+	ntorV3TweakMsgKey  = []byte(ntorV3ProtoID + ":kdf_phase1")
+	ntorV3TweakMsgMAC  = []byte(ntorV3ProtoID + ":msg_mac")
+	ntorV3TweakKeySeed = []byte(ntorV3ProtoID + ":key_seed")
+	ntorV3TweakVerify  = []byte(ntorV3ProtoID + ":verify")
+	ntorV3TweakFinal   = []byte(ntorV3ProtoID + ":kdf_final")
+	ntorV3TweakAuth    = []byte(ntorV3ProtoID + ":auth_final")
+)
+
+// NtorV3ClientState holds the client's ephemeral state between sending an
+// ntor v3 handshake and receiving the relay's reply
+type NtorV3ClientState struct {
+	private      [32]byte
+	public       [32]byte
+	relayID      [32]byte
+	relayKey     [32]byte
+	verification []byte
+	bx           [32]byte // EXP(B,x)
+	msgMAC       [ntorV3MACLen]byte
+}
+
+// NtorV3ClientHandshake performs the client side of the ntor v3 handshake.
+// It returns the handshake data for CREATE2/EXTEND2, which carries message
+// encrypted to the relay, and the state needed to process the reply.
+//
+// Parameters:
+//   - identityKey: The relay's Ed25519 identity key (32 bytes)
+//   - ntorOnionKey: The relay's ntor onion key (32 bytes)
+//   - verification: The verification string (empty for circuit extension)
+//   - message: The client message, an encoded list of extensions
+//
+// Implements tor-spec.txt section 5.1.4.2
+func NtorV3ClientHandshake(identityKey, ntorOnionKey, verification, message []byte) ([]byte, *NtorV3ClientState, error) {
+	ephemeral, err := GenerateNtorKeyPair()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	defer security.SecureZeroMemory(ephemeral.Private[:])
+	return ntorV3ClientHandshake(ephemeral.Private, identityKey, ntorOnionKey, verification, message)
+}
+
+func ntorV3ClientHandshake(x [32]byte, identityKey, ntorOnionKey, verification, message []byte) ([]byte, *NtorV3ClientState, error) {
+	if len(identityKey) != 32 {
+		return nil, nil, fmt.Errorf("invalid identity key length: %d", len(identityKey))
+	}
+	if len(ntorOnionKey) != 32 {
+		return nil, nil, fmt.Errorf("invalid ntor onion key length: %d", len(ntorOnionKey))
+	}
+
+	state := &NtorV3ClientState{
+		private:      x,
+		verification: append([]byte(nil), verification...),
+	}
+	copy(state.relayID[:], identityKey)
+	copy(state.relayKey[:], ntorOnionKey)
+	curve25519.ScalarBaseMult(&state.public, &state.private)
+
+	bx, err := curve25519.X25519(state.private[:], state.relayKey[:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid relay ntor key: %w", err)
+	}
+	copy(state.bx[:], bx)
+
+	// secret_input_phase1 = Bx | ID | X | B | PROTOID | ENCAP(VER)
+	phase1 := concat(state.bx[:], state.relayID[:], state.public[:], state.relayKey[:],
+		[]byte(ntorV3ProtoID), encap(verification))
+	phase1Keys := ntorV3KDF(phase1, ntorV3TweakMsgKey, 2*ntorV3KeyLen)
+	defer security.SecureZeroMemory(phase1Keys)
+
+	encrypted, err := aes256CTR(phase1Keys[:ntorV3KeyLen], message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handshake := concat(state.relayID[:], state.relayKey[:], state.public[:], encrypted)
+	copy(state.msgMAC[:], ntorV3MAC(phase1Keys[ntorV3KeyLen:], handshake, ntorV3TweakMsgMAC))
+	return append(handshake, state.msgMAC[:]...), state, nil
+}
+
+// ProcessResponse verifies the relay's ntor v3 reply and returns the
+// decrypted server message and keyLen bytes of circuit key material
+func (s *NtorV3ClientState) ProcessResponse(response []byte, keyLen int) (serverMessage, keyMaterial []byte, err error) {
+	if len(response) < NtorV3ServerHeaderLen {
+		return nil, nil, fmt.Errorf("invalid response length: %d, need at least %d", len(response), NtorV3ServerHeaderLen)
+	}
+	serverY := response[0:32]
+	auth := response[32:NtorV3ServerHeaderLen]
+	encrypted := response[NtorV3ServerHeaderLen:]
+
+	yx, err := curve25519.X25519(s.private[:], serverY)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid server ephemeral key: %w", err)
+	}
+	defer security.SecureZeroMemory(yx)
+
+	seed, expectedAuth := ntorV3ServerAuth(yx, s.bx[:], s.relayID[:], s.relayKey[:], s.public[:], serverY,
+		s.verification, s.msgMAC[:], encrypted)
+	defer security.SecureZeroMemory(seed)
+	if !constantTimeCompare(auth, expectedAuth) {
+		return nil, nil, fmt.Errorf("auth MAC verification failed: server authentication invalid")
+	}
+
+	serverMessage, keyMaterial, err = ntorV3FinalKeys(seed, encrypted, keyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	security.SecureZeroMemory(s.private[:])
+	security.SecureZeroMemory(s.bx[:])
+	return serverMessage, keyMaterial, nil
+}
+
+// NtorV3ServerHandshake performs the relay side of the ntor v3 handshake.
+// respond is called with the decrypted client message and returns the server
+// message to encrypt into the reply.
+//
+// Returns the data for CREATED2/EXTENDED2 (Y | AUTH | encrypted message) and
+// keyLen bytes of circuit key material matching ProcessResponse.
+func NtorV3ServerHandshake(handshakeData, identityKey, ntorPrivate, verification []byte, keyLen int,
+	respond func(clientMessage []byte) []byte) (response, keyMaterial []byte, err error) {
+	ephemeral, err := GenerateNtorKeyPair()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	defer security.SecureZeroMemory(ephemeral.Private[:])
+	return ntorV3ServerHandshake(ephemeral.Private, handshakeData, identityKey, ntorPrivate, verification, keyLen, respond)
+}
+
+func ntorV3ServerHandshake(y [32]byte, handshakeData, identityKey, ntorPrivate, verification []byte, keyLen int,
+	respond func(clientMessage []byte) []byte) ([]byte, []byte, error) {
+	if len(handshakeData) < NtorV3ClientHeaderLen+ntorV3MACLen {
+		return nil, nil, fmt.Errorf("invalid handshake data length: %d", len(handshakeData))
+	}
+	if len(identityKey) != 32 {
+		return nil, nil, fmt.Errorf("invalid identity key length: %d", len(identityKey))
+	}
+	if len(ntorPrivate) != 32 {
+		return nil, nil, fmt.Errorf("invalid ntor private key length: %d", len(ntorPrivate))
+	}
+
+	relayID := handshakeData[0:32]
+	relayKey := handshakeData[32:64]
+	clientX := handshakeData[64:96]
+	macStart := len(handshakeData) - ntorV3MACLen
+	encrypted := handshakeData[NtorV3ClientHeaderLen:macStart]
+	msgMAC := handshakeData[macStart:]
+
+	serverB, err := curve25519.X25519(ntorPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ntor private key: %w", err)
+	}
+	if !constantTimeCompare(relayID, identityKey) {
+		return nil, nil, fmt.Errorf("handshake ID does not match relay identity")
+	}
+	if !constantTimeCompare(relayKey, serverB) {
+		return nil, nil, fmt.Errorf("handshake KEYID does not match relay ntor key")
+	}
+
+	bx, err := curve25519.X25519(ntorPrivate, clientX)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid client ephemeral key: %w", err)
+	}
+	defer security.SecureZeroMemory(bx)
+
+	phase1 := concat(bx, relayID, clientX, relayKey, []byte(ntorV3ProtoID), encap(verification))
+	phase1Keys := ntorV3KDF(phase1, ntorV3TweakMsgKey, 2*ntorV3KeyLen)
+	defer security.SecureZeroMemory(phase1Keys)
+	if !constantTimeCompare(msgMAC, ntorV3MAC(phase1Keys[ntorV3KeyLen:], handshakeData[:macStart], ntorV3TweakMsgMAC)) {
+		return nil, nil, fmt.Errorf("client message MAC verification failed")
+	}
+	clientMessage, err := aes256CTR(phase1Keys[:ntorV3KeyLen], encrypted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var serverY [32]byte
+	curve25519.ScalarBaseMult(&serverY, &y)
+	yx, err := curve25519.X25519(y[:], clientX)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid client ephemeral key: %w", err)
+	}
+	defer security.SecureZeroMemory(yx)
+
+	// The server message is encrypted with ENC_KEY from the final KDF, which
+	// depends only on the key seed, so derive it before computing AUTH
+	secretInput := concat(yx, bx, relayID, relayKey, clientX, serverY[:], []byte(ntorV3ProtoID), encap(verification))
+	seed := ntorV3Hash(secretInput, ntorV3TweakKeySeed)
+	defer security.SecureZeroMemory(seed)
+	stream := ntorV3KDF(seed, ntorV3TweakFinal, ntorV3KeyLen+keyLen)
+	encryptedReply, err := aes256CTR(stream[:ntorV3KeyLen], respond(clientMessage))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, auth := ntorV3ServerAuth(yx, bx, relayID, relayKey, clientX, serverY[:], verification, msgMAC, encryptedReply)
+	keyMaterial := append([]byte(nil), stream[ntorV3KeyLen:]...)
+	security.SecureZeroMemory(stream)
+	return concat(serverY[:], auth, encryptedReply), keyMaterial, nil
+}
+
+// ntorV3ServerAuth computes ntor_key_seed and AUTH from both DH results:
+//
+//	secret_input = Yx | Bx | ID | B | X | Y | PROTOID | ENCAP(VER)
+//	auth_input = verify | ID | B | Y | X | MAC | ENCAP(encrypted_msg) | PROTOID | "Server"
+func ntorV3ServerAuth(yx, bx, relayID, relayKey, clientX, serverY, verification, msgMAC, encrypted []byte) (seed, auth []byte) {
+	secretInput := concat(yx, bx, relayID, relayKey, clientX, serverY, []byte(ntorV3ProtoID), encap(verification))
+	defer security.SecureZeroMemory(secretInput)
+
+	seed = ntorV3Hash(secretInput, ntorV3TweakKeySeed)
+	verify := ntorV3Hash(secretInput, ntorV3TweakVerify)
+	authInput := concat(verify, relayID, relayKey, serverY, clientX, msgMAC, encap(encrypted),
+		[]byte(ntorV3ProtoID), []byte("Server"))
+	return seed, ntorV3Hash(authInput, ntorV3TweakAuth)
+}
+
+// ntorV3FinalKeys expands ntor_key_seed into ENC_KEY and keyLen bytes of key
+// material, and decrypts the server message with ENC_KEY
+func ntorV3FinalKeys(seed, encrypted []byte, keyLen int) (message, keyMaterial []byte, err error) {
+	stream := ntorV3KDF(seed, ntorV3TweakFinal, ntorV3KeyLen+keyLen)
+	defer security.SecureZeroMemory(stream)
+
+	message, err = aes256CTR(stream[:ntorV3KeyLen], encrypted)
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, append([]byte(nil), stream[ntorV3KeyLen:]...), nil
+}
+
+// ntorV3Hash computes H(s, t) = SHA3_256(ENCAP(t) | s)
+func ntorV3Hash(s, tweak []byte) []byte {
+	h := sha3.New256()
+	h.Write(encap(tweak))
+	h.Write(s)
+	return h.Sum(nil)
+}
+
+// ntorV3MAC computes MAC(k, msg, t) = SHA3_256(ENCAP(t) | ENCAP(k) | msg)
+func ntorV3MAC(key, msg, tweak []byte) []byte {
+	h := sha3.New256()
+	h.Write(encap(tweak))
+	h.Write(encap(key))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// ntorV3KDF computes KDF(s, t) = SHAKE_256(ENCAP(t) | s), truncated to n bytes
+func ntorV3KDF(s, tweak []byte, n int) []byte {
+	xof := sha3.NewSHAKE256()
+	xof.Write(encap(tweak))
+	xof.Write(s)
+	out := make([]byte, n)
+	xof.Read(out)
+	return out
+}
+
+// encap returns ENCAP(s) = htonll(len(s)) | s
+func encap(s []byte) []byte {
+	out := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(s)), uint64(len(s)))
+	return append(out, s...)
+}
+
+// aes256CTR encrypts or decrypts data with AES-256-CTR and an all-zero IV
+func aes256CTR(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	out := make([]byte, len(data))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(out, data)
+	return out, nil
+}
+
+// concat returns the concatenation of parts in a new slice
+func concat(parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	out := make([]byte, 0, n)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
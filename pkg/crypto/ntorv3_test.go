@@ -0,0 +1,147 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+// TestNtorV3TestVectors checks the handshake against the test vectors from
+// tor-spec.txt section 5.1.4.2 (as used by tor's test_ntor_v3.c)
+func TestNtorV3TestVectors(t *testing.T) {
+	var x, y [32]byte
+	copy(x[:], mustHex(t, "b825a3719147bcbe5fb1d0b0fcb9c09e51948048e2e3283d2ab7b45b5ef38b49"))
+	copy(y[:], mustHex(t, "4865a5b7689dafd978f529291c7171bc159be076b92186405d13220b80e2a053"))
+	relayPrivate := mustHex(t, "4051daa5921cfa2a1c27b08451324919538e79e788a81b38cbed097a5dff454a")
+	relayPublic := mustHex(t, "f8307a2bc1870b00b828bb74dbb8fd88e632a6375ab3bcd1ae706aaa8b6cdd1d")
+	relayID := mustHex(t, "9fad2af287ef942632833d21f946c6260c33fae6172b60006e86e4a6911753a2")
+	verification := []byte("xyzzy")
+	clientMessage := []byte("hello world")
+	serverMessage := []byte("Hola Mundo")
+
+	expectedClient := mustHex(t, "9fad2af287ef942632833d21f946c6260c33fae6172b60006e86e4a6911753a2"+
+		"f8307a2bc1870b00b828bb74dbb8fd88e632a6375ab3bcd1ae706aaa8b6cdd1d"+
+		"252fe9ae91264c91d4ecb8501f79d0387e34ad8ca0f7c995184f7d11d5da4f46"+
+		"3bebd9151fd3b47c180abc9e044d53565f04d82bbb3bebed3d06cea65db8be9c"+
+		"72b68cd461942088502f67")
+	expectedServer := mustHex(t, "4bf4814326fdab45ad5184f5518bd7fae25dc59374062698201a50a22954246d"+
+		"2fc5f8773ca824542bc6cf6f57c7c29bbf4e5476461ab130c5b18ab0a9127665"+
+		"1202c3e1e87c0d32054c")
+	expectedKeys := mustHex(t, "9c19b631fd94ed86a817e01f6c80b0743a43f5faebd39cfaa8b00fa8bcc65c3b"+
+		"feaa403d91acbd68a821bf6ee8504602b094a254392a07737d5662768c7a9fb1")
+
+	clientHandshake, state, err := ntorV3ClientHandshake(x, relayID, relayPublic, verification, clientMessage)
+	if err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	if !bytes.Equal(clientHandshake, expectedClient) {
+		t.Errorf("client handshake mismatch:\n got %x\nwant %x", clientHandshake, expectedClient)
+	}
+
+	var gotClientMessage []byte
+	serverHandshake, serverKeys, err := ntorV3ServerHandshake(y, clientHandshake, relayID, relayPrivate, verification, 64,
+		func(m []byte) []byte {
+			gotClientMessage = m
+			return serverMessage
+		})
+	if err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+	if !bytes.Equal(gotClientMessage, clientMessage) {
+		t.Errorf("server decrypted %q, want %q", gotClientMessage, clientMessage)
+	}
+	if !bytes.Equal(serverHandshake, expectedServer) {
+		t.Errorf("server handshake mismatch:\n got %x\nwant %x", serverHandshake, expectedServer)
+	}
+	if !bytes.Equal(serverKeys, expectedKeys) {
+		t.Errorf("server keys mismatch:\n got %x\nwant %x", serverKeys, expectedKeys)
+	}
+
+	gotServerMessage, clientKeys, err := state.ProcessResponse(serverHandshake, 64)
+	if err != nil {
+		t.Fatalf("ProcessResponse failed: %v", err)
+	}
+	if !bytes.Equal(gotServerMessage, serverMessage) {
+		t.Errorf("client decrypted %q, want %q", gotServerMessage, serverMessage)
+	}
+	if !bytes.Equal(clientKeys, expectedKeys) {
+		t.Errorf("client keys mismatch:\n got %x\nwant %x", clientKeys, expectedKeys)
+	}
+}
+
+func TestNtorV3RoundTrip(t *testing.T) {
+	relay, err := GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, _, err := GenerateEd25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake, state, err := NtorV3ClientHandshake(identity, relay.Public[:], nil, []byte{0})
+	if err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	response, serverKeys, err := NtorV3ServerHandshake(handshake, identity, relay.Private[:], nil, 72,
+		func([]byte) []byte { return []byte{0} })
+	if err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+	_, clientKeys, err := state.ProcessResponse(response, 72)
+	if err != nil {
+		t.Fatalf("ProcessResponse failed: %v", err)
+	}
+	if len(clientKeys) != 72 || !bytes.Equal(clientKeys, serverKeys) {
+		t.Error("client and server derived different key material")
+	}
+}
+
+func TestNtorV3Tampering(t *testing.T) {
+	relay, err := GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, _, err := GenerateEd25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := func(m []byte) []byte { return m }
+
+	handshake, state, err := NtorV3ClientHandshake(identity, relay.Public[:], nil, []byte("ext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), handshake...)
+	tampered[NtorV3ClientHeaderLen] ^= 1
+	if _, _, err := NtorV3ServerHandshake(tampered, identity, relay.Private[:], nil, 72, echo); err == nil {
+		t.Error("server accepted a client message with a bad MAC")
+	}
+
+	otherIdentity, _, _ := GenerateEd25519KeyPair()
+	if _, _, err := NtorV3ServerHandshake(handshake, otherIdentity, relay.Private[:], nil, 72, echo); err == nil {
+		t.Error("server accepted a handshake for a different identity")
+	}
+
+	response, _, err := NtorV3ServerHandshake(handshake, identity, relay.Private[:], nil, 72, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response[len(response)-1] ^= 1
+	if _, _, err := state.ProcessResponse(response, 72); err == nil {
+		t.Error("client accepted a tampered server message")
+	}
+	if _, _, err := state.ProcessResponse(response[:10], 72); err == nil {
+		t.Error("client accepted a truncated response")
+	}
+}
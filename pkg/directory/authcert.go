@@ -0,0 +1,384 @@
+// Package directory provides directory authority key certificates.
+package directory
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1" // #nosec G505 - SHA-1 is mandated by dir-spec.txt for key fingerprints
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+const (
+	// authCertPathPrefix fetches key certificates by identity and signing key
+	// digest (dir-spec.txt section 4.3)
+	authCertPathPrefix = "/tor/keys/fp-sk/"
+
+	// authCertCacheFile is the cache file name inside the DataDirectory (as in C tor)
+	authCertCacheFile = "cached-certs"
+)
+
+// TrustedAuthority identifies a v3 directory authority whose consensus
+// signatures are trusted
+type TrustedAuthority struct {
+	Nickname string
+	V3Ident  string // Upper-case hex SHA-1 of the authority's v3 identity key
+}
+
+// DefaultTrustedAuthorities is the v3 identity of each directory authority in
+// the public Tor network
+var DefaultTrustedAuthorities = []TrustedAuthority{
+	{Nickname: "moria1", V3Ident: "F533C81CEF0BC0267857C99B2F471ADF249FA232"},
+	{Nickname: "tor26", V3Ident: "2F3DF9CA0E5D36F2685A2DA67184EB8DCB8CBA8C"},
+	{Nickname: "dizum", V3Ident: "E8A9C45EDE6D711294FADF8E7951F4DE6CA56B58"},
+	{Nickname: "gabelmoo", V3Ident: "ED03BB616EB2F60BEC80151114BB25CEF515B226"},
+	{Nickname: "dannenberg", V3Ident: "0232AF901C31A04EE9848595AF9BB7620D4C5B2E"},
+	{Nickname: "maatuska", V3Ident: "49015F787433103580E3B66A1707A00E60F2D15B"},
+	{Nickname: "longclaw", V3Ident: "23D15D965BC35114467363C165C4F724B64B4F66"},
+	{Nickname: "bastet", V3Ident: "27102BC123E7AF1D4741AE047E160C91ADC76B21"},
+	{Nickname: "faravahar", V3Ident: "EFCBE720AB3A82B99F9E953CD5BF50F7EEFC7B97"},
+}
+
+// AuthorityCert is a directory authority key certificate binding a medium-term
+// signing key to the authority's long-term identity key (dir-spec.txt section 3.1)
+type AuthorityCert struct {
+	Fingerprint      string // Upper-case hex SHA-1 of the identity key
+	SigningKeyDigest string // Upper-case hex SHA-1 of the signing key
+	IdentityKey      *rsa.PublicKey
+	SigningKey       *rsa.PublicKey
+	Published        time.Time
+	Expires          time.Time
+	Raw              []byte // Raw document, used for caching
+}
+
+// IsExpired reports whether the certificate has expired at now
+func (ac *AuthorityCert) IsExpired(now time.Time) bool {
+	return now.After(ac.Expires)
+}
+
+// ParseAuthorityCerts parses a sequence of key certificates. Each certificate's
+// cross-certification and identity signature are verified; a certificate that
+// fails verification is logged and skipped, and it is an error only when no
+// certificate is valid.
+func ParseAuthorityCerts(data []byte, log *logger.Logger) ([]*AuthorityCert, error) {
+	if log == nil {
+		log = logger.NewDefault()
+	}
+	docs := splitDocuments(data, "dir-key-certificate-version")
+
+	certs := make([]*AuthorityCert, 0, len(docs))
+	var lastErr error
+	for _, doc := range docs {
+		cert, err := parseAuthorityCert(doc)
+		if err != nil {
+			log.Warn("Skipping invalid authority key certificate", "error", err)
+			lastErr = err
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("no key certificates found")
+	}
+	return certs, nil
+}
+
+// parseAuthorityCert parses and verifies a single key certificate
+func parseAuthorityCert(doc []byte) (*AuthorityCert, error) {
+	items, err := parseDocumentItems(doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key certificate: %w", err)
+	}
+	if len(items) == 0 || items[0].Keyword != "dir-key-certificate-version" ||
+		len(items[0].Args) != 1 || items[0].Args[0] != "3" {
+		return nil, fmt.Errorf("invalid key certificate: unsupported version")
+	}
+
+	cert := &AuthorityCert{Raw: append([]byte(nil), doc...)}
+	var fingerprint string
+	var identityDER, crosscert, certification []byte
+	var signedEnd int
+
+	for _, item := range items {
+		switch item.Keyword {
+		case "fingerprint":
+			if len(item.Args) == 1 {
+				fingerprint = strings.ToUpper(item.Args[0])
+			}
+		case "dir-key-published":
+			cert.Published, err = time.Parse(documentTimeLayout, strings.Join(item.Args, " "))
+			if err != nil {
+				return nil, fmt.Errorf("invalid dir-key-published: %w", err)
+			}
+		case "dir-key-expires":
+			cert.Expires, err = time.Parse(documentTimeLayout, strings.Join(item.Args, " "))
+			if err != nil {
+				return nil, fmt.Errorf("invalid dir-key-expires: %w", err)
+			}
+		case "dir-identity-key":
+			identityDER = item.Object
+			cert.IdentityKey, err = x509.ParsePKCS1PublicKey(item.Object)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dir-identity-key: %w", err)
+			}
+		case "dir-signing-key":
+			cert.SigningKey, err = x509.ParsePKCS1PublicKey(item.Object)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dir-signing-key: %w", err)
+			}
+			digest := sha1.Sum(item.Object) // #nosec G401
+			cert.SigningKeyDigest = strings.ToUpper(hex.EncodeToString(digest[:]))
+		case "dir-key-crosscert":
+			crosscert = item.Object
+		case "dir-key-certification":
+			certification = item.Object
+			signedEnd = item.lineEnd
+		}
+	}
+
+	if cert.IdentityKey == nil || cert.SigningKey == nil || crosscert == nil || certification == nil {
+		return nil, fmt.Errorf("invalid key certificate: missing required item")
+	}
+	if cert.Expires.IsZero() {
+		return nil, fmt.Errorf("invalid key certificate: missing dir-key-expires")
+	}
+
+	identityDigest := sha1.Sum(identityDER) // #nosec G401
+	cert.Fingerprint = strings.ToUpper(hex.EncodeToString(identityDigest[:]))
+	if fingerprint != cert.Fingerprint {
+		return nil, fmt.Errorf("key certificate fingerprint %s does not match identity key %s", fingerprint, cert.Fingerprint)
+	}
+
+	// The signing key signs the identity key digest, proving the authority
+	// holds it (dir-key-crosscert)
+	if err := verifyRSASignature(cert.SigningKey, identityDigest[:], crosscert); err != nil {
+		return nil, fmt.Errorf("key certificate %s: invalid cross-certification: %w", cert.Fingerprint, err)
+	}
+
+	// The identity key signs the certificate up to and including the
+	// dir-key-certification line
+	signedDigest := sha1.Sum(doc[:signedEnd]) // #nosec G401
+	if err := verifyRSASignature(cert.IdentityKey, signedDigest[:], certification); err != nil {
+		return nil, fmt.Errorf("key certificate %s: invalid certification: %w", cert.Fingerprint, err)
+	}
+
+	return cert, nil
+}
+
+// verifyRSASignature checks a directory signature: PKCS#1 v1.5 padding over the
+// bare digest, without an ASN.1 DigestInfo prefix (dir-spec.txt section 1.3)
+func verifyRSASignature(key *rsa.PublicKey, digest, signature []byte) error {
+	return rsa.VerifyPKCS1v15(key, crypto.Hash(0), digest, signature)
+}
+
+// AuthorityCertCache stores verified authority key certificates and, when
+// created with a data directory, persists them across restarts
+type AuthorityCertCache struct {
+	logger *logger.Logger
+	path   string // Empty for an in-memory cache
+	mu     sync.RWMutex
+	certs  map[string]*AuthorityCert // Keyed by certKey
+	dirty  bool
+}
+
+// certKey identifies a certificate by identity and signing key digest
+func certKey(fingerprint, signingKeyDigest string) string {
+	return strings.ToUpper(fingerprint) + "-" + strings.ToUpper(signingKeyDigest)
+}
+
+// newMemoryAuthorityCertCache creates a cache that is never written to disk
+func newMemoryAuthorityCertCache(log *logger.Logger) *AuthorityCertCache {
+	return &AuthorityCertCache{
+		logger: log.Component("cert-cache"),
+		certs:  make(map[string]*AuthorityCert),
+	}
+}
+
+// NewAuthorityCertCache creates a key certificate cache in dataDir, loading
+// any previously saved certificates
+func NewAuthorityCertCache(dataDir string, log *logger.Logger) (*AuthorityCertCache, error) {
+	if log == nil {
+		log = logger.NewDefault()
+	}
+
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	cache := newMemoryAuthorityCertCache(log)
+	cache.path = filepath.Join(dataDir, authCertCacheFile)
+
+	if err := cache.load(); err != nil {
+		if !os.IsNotExist(err) {
+			// A corrupt cache is not fatal; certificates will be re-downloaded
+			cache.logger.Warn("Failed to load authority certificate cache", "error", err)
+		}
+	}
+
+	return cache, nil
+}
+
+// load reads the cache file from disk, dropping expired certificates
+func (cc *AuthorityCertCache) load() error {
+	data, err := os.ReadFile(cc.path)
+	if err != nil {
+		return err
+	}
+
+	certs, err := ParseAuthorityCerts(data, cc.logger)
+	if err != nil {
+		return fmt.Errorf("failed to parse authority certificate cache: %w", err)
+	}
+
+	now := time.Now()
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for _, cert := range certs {
+		if cert.IsExpired(now) {
+			cc.dirty = true
+			continue
+		}
+		cc.certs[certKey(cert.Fingerprint, cert.SigningKeyDigest)] = cert
+	}
+
+	cc.logger.Info("Loaded authority certificate cache", "certificates", len(cc.certs))
+	return nil
+}
+
+// Get returns the certificate for an authority identity and signing key digest
+func (cc *AuthorityCertCache) Get(fingerprint, signingKeyDigest string) (*AuthorityCert, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	cert, ok := cc.certs[certKey(fingerprint, signingKeyDigest)]
+	return cert, ok
+}
+
+// Add stores verified certificates in the cache
+func (cc *AuthorityCertCache) Add(certs ...*AuthorityCert) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for _, cert := range certs {
+		key := certKey(cert.Fingerprint, cert.SigningKeyDigest)
+		if _, exists := cc.certs[key]; !exists {
+			cc.certs[key] = cert
+			cc.dirty = true
+		}
+	}
+}
+
+// Len returns the number of cached certificates
+func (cc *AuthorityCertCache) Len() int {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return len(cc.certs)
+}
+
+// Save writes the cache to disk if it has changed since the last save.
+// It is a no-op for in-memory caches.
+func (cc *AuthorityCertCache) Save() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.path == "" || !cc.dirty {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, cert := range cc.certs {
+		buf.Write(cert.Raw)
+	}
+
+	// Write to temporary file first, then rename for atomic update
+	tmpFile := cc.path + ".tmp"
+	if err := os.WriteFile(tmpFile, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write authority certificate cache: %w", err)
+	}
+
+	if err := os.Rename(tmpFile, cc.path); err != nil {
+		return fmt.Errorf("failed to rename authority certificate cache file: %w", err)
+	}
+
+	cc.dirty = false
+	cc.logger.Debug("Saved authority certificate cache", "certificates", len(cc.certs))
+	return nil
+}
+
+// SetAuthorityCertCache replaces the client's key certificate cache, typically
+// with one persisted in the DataDirectory
+func (c *Client) SetAuthorityCertCache(cache *AuthorityCertCache) {
+	c.certCache = cache
+}
+
+// FetchAuthorityCerts downloads the key certificates for the given signatures
+// from a directory server. Certificates that fail verification are skipped.
+func (c *Client) FetchAuthorityCerts(ctx context.Context, baseURL string, sigs []*DirectorySignature) ([]*AuthorityCert, error) {
+	keys := make([]string, 0, len(sigs))
+	for _, sig := range sigs {
+		keys = append(keys, sig.Identity+"-"+sig.SigningKeyDigest)
+	}
+
+	body, err := c.fetchDocument(ctx, baseURL+authCertPathPrefix+strings.Join(keys, "+"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch authority certificates: %w", err)
+	}
+
+	certs, err := ParseAuthorityCerts(body, c.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse authority certificates: %w", err)
+	}
+	return certs, nil
+}
+
+// verifyConsensus checks the consensus signatures against the trusted
+// authorities, downloading any key certificates that are not yet cached
+func (c *Client) verifyConsensus(ctx context.Context, baseURL string, consensus *Consensus) error {
+	trusted := make(map[string]bool, len(c.trustedAuthorities))
+	for _, auth := range c.trustedAuthorities {
+		trusted[strings.ToUpper(auth.V3Ident)] = true
+	}
+
+	var missing []*DirectorySignature
+	for _, sig := range consensus.Signatures {
+		if !trusted[sig.Identity] {
+			continue
+		}
+		if _, ok := c.certCache.Get(sig.Identity, sig.SigningKeyDigest); !ok {
+			missing = append(missing, sig)
+		}
+	}
+
+	if len(missing) > 0 {
+		c.logger.Info("Fetching authority key certificates", "missing", len(missing))
+		certs, err := c.FetchAuthorityCerts(ctx, baseURL, missing)
+		if err != nil {
+			// Verification below still succeeds if enough certificates are cached
+			c.logger.Warn("Failed to fetch authority key certificates", "error", err)
+		} else {
+			c.certCache.Add(certs...)
+			if err := c.certCache.Save(); err != nil {
+				c.logger.Warn("Failed to save authority certificate cache", "error", err)
+			}
+		}
+	}
+
+	valid, err := consensus.VerifySignatures(c.trustedAuthorities, c.certCache, time.Now())
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("Consensus signatures verified", "valid", valid, "authorities", len(c.trustedAuthorities))
+	return nil
+}
@@ -0,0 +1,500 @@
+package directory
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+// testAuthority is a locally generated v3 directory authority
+type testAuthority struct {
+	nickname    string
+	identityKey *rsa.PrivateKey
+	signingKey  *rsa.PrivateKey
+	fingerprint string
+	skDigest    string
+	cert        string
+}
+
+var (
+	testAuthorityPoolOnce sync.Once
+	testAuthorityPool     []*testAuthority
+)
+
+// testAuthorities returns n test authorities. Keys are generated once and
+// shared between tests; 1024-bit keys keep generation fast.
+func testAuthorities(t *testing.T, n int) []*testAuthority {
+	t.Helper()
+
+	testAuthorityPoolOnce.Do(func() {
+		for i := 0; i < 6; i++ {
+			identity, err := rsa.GenerateKey(rand.Reader, 1024)
+			if err != nil {
+				panic(err)
+			}
+			signing, err := rsa.GenerateKey(rand.Reader, 1024)
+			if err != nil {
+				panic(err)
+			}
+			auth := &testAuthority{
+				nickname:    fmt.Sprintf("testauth%d", i),
+				identityKey: identity,
+				signingKey:  signing,
+				fingerprint: rsaKeyDigest(&identity.PublicKey),
+				skDigest:    rsaKeyDigest(&signing.PublicKey),
+			}
+			auth.cert = buildTestCert(identity, signing, signing, time.Now().Add(365*24*time.Hour))
+			testAuthorityPool = append(testAuthorityPool, auth)
+		}
+	})
+
+	if n > len(testAuthorityPool) {
+		t.Fatalf("at most %d test authorities available", len(testAuthorityPool))
+	}
+	return testAuthorityPool[:n]
+}
+
+// trustedSet returns the trusted authority list for test authorities
+func trustedSet(auths []*testAuthority) []TrustedAuthority {
+	trusted := make([]TrustedAuthority, 0, len(auths))
+	for _, auth := range auths {
+		trusted = append(trusted, TrustedAuthority{Nickname: auth.nickname, V3Ident: auth.fingerprint})
+	}
+	return trusted
+}
+
+// rsaKeyDigest returns the upper-case hex SHA-1 of a PKCS#1 DER public key
+func rsaKeyDigest(key *rsa.PublicKey) string {
+	digest := sha1.Sum(x509.MarshalPKCS1PublicKey(key))
+	return strings.ToUpper(hex.EncodeToString(digest[:]))
+}
+
+// testObject formats a directory document object
+func testObject(objectType string, data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	fmt.Fprintf(&b, "-----BEGIN %s-----\n", objectType)
+	for len(encoded) > 64 {
+		b.WriteString(encoded[:64] + "\n")
+		encoded = encoded[64:]
+	}
+	b.WriteString(encoded + "\n")
+	fmt.Fprintf(&b, "-----END %s-----\n", objectType)
+	return b.String()
+}
+
+// testSign produces a directory signature over digest
+func testSign(key *rsa.PrivateKey, digest []byte) []byte {
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.Hash(0), digest)
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// buildTestCert builds a key certificate whose cross-certification is signed by crossKey
+func buildTestCert(identity, signing, crossKey *rsa.PrivateKey, expires time.Time) string {
+	identityDER := x509.MarshalPKCS1PublicKey(&identity.PublicKey)
+	identityDigest := sha1.Sum(identityDER)
+
+	var b strings.Builder
+	b.WriteString("dir-key-certificate-version 3\n")
+	fmt.Fprintf(&b, "fingerprint %s\n", rsaKeyDigest(&identity.PublicKey))
+	fmt.Fprintf(&b, "dir-key-published %s\n", expires.Add(-365*24*time.Hour).UTC().Format(documentTimeLayout))
+	fmt.Fprintf(&b, "dir-key-expires %s\n", expires.UTC().Format(documentTimeLayout))
+	b.WriteString("dir-identity-key\n" + testObject("RSA PUBLIC KEY", identityDER))
+	b.WriteString("dir-signing-key\n" + testObject("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&signing.PublicKey)))
+	b.WriteString("dir-key-crosscert\n" + testObject("ID SIGNATURE", testSign(crossKey, identityDigest[:])))
+	b.WriteString("dir-key-certification\n")
+
+	signed := sha1.Sum([]byte(b.String()))
+	b.WriteString(testObject("SIGNATURE", testSign(identity, signed[:])))
+	return b.String()
+}
+
+// signTestConsensus appends directory-signature items from each authority to body
+func signTestConsensus(body, alg string, auths ...*testAuthority) string {
+	signedPortion := []byte(body + "directory-signature ")
+	var digest []byte
+	if alg == SignatureAlgSHA256 {
+		sum := sha256.Sum256(signedPortion)
+		digest = sum[:]
+	} else {
+		sum := sha1.Sum(signedPortion)
+		digest = sum[:]
+	}
+
+	var b strings.Builder
+	b.WriteString(body)
+	for _, auth := range auths {
+		if alg == SignatureAlgSHA256 {
+			fmt.Fprintf(&b, "directory-signature %s %s %s\n", alg, auth.fingerprint, auth.skDigest)
+		} else {
+			fmt.Fprintf(&b, "directory-signature %s %s\n", auth.fingerprint, auth.skDigest)
+		}
+		b.WriteString(testObject("SIGNATURE", testSign(auth.signingKey, digest)))
+	}
+	return b.String()
+}
+
+const testSignedConsensusBody = `network-status-version 3
+vote-status consensus
+valid-after 2024-01-01 00:00:00
+r Relay1 AAECAwQFBgcICQoLDA0ODxAREhM AAAAAAAAAAAAAAAAAAAAAAAAAAA 2024-01-01 00:00:00 10.1.0.1 9001 9030
+s Fast Guard Running Stable Valid
+w Bandwidth=1000
+directory-footer
+bandwidth-weights Wgg=6000
+`
+
+func TestParseAuthorityCerts(t *testing.T) {
+	auths := testAuthorities(t, 2)
+
+	certs, err := ParseAuthorityCerts([]byte(auths[0].cert+auths[1].cert), nil)
+	if err != nil {
+		t.Fatalf("ParseAuthorityCerts() error = %v", err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("ParseAuthorityCerts() returned %d certificates, want 2", len(certs))
+	}
+
+	for i, cert := range certs {
+		if cert.Fingerprint != auths[i].fingerprint {
+			t.Errorf("certs[%d].Fingerprint = %s, want %s", i, cert.Fingerprint, auths[i].fingerprint)
+		}
+		if cert.SigningKeyDigest != auths[i].skDigest {
+			t.Errorf("certs[%d].SigningKeyDigest = %s, want %s", i, cert.SigningKeyDigest, auths[i].skDigest)
+		}
+		if cert.SigningKey.N.Cmp(auths[i].signingKey.N) != 0 {
+			t.Errorf("certs[%d].SigningKey mismatch", i)
+		}
+		if cert.IsExpired(time.Now()) {
+			t.Errorf("certs[%d] should not be expired", i)
+		}
+	}
+}
+
+func TestParseAuthorityCertsSkipsInvalid(t *testing.T) {
+	auths := testAuthorities(t, 2)
+	invalid := strings.Replace(auths[0].cert, "dir-key-certificate-version 3\n",
+		"dir-key-certificate-version 3\nextra-item tampered\n", 1)
+
+	certs, err := ParseAuthorityCerts([]byte(invalid+auths[1].cert), nil)
+	if err != nil {
+		t.Fatalf("ParseAuthorityCerts() error = %v", err)
+	}
+	if len(certs) != 1 || certs[0].Fingerprint != auths[1].fingerprint {
+		t.Fatalf("ParseAuthorityCerts() = %d certificates, want only %s", len(certs), auths[1].fingerprint)
+	}
+
+	if _, err := ParseAuthorityCerts(nil, nil); err == nil {
+		t.Error("Expected error without certificates")
+	}
+}
+
+func TestParseAuthorityCertRejectsInvalid(t *testing.T) {
+	auths := testAuthorities(t, 2)
+	valid := auths[0].cert
+	expires := time.Now().Add(24 * time.Hour)
+
+	tests := []struct {
+		name string
+		cert string
+	}{
+		{
+			name: "cross-certification by another key",
+			cert: buildTestCert(auths[0].identityKey, auths[0].signingKey, auths[1].signingKey, expires),
+		},
+		{
+			name: "tampered after certification",
+			cert: strings.Replace(valid, "dir-key-certificate-version 3\n",
+				"dir-key-certificate-version 3\nextra-item tampered\n", 1),
+		},
+		{
+			name: "fingerprint does not match identity key",
+			cert: strings.Replace(valid, "fingerprint "+auths[0].fingerprint,
+				"fingerprint "+auths[1].fingerprint, 1),
+		},
+		{
+			name: "missing signing key",
+			cert: strings.Replace(valid, "dir-signing-key\n", "dir-other-key\n", 1),
+		},
+		{
+			name: "unsupported version",
+			cert: strings.Replace(valid, "dir-key-certificate-version 3", "dir-key-certificate-version 2", 1),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseAuthorityCerts([]byte(tt.cert), nil); err == nil {
+				t.Error("Expected error for invalid certificate")
+			}
+		})
+	}
+}
+
+func TestConsensusVerifySignatures(t *testing.T) {
+	auths := testAuthorities(t, 6)
+	trusted := trustedSet(auths[:5])
+	untrusted := auths[5]
+	now := time.Now()
+
+	certs := newMemoryAuthorityCertCache(logger.NewDefault())
+	for _, auth := range auths {
+		parsed, err := ParseAuthorityCerts([]byte(auth.cert), nil)
+		if err != nil {
+			t.Fatalf("ParseAuthorityCerts() error = %v", err)
+		}
+		certs.Add(parsed...)
+	}
+
+	tests := []struct {
+		name      string
+		document  string
+		wantValid int
+		wantErr   bool
+	}{
+		{
+			name:      "majority of authorities",
+			document:  signTestConsensus(testSignedConsensusBody, SignatureAlgSHA1, auths[0], auths[1], auths[2]),
+			wantValid: 3,
+		},
+		{
+			name:      "all authorities with sha256",
+			document:  signTestConsensus(testSignedConsensusBody, SignatureAlgSHA256, auths[:5]...),
+			wantValid: 5,
+		},
+		{
+			name:      "minority of authorities",
+			document:  signTestConsensus(testSignedConsensusBody, SignatureAlgSHA1, auths[0], auths[1]),
+			wantValid: 2,
+			wantErr:   true,
+		},
+		{
+			name:      "repeated signatures count once",
+			document:  signTestConsensus(testSignedConsensusBody, SignatureAlgSHA1, auths[0], auths[0], auths[0], auths[1]),
+			wantValid: 2,
+			wantErr:   true,
+		},
+		{
+			name:      "untrusted signatures are ignored",
+			document:  signTestConsensus(testSignedConsensusBody, SignatureAlgSHA1, auths[0], auths[1], untrusted),
+			wantValid: 2,
+			wantErr:   true,
+		},
+		{
+			name: "body modified after signing",
+			document: strings.Replace(
+				signTestConsensus(testSignedConsensusBody, SignatureAlgSHA1, auths[:5]...),
+				"10.1.0.1", "10.9.0.1", 1),
+			wantValid: 0,
+			wantErr:   true,
+		},
+		{
+			name:     "unsigned",
+			document: testSignedConsensusBody,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consensus, err := NewClient(nil).ParseConsensus(strings.NewReader(tt.document))
+			if err != nil {
+				t.Fatalf("ParseConsensus() error = %v", err)
+			}
+
+			valid, err := consensus.VerifySignatures(trusted, certs, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifySignatures() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if valid != tt.wantValid {
+				t.Errorf("VerifySignatures() valid = %d, want %d", valid, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestConsensusVerifySignaturesExpiredCert(t *testing.T) {
+	auths := testAuthorities(t, 3)
+	document := signTestConsensus(testSignedConsensusBody, SignatureAlgSHA1, auths...)
+
+	consensus, err := NewClient(nil).ParseConsensus(strings.NewReader(document))
+	if err != nil {
+		t.Fatalf("ParseConsensus() error = %v", err)
+	}
+
+	certs := newMemoryAuthorityCertCache(logger.NewDefault())
+	for _, auth := range auths {
+		parsed, err := ParseAuthorityCerts([]byte(auth.cert), nil)
+		if err != nil {
+			t.Fatalf("ParseAuthorityCerts() error = %v", err)
+		}
+		certs.Add(parsed...)
+	}
+
+	// Certificates expire after a year; two years on, no signature counts
+	if _, err := consensus.VerifySignatures(trustedSet(auths), certs, time.Now().Add(2*365*24*time.Hour)); err == nil {
+		t.Error("Expected error when every certificate has expired")
+	}
+}
+
+func TestAuthorityCertCachePersistence(t *testing.T) {
+	auths := testAuthorities(t, 2)
+	dataDir := t.TempDir()
+
+	cache, err := NewAuthorityCertCache(dataDir, nil)
+	if err != nil {
+		t.Fatalf("NewAuthorityCertCache() error = %v", err)
+	}
+
+	valid, err := ParseAuthorityCerts([]byte(auths[0].cert), nil)
+	if err != nil {
+		t.Fatalf("ParseAuthorityCerts() error = %v", err)
+	}
+	expired, err := ParseAuthorityCerts([]byte(buildTestCert(auths[1].identityKey, auths[1].signingKey,
+		auths[1].signingKey, time.Now().Add(-time.Hour))), nil)
+	if err != nil {
+		t.Fatalf("ParseAuthorityCerts() error = %v", err)
+	}
+	cache.Add(valid...)
+	cache.Add(expired...)
+
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	reloaded, err := NewAuthorityCertCache(dataDir, nil)
+	if err != nil {
+		t.Fatalf("NewAuthorityCertCache() error = %v", err)
+	}
+	if reloaded.Len() != 1 {
+		t.Errorf("reloaded Len() = %d, want 1 (expired certificate dropped)", reloaded.Len())
+	}
+	if _, ok := reloaded.Get(auths[0].fingerprint, auths[0].skDigest); !ok {
+		t.Error("valid certificate missing after reload")
+	}
+
+	// A corrupt certificate in the cache file does not drop the valid one
+	corrupt := strings.Replace(auths[1].cert, "dir-key-certificate-version 3\n",
+		"dir-key-certificate-version 3\nextra-item tampered\n", 1)
+	if err := os.WriteFile(filepath.Join(dataDir, authCertCacheFile), []byte(corrupt+auths[0].cert), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err = NewAuthorityCertCache(dataDir, nil)
+	if err != nil {
+		t.Fatalf("NewAuthorityCertCache() error = %v", err)
+	}
+	if _, ok := reloaded.Get(auths[0].fingerprint, auths[0].skDigest); !ok || reloaded.Len() != 1 {
+		t.Errorf("reloaded Len() = %d with a corrupt certificate, want the valid one", reloaded.Len())
+	}
+}
+
+// testCertServer serves a consensus and the test authorities' key certificates
+type testCertServer struct {
+	*httptest.Server
+	mu           sync.Mutex
+	consensus    string
+	certs        map[string]string
+	certRequests int
+}
+
+func newTestCertServer(t *testing.T, consensus string, auths []*testAuthority) *testCertServer {
+	t.Helper()
+
+	cs := &testCertServer{consensus: consensus, certs: make(map[string]string)}
+	for _, auth := range auths {
+		cs.certs[auth.fingerprint+"-"+auth.skDigest] = auth.cert
+	}
+
+	cs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/tor/status-vote/current/consensus":
+			fmt.Fprint(w, cs.consensus)
+		case strings.HasPrefix(r.URL.Path, authCertPathPrefix):
+			cs.mu.Lock()
+			cs.certRequests++
+			cs.mu.Unlock()
+			for _, key := range strings.Split(strings.TrimPrefix(r.URL.Path, authCertPathPrefix), "+") {
+				fmt.Fprint(w, cs.certs[key])
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(cs.Close)
+	return cs
+}
+
+func TestFetchConsensusVerifiesSignatures(t *testing.T) {
+	auths := testAuthorities(t, 5)
+	trusted := auths[:4]
+	document := signTestConsensus(testSignedConsensusBody, SignatureAlgSHA1, trusted[0], trusted[1], trusted[2])
+	server := newTestCertServer(t, document, auths)
+	dataDir := t.TempDir()
+
+	newClient := func() *Client {
+		t.Helper()
+		cache, err := NewAuthorityCertCache(dataDir, nil)
+		if err != nil {
+			t.Fatalf("NewAuthorityCertCache() error = %v", err)
+		}
+		client := NewClient(nil)
+		client.authorities = []string{server.URL + "/tor/status-vote/current/consensus"}
+		client.trustedAuthorities = trustedSet(trusted)
+		client.SetAuthorityCertCache(cache)
+		return client
+	}
+
+	consensus, err := newClient().FetchConsensusDocument(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConsensusDocument() error = %v", err)
+	}
+	if len(consensus.Relays) != 1 || len(consensus.Signatures) != 3 {
+		t.Errorf("got %d relays and %d signatures, want 1 and 3", len(consensus.Relays), len(consensus.Signatures))
+	}
+	if server.certRequests != 1 {
+		t.Errorf("certificate requests = %d, want 1", server.certRequests)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, authCertCacheFile)); err != nil {
+		t.Fatalf("certificate cache not written: %v", err)
+	}
+
+	// A restarted client verifies with cached certificates
+	if _, err := newClient().FetchConsensusDocument(context.Background()); err != nil {
+		t.Fatalf("FetchConsensusDocument() after restart error = %v", err)
+	}
+	if server.certRequests != 1 {
+		t.Errorf("certificate requests after restart = %d, want 1 (all cached)", server.certRequests)
+	}
+
+	// A consensus signed by a minority of trusted authorities is rejected
+	server.consensus = signTestConsensus(testSignedConsensusBody, SignatureAlgSHA1, trusted[0], auths[4])
+	if _, err := newClient().FetchConsensusDocument(context.Background()); err == nil {
+		t.Error("Expected error for consensus without a majority of trusted signatures")
+	}
+
+	// So is a consensus altered after signing
+	server.consensus = strings.Replace(document, "Bandwidth=1000", "Bandwidth=999999", 1)
+	if _, err := newClient().FetchConsensusDocument(context.Background()); err == nil {
+		t.Error("Expected error for tampered consensus")
+	}
+}
@@ -0,0 +1,179 @@
+// Package directory provides parallel consensus bootstrap from directory
+// authorities and fallback directory mirrors.
+package directory
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// bootstrapMaxInProgress is how many consensus downloads run at once while
+// bootstrapping (ClientBootstrapConsensusMaxInProgressTries in C tor)
+const bootstrapMaxInProgress = 3
+
+// SetDirAuthorities replaces the directory authorities, e.g. from torrc
+// DirAuthority lines for a private test network. Consensus signatures are
+// then only trusted from the v3 authorities in auths.
+func (c *Client) SetDirAuthorities(auths []*DirAuthority) error {
+	var urls []string
+	var trusted []TrustedAuthority
+	for _, auth := range auths {
+		if auth.Bridge || auth.V3Ident == "" {
+			continue
+		}
+		urls = append(urls, auth.ConsensusURL())
+		trusted = append(trusted, TrustedAuthority{Nickname: auth.Nickname, V3Ident: auth.V3Ident})
+	}
+
+	if len(urls) == 0 {
+		return fmt.Errorf("no v3 directory authority configured (DirAuthority needs v3ident=)")
+	}
+
+	c.authorities = urls
+	c.trustedAuthorities = trusted
+	return nil
+}
+
+// SetFallbackDirs replaces the fallback directory mirrors used to bootstrap
+func (c *Client) SetFallbackDirs(fallbacks []*FallbackDir) {
+	c.fallbackDirs = fallbacks
+}
+
+// consensusSources returns the consensus URLs to try, in order, and how many
+// to try at once. As in C tor, bootstrap prefers the fallback mirrors to
+// spread load away from the authorities, but one authority is always among
+// the first attempts. Tunnelled requests all reach the same directory guard,
+// so they are made one at a time.
+func (c *Client) consensusSources() ([]string, int) {
+	if c.tunnelled {
+		return c.authorities, 1
+	}
+
+	authorities := append([]string(nil), c.authorities...)
+	// Uses math/rand intentionally: source order only spreads load and is
+	// not security sensitive, since every consensus is signature-checked
+	rand.Shuffle(len(authorities), func(i, j int) { // #nosec G404
+		authorities[i], authorities[j] = authorities[j], authorities[i]
+	})
+
+	fallbacks := weightedFallbackOrder(c.fallbackDirs)
+	if len(fallbacks) == 0 {
+		return authorities, bootstrapMaxInProgress
+	}
+
+	sources := make([]string, 0, len(fallbacks)+len(authorities))
+	sources = append(sources, fallbacks[0])
+	if len(authorities) > 0 {
+		sources = append(sources, authorities[0])
+		authorities = authorities[1:]
+	}
+	sources = append(sources, fallbacks[1:]...)
+	sources = append(sources, authorities...)
+	return sources, bootstrapMaxInProgress
+}
+
+// weightedFallbackOrder returns the fallback consensus URLs in a random order
+// where mirrors with a higher weight tend to come first
+func weightedFallbackOrder(fallbacks []*FallbackDir) []string {
+	type keyed struct {
+		url string
+		key float64
+	}
+
+	// Weighted random permutation: sort by u^(1/w) (Efraimidis-Spirakis)
+	entries := make([]keyed, len(fallbacks))
+	for i, fallback := range fallbacks {
+		weight := fallback.Weight
+		if weight <= 0 {
+			weight = 1.0
+		}
+		entries[i] = keyed{
+			url: fallback.ConsensusURL(),
+			key: math.Pow(rand.Float64(), 1/weight), // #nosec G404
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key > entries[j].key })
+
+	urls := make([]string, len(entries))
+	for i, entry := range entries {
+		urls[i] = entry.url
+	}
+	return urls
+}
+
+// consensusResult is the outcome of one consensus download
+type consensusResult struct {
+	source    string
+	consensus *Consensus
+	err       error
+}
+
+// fetchConsensusFromSources downloads and verifies a consensus, keeping up to
+// parallel downloads in progress. The first verified consensus wins and the
+// other downloads are cancelled; a failed download starts the next source.
+func (c *Client) fetchConsensusFromSources(ctx context.Context, sources []string, parallel int) (*Consensus, string, error) {
+	if len(sources) == 0 {
+		return nil, "", fmt.Errorf("no directory sources configured")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan consensusResult, len(sources))
+	next, inProgress := 0, 0
+	launch := func() {
+		source := sources[next]
+		next++
+		inProgress++
+		go func() {
+			consensus, err := c.fetchVerifiedConsensus(ctx, source)
+			results <- consensusResult{source: source, consensus: consensus, err: err}
+		}()
+	}
+
+	for inProgress < parallel && next < len(sources) {
+		launch()
+	}
+
+	var lastErr error
+	for inProgress > 0 {
+		result := <-results
+		inProgress--
+		if result.err == nil {
+			return result.consensus, result.source, nil
+		}
+
+		c.logger.Warn("Failed to fetch from authority", "authority", result.source, "error", result.err)
+		lastErr = result.err
+		if next < len(sources) && ctx.Err() == nil {
+			launch()
+		}
+	}
+	return nil, "", lastErr
+}
+
+// populateFromSources fetches the consensus microdescriptors from the source
+// the consensus came from, trying the other sources if that fails
+func (c *Client) populateFromSources(ctx context.Context, consensus *Consensus, source string, sources []string) error {
+	var lastErr error
+	for _, candidate := range append([]string{source}, sources...) {
+		if candidate == source && lastErr != nil {
+			continue
+		}
+		base, err := authorityBaseURL(candidate)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := c.populateMicrodescriptors(ctx, base, consensus); err != nil {
+			c.logger.Warn("Failed to fetch microdescriptors", "authority", candidate, "error", err)
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
@@ -0,0 +1,102 @@
+// Package directory provides an on-disk consensus cache.
+package directory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Consensus cache file names inside the DataDirectory (as in C tor)
+const (
+	consensusCacheFile          = "cached-consensus"
+	microdescConsensusCacheFile = "cached-microdesc-consensus"
+)
+
+// EnableConsensusCache stores each verified consensus in dataDir so that a
+// restarted client can reload it instead of contacting the authorities
+func (c *Client) EnableConsensusCache(dataDir string) {
+	c.consensusCacheDir = dataDir
+}
+
+// consensusCachePath returns the cache file for the flavor the client fetches
+func (c *Client) consensusCachePath() string {
+	if c.microdescCache != nil {
+		return filepath.Join(c.consensusCacheDir, microdescConsensusCacheFile)
+	}
+	return filepath.Join(c.consensusCacheDir, consensusCacheFile)
+}
+
+// saveConsensus writes a verified consensus to the cache
+func (c *Client) saveConsensus(consensus *Consensus) error {
+	if c.consensusCacheDir == "" || len(consensus.Raw) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(c.consensusCacheDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// Write to temporary file first, then rename for atomic update
+	cachePath := c.consensusCachePath()
+	tmpFile := cachePath + ".tmp"
+	if err := os.WriteFile(tmpFile, consensus.Raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write consensus cache: %w", err)
+	}
+
+	if err := os.Rename(tmpFile, cachePath); err != nil {
+		return fmt.Errorf("failed to rename consensus cache file: %w", err)
+	}
+
+	c.logger.Debug("Saved consensus cache", "path", cachePath, "valid_until", consensus.ValidUntil)
+	return nil
+}
+
+// LoadCachedConsensus loads the consensus saved by a previous run. The cached
+// document is verified again, and it is rejected once it has expired.
+func (c *Client) LoadCachedConsensus(ctx context.Context) (*Consensus, error) {
+	if c.consensusCacheDir == "" {
+		return nil, fmt.Errorf("consensus cache not enabled")
+	}
+
+	data, err := os.ReadFile(c.consensusCachePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consensus cache: %w", err)
+	}
+
+	consensus, err := c.ParseConsensus(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cached consensus: %w", err)
+	}
+
+	if consensus.IsExpired(time.Now()) {
+		return nil, fmt.Errorf("cached consensus expired at %s", consensus.ValidUntil.Format(time.RFC3339))
+	}
+
+	// Missing certificates or microdescriptors are fetched from the first authority
+	var base string
+	if len(c.authorities) > 0 {
+		if base, err = authorityBaseURL(c.authorities[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.verifyConsensus(ctx, base, consensus); err != nil {
+		return nil, fmt.Errorf("cached consensus signature verification failed: %w", err)
+	}
+
+	if c.microdescCache != nil {
+		if err := c.populateMicrodescriptors(ctx, base, consensus); err != nil {
+			return nil, err
+		}
+	}
+
+	c.logger.Info("Loaded cached consensus",
+		"relays", len(consensus.Relays),
+		"fresh_until", consensus.FreshUntil,
+		"valid_until", consensus.ValidUntil)
+	return consensus, nil
+}
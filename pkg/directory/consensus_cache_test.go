@@ -0,0 +1,187 @@
+package directory
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLiveConsensusBody returns the test consensus with a one-hour fresh
+// interval and three-hour lifetime starting at validAfter
+func testLiveConsensusBody(validAfter time.Time) string {
+	validAfter = validAfter.UTC().Truncate(time.Second)
+	lifetime := fmt.Sprintf("valid-after %s\nfresh-until %s\nvalid-until %s\n",
+		validAfter.Format(documentTimeLayout),
+		validAfter.Add(time.Hour).Format(documentTimeLayout),
+		validAfter.Add(3*time.Hour).Format(documentTimeLayout))
+	return strings.Replace(testSignedConsensusBody, "valid-after 2024-01-01 00:00:00\n", lifetime, 1)
+}
+
+func TestParseConsensusLifetime(t *testing.T) {
+	validAfter := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	consensus, err := NewClient(nil).ParseConsensus(strings.NewReader(testLiveConsensusBody(validAfter)))
+	if err != nil {
+		t.Fatalf("ParseConsensus() error = %v", err)
+	}
+
+	if !consensus.ValidAfter.Equal(validAfter) {
+		t.Errorf("ValidAfter = %v, want %v", consensus.ValidAfter, validAfter)
+	}
+	if !consensus.FreshUntil.Equal(validAfter.Add(time.Hour)) {
+		t.Errorf("FreshUntil = %v, want %v", consensus.FreshUntil, validAfter.Add(time.Hour))
+	}
+	if !consensus.ValidUntil.Equal(validAfter.Add(3 * time.Hour)) {
+		t.Errorf("ValidUntil = %v, want %v", consensus.ValidUntil, validAfter.Add(3*time.Hour))
+	}
+	if string(consensus.Raw) != testLiveConsensusBody(validAfter) {
+		t.Error("Raw does not hold the parsed document")
+	}
+
+	bad := strings.Replace(testSignedConsensusBody, "valid-after 2024-01-01 00:00:00", "valid-after yesterday", 1)
+	if _, err := NewClient(nil).ParseConsensus(strings.NewReader(bad)); err == nil {
+		t.Error("Expected error for malformed valid-after")
+	}
+}
+
+func TestConsensusIsExpired(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		validUntil time.Time
+		want       bool
+	}{
+		{"live", now.Add(time.Hour), false},
+		{"expired", now.Add(-time.Second), true},
+		{"no lifetime", time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consensus := &Consensus{ValidUntil: tt.validUntil}
+			if got := consensus.IsExpired(now); got != tt.want {
+				t.Errorf("IsExpired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsensusNextRefresh(t *testing.T) {
+	validAfter := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	consensus := &Consensus{
+		ValidAfter: validAfter,
+		FreshUntil: validAfter.Add(time.Hour),
+		ValidUntil: validAfter.Add(3 * time.Hour),
+	}
+
+	// Window starts 45m after fresh-until and covers 7/8 of the remaining 75m
+	windowStart := consensus.FreshUntil.Add(45 * time.Minute)
+	windowEnd := windowStart.Add(75 * time.Minute * 7 / 8)
+
+	now := validAfter.Add(10 * time.Minute)
+	for i := 0; i < 200; i++ {
+		next := consensus.NextRefresh(now)
+		if next.Before(windowStart) || !next.Before(windowEnd) {
+			t.Fatalf("NextRefresh() = %v, want in [%v, %v)", next, windowStart, windowEnd)
+		}
+		if !next.After(consensus.FreshUntil) || !next.Before(consensus.ValidUntil) {
+			t.Fatalf("NextRefresh() = %v is not between fresh-until and valid-until", next)
+		}
+	}
+
+	// Inside the window, the refresh is never scheduled in the past
+	inWindow := windowStart.Add(30 * time.Minute)
+	if next := consensus.NextRefresh(inWindow); next.Before(inWindow) || !next.Before(windowEnd) {
+		t.Errorf("NextRefresh() inside window = %v, want in [%v, %v)", next, inWindow, windowEnd)
+	}
+
+	// Past the window, or without a lifetime, refresh immediately
+	late := consensus.ValidUntil.Add(-time.Minute)
+	if next := consensus.NextRefresh(late); !next.Equal(late) {
+		t.Errorf("NextRefresh() past window = %v, want %v", next, late)
+	}
+	if next := (&Consensus{}).NextRefresh(now); !next.Equal(now) {
+		t.Errorf("NextRefresh() without lifetime = %v, want %v", next, now)
+	}
+}
+
+func TestConsensusCache(t *testing.T) {
+	auths := testAuthorities(t, 3)
+	document := signTestConsensus(testLiveConsensusBody(time.Now().Add(-30*time.Minute)), SignatureAlgSHA1, auths...)
+	server := newTestCertServer(t, document, auths)
+	dataDir := t.TempDir()
+
+	newClient := func() *Client {
+		t.Helper()
+		certCache, err := NewAuthorityCertCache(dataDir, nil)
+		if err != nil {
+			t.Fatalf("NewAuthorityCertCache() error = %v", err)
+		}
+		client := NewClient(nil)
+		client.authorities = []string{server.URL + "/tor/status-vote/current/consensus"}
+		client.trustedAuthorities = trustedSet(auths)
+		client.SetAuthorityCertCache(certCache)
+		client.EnableConsensusCache(dataDir)
+		return client
+	}
+
+	if _, err := newClient().LoadCachedConsensus(context.Background()); err == nil {
+		t.Error("Expected error loading a consensus that was never cached")
+	}
+
+	fetched, err := newClient().FetchConsensusDocument(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConsensusDocument() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, consensusCacheFile)); err != nil {
+		t.Fatalf("consensus cache not written: %v", err)
+	}
+
+	// A restarted client loads the cached consensus without the network
+	server.Close()
+	loaded, err := newClient().LoadCachedConsensus(context.Background())
+	if err != nil {
+		t.Fatalf("LoadCachedConsensus() error = %v", err)
+	}
+	if len(loaded.Relays) != len(fetched.Relays) || !loaded.ValidUntil.Equal(fetched.ValidUntil) {
+		t.Errorf("cached consensus differs: %d relays valid until %v, want %d relays valid until %v",
+			len(loaded.Relays), loaded.ValidUntil, len(fetched.Relays), fetched.ValidUntil)
+	}
+
+	// A tampered cache fails verification
+	tampered := strings.Replace(document, "Bandwidth=1000", "Bandwidth=999999", 1)
+	if err := os.WriteFile(filepath.Join(dataDir, consensusCacheFile), []byte(tampered), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := newClient().LoadCachedConsensus(context.Background()); err == nil {
+		t.Error("Expected error loading a tampered cached consensus")
+	}
+
+	// An expired cache is refused
+	expired := signTestConsensus(testLiveConsensusBody(time.Now().Add(-4*time.Hour)), SignatureAlgSHA1, auths...)
+	if err := os.WriteFile(filepath.Join(dataDir, consensusCacheFile), []byte(expired), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := newClient().LoadCachedConsensus(context.Background()); err == nil {
+		t.Error("Expected error loading an expired cached consensus")
+	}
+}
+
+func TestFetchConsensusRejectsExpired(t *testing.T) {
+	auths := testAuthorities(t, 3)
+	expired := signTestConsensus(testLiveConsensusBody(time.Now().Add(-4*time.Hour)), SignatureAlgSHA1, auths...)
+	server := newTestCertServer(t, expired, auths)
+
+	client := NewClient(nil)
+	client.authorities = []string{server.URL + "/tor/status-vote/current/consensus"}
+	client.trustedAuthorities = trustedSet(auths)
+	client.EnableConsensusCache(t.TempDir())
+
+	if _, err := client.FetchConsensusDocument(context.Background()); err == nil {
+		t.Error("Expected error for an expired consensus")
+	}
+}
@@ -4,13 +4,21 @@ package directory
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"compress/zlib"
 	"context"
+	"crypto/sha1" // #nosec G505 - SHA-1 consensus digests are defined by dir-spec.txt
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,15 +30,14 @@ const (
 	maxMalformedEntryRate = 10 // Reject if >10% of entries are malformed
 	maxPortParseErrorRate = 20 // Warn if >20% of entries have port parse errors
 
-	// SPEC-003: Enhanced consensus signature validation thresholds
-	// These constants support future implementation of multi-signature threshold validation
-	// per dir-spec.txt section 3.4 (Voting and consensus signature requirements)
+	// SPEC-003: Consensus metadata sanity thresholds. Cryptographic signature
+	// checks against the trusted authority set are done by Consensus.VerifySignatures.
 	minDirectoryAuthorities = 3                // Minimum authorities for valid consensus
-	minSignatureThreshold   = 2                // Minimum signatures required (future: implement proper quorum)
+	minSignatureThreshold   = 2                // Minimum signatures required
 	maxClockSkew            = 30 * time.Minute // Maximum allowed clock skew for consensus timestamps
 )
 
-// Default directory authority addresses (hardcoded fallback directories)
+// Default directory authority addresses, used unless DirAuthority is configured
 // Using HTTP instead of HTTPS for better compatibility with IP-based authorities
 // The Tor consensus is cryptographically signed, so transport encryption is not critical
 var DefaultAuthorities = []string{
@@ -49,10 +56,120 @@ type Relay struct {
 	Address      string
 	ORPort       int
 	DirPort      int
+	IPv6Address  string // IPv6 ORPort address from the consensus "a" line, if any
+	IPv6ORPort   int
 	Flags        []string
 	Published    time.Time
 	IdentityKey  []byte // Ed25519 identity key (32 bytes) - SPEC-001
 	NtorOnionKey []byte // Curve25519 ntor onion key (32 bytes) - SPEC-001
+	Bandwidth    int64  // Consensus weight from the "w Bandwidth=" line (kilobytes/s)
+	Unmeasured   bool   // True if the bandwidth was not measured by bandwidth authorities
+
+	// Family lists the relay's declared family members from its
+	// microdescriptor "family" line, normalised by ParseFamily. The ns
+	// consensus carries no families, so it is only known with
+	// microdescriptors.
+	Family []string
+
+	// MicrodescDigest is the "m" line digest in a microdesc-flavored consensus
+	MicrodescDigest string
+
+	// ExitPolicy is the IPv4 exit policy summary, if known
+	ExitPolicy *ExitPolicySummary
+
+	// Protocols lists the subprotocol versions from the "pr" line
+	Protocols Protocols
+}
+
+// Consensus flavors (dir-spec.txt section 3.4.1)
+const (
+	FlavorNS        = "ns"
+	FlavorMicrodesc = "microdesc"
+)
+
+// Consensus represents a parsed network-status consensus document
+type Consensus struct {
+	Flavor string // FlavorNS or FlavorMicrodesc
+	Relays []*Relay
+
+	// Lifetime of the consensus (dir-spec.txt section 3.4.1)
+	ValidAfter time.Time
+	FreshUntil time.Time
+	ValidUntil time.Time
+
+	// BandwidthWeights holds the "bandwidth-weights" footer values (Wgg, Wgm, Wee, ...)
+	// used for position-weighted relay selection per dir-spec.txt section 3.8.3
+	BandwidthWeights map[string]int64
+
+	// Params holds the consensus "params" line values
+	Params map[string]int64
+
+	// Shared random values that place onion service descriptors on the
+	// HSDir hash ring (dir-spec.txt section 3.4.1); nil when absent
+	SharedRandCurrent  []byte
+	SharedRandPrevious []byte
+
+	// Signatures holds the footer "directory-signature" items
+	Signatures []*DirectorySignature
+
+	// signedDigests maps a signature algorithm to the digest of the signed
+	// portion of the document
+	signedDigests map[string][]byte
+
+	// Raw is the document as received, used for the on-disk consensus cache
+	Raw []byte
+}
+
+// Default consensus parameter values (dir-spec.txt section 3.4.1)
+const (
+	defaultBwWeightScale   = 10000
+	defaultMaxUnmeasuredBw = 20
+)
+
+// WeightScale returns the denominator for bandwidth-weights ("bwweightscale" param)
+func (c *Consensus) WeightScale() int64 {
+	if v, ok := c.Params["bwweightscale"]; ok && v > 0 {
+		return v
+	}
+	return defaultBwWeightScale
+}
+
+// MaxUnmeasuredBandwidth returns the cap applied to unmeasured relays ("maxunmeasuredbw" param)
+func (c *Consensus) MaxUnmeasuredBandwidth() int64 {
+	if v, ok := c.Params["maxunmeasuredbw"]; ok && v >= 0 {
+		return v
+	}
+	return defaultMaxUnmeasuredBw
+}
+
+// IsExpired reports whether the consensus is past its valid-until time.
+// A consensus without timing information is never considered expired.
+func (c *Consensus) IsExpired(now time.Time) bool {
+	return !c.ValidUntil.IsZero() && now.After(c.ValidUntil)
+}
+
+// NextRefresh returns when a client should fetch the next consensus. As in C
+// tor (dir-spec.txt section 5.1), the time is chosen uniformly at random from
+// a window starting 3/4 of the fresh interval after fresh-until and covering
+// the first 7/8 of the time remaining before valid-until. A window that has
+// already started or passed is clamped to now.
+func (c *Consensus) NextRefresh(now time.Time) time.Time {
+	if c.FreshUntil.IsZero() || c.ValidUntil.IsZero() {
+		return now
+	}
+
+	start := c.FreshUntil.Add(c.FreshUntil.Sub(c.ValidAfter) * 3 / 4)
+	end := start.Add(c.ValidUntil.Sub(start) * 7 / 8)
+	if start.Before(now) {
+		start = now
+	}
+	if !end.After(start) {
+		return start
+	}
+
+	// Uses math/rand intentionally: the refresh time only spreads load on the
+	// directory authorities and is not security sensitive
+	return start.Add(time.Duration(rand.Int63n(int64(end.Sub(start))))) // #nosec G404
 }
 
 // Client provides directory protocol operations
@@ -60,6 +177,34 @@ type Client struct {
 	httpClient  *http.Client
 	logger      *logger.Logger
 	authorities []string
+
+	// Consensus signature verification
+	trustedAuthorities []TrustedAuthority
+	certCache          *AuthorityCertCache
+
+	// Microdescriptor support (nil cache = full "ns" consensus)
+	microdescCache     *MicrodescCache
+	microdescBatchSize int
+
+	// consensusCacheDir holds the cached consensus ("" = no cache)
+	consensusCacheDir string
+
+	// Bootstrap sources besides the authorities, and whether requests are
+	// tunnelled over circuits (see SetTransport)
+	fallbackDirs []*FallbackDir
+	tunnelled    bool
+}
+
+// newDirectTransport returns the transport used to contact directory
+// authorities directly, before any circuit can be built
+func newDirectTransport() http.RoundTripper {
+	// Use TLS config that skips verification for IP-based authorities
+	// This is acceptable because consensus documents are cryptographically signed
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, // Required for IP-based directory authorities
+		},
+	}
 }
 
 // NewClient creates a new directory client
@@ -68,48 +213,91 @@ func NewClient(log *logger.Logger) *Client {
 		log = logger.NewDefault()
 	}
 
-	// Create HTTP client with custom transport
-	// Use TLS config that skips verification for IP-based authorities
-	// This is acceptable because consensus documents are cryptographically signed
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true, // Required for IP-based directory authorities
-		},
+	dirLog := log.Component("directory")
+	fallbacks := DefaultFallbackDirs()
+	if len(fallbacks) == 0 {
+		dirLog.Warn("Built-in fallback directory list is empty; bootstrapping from the directory authorities only")
 	}
 
 	return &Client{
 		httpClient: &http.Client{
 			Timeout:   10 * time.Second, // Reduced timeout for faster fallback
-			Transport: transport,
+			Transport: newDirectTransport(),
 		},
-		logger:      log.Component("directory"),
-		authorities: DefaultAuthorities,
+		logger:             dirLog,
+		authorities:        DefaultAuthorities,
+		trustedAuthorities: DefaultTrustedAuthorities,
+		certCache:          newMemoryAuthorityCertCache(log),
+		fallbackDirs:       fallbacks,
 	}
 }
 
 // FetchConsensus fetches the network consensus from directory authorities
 func (c *Client) FetchConsensus(ctx context.Context) ([]*Relay, error) {
+	consensus, err := c.FetchConsensusDocument(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return consensus.Relays, nil
+}
+
+// FetchConsensusDocument fetches the network consensus from directory authorities,
+// including the document-level data (bandwidth weights, params) needed for path selection
+func (c *Client) FetchConsensusDocument(ctx context.Context) (*Consensus, error) {
 	c.logger.Info("Fetching network consensus")
 
-	// Try each authority until one succeeds
-	var lastErr error
-	for _, authority := range c.authorities {
-		relays, err := c.fetchFromAuthority(ctx, authority)
-		if err != nil {
-			c.logger.Warn("Failed to fetch from authority", "authority", authority, "error", err)
-			lastErr = err
-			continue
+	sources, parallel := c.consensusSources()
+	consensus, source, err := c.fetchConsensusFromSources(ctx, sources, parallel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch consensus from any authority: %w", err)
+	}
+
+	// Microdescriptors are fetched once, from the source that won the race,
+	// falling back to the other sources if it cannot serve them
+	if c.microdescCache != nil {
+		if err := c.populateFromSources(ctx, consensus, source, sources); err != nil {
+			return nil, err
 		}
+	}
 
-		c.logger.Info("Successfully fetched consensus", "relays", len(relays), "authority", authority)
-		return relays, nil
+	c.logger.Info("Successfully fetched consensus", "relays", len(consensus.Relays), "authority", source)
+	if err := c.saveConsensus(consensus); err != nil {
+		c.logger.Warn("Failed to save consensus cache", "error", err)
 	}
+	return consensus, nil
+}
 
-	return nil, fmt.Errorf("failed to fetch consensus from any authority: %w", lastErr)
+// fetchVerifiedConsensus fetches a consensus from a specific authority and
+// verifies its signatures. Microdescriptors are fetched separately, once a
+// consensus is known to be authentic.
+func (c *Client) fetchVerifiedConsensus(ctx context.Context, authority string) (*Consensus, error) {
+	base, err := authorityBaseURL(authority)
+	if err != nil {
+		return nil, err
+	}
+
+	consensusURL := authority
+	if c.microdescCache != nil {
+		consensusURL = base + microdescConsensusPath
+	}
+
+	consensus, err := c.fetchFromAuthority(ctx, consensusURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.verifyConsensus(ctx, base, consensus); err != nil {
+		return nil, fmt.Errorf("consensus signature verification failed: %w", err)
+	}
+
+	if consensus.IsExpired(time.Now()) {
+		return nil, fmt.Errorf("consensus expired at %s", consensus.ValidUntil.Format(time.RFC3339))
+	}
+	return consensus, nil
 }
 
 // fetchFromAuthority fetches consensus from a specific authority
-func (c *Client) fetchFromAuthority(ctx context.Context, authorityURL string) ([]*Relay, error) {
+func (c *Client) fetchFromAuthority(ctx context.Context, authorityURL string) (*Consensus, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", authorityURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
@@ -158,20 +346,46 @@ func (c *Client) fetchFromAuthority(ctx context.Context, authorityURL string) ([
 	}
 
 	// Parse the consensus document
-	relays, err := c.parseConsensus(reader)
+	consensus, err := c.ParseConsensus(reader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse consensus: %w", err)
 	}
 
-	return relays, nil
+	return consensus, nil
 }
 
 // parseConsensus parses a consensus document and extracts relay information
 func (c *Client) parseConsensus(r io.Reader) ([]*Relay, error) {
+	consensus, err := c.ParseConsensus(r)
+	if err != nil {
+		return nil, err
+	}
+	return consensus.Relays, nil
+}
+
+// ParseConsensus parses a consensus document, including relay entries,
+// bandwidth weights and consensus parameters
+func (c *Client) ParseConsensus(r io.Reader) (*Consensus, error) {
 	var relays []*Relay
-	scanner := bufio.NewScanner(r)
+	var raw bytes.Buffer
+	consensus := &Consensus{
+		Flavor:           FlavorNS,
+		BandwidthWeights: make(map[string]int64),
+		Params:           make(map[string]int64),
+	}
+	scanner := bufio.NewScanner(io.TeeReader(r, &raw))
+
+	// The signed portion runs from the start of the document through the
+	// space after the first "directory-signature" keyword
+	sha1Digest := sha1.New() // #nosec G401
+	sha256Digest := sha256.New()
+	signedPortion := io.MultiWriter(sha1Digest, sha256Digest)
+	inFooterSignatures := false
 
 	var currentRelay *Relay
+	var currentSig *DirectorySignature
+	var sigData strings.Builder
+	var inSigObject bool
 	var totalEntries int
 	var malformedEntries int
 	var portParseErrors int
@@ -179,44 +393,162 @@ func (c *Client) parseConsensus(r io.Reader) ([]*Relay, error) {
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		// Parse "directory-signature" items from the footer
+		if strings.HasPrefix(line, "directory-signature ") {
+			if !inFooterSignatures {
+				_, _ = io.WriteString(signedPortion, "directory-signature ")
+				consensus.signedDigests = map[string][]byte{
+					SignatureAlgSHA1:   sha1Digest.Sum(nil),
+					SignatureAlgSHA256: sha256Digest.Sum(nil),
+				}
+				inFooterSignatures = true
+			}
+			sig, err := parseDirectorySignatureLine(line)
+			if err != nil {
+				return nil, err
+			}
+			currentSig = sig
+			continue
+		}
+		if inFooterSignatures {
+			switch {
+			case line == "-----BEGIN SIGNATURE-----":
+				inSigObject = true
+				sigData.Reset()
+			case line == "-----END SIGNATURE-----" && inSigObject:
+				inSigObject = false
+				signature, err := base64.StdEncoding.DecodeString(sigData.String())
+				if err != nil {
+					return nil, fmt.Errorf("invalid directory-signature object: %w", err)
+				}
+				if currentSig != nil {
+					currentSig.Signature = signature
+					consensus.Signatures = append(consensus.Signatures, currentSig)
+					currentSig = nil
+				}
+			case inSigObject:
+				sigData.WriteString(line)
+			}
+			continue
+		}
+		_, _ = io.WriteString(signedPortion, line+"\n")
+
+		// Parse the flavor from "network-status-version 3 [flavor]"
+		if strings.HasPrefix(line, "network-status-version ") {
+			if fields := strings.Fields(line); len(fields) >= 3 && fields[2] == FlavorMicrodesc {
+				consensus.Flavor = FlavorMicrodesc
+			}
+		}
+
+		// Parse the consensus lifetime
+		if err := parseConsensusTime(line, "valid-after ", &consensus.ValidAfter); err != nil {
+			return nil, err
+		}
+		if err := parseConsensusTime(line, "fresh-until ", &consensus.FreshUntil); err != nil {
+			return nil, err
+		}
+		if err := parseConsensusTime(line, "valid-until ", &consensus.ValidUntil); err != nil {
+			return nil, err
+		}
+
 		// Parse "r" lines (router status entries)
 		if strings.HasPrefix(line, "r ") {
 			totalEntries++
 
 			if currentRelay != nil {
 				relays = append(relays, currentRelay)
+				currentRelay = nil
+			}
+
+			// The microdesc flavor omits the descriptor digest field
+			minParts := 9
+			if consensus.Flavor == FlavorMicrodesc {
+				minParts = 8
 			}
 
 			parts := strings.Fields(line)
-			if len(parts) < 9 {
+			if len(parts) < minParts {
 				malformedEntries++
 				c.logger.Debug("Skipping malformed relay entry", "line", line)
 				continue // Skip malformed entries
 			}
 
+			// Address, ORPort and DirPort are the last three fields in both flavors
+			addrIdx := minParts - 3
 			currentRelay = &Relay{
 				Nickname:    parts[1],
 				Fingerprint: parts[2],
-				Address:     parts[6],
+				Address:     parts[addrIdx],
 			}
 
 			// Parse ORPort (track errors for SEC-014)
-			if _, err := fmt.Sscanf(parts[7], "%d", &currentRelay.ORPort); err != nil {
+			if _, err := fmt.Sscanf(parts[addrIdx+1], "%d", &currentRelay.ORPort); err != nil {
 				portParseErrors++
-				c.logger.Debug("Failed to parse ORPort", "error", err, "value", parts[7])
+				c.logger.Debug("Failed to parse ORPort", "error", err, "value", parts[addrIdx+1])
 			}
 			// Parse DirPort (track errors for SEC-014)
-			if _, err := fmt.Sscanf(parts[8], "%d", &currentRelay.DirPort); err != nil {
+			if _, err := fmt.Sscanf(parts[addrIdx+2], "%d", &currentRelay.DirPort); err != nil {
 				portParseErrors++
-				c.logger.Debug("Failed to parse DirPort", "error", err, "value", parts[8])
+				c.logger.Debug("Failed to parse DirPort", "error", err, "value", parts[addrIdx+2])
+			}
+		}
+
+		// Parse "a" lines (additional OR addresses); the first IPv6 one is kept
+		if strings.HasPrefix(line, "a ") && currentRelay != nil && currentRelay.IPv6Address == "" {
+			if addr, port, err := parseIPv6ORAddress(line[2:]); err != nil {
+				c.logger.Debug("Ignoring OR address", "relay", currentRelay.Nickname, "error", err)
+			} else {
+				currentRelay.IPv6Address, currentRelay.IPv6ORPort = addr, port
 			}
 		}
 
+		// Parse "m" lines (microdescriptor digest, microdesc flavor only)
+		if strings.HasPrefix(line, "m ") && currentRelay != nil && consensus.Flavor == FlavorMicrodesc {
+			currentRelay.MicrodescDigest = strings.TrimSpace(line[2:])
+		}
+
 		// Parse "s" lines (flags)
 		if strings.HasPrefix(line, "s ") && currentRelay != nil {
 			flags := strings.Fields(line[2:]) // Skip "s "
 			currentRelay.Flags = flags
 		}
+
+		// Parse "pr" lines (supported subprotocol versions)
+		if strings.HasPrefix(line, "pr ") && currentRelay != nil {
+			protocols, err := ParseProtocols(line[3:])
+			if err != nil {
+				c.logger.Debug("Ignoring malformed protocol line", "relay", currentRelay.Nickname, "error", err)
+			} else {
+				currentRelay.Protocols = protocols
+			}
+		}
+
+		// Parse "w" lines (consensus bandwidth)
+		if strings.HasPrefix(line, "w ") && currentRelay != nil {
+			kv := parseKeywordValues(strings.Fields(line[2:]))
+			currentRelay.Bandwidth = kv["Bandwidth"]
+			currentRelay.Unmeasured = kv["Unmeasured"] == 1
+		}
+
+		// Parse document-level "params" and "bandwidth-weights" lines
+		if strings.HasPrefix(line, "params ") {
+			for k, v := range parseKeywordValues(strings.Fields(line)[1:]) {
+				consensus.Params[k] = v
+			}
+		}
+		if strings.HasPrefix(line, "bandwidth-weights ") {
+			for k, v := range parseKeywordValues(strings.Fields(line)[1:]) {
+				consensus.BandwidthWeights[k] = v
+			}
+		}
+
+		// Parse "shared-rand-{current,previous}-value NumReveals Value" lines
+		if strings.HasPrefix(line, "shared-rand-current-value ") {
+			consensus.SharedRandCurrent = parseSharedRandValue(line)
+		}
+		if strings.HasPrefix(line, "shared-rand-previous-value ") {
+			consensus.SharedRandPrevious = parseSharedRandValue(line)
+		}
 	}
 
 	// Add the last relay
@@ -251,7 +583,72 @@ func (c *Client) parseConsensus(r io.Reader) ([]*Relay, error) {
 			"total", totalEntries, "valid", len(relays))
 	}
 
-	return relays, nil
+	consensus.Relays = relays
+	consensus.Raw = raw.Bytes()
+	return consensus, nil
+}
+
+// parseIPv6ORAddress parses the "[address]:port" argument of an "a" line
+// holding an IPv6 address
+func parseIPv6ORAddress(s string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(strings.TrimSpace(s))
+	if err != nil {
+		return "", 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return "", 0, fmt.Errorf("not an IPv6 address: %q", host)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port: %q", portStr)
+	}
+	return ip.String(), port, nil
+}
+
+// parseConsensusTime parses a timestamp line such as "valid-after" into dst
+// if line starts with prefix
+func parseConsensusTime(line, prefix string, dst *time.Time) error {
+	if !strings.HasPrefix(line, prefix) {
+		return nil
+	}
+	t, err := time.Parse(documentTimeLayout, strings.TrimSpace(line[len(prefix):]))
+	if err != nil {
+		return fmt.Errorf("invalid %s time: %w", strings.TrimSpace(prefix), err)
+	}
+	*dst = t
+	return nil
+}
+
+// parseKeywordValues parses "Key=Value" integer pairs, skipping malformed entries
+func parseKeywordValues(fields []string) map[string]int64 {
+	values := make(map[string]int64, len(fields))
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		values[key] = n
+	}
+	return values
+}
+
+// parseSharedRandValue returns the 32-byte value of a shared-rand-*-value
+// line, or nil if it is malformed
+func parseSharedRandValue(line string) []byte {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return nil
+	}
+	value, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil || len(value) != 32 {
+		return nil
+	}
+	return value
 }
 
 // HasFlag checks if a relay has a specific flag
@@ -289,11 +686,90 @@ func (r *Relay) IsValid() bool {
 	return r.HasFlag("Valid")
 }
 
+// AllowsExitPort reports whether the relay's exit policy summary permits port.
+// Relays without a known policy are assumed to allow it.
+func (r *Relay) AllowsExitPort(port int) bool {
+	if r.ExitPolicy == nil {
+		return true
+	}
+	return r.ExitPolicy.AllowsPort(port)
+}
+
 // String returns a string representation of the relay
 func (r *Relay) String() string {
 	return fmt.Sprintf("%s (%s:%d)", r.Nickname, r.Address, r.ORPort)
 }
 
+// HexFingerprint returns the relay's RSA identity digest as upper-case hex.
+// Consensus "r" lines carry the digest in unpadded base64; values that are
+// already hex are returned normalised.
+func (r *Relay) HexFingerprint() string {
+	fp := strings.TrimPrefix(r.Fingerprint, "$")
+	if len(fp) == 40 {
+		if _, err := hex.DecodeString(fp); err == nil {
+			return strings.ToUpper(fp)
+		}
+	}
+	if digest, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fp, "=")); err == nil && len(digest) == 20 {
+		return strings.ToUpper(hex.EncodeToString(digest))
+	}
+	return strings.ToUpper(fp)
+}
+
+// ParseFamily parses the arguments of a descriptor "family" line. Fingerprint
+// entries ("$HEX", "$HEX~nick", "$HEX=nick") are normalised to "$" followed by
+// upper-case hex; nickname entries are kept as-is.
+func ParseFamily(line string) []string {
+	fields := strings.Fields(strings.TrimPrefix(line, "family"))
+	family := make([]string, 0, len(fields))
+	for _, entry := range fields {
+		if strings.HasPrefix(entry, "$") {
+			fp := entry[1:]
+			if i := strings.IndexAny(fp, "~="); i >= 0 {
+				fp = fp[:i]
+			}
+			if len(fp) != 40 {
+				continue
+			}
+			if _, err := hex.DecodeString(fp); err != nil {
+				continue
+			}
+			family = append(family, "$"+strings.ToUpper(fp))
+			continue
+		}
+		family = append(family, entry)
+	}
+	return family
+}
+
+// declaresFamilyMember reports whether r lists other in its declared family
+func (r *Relay) declaresFamilyMember(other *Relay) bool {
+	if len(r.Family) == 0 {
+		return false
+	}
+	otherFP := "$" + other.HexFingerprint()
+	for _, member := range r.Family {
+		if strings.HasPrefix(member, "$") {
+			if member == otherFP {
+				return true
+			}
+		} else if strings.EqualFold(member, other.Nickname) {
+			return true
+		}
+	}
+	return false
+}
+
+// InSameFamily reports whether r and other are in the same family. Per
+// path-spec.txt section 5.3, two relays are in the same family only if each
+// one lists the other.
+func (r *Relay) InSameFamily(other *Relay) bool {
+	if r == nil || other == nil {
+		return false
+	}
+	return r.declaresFamilyMember(other) && other.declaresFamilyMember(r)
+}
+
 // GetIdentityKey returns the relay's Ed25519 identity key (SPEC-001)
 func (r *Relay) GetIdentityKey() []byte {
 	return r.IdentityKey
@@ -309,27 +785,20 @@ func (r *Relay) HasValidKeys() bool {
 	return len(r.IdentityKey) == 32 && len(r.NtorOnionKey) == 32
 }
 
-// SPEC-003: Enhanced consensus validation infrastructure
-// These types and methods provide hooks for implementing full multi-signature
-// threshold validation per dir-spec.txt section 3.4
+// SPEC-003: Consensus metadata validation
 
 // ConsensusMetadata contains metadata about a consensus document (SPEC-003)
-// Future enhancement: parse and validate directory authority signatures
 type ConsensusMetadata struct {
 	ValidAfter  time.Time
 	FreshUntil  time.Time
 	ValidUntil  time.Time
-	Signatures  int // Number of authority signatures (future: validate each)
+	Signatures  int // Number of authority signatures
 	Authorities int // Number of authorities in consensus
 }
 
-// ValidateConsensusMetadata performs enhanced validation on consensus metadata (SPEC-003)
-// This provides infrastructure for implementing multi-signature threshold validation
-// Current implementation provides basic timing validation; future versions should:
-// - Parse and verify all directory authority signatures
-// - Validate signature threshold meets quorum requirements
-// - Check authority keys against hardcoded trusted set
-// - Implement proper Byzantine fault tolerance
+// ValidateConsensusMetadata performs basic timing and count validation on
+// consensus metadata (SPEC-003). Signatures themselves are verified against
+// authority key certificates by Consensus.VerifySignatures.
 func ValidateConsensusMetadata(meta *ConsensusMetadata) error {
 	now := time.Now()
 
@@ -1,7 +1,9 @@
 package directory
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"strings"
 	"testing"
 	"time"
@@ -89,6 +91,132 @@ s Running Valid
 	}
 }
 
+func TestParseConsensusBandwidth(t *testing.T) {
+	consensusData := `network-status-version 3
+vote-status consensus
+params bwweightscale=1000 maxunmeasuredbw=50
+r Test1 AAAAAAAAAAAAAAAAAAAAAA BBBBBBBBBBBBB 2024-01-01 00:00:00 192.168.1.1 9001 0
+s Fast Guard Running Stable Valid
+w Bandwidth=5000
+r Test2 CCCCCCCCCCCCCCCCCCCCCC DDDDDDDDDDDDD 2024-01-01 00:00:00 192.168.1.2 9002 9030
+s Exit Fast Running Stable Valid
+w Bandwidth=30 Unmeasured=1
+directory-footer
+bandwidth-weights Wbd=0 Wbe=0 Wbg=4203 Wbm=10000 Wdb=10000 Web=10000 Wed=10000 Wee=10000 Weg=10000 Wem=10000 Wgb=10000 Wgd=0 Wgg=5797 Wgm=5797 Wmb=10000 Wmd=0 Wme=0 Wmg=4203 Wmm=10000
+`
+
+	client := NewClient(nil)
+	consensus, err := client.ParseConsensus(strings.NewReader(consensusData))
+	if err != nil {
+		t.Fatalf("ParseConsensus() error = %v", err)
+	}
+
+	if len(consensus.Relays) != 2 {
+		t.Fatalf("ParseConsensus() returned %d relays, want 2", len(consensus.Relays))
+	}
+	if consensus.Relays[0].Bandwidth != 5000 || consensus.Relays[0].Unmeasured {
+		t.Errorf("relay[0] bandwidth = %d (unmeasured=%v), want 5000 measured",
+			consensus.Relays[0].Bandwidth, consensus.Relays[0].Unmeasured)
+	}
+	if consensus.Relays[1].Bandwidth != 30 || !consensus.Relays[1].Unmeasured {
+		t.Errorf("relay[1] bandwidth = %d (unmeasured=%v), want 30 unmeasured",
+			consensus.Relays[1].Bandwidth, consensus.Relays[1].Unmeasured)
+	}
+
+	if got := consensus.BandwidthWeights["Wgg"]; got != 5797 {
+		t.Errorf("Wgg = %d, want 5797", got)
+	}
+	if got := consensus.BandwidthWeights["Wmg"]; got != 4203 {
+		t.Errorf("Wmg = %d, want 4203", got)
+	}
+	if len(consensus.BandwidthWeights) != 19 {
+		t.Errorf("parsed %d bandwidth weights, want 19", len(consensus.BandwidthWeights))
+	}
+
+	if got := consensus.WeightScale(); got != 1000 {
+		t.Errorf("WeightScale() = %d, want 1000", got)
+	}
+	if got := consensus.MaxUnmeasuredBandwidth(); got != 50 {
+		t.Errorf("MaxUnmeasuredBandwidth() = %d, want 50", got)
+	}
+
+	// Defaults apply when params are absent
+	empty := &Consensus{}
+	if got := empty.WeightScale(); got != 10000 {
+		t.Errorf("default WeightScale() = %d, want 10000", got)
+	}
+	if got := empty.MaxUnmeasuredBandwidth(); got != 20 {
+		t.Errorf("default MaxUnmeasuredBandwidth() = %d, want 20", got)
+	}
+}
+
+func TestParseConsensusIPv6Address(t *testing.T) {
+	consensusData := `network-status-version 3 microdesc
+vote-status consensus
+r Test1 AAAAAAAAAAAAAAAAAAAAAA 2024-01-01 00:00:00 192.0.2.1 9001 0
+a [2001:db8::1]:9001
+a [2001:db8::2]:9002
+m CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC
+s Fast Running Valid
+r Test2 BBBBBBBBBBBBBBBBBBBBBB 2024-01-01 00:00:00 192.0.2.2 9001 0
+a 192.0.2.3:9001
+s Fast Running Valid
+r Test3 DDDDDDDDDDDDDDDDDDDDDD 2024-01-01 00:00:00 192.0.2.4 9001 0
+a [2001:db8::4]:0
+s Fast Running Valid
+`
+
+	consensus, err := NewClient(nil).ParseConsensus(strings.NewReader(consensusData))
+	if err != nil {
+		t.Fatalf("ParseConsensus() error = %v", err)
+	}
+	if len(consensus.Relays) != 3 {
+		t.Fatalf("ParseConsensus() returned %d relays, want 3", len(consensus.Relays))
+	}
+	if r := consensus.Relays[0]; r.IPv6Address != "2001:db8::1" || r.IPv6ORPort != 9001 {
+		t.Errorf("relay[0] IPv6 address = %s port %d, want the first \"a\" line", r.IPv6Address, r.IPv6ORPort)
+	}
+	// IPv4 "a" lines and invalid ports are ignored
+	for _, r := range consensus.Relays[1:] {
+		if r.IPv6Address != "" {
+			t.Errorf("%s IPv6 address = %s, want none", r.Nickname, r.IPv6Address)
+		}
+	}
+}
+
+func TestParseConsensusSharedRandom(t *testing.T) {
+	current := bytes.Repeat([]byte{0xAA}, 32)
+	previous := bytes.Repeat([]byte{0xBB}, 32)
+	consensusData := `network-status-version 3
+vote-status consensus
+shared-rand-previous-value 9 ` + base64.StdEncoding.EncodeToString(previous) + `
+shared-rand-current-value 9 ` + base64.StdEncoding.EncodeToString(current) + `
+r Test1 AAAAAAAAAAAAAAAAAAAAAA BBBBBBBBBBBBB 2024-01-01 00:00:00 192.168.1.1 9001 0
+s Fast Guard HSDir Running Stable Valid
+`
+
+	client := NewClient(nil)
+	consensus, err := client.ParseConsensus(strings.NewReader(consensusData))
+	if err != nil {
+		t.Fatalf("ParseConsensus() error = %v", err)
+	}
+	if !bytes.Equal(consensus.SharedRandCurrent, current) {
+		t.Errorf("SharedRandCurrent = %x, want %x", consensus.SharedRandCurrent, current)
+	}
+	if !bytes.Equal(consensus.SharedRandPrevious, previous) {
+		t.Errorf("SharedRandPrevious = %x, want %x", consensus.SharedRandPrevious, previous)
+	}
+
+	// Malformed values are dropped rather than used on the hash ring
+	consensus, err = client.ParseConsensus(strings.NewReader("network-status-version 3\nshared-rand-current-value 9 AAAA\n"))
+	if err != nil {
+		t.Fatalf("ParseConsensus() error = %v", err)
+	}
+	if consensus.SharedRandCurrent != nil {
+		t.Errorf("SharedRandCurrent = %x, want nil", consensus.SharedRandCurrent)
+	}
+}
+
 func TestParseConsensusEmpty(t *testing.T) {
 	client := NewClient(nil)
 	reader := strings.NewReader("")
@@ -359,3 +487,77 @@ func TestConsensusMetadataStructure(t *testing.T) {
 		t.Errorf("Expected 9 authorities, got %d", meta.Authorities)
 	}
 }
+
+func TestRelayHexFingerprint(t *testing.T) {
+	tests := []struct {
+		name        string
+		fingerprint string
+		want        string
+	}{
+		{"base64 digest", "AAECAwQFBgcICQoLDA0ODxAREhM", "000102030405060708090A0B0C0D0E0F10111213"},
+		{"lower-case hex", "000102030405060708090a0b0c0d0e0f10111213", "000102030405060708090A0B0C0D0E0F10111213"},
+		{"dollar-prefixed hex", "$000102030405060708090A0B0C0D0E0F10111213", "000102030405060708090A0B0C0D0E0F10111213"},
+		{"opaque value", "aaaa1111", "AAAA1111"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := &Relay{Fingerprint: tt.fingerprint}
+			if got := relay.HexFingerprint(); got != tt.want {
+				t.Errorf("HexFingerprint() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFamily(t *testing.T) {
+	family := ParseFamily("family $0123456789abcdef0123456789abcdef01234567~nick1 " +
+		"$FEDCBA9876543210FEDCBA9876543210FEDCBA98=nick2 NickOnly $SHORT")
+
+	want := []string{
+		"$0123456789ABCDEF0123456789ABCDEF01234567",
+		"$FEDCBA9876543210FEDCBA9876543210FEDCBA98",
+		"NickOnly",
+	}
+	if len(family) != len(want) {
+		t.Fatalf("ParseFamily() returned %v, want %v", family, want)
+	}
+	for i := range want {
+		if family[i] != want[i] {
+			t.Errorf("family[%d] = %s, want %s", i, family[i], want[i])
+		}
+	}
+}
+
+func TestRelayInSameFamily(t *testing.T) {
+	a := &Relay{Nickname: "RelayA", Fingerprint: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}
+	b := &Relay{Nickname: "RelayB", Fingerprint: "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"}
+	c := &Relay{Nickname: "RelayC", Fingerprint: "CCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC"}
+
+	tests := []struct {
+		name    string
+		familyA []string
+		familyB []string
+		want    bool
+	}{
+		{"mutual fingerprints", []string{"$" + b.Fingerprint}, []string{"$" + a.Fingerprint}, true},
+		{"mutual nicknames", []string{"relayb"}, []string{"RelayA"}, true},
+		{"mixed forms", []string{"$" + b.Fingerprint}, []string{"RelayA"}, true},
+		{"one-sided declaration", []string{"$" + b.Fingerprint}, nil, false},
+		{"unrelated families", []string{"$" + c.Fingerprint}, []string{"$" + c.Fingerprint}, false},
+		{"no families", nil, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Family = tt.familyA
+			b.Family = tt.familyB
+			if got := a.InSameFamily(b); got != tt.want {
+				t.Errorf("a.InSameFamily(b) = %v, want %v", got, tt.want)
+			}
+			if got := b.InSameFamily(a); got != tt.want {
+				t.Errorf("b.InSameFamily(a) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
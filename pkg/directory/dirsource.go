@@ -0,0 +1,251 @@
+// Package directory provides configurable directory authorities and fallback
+// directory mirrors.
+package directory
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// consensusPath is the request path of the full ("ns") consensus
+const consensusPath = "/tor/status-vote/current/consensus"
+
+// DirAuthority is a directory authority from a torrc "DirAuthority" line
+type DirAuthority struct {
+	Nickname    string
+	Address     string // IPv4 address
+	DirPort     int
+	ORPort      int
+	Fingerprint string // Upper-case hex SHA-1 of the relay identity key
+	V3Ident     string // Upper-case hex SHA-1 of the v3 identity key ("" = not a v3 authority)
+	Bridge      bool   // Bridge authorities do not sign the consensus
+}
+
+// ParseDirAuthority parses the value of a torrc DirAuthority option:
+//
+//	[nickname] [flags] address:dirport fingerprint
+//
+// where flags include "orport=PORT" and "v3ident=FINGERPRINT". The identity
+// fingerprint may be split into groups of four hex digits, as in C tor.
+func ParseDirAuthority(line string) (*DirAuthority, error) {
+	fields := strings.Fields(line)
+	auth := &DirAuthority{}
+
+	i := 0
+	if i < len(fields) && !strings.Contains(fields[i], "=") && !strings.Contains(fields[i], ":") {
+		auth.Nickname = fields[i]
+		i++
+	}
+
+	for ; i < len(fields) && !strings.Contains(fields[i], ":"); i++ {
+		key, value, _ := strings.Cut(fields[i], "=")
+		switch key {
+		case "orport":
+			port, err := parsePort(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DirAuthority orport: %w", err)
+			}
+			auth.ORPort = port
+		case "v3ident":
+			fp, err := parseFingerprint(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DirAuthority v3ident: %w", err)
+			}
+			auth.V3Ident = fp
+		case "bridge":
+			auth.Bridge = true
+		default:
+			// Other C tor flags (no-v2, hs, weight=, ...) do not affect a client
+		}
+	}
+
+	if i >= len(fields) {
+		return nil, fmt.Errorf("invalid DirAuthority %q: missing address", line)
+	}
+	address, dirPort, err := parseAddrPort(fields[i])
+	if err != nil {
+		return nil, fmt.Errorf("invalid DirAuthority address: %w", err)
+	}
+	auth.Address = address
+	auth.DirPort = dirPort
+
+	fp, err := parseFingerprint(strings.Join(fields[i+1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DirAuthority fingerprint: %w", err)
+	}
+	auth.Fingerprint = fp
+
+	return auth, nil
+}
+
+// ConsensusURL returns the URL of the consensus on the authority's DirPort
+func (a *DirAuthority) ConsensusURL() string {
+	return dirPortURL(a.Address, a.DirPort) + consensusPath
+}
+
+// FallbackDir is a directory mirror used to bootstrap, from a torrc
+// "FallbackDir" line or the built-in list
+type FallbackDir struct {
+	Address     string // IPv4 address
+	DirPort     int
+	ORPort      int
+	Fingerprint string  // Upper-case hex SHA-1 of the relay identity key
+	Weight      float64 // Selection weight (default 1.0)
+}
+
+// ParseFallbackDir parses the value of a torrc FallbackDir option:
+//
+//	address:dirport orport=PORT id=FINGERPRINT [weight=NUM] [ipv6=[addr]:port]
+func ParseFallbackDir(line string) (*FallbackDir, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid FallbackDir: empty line")
+	}
+
+	address, dirPort, err := parseAddrPort(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid FallbackDir address: %w", err)
+	}
+	fallback := &FallbackDir{Address: address, DirPort: dirPort, Weight: 1.0}
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "orport":
+			if fallback.ORPort, err = parsePort(value); err != nil {
+				return nil, fmt.Errorf("invalid FallbackDir orport: %w", err)
+			}
+		case "id":
+			if fallback.Fingerprint, err = parseFingerprint(value); err != nil {
+				return nil, fmt.Errorf("invalid FallbackDir id: %w", err)
+			}
+		case "weight":
+			weight, err := strconv.ParseFloat(value, 64)
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("invalid FallbackDir weight: %s", value)
+			}
+			fallback.Weight = weight
+		default:
+			// ipv6= is not used: directory requests are made over IPv4
+		}
+	}
+
+	if fallback.ORPort == 0 || fallback.Fingerprint == "" {
+		return nil, fmt.Errorf("invalid FallbackDir %q: orport and id are required", line)
+	}
+	return fallback, nil
+}
+
+// ConsensusURL returns the URL of the consensus on the mirror's DirPort
+func (f *FallbackDir) ConsensusURL() string {
+	return dirPortURL(f.Address, f.DirPort) + consensusPath
+}
+
+// ParseFallbackDirList parses a fallback list in the format of C tor's
+// fallback_dirs.inc: quoted FallbackDir values, with continuation strings,
+// separated by commas and interleaved with C comments
+func ParseFallbackDirList(data string) ([]*FallbackDir, error) {
+	var fallbacks []*FallbackDir
+	var entry strings.Builder
+
+	flush := func() error {
+		line := strings.TrimSpace(entry.String())
+		entry.Reset()
+		if line == "" {
+			return nil
+		}
+		fallback, err := ParseFallbackDir(line)
+		if err != nil {
+			return err
+		}
+		fallbacks = append(fallbacks, fallback)
+		return nil
+	}
+
+	inComment := false
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		for line != "" {
+			switch {
+			case inComment:
+				end := strings.Index(line, "*/")
+				if end < 0 {
+					line = ""
+					continue
+				}
+				inComment = false
+				line = strings.TrimSpace(line[end+2:])
+			case strings.HasPrefix(line, "/*"):
+				inComment = true
+				line = line[2:]
+			case strings.HasPrefix(line, "\""):
+				end := strings.Index(line[1:], "\"")
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated string in fallback list: %s", line)
+				}
+				entry.WriteString(line[1 : end+1])
+				line = strings.TrimSpace(line[end+2:])
+			case strings.HasPrefix(line, ","):
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				line = strings.TrimSpace(line[1:])
+			default:
+				return nil, fmt.Errorf("unexpected text in fallback list: %s", line)
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return fallbacks, nil
+}
+
+// parseAddrPort parses an "IPv4:port" directory address
+func parseAddrPort(s string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		return "", 0, fmt.Errorf("not an IPv4 address: %s", host)
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// parsePort parses a TCP port number
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return port, nil
+}
+
+// parseFingerprint parses a 40-digit hex relay fingerprint, ignoring a leading "$"
+func parseFingerprint(s string) (string, error) {
+	fp := strings.ToUpper(strings.TrimPrefix(s, "$"))
+	if len(fp) != 40 {
+		return "", fmt.Errorf("fingerprint must be 40 hex digits: %q", s)
+	}
+	if _, err := hex.DecodeString(fp); err != nil {
+		return "", fmt.Errorf("fingerprint must be 40 hex digits: %q", s)
+	}
+	return fp, nil
+}
+
+// dirPortURL returns the base URL of a DirPort
+func dirPortURL(address string, port int) string {
+	if port == 80 {
+		return "http://" + address
+	}
+	return "http://" + net.JoinHostPort(address, strconv.Itoa(port))
+}
@@ -0,0 +1,260 @@
+package directory
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDirAuthority(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *DirAuthority
+		wantErr bool
+	}{
+		{
+			name: "chutney authority",
+			line: "test000a orport=5000 no-v2 v3ident=0123456789abcdef0123456789abcdef01234567 127.0.0.1:7000 89AB CDEF 0123 4567 89AB CDEF 0123 4567 89AB CDEF",
+			want: &DirAuthority{
+				Nickname:    "test000a",
+				Address:     "127.0.0.1",
+				DirPort:     7000,
+				ORPort:      5000,
+				Fingerprint: "89ABCDEF0123456789ABCDEF0123456789ABCDEF",
+				V3Ident:     "0123456789ABCDEF0123456789ABCDEF01234567",
+			},
+		},
+		{
+			name: "without nickname",
+			line: "orport=443 v3ident=0123456789ABCDEF0123456789ABCDEF01234567 192.0.2.1:80 89ABCDEF0123456789ABCDEF0123456789ABCDEF",
+			want: &DirAuthority{
+				Address:     "192.0.2.1",
+				DirPort:     80,
+				ORPort:      443,
+				Fingerprint: "89ABCDEF0123456789ABCDEF0123456789ABCDEF",
+				V3Ident:     "0123456789ABCDEF0123456789ABCDEF01234567",
+			},
+		},
+		{
+			name: "bridge authority",
+			line: "bridgeauth bridge orport=443 192.0.2.2:80 89ABCDEF0123456789ABCDEF0123456789ABCDEF",
+			want: &DirAuthority{
+				Nickname:    "bridgeauth",
+				Address:     "192.0.2.2",
+				DirPort:     80,
+				ORPort:      443,
+				Fingerprint: "89ABCDEF0123456789ABCDEF0123456789ABCDEF",
+				Bridge:      true,
+			},
+		},
+		{name: "missing address", line: "test000a orport=5000", wantErr: true},
+		{name: "bad port", line: "test000a 127.0.0.1:0 89ABCDEF0123456789ABCDEF0123456789ABCDEF", wantErr: true},
+		{name: "hostname address", line: "test000a localhost:7000 89ABCDEF0123456789ABCDEF0123456789ABCDEF", wantErr: true},
+		{name: "short fingerprint", line: "test000a 127.0.0.1:7000 89AB CDEF", wantErr: true},
+		{name: "bad v3ident", line: "test000a v3ident=XYZ 127.0.0.1:7000 89ABCDEF0123456789ABCDEF0123456789ABCDEF", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDirAuthority(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseDirAuthority() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseDirAuthority() error = %v", err)
+			}
+			if *got != *tt.want {
+				t.Errorf("ParseDirAuthority() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFallbackDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *FallbackDir
+		wantErr bool
+	}{
+		{
+			name: "full entry",
+			line: "192.0.2.10:80 orport=443 id=0123456789abcdef0123456789abcdef01234567 weight=2.5 ipv6=[2001:db8::1]:443",
+			want: &FallbackDir{Address: "192.0.2.10", DirPort: 80, ORPort: 443, Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567", Weight: 2.5},
+		},
+		{
+			name: "default weight",
+			line: "192.0.2.11:9030 orport=9001 id=0123456789ABCDEF0123456789ABCDEF01234567",
+			want: &FallbackDir{Address: "192.0.2.11", DirPort: 9030, ORPort: 9001, Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567", Weight: 1.0},
+		},
+		{name: "missing id", line: "192.0.2.10:80 orport=443", wantErr: true},
+		{name: "missing orport", line: "192.0.2.10:80 id=0123456789ABCDEF0123456789ABCDEF01234567", wantErr: true},
+		{name: "bad weight", line: "192.0.2.10:80 orport=443 id=0123456789ABCDEF0123456789ABCDEF01234567 weight=0", wantErr: true},
+		{name: "empty", line: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFallbackDir(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseFallbackDir() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFallbackDir() error = %v", err)
+			}
+			if *got != *tt.want {
+				t.Errorf("ParseFallbackDir() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFallbackDirList(t *testing.T) {
+	list := `/* type=fallback */
+/* version=3.0.0 */
+/* ===== */
+"192.0.2.10:80 orport=443 id=0123456789ABCDEF0123456789ABCDEF01234567"
+" ipv6=[2001:db8::1]:443"
+/* nickname=first */
+/* extrainfo=0 */
+/* ===== */
+,
+"192.0.2.11:9030 orport=9001 id=89ABCDEF0123456789ABCDEF0123456789ABCDEF weight=3"
+/* nickname=second
+   multi-line comment */
+/* ===== */
+,
+`
+	fallbacks, err := ParseFallbackDirList(list)
+	if err != nil {
+		t.Fatalf("ParseFallbackDirList() error = %v", err)
+	}
+	if len(fallbacks) != 2 {
+		t.Fatalf("ParseFallbackDirList() returned %d entries, want 2", len(fallbacks))
+	}
+	if fallbacks[0].Address != "192.0.2.10" || fallbacks[1].Weight != 3 {
+		t.Errorf("unexpected entries: %+v, %+v", fallbacks[0], fallbacks[1])
+	}
+
+	if _, err := ParseFallbackDirList(`"192.0.2.10:80 orport=443"` + "\n,"); err == nil {
+		t.Error("Expected error for an invalid entry")
+	}
+	if _, err := ParseFallbackDirList(`"192.0.2.10:80`); err == nil {
+		t.Error("Expected error for an unterminated string")
+	}
+
+	// The built-in list must always parse
+	if _, err := ParseFallbackDirList(defaultFallbackDirList); err != nil {
+		t.Errorf("built-in fallback list does not parse: %v", err)
+	}
+}
+
+func TestSetDirAuthorities(t *testing.T) {
+	auths := []*DirAuthority{
+		{Nickname: "test000a", Address: "127.0.0.1", DirPort: 7000, V3Ident: "0123456789ABCDEF0123456789ABCDEF01234567"},
+		{Nickname: "bridgeauth", Address: "127.0.0.1", DirPort: 7001, Bridge: true},
+		{Nickname: "test001a", Address: "127.0.0.1", DirPort: 80, V3Ident: "89ABCDEF0123456789ABCDEF0123456789ABCDEF"},
+	}
+
+	client := NewClient(nil)
+	if err := client.SetDirAuthorities(auths); err != nil {
+		t.Fatalf("SetDirAuthorities() error = %v", err)
+	}
+
+	wantURLs := []string{
+		"http://127.0.0.1:7000/tor/status-vote/current/consensus",
+		"http://127.0.0.1/tor/status-vote/current/consensus",
+	}
+	if strings.Join(client.authorities, " ") != strings.Join(wantURLs, " ") {
+		t.Errorf("authorities = %v, want %v", client.authorities, wantURLs)
+	}
+	if len(client.trustedAuthorities) != 2 || client.trustedAuthorities[1].V3Ident != auths[2].V3Ident {
+		t.Errorf("trustedAuthorities = %v", client.trustedAuthorities)
+	}
+
+	if err := client.SetDirAuthorities(auths[1:2]); err == nil {
+		t.Error("Expected error without any v3 authority")
+	}
+}
+
+func TestConsensusSources(t *testing.T) {
+	client := NewClient(nil)
+	client.authorities = []string{"http://192.0.2.1/a", "http://192.0.2.2/b"}
+	client.SetFallbackDirs([]*FallbackDir{
+		{Address: "192.0.2.10", DirPort: 80, Weight: 1},
+		{Address: "192.0.2.11", DirPort: 80, Weight: 1},
+	})
+
+	sources, parallel := client.consensusSources()
+	if parallel != bootstrapMaxInProgress || len(sources) != 4 {
+		t.Fatalf("consensusSources() = %v, %d", sources, parallel)
+	}
+	// A fallback goes first, followed by an authority
+	if sources[0] != client.fallbackDirs[0].ConsensusURL() && sources[0] != client.fallbackDirs[1].ConsensusURL() {
+		t.Errorf("first source %s is not a fallback", sources[0])
+	}
+	if sources[1] != client.authorities[0] && sources[1] != client.authorities[1] {
+		t.Errorf("second source %s is not an authority", sources[1])
+	}
+
+	// Tunnelled requests all reach the directory guard, one at a time
+	client.SetTransport(http.DefaultTransport)
+	if sources, parallel := client.consensusSources(); parallel != 1 || len(sources) != 2 {
+		t.Errorf("tunnelled consensusSources() = %v, %d", sources, parallel)
+	}
+}
+
+func TestFetchConsensusParallelBootstrap(t *testing.T) {
+	auths := testAuthorities(t, 3)
+	document := signTestConsensus(testLiveConsensusBody(time.Now().Add(-30*time.Minute)), SignatureAlgSHA1, auths...)
+	good := newTestCertServer(t, document, auths)
+
+	// A source that never answers must not hold up bootstrap
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer stalled.Close()
+	defer close(release)
+
+	// A source serving garbage fails and is replaced by the next source
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	client := NewClient(nil)
+	client.authorities = []string{
+		stalled.URL + consensusPath,
+		broken.URL + consensusPath,
+		stalled.URL + consensusPath,
+		good.URL + consensusPath,
+	}
+	client.trustedAuthorities = trustedSet(auths)
+	client.SetFallbackDirs(nil)
+
+	start := time.Now()
+	consensus, err := client.FetchConsensusDocument(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConsensusDocument() error = %v", err)
+	}
+	if len(consensus.Relays) == 0 {
+		t.Error("Expected relays in the consensus")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("bootstrap took %v, stalled sources were not bypassed", elapsed)
+	}
+}
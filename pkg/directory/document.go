@@ -0,0 +1,131 @@
+// Package directory provides helpers for parsing directory documents.
+package directory
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// documentTimeLayout is the timestamp format used in directory documents
+const documentTimeLayout = "2006-01-02 15:04:05"
+
+// documentItem is a keyword line of a directory document with its optional
+// object (dir-spec.txt section 1.2)
+type documentItem struct {
+	Keyword    string
+	Args       []string
+	ObjectType string // e.g. "RSA PUBLIC KEY", "SIGNATURE"
+	Object     []byte // Base64-decoded object, nil if the item has none
+
+	// lineEnd is the offset just past the keyword line, used to locate the
+	// signed portion of a document
+	lineEnd int
+}
+
+// parseDocumentItems splits a directory document into its items
+func parseDocumentItems(doc []byte) ([]*documentItem, error) {
+	var items []*documentItem
+	var current *documentItem
+	var objectData strings.Builder
+	inObject := false
+
+	offset := 0
+	for offset < len(doc) {
+		lineEnd := len(doc)
+		if nl := bytes.IndexByte(doc[offset:], '\n'); nl >= 0 {
+			lineEnd = offset + nl + 1
+		}
+		line := strings.TrimRight(string(doc[offset:lineEnd]), "\r\n")
+		offset = lineEnd
+
+		switch {
+		case inObject:
+			if line != "-----END "+current.ObjectType+"-----" {
+				objectData.WriteString(line)
+				continue
+			}
+			decoded, err := base64.StdEncoding.DecodeString(objectData.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s object: %w", current.ObjectType, err)
+			}
+			current.Object = decoded
+			objectData.Reset()
+			inObject = false
+		case strings.HasPrefix(line, "-----BEGIN ") && strings.HasSuffix(line, "-----"):
+			if current == nil || current.ObjectType != "" {
+				return nil, fmt.Errorf("object without keyword line")
+			}
+			current.ObjectType = strings.TrimSuffix(strings.TrimPrefix(line, "-----BEGIN "), "-----")
+			inObject = true
+		case strings.TrimSpace(line) == "":
+			continue
+		default:
+			fields := strings.Fields(line)
+			current = &documentItem{Keyword: fields[0], Args: fields[1:], lineEnd: lineEnd}
+			items = append(items, current)
+		}
+	}
+
+	if inObject {
+		return nil, fmt.Errorf("unterminated %s object", current.ObjectType)
+	}
+	return items, nil
+}
+
+// splitDocuments splits concatenated documents at each line starting with keyword
+func splitDocuments(data []byte, keyword string) [][]byte {
+	var docs [][]byte
+	start := -1
+	offset := 0
+	for offset < len(data) {
+		lineEnd := len(data)
+		if nl := bytes.IndexByte(data[offset:], '\n'); nl >= 0 {
+			lineEnd = offset + nl + 1
+		}
+		line := bytes.TrimRight(data[offset:lineEnd], "\r\n")
+		if bytes.Equal(line, []byte(keyword)) || bytes.HasPrefix(line, []byte(keyword+" ")) {
+			if start >= 0 {
+				docs = append(docs, data[start:offset])
+			}
+			start = offset
+		}
+		offset = lineEnd
+	}
+	if start >= 0 {
+		docs = append(docs, data[start:])
+	}
+	return docs
+}
+
+// fetchDocument performs a directory GET request and returns the response body
+func (c *Client) fetchDocument(ctx context.Context, reqURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", reqURL, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			c.logger.Error("Failed to close response body", "function", "fetchDocument", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return body, nil
+}
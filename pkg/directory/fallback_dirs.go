@@ -0,0 +1,26 @@
+// Package directory provides the built-in fallback directory mirror list.
+package directory
+
+import _ "embed"
+
+// defaultFallbackDirList holds the built-in fallback directory mirrors in the
+// format of C tor's src/app/config/fallback_dirs.inc, of which
+// fallback_dirs.inc is a verbatim copy refreshed with go generate. The mirrors' identities are not trusted:
+// every consensus they serve is verified against the directory authority
+// signatures.
+//
+//go:generate curl -fsSL -o fallback_dirs.inc https://gitlab.torproject.org/tpo/core/tor/-/raw/main/src/app/config/fallback_dirs.inc
+//go:embed fallback_dirs.inc
+var defaultFallbackDirList string
+
+// DefaultFallbackDirs returns the built-in fallback directory mirrors. They
+// are used, along with DefaultAuthorities, unless FallbackDir or DirAuthority
+// is configured.
+func DefaultFallbackDirs() []*FallbackDir {
+	fallbacks, err := ParseFallbackDirList(defaultFallbackDirList)
+	if err != nil {
+		// The built-in list is covered by tests; never fail bootstrap over it
+		return nil
+	}
+	return fallbacks
+}
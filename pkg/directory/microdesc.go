@@ -0,0 +1,299 @@
+// Package directory provides microdescriptor parsing and fetching.
+package directory
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+const (
+	// microdescConsensusPath is the microdesc-flavored consensus (dir-spec.txt section 4.2)
+	microdescConsensusPath = "/tor/status-vote/current/consensus-microdesc"
+
+	// microdescPathPrefix fetches microdescriptors by digest (dir-spec.txt section 4.3)
+	microdescPathPrefix = "/tor/micro/d/"
+
+	// maxMicrodescsPerRequest matches C tor's batch size for microdescriptor downloads
+	maxMicrodescsPerRequest = 92
+)
+
+// Microdescriptor holds the fields of a relay microdescriptor used by clients
+type Microdescriptor struct {
+	Digest       string             // Unpadded base64 SHA-256 digest, as in consensus "m" lines
+	NtorOnionKey []byte             // Curve25519 ntor onion key (32 bytes)
+	Ed25519ID    []byte             // Ed25519 identity key from "id ed25519" (32 bytes)
+	Family       []string           // Declared family, normalised by ParseFamily
+	ExitPolicy   *ExitPolicySummary // IPv4 exit policy summary ("p" line)
+	ExitPolicy6  *ExitPolicySummary // IPv6 exit policy summary ("p6" line)
+	Raw          []byte             // Raw document, used for caching
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Low  int
+	High int
+}
+
+// ExitPolicySummary is a compact exit policy: accepted or rejected port ranges
+// for all addresses (dir-spec.txt section 3.4.1, "p" lines)
+type ExitPolicySummary struct {
+	Accept bool
+	Ports  []PortRange
+}
+
+// ParseExitPolicySummary parses the arguments of a "p" or "p6" line, for example
+// "accept 80,443,8000-8999"
+func ParseExitPolicySummary(s string) (*ExitPolicySummary, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid exit policy summary: %q", s)
+	}
+
+	policy := &ExitPolicySummary{}
+	switch fields[0] {
+	case "accept":
+		policy.Accept = true
+	case "reject":
+		policy.Accept = false
+	default:
+		return nil, fmt.Errorf("invalid exit policy keyword: %s", fields[0])
+	}
+
+	for _, item := range strings.Split(fields[1], ",") {
+		lowStr, highStr, isRange := strings.Cut(item, "-")
+		low, err := strconv.Atoi(lowStr)
+		if err != nil || low < 1 || low > 65535 {
+			return nil, fmt.Errorf("invalid port in exit policy: %s", item)
+		}
+		high := low
+		if isRange {
+			high, err = strconv.Atoi(highStr)
+			if err != nil || high < low || high > 65535 {
+				return nil, fmt.Errorf("invalid port range in exit policy: %s", item)
+			}
+		}
+		policy.Ports = append(policy.Ports, PortRange{Low: low, High: high})
+	}
+
+	return policy, nil
+}
+
+// AllowsPort reports whether the policy permits exiting to port
+func (p *ExitPolicySummary) AllowsPort(port int) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Ports {
+		if port >= r.Low && port <= r.High {
+			return p.Accept
+		}
+	}
+	return !p.Accept
+}
+
+// ParseMicrodescriptors parses a sequence of microdescriptors. Each document
+// starts with an "onion-key" line, and its digest is the SHA-256 of its text
+// (dir-spec.txt section 3.3). Malformed documents are logged and skipped, so
+// one bad relay does not cost the rest of the batch.
+func ParseMicrodescriptors(data []byte, log *logger.Logger) []*Microdescriptor {
+	if log == nil {
+		log = logger.NewDefault()
+	}
+	docs := splitDocuments(data, "onion-key")
+
+	mds := make([]*Microdescriptor, 0, len(docs))
+	for _, doc := range docs {
+		md, err := parseMicrodescriptor(doc)
+		if err != nil {
+			log.Warn("Skipping malformed microdescriptor", "error", err)
+			continue
+		}
+		mds = append(mds, md)
+	}
+	return mds
+}
+
+// parseMicrodescriptor parses a single microdescriptor document
+func parseMicrodescriptor(doc []byte) (*Microdescriptor, error) {
+	digest := sha256.Sum256(doc)
+	md := &Microdescriptor{
+		Digest: base64.RawStdEncoding.EncodeToString(digest[:]),
+		Raw:    append([]byte(nil), doc...),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(doc))
+	for scanner.Scan() {
+		line := scanner.Text()
+		keyword, args, _ := strings.Cut(line, " ")
+
+		switch keyword {
+		case "ntor-onion-key":
+			key, err := decodeBase64Key(args)
+			if err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("invalid ntor-onion-key in microdescriptor %s", md.Digest)
+			}
+			md.NtorOnionKey = key
+		case "id":
+			fields := strings.Fields(args)
+			if len(fields) == 2 && fields[0] == "ed25519" {
+				key, err := decodeBase64Key(fields[1])
+				if err != nil || len(key) != 32 {
+					return nil, fmt.Errorf("invalid ed25519 id in microdescriptor %s", md.Digest)
+				}
+				md.Ed25519ID = key
+			}
+		case "family":
+			md.Family = ParseFamily(line)
+		case "p":
+			policy, err := ParseExitPolicySummary(args)
+			if err != nil {
+				return nil, fmt.Errorf("microdescriptor %s: %w", md.Digest, err)
+			}
+			md.ExitPolicy = policy
+		case "p6":
+			policy, err := ParseExitPolicySummary(args)
+			if err != nil {
+				return nil, fmt.Errorf("microdescriptor %s: %w", md.Digest, err)
+			}
+			md.ExitPolicy6 = policy
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading microdescriptor: %w", err)
+	}
+
+	if md.NtorOnionKey == nil {
+		return nil, fmt.Errorf("microdescriptor %s has no ntor-onion-key", md.Digest)
+	}
+
+	return md, nil
+}
+
+// decodeBase64Key decodes a base64 key with or without padding
+func decodeBase64Key(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+}
+
+// applyTo copies the microdescriptor fields onto a relay
+func (md *Microdescriptor) applyTo(relay *Relay) {
+	relay.NtorOnionKey = md.NtorOnionKey
+	if md.Ed25519ID != nil {
+		relay.IdentityKey = md.Ed25519ID
+	}
+	relay.Family = md.Family
+	relay.ExitPolicy = md.ExitPolicy
+}
+
+// EnableMicrodescriptors switches the client to the microdesc-flavored
+// consensus. Microdescriptors are fetched by digest and kept in cache, so
+// restarts only download the ones that changed.
+func (c *Client) EnableMicrodescriptors(cache *MicrodescCache) {
+	c.microdescCache = cache
+}
+
+// authorityBaseURL returns the scheme and host of an authority consensus URL
+func authorityBaseURL(authority string) (string, error) {
+	u, err := url.Parse(authority)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid authority URL: %s", authority)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// populateMicrodescriptors attaches microdescriptors to consensus relays,
+// downloading the ones missing from the cache in batches
+func (c *Client) populateMicrodescriptors(ctx context.Context, base string, consensus *Consensus) error {
+	var missing []string
+	for _, relay := range consensus.Relays {
+		if relay.MicrodescDigest == "" {
+			continue
+		}
+		if _, ok := c.microdescCache.Get(relay.MicrodescDigest); !ok {
+			missing = append(missing, relay.MicrodescDigest)
+		}
+	}
+
+	if len(missing) > 0 {
+		c.logger.Info("Fetching microdescriptors", "missing", len(missing), "cached", c.microdescCache.Len())
+		mds, err := c.FetchMicrodescriptors(ctx, base, missing)
+		if err != nil {
+			return err
+		}
+		c.microdescCache.Add(mds...)
+	}
+
+	attached := 0
+	for _, relay := range consensus.Relays {
+		if md, ok := c.microdescCache.Get(relay.MicrodescDigest); ok {
+			md.applyTo(relay)
+			attached++
+		}
+	}
+
+	// Drop microdescriptors no longer referenced by the consensus, then persist
+	c.microdescCache.Retain(consensus.Relays)
+	if err := c.microdescCache.Save(); err != nil {
+		c.logger.Warn("Failed to save microdescriptor cache", "error", err)
+	}
+
+	if attached < len(consensus.Relays) {
+		c.logger.Warn("Some relays have no microdescriptor",
+			"missing", len(consensus.Relays)-attached, "total", len(consensus.Relays))
+	}
+	return nil
+}
+
+// FetchMicrodescriptors downloads microdescriptors by digest from a directory
+// server, in batches of at most maxMicrodescsPerRequest. Documents whose digest
+// was not requested are discarded.
+func (c *Client) FetchMicrodescriptors(ctx context.Context, baseURL string, digests []string) ([]*Microdescriptor, error) {
+	batchSize := c.microdescBatchSize
+	if batchSize <= 0 {
+		batchSize = maxMicrodescsPerRequest
+	}
+
+	wanted := make(map[string]bool, len(digests))
+	for _, d := range digests {
+		wanted[d] = true
+	}
+
+	var result []*Microdescriptor
+	for start := 0; start < len(digests); start += batchSize {
+		end := start + batchSize
+		if end > len(digests) {
+			end = len(digests)
+		}
+
+		mds, err := c.fetchMicrodescBatch(ctx, baseURL, digests[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, md := range mds {
+			if !wanted[md.Digest] {
+				c.logger.Debug("Discarding unrequested microdescriptor", "digest", md.Digest)
+				continue
+			}
+			result = append(result, md)
+		}
+	}
+
+	return result, nil
+}
+
+// fetchMicrodescBatch fetches a single batch of microdescriptors
+func (c *Client) fetchMicrodescBatch(ctx context.Context, baseURL string, digests []string) ([]*Microdescriptor, error) {
+	body, err := c.fetchDocument(ctx, baseURL+microdescPathPrefix+strings.Join(digests, "-"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch microdescriptors: %w", err)
+	}
+	return ParseMicrodescriptors(body, c.logger), nil
+}
@@ -0,0 +1,153 @@
+// Package directory provides an on-disk microdescriptor cache.
+package directory
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+// microdescCacheFile is the cache file name inside the DataDirectory (as in C tor)
+const microdescCacheFile = "cached-microdescs"
+
+// MicrodescCache stores microdescriptors by digest and persists them to the
+// DataDirectory. The file holds the raw documents back to back, so digests are
+// recomputed (and therefore verified) when it is loaded.
+type MicrodescCache struct {
+	logger *logger.Logger
+	path   string
+	mu     sync.RWMutex
+	mds    map[string]*Microdescriptor
+	dirty  bool
+}
+
+// NewMicrodescCache creates a microdescriptor cache in dataDir, loading any
+// previously saved microdescriptors
+func NewMicrodescCache(dataDir string, log *logger.Logger) (*MicrodescCache, error) {
+	if log == nil {
+		log = logger.NewDefault()
+	}
+
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	cache := &MicrodescCache{
+		logger: log.Component("microdesc-cache"),
+		path:   filepath.Join(dataDir, microdescCacheFile),
+		mds:    make(map[string]*Microdescriptor),
+	}
+
+	if err := cache.load(); err != nil {
+		if !os.IsNotExist(err) {
+			// A corrupt cache is not fatal; it will be re-downloaded
+			cache.logger.Warn("Failed to load microdescriptor cache", "error", err)
+		}
+	}
+
+	return cache, nil
+}
+
+// load reads the cache file from disk
+func (mc *MicrodescCache) load() error {
+	data, err := os.ReadFile(mc.path)
+	if err != nil {
+		return err
+	}
+
+	mds := ParseMicrodescriptors(data, mc.logger)
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, md := range mds {
+		mc.mds[md.Digest] = md
+	}
+
+	mc.logger.Info("Loaded microdescriptor cache", "microdescriptors", len(mds))
+	return nil
+}
+
+// Get returns the microdescriptor with the given digest
+func (mc *MicrodescCache) Get(digest string) (*Microdescriptor, bool) {
+	if mc == nil {
+		return nil, false
+	}
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	md, ok := mc.mds[digest]
+	return md, ok
+}
+
+// Add stores microdescriptors in the cache
+func (mc *MicrodescCache) Add(mds ...*Microdescriptor) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, md := range mds {
+		if _, exists := mc.mds[md.Digest]; !exists {
+			mc.mds[md.Digest] = md
+			mc.dirty = true
+		}
+	}
+}
+
+// Retain drops microdescriptors not referenced by any of the relays
+func (mc *MicrodescCache) Retain(relays []*Relay) {
+	referenced := make(map[string]bool, len(relays))
+	for _, relay := range relays {
+		if relay.MicrodescDigest != "" {
+			referenced[relay.MicrodescDigest] = true
+		}
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for digest := range mc.mds {
+		if !referenced[digest] {
+			delete(mc.mds, digest)
+			mc.dirty = true
+		}
+	}
+}
+
+// Len returns the number of cached microdescriptors
+func (mc *MicrodescCache) Len() int {
+	if mc == nil {
+		return 0
+	}
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return len(mc.mds)
+}
+
+// Save writes the cache to disk if it has changed since the last save
+func (mc *MicrodescCache) Save() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if !mc.dirty {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, md := range mc.mds {
+		buf.Write(md.Raw)
+	}
+
+	// Write to temporary file first, then rename for atomic update
+	tmpFile := mc.path + ".tmp"
+	if err := os.WriteFile(tmpFile, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write microdescriptor cache: %w", err)
+	}
+
+	if err := os.Rename(tmpFile, mc.path); err != nil {
+		return fmt.Errorf("failed to rename microdescriptor cache file: %w", err)
+	}
+
+	mc.dirty = false
+	mc.logger.Debug("Saved microdescriptor cache", "microdescriptors", len(mc.mds))
+	return nil
+}
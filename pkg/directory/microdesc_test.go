@@ -0,0 +1,327 @@
+package directory
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testMicrodesc returns a microdescriptor document for relay i
+func testMicrodesc(i int) string {
+	ntorKey := bytes.Repeat([]byte{byte(i + 1)}, 32)
+	edKey := bytes.Repeat([]byte{byte(i + 101)}, 32)
+	return fmt.Sprintf("onion-key\nntor-onion-key %s\nfamily $%040X\np accept 80,443\nid ed25519 %s\n",
+		base64.StdEncoding.EncodeToString(ntorKey), i,
+		base64.RawStdEncoding.EncodeToString(edKey))
+}
+
+// microdescDigest returns the consensus "m" line digest of a microdescriptor
+func microdescDigest(doc string) string {
+	sum := sha256.Sum256([]byte(doc))
+	return base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// testMicrodescConsensus builds a microdesc-flavored consensus over docs
+func testMicrodescConsensus(docs []string) string {
+	var b strings.Builder
+	b.WriteString("network-status-version 3 microdesc\nvote-status consensus\n")
+	for i, doc := range docs {
+		id := base64.RawStdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i)}, 20))
+		fmt.Fprintf(&b, "r Relay%d %s 2024-01-01 00:00:00 10.%d.0.1 9001 0\n", i, id, i+1)
+		fmt.Fprintf(&b, "m %s\n", microdescDigest(doc))
+		b.WriteString("s Exit Fast Running Valid\nw Bandwidth=100\n")
+	}
+	b.WriteString("directory-footer\n")
+	return b.String()
+}
+
+// testDirServer serves a microdesc consensus and microdescriptors by digest
+type testDirServer struct {
+	*httptest.Server
+	mu              sync.Mutex
+	docs            map[string]string
+	consensus       string
+	auths           []*testAuthority
+	microdescFetch  int
+	requestedDigest []string
+}
+
+func newTestDirServer(t *testing.T, docs []string) *testDirServer {
+	t.Helper()
+
+	auths := testAuthorities(t, 3)
+	ds := &testDirServer{
+		docs:      make(map[string]string),
+		consensus: signTestConsensus(testMicrodescConsensus(docs), SignatureAlgSHA1, auths...),
+		auths:     auths,
+	}
+	for _, doc := range docs {
+		ds.docs[microdescDigest(doc)] = doc
+	}
+
+	ds.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == microdescConsensusPath:
+			fmt.Fprint(w, ds.consensus)
+		case strings.HasPrefix(r.URL.Path, authCertPathPrefix):
+			for _, auth := range ds.auths {
+				fmt.Fprint(w, auth.cert)
+			}
+		case strings.HasPrefix(r.URL.Path, microdescPathPrefix):
+			ds.mu.Lock()
+			ds.microdescFetch++
+			digests := strings.Split(strings.TrimPrefix(r.URL.Path, microdescPathPrefix), "-")
+			ds.requestedDigest = append(ds.requestedDigest, digests...)
+			ds.mu.Unlock()
+			for _, d := range digests {
+				fmt.Fprint(w, ds.docs[d])
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ds.Close)
+	return ds
+}
+
+func TestParseMicrodescriptors(t *testing.T) {
+	doc0 := testMicrodesc(0)
+	doc1 := "onion-key\n-----BEGIN RSA PUBLIC KEY-----\nAAAA\n-----END RSA PUBLIC KEY-----\n" +
+		"ntor-onion-key " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32)) + "\n" +
+		"p reject 25,119\np6 accept 80\n"
+
+	mds := ParseMicrodescriptors([]byte(doc0+doc1), nil)
+	if len(mds) != 2 {
+		t.Fatalf("ParseMicrodescriptors() returned %d, want 2", len(mds))
+	}
+
+	if mds[0].Digest != microdescDigest(doc0) {
+		t.Errorf("mds[0].Digest = %s, want %s", mds[0].Digest, microdescDigest(doc0))
+	}
+	if mds[1].Digest != microdescDigest(doc1) {
+		t.Errorf("mds[1].Digest = %s, want %s", mds[1].Digest, microdescDigest(doc1))
+	}
+	if !bytes.Equal(mds[0].NtorOnionKey, bytes.Repeat([]byte{1}, 32)) {
+		t.Error("mds[0].NtorOnionKey mismatch")
+	}
+	if !bytes.Equal(mds[0].Ed25519ID, bytes.Repeat([]byte{101}, 32)) {
+		t.Error("mds[0].Ed25519ID mismatch")
+	}
+	if len(mds[0].Family) != 1 || mds[0].Family[0] != fmt.Sprintf("$%040X", 0) {
+		t.Errorf("mds[0].Family = %v", mds[0].Family)
+	}
+	if !mds[0].ExitPolicy.AllowsPort(443) || mds[0].ExitPolicy.AllowsPort(22) {
+		t.Error("mds[0].ExitPolicy should accept only 80,443")
+	}
+	if mds[1].ExitPolicy.AllowsPort(25) || !mds[1].ExitPolicy.AllowsPort(80) {
+		t.Error("mds[1].ExitPolicy should reject 25 and accept 80")
+	}
+	if mds[1].ExitPolicy6 == nil || !mds[1].ExitPolicy6.Accept {
+		t.Error("mds[1].ExitPolicy6 should be parsed")
+	}
+
+	// ntor-onion-key is mandatory; a document without one is skipped and
+	// the rest of the batch kept
+	mds = ParseMicrodescriptors([]byte(doc0+"onion-key\np accept 80\n"+doc1), nil)
+	if len(mds) != 2 || mds[0].Digest != microdescDigest(doc0) || mds[1].Digest != microdescDigest(doc1) {
+		t.Errorf("ParseMicrodescriptors() with a malformed document returned %d, want the 2 valid ones", len(mds))
+	}
+}
+
+func TestParseExitPolicySummary(t *testing.T) {
+	tests := []struct {
+		input   string
+		port    int
+		allowed bool
+		wantErr bool
+	}{
+		{"accept 80,443", 80, true, false},
+		{"accept 80,443", 22, false, false},
+		{"accept 20-23,80", 21, true, false},
+		{"reject 1-65535", 80, false, false},
+		{"reject 25,119,135-139", 137, false, false},
+		{"reject 25,119,135-139", 443, true, false},
+		{"allow 80", 0, false, true},
+		{"accept 0", 0, false, true},
+		{"accept 90-80", 0, false, true},
+		{"accept", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		policy, err := ParseExitPolicySummary(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseExitPolicySummary(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if err == nil && policy.AllowsPort(tt.port) != tt.allowed {
+			t.Errorf("ParseExitPolicySummary(%q).AllowsPort(%d) = %v, want %v",
+				tt.input, tt.port, !tt.allowed, tt.allowed)
+		}
+	}
+}
+
+func TestParseMicrodescConsensus(t *testing.T) {
+	docs := []string{testMicrodesc(0), testMicrodesc(1)}
+	client := NewClient(nil)
+
+	consensus, err := client.ParseConsensus(strings.NewReader(testMicrodescConsensus(docs)))
+	if err != nil {
+		t.Fatalf("ParseConsensus() error = %v", err)
+	}
+
+	if consensus.Flavor != FlavorMicrodesc {
+		t.Errorf("Flavor = %s, want %s", consensus.Flavor, FlavorMicrodesc)
+	}
+	if len(consensus.Relays) != 2 {
+		t.Fatalf("parsed %d relays, want 2", len(consensus.Relays))
+	}
+
+	relay := consensus.Relays[1]
+	if relay.Address != "10.2.0.1" || relay.ORPort != 9001 || relay.DirPort != 0 {
+		t.Errorf("relay = %s:%d/%d, want 10.2.0.1:9001/0", relay.Address, relay.ORPort, relay.DirPort)
+	}
+	if relay.MicrodescDigest != microdescDigest(docs[1]) {
+		t.Errorf("MicrodescDigest = %s, want %s", relay.MicrodescDigest, microdescDigest(docs[1]))
+	}
+	if !relay.IsExit() || relay.Bandwidth != 100 {
+		t.Errorf("relay flags/bandwidth not parsed: %v %d", relay.Flags, relay.Bandwidth)
+	}
+}
+
+func TestFetchMicrodescConsensus(t *testing.T) {
+	docs := make([]string, 5)
+	for i := range docs {
+		docs[i] = testMicrodesc(i)
+	}
+	server := newTestDirServer(t, docs)
+	dataDir := t.TempDir()
+
+	cache, err := NewMicrodescCache(dataDir, nil)
+	if err != nil {
+		t.Fatalf("NewMicrodescCache() error = %v", err)
+	}
+
+	client := NewClient(nil)
+	client.authorities = []string{server.URL + "/tor/status-vote/current/consensus"}
+	client.trustedAuthorities = trustedSet(server.auths)
+	client.microdescBatchSize = 2
+	client.EnableMicrodescriptors(cache)
+
+	consensus, err := client.FetchConsensusDocument(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConsensusDocument() error = %v", err)
+	}
+
+	if consensus.Flavor != FlavorMicrodesc {
+		t.Errorf("Flavor = %s, want %s", consensus.Flavor, FlavorMicrodesc)
+	}
+	for i, relay := range consensus.Relays {
+		if !relay.HasValidKeys() {
+			t.Errorf("relay %d has no keys after microdescriptor fetch", i)
+		}
+		if !bytes.Equal(relay.NtorOnionKey, bytes.Repeat([]byte{byte(i + 1)}, 32)) {
+			t.Errorf("relay %d has wrong ntor key", i)
+		}
+		if len(relay.Family) != 1 || relay.ExitPolicy == nil {
+			t.Errorf("relay %d missing family or exit policy", i)
+		}
+	}
+
+	// 5 digests in batches of 2
+	if server.microdescFetch != 3 {
+		t.Errorf("microdescriptor requests = %d, want 3", server.microdescFetch)
+	}
+	if len(server.requestedDigest) != 5 {
+		t.Errorf("requested %d digests, want 5", len(server.requestedDigest))
+	}
+
+	if _, err := os.Stat(filepath.Join(dataDir, microdescCacheFile)); err != nil {
+		t.Fatalf("cache file not written: %v", err)
+	}
+
+	// A restarted client loads the cache and downloads nothing
+	reloaded, err := NewMicrodescCache(dataDir, nil)
+	if err != nil {
+		t.Fatalf("NewMicrodescCache() error = %v", err)
+	}
+	if reloaded.Len() != 5 {
+		t.Errorf("reloaded cache has %d entries, want 5", reloaded.Len())
+	}
+
+	restarted := NewClient(nil)
+	restarted.authorities = client.authorities
+	restarted.trustedAuthorities = client.trustedAuthorities
+	restarted.EnableMicrodescriptors(reloaded)
+
+	consensus, err = restarted.FetchConsensusDocument(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConsensusDocument() after restart error = %v", err)
+	}
+	if server.microdescFetch != 3 {
+		t.Errorf("microdescriptor requests after restart = %d, want 3 (all cached)", server.microdescFetch)
+	}
+	if !consensus.Relays[0].HasValidKeys() {
+		t.Error("relay keys not populated from cache")
+	}
+}
+
+func TestMicrodescCacheRetain(t *testing.T) {
+	dataDir := t.TempDir()
+	cache, err := NewMicrodescCache(dataDir, nil)
+	if err != nil {
+		t.Fatalf("NewMicrodescCache() error = %v", err)
+	}
+
+	mds := ParseMicrodescriptors([]byte(testMicrodesc(0)+testMicrodesc(1)), nil)
+	cache.Add(mds...)
+	if cache.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", cache.Len())
+	}
+
+	cache.Retain([]*Relay{{MicrodescDigest: mds[1].Digest}})
+	if _, ok := cache.Get(mds[0].Digest); ok {
+		t.Error("unreferenced microdescriptor should be dropped")
+	}
+	if _, ok := cache.Get(mds[1].Digest); !ok {
+		t.Error("referenced microdescriptor should be kept")
+	}
+
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	reloaded, err := NewMicrodescCache(dataDir, nil)
+	if err != nil {
+		t.Fatalf("NewMicrodescCache() error = %v", err)
+	}
+	if reloaded.Len() != 1 {
+		t.Errorf("reloaded Len() = %d, want 1", reloaded.Len())
+	}
+}
+
+func TestFetchMicrodescriptorsDiscardsUnrequested(t *testing.T) {
+	wanted := testMicrodesc(0)
+	extra := testMicrodesc(1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, wanted+extra)
+	}))
+	defer server.Close()
+
+	client := NewClient(nil)
+	mds, err := client.FetchMicrodescriptors(context.Background(), server.URL, []string{microdescDigest(wanted)})
+	if err != nil {
+		t.Fatalf("FetchMicrodescriptors() error = %v", err)
+	}
+	if len(mds) != 1 || mds[0].Digest != microdescDigest(wanted) {
+		t.Errorf("FetchMicrodescriptors() returned %d documents, want only the requested one", len(mds))
+	}
+}
@@ -0,0 +1,78 @@
+package directory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Subprotocol names and versions that affect how clients talk to a relay
+// (tor-spec.txt section 9)
+const (
+	ProtoRelay    = "Relay"
+	ProtoFlowCtrl = "FlowCtrl"
+
+	// ProtoRelayNtorV3 is the Relay version that supports the ntor v3 handshake
+	ProtoRelayNtorV3 = 4
+	// ProtoFlowCtrlCongestionControl is the FlowCtrl version that supports
+	// congestion control negotiation (prop324)
+	ProtoFlowCtrlCongestionControl = 2
+)
+
+// VersionRange is an inclusive range of subprotocol versions
+type VersionRange struct {
+	Low  int
+	High int
+}
+
+// Protocols maps subprotocol names to the versions a relay supports
+type Protocols map[string][]VersionRange
+
+// ParseProtocols parses the arguments of a "pr" line, for example
+// "Cons=1-2 Link=1-5 Relay=1-4" (dir-spec.txt section 3.4.1)
+func ParseProtocols(s string) (Protocols, error) {
+	protocols := make(Protocols)
+	for _, entry := range strings.Fields(s) {
+		name, versions, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid protocol entry: %s", entry)
+		}
+		if versions == "" {
+			protocols[name] = nil
+			continue
+		}
+
+		for _, item := range strings.Split(versions, ",") {
+			lowStr, highStr, isRange := strings.Cut(item, "-")
+			low, err := strconv.Atoi(lowStr)
+			if err != nil || low < 0 || low > 63 {
+				return nil, fmt.Errorf("invalid protocol version in %s: %s", name, item)
+			}
+			high := low
+			if isRange {
+				high, err = strconv.Atoi(highStr)
+				if err != nil || high < low || high > 63 {
+					return nil, fmt.Errorf("invalid protocol version range in %s: %s", name, item)
+				}
+			}
+			protocols[name] = append(protocols[name], VersionRange{Low: low, High: high})
+		}
+	}
+	return protocols, nil
+}
+
+// Supports reports whether version of the named subprotocol is listed
+func (p Protocols) Supports(name string, version int) bool {
+	for _, r := range p[name] {
+		if version >= r.Low && version <= r.High {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsProtocol reports whether the relay's "pr" line lists version of the
+// named subprotocol
+func (r *Relay) SupportsProtocol(name string, version int) bool {
+	return r.Protocols.Supports(name, version)
+}
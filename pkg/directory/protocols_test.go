@@ -0,0 +1,70 @@
+package directory
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProtocols(t *testing.T) {
+	protocols, err := ParseProtocols("Cons=1-2 Desc=1-2 FlowCtrl=1-2 Link=1-5 Padding= Relay=1-2,4")
+	if err != nil {
+		t.Fatalf("ParseProtocols() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		version int
+		want    bool
+	}{
+		{ProtoRelay, 1, true},
+		{ProtoRelay, 3, false},
+		{ProtoRelay, ProtoRelayNtorV3, true},
+		{ProtoFlowCtrl, 2, true},
+		{"Link", 5, true},
+		{"Link", 6, false},
+		{"Padding", 1, false},
+		{"HSDir", 2, false},
+	}
+	for _, tt := range tests {
+		if got := protocols.Supports(tt.name, tt.version); got != tt.want {
+			t.Errorf("Supports(%s, %d) = %v, want %v", tt.name, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseProtocolsInvalid(t *testing.T) {
+	for _, s := range []string{"Relay", "=1", "Relay=x", "Relay=3-1", "Relay=1-64"} {
+		if _, err := ParseProtocols(s); err == nil {
+			t.Errorf("ParseProtocols(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestParseConsensusProtocols(t *testing.T) {
+	consensusData := `network-status-version 3
+vote-status consensus
+r Test1 AAAAAAAAAAAAAAAAAAAAAA BBBBBBBBBBBBB 2024-01-01 00:00:00 192.168.1.1 9001 0
+s Fast Guard Running Stable Valid
+pr Cons=1-2 Link=1-5 Relay=1-4
+r Test2 CCCCCCCCCCCCCCCCCCCCCC DDDDDDDDDDDDD 2024-01-01 00:00:00 192.168.1.2 9002 9030
+s Exit Fast Running Stable Valid
+pr Cons=1-2 Link=1-5 Relay=1-2
+`
+
+	consensus, err := NewClient(nil).ParseConsensus(strings.NewReader(consensusData))
+	if err != nil {
+		t.Fatalf("ParseConsensus() error = %v", err)
+	}
+	if len(consensus.Relays) != 2 {
+		t.Fatalf("ParseConsensus() returned %d relays, want 2", len(consensus.Relays))
+	}
+	if !consensus.Relays[0].SupportsProtocol(ProtoRelay, ProtoRelayNtorV3) {
+		t.Error("relay[0] should support ntor v3")
+	}
+	if consensus.Relays[1].SupportsProtocol(ProtoRelay, ProtoRelayNtorV3) {
+		t.Error("relay[1] should not support ntor v3")
+	}
+	if (&Relay{}).SupportsProtocol(ProtoRelay, 1) {
+		t.Error("relay without a pr line should not support any protocol")
+	}
+}
@@ -0,0 +1,86 @@
+// Package directory provides consensus signature verification.
+package directory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Consensus signature digest algorithms (dir-spec.txt section 3.4.1)
+const (
+	SignatureAlgSHA1   = "sha1"
+	SignatureAlgSHA256 = "sha256"
+)
+
+// DirectorySignature is a "directory-signature" item from a consensus footer
+type DirectorySignature struct {
+	Algorithm        string // SignatureAlgSHA1 or SignatureAlgSHA256
+	Identity         string // Upper-case hex fingerprint of the authority identity key
+	SigningKeyDigest string // Upper-case hex digest of the authority signing key
+	Signature        []byte
+}
+
+// parseDirectorySignatureLine parses the keyword line of a directory-signature
+// item: "directory-signature [algorithm] identity signing-key-digest"
+func parseDirectorySignatureLine(line string) (*DirectorySignature, error) {
+	fields := strings.Fields(line)[1:]
+
+	sig := &DirectorySignature{Algorithm: SignatureAlgSHA1}
+	switch len(fields) {
+	case 2:
+	case 3:
+		sig.Algorithm = fields[0]
+		fields = fields[1:]
+	default:
+		return nil, fmt.Errorf("invalid directory-signature line: %q", line)
+	}
+
+	sig.Identity = strings.ToUpper(fields[0])
+	sig.SigningKeyDigest = strings.ToUpper(fields[1])
+	return sig, nil
+}
+
+// VerifySignatures checks the consensus signatures against the trusted
+// authorities and their key certificates. Each authority counts at most once,
+// and more than half of the trusted authorities must have signed the consensus
+// with an unexpired certificate. It returns the number of valid signatures.
+func (c *Consensus) VerifySignatures(trusted []TrustedAuthority, certs *AuthorityCertCache, now time.Time) (int, error) {
+	if len(trusted) == 0 {
+		return 0, fmt.Errorf("no trusted directory authorities configured")
+	}
+
+	trustedIDs := make(map[string]bool, len(trusted))
+	for _, auth := range trusted {
+		trustedIDs[strings.ToUpper(auth.V3Ident)] = true
+	}
+
+	signed := make(map[string]bool)
+	for _, sig := range c.Signatures {
+		if !trustedIDs[sig.Identity] || signed[sig.Identity] {
+			continue
+		}
+
+		digest, ok := c.signedDigests[sig.Algorithm]
+		if !ok {
+			continue // Unknown algorithm
+		}
+
+		cert, ok := certs.Get(sig.Identity, sig.SigningKeyDigest)
+		if !ok || cert.IsExpired(now) {
+			continue
+		}
+
+		if err := verifyRSASignature(cert.SigningKey, digest, sig.Signature); err != nil {
+			continue
+		}
+		signed[sig.Identity] = true
+	}
+
+	needed := len(trusted)/2 + 1
+	if len(signed) < needed {
+		return len(signed), fmt.Errorf("consensus has %d valid authority signatures, need %d of %d",
+			len(signed), needed, len(trusted))
+	}
+	return len(signed), nil
+}
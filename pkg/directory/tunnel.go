@@ -0,0 +1,39 @@
+// Package directory provides tunnelled directory requests over Tor circuits.
+package directory
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// DirStreamDialer opens a directory stream to a relay over a circuit
+// (RELAY_BEGIN_DIR, tor-spec.txt section 6.2). The stream is closed by the
+// caller once the HTTP response has been read.
+type DirStreamDialer func(ctx context.Context) (net.Conn, error)
+
+// NewTunnelTransport returns an http.RoundTripper that sends each directory
+// request over a new stream from dial. The host in the request URL is not
+// contacted: every stream ends at the directory service of the relay the
+// dialer chose, as with BEGIN_DIR in C tor.
+func NewTunnelTransport(dial DirStreamDialer) http.RoundTripper {
+	return &http.Transport{
+		Proxy: nil, // Never send directory requests to an HTTP proxy
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx)
+		},
+		// Relays answer one request per directory stream
+		DisableKeepAlives: true,
+	}
+}
+
+// SetTransport replaces the transport used for directory requests, e.g. with
+// NewTunnelTransport once circuits can be built. A nil transport restores
+// direct connections to the directory authorities.
+func (c *Client) SetTransport(rt http.RoundTripper) {
+	c.tunnelled = rt != nil
+	if rt == nil {
+		rt = newDirectTransport()
+	}
+	c.httpClient.Transport = rt
+}
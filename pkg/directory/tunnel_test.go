@@ -0,0 +1,94 @@
+package directory
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDirStreams is a DirStreamDialer whose streams are served in-process by
+// handler, standing in for RELAY_BEGIN_DIR streams to a relay
+type pipeDirStreams struct {
+	handler http.Handler
+	mu      sync.Mutex
+	dials   int
+}
+
+func (p *pipeDirStreams) dial(ctx context.Context) (net.Conn, error) {
+	p.mu.Lock()
+	p.dials++
+	p.mu.Unlock()
+
+	client, relay := net.Pipe()
+	go func() {
+		defer relay.Close()
+		req, err := http.ReadRequest(bufio.NewReader(relay))
+		if err != nil {
+			return
+		}
+		rec := httptest.NewRecorder()
+		p.handler.ServeHTTP(rec, req)
+		resp := rec.Result()
+		resp.Close = true
+		_ = resp.Write(relay)
+	}()
+	return client, nil
+}
+
+func (p *pipeDirStreams) dialCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dials
+}
+
+func TestFetchConsensusOverTunnel(t *testing.T) {
+	auths := testAuthorities(t, 3)
+	document := signTestConsensus(testLiveConsensusBody(time.Now().Add(-30*time.Minute)), SignatureAlgSHA1, auths...)
+	server := newTestCertServer(t, document, auths)
+	streams := &pipeDirStreams{handler: server.Config.Handler}
+
+	client := NewClient(nil)
+	// TEST-NET-1 address: the request must never leave the tunnel
+	client.authorities = []string{"http://192.0.2.1/tor/status-vote/current/consensus"}
+	client.trustedAuthorities = trustedSet(auths)
+	client.SetTransport(NewTunnelTransport(streams.dial))
+
+	consensus, err := client.FetchConsensusDocument(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConsensusDocument() error = %v", err)
+	}
+	if len(consensus.Relays) == 0 {
+		t.Error("Expected relays in the tunnelled consensus")
+	}
+
+	// One stream for the consensus and one for the missing certificates
+	if got := streams.dialCount(); got != 2 {
+		t.Errorf("directory streams opened = %d, want 2", got)
+	}
+	if server.certRequests != 1 {
+		t.Errorf("certificate requests = %d, want 1", server.certRequests)
+	}
+}
+
+func TestTunnelTransportDialError(t *testing.T) {
+	client := NewClient(nil)
+	client.authorities = []string{"http://192.0.2.1/tor/status-vote/current/consensus"}
+	client.SetTransport(NewTunnelTransport(func(ctx context.Context) (net.Conn, error) {
+		return nil, net.ErrClosed
+	}))
+
+	if _, err := client.FetchConsensusDocument(context.Background()); err == nil {
+		t.Error("Expected error when no directory stream can be opened")
+	}
+
+	// A nil transport restores direct connections
+	client.SetTransport(nil)
+	if _, ok := client.httpClient.Transport.(*http.Transport); !ok {
+		t.Errorf("Transport = %T, want *http.Transport", client.httpClient.Transport)
+	}
+}
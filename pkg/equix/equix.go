@@ -0,0 +1,203 @@
+package equix
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Equi-X finds eight HashX inputs whose outputs sum to zero modulo 2^60,
+// built up as a tree of pairs: each pair sums to zero modulo 2^15, each pair
+// of pairs modulo 2^30 (github.com/tevador/equix)
+const (
+	// SolutionSize is the length of an encoded solution
+	SolutionSize = 16
+
+	stage1Bits = 15
+	stage2Bits = 30
+	fullBits   = 60
+	stage1Mask = 1<<stage1Bits - 1
+	stage2Mask = 1<<stage2Bits - 1
+	fullMask   = 1<<fullBits - 1
+
+	numIndices = 1 << 16
+)
+
+// Verification errors
+var (
+	ErrOrder      = errors.New("equix: solution indices are not in tree order")
+	ErrPartialSum = errors.New("equix: partial sum is not zero")
+	ErrFinalSum   = errors.New("equix: final sum is not zero")
+)
+
+// Solution is an Equi-X solution: eight 16-bit HashX inputs
+type Solution [8]uint16
+
+// Bytes encodes the solution as eight little-endian 16-bit words
+func (s Solution) Bytes() []byte {
+	out := make([]byte, SolutionSize)
+	for i, idx := range s {
+		binary.LittleEndian.PutUint16(out[2*i:], idx)
+	}
+	return out
+}
+
+// ParseSolution decodes a solution encoded by Bytes
+func ParseSolution(data []byte) (Solution, error) {
+	var s Solution
+	if len(data) != SolutionSize {
+		return s, fmt.Errorf("invalid solution length: %d", len(data))
+	}
+	for i := range s {
+		s[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return s, nil
+}
+
+// Pairs and quads are ordered by reading their indices as one little-endian
+// integer, so the later index is the more significant
+func treeIdx2(idx []uint16) uint32 {
+	return uint32(idx[1])<<16 | uint32(idx[0])
+}
+
+func treeIdx4(idx []uint16) uint64 {
+	return uint64(treeIdx2(idx[2:4]))<<32 | uint64(treeIdx2(idx[0:2]))
+}
+
+// ordered reports whether the indices are in the canonical tree order, so
+// that each solution has only one encoding
+func (s *Solution) ordered() bool {
+	return treeIdx4(s[0:4]) <= treeIdx4(s[4:8]) &&
+		treeIdx2(s[0:2]) <= treeIdx2(s[2:4]) &&
+		treeIdx2(s[4:6]) <= treeIdx2(s[6:8]) &&
+		s[0] <= s[1] && s[2] <= s[3] && s[4] <= s[5] && s[6] <= s[7]
+}
+
+// Verify checks a solution for a challenge. It returns
+// ErrProgramGeneration if the challenge has no HashX program, in which case
+// no solution is valid.
+func Verify(challenge []byte, s Solution) error {
+	if !s.ordered() {
+		return ErrOrder
+	}
+	h, err := NewHashX(challenge)
+	if err != nil {
+		return err
+	}
+
+	var pairs [4]uint64
+	for i := range pairs {
+		pairs[i] = h.Hash(uint64(s[2*i])) + h.Hash(uint64(s[2*i+1]))
+		if pairs[i]&stage1Mask != 0 {
+			return ErrPartialSum
+		}
+	}
+	left, right := pairs[0]+pairs[1], pairs[2]+pairs[3]
+	if left&stage2Mask != 0 || right&stage2Mask != 0 {
+		return ErrPartialSum
+	}
+	if (left+right)&fullMask != 0 {
+		return ErrFinalSum
+	}
+	return nil
+}
+
+// Solve returns every solution for a challenge, ordered as the 128-bit
+// little-endian numbers they encode.
+// There are two on average. It returns ErrProgramGeneration if the
+// challenge has no HashX program.
+func Solve(challenge []byte) ([]Solution, error) {
+	h, err := NewHashX(challenge)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]uint64, numIndices)
+	for i := range hashes {
+		hashes[i] = h.Hash(uint64(i))
+	}
+
+	// Each stage pairs up the items of the previous one whose sums cancel
+	// in the next bits. Items are sorted by those bits so that each group
+	// of equal keys can be matched with its partner group.
+	type node struct {
+		sum uint64
+		idx []uint16
+	}
+	leaves := make([]node, numIndices)
+	for i, hash := range hashes {
+		leaves[i] = node{sum: hash, idx: []uint16{uint16(i)}}
+	}
+	combine := func(items []node, shift uint, bits uint) []node {
+		mask := uint64(1)<<bits - 1
+		key := func(item node) uint64 { return item.sum >> shift & mask }
+		sort.Slice(items, func(i, j int) bool { return key(items[i]) < key(items[j]) })
+		group := func(k uint64) []node {
+			start := sort.Search(len(items), func(i int) bool { return key(items[i]) >= k })
+			end := start
+			for end < len(items) && key(items[end]) == k {
+				end++
+			}
+			return items[start:end]
+		}
+
+		var out []node
+		for start := 0; start < len(items); {
+			k := key(items[start])
+			members := group(k)
+			start += len(members)
+			partner := -k & mask
+			if partner < k {
+				continue // Matched from the other side
+			}
+			partners := group(partner)
+			for ai, a := range members {
+				others := partners
+				if partner == k {
+					others = members[ai+1:]
+				}
+				for _, b := range others {
+					left, right := a, b
+					if !treeLess(left.idx, right.idx) {
+						left, right = right, left
+					}
+					idx := make([]uint16, 0, 2*len(left.idx))
+					idx = append(append(idx, left.idx...), right.idx...)
+					out = append(out, node{sum: left.sum + right.sum, idx: idx})
+				}
+			}
+		}
+		return out
+	}
+
+	pairs := combine(leaves, 0, stage1Bits)
+	quads := combine(pairs, stage1Bits, stage2Bits-stage1Bits)
+	octs := combine(quads, stage2Bits, fullBits-stage2Bits)
+
+	solutions := make([]Solution, 0, len(octs))
+	for _, oct := range octs {
+		var s Solution
+		copy(s[:], oct.idx)
+		solutions = append(solutions, s)
+	}
+	sort.Slice(solutions, func(i, j int) bool {
+		a, b := solutions[i][:], solutions[j][:]
+		if treeIdx4(a[4:]) != treeIdx4(b[4:]) {
+			return treeIdx4(a[4:]) < treeIdx4(b[4:])
+		}
+		return treeIdx4(a) < treeIdx4(b)
+	})
+	return solutions, nil
+}
+
+// treeLess reports whether subtree a comes no later than b in tree order
+func treeLess(a, b []uint16) bool {
+	switch len(a) {
+	case 1:
+		return a[0] <= b[0]
+	case 2:
+		return treeIdx2(a) <= treeIdx2(b)
+	default:
+		return treeIdx4(a) <= treeIdx4(b)
+	}
+}
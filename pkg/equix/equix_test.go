@@ -0,0 +1,249 @@
+package equix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestBlake2b512Salted(t *testing.T) {
+	// Without a salt the digest is plain BLAKE2b-512
+	for _, n := range []int{0, 1, 127, 128, 129, 256, 300} {
+		data := bytes.Repeat([]byte{0xA5}, n)
+		if got, want := blake2b512Salted(data, nil), blake2b.Sum512(data); got != want {
+			t.Errorf("BLAKE2b-512 of %d bytes = %x, want %x", n, got, want)
+		}
+	}
+
+	// The salt changes the digest
+	if blake2b512Salted([]byte("seed"), []byte(hashxSalt)) == blake2b512Salted([]byte("seed"), nil) {
+		t.Error("Salted digest equals the unsalted one")
+	}
+}
+
+func TestHashX(t *testing.T) {
+	h1, err := NewHashX([]byte("This is a test"))
+	if err != nil {
+		t.Fatalf("NewHashX() error = %v", err)
+	}
+	h2, err := NewHashX([]byte("This is a test"))
+	if err != nil {
+		t.Fatalf("NewHashX() error = %v", err)
+	}
+	other, err := NewHashX([]byte("Lorem ipsum dolor sit amet"))
+	if err != nil {
+		t.Fatalf("NewHashX() error = %v", err)
+	}
+
+	for _, input := range []uint64{0, 1, 123456, 987654321123456789} {
+		if h1.Hash(input) != h2.Hash(input) {
+			t.Errorf("Hash(%d) differs between functions with the same seed", input)
+		}
+		if h1.Hash(input) == other.Hash(input) {
+			t.Errorf("Hash(%d) is the same for different seeds", input)
+		}
+		sum := h1.Sum(input)
+		if got := binary.LittleEndian.Uint64(sum[:8]); got != h1.Hash(input) {
+			t.Errorf("Sum(%d) starts with %x, want Hash() = %x", input, got, h1.Hash(input))
+		}
+	}
+	if h1.Hash(0) == h1.Hash(1) {
+		t.Error("Hash(0) == Hash(1)")
+	}
+}
+
+// TestHashXVectors checks HashX against the known-answer tests in tor's
+// test_crypto.c, which print the first 8 bytes of output in hex
+func TestHashXVectors(t *testing.T) {
+	vectors := []struct {
+		seed  string
+		input uint64
+		want  string
+	}{
+		{"", 0, "466cc2021c268560"},
+		{"a", 0, "b2a110ee695c475c"},
+		{"ab", 0, "57c77f7e0d2c1727"},
+		{"abc", 0, "ef560991338086d1"},
+		{"", 999, "304068b62bc4874e"},
+		{"a", 999, "c8b66a8eb4bba304"},
+		{"ab", 999, "26c1f7031f0b3645"},
+		{"abc", 999, "de84f9d286b39ab5"},
+		{"abc", math.MaxUint64, "f756c266a3cb3b5a"},
+	}
+	for _, v := range vectors {
+		h, err := NewHashX([]byte(v.seed))
+		if err != nil {
+			t.Fatalf("NewHashX(%q) error = %v", v.seed, err)
+		}
+		got := hex.EncodeToString(binary.LittleEndian.AppendUint64(nil, h.Hash(v.input)))
+		if got != v.want {
+			t.Errorf("HashX(%q, %d) = %s, want %s", v.seed, v.input, got, v.want)
+		}
+	}
+}
+
+// TestEquiXVectors checks Solve and Verify against the Equi-X reference
+// tests
+func TestEquiXVectors(t *testing.T) {
+	vectors := []struct {
+		challenge string
+		want      []Solution
+	}{
+		{"zzz", []Solution{{0xae21, 0xd392, 0x3215, 0xdd9c, 0x2f08, 0x93df, 0x232c, 0xe5dc}}},
+		{"rrr", []Solution{{0x0873, 0x57a8, 0x73e0, 0x912e, 0x1ca8, 0xad96, 0x9abd, 0xd7de}}},
+		{"qqq", nil},
+		{"0123456789", nil},
+		{"", []Solution{
+			{0x0098, 0x3a4d, 0xc489, 0xcfba, 0x7ef3, 0xa498, 0xa00f, 0xec20},
+			{0x78d8, 0x8611, 0xa4df, 0xec19, 0x0927, 0xa729, 0x842f, 0xf771},
+			{0x54b5, 0xcc11, 0x1593, 0xe624, 0x9357, 0xb339, 0xb138, 0xed99},
+		}},
+		{"a", []Solution{
+			{0x4b38, 0x8c81, 0x9255, 0xad99, 0x5ce7, 0xeb3e, 0xc635, 0xee38},
+			{0x3f9e, 0x659b, 0x9ae6, 0xb891, 0x63ae, 0x777c, 0x06ca, 0xc593},
+			{0x2227, 0xa173, 0x365a, 0xb47d, 0x1bb2, 0xa077, 0x0d5e, 0xf25f},
+		}},
+	}
+	for _, v := range vectors {
+		solutions, err := Solve([]byte(v.challenge))
+		if err != nil {
+			t.Fatalf("Solve(%q) error = %v", v.challenge, err)
+		}
+		// The reference lists solutions in the order its solver finds them
+		if len(solutions) != len(v.want) {
+			t.Errorf("Solve(%q) found %d solutions, want %d", v.challenge, len(solutions), len(v.want))
+		}
+		for _, want := range v.want {
+			if !slices.Contains(solutions, want) {
+				t.Errorf("Solve(%q) did not find %04x", v.challenge, want)
+			}
+			if err := Verify([]byte(v.challenge), want); err != nil {
+				t.Errorf("Verify(%q, %04x) error = %v", v.challenge, want, err)
+			}
+		}
+	}
+}
+
+func TestGenerateProgram(t *testing.T) {
+	// Nearly all seeds give a program; the ones that do meet every
+	// requirement
+	failed := 0
+	for i := 0; i < 200; i++ {
+		h, err := NewHashX([]byte(fmt.Sprintf("seed %d", i)))
+		if errors.Is(err, ErrProgramGeneration) {
+			failed++
+			continue
+		}
+		if err != nil {
+			t.Fatalf("NewHashX() error = %v", err)
+		}
+		muls := 0
+		for _, instr := range h.program.code {
+			if instr.op <= opMul {
+				muls++
+			}
+		}
+		if len(h.program.code) != hashxProgramSize || muls != requiredMulCount {
+			t.Errorf("Seed %d: program has %d instructions and %d multiplications, want %d and %d",
+				i, len(h.program.code), muls, hashxProgramSize, requiredMulCount)
+		}
+	}
+	if failed > 2 {
+		t.Errorf("%d of 200 seeds gave no program", failed)
+	}
+}
+
+func TestSolveVerify(t *testing.T) {
+	found := 0
+	for i := 0; i < 4; i++ {
+		challenge := []byte(fmt.Sprintf("challenge %d", i))
+		solutions, err := Solve(challenge)
+		if err != nil {
+			t.Fatalf("Solve() error = %v", err)
+		}
+		for j, s := range solutions {
+			if err := Verify(challenge, s); err != nil {
+				t.Errorf("Verify(%q, %v) error = %v", challenge, s, err)
+			}
+			if err := Verify([]byte("another challenge"), s); err == nil {
+				t.Errorf("Solution %v verified for another challenge", s)
+			}
+			if j > 0 && !treeLess(solutions[j-1][4:], s[4:]) {
+				t.Errorf("Solutions %v and %v are out of order", solutions[j-1], s)
+			}
+		}
+		found += len(solutions)
+	}
+	// Two solutions per challenge on average
+	if found == 0 {
+		t.Fatal("No solutions found for any challenge")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	challenge := []byte("challenge 0")
+	solutions, err := Solve(challenge)
+	if err != nil {
+		t.Fatalf("Solve() error = %v", err)
+	}
+	if len(solutions) == 0 {
+		t.Skip("Challenge has no solutions")
+	}
+	s := solutions[0]
+
+	swapped := s
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	if swapped[0] == swapped[1] {
+		swapped[0]++
+	}
+	if err := Verify(challenge, swapped); !errors.Is(err, ErrOrder) && !errors.Is(err, ErrPartialSum) {
+		t.Errorf("Verify(swapped) error = %v, want ErrOrder", err)
+	}
+
+	changed := s
+	changed[7]++
+	if changed[7] == 0 {
+		changed[6], changed[7] = 0, 1
+	}
+	if err := Verify(challenge, changed); err == nil {
+		t.Error("Verify(changed) accepted a changed solution")
+	}
+
+	if err := Verify(challenge, Solution{}); !errors.Is(err, ErrPartialSum) {
+		t.Errorf("Verify(zero) error = %v, want ErrPartialSum", err)
+	}
+}
+
+func TestSolutionEncoding(t *testing.T) {
+	s := Solution{0x0102, 0x0304, 0x0506, 0x0708, 0x090a, 0x0b0c, 0x0d0e, 0xf00f}
+	encoded := s.Bytes()
+	want := []byte{2, 1, 4, 3, 6, 5, 8, 7, 0x0a, 9, 0x0c, 0x0b, 0x0e, 0x0d, 0x0f, 0xf0}
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("Bytes() = %x, want %x", encoded, want)
+	}
+	parsed, err := ParseSolution(encoded)
+	if err != nil {
+		t.Fatalf("ParseSolution() error = %v", err)
+	}
+	if parsed != s {
+		t.Errorf("ParseSolution() = %v, want %v", parsed, s)
+	}
+	if _, err := ParseSolution(encoded[:15]); err == nil {
+		t.Error("ParseSolution() accepted a short solution")
+	}
+}
+
+func BenchmarkSolve(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := Solve([]byte(fmt.Sprintf("challenge %d", i))); err != nil && !errors.Is(err, ErrProgramGeneration) {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Package equix implements the Equi-X client puzzle and the HashX hash
+// function it is built on, as used by the onion service proof-of-work
+// defence (proposal 327, hspow-spec/v1-equix.md).
+package equix
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// HashX parameters
+const (
+	hashxProgramSize = 512
+	hashxSalt        = "HashX v1"
+)
+
+// ErrProgramGeneration is returned for seeds whose HashX program does not
+// meet the generator's requirements. Callers pick another seed, as C Tor
+// does by moving to the next nonce.
+var ErrProgramGeneration = errors.New("hashx: seed does not yield a valid program")
+
+// siphashState is the internal state of SipHash, used as a key
+type siphashState struct {
+	v0, v1, v2, v3 uint64
+}
+
+// HashX is a hash function drawn at random, by its seed, from a large
+// family of functions (github.com/tevador/hashx)
+type HashX struct {
+	keys    siphashState
+	program *hashxProgram
+}
+
+// NewHashX returns the HashX function for a seed
+func NewHashX(seed []byte) (*HashX, error) {
+	digest := blake2b512Salted(seed, []byte(hashxSalt))
+	genKey := siphashStateFromBytes(digest[:32])
+	program, ok := generateProgram(&genKey)
+	if !ok {
+		return nil, ErrProgramGeneration
+	}
+	return &HashX{
+		keys:    siphashStateFromBytes(digest[32:]),
+		program: program,
+	}, nil
+}
+
+// Hash returns the 64-bit HashX output for an input, which is the first 8
+// bytes of the full output read as a little-endian integer
+func (h *HashX) Hash(input uint64) uint64 {
+	var r [8]uint64
+	h.registers(input, &r)
+	return r[0] ^ r[4]
+}
+
+// Sum returns the full 32-byte HashX output for an input
+func (h *HashX) Sum(input uint64) [32]byte {
+	var r [8]uint64
+	h.registers(input, &r)
+	var out [32]byte
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint64(out[8*i:], r[i]^r[i+4])
+	}
+	return out
+}
+
+// registers runs the program on the input and finalizes the registers
+func (h *HashX) registers(input uint64, r *[8]uint64) {
+	siphash24CtrState512(&h.keys, input, r)
+	h.program.execute(r)
+
+	// Remove the bias toward zero left by the multiplications
+	r[0] += h.keys.v0
+	r[1] += h.keys.v1
+	r[6] += h.keys.v2
+	r[7] += h.keys.v3
+	sipRound(&r[0], &r[1], &r[2], &r[3])
+	sipRound(&r[4], &r[5], &r[6], &r[7])
+}
+
+// siphashStateFromBytes loads a SipHash state from 32 little-endian bytes
+func siphashStateFromBytes(b []byte) siphashState {
+	return siphashState{
+		v0: binary.LittleEndian.Uint64(b[0:]),
+		v1: binary.LittleEndian.Uint64(b[8:]),
+		v2: binary.LittleEndian.Uint64(b[16:]),
+		v3: binary.LittleEndian.Uint64(b[24:]),
+	}
+}
+
+// sipRound is one SipRound on four state words
+func sipRound(v0, v1, v2, v3 *uint64) {
+	*v0 += *v1
+	*v2 += *v3
+	*v1 = bits.RotateLeft64(*v1, 13)
+	*v3 = bits.RotateLeft64(*v3, 16)
+	*v1 ^= *v0
+	*v3 ^= *v2
+	*v0 = bits.RotateLeft64(*v0, 32)
+	*v2 += *v1
+	*v0 += *v3
+	*v1 = bits.RotateLeft64(*v1, 17)
+	*v3 = bits.RotateLeft64(*v3, 21)
+	*v1 ^= *v2
+	*v3 ^= *v0
+	*v2 = bits.RotateLeft64(*v2, 32)
+}
+
+// siphash13Ctr is SipHash-1-3 of a single counter block, without the
+// length block. It feeds the program generator.
+func siphash13Ctr(input uint64, keys *siphashState) uint64 {
+	v0, v1, v2, v3 := keys.v0, keys.v1, keys.v2, keys.v3
+	v3 ^= input
+	sipRound(&v0, &v1, &v2, &v3)
+	v0 ^= input
+	v2 ^= 0xff
+	sipRound(&v0, &v1, &v2, &v3)
+	sipRound(&v0, &v1, &v2, &v3)
+	sipRound(&v0, &v1, &v2, &v3)
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// siphash24CtrState512 expands an input into the 8 initial registers with
+// SipHash-2-4 in its 128-bit output mode, keeping the whole state
+func siphash24CtrState512(keys *siphashState, input uint64, out *[8]uint64) {
+	v0, v1, v2, v3 := keys.v0, keys.v1, keys.v2, keys.v3
+	v1 ^= 0xee
+	v3 ^= input
+	sipRound(&v0, &v1, &v2, &v3)
+	sipRound(&v0, &v1, &v2, &v3)
+	v0 ^= input
+	v2 ^= 0xee
+	sipRound(&v0, &v1, &v2, &v3)
+	sipRound(&v0, &v1, &v2, &v3)
+	sipRound(&v0, &v1, &v2, &v3)
+	sipRound(&v0, &v1, &v2, &v3)
+
+	v4, v5, v6, v7 := v0, v1^0xdd, v2, v3
+	sipRound(&v4, &v5, &v6, &v7)
+	sipRound(&v4, &v5, &v6, &v7)
+	sipRound(&v4, &v5, &v6, &v7)
+	sipRound(&v4, &v5, &v6, &v7)
+
+	*out = [8]uint64{v0, v1, v2, v3, v4, v5, v6, v7}
+}
+
+// siphashRNG draws the generator's random choices from SipHash-1-3 in
+// counter mode. Bytes and words are taken from separate buffers, most
+// significant first.
+type siphashRNG struct {
+	keys     siphashState
+	counter  uint64
+	buffer8  uint64
+	buffer32 uint64
+	count8   uint
+	count32  uint
+}
+
+func (g *siphashRNG) u8() uint8 {
+	if g.count8 == 0 {
+		g.buffer8 = siphash13Ctr(g.counter, &g.keys)
+		g.counter++
+		g.count8 = 8
+	}
+	g.count8--
+	return uint8(g.buffer8 >> (g.count8 * 8))
+}
+
+func (g *siphashRNG) u32() uint32 {
+	if g.count32 == 0 {
+		g.buffer32 = siphash13Ctr(g.counter, &g.keys)
+		g.counter++
+		g.count32 = 2
+	}
+	g.count32--
+	return uint32(g.buffer32 >> (g.count32 * 32))
+}
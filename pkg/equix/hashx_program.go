@@ -0,0 +1,453 @@
+package equix
+
+import (
+	"math/bits"
+)
+
+// HashX programs are generated by simulating their execution on a
+// superscalar CPU, so that every program takes about the same time to run.
+// The choices below must match the reference generator exactly.
+
+// Instruction types. Several types share a group: the generator avoids
+// repeating a group on the same register.
+type hashxOp uint8
+
+const (
+	opUmulh hashxOp = iota
+	opSmulh
+	opMul
+	opSub
+	opXor
+	opAddShift
+	opRor
+	opAddConst
+	opXorConst
+	opTarget
+	opBranch
+	opNone hashxOp = 0xff // Register not yet written
+)
+
+// Generator limits
+const (
+	targetCycle               = 192
+	requiredMulCount          = 192
+	requiredLatency           = 195
+	registerNeedsDisplacement = 5 // r13 on x86, which lea cannot use as a base
+	portMapSize               = targetCycle + 4
+	maxRetries                = 1
+	branchMaskBits            = 4 // A branch is taken with probability 2^-4
+	noOpPar                   = ^uint32(0)
+)
+
+// Execution ports of the simulated CPU
+const (
+	portNone = 0
+	portP0   = 1
+	portP1   = 2
+	portP5   = 4
+	portP01  = portP0 | portP1
+	portP05  = portP0 | portP5
+	portP015 = portP0 | portP1 | portP5
+)
+
+// instrTemplate describes one instruction type to the generator
+type instrTemplate struct {
+	op          hashxOp
+	latency     int
+	uop1, uop2  uint8
+	immMask     uint32
+	group       hashxOp
+	immCanBe0   bool
+	distinctDst bool // dst must differ from src
+	opParSrc    bool // The operation parameter is the src register
+	hasSrc      bool
+	hasDst      bool
+}
+
+var (
+	tplUmulh    = &instrTemplate{op: opUmulh, latency: 4, uop1: portP1, uop2: portP5, group: opUmulh, hasSrc: true, hasDst: true}
+	tplSmulh    = &instrTemplate{op: opSmulh, latency: 4, uop1: portP1, uop2: portP5, group: opSmulh, hasSrc: true, hasDst: true}
+	tplMul      = &instrTemplate{op: opMul, latency: 3, uop1: portP1, group: opMul, distinctDst: true, opParSrc: true, hasSrc: true, hasDst: true}
+	tplSub      = &instrTemplate{op: opSub, latency: 1, uop1: portP015, group: opAddShift, distinctDst: true, opParSrc: true, hasSrc: true, hasDst: true}
+	tplXor      = &instrTemplate{op: opXor, latency: 1, uop1: portP015, group: opXor, distinctDst: true, opParSrc: true, hasSrc: true, hasDst: true}
+	tplAddShift = &instrTemplate{op: opAddShift, latency: 1, uop1: portP01, immMask: 3, group: opAddShift, immCanBe0: true, distinctDst: true, opParSrc: true, hasSrc: true, hasDst: true}
+	tplRor      = &instrTemplate{op: opRor, latency: 1, uop1: portP05, immMask: 63, group: opRor, distinctDst: true, hasDst: true}
+	tplAddConst = &instrTemplate{op: opAddConst, latency: 1, uop1: portP015, immMask: ^uint32(0), group: opAddConst, distinctDst: true, hasDst: true}
+	tplXorConst = &instrTemplate{op: opXorConst, latency: 1, uop1: portP015, immMask: ^uint32(0), group: opXorConst, distinctDst: true, hasDst: true}
+	tplTarget   = &instrTemplate{op: opTarget, latency: 1, uop1: portP015, uop2: portP015, group: opTarget, distinctDst: true}
+	tplBranch   = &instrTemplate{op: opBranch, latency: 1, uop1: portP015, uop2: portP015, immMask: 1 << 31, group: opBranch, distinctDst: true}
+)
+
+// programItem is a slot of the program layout and the templates it may
+// be filled with. Retries only pick templates within mask1.
+type programItem struct {
+	templates    []*instrTemplate
+	mask0, mask1 uint8
+	duplicates   bool
+}
+
+var (
+	itemMul     = &programItem{templates: []*instrTemplate{tplMul}, duplicates: true}
+	itemTarget  = &programItem{templates: []*instrTemplate{tplTarget}, duplicates: true}
+	itemBranch  = &programItem{templates: []*instrTemplate{tplBranch}, duplicates: true}
+	itemWideMul = &programItem{templates: []*instrTemplate{tplSmulh, tplUmulh}, mask0: 1, mask1: 1, duplicates: true}
+	itemAny     = &programItem{
+		templates: []*instrTemplate{tplRor, tplXorConst, tplAddConst, tplAddConst, tplSub, tplXor, tplXorConst, tplAddShift},
+		mask0:     7,
+		mask1:     3, // Templates without a src register
+	}
+)
+
+// programLayout is indexed by sub-cycle, three to a cycle
+var programLayout = [36]*programItem{
+	itemMul, itemTarget, itemAny,
+	itemMul, itemAny, itemAny,
+	itemMul, itemAny, itemAny,
+	itemMul, itemAny, itemAny,
+	itemWideMul, itemAny, itemAny,
+	itemMul, itemAny, itemAny,
+	itemMul, itemBranch, itemAny,
+	itemMul, itemAny, itemAny,
+	itemWideMul, itemAny, itemAny,
+	itemMul, itemAny, itemAny,
+	itemMul, itemAny, itemAny,
+	itemMul, itemAny, itemAny,
+}
+
+// hashxInstr is one program instruction
+type hashxInstr struct {
+	op    hashxOp
+	src   int
+	dst   int
+	imm   uint32
+	opPar uint32
+}
+
+// hashxProgram is a generated HashX program
+type hashxProgram struct {
+	code []hashxInstr
+}
+
+// registerInfo tracks a register during generation
+type registerInfo struct {
+	latency   int     // Cycle at which its value is ready
+	lastOp    hashxOp // Group of the last instruction writing it
+	lastOpPar uint32  // Parameter of that instruction
+}
+
+// generator is the state of the CPU simulation
+type generator struct {
+	cycle     int
+	subCycle  int
+	mulCount  int
+	chainMul  bool
+	latency   int
+	rng       siphashRNG
+	registers [8]registerInfo
+	ports     [portMapSize][3]uint8
+}
+
+// generateProgram generates the program for a generator key. It reports
+// false if the program does not meet the size, multiplication and latency
+// requirements.
+func generateProgram(key *siphashState) (*hashxProgram, bool) {
+	g := &generator{rng: siphashRNG{keys: *key}}
+	for i := range g.registers {
+		g.registers[i] = registerInfo{lastOp: opNone, lastOpPar: noOpPar}
+	}
+
+	program := &hashxProgram{code: make([]hashxInstr, 0, hashxProgramSize)}
+	attempt := 0
+	lastGroup := opNone
+	var instr hashxInstr
+	for len(program.code) < hashxProgramSize {
+		tpl := g.selectTemplate(lastGroup, attempt)
+		lastGroup = tpl.group
+		g.instrFromTemplate(tpl, &instr)
+
+		// The earliest cycle at which all of its uops can be scheduled
+		scheduleCycle := g.scheduleInstr(tpl, false)
+		if scheduleCycle < 0 {
+			break
+		}
+		g.chainMul = attempt > 0
+
+		// Operands must be ready by then; if not, retry with another
+		// template and then give up on this cycle
+		if tpl.hasSrc && !g.selectSource(tpl, &instr, scheduleCycle) {
+			if attempt < maxRetries {
+				attempt++
+				continue
+			}
+			g.stall()
+			attempt = 0
+			continue
+		}
+		if tpl.hasDst && !g.selectDestination(tpl, &instr, scheduleCycle) {
+			if attempt < maxRetries {
+				attempt++
+				continue
+			}
+			g.stall()
+			attempt = 0
+			continue
+		}
+		attempt = 0
+
+		scheduleCycle = g.scheduleInstr(tpl, true)
+		if scheduleCycle < 0 || scheduleCycle >= targetCycle {
+			break
+		}
+
+		if tpl.hasDst {
+			reg := &g.registers[instr.dst]
+			retireCycle := scheduleCycle + tpl.latency
+			reg.latency = retireCycle
+			reg.lastOp = tpl.group
+			reg.lastOpPar = instr.opPar
+			g.latency = max(g.latency, retireCycle)
+		}
+
+		program.code = append(program.code, instr)
+		if instr.op <= opMul {
+			g.mulCount++
+		}
+		g.subCycle++
+		if tpl.uop2 != portNone {
+			g.subCycle++
+		}
+		g.cycle = g.subCycle / 3
+	}
+
+	ok := len(program.code) == hashxProgramSize &&
+		g.mulCount == requiredMulCount &&
+		g.latency == requiredLatency-1 // Cycles are numbered from 0
+	return program, ok
+}
+
+// stall moves the simulation to the next cycle
+func (g *generator) stall() {
+	g.subCycle += 3
+	g.cycle = g.subCycle / 3
+}
+
+// selectTemplate picks the template for the current sub-cycle, never
+// repeating the last group in slots that do not allow it
+func (g *generator) selectTemplate(lastGroup hashxOp, attempt int) *instrTemplate {
+	item := programLayout[g.subCycle%len(programLayout)]
+	for {
+		index := 0
+		if item.mask0 != 0 {
+			mask := item.mask0
+			if attempt > 0 {
+				mask = item.mask1
+			}
+			index = int(g.rng.u8() & mask)
+		}
+		tpl := item.templates[index]
+		if item.duplicates || tpl.group != lastGroup {
+			return tpl
+		}
+	}
+}
+
+// instrFromTemplate draws the immediate and operation parameter of an
+// instruction
+func (g *generator) instrFromTemplate(tpl *instrTemplate, instr *hashxInstr) {
+	instr.op = tpl.op
+	switch {
+	case tpl.op == opBranch:
+		instr.imm = g.branchMask()
+	case tpl.immMask != 0 && tpl.immCanBe0:
+		instr.imm = g.rng.u32() & tpl.immMask
+	case tpl.immMask != 0:
+		for {
+			instr.imm = g.rng.u32() & tpl.immMask
+			if instr.imm != 0 {
+				break
+			}
+		}
+	}
+	if !tpl.opParSrc {
+		if tpl.distinctDst {
+			instr.opPar = noOpPar
+		} else {
+			instr.opPar = g.rng.u32()
+		}
+	}
+	if !tpl.hasSrc {
+		instr.src = -1
+	}
+	if !tpl.hasDst {
+		instr.dst = -1
+	}
+}
+
+// branchMask returns a 32-bit mask with branchMaskBits bits set
+func (g *generator) branchMask() uint32 {
+	var mask uint32
+	for bits.OnesCount32(mask) < branchMaskBits {
+		mask |= 1 << (g.rng.u8() % 32)
+	}
+	return mask
+}
+
+// scheduleUop finds the first cycle from cycle on with a free port for a
+// uop, trying P5, then P0, then P1 to keep P1 free for multiplications
+func (g *generator) scheduleUop(uop uint8, cycle int, commit bool) int {
+	for ; cycle < portMapSize; cycle++ {
+		for _, p := range [3]struct {
+			mask  uint8
+			index int
+		}{{portP5, 2}, {portP0, 0}, {portP1, 1}} {
+			if uop&p.mask != 0 && g.ports[cycle][p.index] == portNone {
+				if commit {
+					g.ports[cycle][p.index] = uop
+				}
+				return cycle
+			}
+		}
+	}
+	return -1
+}
+
+// scheduleInstr returns the cycle an instruction can be scheduled at.
+// Instructions with two uops need both to run in the same cycle.
+func (g *generator) scheduleInstr(tpl *instrTemplate, commit bool) int {
+	if tpl.uop2 == portNone {
+		return g.scheduleUop(tpl.uop1, g.cycle, commit)
+	}
+	for cycle := g.cycle; cycle < portMapSize; cycle++ {
+		cycle1 := g.scheduleUop(tpl.uop1, cycle, false)
+		cycle2 := g.scheduleUop(tpl.uop2, cycle, false)
+		if cycle1 >= 0 && cycle1 == cycle2 {
+			if commit {
+				g.scheduleUop(tpl.uop1, cycle, true)
+				g.scheduleUop(tpl.uop2, cycle, true)
+			}
+			return cycle1
+		}
+	}
+	return -1
+}
+
+// selectRegister picks one of the candidate registers
+func (g *generator) selectRegister(candidates []int) (int, bool) {
+	switch len(candidates) {
+	case 0:
+		return 0, false
+	case 1:
+		return candidates[0], true
+	default:
+		return candidates[g.rng.u32()%uint32(len(candidates))], true
+	}
+}
+
+// selectSource picks a src register whose value is ready at cycle
+func (g *generator) selectSource(tpl *instrTemplate, instr *hashxInstr, cycle int) bool {
+	candidates := make([]int, 0, 8)
+	for i, reg := range g.registers {
+		if reg.latency <= cycle {
+			candidates = append(candidates, i)
+		}
+	}
+	// lea cannot add to r5, so with only two choices it must be the source
+	if len(candidates) == 2 && instr.op == opAddShift &&
+		(candidates[0] == registerNeedsDisplacement || candidates[1] == registerNeedsDisplacement) {
+		instr.src = registerNeedsDisplacement
+		instr.opPar = registerNeedsDisplacement
+		return true
+	}
+	src, ok := g.selectRegister(candidates)
+	if !ok {
+		return false
+	}
+	instr.src = src
+	if tpl.opParSrc {
+		instr.opPar = uint32(src)
+	}
+	return true
+}
+
+// selectDestination picks a dst register that is ready at cycle and would
+// not make the instruction trivially optimizable
+func (g *generator) selectDestination(tpl *instrTemplate, instr *hashxInstr, cycle int) bool {
+	candidates := make([]int, 0, 8)
+	for i, reg := range g.registers {
+		if reg.latency > cycle {
+			continue
+		}
+		if tpl.distinctDst && i == instr.src {
+			continue
+		}
+		// Repeated multiplication of a register accumulates trailing zeroes
+		if !g.chainMul && tpl.group == opMul && reg.lastOp == opMul {
+			continue
+		}
+		// Sequences such as "xor r1, r2; xor r1, r2" cancel out
+		if reg.lastOp == tpl.group && reg.lastOpPar == instr.opPar {
+			continue
+		}
+		if instr.op == opAddShift && i == registerNeedsDisplacement {
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	dst, ok := g.selectRegister(candidates)
+	if ok {
+		instr.dst = dst
+	}
+	return ok
+}
+
+// execute runs the program on the registers. A branch is taken at most
+// once, back to the instruction after the last target.
+func (p *hashxProgram) execute(r *[8]uint64) {
+	target := 0
+	branchEnable := true
+	var result uint32
+	for i := 0; i < len(p.code); i++ {
+		instr := &p.code[i]
+		switch instr.op {
+		case opUmulh:
+			r[instr.dst], _ = bits.Mul64(r[instr.dst], r[instr.src])
+			result = uint32(r[instr.dst])
+		case opSmulh:
+			r[instr.dst] = smulh(r[instr.dst], r[instr.src])
+			result = uint32(r[instr.dst])
+		case opMul:
+			r[instr.dst] *= r[instr.src]
+		case opSub:
+			r[instr.dst] -= r[instr.src]
+		case opXor:
+			r[instr.dst] ^= r[instr.src]
+		case opAddShift:
+			r[instr.dst] += r[instr.src] << instr.imm
+		case opRor:
+			r[instr.dst] = bits.RotateLeft64(r[instr.dst], -int(instr.imm))
+		case opAddConst:
+			r[instr.dst] += uint64(int64(int32(instr.imm)))
+		case opXorConst:
+			r[instr.dst] ^= uint64(int64(int32(instr.imm)))
+		case opTarget:
+			target = i
+		case opBranch:
+			if branchEnable && result&instr.imm == 0 {
+				i = target
+				branchEnable = false
+			}
+		}
+	}
+}
+
+// smulh returns the high 64 bits of the signed 128-bit product
+func smulh(a, b uint64) uint64 {
+	hi, _ := bits.Mul64(a, b)
+	if int64(a) < 0 {
+		hi -= b
+	}
+	if int64(b) < 0 {
+		hi -= a
+	}
+	return hi
+}
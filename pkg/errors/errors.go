@@ -175,6 +175,25 @@ func InternalError(message string, err error) *TorError {
 	return Wrap(CategoryInternal, SeverityHigh, message, err)
 }
 
+// UnsupportedHandshakeError reports a circuit handshake type that the client
+// refuses to negotiate, such as the obsolete TAP handshake. It is returned
+// wrapped in a protocol TorError by UnsupportedHandshake.
+type UnsupportedHandshakeError struct {
+	HandshakeType uint16
+	Reason        string
+}
+
+// Error implements the error interface
+func (e *UnsupportedHandshakeError) Error() string {
+	return fmt.Sprintf("unsupported circuit handshake type 0x%04x: %s", e.HandshakeType, e.Reason)
+}
+
+// UnsupportedHandshake creates a protocol error for a circuit handshake type
+// that the client refuses to negotiate
+func UnsupportedHandshake(handshakeType uint16, reason string) *TorError {
+	return ProtocolError("unsupported circuit handshake", &UnsupportedHandshakeError{HandshakeType: handshakeType, Reason: reason})
+}
+
 // IsRetryable checks if an error is retryable
 func IsRetryable(err error) bool {
 	var torErr *TorError
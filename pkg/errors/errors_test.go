@@ -313,3 +313,24 @@ func TestAllErrorConstructors(t *testing.T) {
 		})
 	}
 }
+
+func TestUnsupportedHandshakeError(t *testing.T) {
+	var err error = fmt.Errorf("create: %w", UnsupportedHandshake(0, "TAP is obsolete"))
+	if !IsCategory(err, CategoryProtocol) {
+		t.Error("UnsupportedHandshake() is not a protocol error")
+	}
+	if IsRetryable(err) {
+		t.Error("UnsupportedHandshake() is retryable")
+	}
+
+	var handshakeErr *UnsupportedHandshakeError
+	if !errors.As(err, &handshakeErr) {
+		t.Fatal("errors.As() did not find UnsupportedHandshakeError")
+	}
+	if handshakeErr.HandshakeType != 0 {
+		t.Errorf("HandshakeType = %d, want 0", handshakeErr.HandshakeType)
+	}
+	if got := handshakeErr.Error(); got != "unsupported circuit handshake type 0x0000: TAP is obsolete" {
+		t.Errorf("Error() = %q", got)
+	}
+}
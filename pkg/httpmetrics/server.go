@@ -167,6 +167,15 @@ func (s *Server) handlePrometheusMetrics(w http.ResponseWriter, r *http.Request)
 	fmt.Fprintf(w, "# TYPE tor_active_circuits gauge\n")
 	fmt.Fprintf(w, "tor_active_circuits %d\n", snapshot.ActiveCircuits)
 
+	// Congestion control metrics
+	fmt.Fprintf(w, "# HELP tor_circuit_congestion_window_cells Congestion window of the most recently updated circuit\n")
+	fmt.Fprintf(w, "# TYPE tor_circuit_congestion_window_cells gauge\n")
+	fmt.Fprintf(w, "tor_circuit_congestion_window_cells %d\n", snapshot.CongestionWindow)
+
+	fmt.Fprintf(w, "# HELP tor_circuit_rtt_seconds Smoothed RTT of the most recently updated circuit in seconds\n")
+	fmt.Fprintf(w, "# TYPE tor_circuit_rtt_seconds gauge\n")
+	fmt.Fprintf(w, "tor_circuit_rtt_seconds %.3f\n", float64(snapshot.CircuitRTTMillis)/1000)
+
 	// Connection metrics
 	fmt.Fprintf(w, "# HELP tor_connection_attempts_total Total number of connection attempts\n")
 	fmt.Fprintf(w, "# TYPE tor_connection_attempts_total counter\n")
@@ -164,6 +164,8 @@ func TestPrometheusMetricsEndpoint(t *testing.T) {
 		"tor_active_circuits",
 		"tor_connection_attempts_total",
 		"tor_active_streams",
+		"tor_circuit_congestion_window_cells",
+		"tor_circuit_rtt_seconds",
 		"tor_uptime_seconds",
 	}
 
@@ -54,6 +54,10 @@ type Metrics struct {
 	ReplayBackwardAttempts *Counter // Replay attempts in backward direction
 	OutOfOrderCells        *Counter // Cells received out of order (not replays)
 
+	// Congestion control metrics (prop324)
+	CongestionWindow *Gauge // Congestion window of the last updated circuit, in cells
+	CircuitRTT       *Gauge // Smoothed circuit RTT of the last updated circuit, in milliseconds
+
 	// System metrics
 	Uptime      *Gauge
 	startTime   time.Time
@@ -107,6 +111,10 @@ func New() *Metrics {
 		ReplayBackwardAttempts: NewCounter(),
 		OutOfOrderCells:        NewCounter(),
 
+		// Congestion control metrics (prop324)
+		CongestionWindow: NewGauge(),
+		CircuitRTT:       NewGauge(),
+
 		// System metrics
 		Uptime:    NewGauge(),
 		startTime: now,
@@ -156,6 +164,13 @@ func (m *Metrics) RecordOutOfOrderCell() {
 	m.OutOfOrderCells.Inc()
 }
 
+// RecordCongestion records a circuit's congestion window and smoothed RTT
+// after a congestion control update
+func (m *Metrics) RecordCongestion(cwnd int, rtt time.Duration) {
+	m.CongestionWindow.Set(int64(cwnd))
+	m.CircuitRTT.Set(rtt.Milliseconds())
+}
+
 // UpdateUptime updates the uptime metric
 func (m *Metrics) UpdateUptime() {
 	m.startTimeMu.RLock()
@@ -212,6 +227,10 @@ func (m *Metrics) Snapshot() *Snapshot {
 		ReplayBackwardAttempts: m.ReplayBackwardAttempts.Value(),
 		OutOfOrderCells:        m.OutOfOrderCells.Value(),
 
+		// Congestion control metrics (prop324)
+		CongestionWindow: m.CongestionWindow.Value(),
+		CircuitRTTMillis: m.CircuitRTT.Value(),
+
 		// System metrics
 		UptimeSeconds: m.Uptime.Value(),
 	}
@@ -264,6 +283,10 @@ type Snapshot struct {
 	ReplayBackwardAttempts int64 // Replay attempts in backward direction
 	OutOfOrderCells        int64 // Cells received out of order
 
+	// Congestion control metrics (prop324)
+	CongestionWindow int64 // cells
+	CircuitRTTMillis int64 // milliseconds
+
 	// System metrics
 	UptimeSeconds int64
 }
@@ -270,6 +270,24 @@ func TestRecordTLSHandshake(t *testing.T) {
 	}
 }
 
+func TestRecordCongestion(t *testing.T) {
+	m := New()
+
+	m.RecordCongestion(248, 150*time.Millisecond)
+
+	if m.CongestionWindow.Value() != 248 {
+		t.Errorf("congestion window = %d, want 248", m.CongestionWindow.Value())
+	}
+	if m.CircuitRTT.Value() != 150 {
+		t.Errorf("circuit RTT = %d ms, want 150", m.CircuitRTT.Value())
+	}
+
+	snap := m.Snapshot()
+	if snap.CongestionWindow != 248 || snap.CircuitRTTMillis != 150 {
+		t.Errorf("snapshot congestion = %d cells, %d ms", snap.CongestionWindow, snap.CircuitRTTMillis)
+	}
+}
+
 func TestUpdateUptime(t *testing.T) {
 	m := New()
 
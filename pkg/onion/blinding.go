@@ -0,0 +1,157 @@
+// Package onion - Key blinding
+// This file implements the v3 key blinding scheme (rend-spec-v3.txt
+// appendix A.2): each time period the service signs its descriptor with a
+// blinded key that clients derive from the onion address alone.
+package onion
+
+import (
+	"crypto/ed25519"
+	"crypto/sha3"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+
+	"filippo.io/edwards25519"
+)
+
+const (
+	// blindString is "Derive temporary signing key" with its NUL terminator
+	blindString = "Derive temporary signing key\x00"
+
+	// blindPrefixString derives the nonce prefix of a blinded private key
+	blindPrefixString = "Derive temporary signing key hash input"
+
+	// ed25519BasepointString is B in the blinding factor
+	ed25519BasepointString = "(15112221349535400772501151409588531511454012693041857206046113283949847762202, " +
+		"46316835694926478169428394003475163141307993866256225615783033603165251855960)"
+)
+
+// blindingFactor computes the unclamped blinding factor
+//
+//	h = SHA3_256(BLIND_STRING | A | s | B | N)
+//	N = "key-blind" | INT_8(period-number) | INT_8(period_length)
+//
+// with no secret s
+func blindingFactor(pubkey []byte, periodNum, periodLength uint64) []byte {
+	h := sha3.New256()
+	h.Write([]byte(blindString))
+	h.Write(pubkey)
+	h.Write([]byte(ed25519BasepointString))
+	h.Write([]byte("key-blind"))
+	h.Write(binary.BigEndian.AppendUint64(nil, periodNum))
+	h.Write(binary.BigEndian.AppendUint64(nil, periodLength))
+	return h.Sum(nil)
+}
+
+// blindPublicKey returns A' = h * A for a blinding factor h
+func blindPublicKey(pubkey, factor []byte) ([]byte, error) {
+	point, err := new(edwards25519.Point).SetBytes(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ed25519 public key: %w", err)
+	}
+	scalar, err := new(edwards25519.Scalar).SetBytesWithClamping(factor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blinding factor: %w", err)
+	}
+	return new(edwards25519.Point).ScalarMult(scalar, point).Bytes(), nil
+}
+
+// blindExpandedKey blinds an expanded private key (scalar | prefix):
+//
+//	a' = h * a mod l
+//	prefix' = SHA512("Derive temporary signing key hash input" | prefix)[:32]
+func blindExpandedKey(expanded, factor []byte) ([]byte, error) {
+	if len(expanded) != 64 {
+		return nil, fmt.Errorf("invalid expanded key length: %d", len(expanded))
+	}
+	a, err := new(edwards25519.Scalar).SetBytesWithClamping(expanded[:32])
+	if err != nil {
+		return nil, fmt.Errorf("invalid private scalar: %w", err)
+	}
+	h, err := new(edwards25519.Scalar).SetBytesWithClamping(factor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blinding factor: %w", err)
+	}
+
+	prefix := sha512.New()
+	prefix.Write([]byte(blindPrefixString))
+	prefix.Write(expanded[32:])
+
+	out := new(edwards25519.Scalar).Multiply(h, a).Bytes()
+	return append(out, prefix.Sum(nil)[:32]...), nil
+}
+
+// expandPrivateKey returns the expanded form (scalar | prefix) of an
+// ed25519 private key
+func expandPrivateKey(key ed25519.PrivateKey) []byte {
+	digest := sha512.Sum512(key.Seed())
+	digest[0] &= 248
+	digest[31] &= 63
+	digest[31] |= 64
+	return digest[:]
+}
+
+// signExpanded makes an ed25519 signature with a blinded expanded private
+// key, whose scalar is already reduced and must not be clamped again
+func signExpanded(expanded, pubkey, message []byte) ([]byte, error) {
+	if len(expanded) != 64 {
+		return nil, fmt.Errorf("invalid expanded key length: %d", len(expanded))
+	}
+	a, err := new(edwards25519.Scalar).SetCanonicalBytes(expanded[:32])
+	if err != nil {
+		return nil, fmt.Errorf("invalid private scalar: %w", err)
+	}
+
+	nonce := sha512.New()
+	nonce.Write(expanded[32:64])
+	nonce.Write(message)
+	r, err := new(edwards25519.Scalar).SetUniformBytes(nonce.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	challenge := sha512.New()
+	challenge.Write(R)
+	challenge.Write(pubkey)
+	challenge.Write(message)
+	k, err := new(edwards25519.Scalar).SetUniformBytes(challenge.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	S := new(edwards25519.Scalar).MultiplyAdd(k, a, r)
+	return append(R, S.Bytes()...), nil
+}
+
+// blindedIdentity is a service identity blinded for one time period
+type blindedIdentity struct {
+	public   []byte // Blinded public key, which names the descriptor on HSDirs
+	expanded []byte // Blinded expanded private key, which certifies the descriptor signing key
+}
+
+// sign signs message with the blinded key
+func (b *blindedIdentity) sign(message []byte) ([]byte, error) {
+	return signExpanded(b.expanded, b.public, message)
+}
+
+// blindIdentity blinds a service identity key for a time period
+func blindIdentity(identity ed25519.PrivateKey, periodNum, periodLength uint64) (*blindedIdentity, error) {
+	return blindExpandedIdentity(expandPrivateKey(identity), identity.Public().(ed25519.PublicKey), periodNum, periodLength)
+}
+
+// blindExpandedIdentity blinds a service identity given as an expanded
+// private key, the form C-tor stores in hs_ed25519_secret_key
+func blindExpandedIdentity(expanded, pubkey []byte, periodNum, periodLength uint64) (*blindedIdentity, error) {
+	factor := blindingFactor(pubkey, periodNum, periodLength)
+
+	public, err := blindPublicKey(pubkey, factor)
+	if err != nil {
+		return nil, err
+	}
+	blindedExpanded, err := blindExpandedKey(expanded, factor)
+	if err != nil {
+		return nil, err
+	}
+	return &blindedIdentity{public: public, expanded: blindedExpanded}, nil
+}
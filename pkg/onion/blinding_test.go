@@ -0,0 +1,82 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+// TestBlindPublicKeyVector checks blinding against the reference
+// implementation's test vector (tor's ed25519_exts_ref.py)
+func TestBlindPublicKeyVector(t *testing.T) {
+	seed, _ := hex.DecodeString("26c76712d89d906e6672dafa614c42e5cb1caac8c6568e4d2493087db51f0d36")
+	param, _ := hex.DecodeString("54a513898b471d1d448a2f3c55c1de2c0ef718c447b04497eeb999ed32027823")
+	wantPub, _ := hex.DecodeString("c2247870536a192d142d056abefca68d6193158e7c1a59c1654c954eccaff894")
+	wantBlinded, _ := hex.DecodeString("1fc1fa4465bd9d4956fdbdc9d3acb3c7019bb8d5606b951c2e1dfe0b42eaeb41")
+
+	identity := ed25519.NewKeyFromSeed(seed)
+	pubkey := identity.Public().(ed25519.PublicKey)
+	if !bytes.Equal(pubkey, wantPub) {
+		t.Fatalf("Public key %x, want %x", pubkey, wantPub)
+	}
+
+	blinded, err := blindPublicKey(pubkey, param)
+	if err != nil {
+		t.Fatalf("Failed to blind public key: %v", err)
+	}
+	if !bytes.Equal(blinded, wantBlinded) {
+		t.Errorf("Blinded public key %x, want %x", blinded, wantBlinded)
+	}
+
+	// The blinded private key matches the blinded public key
+	expanded, err := blindExpandedKey(expandPrivateKey(identity), param)
+	if err != nil {
+		t.Fatalf("Failed to blind private key: %v", err)
+	}
+	message := []byte("Tor onion service descriptor sig v3")
+	sig, err := signExpanded(expanded, blinded, message)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if !ed25519.Verify(blinded, message, sig) {
+		t.Error("Signature by blinded private key does not verify with blinded public key")
+	}
+}
+
+func TestBlindIdentity(t *testing.T) {
+	pubkey, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	blinded, err := blindIdentity(identity, 16903, defaultPeriodLength)
+	if err != nil {
+		t.Fatalf("Failed to blind identity: %v", err)
+	}
+
+	// Clients derive the same blinded key from the public key alone
+	public, err := ComputeBlindedPubkey(pubkey, 16903, defaultPeriodLength)
+	if err != nil {
+		t.Fatalf("Failed to blind public key: %v", err)
+	}
+	if !bytes.Equal(blinded.public, public) {
+		t.Errorf("Blinded identity %x, client derived %x", blinded.public, public)
+	}
+	if bytes.Equal(public, pubkey) {
+		t.Error("Blinded key equals the identity key")
+	}
+
+	message := []byte("certificate body")
+	sig, err := blinded.sign(message)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if !ed25519.Verify(public, message, sig) {
+		t.Error("Blinded signature does not verify")
+	}
+	if ed25519.Verify(pubkey, message, sig) {
+		t.Error("Blinded signature verifies with the identity key")
+	}
+}
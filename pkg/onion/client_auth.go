@@ -0,0 +1,250 @@
+// Package onion - Client authorization
+// This file implements restricted discovery (rend-spec-v3.txt section
+// 2.5.1.2): the service encrypts its introduction points with a descriptor
+// cookie that only clients holding an authorized x25519 key can recover.
+package onion
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha3"
+	"crypto/subtle"
+	"encoding/base32"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opd-ai/go-tor/pkg/logger"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	descriptorCookieLen = 32
+	authClientIDLen     = 8
+	authClientIVLen     = 16
+	authCookieKeyLen    = 32
+
+	// clientAuthFileSuffix marks key files in ClientOnionAuthDir
+	clientAuthFileSuffix = ".auth_private"
+)
+
+// clientAuthEncoding is the base32 form of x25519 keys in key files
+var clientAuthEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// authClient is one auth-client line of the superencrypted layer
+type authClient struct {
+	id     []byte // CLIENT-ID (8 bytes)
+	iv     []byte // 16 bytes
+	cookie []byte // Encrypted descriptor cookie (32 bytes)
+}
+
+// clientAuthKeys derives the client ID and cookie key a client shares with
+// the service:
+//
+//	SECRET_SEED = x25519(hs_y, client_X) = x25519(client_y, hs_Y)
+//	KEYS = KDF(N_hs_subcred | SECRET_SEED, 40)
+func clientAuthKeys(private, public, subcredential []byte) (clientID, cookieKey []byte, err error) {
+	secretSeed, err := curve25519.X25519(private, public)
+	if err != nil {
+		return nil, nil, fmt.Errorf("x25519 failed: %w", err)
+	}
+
+	h := sha3.NewSHAKE256()
+	h.Write(subcredential)
+	h.Write(secretSeed)
+	keys := make([]byte, authClientIDLen+authCookieKeyLen)
+	h.Read(keys)
+	return keys[:authClientIDLen], keys[authClientIDLen:], nil
+}
+
+// xorCookie encrypts or decrypts a descriptor cookie with AES-256-CTR
+func xorCookie(cookieKey, iv, in []byte) ([]byte, error) {
+	block, err := aes.NewCipher(cookieKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	out := make([]byte, len(in))
+	cipher.NewCTR(block, iv).XORKeyStream(out, in)
+	return out, nil
+}
+
+// buildAuthClients encrypts the descriptor cookie for each authorized client
+// and pads the entries with random ones, so their number only reveals a
+// multiple of fakeAuthClients. Entries are ordered by client ID.
+func buildAuthClients(cookie []byte, clientKeys [][]byte, ephemeralPrivate, subcredential []byte) ([]authClient, error) {
+	if len(clientKeys) > 0 && len(cookie) != descriptorCookieLen {
+		return nil, fmt.Errorf("invalid descriptor cookie length: %d", len(cookie))
+	}
+
+	clients := make([]authClient, 0, len(clientKeys)+fakeAuthClients)
+	for i, clientKey := range clientKeys {
+		if len(clientKey) != 32 {
+			return nil, fmt.Errorf("authorized client %d has invalid key length: %d", i, len(clientKey))
+		}
+		clientID, cookieKey, err := clientAuthKeys(ephemeralPrivate, clientKey, subcredential)
+		if err != nil {
+			return nil, fmt.Errorf("authorized client %d: %w", i, err)
+		}
+		iv := make([]byte, authClientIVLen)
+		if _, err := rand.Read(iv); err != nil {
+			return nil, fmt.Errorf("failed to generate IV: %w", err)
+		}
+		encrypted, err := xorCookie(cookieKey, iv, cookie)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, authClient{id: clientID, iv: iv, cookie: encrypted})
+	}
+
+	for len(clients) == 0 || len(clients)%fakeAuthClients != 0 {
+		random := make([]byte, authClientIDLen+authClientIVLen+descriptorCookieLen)
+		if _, err := rand.Read(random); err != nil {
+			return nil, fmt.Errorf("failed to generate fake client auth: %w", err)
+		}
+		clients = append(clients, authClient{
+			id:     random[:authClientIDLen],
+			iv:     random[authClientIDLen : authClientIDLen+authClientIVLen],
+			cookie: random[authClientIDLen+authClientIVLen:],
+		})
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return bytes.Compare(clients[i].id, clients[j].id) < 0
+	})
+	return clients, nil
+}
+
+// decryptDescriptorCookie recovers the descriptor cookie from the entry for
+// a client's private key, if there is one
+func decryptDescriptorCookie(clients []authClient, ephemeralKey, clientPrivate, subcredential []byte) ([]byte, error) {
+	clientID, cookieKey, err := clientAuthKeys(clientPrivate, ephemeralKey, subcredential)
+	if err != nil {
+		return nil, err
+	}
+	for _, client := range clients {
+		if subtle.ConstantTimeCompare(client.id, clientID) == 1 {
+			return xorCookie(cookieKey, client.iv, client.cookie)
+		}
+	}
+	return nil, fmt.Errorf("client is not authorized by this descriptor")
+}
+
+// GenerateClientAuthKey returns a new x25519 key pair for client
+// authorization. The service is given the public key.
+func GenerateClientAuthKey() (public, private []byte, err error) {
+	private = make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	public, err = curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return public, private, nil
+}
+
+// EncodeClientAuthKey returns the base32 form of an x25519 key used in
+// authorization files
+func EncodeClientAuthKey(key []byte) string {
+	return clientAuthEncoding.EncodeToString(key)
+}
+
+// DecodeClientAuthKey parses the base32 form of an x25519 key
+func DecodeClientAuthKey(s string) ([]byte, error) {
+	key, err := clientAuthEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(s)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 key: %w", err)
+	}
+	if len(key) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid x25519 key length: %d", len(key))
+	}
+	return key, nil
+}
+
+// ParseClientAuthLine parses a client key file line:
+//
+//	<onion-address>:descriptor:x25519:<base32-encoded-private-key>
+func ParseClientAuthLine(line string) (*Address, []byte, error) {
+	fields := strings.Split(strings.TrimSpace(line), ":")
+	if len(fields) != 4 {
+		return nil, nil, fmt.Errorf("expected <address>:descriptor:x25519:<key>")
+	}
+	if fields[1] != "descriptor" {
+		return nil, nil, fmt.Errorf("unsupported authorization type %q", fields[1])
+	}
+	if fields[2] != "x25519" {
+		return nil, nil, fmt.Errorf("unsupported key type %q", fields[2])
+	}
+
+	host := fields[0]
+	if !strings.HasSuffix(host, V3Suffix) {
+		host += V3Suffix
+	}
+	addr, err := ParseAddress(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if addr.Version != V3 {
+		return nil, nil, fmt.Errorf("client authorization requires a v3 address")
+	}
+	key, err := DecodeClientAuthKey(fields[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, key, nil
+}
+
+// ParseAuthorizedClientLine parses the line of an authorized client file in
+// a service directory and returns the client's x25519 public key:
+//
+//	descriptor:x25519:<base32-encoded-public-key>
+func ParseAuthorizedClientLine(line string) ([]byte, error) {
+	fields := strings.Split(strings.TrimSpace(line), ":")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("expected descriptor:x25519:<key>")
+	}
+	if fields[0] != "descriptor" {
+		return nil, fmt.Errorf("unsupported authorization type %q", fields[0])
+	}
+	if fields[1] != "x25519" {
+		return nil, fmt.Errorf("unsupported key type %q", fields[1])
+	}
+	return DecodeClientAuthKey(fields[2])
+}
+
+// LoadClientAuthDir reads the private keys in every *.auth_private file of
+// a ClientOnionAuthDir, keyed by onion address. As in C tor, malformed files
+// are logged and skipped, so one bad file does not disable the others.
+func LoadClientAuthDir(dir string, log *logger.Logger) (map[string][]byte, error) {
+	if log == nil {
+		log = logger.NewDefault()
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client auth directory: %w", err)
+	}
+
+	keys := make(map[string][]byte)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), clientAuthFileSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path) // #nosec G304 - files in the configured ClientOnionAuthDir
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		addr, key, err := ParseClientAuthLine(string(data))
+		if err != nil {
+			log.Warn("Skipping malformed client auth file", "path", path, "error", err)
+			continue
+		}
+		keys[addr.Encode()] = key
+	}
+	return keys, nil
+}
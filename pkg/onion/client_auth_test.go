@@ -0,0 +1,210 @@
+package onion
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+func TestClientAuthorization(t *testing.T) {
+	alicePub, alicePriv, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	bobPub, bobPriv, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	_, evePriv, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	desc, service := newTestDescriptorWithConfig(t, &ServiceConfig{
+		Ports:             map[int]string{80: "localhost:8080"},
+		AuthorizedClients: [][]byte{alicePub, bobPub},
+	})
+	if len(desc.DescriptorCookie) != descriptorCookieLen {
+		t.Fatalf("Descriptor cookie has length %d", len(desc.DescriptorCookie))
+	}
+
+	tests := []struct {
+		name       string
+		clientKey  []byte
+		authorized bool
+	}{
+		{"first authorized client", alicePriv, true},
+		{"second authorized client", bobPriv, true},
+		{"unauthorized client", evePriv, false},
+		{"no client key", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseDescriptor(desc.RawDescriptor)
+			if err != nil {
+				t.Fatalf("Failed to parse descriptor: %v", err)
+			}
+			parsed.BlindedPubkey = desc.BlindedPubkey
+
+			err = DecryptDescriptorWithClientAuth(parsed, service.address, tt.clientKey)
+			if !tt.authorized {
+				if err == nil {
+					t.Fatal("Expected decryption to fail")
+				}
+				if len(parsed.IntroPoints) != 0 {
+					t.Errorf("Got %d introduction points without authorization", len(parsed.IntroPoints))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to decrypt descriptor: %v", err)
+			}
+			if len(parsed.IntroPoints) != len(desc.IntroPoints) {
+				t.Errorf("Got %d introduction points, want %d", len(parsed.IntroPoints), len(desc.IntroPoints))
+			}
+			if !bytes.Equal(parsed.DescriptorCookie, desc.DescriptorCookie) {
+				t.Error("Recovered descriptor cookie does not match")
+			}
+		})
+	}
+
+	// The number of auth-client lines does not reveal the number of clients
+	subcredential := ComputeSubcredential(service.address.Pubkey, desc.BlindedPubkey)
+	parsed, err := ParseDescriptor(desc.RawDescriptor)
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %v", err)
+	}
+	middle, err := decryptDescriptorLayer(parsed.Superencrypted, desc.BlindedPubkey, subcredential, desc.RevisionCounter, superencryptedConstant)
+	if err != nil {
+		t.Fatalf("Failed to decrypt superencrypted layer: %v", err)
+	}
+	if n := strings.Count(string(middle), "\nauth-client "); n != fakeAuthClients {
+		t.Errorf("Got %d auth-client lines, want %d", n, fakeAuthClients)
+	}
+}
+
+func TestClientKeyWithoutAuthorization(t *testing.T) {
+	// A client key for a service that does not restrict discovery is unused
+	desc, service := newTestDescriptor(t)
+	_, clientPriv, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	parsed, err := ParseDescriptor(desc.RawDescriptor)
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %v", err)
+	}
+	parsed.BlindedPubkey = desc.BlindedPubkey
+	if err := DecryptDescriptorWithClientAuth(parsed, service.address, clientPriv); err != nil {
+		t.Fatalf("Failed to decrypt descriptor: %v", err)
+	}
+	if len(parsed.IntroPoints) != len(desc.IntroPoints) || parsed.DescriptorCookie != nil {
+		t.Errorf("Got %d introduction points and cookie %x", len(parsed.IntroPoints), parsed.DescriptorCookie)
+	}
+}
+
+func TestNewServiceRejectsInvalidClientKeys(t *testing.T) {
+	_, err := NewService(&ServiceConfig{AuthorizedClients: [][]byte{make([]byte, 31)}}, logger.NewDefault())
+	if err == nil {
+		t.Error("Expected error for short authorized client key")
+	}
+}
+
+func TestParseClientAuthLine(t *testing.T) {
+	service, err := NewService(&ServiceConfig{}, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	host := strings.TrimSuffix(service.GetAddress(), V3Suffix)
+	_, private, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	key := EncodeClientAuthKey(private)
+
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{"valid", host + ":descriptor:x25519:" + key, false},
+		{"with suffix and newline", host + ".onion:descriptor:x25519:" + key + "\n", false},
+		{"lowercase key", host + ":descriptor:x25519:" + strings.ToLower(key), false},
+		{"missing field", host + ":descriptor:" + key, true},
+		{"wrong auth type", host + ":intro:x25519:" + key, true},
+		{"wrong key type", host + ":descriptor:ed25519:" + key, true},
+		{"invalid address", "example:descriptor:x25519:" + key, true},
+		{"short key", host + ":descriptor:x25519:" + key[:40], true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, got, err := ParseClientAuthLine(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseClientAuthLine() error = %v", err)
+			}
+			if addr.Encode() != service.GetAddress() {
+				t.Errorf("Address = %s, want %s", addr.Encode(), service.GetAddress())
+			}
+			if !bytes.Equal(got, private) {
+				t.Error("Private key mismatch")
+			}
+		})
+	}
+}
+
+func TestLoadClientAuthDir(t *testing.T) {
+	service, err := NewService(&ServiceConfig{}, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	_, private, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	line := strings.TrimSuffix(service.GetAddress(), V3Suffix) + ":descriptor:x25519:" + EncodeClientAuthKey(private) + "\n"
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "alice.auth_private"), []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Files without the suffix are ignored
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadClientAuthDir(dir, nil)
+	if err != nil {
+		t.Fatalf("LoadClientAuthDir() error = %v", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[service.GetAddress()], private) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "broken.auth_private"), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// A malformed file is skipped and the valid ones still load
+	keys, err = LoadClientAuthDir(dir, nil)
+	if err != nil {
+		t.Fatalf("LoadClientAuthDir() with a malformed file error = %v", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[service.GetAddress()], private) {
+		t.Errorf("Unexpected keys with a malformed file %v", keys)
+	}
+	if _, err := LoadClientAuthDir(filepath.Join(dir, "missing"), nil); err == nil {
+		t.Error("Expected error for missing directory")
+	}
+}
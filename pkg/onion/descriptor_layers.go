@@ -0,0 +1,613 @@
+// Package onion - Descriptor encryption layers
+// This file implements the superencrypted and encrypted sections of v3
+// descriptors (rend-spec-v3.txt section 2.5)
+package onion
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha3"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/crypto"
+)
+
+const (
+	descriptorSaltLen   = 16
+	descriptorKeyLen    = 32 // AES-256
+	descriptorIVLen     = 16
+	descriptorMACLen    = 32 // SHA3-256
+	descriptorMACKeyLen = 32
+
+	superencryptedConstant = "hsdir-superencrypted-data"
+	encryptedConstant      = "hsdir-encrypted-data"
+
+	// The middle layer is padded so that its size does not reveal the
+	// number of introduction points or authorized clients
+	superencryptedPadMultiple = 10000
+
+	// auth-client lines are padded with random entries to a multiple of
+	// this, so services without client authorization look the same
+	fakeAuthClients = 16
+
+	// descriptorSigPrefix is prepended to the descriptor body before signing
+	descriptorSigPrefix = "Tor onion service descriptor sig v3"
+
+	// Certificate types used in descriptors (cert-spec.txt section A.1)
+	certTypeDescriptorSigning = 0x08
+	certTypeIntroAuthKey      = 0x09
+	certTypeIntroEncKey       = 0x0B
+
+	// Certificate extensions (cert-spec.txt section 2.2)
+	certExtSignedWithKey     = 0x04
+	certExtAffectsValidation = 0x01
+)
+
+// descriptorLayerKeys derives the AES key, IV and MAC key of one layer:
+//
+//	secret_input = SECRET_DATA | N_hs_subcred | INT_8(revision_counter)
+//	keys = SHAKE256(secret_input | salt | STRING_CONSTANT)
+func descriptorLayerKeys(secretData, subcredential []byte, revision uint64, salt []byte, constant string) (key, iv, macKey []byte) {
+	h := sha3.NewSHAKE256()
+	h.Write(secretData)
+	h.Write(subcredential)
+	h.Write(binary.BigEndian.AppendUint64(nil, revision))
+	h.Write(salt)
+	h.Write([]byte(constant))
+
+	out := make([]byte, descriptorKeyLen+descriptorIVLen+descriptorMACKeyLen)
+	h.Read(out)
+	return out[:descriptorKeyLen], out[descriptorKeyLen : descriptorKeyLen+descriptorIVLen], out[descriptorKeyLen+descriptorIVLen:]
+}
+
+// descriptorLayerMAC computes
+// SHA3-256(INT_8(len(mac_key)) | mac_key | INT_8(len(salt)) | salt | encrypted)
+func descriptorLayerMAC(macKey, salt, encrypted []byte) []byte {
+	h := sha3.New256()
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(macKey))))
+	h.Write(macKey)
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(salt))))
+	h.Write(salt)
+	h.Write(encrypted)
+	return h.Sum(nil)
+}
+
+// encryptDescriptorLayer encrypts one layer as SALT | ENCRYPTED | MAC
+func encryptDescriptorLayer(plaintext, secretData, subcredential []byte, revision uint64, constant string) ([]byte, error) {
+	salt := make([]byte, descriptorSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key, iv, macKey := descriptorLayerKeys(secretData, subcredential, revision, salt, constant)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(encrypted, plaintext)
+
+	out := make([]byte, 0, descriptorSaltLen+len(encrypted)+descriptorMACLen)
+	out = append(out, salt...)
+	out = append(out, encrypted...)
+	return append(out, descriptorLayerMAC(macKey, salt, encrypted)...), nil
+}
+
+// decryptDescriptorLayer checks the MAC of a SALT | ENCRYPTED | MAC blob and
+// decrypts it
+func decryptDescriptorLayer(blob, secretData, subcredential []byte, revision uint64, constant string) ([]byte, error) {
+	if len(blob) < descriptorSaltLen+descriptorMACLen {
+		return nil, fmt.Errorf("encrypted layer too short: %d bytes", len(blob))
+	}
+	salt := blob[:descriptorSaltLen]
+	encrypted := blob[descriptorSaltLen : len(blob)-descriptorMACLen]
+	mac := blob[len(blob)-descriptorMACLen:]
+
+	key, iv, macKey := descriptorLayerKeys(secretData, subcredential, revision, salt, constant)
+	if subtle.ConstantTimeCompare(mac, descriptorLayerMAC(macKey, salt, encrypted)) != 1 {
+		return nil, fmt.Errorf("encrypted layer MAC mismatch")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	plaintext := make([]byte, len(encrypted))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, encrypted)
+	return plaintext, nil
+}
+
+// encodeDescriptorLayers builds the superencrypted blob of a descriptor
+// around the encrypted section listing its introduction points. With
+// authorized clients the encrypted section also needs the descriptor
+// cookie, which each client recovers from its auth-client line.
+func encodeDescriptorLayers(desc *Descriptor, blindedKey, subcredential []byte) ([]byte, error) {
+	ephemeral, err := crypto.GenerateNtorKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate descriptor ephemeral key: %w", err)
+	}
+	clients, err := buildAuthClients(desc.DescriptorCookie, desc.AuthorizedClients, ephemeral.Private[:], subcredential)
+	if err != nil {
+		return nil, err
+	}
+	secretData := blindedKey
+	if len(desc.AuthorizedClients) > 0 {
+		secretData = append(append([]byte(nil), blindedKey...), desc.DescriptorCookie...)
+	}
+
+	inner, err := buildEncryptedPlaintext(desc.IntroPoints, desc.PoW)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptDescriptorLayer(inner, secretData, subcredential, desc.RevisionCounter, encryptedConstant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt descriptor: %w", err)
+	}
+
+	middle := buildSuperencryptedPlaintext(&superencryptedLayer{
+		ephemeralKey: ephemeral.Public[:],
+		clients:      clients,
+		encrypted:    encrypted,
+	})
+	if rem := len(middle) % superencryptedPadMultiple; rem != 0 {
+		middle = append(middle, make([]byte, superencryptedPadMultiple-rem)...)
+	}
+	superencrypted, err := encryptDescriptorLayer(middle, blindedKey, subcredential, desc.RevisionCounter, superencryptedConstant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to superencrypt descriptor: %w", err)
+	}
+	return superencrypted, nil
+}
+
+// DecryptDescriptor decrypts both layers of a parsed descriptor and fills in
+// its introduction points. The blinded key is desc.BlindedPubkey, or the one
+// for the current time period if the descriptor has none.
+func DecryptDescriptor(desc *Descriptor, addr *Address) error {
+	return DecryptDescriptorWithClientAuth(desc, addr, nil)
+}
+
+// DecryptDescriptorWithClientAuth is DecryptDescriptor for a client holding
+// an x25519 authorization key for the service, which it needs when the
+// service restricts discovery to authorized clients. On success the
+// recovered cookie is stored in desc.DescriptorCookie.
+func DecryptDescriptorWithClientAuth(desc *Descriptor, addr *Address, clientKey []byte) error {
+	if desc == nil {
+		return fmt.Errorf("nil descriptor")
+	}
+	if addr == nil || len(addr.Pubkey) != V3PubkeyLen {
+		return fmt.Errorf("invalid onion address")
+	}
+	if len(desc.Superencrypted) == 0 {
+		return fmt.Errorf("descriptor has no superencrypted section")
+	}
+
+	blindedKey := desc.BlindedPubkey
+	if len(blindedKey) != 32 {
+		var err error
+		if blindedKey, err = currentBlindedPubkey(addr.Pubkey); err != nil {
+			return err
+		}
+	}
+	subcredential := ComputeSubcredential(addr.Pubkey, blindedKey)
+
+	// Introduction point certificates are signed by the descriptor signing
+	// key; without its certificate they cannot be checked
+	var signingKey ed25519.PublicKey
+	if len(desc.DescriptorSigningKeyCert) > 0 {
+		cert, err := parseCertificate(desc.DescriptorSigningKeyCert)
+		if err != nil {
+			return fmt.Errorf("failed to parse descriptor signing key certificate: %w", err)
+		}
+		signingKey = cert.SigningKey
+	}
+
+	plaintext, err := decryptDescriptorLayer(desc.Superencrypted, blindedKey, subcredential, desc.RevisionCounter, superencryptedConstant)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt superencrypted layer: %w", err)
+	}
+	middle, err := parseSuperencryptedPlaintext(plaintext)
+	if err != nil {
+		return err
+	}
+
+	secretData := blindedKey
+	var cookie []byte
+	if clientKey != nil {
+		// Services without client authorization only list random entries,
+		// so not finding one is not an error yet
+		if cookie, err = decryptDescriptorCookie(middle.clients, middle.ephemeralKey, clientKey, subcredential); err == nil {
+			secretData = append(append([]byte(nil), blindedKey...), cookie...)
+		}
+	}
+
+	inner, err := decryptDescriptorLayer(middle.encrypted, secretData, subcredential, desc.RevisionCounter, encryptedConstant)
+	if err != nil {
+		if cookie == nil {
+			return fmt.Errorf("failed to decrypt encrypted layer (the service may require client authorization): %w", err)
+		}
+		return fmt.Errorf("failed to decrypt encrypted layer: %w", err)
+	}
+	introPoints, pow, err := parseEncryptedPlaintext(inner, signingKey)
+	if err != nil {
+		return err
+	}
+
+	desc.IntroPoints = introPoints
+	desc.PoW = pow
+	desc.DescriptorCookie = cookie
+	return nil
+}
+
+// superencryptedLayer is the plaintext of the middle layer
+type superencryptedLayer struct {
+	ephemeralKey []byte       // desc-auth-ephemeral-key (x25519)
+	clients      []authClient // auth-client lines
+	encrypted    []byte       // The encrypted section
+}
+
+// buildSuperencryptedPlaintext writes the middle layer
+func buildSuperencryptedPlaintext(layer *superencryptedLayer) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("desc-auth-type x25519\n")
+	fmt.Fprintf(&buf, "desc-auth-ephemeral-key %s\n", base64.StdEncoding.EncodeToString(layer.ephemeralKey))
+	for _, client := range layer.clients {
+		fmt.Fprintf(&buf, "auth-client %s %s %s\n",
+			base64.RawStdEncoding.EncodeToString(client.id),
+			base64.RawStdEncoding.EncodeToString(client.iv),
+			base64.RawStdEncoding.EncodeToString(client.cookie))
+	}
+	buf.WriteString("encrypted\n")
+	writeObject(&buf, "MESSAGE", layer.encrypted)
+	return buf.Bytes()
+}
+
+// parseSuperencryptedPlaintext parses the middle layer. Malformed
+// auth-client lines are skipped, as they cannot match any client.
+func parseSuperencryptedPlaintext(plaintext []byte) (*superencryptedLayer, error) {
+	items, err := parseDescriptorItems(bytes.TrimRight(plaintext, "\x00"))
+	if err != nil {
+		return nil, fmt.Errorf("malformed superencrypted layer: %w", err)
+	}
+
+	layer := &superencryptedLayer{}
+	for _, item := range items {
+		switch item.keyword {
+		case "desc-auth-ephemeral-key":
+			key, err := decodeDescriptorBase64(item.args)
+			if err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("invalid desc-auth-ephemeral-key")
+			}
+			layer.ephemeralKey = key
+
+		case "auth-client":
+			fields := strings.Fields(item.args)
+			if len(fields) != 3 {
+				continue
+			}
+			id, errID := decodeDescriptorBase64(fields[0])
+			iv, errIV := decodeDescriptorBase64(fields[1])
+			cookie, errCookie := decodeDescriptorBase64(fields[2])
+			if errID != nil || errIV != nil || errCookie != nil ||
+				len(id) != authClientIDLen || len(iv) != authClientIVLen || len(cookie) != descriptorCookieLen {
+				continue
+			}
+			layer.clients = append(layer.clients, authClient{id: id, iv: iv, cookie: cookie})
+
+		case "encrypted":
+			if len(item.object) == 0 {
+				return nil, fmt.Errorf("encrypted section has no message")
+			}
+			layer.encrypted = item.object
+		}
+	}
+	if layer.encrypted == nil {
+		return nil, fmt.Errorf("superencrypted layer has no encrypted section")
+	}
+	return layer, nil
+}
+
+// buildEncryptedPlaintext writes the inner layer listing the introduction
+// points and the proof-of-work parameters, if any
+func buildEncryptedPlaintext(intros []IntroductionPoint, pow *PoWParams) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("create2-formats 2\n")
+	if pow != nil {
+		buf.WriteString(pow.encode())
+	}
+	for i, intro := range intros {
+		if len(intro.OnionKey) != 32 || len(intro.EncKey) != 32 {
+			return nil, fmt.Errorf("introduction point %d has invalid keys", i)
+		}
+		if len(intro.AuthKeyCert) == 0 || len(intro.EncKeyCert) == 0 {
+			return nil, fmt.Errorf("introduction point %d has no certificates", i)
+		}
+
+		fmt.Fprintf(&buf, "introduction-point %s\n", base64.StdEncoding.EncodeToString(encodeLinkSpecifiers(intro.LinkSpecifiers)))
+		fmt.Fprintf(&buf, "onion-key ntor %s\n", base64.StdEncoding.EncodeToString(intro.OnionKey))
+		buf.WriteString("auth-key\n")
+		writeObject(&buf, "ED25519 CERT", intro.AuthKeyCert)
+		fmt.Fprintf(&buf, "enc-key ntor %s\n", base64.StdEncoding.EncodeToString(intro.EncKey))
+		buf.WriteString("enc-key-cert\n")
+		writeObject(&buf, "ED25519 CERT", intro.EncKeyCert)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseEncryptedPlaintext reads the introduction points and v1
+// proof-of-work parameters of the inner layer. The points' certificates are
+// checked against signingKey unless it is nil.
+func parseEncryptedPlaintext(plaintext []byte, signingKey ed25519.PublicKey) ([]IntroductionPoint, *PoWParams, error) {
+	items, err := parseDescriptorItems(plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed encrypted layer: %w", err)
+	}
+
+	introPoints := make([]IntroductionPoint, 0)
+	var current *IntroductionPoint
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		if err := checkIntroductionPoint(current, signingKey); err != nil {
+			return fmt.Errorf("introduction point %d: %w", len(introPoints), err)
+		}
+		introPoints = append(introPoints, *current)
+		current = nil
+		return nil
+	}
+
+	var pow *PoWParams
+	for _, item := range items {
+		if item.keyword == "pow-params" && current == nil {
+			params, err := parsePoWParams(item.args)
+			if err != nil {
+				return nil, nil, err
+			}
+			if params != nil {
+				pow = params
+			}
+			continue
+		}
+		if item.keyword == "introduction-point" {
+			if err := finish(); err != nil {
+				return nil, nil, err
+			}
+			data, err := decodeDescriptorBase64(item.args)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid introduction-point link specifiers: %w", err)
+			}
+			specs, _, err := parseLinkSpecifiers(data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid introduction-point link specifiers: %w", err)
+			}
+			current = &IntroductionPoint{LinkSpecifiers: specs}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		switch item.keyword {
+		case "onion-key":
+			if key, ok := ntorKeyArgument(item.args); ok {
+				current.OnionKey = key
+			}
+		case "auth-key":
+			current.AuthKeyCert = item.object
+		case "enc-key":
+			if key, ok := ntorKeyArgument(item.args); ok {
+				current.EncKey = key
+			}
+		case "enc-key-cert":
+			current.EncKeyCert = item.object
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, nil, err
+	}
+	return introPoints, pow, nil
+}
+
+// checkIntroductionPoint fills in the auth key from its certificate and
+// verifies both certificates
+func checkIntroductionPoint(intro *IntroductionPoint, signingKey ed25519.PublicKey) error {
+	if len(intro.OnionKey) != 32 {
+		return fmt.Errorf("missing ntor onion-key")
+	}
+	if len(intro.EncKey) != 32 {
+		return fmt.Errorf("missing ntor enc-key")
+	}
+
+	authCert, err := parseCertificate(intro.AuthKeyCert)
+	if err != nil {
+		return fmt.Errorf("invalid auth-key certificate: %w", err)
+	}
+	if authCert.CertType != certTypeIntroAuthKey {
+		return fmt.Errorf("auth-key certificate has type %d", authCert.CertType)
+	}
+	intro.AuthKey = authCert.SigningKey
+
+	encCert, err := parseCertificate(intro.EncKeyCert)
+	if err != nil {
+		return fmt.Errorf("invalid enc-key-cert: %w", err)
+	}
+	if encCert.CertType != certTypeIntroEncKey {
+		return fmt.Errorf("enc-key-cert has type %d", encCert.CertType)
+	}
+	encEd25519, err := curve25519ToEd25519(intro.EncKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(encCert.SigningKey, encEd25519) {
+		return fmt.Errorf("enc-key-cert does not certify enc-key")
+	}
+
+	if signingKey == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, cert := range []*Certificate{authCert, encCert} {
+		if now.After(cert.ExpiresAt) {
+			return fmt.Errorf("certificate type %d expired at %v", cert.CertType, cert.ExpiresAt)
+		}
+		if !ed25519.Verify(signingKey, cert.SignedData, cert.Signature) {
+			return fmt.Errorf("certificate type %d not signed by descriptor signing key", cert.CertType)
+		}
+	}
+	return nil
+}
+
+// newCertificate builds a cert-spec.txt Ed25519 certificate for an Ed25519
+// key, signed by signer
+func newCertificate(certType uint8, certifiedKey []byte, expires time.Time, signer ed25519.PrivateKey) []byte {
+	cert := certificateBody(certType, certifiedKey, expires, signer.Public().(ed25519.PublicKey))
+	return append(cert, ed25519.Sign(signer, cert)...)
+}
+
+// certificateBody builds the signed portion of a certificate, with a
+// signed-with-ed25519-key extension naming the signing key
+func certificateBody(certType uint8, certifiedKey []byte, expires time.Time, signedWithKey []byte) []byte {
+	cert := make([]byte, 0, 40+4+len(signedWithKey)+ed25519.SignatureSize)
+	cert = append(cert, 1, certType)
+	cert = binary.BigEndian.AppendUint32(cert, uint32(expires.Unix()/3600))
+	cert = append(cert, 1) // Ed25519 certified key
+	cert = append(cert, certifiedKey...)
+	cert = append(cert, 1) // One extension
+	cert = binary.BigEndian.AppendUint16(cert, uint16(len(signedWithKey)))
+	cert = append(cert, certExtSignedWithKey, 0)
+	return append(cert, signedWithKey...)
+}
+
+// curve25519P is the field prime 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// curve25519ToEd25519 maps a Montgomery u-coordinate to the Ed25519 public
+// key with sign bit 0, y = (u - 1) / (u + 1), as certified by enc-key-cert
+func curve25519ToEd25519(u []byte) ([]byte, error) {
+	if len(u) != 32 {
+		return nil, fmt.Errorf("invalid curve25519 key length: %d", len(u))
+	}
+	le := make([]byte, 32)
+	copy(le, u)
+	le[31] &= 0x7f
+	x := new(big.Int).SetBytes(reverseBytes(le))
+	x.Mod(x, curve25519P)
+
+	denominator := new(big.Int).Add(x, big.NewInt(1))
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, fmt.Errorf("curve25519 key has no Ed25519 form")
+	}
+	y := new(big.Int).Sub(x, big.NewInt(1))
+	y.Mul(y, denominator.ModInverse(denominator, curve25519P))
+	y.Mod(y, curve25519P)
+
+	out := make([]byte, 32)
+	y.FillBytes(out)
+	return reverseBytes(out), nil
+}
+
+// reverseBytes reverses b in place and returns it
+func reverseBytes(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+// descriptorItem is one keyword line of a descriptor with its optional
+// object block
+type descriptorItem struct {
+	keyword string
+	args    string
+	object  []byte
+}
+
+// parseDescriptorItems splits a descriptor section into keyword lines and
+// decodes the -----BEGIN/END----- object that may follow each one
+func parseDescriptorItems(text []byte) ([]descriptorItem, error) {
+	lines := bytes.Split(text, []byte("\n"))
+	items := make([]descriptorItem, 0, len(lines))
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(string(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "-----BEGIN") {
+			return nil, fmt.Errorf("object without keyword at line %d", i+1)
+		}
+
+		keyword, args, _ := strings.Cut(line, " ")
+		item := descriptorItem{keyword: keyword, args: strings.TrimSpace(args)}
+		if i+1 < len(lines) && bytes.HasPrefix(bytes.TrimSpace(lines[i+1]), []byte("-----BEGIN")) {
+			object, next, err := readObject(lines, i+1)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", keyword, err)
+			}
+			item.object = object
+			i = next
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// readObject decodes the object starting at lines[start] and returns the
+// index of its END line
+func readObject(lines [][]byte, start int) ([]byte, int, error) {
+	var b64 bytes.Buffer
+	for j := start + 1; j < len(lines); j++ {
+		line := bytes.TrimSpace(lines[j])
+		if bytes.HasPrefix(line, []byte("-----END")) {
+			data, err := base64.StdEncoding.DecodeString(b64.String())
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid object encoding: %w", err)
+			}
+			return data, j, nil
+		}
+		b64.Write(line)
+	}
+	return nil, 0, fmt.Errorf("unterminated object")
+}
+
+// writeObject writes data as a base64 object with 64-character lines
+func writeObject(buf *bytes.Buffer, label string, data []byte) {
+	fmt.Fprintf(buf, "-----BEGIN %s-----\n", label)
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for i := 0; i < len(encoded); i += 64 {
+		end := i + 64
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		fmt.Fprintf(buf, "%s\n", encoded[i:end])
+	}
+	fmt.Fprintf(buf, "-----END %s-----\n", label)
+}
+
+// ntorKeyArgument decodes the key of an "ntor <base64>" argument
+func ntorKeyArgument(args string) ([]byte, bool) {
+	keyType, key, ok := strings.Cut(args, " ")
+	if !ok || keyType != "ntor" {
+		return nil, false
+	}
+	decoded, err := decodeDescriptorBase64(key)
+	if err != nil || len(decoded) != 32 {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// decodeDescriptorBase64 decodes base64 with or without padding, since
+// descriptors use both
+func decodeDescriptorBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+}
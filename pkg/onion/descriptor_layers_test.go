@@ -0,0 +1,304 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+// newTestDescriptor returns the signed descriptor of a service with two
+// reachable introduction points
+func newTestDescriptor(t testing.TB) (*Descriptor, *Service) {
+	t.Helper()
+	return newTestDescriptorWithConfig(t, &ServiceConfig{Ports: map[int]string{80: "localhost:8080"}})
+}
+
+// newTestDescriptorWithConfig is newTestDescriptor for a given service config
+func newTestDescriptorWithConfig(t testing.TB, config *ServiceConfig) (*Descriptor, *Service) {
+	t.Helper()
+
+	service, err := NewService(config, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	for _, fingerprint := range []string{
+		"0123456789ABCDEF0123456789ABCDEF01234567",
+		"89ABCDEF0123456789ABCDEF0123456789ABCDEF",
+	} {
+		authKey, authPrivate, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate auth key: %v", err)
+		}
+		encKey, err := crypto.GenerateNtorKeyPair()
+		if err != nil {
+			t.Fatalf("Failed to generate enc key: %v", err)
+		}
+		relay := testIntroRelay(fingerprint)
+		relay.NtorOnionKey = bytes.Repeat([]byte{0x42}, 32)
+		service.introPoints = append(service.introPoints, &ServiceIntroPoint{
+			Relay:       relay,
+			AuthKey:     authKey,
+			EncKey:      append([]byte(nil), encKey.Public[:]...),
+			authPrivate: authPrivate,
+			encPrivate:  encKey.Private,
+		})
+	}
+	if err := service.createDescriptor(); err != nil {
+		t.Fatalf("Failed to create descriptor: %v", err)
+	}
+	return service.descriptor, service
+}
+
+func TestDescriptorLayerRoundTrip(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, 32)
+	subcredential := bytes.Repeat([]byte{2}, 32)
+	plaintext := []byte("create2-formats 2\n")
+
+	blob, err := encryptDescriptorLayer(plaintext, secret, subcredential, 7, encryptedConstant)
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	if len(blob) != descriptorSaltLen+len(plaintext)+descriptorMACLen {
+		t.Errorf("Unexpected layer length %d", len(blob))
+	}
+	if bytes.Contains(blob, plaintext) {
+		t.Error("Layer contains the plaintext")
+	}
+
+	decrypted, err := decryptDescriptorLayer(blob, secret, subcredential, 7, encryptedConstant)
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decrypted %q, want %q", decrypted, plaintext)
+	}
+
+	tampered := append([]byte(nil), blob...)
+	tampered[descriptorSaltLen] ^= 1
+
+	tests := []struct {
+		name          string
+		blob          []byte
+		subcredential []byte
+		revision      uint64
+		constant      string
+	}{
+		{"tampered ciphertext", tampered, subcredential, 7, encryptedConstant},
+		{"wrong subcredential", blob, bytes.Repeat([]byte{3}, 32), 7, encryptedConstant},
+		{"wrong revision counter", blob, subcredential, 8, encryptedConstant},
+		{"wrong layer", blob, subcredential, 7, superencryptedConstant},
+		{"truncated", blob[:descriptorSaltLen+descriptorMACLen-1], subcredential, 7, encryptedConstant},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decryptDescriptorLayer(tt.blob, secret, tt.subcredential, tt.revision, tt.constant); err == nil {
+				t.Error("Expected decryption to fail")
+			}
+		})
+	}
+}
+
+func TestDecryptDescriptor(t *testing.T) {
+	desc, service := newTestDescriptor(t)
+
+	parsed, err := ParseDescriptor(desc.RawDescriptor)
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %v", err)
+	}
+	parsed.BlindedPubkey = desc.BlindedPubkey
+	if err := DecryptDescriptor(parsed, service.address); err != nil {
+		t.Fatalf("Failed to decrypt descriptor: %v", err)
+	}
+
+	if len(parsed.IntroPoints) != len(desc.IntroPoints) {
+		t.Fatalf("Got %d introduction points, want %d", len(parsed.IntroPoints), len(desc.IntroPoints))
+	}
+	for i, got := range parsed.IntroPoints {
+		want := service.introPoints[i]
+		if !bytes.Equal(got.AuthKey, want.AuthKey) {
+			t.Errorf("Introduction point %d: auth key mismatch", i)
+		}
+		if !bytes.Equal(got.EncKey, want.EncKey) {
+			t.Errorf("Introduction point %d: enc key mismatch", i)
+		}
+		if !bytes.Equal(got.OnionKey, want.Relay.NtorOnionKey) {
+			t.Errorf("Introduction point %d: onion key mismatch", i)
+		}
+		relay, err := got.Relay()
+		if err != nil {
+			t.Fatalf("Introduction point %d: %v", i, err)
+		}
+		if relay.Fingerprint != want.Relay.Fingerprint || relay.Address != want.Relay.Address || relay.ORPort != want.Relay.ORPort {
+			t.Errorf("Introduction point %d: relay %+v, want %+v", i, relay, want.Relay)
+		}
+	}
+
+	// The middle layer is padded to hide the number of introduction points
+	subcredential := ComputeSubcredential(service.address.Pubkey, desc.BlindedPubkey)
+	middle, err := decryptDescriptorLayer(parsed.Superencrypted, desc.BlindedPubkey, subcredential, desc.RevisionCounter, superencryptedConstant)
+	if err != nil {
+		t.Fatalf("Failed to decrypt superencrypted layer: %v", err)
+	}
+	if len(middle)%superencryptedPadMultiple != 0 {
+		t.Errorf("Superencrypted plaintext is %d bytes, not padded", len(middle))
+	}
+	if n := strings.Count(string(middle), "\nauth-client "); n != fakeAuthClients {
+		t.Errorf("Got %d auth-client lines, want %d", n, fakeAuthClients)
+	}
+}
+
+func TestDecryptDescriptorRejects(t *testing.T) {
+	desc, service := newTestDescriptor(t)
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherAddress, err := addressFromPublicKey(otherKey)
+	if err != nil {
+		t.Fatalf("Failed to derive address: %v", err)
+	}
+
+	// withIntroPoint re-encodes the descriptor after changing its first
+	// introduction point
+	withIntroPoint := func(t *testing.T, change func(intro *IntroductionPoint)) []byte {
+		copied := *desc
+		copied.IntroPoints = append([]IntroductionPoint(nil), desc.IntroPoints...)
+		change(&copied.IntroPoints[0])
+		raw, err := EncodeDescriptor(&copied)
+		if err != nil {
+			t.Fatalf("Failed to encode descriptor: %v", err)
+		}
+		return raw
+	}
+
+	tests := []struct {
+		name    string
+		address *Address
+		raw     func(t *testing.T) []byte
+		modify  func(parsed *Descriptor)
+	}{
+		{
+			name:    "other service",
+			address: otherAddress,
+		},
+		{
+			name:    "other revision counter",
+			address: service.address,
+			modify:  func(parsed *Descriptor) { parsed.RevisionCounter++ },
+		},
+		{
+			name:    "no superencrypted section",
+			address: service.address,
+			modify:  func(parsed *Descriptor) { parsed.Superencrypted = nil },
+		},
+		{
+			name:    "introduction point certified by another key",
+			address: service.address,
+			raw: func(t *testing.T) []byte {
+				_, forger, err := ed25519.GenerateKey(rand.Reader)
+				if err != nil {
+					t.Fatalf("Failed to generate key: %v", err)
+				}
+				return withIntroPoint(t, func(intro *IntroductionPoint) {
+					intro.AuthKeyCert = newCertificate(certTypeIntroAuthKey, intro.AuthKey, time.Now().Add(time.Hour), forger)
+				})
+			},
+		},
+		{
+			name:    "enc-key-cert for another key",
+			address: service.address,
+			raw: func(t *testing.T) []byte {
+				return withIntroPoint(t, func(intro *IntroductionPoint) {
+					intro.EncKeyCert = desc.IntroPoints[1].EncKeyCert
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := desc.RawDescriptor
+			if tt.raw != nil {
+				raw = tt.raw(t)
+			}
+			parsed, err := ParseDescriptor(raw)
+			if err != nil {
+				t.Fatalf("Failed to parse descriptor: %v", err)
+			}
+			if tt.modify != nil {
+				tt.modify(parsed)
+			}
+
+			if err := DecryptDescriptor(parsed, tt.address); err == nil {
+				t.Error("Expected decryption to fail")
+			}
+			if len(parsed.IntroPoints) != 0 {
+				t.Errorf("Got %d introduction points from a rejected descriptor", len(parsed.IntroPoints))
+			}
+		})
+	}
+}
+
+func TestCurve25519ToEd25519(t *testing.T) {
+	// The Curve25519 base point u = 9 maps to the Ed25519 base point
+	u := make([]byte, 32)
+	u[0] = 9
+	got, err := curve25519ToEd25519(u)
+	if err != nil {
+		t.Fatalf("Failed to convert key: %v", err)
+	}
+	want, _ := hex.DecodeString("5866666666666666666666666666666666666666666666666666666666666666")
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got %x, want %x", got, want)
+	}
+
+	// u = -1 has no Ed25519 form
+	minusOne, _ := hex.DecodeString("ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f")
+	if _, err := curve25519ToEd25519(minusOne); err == nil {
+		t.Error("Expected error for u = -1")
+	}
+
+	if _, err := curve25519ToEd25519(u[:31]); err == nil {
+		t.Error("Expected error for short key")
+	}
+}
+
+func TestCertificateExtensions(t *testing.T) {
+	signerPub, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	certified := bytes.Repeat([]byte{5}, 32)
+
+	cert, err := parseCertificate(newCertificate(certTypeIntroAuthKey, certified, time.Now().Add(time.Hour), signer))
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	if !bytes.Equal(cert.SignedWithKey, signerPub) {
+		t.Errorf("SignedWithKey = %x, want %x", cert.SignedWithKey, signerPub)
+	}
+	if !ed25519.Verify(signerPub, cert.SignedData, cert.Signature) {
+		t.Error("Certificate signature does not verify")
+	}
+
+	// Unknown extensions are skipped unless they affect validation
+	withExtension := func(flags byte) []byte {
+		body := certificateBody(certTypeIntroAuthKey, certified, time.Now().Add(time.Hour), signerPub)
+		body[39] = 2
+		body = append(body, 0, 1, 0x7F, flags, 0xAA)
+		return append(body, ed25519.Sign(signer, body)...)
+	}
+	if _, err := parseCertificate(withExtension(0)); err != nil {
+		t.Errorf("Unknown extension without flags rejected: %v", err)
+	}
+	if _, err := parseCertificate(withExtension(certExtAffectsValidation)); err == nil {
+		t.Error("Expected error for unknown extension that affects validation")
+	}
+}
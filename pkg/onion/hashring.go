@@ -0,0 +1,220 @@
+// Package onion - HSDir hash ring
+// This file implements the placement of descriptors on HSDirs
+// (rend-spec-v3.txt section 2.2)
+package onion
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// Hash ring defaults, overridden by consensus params (rend-spec-v3.txt
+// section 2.2.3)
+const (
+	defaultPeriodLength = 1440 // hsdir_interval, in minutes
+	defaultReplicas     = 2    // hsdir_n_replicas
+	defaultSpreadFetch  = 3    // hsdir_spread_fetch
+	defaultSpreadStore  = 4    // hsdir_spread_store
+
+	// Time periods start this long after the shared random value changes
+	timePeriodRotationOffset = 12 * time.Hour
+)
+
+// NetworkParams holds the consensus values that decide where descriptors
+// are stored
+type NetworkParams struct {
+	ValidAfter  time.Time        // Consensus valid-after, which decides the time period and SRV in use
+	CurrentSRV  []byte           // shared-rand-current-value
+	PreviousSRV []byte           // shared-rand-previous-value
+	Params      map[string]int64 // Consensus params (hsdir_interval, hsdir_n_replicas, ...)
+}
+
+// param returns a consensus param within [min, max], or def
+func (p NetworkParams) param(name string, def, min, max int64) int64 {
+	if v, ok := p.Params[name]; ok && v >= min && v <= max {
+		return v
+	}
+	return def
+}
+
+// PeriodLength returns the time period length in minutes
+func (p NetworkParams) PeriodLength() uint64 {
+	return uint64(p.param("hsdir_interval", defaultPeriodLength, 30, 14400))
+}
+
+// Replicas returns the number of hash ring positions per descriptor
+func (p NetworkParams) Replicas() int {
+	return int(p.param("hsdir_n_replicas", defaultReplicas, 1, 16))
+}
+
+// SpreadFetch returns how many HSDirs per replica a client may fetch from
+func (p NetworkParams) SpreadFetch() int {
+	return int(p.param("hsdir_spread_fetch", defaultSpreadFetch, 1, 128))
+}
+
+// SpreadStore returns how many HSDirs per replica a service uploads to
+func (p NetworkParams) SpreadStore() int {
+	return int(p.param("hsdir_spread_store", defaultSpreadStore, 1, 128))
+}
+
+// now returns the consensus valid-after, or the current time without a
+// consensus
+func (p NetworkParams) now() time.Time {
+	if p.ValidAfter.IsZero() {
+		return time.Now()
+	}
+	return p.ValidAfter
+}
+
+// CurrentHashRing returns the ring clients fetch current descriptors from.
+// A new time period starts 12 hours after a new SRV, so in the first half
+// of each SRV run the previous SRV still goes with the current period
+// (rend-spec-v3.txt section 2.2.4).
+func (p NetworkParams) CurrentHashRing() HashRing {
+	now := p.now()
+	length := p.PeriodLength()
+	periodNum := timePeriodNum(now, length)
+
+	srv := p.CurrentSRV
+	if inOverlapPeriod(now, length) {
+		srv = p.PreviousSRV
+	}
+	if len(srv) != 32 {
+		srv = disasterSRV(periodNum, length)
+	}
+
+	return HashRing{PeriodNum: periodNum, PeriodLength: length, SRV: srv}
+}
+
+// NextHashRing returns the ring of the next time period, which services
+// upload to ahead of the rollover. The next period's SRV is only known
+// between a new SRV and the start of that period, so there is no ring
+// outside this overlap (rend-spec-v3.txt section 2.2.4.1).
+func (p NetworkParams) NextHashRing() (HashRing, bool) {
+	now := p.now()
+	length := p.PeriodLength()
+	if !inOverlapPeriod(now, length) {
+		return HashRing{}, false
+	}
+	periodNum := timePeriodNum(now, length) + 1
+
+	srv := p.CurrentSRV
+	if len(srv) != 32 {
+		srv = disasterSRV(periodNum, length)
+	}
+
+	return HashRing{PeriodNum: periodNum, PeriodLength: length, SRV: srv}, true
+}
+
+// inOverlapPeriod reports whether t falls between the latest SRV and the
+// start of the next time period
+func inOverlapPeriod(t time.Time, length uint64) bool {
+	srvStart := t.UTC().Truncate(24 * time.Hour)
+	nextPeriodStart := timePeriodStart(timePeriodNum(srvStart, length)+1, length)
+	return !t.Before(srvStart) && t.Before(nextPeriodStart)
+}
+
+// timePeriodNum returns the time period containing t for a period length
+// in minutes
+func timePeriodNum(t time.Time, length uint64) uint64 {
+	minutes := t.Unix()/60 - int64(timePeriodRotationOffset/time.Minute)
+	if minutes < 0 {
+		return 0
+	}
+	return uint64(minutes) / length
+}
+
+// timePeriodStart returns when a time period begins
+func timePeriodStart(periodNum, length uint64) time.Time {
+	minutes := int64(periodNum*length) + int64(timePeriodRotationOffset/time.Minute)
+	return time.Unix(minutes*60, 0).UTC()
+}
+
+// disasterSRV is the shared random value used when the consensus has none:
+// H("shared-random-disaster" | INT_8(period_length) | INT_8(period_num))
+func disasterSRV(periodNum, length uint64) []byte {
+	h := sha3.New256()
+	h.Write([]byte("shared-random-disaster"))
+	h.Write(binary.BigEndian.AppendUint64(nil, length))
+	h.Write(binary.BigEndian.AppendUint64(nil, periodNum))
+	return h.Sum(nil)
+}
+
+// HashRing orders HSDirs for one time period and shared random value
+type HashRing struct {
+	PeriodNum    uint64
+	PeriodLength uint64 // Minutes
+	SRV          []byte // Shared random value (32 bytes)
+}
+
+// HSIndex returns the ring position of a descriptor replica:
+// H("store-at-idx" | blinded_public_key | INT_8(replicanum) |
+// INT_8(period_length) | INT_8(period_num))
+func (r HashRing) HSIndex(blindedKey []byte, replica int) []byte {
+	h := sha3.New256()
+	h.Write([]byte("store-at-idx"))
+	h.Write(blindedKey)
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(replica)))
+	h.Write(binary.BigEndian.AppendUint64(nil, r.PeriodLength))
+	h.Write(binary.BigEndian.AppendUint64(nil, r.PeriodNum))
+	return h.Sum(nil)
+}
+
+// HSDirIndex returns the ring position of a relay:
+// H("node-idx" | node_identity | shared_random_value | INT_8(period_num) |
+// INT_8(period_length))
+func (r HashRing) HSDirIndex(identityKey []byte) []byte {
+	h := sha3.New256()
+	h.Write([]byte("node-idx"))
+	h.Write(identityKey)
+	h.Write(r.SRV)
+	h.Write(binary.BigEndian.AppendUint64(nil, r.PeriodNum))
+	h.Write(binary.BigEndian.AppendUint64(nil, r.PeriodLength))
+	return h.Sum(nil)
+}
+
+// responsible returns, for each replica 1..replicas, the first spread HSDirs
+// at or after the replica's position on the ring, without repeating any
+func (r HashRing) responsible(blindedKey []byte, hsdirs []*HSDirectory, replicas, spread int) []*HSDirectory {
+	type ringEntry struct {
+		index []byte
+		hsdir *HSDirectory
+	}
+	ring := make([]ringEntry, 0, len(hsdirs))
+	for _, hsdir := range hsdirs {
+		if hsdir.HSDir && len(hsdir.IdentityKey) == 32 {
+			ring = append(ring, ringEntry{index: r.HSDirIndex(hsdir.IdentityKey), hsdir: hsdir})
+		}
+	}
+	if len(ring) == 0 {
+		return nil
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return bytes.Compare(ring[i].index, ring[j].index) < 0
+	})
+
+	selected := make([]*HSDirectory, 0, replicas*spread)
+	chosen := make(map[*HSDirectory]bool)
+	for replica := 1; replica <= replicas; replica++ {
+		hsIndex := r.HSIndex(blindedKey, replica)
+		start := sort.Search(len(ring), func(i int) bool {
+			return bytes.Compare(ring[i].index, hsIndex) >= 0
+		}) % len(ring)
+
+		added := 0
+		for i := start; added < spread; {
+			if entry := ring[i]; !chosen[entry.hsdir] {
+				chosen[entry.hsdir] = true
+				selected = append(selected, entry.hsdir)
+				added++
+			}
+			if i = (i + 1) % len(ring); i == start {
+				break
+			}
+		}
+	}
+	return selected
+}
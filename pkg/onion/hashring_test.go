@@ -0,0 +1,243 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testHashRingRelays returns n HSDirs with random identity keys
+func testHashRingRelays(n int) []*HSDirectory {
+	hsdirs := make([]*HSDirectory, n)
+	for i := range hsdirs {
+		identity := make([]byte, 32)
+		rand.Read(identity)
+		hsdirs[i] = &HSDirectory{
+			Fingerprint: fmt.Sprintf("%040X", i),
+			Address:     fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+			ORPort:      9001,
+			HSDir:       true,
+			IdentityKey: identity,
+		}
+	}
+	return hsdirs
+}
+
+func TestCurrentHashRing(t *testing.T) {
+	current := bytes.Repeat([]byte{0xC0}, 32)
+	previous := bytes.Repeat([]byte{0x9E}, 32)
+
+	tests := []struct {
+		name       string
+		validAfter time.Time
+		current    []byte
+		previous   []byte
+		wantPeriod uint64
+		wantSRV    []byte
+	}{
+		{
+			name:       "before the period starts at 12:00",
+			validAfter: time.Date(2016, 4, 13, 11, 15, 1, 0, time.UTC),
+			current:    current,
+			previous:   previous,
+			wantPeriod: 16903,
+			wantSRV:    previous,
+		},
+		{
+			name:       "new SRV at midnight",
+			validAfter: time.Date(2016, 4, 13, 0, 0, 0, 0, time.UTC),
+			current:    current,
+			previous:   previous,
+			wantPeriod: 16903,
+			wantSRV:    previous,
+		},
+		{
+			name:       "after the period starts",
+			validAfter: time.Date(2016, 4, 13, 12, 0, 0, 0, time.UTC),
+			current:    current,
+			previous:   previous,
+			wantPeriod: 16904,
+			wantSRV:    current,
+		},
+		{
+			name:       "late in the SRV run",
+			validAfter: time.Date(2016, 4, 13, 23, 0, 0, 0, time.UTC),
+			current:    current,
+			previous:   previous,
+			wantPeriod: 16904,
+			wantSRV:    current,
+		},
+		{
+			name:       "missing SRV",
+			validAfter: time.Date(2016, 4, 13, 13, 0, 0, 0, time.UTC),
+			previous:   previous,
+			wantPeriod: 16904,
+			wantSRV:    disasterSRV(16904, defaultPeriodLength),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NetworkParams{ValidAfter: tt.validAfter, CurrentSRV: tt.current, PreviousSRV: tt.previous}.CurrentHashRing()
+			if ring.PeriodNum != tt.wantPeriod {
+				t.Errorf("PeriodNum = %d, want %d", ring.PeriodNum, tt.wantPeriod)
+			}
+			if ring.PeriodLength != defaultPeriodLength {
+				t.Errorf("PeriodLength = %d, want %d", ring.PeriodLength, defaultPeriodLength)
+			}
+			if !bytes.Equal(ring.SRV, tt.wantSRV) {
+				t.Errorf("SRV = %x, want %x", ring.SRV, tt.wantSRV)
+			}
+		})
+	}
+}
+
+func TestNextHashRing(t *testing.T) {
+	current := bytes.Repeat([]byte{0xC0}, 32)
+	previous := bytes.Repeat([]byte{0x9E}, 32)
+
+	// In the overlap the next period is stored with the new SRV, which the
+	// current ring moves to once that period starts
+	overlap := NetworkParams{ValidAfter: time.Date(2016, 4, 13, 11, 15, 1, 0, time.UTC), CurrentSRV: current, PreviousSRV: previous}
+	ring, ok := overlap.NextHashRing()
+	if !ok {
+		t.Fatal("NextHashRing() has no ring in the overlap period")
+	}
+	if ring.PeriodNum != 16904 || !bytes.Equal(ring.SRV, current) {
+		t.Errorf("NextHashRing() = period %d with SRV %x, want period 16904 with %x", ring.PeriodNum, ring.SRV, current)
+	}
+	rolled := overlap
+	rolled.ValidAfter = time.Date(2016, 4, 13, 12, 0, 0, 0, time.UTC)
+	if after := rolled.CurrentHashRing(); after.PeriodNum != ring.PeriodNum || !bytes.Equal(after.SRV, ring.SRV) {
+		t.Errorf("Current ring after the rollover = %+v, want %+v", after, ring)
+	}
+
+	// Until the next SRV there is nothing to publish ahead
+	if _, ok := rolled.NextHashRing(); ok {
+		t.Error("NextHashRing() returned a ring outside the overlap period")
+	}
+
+	noSRV := NetworkParams{ValidAfter: overlap.ValidAfter}
+	if ring, _ := noSRV.NextHashRing(); !bytes.Equal(ring.SRV, disasterSRV(16904, defaultPeriodLength)) {
+		t.Errorf("NextHashRing() without an SRV = %x, want the disaster SRV", ring.SRV)
+	}
+}
+
+func TestNetworkParamsDefaults(t *testing.T) {
+	var params NetworkParams
+	if params.PeriodLength() != 1440 || params.Replicas() != 2 || params.SpreadFetch() != 3 || params.SpreadStore() != 4 {
+		t.Errorf("Unexpected defaults: %d %d %d %d",
+			params.PeriodLength(), params.Replicas(), params.SpreadFetch(), params.SpreadStore())
+	}
+
+	params.Params = map[string]int64{
+		"hsdir_interval":     120,
+		"hsdir_n_replicas":   3,
+		"hsdir_spread_fetch": 0, // Out of range, ignored
+		"hsdir_spread_store": 6,
+	}
+	if params.PeriodLength() != 120 || params.Replicas() != 3 || params.SpreadFetch() != 3 || params.SpreadStore() != 6 {
+		t.Errorf("Unexpected params: %d %d %d %d",
+			params.PeriodLength(), params.Replicas(), params.SpreadFetch(), params.SpreadStore())
+	}
+}
+
+func TestHashRingResponsible(t *testing.T) {
+	hsdirs := testHashRingRelays(3)
+	ring := HashRing{PeriodNum: 16903, PeriodLength: defaultPeriodLength, SRV: bytes.Repeat([]byte{7}, 32)}
+
+	// With one replica and a spread of one, the responsible HSDir is the
+	// first at or after hs_index, wrapping around the end of the ring
+	sorted := append([]*HSDirectory(nil), hsdirs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(ring.HSDirIndex(sorted[i].IdentityKey), ring.HSDirIndex(sorted[j].IdentityKey)) < 0
+	})
+	for i := 0; i < 50; i++ {
+		blindedKey := make([]byte, 32)
+		rand.Read(blindedKey)
+		hsIndex := ring.HSIndex(blindedKey, 1)
+
+		want := sorted[0]
+		for _, h := range sorted {
+			if bytes.Compare(ring.HSDirIndex(h.IdentityKey), hsIndex) >= 0 {
+				want = h
+				break
+			}
+		}
+		got := ring.responsible(blindedKey, hsdirs, 1, 1)
+		if len(got) != 1 || got[0] != want {
+			t.Fatalf("Got %v, want %s", got, want.Fingerprint)
+		}
+	}
+}
+
+func TestHashRingSkipsIneligibleRelays(t *testing.T) {
+	hsdirs := testHashRingRelays(4)
+	hsdirs[0].HSDir = false
+	hsdirs[1].IdentityKey = nil
+	ring := HashRing{PeriodNum: 1, PeriodLength: defaultPeriodLength, SRV: make([]byte, 32)}
+
+	selected := ring.responsible(make([]byte, 32), hsdirs, 2, 3)
+	if len(selected) != 2 {
+		t.Fatalf("Got %d HSDirs, want 2", len(selected))
+	}
+	for _, h := range selected {
+		if h == hsdirs[0] || h == hsdirs[1] {
+			t.Errorf("Selected ineligible relay %s", h.Fingerprint)
+		}
+	}
+}
+
+func TestHashRingDependsOnSRV(t *testing.T) {
+	hsdirs := testHashRingRelays(50)
+	blindedKey := make([]byte, 32)
+	rand.Read(blindedKey)
+
+	a := HashRing{PeriodNum: 1, PeriodLength: defaultPeriodLength, SRV: bytes.Repeat([]byte{1}, 32)}
+	b := HashRing{PeriodNum: 1, PeriodLength: defaultPeriodLength, SRV: bytes.Repeat([]byte{2}, 32)}
+	selectedA := a.responsible(blindedKey, hsdirs, 2, 3)
+	selectedB := b.responsible(blindedKey, hsdirs, 2, 3)
+
+	same := true
+	for i := range selectedA {
+		if selectedA[i] != selectedB[i] {
+			same = false
+		}
+	}
+	if same {
+		t.Error("Expected a different SRV to change the responsible HSDirs")
+	}
+}
+
+// TestHashRingStoreCoversFetch checks that every HSDir a client may fetch
+// from is one the service uploaded to
+func TestHashRingStoreCoversFetch(t *testing.T) {
+	hsdirs := testHashRingRelays(40)
+	params := NetworkParams{
+		ValidAfter: time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC),
+		CurrentSRV: bytes.Repeat([]byte{3}, 32),
+	}
+	ring := params.CurrentHashRing()
+
+	for i := 0; i < 20; i++ {
+		blindedKey := make([]byte, 32)
+		rand.Read(blindedKey)
+
+		stored := make(map[*HSDirectory]bool)
+		for _, h := range ring.responsible(blindedKey, hsdirs, params.Replicas(), params.SpreadStore()) {
+			stored[h] = true
+		}
+		fetched := ring.responsible(blindedKey, hsdirs, params.Replicas(), params.SpreadFetch())
+		if len(fetched) != params.Replicas()*params.SpreadFetch() {
+			t.Fatalf("Got %d HSDirs to fetch from, want %d", len(fetched), params.Replicas()*params.SpreadFetch())
+		}
+		for _, h := range fetched {
+			if !stored[h] {
+				t.Fatalf("Client would fetch from %s, which has no descriptor", h.Fingerprint)
+			}
+		}
+	}
+}
@@ -4,27 +4,30 @@
 package onion
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/sha256"
 	"crypto/sha3"
 	"encoding/base32"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
-	"golang.org/x/crypto/curve25519"
-	"golang.org/x/crypto/hkdf"
-
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/circuit"
+	"github.com/opd-ai/go-tor/pkg/crypto"
 	"github.com/opd-ai/go-tor/pkg/logger"
 	"github.com/opd-ai/go-tor/pkg/security"
 )
@@ -162,14 +165,23 @@ type Descriptor struct {
 	Version                  int                 // Descriptor version (3)
 	Address                  *Address            // Onion service address
 	IntroPoints              []IntroductionPoint // Introduction points
-	DescriptorID             []byte              // Descriptor identifier (32 bytes)
+	DescriptorID             []byte              // HSDir lookup key; the blinded key in v3 (32 bytes)
 	BlindedPubkey            []byte              // Blinded ed25519 public key (32 bytes)
 	RevisionCounter          uint64              // Revision counter for freshness
 	Signature                []byte              // Descriptor signature
 	DescriptorSigningKeyCert []byte              // Descriptor signing key certificate (AUDIT-002)
+	Superencrypted           []byte              // Encrypted introduction point layers, see DecryptDescriptor
 	RawDescriptor            []byte              // Raw descriptor content
 	CreatedAt                time.Time           // When descriptor was created
 	Lifetime                 time.Duration       // Descriptor validity lifetime
+
+	// Client authorization (rend-spec-v3.txt section 2.5.1.2)
+	AuthorizedClients [][]byte // x25519 public keys that may decrypt the introduction points
+	DescriptorCookie  []byte   // Secret the encrypted section is keyed with when clients are authorized
+
+	// Proof-of-work puzzle clients should solve before introducing
+	// themselves, from the encrypted section (nil if none)
+	PoW *PoWParams
 }
 
 // IntroductionPoint represents an introduction point
@@ -177,6 +189,7 @@ type IntroductionPoint struct {
 	LinkSpecifiers []LinkSpecifier
 	OnionKey       []byte // ed25519 public key
 	AuthKey        []byte // ed25519 public key
+	AuthKeyCert    []byte // auth-key certificate signed by the descriptor signing key
 	EncKey         []byte // curve25519 public key
 	EncKeyCert     []byte // cross-certification
 	LegacyKeyID    []byte // RSA key digest (20 bytes)
@@ -188,6 +201,115 @@ type LinkSpecifier struct {
 	Data []byte // Link specifier data
 }
 
+// Link specifier types (tor-spec.txt section 5.1.2)
+const (
+	LinkSpecIPv4     uint8 = 0 // IPv4 address and port (6 bytes)
+	LinkSpecIPv6     uint8 = 1 // IPv6 address and port (18 bytes)
+	LinkSpecLegacyID uint8 = 2 // SHA-1 RSA identity fingerprint (20 bytes)
+	LinkSpecEd25519  uint8 = 3 // Ed25519 identity key (32 bytes)
+)
+
+// Relay returns the relay acting as introduction point, as described by its
+// link specifiers and ntor onion key
+func (ip *IntroductionPoint) Relay() (*HSDirectory, error) {
+	relay, err := relayFromLinkSpecifiers(ip.LinkSpecifiers)
+	if err != nil {
+		return nil, err
+	}
+	if len(ip.OnionKey) != 32 {
+		return nil, fmt.Errorf("invalid onion key length: %d", len(ip.OnionKey))
+	}
+	relay.NtorOnionKey = append([]byte(nil), ip.OnionKey...)
+	return relay, nil
+}
+
+// relayFromLinkSpecifiers returns the relay reached by link specifiers; an
+// address and a legacy identity are required
+func relayFromLinkSpecifiers(specs []LinkSpecifier) (*HSDirectory, error) {
+	relay := &HSDirectory{}
+	for _, spec := range specs {
+		switch {
+		case spec.Type == LinkSpecIPv4 && len(spec.Data) == 6:
+			relay.Address = net.IP(spec.Data[0:4]).String()
+			relay.ORPort = int(binary.BigEndian.Uint16(spec.Data[4:6]))
+		case spec.Type == LinkSpecIPv6 && len(spec.Data) == 18 && relay.Address == "":
+			relay.Address = net.IP(spec.Data[0:16]).String()
+			relay.ORPort = int(binary.BigEndian.Uint16(spec.Data[16:18]))
+		case spec.Type == LinkSpecLegacyID && len(spec.Data) == 20:
+			relay.Fingerprint = strings.ToUpper(hex.EncodeToString(spec.Data))
+		case spec.Type == LinkSpecEd25519 && len(spec.Data) == 32:
+			relay.IdentityKey = append([]byte(nil), spec.Data...)
+		}
+	}
+	if relay.Address == "" {
+		return nil, fmt.Errorf("no address link specifier")
+	}
+	if relay.Fingerprint == "" {
+		return nil, fmt.Errorf("no legacy identity link specifier")
+	}
+	return relay, nil
+}
+
+// linkSpecifiersForRelay returns the link specifiers another relay needs to
+// extend a circuit to relay: its address, legacy identity and, if known, its
+// Ed25519 identity
+func linkSpecifiersForRelay(relay *HSDirectory) ([]LinkSpecifier, error) {
+	ip := net.ParseIP(relay.Address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid relay address %q", relay.Address)
+	}
+	port, err := security.SafeIntToUint16(relay.ORPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay port: %w", err)
+	}
+	fingerprint, err := hex.DecodeString(relay.Fingerprint)
+	if err != nil || len(fingerprint) != 20 {
+		return nil, fmt.Errorf("invalid relay fingerprint %q", relay.Fingerprint)
+	}
+
+	specs := make([]LinkSpecifier, 0, 3)
+	if ip4 := ip.To4(); ip4 != nil {
+		specs = append(specs, LinkSpecifier{Type: LinkSpecIPv4, Data: binary.BigEndian.AppendUint16(append([]byte(nil), ip4...), port)})
+	} else {
+		specs = append(specs, LinkSpecifier{Type: LinkSpecIPv6, Data: binary.BigEndian.AppendUint16(append([]byte(nil), ip.To16()...), port)})
+	}
+	specs = append(specs, LinkSpecifier{Type: LinkSpecLegacyID, Data: fingerprint})
+	if len(relay.IdentityKey) == 32 {
+		specs = append(specs, LinkSpecifier{Type: LinkSpecEd25519, Data: append([]byte(nil), relay.IdentityKey...)})
+	}
+	return specs, nil
+}
+
+// encodeLinkSpecifiers encodes NSPEC followed by each link specifier as
+// LSTYPE | LSLEN | LSPEC
+func encodeLinkSpecifiers(specs []LinkSpecifier) []byte {
+	out := []byte{byte(len(specs))}
+	for _, spec := range specs {
+		out = append(out, spec.Type, byte(len(spec.Data)))
+		out = append(out, spec.Data...)
+	}
+	return out
+}
+
+// parseLinkSpecifiers decodes NSPEC link specifiers and returns the bytes
+// that follow them
+func parseLinkSpecifiers(data []byte) ([]LinkSpecifier, []byte, error) {
+	if len(data) < 1 {
+		return nil, nil, fmt.Errorf("missing link specifier count")
+	}
+	n := int(data[0])
+	rest := data[1:]
+	specs := make([]LinkSpecifier, 0, n)
+	for i := 0; i < n; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, nil, fmt.Errorf("truncated link specifier %d", i)
+		}
+		specs = append(specs, LinkSpecifier{Type: rest[0], Data: append([]byte(nil), rest[2:2+int(rest[1])]...)})
+		rest = rest[2+int(rest[1]):]
+	}
+	return specs, rest, nil
+}
+
 // DescriptorCache manages cached onion service descriptors
 type DescriptorCache struct {
 	mu          sync.RWMutex
@@ -302,35 +424,22 @@ func (c *DescriptorCache) CleanExpired() int {
 	return count
 }
 
-// CircuitBuilder defines the interface for building circuits
+// CircuitBuilder builds the 3-hop circuits used for introduction and
+// rendezvous, whose last hop is the given relay
 type CircuitBuilder interface {
-	BuildCircuitToRelay(ctx context.Context, relay *HSDirectory, timeout time.Duration) (uint32, error)
-}
-
-// CellSender defines the interface for sending relay cells
-type CellSender interface {
-	SendRelayCell(ctx context.Context, circuitID uint32, command uint8, data []byte) error
-	ReceiveRelayCell(ctx context.Context, circuitID uint32, timeout time.Duration) ([]byte, error)
+	BuildCircuitToRelay(ctx context.Context, relay *HSDirectory, timeout time.Duration) (*circuit.Circuit, error)
 }
 
 // Client provides onion service client functionality
-// RendezvousState stores the cryptographic state for a rendezvous in progress (AUDIT-006)
-type RendezvousState struct {
-	EphemeralPrivate [32]byte // Client's ephemeral private key (x)
-	EphemeralPublic  [32]byte // Client's ephemeral public key (X)
-	OnionKey         [32]byte // Service's onion key from INTRODUCE1
-	CircuitID        uint32   // Rendezvous circuit ID
-}
-
 type Client struct {
-	cache           *DescriptorCache
-	logger          *logger.Logger
-	hsdir           *HSDir
-	consensus       []*HSDirectory              // Available HSDirs from consensus
-	circuitBuilder  CircuitBuilder              // Circuit builder for creating circuits
-	cellSender      CellSender                  // Cell sender for relay communication
-	rendezvousState map[uint32]*RendezvousState // AUDIT-006: Track ephemeral keys per circuit
-	rendezvousMu    sync.Mutex                  // Protects rendezvousState map
+	cache  *DescriptorCache
+	logger *logger.Logger
+	hsdir  *HSDir
+
+	mu             sync.RWMutex
+	consensus      []*HSDirectory // Relays from the consensus: HSDirs and rendezvous point candidates
+	circuitBuilder CircuitBuilder // Circuit builder for introduction and rendezvous circuits
+	maxPoWEffort   uint32         // Most effort spent on a service's proof-of-work puzzle
 }
 
 // NewClient creates a new onion service client
@@ -340,56 +449,63 @@ func NewClient(log *logger.Logger) *Client {
 	}
 
 	return &Client{
-		cache:           NewDescriptorCache(log),
-		logger:          log.Component("onion-client"),
-		hsdir:           NewHSDir(log),
-		consensus:       make([]*HSDirectory, 0),
-		rendezvousState: make(map[uint32]*RendezvousState), // AUDIT-006
+		cache:        NewDescriptorCache(log),
+		logger:       log.Component("onion-client"),
+		hsdir:        NewHSDir(log),
+		consensus:    make([]*HSDirectory, 0),
+		maxPoWEffort: DefaultMaxPoWEffort,
 	}
 }
 
 // SetCircuitBuilder sets the circuit builder for creating real circuits
 func (c *Client) SetCircuitBuilder(builder CircuitBuilder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.circuitBuilder = builder
-}
-
-// SetCellSender sets the cell sender for relay communication
-func (c *Client) SetCellSender(sender CellSender) {
-	c.cellSender = sender
+	c.hsdir.SetCircuitBuilder(builder)
 }
 
 // UpdateHSDirs updates the list of available HSDirs from consensus
 func (c *Client) UpdateHSDirs(relays []*HSDirectory) {
+	c.mu.Lock()
 	c.consensus = relays
+	c.mu.Unlock()
 	c.logger.Info("Updated HSDir list", "count", len(relays))
 }
 
-// StoreRendezvousState stores the ephemeral key state for a rendezvous (AUDIT-006)
-func (c *Client) StoreRendezvousState(circuitID uint32, state *RendezvousState) {
-	c.rendezvousMu.Lock()
-	defer c.rendezvousMu.Unlock()
-	c.rendezvousState[circuitID] = state
-	c.logger.Debug("Stored rendezvous state", "circuit_id", circuitID)
+// SetNetworkParams sets the consensus time, shared random values and
+// params that decide which HSDirs hold a descriptor
+func (c *Client) SetNetworkParams(params NetworkParams) {
+	c.hsdir.SetNetworkParams(params)
 }
 
-// GetRendezvousState retrieves the ephemeral key state for a rendezvous (AUDIT-006)
-func (c *Client) GetRendezvousState(circuitID uint32) (*RendezvousState, bool) {
-	c.rendezvousMu.Lock()
-	defer c.rendezvousMu.Unlock()
-	state, ok := c.rendezvousState[circuitID]
-	return state, ok
+// SetCircuitBuilder sets the builder for circuits to HSDirs
+func (h *HSDir) SetCircuitBuilder(builder CircuitBuilder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.circuitBuilder = builder
 }
 
-// RemoveRendezvousState removes the ephemeral key state after use (AUDIT-006)
-func (c *Client) RemoveRendezvousState(circuitID uint32) {
-	c.rendezvousMu.Lock()
-	defer c.rendezvousMu.Unlock()
-	if state, ok := c.rendezvousState[circuitID]; ok {
-		// AUDIT-006: Securely zero the private key before removing
-		security.SecureZeroMemory(state.EphemeralPrivate[:])
-		delete(c.rendezvousState, circuitID)
-		c.logger.Debug("Removed rendezvous state", "circuit_id", circuitID)
-	}
+// SetClientAuthKeys sets the x25519 private keys, keyed by onion address,
+// for services that only publish introduction points to authorized clients
+func (c *Client) SetClientAuthKeys(keys map[string][]byte) {
+	c.hsdir.SetClientAuthKeys(keys)
+}
+
+// SetMaxPoWEffort caps the effort spent solving a service's proof-of-work
+// puzzle. Services suggesting more get a cheaper solution, which they may
+// answer later than others; 0 never solves puzzles.
+func (c *Client) SetMaxPoWEffort(effort uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxPoWEffort = effort
+}
+
+// network returns the consensus relays and the circuit builder
+func (c *Client) network() ([]*HSDirectory, CircuitBuilder) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.consensus, c.circuitBuilder
 }
 
 // CacheDescriptor caches a descriptor for testing or manual management
@@ -426,12 +542,13 @@ func (c *Client) fetchDescriptor(ctx context.Context, addr *Address) (*Descripto
 	c.logger.Debug("Computing descriptor ID for address", "address", addr.String())
 
 	// Use HSDir protocol to fetch descriptor
-	if len(c.consensus) == 0 {
+	relays, _ := c.network()
+	if len(relays) == 0 {
 		return nil, fmt.Errorf("no HSDirs available in consensus - cannot fetch descriptor")
 	}
 
 	// Fetch from HSDirs using the protocol with retry logic
-	desc, err := c.hsdir.FetchDescriptor(ctx, addr, c.consensus)
+	desc, err := c.hsdir.FetchDescriptor(ctx, addr, relays)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch descriptor from HSDirs: %w", err)
 	}
@@ -439,76 +556,45 @@ func (c *Client) fetchDescriptor(ctx context.Context, addr *Address) (*Descripto
 	return desc, nil
 }
 
-// createMockDescriptor creates a mock descriptor for testing ONLY
-// AUDIT-003: This function should NOT be called in production code paths
-// It exists solely for test infrastructure and examples
-func (c *Client) createMockDescriptor(addr *Address) *Descriptor {
-	// Calculate blinded public key and descriptor ID
-	timePeriod := GetTimePeriod(time.Now())
-	blindedPubkey := ComputeBlindedPubkey(ed25519.PublicKey(addr.Pubkey), timePeriod)
-	descriptorID := computeDescriptorID(blindedPubkey)
-
-	// Safe conversion of timestamp to uint64
-	now := time.Now()
-	revisionCounter, err := security.SafeUnixToUint64(now)
-	if err != nil {
-		// In case of error, use 0 as revision counter (should never happen with valid timestamps)
-		revisionCounter = 0
-	}
-
-	return &Descriptor{
-		Version:         3,
-		Address:         addr,
-		BlindedPubkey:   blindedPubkey,
-		DescriptorID:    descriptorID,
-		RevisionCounter: revisionCounter,
-		CreatedAt:       now,
-		Lifetime:        3 * time.Hour,
-		IntroPoints:     make([]IntroductionPoint, 0),
+// ComputeBlindedPubkey computes the blinded public key of an onion service
+// for a time period (rend-spec-v3.txt appendix A.2). It names the service's
+// descriptor on the HSDirs and certifies its descriptor signing key.
+func ComputeBlindedPubkey(pubkey ed25519.PublicKey, timePeriod, periodLength uint64) ([]byte, error) {
+	if len(pubkey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length: %d", len(pubkey))
 	}
+	return blindPublicKey(pubkey, blindingFactor(pubkey, timePeriod, periodLength))
 }
 
-// computeDescriptorID computes the descriptor ID from a blinded public key
-func computeDescriptorID(blindedPubkey []byte) []byte {
-	h := sha3.New256()
-	h.Write(blindedPubkey)
-	return h.Sum(nil)
+// currentBlindedPubkey returns the blinded key for the current time period
+// with the default period length
+func currentBlindedPubkey(pubkey []byte) ([]byte, error) {
+	return ComputeBlindedPubkey(ed25519.PublicKey(pubkey), GetTimePeriod(time.Now()), defaultPeriodLength)
 }
 
-// ComputeBlindedPubkey computes the blinded public key for a given time period
-// Per Tor spec: blinded_key = h("Derive temporary signing key" || pubkey || time_period)
-func ComputeBlindedPubkey(pubkey ed25519.PublicKey, timePeriod uint64) []byte {
-	h := sha3.New256()
-	h.Write([]byte("Derive temporary signing key"))
-	h.Write(pubkey)
-
-	// Convert time period to bytes (8 bytes, big-endian)
-	timePeriodBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(timePeriodBytes, timePeriod)
-	h.Write(timePeriodBytes)
-
-	return h.Sum(nil)
-}
-
-// GetTimePeriod computes the current time period for descriptor rotation
-// Per Tor spec: time_period = (unix_time + offset) / period_length
-// For v3: period_length = 1440 minutes (24 hours), offset = 12 hours
+// ComputeSubcredential derives the subcredential that binds hs-ntor
+// handshakes to a service and time period (rend-spec-v3.txt section 2.1):
+//
+//	N_hs_cred = SHA3_256("credential" | public-identity-key)
+//	N_hs_subcred = SHA3_256("subcredential" | N_hs_cred | blinded-public-key)
+func ComputeSubcredential(identityKey, blindedKey []byte) []byte {
+	credential := sha3.New256()
+	credential.Write([]byte("credential"))
+	credential.Write(identityKey)
+
+	subcredential := sha3.New256()
+	subcredential.Write([]byte("subcredential"))
+	subcredential.Write(credential.Sum(nil))
+	subcredential.Write(blindedKey)
+	return subcredential.Sum(nil)
+}
+
+// GetTimePeriod computes the time period for descriptor rotation
+// Per Tor spec (rend-spec-v3.txt section 2.2.1), with the default
+// 1440-minute period length: time periods start at 12:00 UTC, so
+// 2016-04-13 11:15:01 UTC is in period 16903
 func GetTimePeriod(now time.Time) uint64 {
-	const periodLength = 24 * 60 * 60 // 24 hours in seconds
-	const offset = 12 * 60 * 60       // 12 hours in seconds
-
-	unixTime := now.Unix()
-	// Safe conversion: validate unixTime is non-negative before arithmetic
-	if unixTime < 0 {
-		// Invalid timestamp, return 0
-		return 0
-	}
-	// Perform calculation in int64 space, then safely convert
-	timePeriod := (unixTime + offset) / periodLength
-	if timePeriod < 0 {
-		return 0
-	}
-	return uint64(timePeriod)
+	return timePeriodNum(now, defaultPeriodLength)
 }
 
 // ParseDescriptor parses a raw v3 onion service descriptor
@@ -528,8 +614,6 @@ func ParseDescriptor(raw []byte) (*Descriptor, error) {
 
 	// Parse descriptor fields line by line
 	lines := bytes.Split(raw, []byte("\n"))
-	var currentIntroPoint *IntroductionPoint
-	var inIntroPointBlock bool
 
 	for i, line := range lines {
 		line = bytes.TrimSpace(line)
@@ -603,67 +687,16 @@ func ParseDescriptor(raw []byte) (*Descriptor, error) {
 			}
 
 		case "superencrypted":
-			// Marks start of encrypted portion - not parsed in this basic implementation
-			// A full implementation would decrypt this section
-
-		case "introduction-point":
-			// Start of introduction point block
-			inIntroPointBlock = true
-			currentIntroPoint = &IntroductionPoint{
-				LinkSpecifiers: make([]LinkSpecifier, 0),
-			}
-
-		case "onion-key":
-			// Introduction point onion key
-			if inIntroPointBlock && currentIntroPoint != nil {
-				// Next line should be the key type
-				if i+1 < len(lines) {
-					keyType := strings.TrimSpace(string(lines[i+1]))
-					if strings.HasPrefix(keyType, "ntor ") {
-						// Key is base64 encoded
-						keyData := strings.TrimPrefix(keyType, "ntor ")
-						decoded, err := base64.StdEncoding.DecodeString(keyData)
-						if err == nil {
-							currentIntroPoint.OnionKey = decoded
-						}
-					}
-				}
-			}
-
-		case "auth-key":
-			// Introduction point authentication key
-			if inIntroPointBlock && currentIntroPoint != nil {
-				// Key data follows
-				if i+1 < len(lines) {
-					keyData := strings.TrimSpace(string(lines[i+1]))
-					decoded, err := base64.StdEncoding.DecodeString(keyData)
-					if err == nil {
-						currentIntroPoint.AuthKey = decoded
-					}
-				}
-			}
-
-		case "enc-key":
-			// Introduction point encryption key
-			if inIntroPointBlock && currentIntroPoint != nil {
-				// Key type and data
-				keyParts := strings.Fields(args)
-				if len(keyParts) >= 2 && keyParts[0] == "ntor" {
-					decoded, err := base64.StdEncoding.DecodeString(keyParts[1])
-					if err == nil {
-						currentIntroPoint.EncKey = decoded
-					}
-				}
+			// Introduction points are inside this section, decrypted by
+			// DecryptDescriptor
+			if i+1 >= len(lines) || !bytes.HasPrefix(bytes.TrimSpace(lines[i+1]), []byte("-----BEGIN MESSAGE")) {
+				return nil, fmt.Errorf("superencrypted at line %d has no message", i+1)
 			}
-
-		case "legacy-key":
-			// Legacy RSA key ID
-			if inIntroPointBlock && currentIntroPoint != nil {
-				decoded, err := base64.StdEncoding.DecodeString(args)
-				if err == nil {
-					currentIntroPoint.LegacyKeyID = decoded
-				}
+			blob, _, err := readObject(lines, i+1)
+			if err != nil {
+				return nil, fmt.Errorf("invalid superencrypted section at line %d: %w", i+1, err)
 			}
+			desc.Superencrypted = blob
 
 		case "signature":
 			// Descriptor signature - marks end of descriptor
@@ -671,21 +704,9 @@ func ParseDescriptor(raw []byte) (*Descriptor, error) {
 			if err == nil {
 				desc.Signature = decoded
 			}
-
-			// End of introduction point block if we were in one
-			if inIntroPointBlock && currentIntroPoint != nil {
-				desc.IntroPoints = append(desc.IntroPoints, *currentIntroPoint)
-				currentIntroPoint = nil
-				inIntroPointBlock = false
-			}
 		}
 	}
 
-	// Add final introduction point if we were building one
-	if inIntroPointBlock && currentIntroPoint != nil {
-		desc.IntroPoints = append(desc.IntroPoints, *currentIntroPoint)
-	}
-
 	return desc, nil
 }
 
@@ -729,13 +750,13 @@ func VerifyDescriptorSignature(descriptor *Descriptor, address *Address) error {
 		return fmt.Errorf("signature line not found in descriptor")
 	}
 
-	// The signed message is everything up to (but not including) the signature line
-	signedMessage := raw[:signatureIdx]
+	// The signed message is everything up to (but not including) the signature
+	// line, after a fixed prefix
+	signedMessage := append([]byte(descriptorSigPrefix), raw[:signatureIdx]...)
 
-	// AUDIT-002 FIX: Implement full certificate chain validation
 	// Per rend-spec-v3.txt section 2.1:
 	// 1. Parse the descriptor-signing-key-cert from the descriptor
-	// 2. Verify certificate signature with identity key (onion address public key)
+	// 2. Verify certificate signature with the blinded key for the time period
 	// 3. Extract descriptor signing key from certificate
 	// 4. Verify descriptor signature with the extracted signing key
 
@@ -749,10 +770,10 @@ func VerifyDescriptorSignature(descriptor *Descriptor, address *Address) error {
 		return fmt.Errorf("failed to parse descriptor signing key certificate: %w", err)
 	}
 
-	// Verify certificate type (should be type 4 for Ed25519 signing key signed with Ed25519 identity)
-	// Per cert-spec.txt section 2.1
-	if cert.CertType != 4 {
-		return fmt.Errorf("invalid certificate type: %d, expected 4 (Ed25519 signing key)", cert.CertType)
+	// Verify certificate type (type 8: descriptor signing key signed with the
+	// blinded key, cert-spec.txt section A.1)
+	if cert.CertType != certTypeDescriptorSigning {
+		return fmt.Errorf("invalid certificate type: %d, expected %d (descriptor signing key)", cert.CertType, certTypeDescriptorSigning)
 	}
 
 	// Check certificate expiration
@@ -760,10 +781,19 @@ func VerifyDescriptorSignature(descriptor *Descriptor, address *Address) error {
 		return fmt.Errorf("certificate expired at %v", cert.ExpiresAt)
 	}
 
-	// Step 2: Verify certificate signature with identity key (onion address public key)
-	// The certificate's signature covers all fields before the signature field
-	if !ed25519.Verify(ed25519.PublicKey(address.Pubkey), cert.SignedData, cert.Signature) {
-		return fmt.Errorf("certificate signature verification failed: identity key did not sign certificate")
+	// Step 2: Verify certificate signature with the blinded key, which the
+	// client derives from the onion address
+	blindedKey := descriptor.BlindedPubkey
+	if len(blindedKey) != 32 {
+		if blindedKey, err = currentBlindedPubkey(address.Pubkey); err != nil {
+			return err
+		}
+	}
+	if cert.SignedWithKey != nil && !bytes.Equal(cert.SignedWithKey, blindedKey) {
+		return fmt.Errorf("certificate signed with unexpected key")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(blindedKey), cert.SignedData, cert.Signature) {
+		return fmt.Errorf("certificate signature verification failed: blinded key did not sign certificate")
 	}
 
 	// Step 3: Extract the descriptor signing key from the certificate
@@ -801,7 +831,8 @@ func parseCertificate(certData []byte) (*Certificate, error) {
 	// [1 byte] cert_type
 	// Type 4 = Ed25519 signing key signed with Ed25519 identity key
 	// Type 5 = TLS link certificate signed with Ed25519 signing key
-	// Type 8 = Ed25519 identity key signed with RSA identity key
+	// Type 8 = Descriptor signing key signed with a blinded key
+	// Type 9 / 0B = Introduction point keys signed with the descriptor signing key
 	cert.CertType = certData[offset]
 	offset++
 
@@ -839,18 +870,30 @@ func parseCertificate(certData []byte) (*Certificate, error) {
 	nExtensions := certData[offset]
 	offset++
 
-	// Parse extensions (skip for now, but account for their size)
+	// Parse extensions; unknown ones that affect validation must be rejected
 	for i := uint8(0); i < nExtensions; i++ {
 		if offset+2 > len(certData) {
 			return nil, fmt.Errorf("certificate truncated in extension %d", i)
 		}
-		extLen := binary.BigEndian.Uint16(certData[offset : offset+2])
+		extLen := int(binary.BigEndian.Uint16(certData[offset : offset+2]))
 		offset += 2
 		// Extension type (1 byte) + flags (1 byte) + data (extLen bytes)
-		if offset+2+int(extLen) > len(certData) {
+		if offset+2+extLen > len(certData) {
 			return nil, fmt.Errorf("certificate truncated in extension %d data", i)
 		}
-		offset += 2 + int(extLen)
+		extType, extFlags := certData[offset], certData[offset+1]
+		extData := certData[offset+2 : offset+2+extLen]
+		offset += 2 + extLen
+
+		switch {
+		case extType == certExtSignedWithKey:
+			if extLen != 32 {
+				return nil, fmt.Errorf("invalid signed-with-ed25519-key extension length: %d", extLen)
+			}
+			cert.SignedWithKey = append([]byte(nil), extData...)
+		case extFlags&certExtAffectsValidation != 0:
+			return nil, fmt.Errorf("unsupported certificate extension type %d", extType)
+		}
 	}
 
 	// [64 bytes] signature (Ed25519 signature of all preceding fields)
@@ -871,25 +914,19 @@ func parseCertificate(certData []byte) (*Certificate, error) {
 // AUDIT-002 FIX: Complete certificate structure
 type Certificate struct {
 	Version    uint8     // Certificate version (must be 1)
-	CertType   uint8     // Certificate type (4 = signing key cert)
+	CertType   uint8     // Certificate type (8 = descriptor signing key cert)
 	ExpiresAt  time.Time // Expiration time
 	SigningKey []byte    // The certified Ed25519 public key (32 bytes)
 	Signature  []byte    // Ed25519 signature (64 bytes)
 	SignedData []byte    // All data that was signed (for verification)
+
+	SignedWithKey []byte // Key from the signed-with-ed25519-key extension, if present
 }
 
 // VerifyDescriptorSignatureWithCertChain performs full certificate chain validation
-// This is a placeholder for full cert-spec.txt implementation
+// VerifyDescriptorSignature already checks the blinded key -> signing key ->
+// descriptor chain; this is kept as an alias
 func VerifyDescriptorSignatureWithCertChain(descriptor *Descriptor, address *Address) error {
-	// This would implement full certificate chain validation:
-	// 1. Parse descriptor-signing-key-cert from raw descriptor
-	// 2. Verify cert signature with identity key
-	// 3. Extract signing key from cert
-	// 4. Verify descriptor signature with signing key
-	//
-	// For now, we use the simplified approach in VerifyDescriptorSignature
-	// which verifies directly with the identity key
-
 	return VerifyDescriptorSignature(descriptor, address)
 }
 
@@ -910,9 +947,41 @@ func ParseDescriptorWithVerification(raw []byte, address *Address) (*Descriptor,
 // EncodeDescriptor encodes a descriptor to its wire format
 // Implements encoding according to rend-spec-v3.txt section 2.4
 func EncodeDescriptor(desc *Descriptor) ([]byte, error) {
+	encoded, err := encodeDescriptorBody(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write signature if available
+	if len(desc.Signature) > 0 {
+		encoded = append(encoded, fmt.Sprintf("signature %s\n", base64.StdEncoding.EncodeToString(desc.Signature))...)
+	}
+
+	return encoded, nil
+}
+
+// encodeDescriptorBody encodes everything the descriptor signature covers.
+// The introduction points are encrypted with the blinded key, so each call
+// gives a different encoding.
+func encodeDescriptorBody(desc *Descriptor) ([]byte, error) {
 	if desc == nil {
 		return nil, fmt.Errorf("descriptor is nil")
 	}
+	if desc.Address == nil || len(desc.Address.Pubkey) != V3PubkeyLen {
+		return nil, fmt.Errorf("descriptor has no onion address")
+	}
+
+	blindedKey := desc.BlindedPubkey
+	if len(blindedKey) != 32 {
+		var err error
+		if blindedKey, err = currentBlindedPubkey(desc.Address.Pubkey); err != nil {
+			return nil, err
+		}
+	}
+	superencrypted, err := encodeDescriptorLayers(desc, blindedKey, ComputeSubcredential(desc.Address.Pubkey, blindedKey))
+	if err != nil {
+		return nil, err
+	}
 
 	var buf bytes.Buffer
 
@@ -927,89 +996,40 @@ func EncodeDescriptor(desc *Descriptor) ([]byte, error) {
 	fmt.Fprintf(&buf, "descriptor-lifetime %d\n", lifetimeMinutes)
 
 	// Write descriptor-signing-key-cert if available
-	// This would be a multi-line base64-encoded Ed25519 certificate
-	// For now, we'll skip this in the basic implementation
+	if len(desc.DescriptorSigningKeyCert) > 0 {
+		buf.WriteString("descriptor-signing-key-cert\n")
+		writeObject(&buf, "ED25519 CERT", desc.DescriptorSigningKeyCert)
+	}
 
 	// Write revision counter
 	fmt.Fprintf(&buf, "revision-counter %d\n", desc.RevisionCounter)
 
-	// Write superencrypted section marker
-	// In a full implementation, this would contain the encrypted descriptor content
-	// For now, we'll write a placeholder
-	fmt.Fprintf(&buf, "superencrypted\n")
-	fmt.Fprintf(&buf, "-----BEGIN MESSAGE-----\n")
-
-	// Encode introduction points
-	for i, intro := range desc.IntroPoints {
-		fmt.Fprintf(&buf, "introduction-point %d\n", i)
-
-		// Write link specifiers
-		for _, ls := range intro.LinkSpecifiers {
-			// Link specifiers are encoded as: type (1 byte) || length (1 byte) || data
-			lsEncoded := base64.StdEncoding.EncodeToString(append([]byte{ls.Type, byte(len(ls.Data))}, ls.Data...))
-			fmt.Fprintf(&buf, "link-specifier %s\n", lsEncoded)
-		}
-
-		// Write onion key
-		if len(intro.OnionKey) > 0 {
-			fmt.Fprintf(&buf, "onion-key ntor %s\n", base64.StdEncoding.EncodeToString(intro.OnionKey))
-		}
-
-		// Write auth key
-		if len(intro.AuthKey) > 0 {
-			fmt.Fprintf(&buf, "auth-key\n")
-			fmt.Fprintf(&buf, "%s\n", base64.StdEncoding.EncodeToString(intro.AuthKey))
-		}
-
-		// Write enc key
-		if len(intro.EncKey) > 0 {
-			fmt.Fprintf(&buf, "enc-key ntor %s\n", base64.StdEncoding.EncodeToString(intro.EncKey))
-		}
-
-		// Write enc-key-cert if available
-		if len(intro.EncKeyCert) > 0 {
-			fmt.Fprintf(&buf, "enc-key-cert\n")
-			fmt.Fprintf(&buf, "-----BEGIN ED25519 CERT-----\n")
-			// Split cert into 64-character lines
-			cert := base64.StdEncoding.EncodeToString(intro.EncKeyCert)
-			for i := 0; i < len(cert); i += 64 {
-				end := i + 64
-				if end > len(cert) {
-					end = len(cert)
-				}
-				fmt.Fprintf(&buf, "%s\n", cert[i:end])
-			}
-			fmt.Fprintf(&buf, "-----END ED25519 CERT-----\n")
-		}
-
-		// Write legacy key ID if available
-		if len(intro.LegacyKeyID) > 0 {
-			fmt.Fprintf(&buf, "legacy-key %s\n", base64.StdEncoding.EncodeToString(intro.LegacyKeyID))
-		}
-	}
-
-	fmt.Fprintf(&buf, "-----END MESSAGE-----\n")
-
-	// Write signature if available
-	if len(desc.Signature) > 0 {
-		fmt.Fprintf(&buf, "signature %s\n", base64.StdEncoding.EncodeToString(desc.Signature))
-	}
+	// Write the encrypted introduction points
+	buf.WriteString("superencrypted\n")
+	writeObject(&buf, "MESSAGE", superencrypted)
 
 	return buf.Bytes(), nil
 }
 
 // HSDirectory represents a Hidden Service Directory capable of storing descriptors
 type HSDirectory struct {
-	Fingerprint string
-	Address     string
-	ORPort      int
-	DirPort     int  // Directory port for HTTP requests
-	HSDir       bool // Has HSDir flag
+	Fingerprint  string
+	Address      string
+	ORPort       int
+	DirPort      int    // Directory port for HTTP requests
+	HSDir        bool   // Has HSDir flag
+	IdentityKey  []byte // Ed25519 identity key, if known
+	NtorOnionKey []byte // Curve25519 ntor onion key, needed to extend circuits to the relay
 }
 
 // HSDir provides Hidden Service Directory operations
 type HSDir struct {
 	logger *logger.Logger
+
+	mu             sync.RWMutex
+	params         NetworkParams     // Consensus values that place descriptors on the hash ring
+	clientAuth     map[string][]byte // x25519 authorization keys by onion address
+	circuitBuilder CircuitBuilder    // Builds the circuits descriptors are fetched over
 }
 
 // NewHSDir creates a new HSDir protocol handler
@@ -1023,113 +1043,52 @@ func NewHSDir(log *logger.Logger) *HSDir {
 	}
 }
 
-// SelectHSDirs selects responsible HSDirs for a given descriptor ID
-// Per Tor spec (rend-spec-v3.txt section 2.2.3):
-// The responsible HSDirs are chosen by:
-// 1. Computing descriptor_id = H(blinded_pubkey || time_period || replica)
-// 2. Finding the 3 relays with fingerprints closest to descriptor_id
-func (h *HSDir) SelectHSDirs(descriptorID []byte, hsdirs []*HSDirectory, replica int) []*HSDirectory {
-	if len(hsdirs) == 0 {
-		h.logger.Warn("No HSDirs available")
-		return nil
-	}
-
-	// Need at least 3 HSDirs, or use all available if less
-	numHSDirs := 3
-	if len(hsdirs) < numHSDirs {
-		numHSDirs = len(hsdirs)
-		h.logger.Debug("Using all available HSDirs", "count", numHSDirs)
-	}
-
-	// Compute descriptor ID for this replica
-	replicaDescID := ComputeReplicaDescriptorID(descriptorID, replica)
-
-	// Sort HSDirs by distance from descriptor ID
-	type hsdirDistance struct {
-		hsdir    *HSDirectory
-		distance []byte
-	}
-
-	distances := make([]hsdirDistance, 0, len(hsdirs))
-	for _, hsdir := range hsdirs {
-		// Compute XOR distance between HSDir fingerprint and descriptor ID
-		distance := computeXORDistance([]byte(hsdir.Fingerprint), replicaDescID)
-		distances = append(distances, hsdirDistance{hsdir: hsdir, distance: distance})
-	}
-
-	// Sort by distance (closest first)
-	// Simple bubble sort since we typically have a small number
-	for i := 0; i < len(distances)-1; i++ {
-		for j := i + 1; j < len(distances); j++ {
-			if compareBytes(distances[i].distance, distances[j].distance) > 0 {
-				distances[i], distances[j] = distances[j], distances[i]
-			}
-		}
-	}
-
-	// Select the closest HSDirs
-	selected := make([]*HSDirectory, 0, numHSDirs)
-	for i := 0; i < numHSDirs && i < len(distances); i++ {
-		selected = append(selected, distances[i].hsdir)
-	}
-
-	h.logger.Debug("Selected HSDirs for descriptor",
-		"descriptor_id_prefix", fmt.Sprintf("%x", replicaDescID[:8]),
-		"replica", replica,
-		"count", len(selected))
-
-	return selected
+// SetNetworkParams sets the consensus values used to locate descriptors
+func (h *HSDir) SetNetworkParams(params NetworkParams) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.params = params
 }
 
-// ComputeReplicaDescriptorID computes the descriptor ID for a specific replica
-// descriptor_id = H(blinded_pubkey || INT_8(replica))
-func ComputeReplicaDescriptorID(baseDescriptorID []byte, replica int) []byte {
-	h := sha3.New256()
-	h.Write(baseDescriptorID)
-	h.Write([]byte{byte(replica)})
-	return h.Sum(nil)
+// NetworkParams returns the consensus values used to locate descriptors
+func (h *HSDir) NetworkParams() NetworkParams {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.params
 }
 
-// computeXORDistance computes the XOR distance between two byte arrays
-// Used for DHT-style routing to find closest HSDirs
-func computeXORDistance(a, b []byte) []byte {
-	minLen := len(a)
-	if len(b) < minLen {
-		minLen = len(b)
-	}
+// SetClientAuthKeys sets the x25519 private keys used to decrypt descriptors
+// of services that restrict discovery, keyed by onion address
+func (h *HSDir) SetClientAuthKeys(keys map[string][]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clientAuth = keys
+}
 
-	distance := make([]byte, minLen)
-	for i := 0; i < minLen; i++ {
-		distance[i] = a[i] ^ b[i]
-	}
-	return distance
+// clientAuthKey returns the authorization key for a service, if any
+func (h *HSDir) clientAuthKey(addr *Address) []byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.clientAuth[addr.Encode()]
 }
 
-// compareBytes compares two byte arrays lexicographically
-// Returns: -1 if a < b, 0 if a == b, 1 if a > b
-func compareBytes(a, b []byte) int {
-	minLen := len(a)
-	if len(b) < minLen {
-		minLen = len(b)
+// SelectHSDirs selects the HSDirs responsible for a blinded key
+// Per Tor spec (rend-spec-v3.txt section 2.2.3), each of the replicas is
+// stored on the first spread HSDirs whose hsdir_index follows its hs_index
+// on the hash ring
+func (h *HSDir) SelectHSDirs(ring HashRing, blindedKey []byte, hsdirs []*HSDirectory, replicas, spread int) []*HSDirectory {
+	selected := ring.responsible(blindedKey, hsdirs, replicas, spread)
+	if len(selected) == 0 {
+		h.logger.Warn("No HSDirs with ed25519 identities available")
+		return nil
 	}
 
-	for i := 0; i < minLen; i++ {
-		if a[i] < b[i] {
-			return -1
-		}
-		if a[i] > b[i] {
-			return 1
-		}
-	}
+	h.logger.Debug("Selected HSDirs for descriptor",
+		"blinded_key_prefix", fmt.Sprintf("%x", blindedKey[:8]),
+		"time_period", ring.PeriodNum,
+		"count", len(selected))
 
-	// All compared bytes are equal, compare lengths
-	if len(a) < len(b) {
-		return -1
-	}
-	if len(a) > len(b) {
-		return 1
-	}
-	return 0
+	return selected
 }
 
 // FetchDescriptor fetches a descriptor from responsible HSDirs
@@ -1139,73 +1098,87 @@ func (h *HSDir) FetchDescriptor(ctx context.Context, addr *Address, hsdirs []*HS
 		return nil, fmt.Errorf("no HSDirs available")
 	}
 
-	// Compute current time period
-	timePeriod := GetTimePeriod(time.Now())
-
-	// Compute blinded public key
-	blindedPubkey := ComputeBlindedPubkey(ed25519.PublicKey(addr.Pubkey), timePeriod)
-
-	// Compute descriptor ID
-	descriptorID := computeDescriptorID(blindedPubkey)
+	// The descriptor for the current time period is stored under its
+	// blinded key on the current hash ring
+	params := h.NetworkParams()
+	ring := params.CurrentHashRing()
+	blindedPubkey, err := ComputeBlindedPubkey(ed25519.PublicKey(addr.Pubkey), ring.PeriodNum, ring.PeriodLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute blinded key: %w", err)
+	}
 
 	h.logger.Debug("Fetching descriptor",
 		"address", addr.String(),
-		"time_period", timePeriod,
-		"descriptor_id", fmt.Sprintf("%x", descriptorID[:8]))
+		"time_period", ring.PeriodNum,
+		"blinded_key", fmt.Sprintf("%x", blindedPubkey[:8]))
+
+	selectedHSDirs := h.SelectHSDirs(ring, blindedPubkey, hsdirs, params.Replicas(), params.SpreadFetch())
+	if len(selectedHSDirs) == 0 {
+		return nil, fmt.Errorf("no responsible HSDirs for %s", addr.String())
+	}
 
 	// AUDIT-003 FIX: Add retry backoff logic
 	var lastErr error
 	maxRetries := 3
 	baseBackoff := 100 * time.Millisecond
 
-	// Try both replicas (Tor uses 2 replicas for redundancy)
-	for replica := 0; replica < 2; replica++ {
-		// Select responsible HSDirs for this replica
-		selectedHSDirs := h.SelectHSDirs(descriptorID, hsdirs, replica)
-
-		// Try each HSDir with retries and backoff
-		for attempt := 0; attempt < maxRetries; attempt++ {
-			// Apply exponential backoff for retries (not on first attempt)
-			if attempt > 0 {
-				backoff := baseBackoff * time.Duration(1<<uint(attempt-1))
-				h.logger.Debug("Retrying after backoff",
-					"attempt", attempt+1,
-					"backoff", backoff,
-					"replica", replica)
+	// Try each responsible HSDir with retries and backoff
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		// Apply exponential backoff for retries (not on first attempt)
+		if attempt > 0 {
+			backoff := baseBackoff * time.Duration(1<<uint(attempt-1))
+			h.logger.Debug("Retrying after backoff",
+				"attempt", attempt+1,
+				"backoff", backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("context cancelled during backoff: %w", ctx.Err())
+			}
+		}
 
-				select {
-				case <-time.After(backoff):
-				case <-ctx.Done():
-					return nil, fmt.Errorf("context cancelled during backoff: %w", ctx.Err())
-				}
+		for _, hsdir := range selectedHSDirs {
+			desc, err := h.fetchFromHSDir(ctx, hsdir, blindedPubkey)
+			if err != nil {
+				h.logger.Debug("Failed to fetch from HSDir",
+					"hsdir", hsdir.Fingerprint,
+					"attempt", attempt+1,
+					"error", err)
+				lastErr = err
+				continue
 			}
 
-			for _, hsdir := range selectedHSDirs {
-				desc, err := h.fetchFromHSDir(ctx, hsdir, descriptorID, replica)
-				if err != nil {
-					h.logger.Debug("Failed to fetch from HSDir",
-						"hsdir", hsdir.Fingerprint,
-						"replica", replica,
-						"attempt", attempt+1,
-						"error", err)
-					lastErr = err
-					continue
-				}
+			// Successfully fetched descriptor
+			h.logger.Info("Successfully fetched descriptor",
+				"address", addr.String(),
+				"hsdir", hsdir.Fingerprint,
+				"attempt", attempt+1)
 
-				// Successfully fetched descriptor
-				h.logger.Info("Successfully fetched descriptor",
-					"address", addr.String(),
-					"hsdir", hsdir.Fingerprint,
-					"replica", replica,
-					"attempt", attempt+1)
+			// Set metadata
+			desc.Address = addr
+			desc.BlindedPubkey = blindedPubkey
+			desc.DescriptorID = blindedPubkey
 
-				// Set metadata
-				desc.Address = addr
-				desc.BlindedPubkey = blindedPubkey
-				desc.DescriptorID = descriptorID
+			if err := VerifyDescriptorSignature(desc, addr); err != nil {
+				h.logger.Debug("Rejected descriptor signature",
+					"hsdir", hsdir.Fingerprint,
+					"error", err)
+				lastErr = err
+				continue
+			}
 
-				return desc, nil
+			// The introduction points are only readable with the
+			// blinded key and subcredential
+			if err := DecryptDescriptorWithClientAuth(desc, addr, h.clientAuthKey(addr)); err != nil {
+				h.logger.Debug("Failed to decrypt descriptor",
+					"hsdir", hsdir.Fingerprint,
+					"error", err)
+				lastErr = err
+				continue
 			}
+
+			return desc, nil
 		}
 	}
 
@@ -1216,99 +1189,92 @@ func (h *HSDir) FetchDescriptor(ctx context.Context, addr *Address, hsdirs []*HS
 	return nil, fmt.Errorf("failed to fetch descriptor from any HSDir")
 }
 
-// fetchFromHSDir fetches a descriptor from a specific HSDir using HTTP
-// Implements the HSDir protocol per dir-spec.txt section 4.3
-// AUDIT-003 FIX: Removed mock fallbacks, returns proper errors with retry support
-func (h *HSDir) fetchFromHSDir(ctx context.Context, hsdir *HSDirectory, descriptorID []byte, replica int) (*Descriptor, error) {
+const (
+	// hsFetchPrefix is where HSDirs serve descriptors, by base64 blinded key
+	hsFetchPrefix = "/tor/hs/3/"
+
+	// descriptorFetchTimeout bounds one fetch, from building the circuit to
+	// the HSDir's response
+	descriptorFetchTimeout = time.Minute
+)
+
+// fetchFromHSDir fetches a descriptor from an HSDir with HTTP GET over a
+// BEGIN_DIR stream on a circuit to it, so the HSDir does not learn who asks
+// (rend-spec-v3.txt section 2.2.6)
+func (h *HSDir) fetchFromHSDir(ctx context.Context, hsdir *HSDirectory, blindedKey []byte) (*Descriptor, error) {
+	h.mu.RLock()
+	builder := h.circuitBuilder
+	h.mu.RUnlock()
+	if builder == nil {
+		return nil, fmt.Errorf("no circuit builder configured")
+	}
+
 	h.logger.Debug("Fetching descriptor from HSDir",
 		"hsdir", hsdir.Fingerprint,
-		"descriptor_id", fmt.Sprintf("%x", descriptorID[:8]),
-		"replica", replica)
+		"blinded_key", fmt.Sprintf("%x", blindedKey[:8]))
 
-	// Build descriptor URL
-	// Format: /tor/hs/3/<base64-descriptor-id>
-	descriptorIDBase64 := base64.RawURLEncoding.EncodeToString(descriptorID)
-	url := fmt.Sprintf("http://%s:%d/tor/hs/3/%s", hsdir.Address, hsdir.DirPort, descriptorIDBase64)
+	ctx, cancel := context.WithTimeout(ctx, descriptorFetchTimeout)
+	defer cancel()
 
-	h.logger.Debug("Building HSDir request", "url", url)
+	circ, err := builder.BuildCircuitToRelay(ctx, hsdir, hsCircuitBuildTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build circuit: %w", err)
+	}
+	defer func() {
+		_ = circ.Close()
+	}()
 
-	// AUDIT-003 FIX: Make timeout configurable (AUDIT-MED-7 related)
-	// Default 5s timeout - should be configurable in production
-	timeout := 5 * time.Second
-	client := &http.Client{
-		Timeout: timeout,
+	stream, err := circ.OpenDirStream(ctx, hsDirStreamID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetReadDeadline(deadline)
 	}
 
-	// Create request with context
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	// The host is not contacted: the stream ends at the HSDir's directory
+	// service whatever the request names
+	url := fmt.Sprintf("http://%s:%d%s%s", hsdir.Address, hsdir.DirPort, hsFetchPrefix, base64.RawStdEncoding.EncodeToString(blindedKey))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HSDir request: %w", err)
 	}
+	req.Close = true
+	if err := req.Write(stream); err != nil {
+		return nil, fmt.Errorf("failed to send request to %s: %w", hsdir.Fingerprint, err)
+	}
 
-	// Set User-Agent header to match Tor client
-	req.Header.Set("User-Agent", "Tor/0.4.7.0")
-
-	// Execute request
-	resp, err := client.Do(req)
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch descriptor from %s: %w", hsdir.Fingerprint, err)
+		return nil, fmt.Errorf("failed to read response from %s: %w", hsdir.Fingerprint, err)
 	}
 	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			h.logger.Error("Failed to close response body", "function", "fetchFromHSDir", "error", err)
-		}
+		_ = resp.Body.Close()
 	}()
-
-	// Check status code
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("HSDir %s returned status %d", hsdir.Fingerprint, resp.StatusCode)
 	}
 
-	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read descriptor from %s: %w", hsdir.Fingerprint, err)
 	}
 
-	// Parse the descriptor
 	desc, err := ParseDescriptor(body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse descriptor from %s: %w", hsdir.Fingerprint, err)
 	}
 
-	// Set descriptor ID
-	desc.DescriptorID = descriptorID
-
 	h.logger.Info("Successfully fetched descriptor",
 		"hsdir", hsdir.Fingerprint,
-		"intro_points", len(desc.IntroPoints),
 		"revision", desc.RevisionCounter)
 
 	return desc, nil
 }
 
-// createMockDescriptor creates a mock descriptor for testing ONLY
-// AUDIT-003: This function should NOT be called in production code paths
-// It exists solely for test infrastructure and examples
-func (h *HSDir) createMockDescriptor(descriptorID []byte) *Descriptor {
-	// Safe conversion of timestamp to uint64
-	now := time.Now()
-	revisionCounter, err := security.SafeUnixToUint64(now)
-	if err != nil {
-		// In case of error, use 0 as revision counter
-		revisionCounter = 0
-	}
-
-	return &Descriptor{
-		Version:         3,
-		DescriptorID:    descriptorID,
-		RevisionCounter: revisionCounter,
-		CreatedAt:       now,
-		Lifetime:        3 * time.Hour,
-		IntroPoints:     make([]IntroductionPoint, 0),
-	}
-}
-
 // IntroductionProtocol handles introduction point operations for onion services
 type IntroductionProtocol struct {
 	logger *logger.Logger
@@ -1371,15 +1337,29 @@ func (ip *IntroductionProtocol) SelectIntroductionPoint(desc *Descriptor) (*Intr
 	return selected, nil
 }
 
+// Introduction and rendezvous cell constants (rend-spec-v3.txt section 3)
+const (
+	authKeyTypeEd25519     = 0x02
+	onionKeyTypeNtor       = 0x01
+	introduceMACLen        = 32
+	introduceAckSuccess    = 0x0000
+	rendezvousHandshakeLen = 64 // SERVER_PK | AUTH
+
+	// introduce1MinLen is the size INTRODUCE1 is padded to, as in C Tor
+	introduce1MinLen = 246
+
+	hsCircuitBuildTimeout = 30 * time.Second
+	introduceAckTimeout   = 10 * time.Second
+	rendezvous2Timeout    = 30 * time.Second
+)
+
 // IntroduceRequest represents an INTRODUCE1 request
 type IntroduceRequest struct {
-	IntroPoint          *IntroductionPoint // Target introduction point
-	RendezvousCookie    []byte             // Rendezvous cookie (20 bytes)
-	RendezvousPoint     string             // Rendezvous point fingerprint
-	RendezvousCircuitID uint32             // AUDIT-006: Circuit ID for storing handshake state
-	OnionKey            []byte             // Client's ephemeral onion key
-	EphemeralPrivate    [32]byte           // AUDIT-006: Client's ephemeral private key (for handshake)
-	EphemeralPublic     [32]byte           // AUDIT-006: Client's ephemeral public key
+	IntroPoint       *IntroductionPoint   // Target introduction point
+	RendezvousCookie []byte               // Rendezvous cookie (20 bytes)
+	RendezvousPoint  *HSDirectory         // Relay the service should meet us at
+	Handshake        *crypto.HsNtorClient // hs-ntor state, later completed with RENDEZVOUS2
+	PoW              *PoWSolution         // Solved puzzle, if the service asks for one
 }
 
 // BuildIntroduce1Cell constructs an INTRODUCE1 cell for the introduction protocol
@@ -1390,9 +1370,15 @@ type IntroduceRequest struct {
 //	  AUTH_KEY_TYPE     [1 byte]
 //	  AUTH_KEY_LEN      [2 bytes]
 //	  AUTH_KEY          [AUTH_KEY_LEN bytes]
-//	  EXTENSIONS        [N bytes]
-//	  ENCRYPTED_DATA    [remaining bytes]
+//	  N_EXTENSIONS      [1 byte]
+//	  CLIENT_PK         [32 bytes]
+//	  ENCRYPTED_DATA    [variable]
+//	  MAC               [32 bytes]
 //	}
+//
+// ENCRYPTED_DATA is the rendezvous cookie, the rendezvous point's ntor onion
+// key and link specifiers, encrypted with the hs-ntor ENC_KEY; MAC covers
+// every preceding byte (rend-spec-v3.txt section 3.3).
 func (ip *IntroductionProtocol) BuildIntroduce1Cell(req *IntroduceRequest) ([]byte, error) {
 	if req == nil {
 		return nil, fmt.Errorf("introduce request is nil")
@@ -1403,372 +1389,319 @@ func (ip *IntroductionProtocol) BuildIntroduce1Cell(req *IntroduceRequest) ([]by
 	if len(req.RendezvousCookie) != 20 {
 		return nil, fmt.Errorf("invalid rendezvous cookie length: %d, expected 20", len(req.RendezvousCookie))
 	}
+	if len(req.IntroPoint.AuthKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid auth key length: %d", len(req.IntroPoint.AuthKey))
+	}
+	if req.RendezvousPoint == nil {
+		return nil, fmt.Errorf("rendezvous point is nil")
+	}
+	if len(req.RendezvousPoint.NtorOnionKey) != 32 {
+		return nil, fmt.Errorf("rendezvous point has no ntor onion key")
+	}
+	if req.Handshake == nil {
+		return nil, fmt.Errorf("hs-ntor handshake is nil")
+	}
+
+	linkSpecs, err := linkSpecifiersForRelay(req.RendezvousPoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rendezvous point: %w", err)
+	}
 
 	ip.logger.Debug("Building INTRODUCE1 cell",
-		"rendezvous_point", req.RendezvousPoint)
+		"rendezvous_point", req.RendezvousPoint.Fingerprint)
 
 	var buf bytes.Buffer
+	buf.Write(make([]byte, 20)) // LEGACY_KEY_ID is zero for v3
+	buf.WriteByte(authKeyTypeEd25519)
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(req.IntroPoint.AuthKey))))
+	buf.Write(req.IntroPoint.AuthKey)
+	buf.WriteByte(0) // N_EXTENSIONS
 
-	// LEGACY_KEY_ID (20 bytes) - set to zero for v3
-	legacyKeyID := make([]byte, 20)
-	buf.Write(legacyKeyID)
-
-	// AUTH_KEY_TYPE (1 byte) - 0x02 for ed25519
-	buf.WriteByte(0x02)
-
-	// AUTH_KEY_LEN (2 bytes) - 32 bytes for ed25519
-	authKeyLen := uint16(32)
-	if len(req.IntroPoint.AuthKey) > 0 {
-		// Safely convert length to uint16
-		keyLen, err := security.SafeLenToUint16(req.IntroPoint.AuthKey)
-		if err != nil {
-			return nil, fmt.Errorf("auth key too large: %v", err)
-		}
-		authKeyLen = keyLen
-	}
-	binary.BigEndian.PutUint16(buf.Bytes()[len(buf.Bytes()):len(buf.Bytes())+2], authKeyLen)
-	buf.Write(make([]byte, 2)) // placeholder, then overwrite
-	buf.Truncate(buf.Len() - 2)
-	authKeyLenBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(authKeyLenBytes, authKeyLen)
-	buf.Write(authKeyLenBytes)
-
-	// AUTH_KEY (AUTH_KEY_LEN bytes)
-	if len(req.IntroPoint.AuthKey) > 0 {
-		buf.Write(req.IntroPoint.AuthKey)
-	} else {
-		// Mock auth key for testing
-		buf.Write(make([]byte, 32))
+	encKey, macKey, err := req.Handshake.IntroduceKeys()
+	if err != nil {
+		return nil, fmt.Errorf("hs-ntor key derivation failed: %w", err)
 	}
+	defer security.SecureZeroMemory(encKey)
+	defer security.SecureZeroMemory(macKey)
 
-	// EXTENSIONS (N bytes) - empty for now
-	buf.WriteByte(0) // N_EXTENSIONS = 0
-
-	// ENCRYPTED_DATA would contain:
-	// - RENDEZVOUS_COOKIE (20 bytes)
-	// - ONION_KEY (32 bytes for x25519)
-	// - LINK_SPECIFIERS for rendezvous point
-	// For Phase 7.3.3, we'll create a simplified version
-	encryptedData := ip.buildEncryptedData(req)
-	buf.Write(encryptedData)
+	plaintext := ip.buildEncryptedData(req, linkSpecs, buf.Len())
+	encrypted, err := introduceCipher(encKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(req.Handshake.PublicKey())
+	buf.Write(encrypted)
+	buf.Write(crypto.HsNtorMAC(macKey, buf.Bytes()))
 
 	ip.logger.Debug("Built INTRODUCE1 cell",
 		"total_size", buf.Len(),
-		"encrypted_data_size", len(encryptedData))
+		"encrypted_data_size", len(encrypted))
 
 	return buf.Bytes(), nil
 }
 
-// buildEncryptedData constructs the encrypted portion of INTRODUCE1
-// SPEC-006/SEC-M003: INTRODUCE1 encryption implementation
-// Implements ntor-based encryption per rend-spec-v3.txt §3.2.3
-//
-// The encryption process:
-// 1. Generate ephemeral client key pair (x, X)
-// 2. Perform Diffie-Hellman with introduction point's EncKey: shared = X25519(x, EncKey)
-// 3. Derive encryption keys using HKDF-SHA256
-// 4. Encrypt plaintext using AES-CTR
-// 5. Prepend client's ephemeral public key X for intro point to decrypt
+// buildEncryptedData constructs the plaintext of the encrypted part of
+// INTRODUCE1 (rend-spec-v3.txt section 3.3):
 //
-// Wire format of encrypted data:
+//	RENDEZVOUS_COOKIE [20 bytes]
+//	N_EXTENSIONS      [1 byte]
+//	EXTENSIONS        [variable]
+//	ONION_KEY_TYPE    [1 byte]
+//	ONION_KEY_LEN     [2 bytes]
+//	ONION_KEY         [ONION_KEY_LEN bytes]
+//	NSPEC             [1 byte]
+//	LINK_SPECIFIERS   [variable]
+//	PAD               [variable]
 //
-//	CLIENT_PK (32 bytes) || ENCRYPTED_DATA (variable length)
-//
-// Where ENCRYPTED_DATA contains:
-//
-//	RENDEZVOUS_COOKIE (20 bytes) || ONION_KEY (32 bytes) || LINK_SPECIFIERS (variable)
-func (ip *IntroductionProtocol) buildEncryptedData(req *IntroduceRequest) []byte {
-	// Build plaintext payload
+// The padding brings the whole cell to introduce1MinLen, so that its length
+// does not depend on the rendezvous point's link specifiers.
+func (ip *IntroductionProtocol) buildEncryptedData(req *IntroduceRequest, linkSpecs []LinkSpecifier, headerLen int) []byte {
 	var plaintext bytes.Buffer
-
-	// RENDEZVOUS_COOKIE (20 bytes)
 	plaintext.Write(req.RendezvousCookie)
-
-	// ONION_KEY (32 bytes for x25519)
-	if len(req.OnionKey) > 0 {
-		plaintext.Write(req.OnionKey)
+	if req.PoW != nil {
+		plaintext.WriteByte(1) // N_EXTENSIONS
+		plaintext.WriteByte(introduceExtPoW)
+		plaintext.WriteByte(powExtensionLen)
+		plaintext.Write(req.PoW.extension())
 	} else {
-		// Mock onion key
-		plaintext.Write(make([]byte, 32))
+		plaintext.WriteByte(0) // N_EXTENSIONS
 	}
+	plaintext.WriteByte(onionKeyTypeNtor)
+	plaintext.Write(binary.BigEndian.AppendUint16(nil, uint16(len(req.RendezvousPoint.NtorOnionKey))))
+	plaintext.Write(req.RendezvousPoint.NtorOnionKey)
+	plaintext.Write(encodeLinkSpecifiers(linkSpecs))
 
-	// LINK_SPECIFIERS for rendezvous point
-	// Format: N_SPEC [1 byte] || LINK_SPEC_1 || ... || LINK_SPEC_N
-	plaintext.WriteByte(0) // N_SPEC = 0 (simplified for current phase)
-
-	plaintextData := plaintext.Bytes()
-
-	// If introduction point has no EncKey, return plaintext (mock/testing mode)
-	if req.IntroPoint == nil || len(req.IntroPoint.EncKey) != 32 {
-		ip.logger.Debug("No valid intro point EncKey, using plaintext mode")
-		return plaintextData
+	overhead := headerLen + 32 + introduceMACLen // CLIENT_PK and MAC
+	if pad := introduce1MinLen - overhead - plaintext.Len(); pad > 0 {
+		plaintext.Write(make([]byte, pad))
 	}
+	return plaintext.Bytes()
+}
 
-	// Encrypt the data using introduction point's encryption key
-	// AUDIT-006: Now captures the ephemeral private key for handshake verification
-	encryptedData, clientPubKey, clientPrivKey, err := ip.encryptIntroduce1Data(plaintextData, req.IntroPoint.EncKey)
+// introduceCipher applies AES-256-CTR with ENC_KEY and a zero IV, which both
+// encrypts and decrypts the INTRODUCE1 payload
+func introduceCipher(encKey, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(encKey)
 	if err != nil {
-		ip.logger.Warn("Failed to encrypt INTRODUCE1 data, using plaintext", "error", err)
-		return plaintextData
-	}
-
-	// AUDIT-006: Store the ephemeral private key in the request for later use
-	// This will be used in CompleteRendezvous to verify the handshake
-	if req.RendezvousCircuitID > 0 && len(clientPrivKey) == 32 {
-		// Store the private key for handshake verification
-		copy(req.EphemeralPrivate[:], clientPrivKey)
-		copy(req.EphemeralPublic[:], clientPubKey)
+		return nil, fmt.Errorf("failed to create INTRODUCE1 cipher: %w", err)
 	}
-
-	// Build final encrypted payload: CLIENT_PK || ENCRYPTED_DATA
-	var result bytes.Buffer
-	result.Write(clientPubKey) // 32 bytes
-	result.Write(encryptedData)
-
-	ip.logger.Debug("INTRODUCE1 data encrypted",
-		"plaintext_len", len(plaintextData),
-		"encrypted_len", len(encryptedData),
-		"total_len", result.Len())
-
-	return result.Bytes()
+	out := make([]byte, len(data))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(out, data)
+	return out, nil
 }
 
-// encryptIntroduce1Data encrypts the INTRODUCE1 data using the introduction point's public key
-// Implements the encryption scheme from rend-spec-v3.txt §3.2.3
-//
-// AUDIT-006: Now returns ephemeral private key for later handshake verification
-//
-// Returns:
-//   - encryptedData: The encrypted payload
-//   - clientPubKey: The client's ephemeral public key (for intro point to decrypt)
-//   - clientPrivKey: The client's ephemeral private key (for handshake completion)
-//   - error: Any error that occurred during encryption
-func (ip *IntroductionProtocol) encryptIntroduce1Data(plaintext, introPointPubKey []byte) ([]byte, []byte, []byte, error) {
-	if len(introPointPubKey) != 32 {
-		return nil, nil, nil, fmt.Errorf("invalid intro point public key length: %d", len(introPointPubKey))
-	}
-
-	// Step 1: Generate ephemeral key pair for client
-	var clientPrivate, clientPublic [32]byte
-	if _, err := rand.Read(clientPrivate[:]); err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
-	}
-
-	// Compute public key from private key
-	// Uses curve25519 scalar multiplication with base point
-	basePoint := [32]byte{9} // Curve25519 base point
-	curve25519.ScalarMult(&clientPublic, &clientPrivate, &basePoint)
-
-	// Step 2: Perform Diffie-Hellman to get shared secret
-	var introPointKey [32]byte
-	copy(introPointKey[:], introPointPubKey)
-
-	var sharedSecret [32]byte
-	curve25519.ScalarMult(&sharedSecret, &clientPrivate, &introPointKey)
-
-	// Step 3: Derive encryption key using HKDF-SHA256
-	// Per rend-spec-v3.txt, we derive a key for AES-CTR encryption
-	// Info string identifies this as an INTRODUCE1 encryption key
-	info := []byte("tor-hs-intro-encryption")
-	encryptionKey, err := deriveKey(sharedSecret[:], info, 32) // 32 bytes for AES-256
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("key derivation failed: %w", err)
+// CreateIntroductionCircuit creates a circuit to an introduction point
+func (ip *IntroductionProtocol) CreateIntroductionCircuit(ctx context.Context, introPoint *IntroductionPoint, circuitBuilder CircuitBuilder) (*circuit.Circuit, error) {
+	if introPoint == nil {
+		return nil, fmt.Errorf("introduction point is nil")
 	}
-
-	// Derive IV for AES-CTR (16 bytes)
-	ivInfo := []byte("tor-hs-intro-iv")
-	iv, err := deriveKey(sharedSecret[:], ivInfo, 16)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("IV derivation failed: %w", err)
+	if circuitBuilder == nil {
+		return nil, fmt.Errorf("no circuit builder configured")
 	}
 
-	// Step 4: Encrypt plaintext using AES-CTR
-	encryptedData := make([]byte, len(plaintext))
-	copy(encryptedData, plaintext)
-
-	// Create AES-CTR cipher
-	block, err := aes.NewCipher(encryptionKey)
+	relay, err := introPoint.Relay()
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to create AES cipher: %w", err)
+		return nil, fmt.Errorf("invalid introduction point: %w", err)
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(encryptedData, encryptedData)
-
-	ip.logger.Debug("Data encrypted successfully",
-		"plaintext_len", len(plaintext),
-		"encrypted_len", len(encryptedData))
+	ip.logger.Info("Creating introduction circuit", "intro_point", relay.Fingerprint)
 
-	// AUDIT-006: Return private key for later handshake verification
-	return encryptedData, clientPublic[:], clientPrivate[:], nil
-}
-
-// deriveKey derives key material using HKDF-SHA256
-// This is a helper function for introduction point encryption
-// Per Tor specification, HKDF-SHA256 is used for key derivation in ntor-based protocols
-func deriveKey(secret, info []byte, length int) ([]byte, error) {
-	hkdfReader := hkdf.New(sha256.New, secret, nil, info)
-	key := make([]byte, length)
-	if _, err := io.ReadFull(hkdfReader, key); err != nil {
-		return nil, fmt.Errorf("HKDF derivation failed: %w", err)
+	circ, err := circuitBuilder.BuildCircuitToRelay(ctx, relay, hsCircuitBuildTimeout)
+	if err != nil {
+		ip.logger.Error("Failed to build introduction circuit", "error", err)
+		return nil, fmt.Errorf("failed to build circuit: %w", err)
 	}
-	return key, nil
-}
-
-// CreateIntroductionCircuit creates a circuit to an introduction point
-func (ip *IntroductionProtocol) CreateIntroductionCircuit(ctx context.Context, introPoint *IntroductionPoint, circuitBuilder CircuitBuilder) (uint32, error) {
-	if introPoint == nil {
-		return 0, fmt.Errorf("introduction point is nil")
-	}
-
-	ip.logger.Info("Creating introduction circuit",
-		"link_specifiers_count", len(introPoint.LinkSpecifiers))
-
-	// If we have a circuit builder, use it to create a real circuit
-	if circuitBuilder != nil {
-		// Extract relay information from link specifiers
-		// For now, we need to convert IntroductionPoint to HSDirectory
-		// In a production system, link specifiers would contain full relay info
-		relay := &HSDirectory{
-			Fingerprint: "", // Would be extracted from link specifiers
-			Address:     "", // Would be extracted from link specifiers
-			ORPort:      0,  // Would be extracted from link specifiers
-			HSDir:       false,
-		}
-
-		// Build circuit with 5 second timeout
-		circuitID, err := circuitBuilder.BuildCircuitToRelay(ctx, relay, 5*time.Second)
-		if err != nil {
-			ip.logger.Error("Failed to build introduction circuit", "error", err)
-			return 0, fmt.Errorf("failed to build circuit: %w", err)
-		}
 
-		ip.logger.Info("Introduction circuit created",
-			"circuit_id", circuitID)
-		return circuitID, nil
+	// Make the circuit look like a general one to the middle relay's guard
+	if err := circ.StartPaddingMachine(circuit.IntroCircuitPaddingMachine()); err != nil {
+		ip.logger.Debug("Introduction circuit padding not started", "error", err)
 	}
 
-	// Fallback: Mock circuit ID for testing when no circuit builder is available
-	circuitID := uint32(1000)
-	ip.logger.Debug("Introduction circuit created (mock - no circuit builder)",
-		"circuit_id", circuitID)
-
-	return circuitID, nil
+	ip.logger.Info("Introduction circuit created", "circuit_id", circ.ID)
+	return circ, nil
 }
 
-// SendIntroduce1 sends an INTRODUCE1 cell over a circuit
-func (ip *IntroductionProtocol) SendIntroduce1(ctx context.Context, circuitID uint32, introduce1Data []byte, cellSender CellSender) error {
+// SendIntroduce1 sends an INTRODUCE1 cell over a circuit and waits for the
+// introduction point's INTRODUCE_ACK
+func (ip *IntroductionProtocol) SendIntroduce1(ctx context.Context, circ *circuit.Circuit, introduce1Data []byte) error {
 	if len(introduce1Data) == 0 {
 		return fmt.Errorf("introduce1 data is empty")
 	}
+	if circ == nil {
+		return fmt.Errorf("introduction circuit is nil")
+	}
 
 	ip.logger.Info("Sending INTRODUCE1 cell",
-		"circuit_id", circuitID,
+		"circuit_id", circ.ID,
 		"data_size", len(introduce1Data))
 
-	// If we have a cell sender, use it to send the cell
-	if cellSender != nil {
-		const RELAY_COMMAND_INTRODUCE1 = 0x22 // Per Tor spec
+	if err := circ.SendRelayCell(cell.NewRelayCell(0, cell.RelayIntroduce1, introduce1Data)); err != nil {
+		return fmt.Errorf("failed to send INTRODUCE1: %w", err)
+	}
 
-		// Send the INTRODUCE1 cell over the circuit
-		if err := cellSender.SendRelayCell(ctx, circuitID, RELAY_COMMAND_INTRODUCE1, introduce1Data); err != nil {
-			ip.logger.Error("Failed to send INTRODUCE1 cell", "error", err)
-			return fmt.Errorf("failed to send INTRODUCE1: %w", err)
-		}
+	ackCtx, cancel := context.WithTimeout(ctx, introduceAckTimeout)
+	defer cancel()
+	ack, err := awaitRelayCell(ackCtx, circ, cell.RelayIntroduceAck)
+	if err != nil {
+		return fmt.Errorf("failed to receive INTRODUCE_ACK: %w", err)
+	}
 
-		ip.logger.Info("INTRODUCE1 cell sent successfully")
-		return nil
+	// INTRODUCE_ACK: STATUS [2 bytes] | N_EXTENSIONS [1 byte] | ...
+	if len(ack.Data) < 2 {
+		return fmt.Errorf("INTRODUCE_ACK too short: %d bytes", len(ack.Data))
+	}
+	if status := binary.BigEndian.Uint16(ack.Data[0:2]); status != introduceAckSuccess {
+		return fmt.Errorf("introduction point refused INTRODUCE1: status %d", status)
 	}
 
-	// Fallback: Mock sending when no cell sender is available
-	ip.logger.Debug("INTRODUCE1 cell sent (mock - no cell sender)")
+	ip.logger.Info("INTRODUCE1 acknowledged")
 	return nil
 }
 
-// ConnectToOnionService orchestrates the full connection process to an onion service
-// This combines descriptor fetching, introduction, and rendezvous protocols
-func (c *Client) ConnectToOnionService(ctx context.Context, addr *Address) (uint32, error) {
+// ConnectToOnionService orchestrates the full connection process to an onion
+// service. It establishes a rendezvous point, introduces itself to the
+// service through one of its introduction points and, once the service
+// answers at the rendezvous point, returns the rendezvous circuit with the
+// service as its last (virtual) hop. Streams opened on the circuit reach the
+// service; BEGIN cells carry only the port (rend-spec-v3.txt section 4.2).
+func (c *Client) ConnectToOnionService(ctx context.Context, addr *Address) (*circuit.Circuit, error) {
 	c.logger.Info("Connecting to onion service", "address", addr.String())
 
 	// Step 1: Get descriptor (from cache or fetch from HSDirs)
 	desc, err := c.GetDescriptor(ctx, addr)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get descriptor: %w", err)
+		return nil, fmt.Errorf("failed to get descriptor: %w", err)
 	}
 
 	c.logger.Debug("Descriptor retrieved", "intro_points", len(desc.IntroPoints))
 
-	// Step 2: Generate cryptographically secure rendezvous cookie
-	rendezvousCookie := make([]byte, 20)
-	if _, err := rand.Read(rendezvousCookie); err != nil {
-		return 0, fmt.Errorf("failed to generate rendezvous cookie: %w", err)
+	// Step 2: Select an introduction point
+	intro := NewIntroductionProtocol(c.logger)
+	introPoint, err := intro.SelectIntroductionPoint(desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select introduction point: %w", err)
 	}
 
-	// Step 3: Establish rendezvous point
-	rendezvousCircuitID, rendezvousPoint, err := c.EstablishRendezvousPoint(ctx, rendezvousCookie, c.consensus)
+	subcredential, err := descriptorSubcredential(addr, desc)
 	if err != nil {
-		return 0, fmt.Errorf("failed to establish rendezvous point: %w", err)
+		return nil, err
 	}
-
-	c.logger.Debug("Rendezvous point established",
-		"circuit_id", rendezvousCircuitID,
-		"fingerprint", rendezvousPoint.Fingerprint)
-
-	// Step 4: Select an introduction point
-	intro := NewIntroductionProtocol(c.logger)
-	introPoint, err := intro.SelectIntroductionPoint(desc)
+	handshake, err := crypto.NewHsNtorClient(introPoint.AuthKey, introPoint.EncKey, subcredential)
 	if err != nil {
-		return 0, fmt.Errorf("failed to select introduction point: %w", err)
+		return nil, fmt.Errorf("failed to start hs-ntor handshake: %w", err)
 	}
-
-	c.logger.Debug("Introduction point selected")
-
-	// Step 5: Create circuit to introduction point
-	introCircuitID, err := intro.CreateIntroductionCircuit(ctx, introPoint, c.circuitBuilder)
+	pow, err := c.solvePoW(ctx, addr, desc)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create introduction circuit: %w", err)
+		return nil, fmt.Errorf("failed to solve proof-of-work puzzle: %w", err)
 	}
 
-	c.logger.Debug("Introduction circuit created", "circuit_id", introCircuitID)
+	// Step 3: Generate cryptographically secure rendezvous cookie
+	rendezvousCookie := make([]byte, 20)
+	if _, err := rand.Read(rendezvousCookie); err != nil {
+		return nil, fmt.Errorf("failed to generate rendezvous cookie: %w", err)
+	}
 
-	// Step 6: Generate ephemeral onion key for client authentication
-	onionKey := make([]byte, 32)
-	if _, err := rand.Read(onionKey); err != nil {
-		return 0, fmt.Errorf("failed to generate onion key: %w", err)
+	// Step 4: Establish rendezvous point
+	relays, builder := c.network()
+	rendCirc, rendezvousPoint, err := c.EstablishRendezvousPoint(ctx, rendezvousCookie, relays)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish rendezvous point: %w", err)
+	}
+	fail := func(err error) (*circuit.Circuit, error) {
+		if closeErr := rendCirc.Close(); closeErr != nil {
+			c.logger.Debug("Failed to close rendezvous circuit", "error", closeErr)
+		}
+		return nil, err
 	}
 
-	// Step 7: Build and send INTRODUCE1 cell
-	req := &IntroduceRequest{
+	c.logger.Debug("Rendezvous point established",
+		"circuit_id", rendCirc.ID,
+		"fingerprint", rendezvousPoint.Fingerprint)
+
+	// Step 5: Build and send INTRODUCE1 cell
+	introduce1Data, err := intro.BuildIntroduce1Cell(&IntroduceRequest{
 		IntroPoint:       introPoint,
 		RendezvousCookie: rendezvousCookie,
-		RendezvousPoint:  rendezvousPoint.Fingerprint,
-		OnionKey:         onionKey,
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
+		PoW:              pow,
+	})
+	if err != nil {
+		return fail(fmt.Errorf("failed to build INTRODUCE1 cell: %w", err))
 	}
 
-	introduce1Data, err := intro.BuildIntroduce1Cell(req)
+	introCirc, err := intro.CreateIntroductionCircuit(ctx, introPoint, builder)
 	if err != nil {
-		return 0, fmt.Errorf("failed to build INTRODUCE1 cell: %w", err)
+		return fail(fmt.Errorf("failed to create introduction circuit: %w", err))
 	}
 
-	c.logger.Debug("INTRODUCE1 cell built", "size", len(introduce1Data))
+	c.logger.Debug("Introduction circuit created", "circuit_id", introCirc.ID)
 
-	if err := intro.SendIntroduce1(ctx, introCircuitID, introduce1Data, c.cellSender); err != nil {
-		return 0, fmt.Errorf("failed to send INTRODUCE1: %w", err)
+	err = intro.SendIntroduce1(ctx, introCirc, introduce1Data)
+	// The introduction circuit is done either way (rend-spec-v3.txt section 3.2)
+	if closeErr := introCirc.Close(); closeErr != nil {
+		c.logger.Debug("Failed to close introduction circuit", "error", closeErr)
+	}
+	if err != nil {
+		return fail(fmt.Errorf("failed to send INTRODUCE1: %w", err))
 	}
 
 	c.logger.Debug("INTRODUCE1 cell sent")
 
-	// Step 8: Wait for RENDEZVOUS2 and complete the connection
-	if err := c.CompleteRendezvous(ctx, rendezvousCircuitID); err != nil {
-		return 0, fmt.Errorf("failed to complete rendezvous: %w", err)
+	// Step 6: Wait for RENDEZVOUS2 and add the service as a virtual hop
+	if err := c.CompleteRendezvous(ctx, rendCirc, handshake); err != nil {
+		return fail(fmt.Errorf("failed to complete rendezvous: %w", err))
 	}
 
 	c.logger.Info("Successfully connected to onion service",
 		"address", addr.String(),
-		"rendezvous_circuit_id", rendezvousCircuitID)
+		"rendezvous_circuit_id", rendCirc.ID)
+
+	return rendCirc, nil
+}
+
+// solvePoW solves the descriptor's proof-of-work puzzle, if it has one, at
+// the suggested effort up to the client's maximum
+func (c *Client) solvePoW(ctx context.Context, addr *Address, desc *Descriptor) (*PoWSolution, error) {
+	c.mu.RLock()
+	maxEffort := c.maxPoWEffort
+	c.mu.RUnlock()
+	effort := clientPoWEffort(desc.PoW, maxEffort, time.Now())
+	if effort == 0 {
+		return nil, nil
+	}
+
+	blindedKey := desc.BlindedPubkey
+	if len(blindedKey) != 32 {
+		var err error
+		if blindedKey, err = currentBlindedPubkey(addr.Pubkey); err != nil {
+			return nil, err
+		}
+	}
+	c.logger.Info("Solving proof-of-work puzzle", "address", addr.String(), "effort", effort)
+	start := time.Now()
+	solution, err := SolvePoW(ctx, desc.PoW, blindedKey, effort)
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Debug("Proof-of-work puzzle solved", "effort", effort, "duration", time.Since(start))
+	return solution, nil
+}
 
-	// Return the rendezvous circuit ID as it's the final connection circuit
-	return rendezvousCircuitID, nil
+// descriptorSubcredential returns the subcredential for the descriptor's
+// time period, deriving the blinded key if the descriptor lacks it
+func descriptorSubcredential(addr *Address, desc *Descriptor) ([]byte, error) {
+	if len(addr.Pubkey) != V3PubkeyLen {
+		return nil, fmt.Errorf("invalid onion service public key length: %d", len(addr.Pubkey))
+	}
+	blindedPubkey := desc.BlindedPubkey
+	if len(blindedPubkey) != 32 {
+		var err error
+		if blindedPubkey, err = currentBlindedPubkey(addr.Pubkey); err != nil {
+			return nil, err
+		}
+	}
+	return ComputeSubcredential(addr.Pubkey, blindedPubkey), nil
 }
 
 // RendezvousProtocol handles rendezvous point operations for onion services
@@ -1789,22 +1722,28 @@ func NewRendezvousProtocol(log *logger.Logger) *RendezvousProtocol {
 
 // SelectRendezvousPoint selects a suitable rendezvous point from available relays
 // Per Tor spec (rend-spec-v3.txt section 3.3):
-// The client selects a rendezvous point randomly from available relays
+// The client selects a rendezvous point randomly from available relays. Only
+// relays whose ntor onion key we know can be used, since the service needs
+// it to extend its circuit there.
 func (rp *RendezvousProtocol) SelectRendezvousPoint(relays []*HSDirectory) (*HSDirectory, error) {
-	if len(relays) == 0 {
+	candidates := make([]*HSDirectory, 0, len(relays))
+	for _, relay := range relays {
+		if relay != nil && len(relay.NtorOnionKey) == 32 {
+			candidates = append(candidates, relay)
+		}
+	}
+	if len(candidates) == 0 {
 		return nil, fmt.Errorf("no relays available for rendezvous point selection")
 	}
 
-	// For Phase 7.3.4, select the first available relay
-	// In a full implementation, this would:
-	// 1. Filter relays that support being rendezvous points
-	// 2. Exclude relays that are already in our circuit
-	// 3. Randomly select from remaining relays
-	// 4. Consider relay stability and performance metrics
-	selected := relays[0]
+	index, err := randomIndex(len(candidates))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select rendezvous point: %w", err)
+	}
+	selected := candidates[index]
 
 	rp.logger.Debug("Selected rendezvous point",
-		"relays_available", len(relays),
+		"relays_available", len(candidates),
 		"selected_fingerprint", selected.Fingerprint)
 
 	return selected, nil
@@ -1842,82 +1781,64 @@ func (rp *RendezvousProtocol) BuildEstablishRendezvousCell(req *EstablishRendezv
 }
 
 // CreateRendezvousCircuit creates a circuit to a rendezvous point
-func (rp *RendezvousProtocol) CreateRendezvousCircuit(ctx context.Context, rendezvousPoint *HSDirectory, circuitBuilder CircuitBuilder) (uint32, error) {
+func (rp *RendezvousProtocol) CreateRendezvousCircuit(ctx context.Context, rendezvousPoint *HSDirectory, circuitBuilder CircuitBuilder) (*circuit.Circuit, error) {
 	if rendezvousPoint == nil {
-		return 0, fmt.Errorf("rendezvous point is nil")
+		return nil, fmt.Errorf("rendezvous point is nil")
+	}
+	if circuitBuilder == nil {
+		return nil, fmt.Errorf("no circuit builder configured")
 	}
 
 	rp.logger.Info("Creating rendezvous circuit",
 		"rendezvous_point", rendezvousPoint.Fingerprint)
 
-	// If we have a circuit builder, use it to create a real circuit
-	if circuitBuilder != nil {
-		// Build circuit to the rendezvous point with 5 second timeout
-		circuitID, err := circuitBuilder.BuildCircuitToRelay(ctx, rendezvousPoint, 5*time.Second)
-		if err != nil {
-			rp.logger.Error("Failed to build rendezvous circuit", "error", err)
-			return 0, fmt.Errorf("failed to build circuit: %w", err)
-		}
-
-		rp.logger.Info("Rendezvous circuit created",
-			"circuit_id", circuitID)
-		return circuitID, nil
+	circ, err := circuitBuilder.BuildCircuitToRelay(ctx, rendezvousPoint, hsCircuitBuildTimeout)
+	if err != nil {
+		rp.logger.Error("Failed to build rendezvous circuit", "error", err)
+		return nil, fmt.Errorf("failed to build circuit: %w", err)
 	}
 
-	// Fallback: Mock circuit ID for testing when no circuit builder is available
-	circuitID := uint32(2000)
-	rp.logger.Debug("Rendezvous circuit created (mock - no circuit builder)",
-		"circuit_id", circuitID)
+	// Make the circuit look like a general one to the middle relay's guard
+	if err := circ.StartPaddingMachine(circuit.RendCircuitPaddingMachine()); err != nil {
+		rp.logger.Debug("Rendezvous circuit padding not started", "error", err)
+	}
 
-	return circuitID, nil
+	rp.logger.Info("Rendezvous circuit created", "circuit_id", circ.ID)
+	return circ, nil
 }
 
 // SendEstablishRendezvous sends an ESTABLISH_RENDEZVOUS cell over a circuit
-func (rp *RendezvousProtocol) SendEstablishRendezvous(ctx context.Context, circuitID uint32, establishData []byte, cellSender CellSender) error {
+// and waits for RENDEZVOUS_ESTABLISHED
+func (rp *RendezvousProtocol) SendEstablishRendezvous(ctx context.Context, circ *circuit.Circuit, establishData []byte) error {
 	if len(establishData) == 0 {
 		return fmt.Errorf("establish rendezvous data is empty")
 	}
+	if circ == nil {
+		return fmt.Errorf("rendezvous circuit is nil")
+	}
 
 	rp.logger.Info("Sending ESTABLISH_RENDEZVOUS cell",
-		"circuit_id", circuitID,
+		"circuit_id", circ.ID,
 		"data_size", len(establishData))
 
-	// If we have a cell sender, use it to send the cell
-	if cellSender != nil {
-		const RELAY_COMMAND_ESTABLISH_RENDEZVOUS = 0x21 // Per Tor spec
-
-		// Send the ESTABLISH_RENDEZVOUS cell over the circuit
-		if err := cellSender.SendRelayCell(ctx, circuitID, RELAY_COMMAND_ESTABLISH_RENDEZVOUS, establishData); err != nil {
-			rp.logger.Error("Failed to send ESTABLISH_RENDEZVOUS cell", "error", err)
-			return fmt.Errorf("failed to send ESTABLISH_RENDEZVOUS: %w", err)
-		}
-
-		// Wait for RENDEZVOUS_ESTABLISHED acknowledgment with timeout
-		ackCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		defer cancel()
-
-		const RELAY_COMMAND_RENDEZVOUS_ESTABLISHED = 0x27
-		ackData, err := cellSender.ReceiveRelayCell(ackCtx, circuitID, 5*time.Second)
-		if err != nil {
-			rp.logger.Warn("Did not receive RENDEZVOUS_ESTABLISHED (continuing anyway)", "error", err)
-			// Don't fail - the rendezvous point might have accepted it
-		} else {
-			rp.logger.Debug("Received RENDEZVOUS_ESTABLISHED", "data_len", len(ackData))
-		}
+	if err := circ.SendRelayCell(cell.NewRelayCell(0, cell.RelayEstablishRendezvous, establishData)); err != nil {
+		return fmt.Errorf("failed to send ESTABLISH_RENDEZVOUS: %w", err)
+	}
 
-		rp.logger.Info("ESTABLISH_RENDEZVOUS completed successfully")
-		return nil
+	ackCtx, cancel := context.WithTimeout(ctx, introduceAckTimeout)
+	defer cancel()
+	if _, err := awaitRelayCell(ackCtx, circ, cell.RelayRendezvousEstablished); err != nil {
+		return fmt.Errorf("failed to receive RENDEZVOUS_ESTABLISHED: %w", err)
 	}
 
-	// Fallback: Mock sending when no cell sender is available
-	rp.logger.Debug("ESTABLISH_RENDEZVOUS cell sent (mock - no cell sender)")
+	rp.logger.Info("ESTABLISH_RENDEZVOUS completed successfully")
 	return nil
 }
 
 // Rendezvous1Request represents a RENDEZVOUS1 request
 type Rendezvous1Request struct {
 	RendezvousCookie []byte // Rendezvous cookie (20 bytes)
-	HandshakeData    []byte // Handshake data from INTRODUCE2
+	HandshakeData    []byte // hs-ntor SERVER_PK | AUTH (64 bytes)
 }
 
 // BuildRendezvous1Cell constructs a RENDEZVOUS1 cell
@@ -1925,11 +1846,10 @@ type Rendezvous1Request struct {
 //
 //	RENDEZVOUS1 {
 //	  RENDEZVOUS_COOKIE [20 bytes]
-//	  HANDSHAKE_DATA    [remaining bytes]
+//	  HANDSHAKE_INFO    [64 bytes]
 //	}
 //
-// Note: RENDEZVOUS1 is sent by the hidden service, not the client.
-// This function is included for completeness but won't be used in client-only implementation.
+// RENDEZVOUS1 is sent by the onion service to the rendezvous point.
 func (rp *RendezvousProtocol) BuildRendezvous1Cell(req *Rendezvous1Request) ([]byte, error) {
 	if req == nil {
 		return nil, fmt.Errorf("rendezvous1 request is nil")
@@ -1937,195 +1857,165 @@ func (rp *RendezvousProtocol) BuildRendezvous1Cell(req *Rendezvous1Request) ([]b
 	if len(req.RendezvousCookie) != 20 {
 		return nil, fmt.Errorf("invalid rendezvous cookie length: %d, expected 20", len(req.RendezvousCookie))
 	}
+	if len(req.HandshakeData) != rendezvousHandshakeLen {
+		return nil, fmt.Errorf("invalid handshake data length: %d, expected %d", len(req.HandshakeData), rendezvousHandshakeLen)
+	}
 
 	rp.logger.Debug("Building RENDEZVOUS1 cell",
 		"cookie_len", len(req.RendezvousCookie),
 		"handshake_data_len", len(req.HandshakeData))
 
 	var buf bytes.Buffer
-
-	// RENDEZVOUS_COOKIE (20 bytes)
 	buf.Write(req.RendezvousCookie)
-
-	// HANDSHAKE_DATA
-	if len(req.HandshakeData) > 0 {
-		buf.Write(req.HandshakeData)
-	}
+	buf.Write(req.HandshakeData)
 
 	rp.logger.Debug("Built RENDEZVOUS1 cell", "size", buf.Len())
 
 	return buf.Bytes(), nil
 }
 
-// ParseRendezvous2Cell parses a RENDEZVOUS2 cell
+// ParseRendezvous2Cell parses a RENDEZVOUS2 cell and returns its
+// HANDSHAKE_INFO (SERVER_PK | AUTH)
 // Per Tor spec (rend-spec-v3.txt section 3.4):
 //
 //	RENDEZVOUS2 {
-//	  HANDSHAKE_DATA [remaining bytes]
+//	  HANDSHAKE_INFO [64 bytes]
 //	}
 func (rp *RendezvousProtocol) ParseRendezvous2Cell(data []byte) ([]byte, error) {
-	if len(data) == 0 {
-		return nil, fmt.Errorf("rendezvous2 data is empty")
+	if len(data) < rendezvousHandshakeLen {
+		return nil, fmt.Errorf("rendezvous2 data too short: %d bytes", len(data))
 	}
 
 	rp.logger.Debug("Parsing RENDEZVOUS2 cell", "size", len(data))
 
-	// The entire cell is handshake data
-	handshakeData := make([]byte, len(data))
+	handshakeData := make([]byte, rendezvousHandshakeLen)
 	copy(handshakeData, data)
 
-	rp.logger.Debug("Parsed RENDEZVOUS2 cell", "handshake_data_len", len(handshakeData))
-
 	return handshakeData, nil
 }
 
 // WaitForRendezvous2 waits for a RENDEZVOUS2 cell on a circuit
-func (rp *RendezvousProtocol) WaitForRendezvous2(ctx context.Context, circuitID uint32, cellSender CellSender) ([]byte, error) {
-	rp.logger.Info("Waiting for RENDEZVOUS2 cell", "circuit_id", circuitID)
-
-	// If we have a cell sender, use it to receive the cell
-	if cellSender != nil {
-		// Wait for RENDEZVOUS2 cell with 30 second timeout (onion services can be slow)
-		const RELAY_COMMAND_RENDEZVOUS2 = 0x25
+func (rp *RendezvousProtocol) WaitForRendezvous2(ctx context.Context, circ *circuit.Circuit) ([]byte, error) {
+	if circ == nil {
+		return nil, fmt.Errorf("rendezvous circuit is nil")
+	}
 
-		waitCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
+	rp.logger.Info("Waiting for RENDEZVOUS2 cell", "circuit_id", circ.ID)
 
-		handshakeData, err := cellSender.ReceiveRelayCell(waitCtx, circuitID, 30*time.Second)
-		if err != nil {
-			rp.logger.Error("Failed to receive RENDEZVOUS2 cell", "error", err)
-			return nil, fmt.Errorf("failed to receive RENDEZVOUS2: %w", err)
-		}
+	// Onion services can be slow to build their circuit to us
+	waitCtx, cancel := context.WithTimeout(ctx, rendezvous2Timeout)
+	defer cancel()
 
-		// Parse the RENDEZVOUS2 cell
-		parsedData, err := rp.ParseRendezvous2Cell(handshakeData)
-		if err != nil {
-			rp.logger.Error("Failed to parse RENDEZVOUS2 cell", "error", err)
-			return nil, fmt.Errorf("failed to parse RENDEZVOUS2: %w", err)
-		}
-
-		rp.logger.Info("Received RENDEZVOUS2 cell", "handshake_data_len", len(parsedData))
-		return parsedData, nil
+	rendezvous2, err := awaitRelayCell(waitCtx, circ, cell.RelayRendezvous2)
+	if err != nil {
+		rp.logger.Error("Failed to receive RENDEZVOUS2 cell", "error", err)
+		return nil, fmt.Errorf("failed to receive RENDEZVOUS2: %w", err)
 	}
 
-	// Fallback: Mock handshake data when no cell sender is available
-	handshakeData := make([]byte, 32)
-	rp.logger.Debug("Received RENDEZVOUS2 cell (mock - no cell sender)", "handshake_data_len", len(handshakeData))
+	handshakeData, err := rp.ParseRendezvous2Cell(rendezvous2.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RENDEZVOUS2: %w", err)
+	}
 
+	rp.logger.Info("Received RENDEZVOUS2 cell", "handshake_data_len", len(handshakeData))
 	return handshakeData, nil
 }
 
 // EstablishRendezvousPoint orchestrates establishing a rendezvous point
 // This combines rendezvous point selection, circuit creation, and ESTABLISH_RENDEZVOUS
-func (c *Client) EstablishRendezvousPoint(ctx context.Context, rendezvousCookie []byte, relays []*HSDirectory) (uint32, *HSDirectory, error) {
+func (c *Client) EstablishRendezvousPoint(ctx context.Context, rendezvousCookie []byte, relays []*HSDirectory) (*circuit.Circuit, *HSDirectory, error) {
 	c.logger.Info("Establishing rendezvous point")
 
 	// Step 1: Select rendezvous point
 	rendezvous := NewRendezvousProtocol(c.logger)
 	rendezvousPoint, err := rendezvous.SelectRendezvousPoint(relays)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to select rendezvous point: %w", err)
+		return nil, nil, fmt.Errorf("failed to select rendezvous point: %w", err)
 	}
 
 	c.logger.Debug("Rendezvous point selected", "fingerprint", rendezvousPoint.Fingerprint)
 
-	// Step 2: Create circuit to rendezvous point
-	circuitID, err := rendezvous.CreateRendezvousCircuit(ctx, rendezvousPoint, c.circuitBuilder)
-	if err != nil {
-		return 0, nil, fmt.Errorf("failed to create rendezvous circuit: %w", err)
-	}
-
-	c.logger.Debug("Rendezvous circuit created", "circuit_id", circuitID)
-
-	// Step 3: Build and send ESTABLISH_RENDEZVOUS cell
-	req := &EstablishRendezvousRequest{
+	// Step 2: Build ESTABLISH_RENDEZVOUS cell
+	establishData, err := rendezvous.BuildEstablishRendezvousCell(&EstablishRendezvousRequest{
 		RendezvousCookie: rendezvousCookie,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build ESTABLISH_RENDEZVOUS cell: %w", err)
 	}
 
-	establishData, err := rendezvous.BuildEstablishRendezvousCell(req)
+	// Step 3: Create circuit to rendezvous point
+	_, builder := c.network()
+	circ, err := rendezvous.CreateRendezvousCircuit(ctx, rendezvousPoint, builder)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to build ESTABLISH_RENDEZVOUS cell: %w", err)
+		return nil, nil, fmt.Errorf("failed to create rendezvous circuit: %w", err)
 	}
 
-	if err := rendezvous.SendEstablishRendezvous(ctx, circuitID, establishData, c.cellSender); err != nil {
-		return 0, nil, fmt.Errorf("failed to send ESTABLISH_RENDEZVOUS: %w", err)
+	c.logger.Debug("Rendezvous circuit created", "circuit_id", circ.ID)
+
+	// Step 4: Send ESTABLISH_RENDEZVOUS cell
+	if err := rendezvous.SendEstablishRendezvous(ctx, circ, establishData); err != nil {
+		if closeErr := circ.Close(); closeErr != nil {
+			c.logger.Debug("Failed to close rendezvous circuit", "error", closeErr)
+		}
+		return nil, nil, fmt.Errorf("failed to send ESTABLISH_RENDEZVOUS: %w", err)
 	}
 
 	c.logger.Info("Successfully established rendezvous point",
-		"circuit_id", circuitID,
+		"circuit_id", circ.ID,
 		"fingerprint", rendezvousPoint.Fingerprint)
 
-	return circuitID, rendezvousPoint, nil
+	return circ, rendezvousPoint, nil
 }
 
-// CompleteRendezvous completes the rendezvous protocol
-// This waits for RENDEZVOUS2 and establishes the final connection
-func (c *Client) CompleteRendezvous(ctx context.Context, rendezvousCircuitID uint32) error {
-	c.logger.Info("Completing rendezvous protocol", "circuit_id", rendezvousCircuitID)
-
-	// AUDIT-006: Retrieve the stored ephemeral key state
-	state, ok := c.GetRendezvousState(rendezvousCircuitID)
-	if !ok {
-		c.logger.Warn("No rendezvous state found for circuit", "circuit_id", rendezvousCircuitID)
-		// Continue with reduced security for backward compatibility
-		// In production, this should be an error
+// CompleteRendezvous completes the rendezvous protocol: it waits for
+// RENDEZVOUS2, verifies the service's hs-ntor reply and appends the service
+// to the rendezvous circuit as a virtual hop keyed with the session keys
+func (c *Client) CompleteRendezvous(ctx context.Context, rendCirc *circuit.Circuit, handshake *crypto.HsNtorClient) error {
+	if rendCirc == nil {
+		return fmt.Errorf("rendezvous circuit is nil")
+	}
+	if handshake == nil {
+		return fmt.Errorf("hs-ntor handshake is nil")
 	}
 
-	// Wait for RENDEZVOUS2 cell from the hidden service
+	c.logger.Info("Completing rendezvous protocol", "circuit_id", rendCirc.ID)
+
 	rendezvous := NewRendezvousProtocol(c.logger)
-	handshakeData, err := rendezvous.WaitForRendezvous2(ctx, rendezvousCircuitID, c.cellSender)
+	handshakeData, err := rendezvous.WaitForRendezvous2(ctx, rendCirc)
 	if err != nil {
-		return fmt.Errorf("failed to receive RENDEZVOUS2: %w", err)
+		return err
 	}
 
-	c.logger.Debug("Received RENDEZVOUS2", "handshake_data_len", len(handshakeData))
-
-	// AUDIT-006: Implement full handshake verification per rend-spec-v3.txt
-	if state != nil && len(handshakeData) >= 32 {
-		c.logger.Debug("Verifying RENDEZVOUS2 handshake")
-
-		// The handshakeData should contain the service's ephemeral public key (Y)
-		// Per rend-spec-v3.txt, we perform X25519 key exchange:
-		// shared_secret = X25519(client_private, service_public)
-
-		if len(handshakeData) < 32 {
-			c.RemoveRendezvousState(rendezvousCircuitID)
-			return fmt.Errorf("invalid RENDEZVOUS2 handshake data length: %d", len(handshakeData))
-		}
-
-		var servicePublic [32]byte
-		copy(servicePublic[:], handshakeData[:32])
+	if err := circuit.NewExtension(rendCirc, c.logger).CompleteRendezvous(handshake, handshakeData); err != nil {
+		return fmt.Errorf("failed to add onion service hop: %w", err)
+	}
 
-		// Perform X25519 Diffie-Hellman
-		var sharedSecret [32]byte
-		curve25519.ScalarMult(&sharedSecret, &state.EphemeralPrivate, &servicePublic)
+	c.logger.Info("Rendezvous protocol completed successfully", "hops", rendCirc.Length())
+	return nil
+}
 
-		// Derive session keys using HKDF-SHA256
-		// Per rend-spec-v3.txt, derive keys for forward and backward encryption
-		info := []byte("tor-hs-rendezvous-keys")
-		sessionKeys, err := deriveKey(sharedSecret[:], info, 64) // 32 bytes each direction
+// awaitRelayCell waits for a relay cell with the given command on a circuit,
+// skipping any others
+func awaitRelayCell(ctx context.Context, circ *circuit.Circuit, command byte) (*cell.RelayCell, error) {
+	for {
+		relayCell, err := circ.ReceiveRelayCell(ctx)
 		if err != nil {
-			c.RemoveRendezvousState(rendezvousCircuitID)
-			return fmt.Errorf("failed to derive session keys: %w", err)
+			return nil, err
+		}
+		if relayCell.Command == command {
+			return relayCell, nil
+		}
+		if relayCell.Command == cell.RelayTruncated || relayCell.Command == cell.RelayEnd && relayCell.StreamID == 0 {
+			return nil, fmt.Errorf("circuit closed by relay while waiting for %s", cell.RelayCmdString(command))
 		}
-
-		c.logger.Info("Handshake verified successfully",
-			"forward_key_len", len(sessionKeys)/2,
-			"backward_key_len", len(sessionKeys)/2)
-
-		// TODO: Store session keys for stream encryption (sessionKeys[0:32], sessionKeys[32:64])
-		// This would be used by the circuit layer for encrypting/decrypting stream data
-		// For now, we securely zero them since circuit encryption is handled elsewhere
-		defer security.SecureZeroMemory(sessionKeys)
-
-		// Securely zero the shared secret
-		security.SecureZeroMemory(sharedSecret[:])
-
-		// Clean up the rendezvous state (which zeros the private key)
-		c.RemoveRendezvousState(rendezvousCircuitID)
 	}
+}
 
-	c.logger.Info("Rendezvous protocol completed successfully")
-
-	return nil
+// randomIndex returns a uniformly random index in [0, n)
+func randomIndex(n int) (int, error) {
+	index, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(index.Int64()), nil
 }
@@ -8,13 +8,18 @@ import (
 	"encoding/base32"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"strings"
 	"testing"
 	"time"
 
-	"golang.org/x/crypto/curve25519"
-
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/circuit"
+	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/directory"
 	"github.com/opd-ai/go-tor/pkg/logger"
+	"github.com/opd-ai/go-tor/pkg/path"
+	"github.com/opd-ai/go-tor/pkg/relaytest"
 )
 
 // TestParseV3Address tests parsing of v3 onion addresses
@@ -326,7 +331,7 @@ func TestDescriptorCache(t *testing.T) {
 		Version:         3,
 		Address:         addr,
 		BlindedPubkey:   addr.Pubkey,
-		DescriptorID:    computeDescriptorID(addr.Pubkey),
+		DescriptorID:    addr.Pubkey,
 		RevisionCounter: 1,
 		CreatedAt:       time.Now(),
 		Lifetime:        1 * time.Hour,
@@ -383,7 +388,7 @@ func TestDescriptorCacheExpiration(t *testing.T) {
 		Version:         3,
 		Address:         addr,
 		BlindedPubkey:   addr.Pubkey,
-		DescriptorID:    computeDescriptorID(addr.Pubkey),
+		DescriptorID:    addr.Pubkey,
 		RevisionCounter: 1,
 		CreatedAt:       time.Now(),
 		Lifetime:        100 * time.Millisecond, // Short lifetime for testing
@@ -458,23 +463,31 @@ func TestComputeBlindedPubkey(t *testing.T) {
 	timePeriod := uint64(12345)
 
 	// Compute blinded key
-	blinded := ComputeBlindedPubkey(pubkey, timePeriod)
+	blinded, err := ComputeBlindedPubkey(pubkey, timePeriod, defaultPeriodLength)
+	if err != nil {
+		t.Fatalf("Failed to blind key: %v", err)
+	}
 
 	if len(blinded) != 32 {
 		t.Errorf("Expected blinded key length 32, got %d", len(blinded))
 	}
 
 	// Same inputs should produce same output
-	blinded2 := ComputeBlindedPubkey(pubkey, timePeriod)
+	blinded2, _ := ComputeBlindedPubkey(pubkey, timePeriod, defaultPeriodLength)
 	if !bytes.Equal(blinded, blinded2) {
 		t.Error("Expected deterministic blinded key computation")
 	}
 
 	// Different time period should produce different output
-	blinded3 := ComputeBlindedPubkey(pubkey, timePeriod+1)
+	blinded3, _ := ComputeBlindedPubkey(pubkey, timePeriod+1, defaultPeriodLength)
 	if bytes.Equal(blinded, blinded3) {
 		t.Error("Expected different blinded key for different time period")
 	}
+
+	// Invalid keys are rejected
+	if _, err := ComputeBlindedPubkey(pubkey[:31], timePeriod, defaultPeriodLength); err == nil {
+		t.Error("Expected error for short public key")
+	}
 }
 
 // TestGetTimePeriod tests time period calculation
@@ -502,6 +515,15 @@ func TestGetTimePeriod(t *testing.T) {
 	if period == period3 {
 		t.Error("Expected different period after 24 hours")
 	}
+
+	// Example from rend-spec-v3.txt section 2.2.1: periods start at 12:00 UTC
+	specTime := time.Date(2016, 4, 13, 11, 15, 1, 0, time.UTC)
+	if got := GetTimePeriod(specTime); got != 16903 {
+		t.Errorf("GetTimePeriod(%v) = %d, want 16903", specTime, got)
+	}
+	if got := GetTimePeriod(time.Date(2016, 4, 13, 12, 0, 0, 0, time.UTC)); got != 16904 {
+		t.Errorf("Expected period 16904 to start at 12:00 UTC, got %d", got)
+	}
 }
 
 // TestParseDescriptor tests descriptor parsing
@@ -535,46 +557,31 @@ revision-counter 42
 	})
 
 	t.Run("descriptor with introduction points", func(t *testing.T) {
-		// Create a descriptor with introduction point data
-		onionKey := []byte("test-onion-key-32-bytes-long!!")
-		authKey := []byte("test-auth-key-32-bytes-long!!!")
-		encKey := []byte("test-enc-key-32-bytes-long!!!!")
-		legacyKey := []byte("legacy-key-20-bytes!")
+		desc, _ := newTestDescriptor(t)
 
-		rawDesc := fmt.Sprintf(`hs-descriptor 3
-descriptor-lifetime 180
-revision-counter 42
-superencrypted
------BEGIN MESSAGE-----
-introduction-point 0
-onion-key ntor %s
-auth-key
-%s
-enc-key ntor %s
-legacy-key %s
------END MESSAGE-----
-signature %s
-`,
-			base64.StdEncoding.EncodeToString(onionKey),
-			base64.StdEncoding.EncodeToString(authKey),
-			base64.StdEncoding.EncodeToString(encKey),
-			base64.StdEncoding.EncodeToString(legacyKey),
-			base64.StdEncoding.EncodeToString([]byte("test-signature")))
-
-		desc, err := ParseDescriptor([]byte(rawDesc))
+		parsed, err := ParseDescriptor(desc.RawDescriptor)
 		if err != nil {
 			t.Fatalf("Failed to parse descriptor: %v", err)
 		}
 
-		if desc.Version != 3 {
-			t.Errorf("Expected version 3, got %d", desc.Version)
+		if parsed.Version != 3 {
+			t.Errorf("Expected version 3, got %d", parsed.Version)
+		}
+
+		// Introduction points stay encrypted until DecryptDescriptor
+		if len(parsed.IntroPoints) != 0 {
+			t.Errorf("Expected no plaintext introduction points, got %d", len(parsed.IntroPoints))
+		}
+
+		if len(parsed.Superencrypted) == 0 {
+			t.Error("Expected superencrypted section to be parsed")
 		}
 
-		if len(desc.IntroPoints) != 1 {
-			t.Errorf("Expected 1 introduction point, got %d", len(desc.IntroPoints))
+		if !bytes.Equal(parsed.DescriptorSigningKeyCert, desc.DescriptorSigningKeyCert) {
+			t.Error("Expected descriptor signing key certificate to be parsed")
 		}
 
-		if len(desc.Signature) == 0 {
+		if len(parsed.Signature) == 0 {
 			t.Error("Expected signature to be parsed")
 		}
 	})
@@ -599,9 +606,12 @@ descriptor-lifetime 180
 
 // TestEncodeDescriptor tests descriptor encoding
 func TestEncodeDescriptor(t *testing.T) {
+	_, service := newTestDescriptor(t)
+
 	t.Run("basic descriptor", func(t *testing.T) {
 		desc := &Descriptor{
 			Version:         3,
+			Address:         service.address,
 			RevisionCounter: 123,
 			Lifetime:        3 * time.Hour,
 			DescriptorID:    make([]byte, 32),
@@ -631,54 +641,52 @@ func TestEncodeDescriptor(t *testing.T) {
 		if !bytes.Contains(encoded, []byte("descriptor-lifetime 180")) {
 			t.Error("Expected encoded descriptor to contain lifetime")
 		}
-	})
 
-	t.Run("descriptor with introduction points", func(t *testing.T) {
-		intro := IntroductionPoint{
-			OnionKey:    []byte("test-onion-key-32-bytes-long!!"),
-			AuthKey:     []byte("test-auth-key-32-bytes-long!!!"),
-			EncKey:      []byte("test-enc-key-32-bytes-long!!!!"),
-			LegacyKeyID: []byte("legacy-key-20-bytes!"),
-			LinkSpecifiers: []LinkSpecifier{
-				{Type: 0, Data: []byte{127, 0, 0, 1}},
-			},
+		// Should contain the encrypted section
+		if !bytes.Contains(encoded, []byte("superencrypted\n-----BEGIN MESSAGE-----\n")) {
+			t.Error("Expected encoded descriptor to contain superencrypted section")
 		}
+	})
 
-		desc := &Descriptor{
-			Version:         3,
-			RevisionCounter: 123,
-			Lifetime:        3 * time.Hour,
-			DescriptorID:    make([]byte, 32),
-			IntroPoints:     []IntroductionPoint{intro},
-			Signature:       []byte("test-signature"),
-		}
+	t.Run("descriptor with introduction points", func(t *testing.T) {
+		desc, _ := newTestDescriptor(t)
+		desc.Signature = []byte("test-signature")
 
 		encoded, err := EncodeDescriptor(desc)
 		if err != nil {
 			t.Fatalf("Failed to encode descriptor: %v", err)
 		}
 
-		// Should contain introduction point marker
-		if !bytes.Contains(encoded, []byte("introduction-point")) {
-			t.Error("Expected encoded descriptor to contain introduction point")
+		// Introduction points must only appear encrypted
+		for _, keyword := range []string{"introduction-point", "onion-key", "auth-key", "enc-key"} {
+			if bytes.Contains(encoded, []byte(keyword)) {
+				t.Errorf("Expected %s to be encrypted", keyword)
+			}
 		}
 
-		// Should contain keys
-		if !bytes.Contains(encoded, []byte("onion-key")) {
-			t.Error("Expected encoded descriptor to contain onion-key")
+		if !bytes.Contains(encoded, []byte("descriptor-signing-key-cert\n-----BEGIN ED25519 CERT-----\n")) {
+			t.Error("Expected encoded descriptor to contain signing key certificate")
 		}
 
-		if !bytes.Contains(encoded, []byte("auth-key")) {
-			t.Error("Expected encoded descriptor to contain auth-key")
+		// Should contain signature
+		if !bytes.Contains(encoded, []byte("signature")) {
+			t.Error("Expected encoded descriptor to contain signature")
 		}
+	})
+
+	t.Run("introduction point without certificates", func(t *testing.T) {
+		desc, _ := newTestDescriptor(t)
+		desc.IntroPoints[0].EncKeyCert = nil
 
-		if !bytes.Contains(encoded, []byte("enc-key")) {
-			t.Error("Expected encoded descriptor to contain enc-key")
+		if _, err := EncodeDescriptor(desc); err == nil {
+			t.Error("Expected error for introduction point without enc-key-cert")
 		}
+	})
 
-		// Should contain signature
-		if !bytes.Contains(encoded, []byte("signature")) {
-			t.Error("Expected encoded descriptor to contain signature")
+	t.Run("descriptor without address", func(t *testing.T) {
+		_, err := EncodeDescriptor(&Descriptor{Version: 3, Lifetime: 3 * time.Hour})
+		if err == nil {
+			t.Error("Expected error for descriptor without address")
 		}
 	})
 
@@ -692,6 +700,7 @@ func TestEncodeDescriptor(t *testing.T) {
 	t.Run("round-trip encode/decode", func(t *testing.T) {
 		original := &Descriptor{
 			Version:         3,
+			Address:         service.address,
 			RevisionCounter: 999,
 			Lifetime:        2 * time.Hour,
 			IntroPoints:     make([]IntroductionPoint, 0),
@@ -721,28 +730,11 @@ func TestEncodeDescriptor(t *testing.T) {
 		if decoded.Lifetime != original.Lifetime {
 			t.Errorf("Lifetime mismatch: expected %v, got %v", original.Lifetime, decoded.Lifetime)
 		}
-	})
-}
-
-// TestComputeDescriptorID tests descriptor ID computation
-func TestComputeDescriptorID(t *testing.T) {
-	// Generate test key
-	pubkey, _, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		t.Fatalf("Failed to generate key: %v", err)
-	}
-
-	descID := computeDescriptorID(pubkey)
 
-	if len(descID) != 32 {
-		t.Errorf("Expected descriptor ID length 32, got %d", len(descID))
-	}
-
-	// Same input should produce same output
-	descID2 := computeDescriptorID(pubkey)
-	if !bytes.Equal(descID, descID2) {
-		t.Error("Expected deterministic descriptor ID computation")
-	}
+		if err := DecryptDescriptor(decoded, service.address); err != nil {
+			t.Errorf("Failed to decrypt: %v", err)
+		}
+	})
 }
 
 // BenchmarkDescriptorCache benchmarks descriptor cache operations
@@ -754,7 +746,7 @@ func BenchmarkDescriptorCache(b *testing.B) {
 		Version:         3,
 		Address:         addr,
 		BlindedPubkey:   addr.Pubkey,
-		DescriptorID:    computeDescriptorID(addr.Pubkey),
+		DescriptorID:    addr.Pubkey,
 		RevisionCounter: 1,
 		CreatedAt:       time.Now(),
 		Lifetime:        1 * time.Hour,
@@ -774,7 +766,7 @@ func BenchmarkComputeBlindedPubkey(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ComputeBlindedPubkey(pubkey, timePeriod)
+		_, _ = ComputeBlindedPubkey(pubkey, timePeriod, defaultPeriodLength)
 	}
 }
 
@@ -783,158 +775,45 @@ func TestHSDirSelection(t *testing.T) {
 	log := logger.NewDefault()
 	hsdir := NewHSDir(log)
 
-	// Create mock HSDirs
-	hsdirs := []*HSDirectory{
-		{Fingerprint: "0000000000000000000000000000000000000001", Address: "10.0.0.1", ORPort: 9001, HSDir: true},
-		{Fingerprint: "0000000000000000000000000000000000000002", Address: "10.0.0.2", ORPort: 9001, HSDir: true},
-		{Fingerprint: "0000000000000000000000000000000000000003", Address: "10.0.0.3", ORPort: 9001, HSDir: true},
-		{Fingerprint: "0000000000000000000000000000000000000004", Address: "10.0.0.4", ORPort: 9001, HSDir: true},
-		{Fingerprint: "0000000000000000000000000000000000000005", Address: "10.0.0.5", ORPort: 9001, HSDir: true},
-	}
-
-	// Generate a random descriptor ID
-	descriptorID := make([]byte, 32)
-	rand.Read(descriptorID)
+	hsdirs := testHashRingRelays(10)
+	ring := HashRing{PeriodNum: 16903, PeriodLength: defaultPeriodLength, SRV: bytes.Repeat([]byte{1}, 32)}
+	blindedKey := make([]byte, 32)
+	rand.Read(blindedKey)
 
-	// Test replica 0
-	selected := hsdir.SelectHSDirs(descriptorID, hsdirs, 0)
-	if len(selected) != 3 {
-		t.Errorf("Expected 3 selected HSDirs, got %d", len(selected))
+	// Two replicas with a spread of 3 give 6 distinct HSDirs
+	selected := hsdir.SelectHSDirs(ring, blindedKey, hsdirs, 2, 3)
+	if len(selected) != 6 {
+		t.Errorf("Expected 6 selected HSDirs, got %d", len(selected))
+	}
+	seen := make(map[string]bool)
+	for _, h := range selected {
+		if seen[h.Fingerprint] {
+			t.Errorf("HSDir %s selected twice", h.Fingerprint)
+		}
+		seen[h.Fingerprint] = true
 	}
 
-	// Test replica 1 - should select different HSDirs
-	selected1 := hsdir.SelectHSDirs(descriptorID, hsdirs, 1)
-	if len(selected1) != 3 {
-		t.Errorf("Expected 3 selected HSDirs for replica 1, got %d", len(selected1))
+	// Selection is deterministic
+	again := hsdir.SelectHSDirs(ring, blindedKey, hsdirs, 2, 3)
+	for i := range selected {
+		if selected[i] != again[i] {
+			t.Fatal("Expected deterministic selection")
+		}
 	}
 
 	// Test with fewer HSDirs than needed
-	smallHSDirs := hsdirs[:2]
-	selected2 := hsdir.SelectHSDirs(descriptorID, smallHSDirs, 0)
+	selected2 := hsdir.SelectHSDirs(ring, blindedKey, hsdirs[:2], 2, 3)
 	if len(selected2) != 2 {
 		t.Errorf("Expected 2 selected HSDirs (all available), got %d", len(selected2))
 	}
 
 	// Test with empty HSDir list
-	selected3 := hsdir.SelectHSDirs(descriptorID, []*HSDirectory{}, 0)
+	selected3 := hsdir.SelectHSDirs(ring, blindedKey, []*HSDirectory{}, 2, 3)
 	if selected3 != nil {
 		t.Error("Expected nil for empty HSDir list")
 	}
 }
 
-// TestComputeReplicaDescriptorID tests replica descriptor ID computation
-func TestComputeReplicaDescriptorID(t *testing.T) {
-	baseID := make([]byte, 32)
-	rand.Read(baseID)
-
-	// Replica 0 and replica 1 should produce different IDs
-	replica0 := ComputeReplicaDescriptorID(baseID, 0)
-	replica1 := ComputeReplicaDescriptorID(baseID, 1)
-
-	if bytes.Equal(replica0, replica1) {
-		t.Error("Expected different descriptor IDs for different replicas")
-	}
-
-	// Same replica should produce same ID
-	replica0_again := ComputeReplicaDescriptorID(baseID, 0)
-	if !bytes.Equal(replica0, replica0_again) {
-		t.Error("Expected deterministic descriptor ID computation")
-	}
-
-	// Check length
-	if len(replica0) != 32 {
-		t.Errorf("Expected descriptor ID length 32, got %d", len(replica0))
-	}
-}
-
-// TestComputeXORDistance tests XOR distance computation
-func TestComputeXORDistance(t *testing.T) {
-	tests := []struct {
-		name     string
-		a        []byte
-		b        []byte
-		expected []byte
-	}{
-		{
-			name:     "same values",
-			a:        []byte{0xFF, 0x00, 0xAA},
-			b:        []byte{0xFF, 0x00, 0xAA},
-			expected: []byte{0x00, 0x00, 0x00},
-		},
-		{
-			name:     "different values",
-			a:        []byte{0xFF, 0x00},
-			b:        []byte{0x00, 0xFF},
-			expected: []byte{0xFF, 0xFF},
-		},
-		{
-			name:     "partial match",
-			a:        []byte{0xF0, 0x0F},
-			b:        []byte{0x0F, 0xF0},
-			expected: []byte{0xFF, 0xFF},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := computeXORDistance(tt.a, tt.b)
-			if !bytes.Equal(result, tt.expected) {
-				t.Errorf("Expected %v, got %v", tt.expected, result)
-			}
-		})
-	}
-}
-
-// TestCompareBytes tests byte comparison
-func TestCompareBytes(t *testing.T) {
-	tests := []struct {
-		name     string
-		a        []byte
-		b        []byte
-		expected int
-	}{
-		{
-			name:     "equal",
-			a:        []byte{0x01, 0x02, 0x03},
-			b:        []byte{0x01, 0x02, 0x03},
-			expected: 0,
-		},
-		{
-			name:     "a less than b",
-			a:        []byte{0x01, 0x02},
-			b:        []byte{0x01, 0x03},
-			expected: -1,
-		},
-		{
-			name:     "a greater than b",
-			a:        []byte{0x02, 0x01},
-			b:        []byte{0x01, 0x01},
-			expected: 1,
-		},
-		{
-			name:     "a shorter than b",
-			a:        []byte{0x01},
-			b:        []byte{0x01, 0x02},
-			expected: -1,
-		},
-		{
-			name:     "a longer than b",
-			a:        []byte{0x01, 0x02},
-			b:        []byte{0x01},
-			expected: 1,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := compareBytes(tt.a, tt.b)
-			if result != tt.expected {
-				t.Errorf("Expected %d, got %d", tt.expected, result)
-			}
-		})
-	}
-}
-
 // TestHSDirFetchDescriptor tests descriptor fetching from HSDirs
 // AUDIT-003 FIX: Updated to expect proper errors instead of mock fallbacks
 func TestHSDirFetchDescriptor(t *testing.T) {
@@ -948,11 +827,7 @@ func TestHSDirFetchDescriptor(t *testing.T) {
 	}
 
 	// Create mock HSDirs (these won't respond)
-	hsdirs := []*HSDirectory{
-		{Fingerprint: "0000000000000000000000000000000000000001", Address: "10.0.0.1", ORPort: 9001, HSDir: true},
-		{Fingerprint: "0000000000000000000000000000000000000002", Address: "10.0.0.2", ORPort: 9001, HSDir: true},
-		{Fingerprint: "0000000000000000000000000000000000000003", Address: "10.0.0.3", ORPort: 9001, HSDir: true},
-	}
+	hsdirs := testHashRingRelays(3)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -1043,22 +918,15 @@ func BenchmarkHSDirSelection(b *testing.B) {
 	hsdir := NewHSDir(log)
 
 	// Create many mock HSDirs
-	hsdirs := make([]*HSDirectory, 100)
-	for i := 0; i < 100; i++ {
-		hsdirs[i] = &HSDirectory{
-			Fingerprint: string(make([]byte, 40)),
-			Address:     "10.0.0.1",
-			ORPort:      9001,
-			HSDir:       true,
-		}
-	}
+	hsdirs := testHashRingRelays(100)
+	ring := HashRing{PeriodNum: 16903, PeriodLength: defaultPeriodLength, SRV: make([]byte, 32)}
 
-	descriptorID := make([]byte, 32)
-	rand.Read(descriptorID)
+	blindedKey := make([]byte, 32)
+	rand.Read(blindedKey)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		hsdir.SelectHSDirs(descriptorID, hsdirs, 0)
+		hsdir.SelectHSDirs(ring, blindedKey, hsdirs, defaultReplicas, defaultSpreadFetch)
 	}
 }
 
@@ -1175,11 +1043,55 @@ func TestSelectIntroductionPoint(t *testing.T) {
 	}
 }
 
+// newTestIntroduction returns an introduction point, the service-side state
+// for it, and a rendezvous point, all with real keys
+func newTestIntroduction(t testing.TB) (*IntroductionPoint, *ServiceIntroPoint, *HSDirectory) {
+	t.Helper()
+
+	authKey, authPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate auth key: %v", err)
+	}
+	encKey, err := crypto.GenerateNtorKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate enc key: %v", err)
+	}
+	rpIdentity, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate relay identity: %v", err)
+	}
+
+	serviceIntro := &ServiceIntroPoint{
+		AuthKey:     authKey,
+		EncKey:      append([]byte(nil), encKey.Public[:]...),
+		authPrivate: authPrivate,
+		encPrivate:  encKey.Private,
+	}
+	introPoint := &IntroductionPoint{
+		AuthKey: serviceIntro.AuthKey,
+		EncKey:  serviceIntro.EncKey,
+	}
+	rendezvousPoint := &HSDirectory{
+		Fingerprint:  "0123456789ABCDEF0123456789ABCDEF01234567",
+		Address:      "192.0.2.7",
+		ORPort:       9001,
+		IdentityKey:  rpIdentity,
+		NtorOnionKey: bytes.Repeat([]byte{0x42}, 32),
+	}
+	return introPoint, serviceIntro, rendezvousPoint
+}
+
 // TestBuildIntroduce1Cell tests INTRODUCE1 cell construction
 func TestBuildIntroduce1Cell(t *testing.T) {
 	log := logger.NewDefault()
 	intro := NewIntroductionProtocol(log)
 
+	introPoint, _, rendezvousPoint := newTestIntroduction(t)
+	handshake, err := crypto.NewHsNtorClient(introPoint.AuthKey, introPoint.EncKey, make([]byte, 32))
+	if err != nil {
+		t.Fatalf("Failed to start hs-ntor handshake: %v", err)
+	}
+
 	rendezvousCookie := make([]byte, 20)
 	for i := range rendezvousCookie {
 		rendezvousCookie[i] = byte(i)
@@ -1190,8 +1102,6 @@ func TestBuildIntroduce1Cell(t *testing.T) {
 		request     *IntroduceRequest
 		wantErr     bool
 		errContains string
-		checkSize   bool
-		minSize     int
 	}{
 		{
 			name:        "nil request",
@@ -1211,36 +1121,63 @@ func TestBuildIntroduce1Cell(t *testing.T) {
 		{
 			name: "invalid rendezvous cookie length",
 			request: &IntroduceRequest{
-				IntroPoint:       &IntroductionPoint{AuthKey: make([]byte, 32)},
+				IntroPoint:       introPoint,
 				RendezvousCookie: make([]byte, 10), // Wrong length
 			},
 			wantErr:     true,
 			errContains: "invalid rendezvous cookie length",
 		},
 		{
-			name: "valid request with auth key",
+			name: "missing auth key",
 			request: &IntroduceRequest{
-				IntroPoint: &IntroductionPoint{
-					AuthKey: make([]byte, 32),
-				},
+				IntroPoint:       &IntroductionPoint{},
 				RendezvousCookie: rendezvousCookie,
-				RendezvousPoint:  "test-rendezvous-point",
-				OnionKey:         make([]byte, 32),
+				RendezvousPoint:  rendezvousPoint,
+				Handshake:        handshake,
 			},
-			wantErr:   false,
-			checkSize: true,
-			minSize:   75, // LEGACY_KEY_ID(20) + AUTH_KEY_TYPE(1) + AUTH_KEY_LEN(2) + AUTH_KEY(32) + EXT(1) + ENCRYPTED(>=20)
+			wantErr:     true,
+			errContains: "invalid auth key length",
 		},
 		{
-			name: "valid request without auth key",
+			name: "nil rendezvous point",
 			request: &IntroduceRequest{
-				IntroPoint:       &IntroductionPoint{},
+				IntroPoint:       introPoint,
+				RendezvousCookie: rendezvousCookie,
+				Handshake:        handshake,
+			},
+			wantErr:     true,
+			errContains: "rendezvous point is nil",
+		},
+		{
+			name: "rendezvous point without ntor key",
+			request: &IntroduceRequest{
+				IntroPoint:       introPoint,
+				RendezvousCookie: rendezvousCookie,
+				RendezvousPoint:  &HSDirectory{Fingerprint: rendezvousPoint.Fingerprint, Address: "192.0.2.7", ORPort: 9001},
+				Handshake:        handshake,
+			},
+			wantErr:     true,
+			errContains: "no ntor onion key",
+		},
+		{
+			name: "nil handshake",
+			request: &IntroduceRequest{
+				IntroPoint:       introPoint,
+				RendezvousCookie: rendezvousCookie,
+				RendezvousPoint:  rendezvousPoint,
+			},
+			wantErr:     true,
+			errContains: "hs-ntor handshake is nil",
+		},
+		{
+			name: "valid request",
+			request: &IntroduceRequest{
+				IntroPoint:       introPoint,
 				RendezvousCookie: rendezvousCookie,
-				RendezvousPoint:  "test-rendezvous-point",
+				RendezvousPoint:  rendezvousPoint,
+				Handshake:        handshake,
 			},
-			wantErr:   false,
-			checkSize: true,
-			minSize:   75,
+			wantErr: false,
 		},
 	}
 
@@ -1261,79 +1198,106 @@ func TestBuildIntroduce1Cell(t *testing.T) {
 				if err != nil {
 					t.Errorf("Unexpected error: %v", err)
 				}
-				if data == nil {
-					t.Error("Expected data but got nil")
-				}
-				if tt.checkSize && len(data) < tt.minSize {
-					t.Errorf("Cell data too small: got %d bytes, expected at least %d", len(data), tt.minSize)
+				// Padded so the length does not reveal the rendezvous point
+				if len(data) != introduce1MinLen {
+					t.Errorf("Cell data length = %d, want %d", len(data), introduce1MinLen)
 				}
 			}
 		})
 	}
 }
 
+// failingCircuitBuilder is a CircuitBuilder that records the relay it was
+// asked for and fails
+type failingCircuitBuilder struct {
+	relay *HSDirectory
+}
+
+func (b *failingCircuitBuilder) BuildCircuitToRelay(ctx context.Context, relay *HSDirectory, timeout time.Duration) (*circuit.Circuit, error) {
+	b.relay = relay
+	return nil, fmt.Errorf("no network")
+}
+
 // TestCreateIntroductionCircuit tests introduction circuit creation
 func TestCreateIntroductionCircuit(t *testing.T) {
 	log := logger.NewDefault()
 	intro := NewIntroductionProtocol(log)
 	ctx := context.Background()
 
+	reachable := &IntroductionPoint{
+		OnionKey: make([]byte, 32),
+		AuthKey:  make([]byte, 32),
+		LinkSpecifiers: []LinkSpecifier{
+			{Type: LinkSpecIPv4, Data: []byte{192, 168, 1, 1, 0x23, 0x29}},
+			{Type: LinkSpecLegacyID, Data: bytes.Repeat([]byte{0xAB}, 20)},
+		},
+	}
+
 	tests := []struct {
 		name        string
 		introPoint  *IntroductionPoint
-		wantErr     bool
+		builder     CircuitBuilder
 		errContains string
 	}{
 		{
 			name:        "nil introduction point",
 			introPoint:  nil,
-			wantErr:     true,
+			builder:     &failingCircuitBuilder{},
 			errContains: "introduction point is nil",
 		},
 		{
-			name: "valid introduction point",
-			introPoint: &IntroductionPoint{
-				OnionKey: make([]byte, 32),
-				AuthKey:  make([]byte, 32),
-			},
-			wantErr: false,
+			name:        "no circuit builder",
+			introPoint:  reachable,
+			builder:     nil,
+			errContains: "no circuit builder",
 		},
 		{
-			name: "introduction point with link specifiers",
+			name: "no link specifiers",
 			introPoint: &IntroductionPoint{
 				OnionKey: make([]byte, 32),
 				AuthKey:  make([]byte, 32),
-				LinkSpecifiers: []LinkSpecifier{
-					{Type: 0, Data: []byte{192, 168, 1, 1}},
-				},
 			},
-			wantErr: false,
+			builder:     &failingCircuitBuilder{},
+			errContains: "invalid introduction point",
+		},
+		{
+			name:        "circuit build fails",
+			introPoint:  reachable,
+			builder:     &failingCircuitBuilder{},
+			errContains: "failed to build circuit",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			circuitID, err := intro.CreateIntroductionCircuit(ctx, tt.introPoint, nil)
-
-			if tt.wantErr {
-				if err == nil {
-					t.Error("Expected error but got none")
-				} else if tt.errContains != "" && !strings.Contains(err.Error(), tt.errContains) {
-					t.Errorf("Error message %q does not contain %q", err.Error(), tt.errContains)
-				}
-				if circuitID != 0 {
-					t.Errorf("Expected circuit ID 0 on error, got %d", circuitID)
-				}
-			} else {
-				if err != nil {
-					t.Errorf("Unexpected error: %v", err)
-				}
-				if circuitID == 0 {
-					t.Error("Expected non-zero circuit ID")
-				}
+			circ, err := intro.CreateIntroductionCircuit(ctx, tt.introPoint, tt.builder)
+			if err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("Error message %q does not contain %q", err.Error(), tt.errContains)
+			}
+			if circ != nil {
+				t.Error("Expected nil circuit on error")
 			}
 		})
 	}
+
+	// The builder is asked for the relay named by the link specifiers
+	builder := &failingCircuitBuilder{}
+	_, _ = intro.CreateIntroductionCircuit(ctx, reachable, builder)
+	if builder.relay == nil {
+		t.Fatal("Circuit builder was not called")
+	}
+	if builder.relay.Address != "192.168.1.1" || builder.relay.ORPort != 9001 {
+		t.Errorf("Relay address = %s:%d, want 192.168.1.1:9001", builder.relay.Address, builder.relay.ORPort)
+	}
+	if builder.relay.Fingerprint != strings.Repeat("AB", 20) {
+		t.Errorf("Relay fingerprint = %s", builder.relay.Fingerprint)
+	}
+	if len(builder.relay.NtorOnionKey) != 32 {
+		t.Error("Relay ntor onion key not taken from the introduction point")
+	}
 }
 
 // TestSendIntroduce1 tests sending INTRODUCE1 cells
@@ -1342,52 +1306,22 @@ func TestSendIntroduce1(t *testing.T) {
 	intro := NewIntroductionProtocol(log)
 	ctx := context.Background()
 
-	tests := []struct {
-		name        string
-		circuitID   uint32
-		data        []byte
-		wantErr     bool
-		errContains string
-	}{
-		{
-			name:        "empty data",
-			circuitID:   1000,
-			data:        []byte{},
-			wantErr:     true,
-			errContains: "introduce1 data is empty",
-		},
-		{
-			name:      "valid data",
-			circuitID: 1000,
-			data:      make([]byte, 100),
-			wantErr:   false,
-		},
+	if err := intro.SendIntroduce1(ctx, nil, []byte{}); err == nil || !strings.Contains(err.Error(), "introduce1 data is empty") {
+		t.Errorf("Expected empty data error, got %v", err)
 	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			err := intro.SendIntroduce1(ctx, tt.circuitID, tt.data, nil)
-
-			if tt.wantErr {
-				if err == nil {
-					t.Error("Expected error but got none")
-				} else if tt.errContains != "" && !strings.Contains(err.Error(), tt.errContains) {
-					t.Errorf("Error message %q does not contain %q", err.Error(), tt.errContains)
-				}
-			} else {
-				if err != nil {
-					t.Errorf("Unexpected error: %v", err)
-				}
-			}
-		})
+	if err := intro.SendIntroduce1(ctx, nil, make([]byte, 100)); err == nil || !strings.Contains(err.Error(), "introduction circuit is nil") {
+		t.Errorf("Expected nil circuit error, got %v", err)
 	}
 }
 
-// TestConnectToOnionService tests the full connection orchestration
+// TestConnectToOnionService tests that connecting fails cleanly without a
+// way to build circuits
 func TestConnectToOnionService(t *testing.T) {
 	log := logger.NewDefault()
 	client := NewClient(log)
 
+	introPoint, _, rendezvousPoint := newTestIntroduction(t)
+
 	// Create a test address
 	pubkey, _, _ := ed25519.GenerateKey(rand.Reader)
 	addr := &Address{
@@ -1396,92 +1330,347 @@ func TestConnectToOnionService(t *testing.T) {
 	}
 	addr.Raw = addr.Encode()
 
-	// Create a mock descriptor with introduction points
 	desc := &Descriptor{
-		Version: 3,
-		Address: addr,
-		IntroPoints: []IntroductionPoint{
-			{
-				OnionKey: make([]byte, 32),
-				AuthKey:  make([]byte, 32),
-			},
-		},
-		CreatedAt: time.Now(),
-		Lifetime:  3 * time.Hour,
+		Version:     3,
+		Address:     addr,
+		IntroPoints: []IntroductionPoint{*introPoint},
+		CreatedAt:   time.Now(),
+		Lifetime:    3 * time.Hour,
 	}
 
 	// Cache the descriptor so we don't need HSDirs
 	client.CacheDescriptor(addr, desc)
+	client.UpdateHSDirs([]*HSDirectory{rendezvousPoint})
 
-	// Provide mock relays for rendezvous point selection
-	mockRelays := []*HSDirectory{
-		{
-			Fingerprint: "0000000000000000000000000000000000000001",
-			Address:     "127.0.0.1",
-			ORPort:      9001,
-			HSDir:       true,
-		},
+	circ, err := client.ConnectToOnionService(context.Background(), addr)
+	if err == nil {
+		t.Fatal("Expected error without a circuit builder")
+	}
+	if !strings.Contains(err.Error(), "no circuit builder") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if circ != nil {
+		t.Error("Expected nil circuit on error")
 	}
-	client.UpdateHSDirs(mockRelays)
+}
 
-	ctx := context.Background()
+// fakeNetworkBuilder builds circuits over a relaytest network: guard and
+// middle are the first two relays other than the target
+type fakeNetworkBuilder struct {
+	network *relaytest.Network
+	builder *circuit.Builder
+}
 
-	// Test connection
-	circuitID, err := client.ConnectToOnionService(ctx, addr)
-	if err != nil {
-		t.Errorf("Failed to connect to onion service: %v", err)
+func (b *fakeNetworkBuilder) BuildCircuitToRelay(ctx context.Context, relay *HSDirectory, timeout time.Duration) (*circuit.Circuit, error) {
+	var hops []*directory.Relay
+	var target *directory.Relay
+	for _, r := range b.network.Relays() {
+		if strings.EqualFold(r.Fingerprint(), relay.Fingerprint) {
+			target = r.Descriptor()
+		} else if len(hops) < 2 {
+			hops = append(hops, r.Descriptor())
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("relay %s not in network", relay.Fingerprint)
 	}
+	return b.builder.BuildCircuit(ctx, &path.Path{Guard: hops[0], Middle: hops[1], Exit: target}, timeout)
+}
 
-	if circuitID == 0 {
-		t.Error("Expected non-zero circuit ID")
+// hsDirectoryFor describes a fake relay as an onion service client sees it
+func hsDirectoryFor(r *relaytest.Relay) *HSDirectory {
+	desc := r.Descriptor()
+	return &HSDirectory{
+		Fingerprint:  desc.Fingerprint,
+		Address:      desc.Address,
+		ORPort:       desc.ORPort,
+		HSDir:        true,
+		IdentityKey:  desc.IdentityKey,
+		NtorOnionKey: desc.NtorOnionKey,
 	}
 }
 
-// TestIntroduce1CellFormat tests the format of INTRODUCE1 cells
-func TestIntroduce1CellFormat(t *testing.T) {
-	log := logger.NewDefault()
-	intro := NewIntroductionProtocol(log)
+// startEchoTarget listens on a local port and answers each line of every
+// connection with "echo: " and the line. It returns the address and a
+// channel that receives once a connection has been closed by the peer.
+func startEchoTarget(t *testing.T) (string, <-chan struct{}) {
+	t.Helper()
 
-	rendezvousCookie := make([]byte, 20)
-	for i := range rendezvousCookie {
-		rendezvousCookie[i] = byte(i)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
 	}
+	t.Cleanup(func() { listener.Close() })
 
-	req := &IntroduceRequest{
-		IntroPoint: &IntroductionPoint{
-			AuthKey: make([]byte, 32),
-		},
-		RendezvousCookie: rendezvousCookie,
-		RendezvousPoint:  "test-rp",
-		OnionKey:         make([]byte, 32),
+	closed := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						closed <- struct{}{}
+						return
+					}
+					if _, err := conn.Write(append([]byte("echo: "), buf[:n]...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), closed
+}
+
+// TestConnectToOnionServiceEndToEnd connects to an in-process onion service
+// over a fake relay network and exchanges data on a stream through the
+// rendezvous point
+func TestConnectToOnionServiceEndToEnd(t *testing.T) {
+	log := logger.NewDefault()
+	network, err := relaytest.NewNetwork(5, log)
+	if err != nil {
+		t.Fatalf("Failed to start fake relay network: %v", err)
 	}
+	t.Cleanup(network.Close)
 
-	data, err := intro.BuildIntroduce1Cell(req)
+	builder := &fakeNetworkBuilder{network: network, builder: circuit.NewBuilder(circuit.NewManager(), log)}
+	relays := network.Relays()
+	introRelay := hsDirectoryFor(relays[4])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// The service sets up its introduction point and descriptor, and
+	// serves port 80 from a local echo server
+	target, targetClosed := startEchoTarget(t)
+	service, err := NewService(&ServiceConfig{
+		NumIntroPoints: 1,
+		Ports:          map[int]string{80: target},
+		IntroDoS:       &IntroDoSParams{RatePerSec: 25, BurstPerSec: 200},
+	}, log)
 	if err != nil {
-		t.Fatalf("Failed to build INTRODUCE1 cell: %v", err)
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.SetCircuitBuilder(builder)
+	defer service.Stop()
+	if err := service.establishIntroductionPoints(ctx, []*HSDirectory{introRelay}); err != nil {
+		t.Fatalf("Failed to set up introduction point: %v", err)
+	}
+	if err := service.createDescriptor(); err != nil {
+		t.Fatalf("Failed to create descriptor: %v", err)
+	}
+	serviceIntro := service.introPoints[0]
+	if dos, ok := relays[4].IntroDoS(serviceIntro.AuthKey); !ok || dos.RatePerSec != 25 || dos.BurstPerSec != 200 {
+		t.Errorf("Introduction point got DoS parameters %+v (sent: %v), want rate 25 and burst 200", dos, ok)
 	}
 
-	// Verify structure
-	if len(data) < 23 { // Minimum: LEGACY_KEY_ID(20) + AUTH_KEY_TYPE(1) + AUTH_KEY_LEN(2)
-		t.Fatalf("Cell data too short: %d bytes", len(data))
+	// The client only knows the address, the published descriptor and the
+	// relays
+	client := NewClient(log)
+	client.SetCircuitBuilder(builder)
+	client.UpdateHSDirs([]*HSDirectory{hsDirectoryFor(relays[3])})
+	service.mu.RLock()
+	raw := service.descriptor.RawDescriptor
+	service.mu.RUnlock()
+	desc, err := ParseDescriptor(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %v", err)
+	}
+	if err := DecryptDescriptor(desc, service.address); err != nil {
+		t.Fatalf("Failed to decrypt descriptor: %v", err)
+	}
+	client.CacheDescriptor(service.address, desc)
+
+	addr, err := ParseAddress(service.GetAddress())
+	if err != nil {
+		t.Fatalf("Failed to parse service address: %v", err)
+	}
+	circ, err := client.ConnectToOnionService(ctx, addr)
+	if err != nil {
+		t.Fatalf("ConnectToOnionService failed: %v", err)
+	}
+	defer circ.Close()
+
+	if circ.Length() != 4 {
+		t.Errorf("Rendezvous circuit has %d hops, want 4 (three relays and the service)", circ.Length())
+	}
+
+	// Two streams on the circuit both reach the local target
+	for streamID := uint16(1); streamID <= 2; streamID++ {
+		if err := circ.OpenStream(streamID, "", 80); err != nil {
+			t.Fatalf("OpenStream %d failed: %v", streamID, err)
+		}
+		if err := circ.WriteToStream(streamID, []byte("hello")); err != nil {
+			t.Fatalf("WriteToStream failed: %v", err)
+		}
+		reply, err := circ.ReadFromStream(ctx, streamID)
+		if err != nil {
+			t.Fatalf("ReadFromStream failed: %v", err)
+		}
+		if string(reply) != "echo: hello" {
+			t.Errorf("Reply = %q, want %q", reply, "echo: hello")
+		}
+		if err := circ.EndStream(streamID, 6); err != nil {
+			t.Fatalf("EndStream failed: %v", err)
+		}
+		select {
+		case <-targetClosed:
+		case <-ctx.Done():
+			t.Fatal("Service did not close the local connection after END")
+		}
+	}
+	if stats := service.GetStats(); stats.Rendezvous != 1 || stats.PendingIntros != 0 {
+		t.Errorf("Stats report %d rendezvous and %d pending introductions, want 1 and 0", stats.Rendezvous, stats.PendingIntros)
+	}
+
+	// A BEGIN for a port the service does not offer closes the circuit
+	if err := circ.SendRelayCell(cell.NewRelayCell(3, cell.RelayBegin, []byte(":22\x00"))); err != nil {
+		t.Fatalf("Failed to send BEGIN: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for service.GetStats().Rendezvous != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Service kept the rendezvous circuit after a BEGIN for an unknown port")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := relays[4].IntroductionCount(); got != 1 {
+		t.Errorf("Introduction point relayed %d introductions, want 1", got)
+	}
+	service.mu.RLock()
+	introductions := serviceIntro.Introductions
+	service.mu.RUnlock()
+	if introductions != 1 {
+		t.Errorf("Service counted %d introductions, want 1", introductions)
+	}
+	if got := relays[3].RendezvousCount(); got != 1 {
+		t.Errorf("Rendezvous point joined %d circuits, want 1", got)
+	}
+}
+
+// TestIntroduce1CellFormat tests the format of INTRODUCE1 cells by having
+// the service side decrypt one
+func TestIntroduce1CellFormat(t *testing.T) {
+	log := logger.NewDefault()
+	intro := NewIntroductionProtocol(log)
+
+	introPoint, serviceIntro, rendezvousPoint := newTestIntroduction(t)
+	subcredential := bytes.Repeat([]byte{0x5C}, 32)
+	handshake, err := crypto.NewHsNtorClient(introPoint.AuthKey, introPoint.EncKey, subcredential)
+	if err != nil {
+		t.Fatalf("Failed to start hs-ntor handshake: %v", err)
+	}
+
+	rendezvousCookie := make([]byte, 20)
+	for i := range rendezvousCookie {
+		rendezvousCookie[i] = byte(i)
+	}
+
+	data, err := intro.BuildIntroduce1Cell(&IntroduceRequest{
+		IntroPoint:       introPoint,
+		RendezvousCookie: rendezvousCookie,
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build INTRODUCE1 cell: %v", err)
 	}
 
 	// Check LEGACY_KEY_ID is zero
-	legacyKeyID := data[0:20]
-	if !bytes.Equal(legacyKeyID, make([]byte, 20)) {
+	if !bytes.Equal(data[0:20], make([]byte, 20)) {
 		t.Error("LEGACY_KEY_ID should be all zeros for v3")
 	}
+	if data[20] != 0x02 {
+		t.Errorf("AUTH_KEY_TYPE should be 0x02 (ed25519), got 0x%02x", data[20])
+	}
+	if authKeyLen := uint16(data[21])<<8 | uint16(data[22]); authKeyLen != 32 {
+		t.Errorf("AUTH_KEY_LEN should be 32, got %d", authKeyLen)
+	}
+	if !bytes.Equal(data[23:55], introPoint.AuthKey) {
+		t.Error("AUTH_KEY does not match the introduction point")
+	}
+	if !bytes.Equal(data[56:88], handshake.PublicKey()) {
+		t.Error("CLIENT_PK does not follow the extensions")
+	}
 
-	// Check AUTH_KEY_TYPE
-	authKeyType := data[20]
-	if authKeyType != 0x02 {
-		t.Errorf("AUTH_KEY_TYPE should be 0x02 (ed25519), got 0x%02x", authKeyType)
+	service := &Service{}
+	req, err := service.decryptIntroduce2(serviceIntro, data, subcredential)
+	if err != nil {
+		t.Fatalf("Service failed to decrypt INTRODUCE2: %v", err)
 	}
+	if !bytes.Equal(req.RendezvousCookie, rendezvousCookie) {
+		t.Error("Rendezvous cookie mismatch")
+	}
+	if !bytes.Equal(req.ClientPK, handshake.PublicKey()) {
+		t.Error("Client public key mismatch")
+	}
+	rp, err := req.RendezvousPoint()
+	if err != nil {
+		t.Fatalf("Failed to read rendezvous point: %v", err)
+	}
+	if rp.Fingerprint != rendezvousPoint.Fingerprint || rp.Address != rendezvousPoint.Address || rp.ORPort != rendezvousPoint.ORPort {
+		t.Errorf("Rendezvous point = %s %s:%d, want %s %s:%d",
+			rp.Fingerprint, rp.Address, rp.ORPort,
+			rendezvousPoint.Fingerprint, rendezvousPoint.Address, rendezvousPoint.ORPort)
+	}
+	if !bytes.Equal(rp.IdentityKey, rendezvousPoint.IdentityKey) || !bytes.Equal(rp.NtorOnionKey, rendezvousPoint.NtorOnionKey) {
+		t.Error("Rendezvous point keys mismatch")
+	}
+}
 
-	// Check AUTH_KEY_LEN
-	authKeyLen := uint16(data[21])<<8 | uint16(data[22])
-	if authKeyLen != 32 {
-		t.Errorf("AUTH_KEY_LEN should be 32, got %d", authKeyLen)
+// TestDecryptIntroduce2Rejects tests that INTRODUCE2 cells that were not
+// built for this introduction point and subcredential are rejected
+func TestDecryptIntroduce2Rejects(t *testing.T) {
+	introPoint, serviceIntro, rendezvousPoint := newTestIntroduction(t)
+	subcredential := bytes.Repeat([]byte{0x5C}, 32)
+	handshake, err := crypto.NewHsNtorClient(introPoint.AuthKey, introPoint.EncKey, subcredential)
+	if err != nil {
+		t.Fatalf("Failed to start hs-ntor handshake: %v", err)
+	}
+	data, err := NewIntroductionProtocol(nil).BuildIntroduce1Cell(&IntroduceRequest{
+		IntroPoint:       introPoint,
+		RendezvousCookie: make([]byte, 20),
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build INTRODUCE1 cell: %v", err)
+	}
+
+	_, otherIntro, _ := newTestIntroduction(t)
+	tampered := append([]byte(nil), data...)
+	tampered[100] ^= 0x01
+
+	tests := []struct {
+		name          string
+		intro         *ServiceIntroPoint
+		data          []byte
+		subcredential []byte
+		errContains   string
+	}{
+		{"truncated", serviceIntro, data[:22], subcredential, "too short"},
+		{"other introduction point", otherIntro, data, subcredential, "different introduction point"},
+		{"wrong subcredential", serviceIntro, data, make([]byte, 32), "MAC mismatch"},
+		{"tampered ciphertext", serviceIntro, tampered, subcredential, "MAC mismatch"},
+	}
+
+	service := &Service{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.decryptIntroduce2(tt.intro, tt.data, tt.subcredential)
+			if err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("Error message %q does not contain %q", err.Error(), tt.errContains)
+			}
+		})
 	}
 }
 
@@ -1510,13 +1699,16 @@ func BenchmarkBuildIntroduce1Cell(b *testing.B) {
 	log := logger.NewDefault()
 	intro := NewIntroductionProtocol(log)
 
+	introPoint, _, rendezvousPoint := newTestIntroduction(b)
+	handshake, err := crypto.NewHsNtorClient(introPoint.AuthKey, introPoint.EncKey, make([]byte, 32))
+	if err != nil {
+		b.Fatalf("Failed to start hs-ntor handshake: %v", err)
+	}
 	req := &IntroduceRequest{
-		IntroPoint: &IntroductionPoint{
-			AuthKey: make([]byte, 32),
-		},
+		IntroPoint:       introPoint,
 		RendezvousCookie: make([]byte, 20),
-		RendezvousPoint:  "test-rp",
-		OnionKey:         make([]byte, 32),
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
 	}
 
 	b.ResetTimer()
@@ -1544,10 +1736,13 @@ func TestSelectRendezvousPoint(t *testing.T) {
 	log := logger.NewDefault()
 	rendezvous := NewRendezvousProtocol(log)
 
+	ntorKey := make([]byte, 32)
+
 	tests := []struct {
 		name        string
 		relays      []*HSDirectory
 		expectError bool
+		expected    string
 	}{
 		{
 			name:        "no relays available",
@@ -1555,20 +1750,38 @@ func TestSelectRendezvousPoint(t *testing.T) {
 			expectError: true,
 		},
 		{
-			name: "single relay",
+			name: "no relay with an ntor key",
 			relays: []*HSDirectory{
 				{Fingerprint: "relay1", Address: "1.1.1.1", ORPort: 9001, HSDir: true},
 			},
+			expectError: true,
+		},
+		{
+			name: "single relay",
+			relays: []*HSDirectory{
+				{Fingerprint: "relay1", Address: "1.1.1.1", ORPort: 9001, HSDir: true, NtorOnionKey: ntorKey},
+			},
 			expectError: false,
+			expected:    "relay1",
 		},
 		{
-			name: "multiple relays",
+			name: "only one usable relay",
 			relays: []*HSDirectory{
 				{Fingerprint: "relay1", Address: "1.1.1.1", ORPort: 9001, HSDir: true},
-				{Fingerprint: "relay2", Address: "2.2.2.2", ORPort: 9002, HSDir: true},
+				{Fingerprint: "relay2", Address: "2.2.2.2", ORPort: 9002, HSDir: true, NtorOnionKey: ntorKey},
 				{Fingerprint: "relay3", Address: "3.3.3.3", ORPort: 9003, HSDir: true},
 			},
 			expectError: false,
+			expected:    "relay2",
+		},
+		{
+			name: "multiple relays",
+			relays: []*HSDirectory{
+				{Fingerprint: "relay1", Address: "1.1.1.1", ORPort: 9001, HSDir: true, NtorOnionKey: ntorKey},
+				{Fingerprint: "relay2", Address: "2.2.2.2", ORPort: 9002, HSDir: true, NtorOnionKey: ntorKey},
+				{Fingerprint: "relay3", Address: "3.3.3.3", ORPort: 9003, HSDir: true, NtorOnionKey: ntorKey},
+			},
+			expectError: false,
 		},
 	}
 
@@ -1585,7 +1798,10 @@ func TestSelectRendezvousPoint(t *testing.T) {
 					t.Errorf("Unexpected error: %v", err)
 				}
 				if relay == nil {
-					t.Error("Expected non-nil relay")
+					t.Fatal("Expected non-nil relay")
+				}
+				if tt.expected != "" && relay.Fingerprint != tt.expected {
+					t.Errorf("Selected %s, want %s", relay.Fingerprint, tt.expected)
 				}
 			}
 		})
@@ -1658,44 +1874,49 @@ func TestCreateRendezvousCircuit(t *testing.T) {
 	rendezvous := NewRendezvousProtocol(log)
 	ctx := context.Background()
 
+	rendezvousPoint := &HSDirectory{
+		Fingerprint: "test-rp",
+		Address:     "1.1.1.1",
+		ORPort:      9001,
+	}
+
 	tests := []struct {
-		name              string
-		rendezvousPoint   *HSDirectory
-		expectError       bool
-		expectedCircuitID uint32
+		name            string
+		rendezvousPoint *HSDirectory
+		builder         CircuitBuilder
+		errContains     string
 	}{
 		{
 			name:            "nil rendezvous point",
 			rendezvousPoint: nil,
-			expectError:     true,
+			builder:         &failingCircuitBuilder{},
+			errContains:     "rendezvous point is nil",
 		},
 		{
-			name: "valid rendezvous point",
-			rendezvousPoint: &HSDirectory{
-				Fingerprint: "test-rp",
-				Address:     "1.1.1.1",
-				ORPort:      9001,
-			},
-			expectError:       false,
-			expectedCircuitID: 2000,
+			name:            "no circuit builder",
+			rendezvousPoint: rendezvousPoint,
+			builder:         nil,
+			errContains:     "no circuit builder",
+		},
+		{
+			name:            "circuit build fails",
+			rendezvousPoint: rendezvousPoint,
+			builder:         &failingCircuitBuilder{},
+			errContains:     "failed to build circuit",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			circuitID, err := rendezvous.CreateRendezvousCircuit(ctx, tt.rendezvousPoint, nil)
-
-			if tt.expectError {
-				if err == nil {
-					t.Error("Expected error but got none")
-				}
-			} else {
-				if err != nil {
-					t.Errorf("Unexpected error: %v", err)
-				}
-				if circuitID != tt.expectedCircuitID {
-					t.Errorf("Expected circuit ID %d, got %d", tt.expectedCircuitID, circuitID)
-				}
+			circ, err := rendezvous.CreateRendezvousCircuit(ctx, tt.rendezvousPoint, tt.builder)
+			if err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("Error message %q does not contain %q", err.Error(), tt.errContains)
+			}
+			if circ != nil {
+				t.Error("Expected nil circuit on error")
 			}
 		})
 	}
@@ -1707,40 +1928,11 @@ func TestSendEstablishRendezvous(t *testing.T) {
 	rendezvous := NewRendezvousProtocol(log)
 	ctx := context.Background()
 
-	tests := []struct {
-		name        string
-		circuitID   uint32
-		data        []byte
-		expectError bool
-	}{
-		{
-			name:        "empty data",
-			circuitID:   2000,
-			data:        []byte{},
-			expectError: true,
-		},
-		{
-			name:        "valid data",
-			circuitID:   2000,
-			data:        make([]byte, 20),
-			expectError: false,
-		},
+	if err := rendezvous.SendEstablishRendezvous(ctx, nil, []byte{}); err == nil {
+		t.Error("Expected error for empty data")
 	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			err := rendezvous.SendEstablishRendezvous(ctx, tt.circuitID, tt.data, nil)
-
-			if tt.expectError {
-				if err == nil {
-					t.Error("Expected error but got none")
-				}
-			} else {
-				if err != nil {
-					t.Errorf("Unexpected error: %v", err)
-				}
-			}
-		})
+	if err := rendezvous.SendEstablishRendezvous(ctx, nil, make([]byte, 20)); err == nil {
+		t.Error("Expected error for nil circuit")
 	}
 }
 
@@ -1764,26 +1956,34 @@ func TestBuildRendezvous1Cell(t *testing.T) {
 			name: "invalid cookie length",
 			request: &Rendezvous1Request{
 				RendezvousCookie: make([]byte, 10),
+				HandshakeData:    make([]byte, 64),
 			},
 			expectError: true,
 		},
 		{
-			name: "valid request without handshake data",
+			name: "missing handshake data",
 			request: &Rendezvous1Request{
 				RendezvousCookie: make([]byte, 20),
 				HandshakeData:    []byte{},
 			},
-			expectError: false,
-			expectedLen: 20,
+			expectError: true,
 		},
 		{
-			name: "valid request with handshake data",
+			name: "short handshake data",
 			request: &Rendezvous1Request{
 				RendezvousCookie: make([]byte, 20),
 				HandshakeData:    make([]byte, 32),
 			},
+			expectError: true,
+		},
+		{
+			name: "valid request",
+			request: &Rendezvous1Request{
+				RendezvousCookie: make([]byte, 20),
+				HandshakeData:    make([]byte, 64),
+			},
 			expectError: false,
-			expectedLen: 52, // 20 + 32
+			expectedLen: 84, // 20 + 64
 		},
 	}
 
@@ -1816,7 +2016,6 @@ func TestParseRendezvous2Cell(t *testing.T) {
 		name        string
 		data        []byte
 		expectError bool
-		expectedLen int
 	}{
 		{
 			name:        "empty data",
@@ -1824,16 +2023,19 @@ func TestParseRendezvous2Cell(t *testing.T) {
 			expectError: true,
 		},
 		{
-			name:        "valid data",
+			name:        "truncated handshake",
 			data:        make([]byte, 32),
+			expectError: true,
+		},
+		{
+			name:        "valid data",
+			data:        make([]byte, 64),
 			expectError: false,
-			expectedLen: 32,
 		},
 		{
-			name:        "large handshake data",
+			name:        "trailing bytes",
 			data:        make([]byte, 100),
 			expectError: false,
-			expectedLen: 100,
 		},
 	}
 
@@ -1849,8 +2051,8 @@ func TestParseRendezvous2Cell(t *testing.T) {
 				if err != nil {
 					t.Errorf("Unexpected error: %v", err)
 				}
-				if len(handshakeData) != tt.expectedLen {
-					t.Errorf("Expected handshake data length %d, got %d", tt.expectedLen, len(handshakeData))
+				if len(handshakeData) != 64 {
+					t.Errorf("Expected handshake data length 64, got %d", len(handshakeData))
 				}
 			}
 		})
@@ -1861,75 +2063,50 @@ func TestParseRendezvous2Cell(t *testing.T) {
 func TestWaitForRendezvous2(t *testing.T) {
 	log := logger.NewDefault()
 	rendezvous := NewRendezvousProtocol(log)
-	ctx := context.Background()
 
-	circuitID := uint32(2000)
-
-	handshakeData, err := rendezvous.WaitForRendezvous2(ctx, circuitID, nil)
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
-	}
-
-	if len(handshakeData) == 0 {
-		t.Error("Expected non-empty handshake data")
+	if _, err := rendezvous.WaitForRendezvous2(context.Background(), nil); err == nil {
+		t.Error("Expected error for nil circuit")
 	}
 }
 
-// TestEstablishRendezvousPoint tests the full rendezvous point establishment
+// TestEstablishRendezvousPoint tests that rendezvous point establishment
+// needs a usable relay and a circuit builder
 func TestEstablishRendezvousPoint(t *testing.T) {
 	log := logger.NewDefault()
 	client := NewClient(log)
 	ctx := context.Background()
 
 	rendezvousCookie := make([]byte, 20)
-	for i := range rendezvousCookie {
-		rendezvousCookie[i] = byte(i)
-	}
-
 	mockRelays := []*HSDirectory{
 		{
-			Fingerprint: "relay1",
-			Address:     "1.1.1.1",
-			ORPort:      9001,
-			HSDir:       true,
-		},
-		{
-			Fingerprint: "relay2",
-			Address:     "2.2.2.2",
-			ORPort:      9002,
-			HSDir:       true,
+			Fingerprint:  "relay1",
+			Address:      "1.1.1.1",
+			ORPort:       9001,
+			HSDir:        true,
+			NtorOnionKey: make([]byte, 32),
 		},
 	}
 
-	circuitID, rendezvousPoint, err := client.EstablishRendezvousPoint(ctx, rendezvousCookie, mockRelays)
-	if err != nil {
-		t.Fatalf("Failed to establish rendezvous point: %v", err)
+	if _, _, err := client.EstablishRendezvousPoint(ctx, rendezvousCookie, nil); err == nil {
+		t.Error("Expected error without relays")
 	}
-
-	if circuitID == 0 {
-		t.Error("Expected non-zero circuit ID")
-	}
-
-	if rendezvousPoint == nil {
-		t.Fatal("Expected non-nil rendezvous point")
-	}
-
-	if rendezvousPoint.Fingerprint == "" {
-		t.Error("Expected non-empty rendezvous point fingerprint")
+	if _, _, err := client.EstablishRendezvousPoint(ctx, rendezvousCookie, mockRelays); err == nil || !strings.Contains(err.Error(), "no circuit builder") {
+		t.Errorf("Expected circuit builder error, got %v", err)
 	}
 }
 
-// TestCompleteRendezvous tests completing the rendezvous protocol
+// TestCompleteRendezvous tests argument checks when completing the
+// rendezvous protocol
 func TestCompleteRendezvous(t *testing.T) {
 	log := logger.NewDefault()
 	client := NewClient(log)
 	ctx := context.Background()
 
-	rendezvousCircuitID := uint32(2000)
-
-	err := client.CompleteRendezvous(ctx, rendezvousCircuitID)
-	if err != nil {
-		t.Errorf("Failed to complete rendezvous: %v", err)
+	if err := client.CompleteRendezvous(ctx, nil, nil); err == nil {
+		t.Error("Expected error for nil circuit")
+	}
+	if err := client.CompleteRendezvous(ctx, circuit.NewCircuit(1), nil); err == nil {
+		t.Error("Expected error for nil handshake")
 	}
 }
 
@@ -1970,10 +2147,11 @@ func BenchmarkSelectRendezvousPoint(b *testing.B) {
 	log := logger.NewDefault()
 	rendezvous := NewRendezvousProtocol(log)
 
+	ntorKey := make([]byte, 32)
 	relays := []*HSDirectory{
-		{Fingerprint: "relay1", Address: "1.1.1.1", ORPort: 9001, HSDir: true},
-		{Fingerprint: "relay2", Address: "2.2.2.2", ORPort: 9002, HSDir: true},
-		{Fingerprint: "relay3", Address: "3.3.3.3", ORPort: 9003, HSDir: true},
+		{Fingerprint: "relay1", Address: "1.1.1.1", ORPort: 9001, HSDir: true, NtorOnionKey: ntorKey},
+		{Fingerprint: "relay2", Address: "2.2.2.2", ORPort: 9002, HSDir: true, NtorOnionKey: ntorKey},
+		{Fingerprint: "relay3", Address: "3.3.3.3", ORPort: 9003, HSDir: true, NtorOnionKey: ntorKey},
 	}
 
 	b.ResetTimer()
@@ -2002,7 +2180,7 @@ func BenchmarkParseRendezvous2Cell(b *testing.B) {
 	log := logger.NewDefault()
 	rendezvous := NewRendezvousProtocol(log)
 
-	data := make([]byte, 32)
+	data := make([]byte, 64)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -2104,343 +2282,86 @@ func TestSelectIntroductionPointNilDescriptor(t *testing.T) {
 	}
 }
 
-// TestEncryptIntroduce1Data tests the INTRODUCE1 encryption implementation (SPEC-006)
-func TestEncryptIntroduce1Data(t *testing.T) {
-	log := logger.NewDefault()
-	ip := NewIntroductionProtocol(log)
-
-	// Create test plaintext
+// TestIntroduceCipher tests that the INTRODUCE1 cipher is its own inverse
+// and starts from a zero IV
+func TestIntroduceCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 32)
 	plaintext := []byte("test plaintext data for encryption")
 
-	// Generate a valid curve25519 public key for introduction point
-	var introPointPrivate, introPointPublic [32]byte
-	if _, err := rand.Read(introPointPrivate[:]); err != nil {
-		t.Fatalf("Failed to generate intro point key: %v", err)
-	}
-
-	// Compute public key using curve25519
-	basePoint := [32]byte{9}
-	curve25519.ScalarMult(&introPointPublic, &introPointPrivate, &basePoint)
-
-	// Test encryption - AUDIT-006: Now returns 4 values including private key
-	encrypted, clientPubKey, clientPrivKey, err := ip.encryptIntroduce1Data(plaintext, introPointPublic[:])
+	encrypted, err := introduceCipher(key, plaintext)
 	if err != nil {
 		t.Fatalf("Encryption failed: %v", err)
 	}
-
-	// Verify encrypted data is different from plaintext
 	if bytes.Equal(encrypted, plaintext) {
 		t.Error("Encrypted data should be different from plaintext")
 	}
-
-	// Verify client public key is 32 bytes
-	if len(clientPubKey) != 32 {
-		t.Errorf("Client public key length = %d, want 32", len(clientPubKey))
-	}
-
-	// AUDIT-006: Verify client private key is 32 bytes
-	if len(clientPrivKey) != 32 {
-		t.Errorf("Client private key length = %d, want 32", len(clientPrivKey))
-	}
-
-	// Verify encrypted data has same length as plaintext (CTR mode)
 	if len(encrypted) != len(plaintext) {
 		t.Errorf("Encrypted data length = %d, want %d", len(encrypted), len(plaintext))
 	}
-}
 
-// TestEncryptIntroduce1DataInvalidKey tests error handling for invalid keys
-func TestEncryptIntroduce1DataInvalidKey(t *testing.T) {
-	log := logger.NewDefault()
-	ip := NewIntroductionProtocol(log)
-
-	plaintext := []byte("test data")
-
-	tests := []struct {
-		name    string
-		keyLen  int
-		wantErr bool
-	}{
-		{
-			name:    "invalid key length - too short",
-			keyLen:  16,
-			wantErr: true,
-		},
-		{
-			name:    "invalid key length - too long",
-			keyLen:  64,
-			wantErr: true,
-		},
-		{
-			name:    "valid key length",
-			keyLen:  32,
-			wantErr: false,
-		},
+	again, err := introduceCipher(key, plaintext)
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if !bytes.Equal(again, encrypted) {
+		t.Error("Encryption should be deterministic for a key")
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			key := make([]byte, tt.keyLen)
-			// AUDIT-006: Now returns 4 values including private key
-			_, _, clientPrivKey, err := ip.encryptIntroduce1Data(plaintext, key)
+	decrypted, err := introduceCipher(key, encrypted)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("Decryption did not recover the plaintext")
+	}
 
-			if tt.wantErr && err == nil {
-				t.Error("Expected error for invalid key, got nil")
-			}
-			if !tt.wantErr && err != nil {
-				t.Errorf("Unexpected error: %v", err)
-			}
-			if !tt.wantErr && len(clientPrivKey) != 32 {
-				t.Errorf("Expected 32-byte private key, got %d bytes", len(clientPrivKey))
-			}
-		})
+	if _, err := introduceCipher(make([]byte, 7), plaintext); err == nil {
+		t.Error("Expected error for invalid key length")
 	}
 }
 
-// TestBuildEncryptedDataWithEncryption tests the complete encrypted data building
-func TestBuildEncryptedDataWithEncryption(t *testing.T) {
+// TestBuildEncryptedData tests the plaintext layout and padding of the
+// encrypted part of INTRODUCE1
+func TestBuildEncryptedData(t *testing.T) {
 	log := logger.NewDefault()
 	ip := NewIntroductionProtocol(log)
 
-	// Generate introduction point with valid encryption key
-	var introPointPrivate, introPointPublic [32]byte
-	if _, err := rand.Read(introPointPrivate[:]); err != nil {
-		t.Fatalf("Failed to generate intro point key: %v", err)
-	}
-	basePoint := [32]byte{9}
-	curve25519.ScalarMult(&introPointPublic, &introPointPrivate, &basePoint)
-
-	// Create test request
+	_, _, rendezvousPoint := newTestIntroduction(t)
 	rendezvousCookie := make([]byte, 20)
 	for i := range rendezvousCookie {
 		rendezvousCookie[i] = byte(i)
 	}
-
-	onionKey := make([]byte, 32)
-	for i := range onionKey {
-		onionKey[i] = byte(i + 20)
+	linkSpecs, err := linkSpecifiersForRelay(rendezvousPoint)
+	if err != nil {
+		t.Fatalf("Failed to build link specifiers: %v", err)
 	}
-
 	req := &IntroduceRequest{
-		IntroPoint: &IntroductionPoint{
-			EncKey:  introPointPublic[:],
-			AuthKey: make([]byte, 32),
-		},
 		RendezvousCookie: rendezvousCookie,
-		RendezvousPoint:  "test-rendezvous",
-		OnionKey:         onionKey,
+		RendezvousPoint:  rendezvousPoint,
 	}
 
-	// Build encrypted data
-	result := ip.buildEncryptedData(req)
+	const headerLen = 20 + 1 + 2 + 32 + 1
+	plaintext := ip.buildEncryptedData(req, linkSpecs, headerLen)
 
-	// Verify result contains: CLIENT_PK (32 bytes) + ENCRYPTED_DATA
-	// Plaintext would be: RENDEZVOUS_COOKIE (20) + ONION_KEY (32) + N_SPEC (1) = 53 bytes
-	// With encryption: CLIENT_PK (32) + ENCRYPTED (53) = 85 bytes
-	expectedMinLen := 32 + 53 // CLIENT_PK + encrypted payload
-	if len(result) < expectedMinLen {
-		t.Errorf("Encrypted result length = %d, want >= %d", len(result), expectedMinLen)
+	if got := headerLen + 32 + len(plaintext) + introduceMACLen; got != introduce1MinLen {
+		t.Errorf("Padded cell length = %d, want %d", got, introduce1MinLen)
 	}
-
-	// First 32 bytes should be client's ephemeral public key
-	clientPubKey := result[0:32]
-	// Verify it's a valid curve25519 public key (not all zeros)
-	allZeros := true
-	for _, b := range clientPubKey {
-		if b != 0 {
-			allZeros = false
-			break
-		}
+	if !bytes.Equal(plaintext[0:20], rendezvousCookie) {
+		t.Error("Plaintext should start with rendezvous cookie")
 	}
-	if allZeros {
-		t.Error("Client public key should not be all zeros")
+	if plaintext[20] != 0 || plaintext[21] != onionKeyTypeNtor || plaintext[22] != 0 || plaintext[23] != 32 {
+		t.Errorf("Unexpected extension and onion key header % x", plaintext[20:24])
 	}
-}
-
-// TestBuildEncryptedDataWithoutEncKey tests fallback to plaintext mode
-func TestBuildEncryptedDataWithoutEncKey(t *testing.T) {
-	log := logger.NewDefault()
-	ip := NewIntroductionProtocol(log)
-
-	rendezvousCookie := make([]byte, 20)
-	onionKey := make([]byte, 32)
-
-	tests := []struct {
-		name       string
-		introPoint *IntroductionPoint
-	}{
-		{
-			name:       "nil introduction point",
-			introPoint: nil,
-		},
-		{
-			name: "introduction point with no EncKey",
-			introPoint: &IntroductionPoint{
-				AuthKey: make([]byte, 32),
-			},
-		},
-		{
-			name: "introduction point with invalid EncKey length",
-			introPoint: &IntroductionPoint{
-				EncKey:  make([]byte, 16), // Wrong length
-				AuthKey: make([]byte, 32),
-			},
-		},
+	if !bytes.Equal(plaintext[24:56], rendezvousPoint.NtorOnionKey) {
+		t.Error("Onion key mismatch")
 	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			req := &IntroduceRequest{
-				IntroPoint:       tt.introPoint,
-				RendezvousCookie: rendezvousCookie,
-				OnionKey:         onionKey,
-			}
-
-			result := ip.buildEncryptedData(req)
-
-			// Should return plaintext: RENDEZVOUS_COOKIE (20) + ONION_KEY (32) + N_SPEC (1) = 53 bytes
-			expectedLen := 53
-			if len(result) != expectedLen {
-				t.Errorf("Plaintext result length = %d, want %d", len(result), expectedLen)
-			}
-
-			// Verify it starts with rendezvous cookie
-			if !bytes.Equal(result[0:20], rendezvousCookie) {
-				t.Error("Result should start with rendezvous cookie")
-			}
-		})
-	}
-}
-
-// TestDeriveKey tests the key derivation function
-func TestDeriveKey(t *testing.T) {
-	secret := []byte("test secret key for HKDF derivation")
-	info := []byte("test-info-string")
-
-	tests := []struct {
-		name    string
-		length  int
-		wantErr bool
-	}{
-		{
-			name:    "derive 16 bytes",
-			length:  16,
-			wantErr: false,
-		},
-		{
-			name:    "derive 32 bytes",
-			length:  32,
-			wantErr: false,
-		},
-		{
-			name:    "derive 64 bytes",
-			length:  64,
-			wantErr: false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			key, err := deriveKey(secret, info, tt.length)
-
-			if tt.wantErr && err == nil {
-				t.Error("Expected error, got nil")
-			}
-			if !tt.wantErr && err != nil {
-				t.Errorf("Unexpected error: %v", err)
-			}
-			if !tt.wantErr && len(key) != tt.length {
-				t.Errorf("Derived key length = %d, want %d", len(key), tt.length)
-			}
-		})
-	}
-}
-
-// TestDeriveKeyDeterministic tests that key derivation is deterministic
-func TestDeriveKeyDeterministic(t *testing.T) {
-	secret := []byte("test secret")
-	info := []byte("test info")
-	length := 32
-
-	// Derive key twice with same inputs
-	key1, err1 := deriveKey(secret, info, length)
-	key2, err2 := deriveKey(secret, info, length)
-
-	if err1 != nil || err2 != nil {
-		t.Fatalf("Key derivation failed: %v, %v", err1, err2)
-	}
-
-	// Keys should be identical
-	if !bytes.Equal(key1, key2) {
-		t.Error("Key derivation should be deterministic")
-	}
-
-	// Different info should produce different keys
-	differentInfo := []byte("different info")
-	key3, err3 := deriveKey(secret, differentInfo, length)
-	if err3 != nil {
-		t.Fatalf("Key derivation failed: %v", err3)
-	}
-
-	if bytes.Equal(key1, key3) {
-		t.Error("Different info should produce different keys")
-	}
-}
-
-// TestEncryptionIntegration tests the full encryption flow in INTRODUCE1
-func TestEncryptionIntegration(t *testing.T) {
-	log := logger.NewDefault()
-	intro := NewIntroductionProtocol(log)
-
-	// Generate introduction point keys
-	var introPointPrivate, introPointPublic [32]byte
-	if _, err := rand.Read(introPointPrivate[:]); err != nil {
-		t.Fatalf("Failed to generate intro point key: %v", err)
-	}
-	basePoint := [32]byte{9}
-	curve25519.ScalarMult(&introPointPublic, &introPointPrivate, &basePoint)
-
-	// Create valid request
-	rendezvousCookie := make([]byte, 20)
-	if _, err := rand.Read(rendezvousCookie); err != nil {
-		t.Fatalf("Failed to generate cookie: %v", err)
-	}
-
-	onionKey := make([]byte, 32)
-	if _, err := rand.Read(onionKey); err != nil {
-		t.Fatalf("Failed to generate onion key: %v", err)
-	}
-
-	authKey := make([]byte, 32)
-	if _, err := rand.Read(authKey); err != nil {
-		t.Fatalf("Failed to generate auth key: %v", err)
-	}
-
-	req := &IntroduceRequest{
-		IntroPoint: &IntroductionPoint{
-			EncKey:  introPointPublic[:],
-			AuthKey: authKey,
-		},
-		RendezvousCookie: rendezvousCookie,
-		RendezvousPoint:  "test-rendezvous-point",
-		OnionKey:         onionKey,
-	}
-
-	// Build INTRODUCE1 cell
-	introduce1Cell, err := intro.BuildIntroduce1Cell(req)
+	specs, _, err := parseLinkSpecifiers(plaintext[56:])
 	if err != nil {
-		t.Fatalf("Failed to build INTRODUCE1 cell: %v", err)
+		t.Fatalf("Failed to parse link specifiers: %v", err)
 	}
-
-	// Verify cell structure
-	// INTRODUCE1 cell format:
-	// LEGACY_KEY_ID (20) + AUTH_KEY_TYPE (1) + AUTH_KEY_LEN (2) + AUTH_KEY (32) + N_EXTENSIONS (1) + ENCRYPTED_DATA
-	minLen := 20 + 1 + 2 + 32 + 1 + 32 + 53 // +32 for client PK, +53 for encrypted payload
-	if len(introduce1Cell) < minLen {
-		t.Errorf("INTRODUCE1 cell length = %d, want >= %d", len(introduce1Cell), minLen)
+	if len(specs) != len(linkSpecs) {
+		t.Errorf("Got %d link specifiers, want %d", len(specs), len(linkSpecs))
 	}
-
-	t.Logf("Successfully created encrypted INTRODUCE1 cell of %d bytes", len(introduce1Cell))
 }
 
 // ============================================================================
@@ -2678,10 +2599,10 @@ func TestVerifyDescriptorSignatureCertificateInvalidType(t *testing.T) {
 		Version: V3,
 		Pubkey:  make([]byte, 32),
 	}
-	// Create certificate with invalid type (not 4)
+	// Create certificate with invalid type (not 8)
 	certData := make([]byte, 104)
 	certData[0] = 1 // Valid version
-	certData[1] = 5 // Invalid type (should be 4 for signing key cert)
+	certData[1] = 4 // Invalid type (should be 8 for descriptor signing key cert)
 	// Add expiration (4 bytes), key_type (1 byte), certified_key (32 bytes), n_ext (1 byte), signature (64 bytes)
 	// Set expiration to future (hours since epoch)
 	futureHours := uint32((time.Now().Add(24 * time.Hour).Unix()) / 3600)
@@ -2718,8 +2639,8 @@ func TestVerifyDescriptorSignatureCertificateExpired(t *testing.T) {
 	}
 	// Create certificate with expired time
 	certData := make([]byte, 104)
-	certData[0] = 1 // Valid version
-	certData[1] = 4 // Valid type (signing key cert)
+	certData[0] = 1                         // Valid version
+	certData[1] = certTypeDescriptorSigning // Valid type
 	// Set expiration to past (hours since epoch - year 2000)
 	pastHours := uint32(1) // Very old
 	certData[2] = byte(pastHours >> 24)
@@ -2762,8 +2683,8 @@ func TestVerifyDescriptorSignatureCertificateSignatureFailed(t *testing.T) {
 
 	// Create certificate with wrong signature
 	certData := make([]byte, 104)
-	certData[0] = 1 // Valid version
-	certData[1] = 4 // Valid type
+	certData[0] = 1                         // Valid version
+	certData[1] = certTypeDescriptorSigning // Valid type
 	// Set expiration to future
 	futureHours := uint32((time.Now().Add(24 * time.Hour).Unix()) / 3600)
 	certData[2] = byte(futureHours >> 24)
@@ -2812,10 +2733,16 @@ func TestVerifyDescriptorSignatureDescriptorSignatureFailed(t *testing.T) {
 		Pubkey:  identityPub,
 	}
 
-	// Build a valid certificate signed by the identity key
+	// The certificate is signed by the blinded identity key
+	blinded, err := blindIdentity(identityPriv, 1, defaultPeriodLength)
+	if err != nil {
+		t.Fatalf("Failed to blind identity key: %v", err)
+	}
+
+	// Build a valid certificate signed by the blinded key
 	certData := make([]byte, 104)
-	certData[0] = 1 // Version
-	certData[1] = 4 // Type
+	certData[0] = 1                         // Version
+	certData[1] = certTypeDescriptorSigning // Type
 	// Set expiration to future
 	futureHours := uint32((time.Now().Add(24 * time.Hour).Unix()) / 3600)
 	certData[2] = byte(futureHours >> 24)
@@ -2828,9 +2755,12 @@ func TestVerifyDescriptorSignatureDescriptorSignatureFailed(t *testing.T) {
 	// n_extensions = 0
 	certData[39] = 0
 
-	// Sign the certificate data with identity key
+	// Sign the certificate data with the blinded key
 	signedPortion := certData[:40]
-	certSig := ed25519.Sign(identityPriv, signedPortion)
+	certSig, err := blinded.sign(signedPortion)
+	if err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
 	copy(certData[40:104], certSig)
 
 	// Create raw descriptor with signature line
@@ -2844,6 +2774,7 @@ func TestVerifyDescriptorSignatureDescriptorSignatureFailed(t *testing.T) {
 		Signature:                wrongSignature,
 		RawDescriptor:            rawDesc,
 		DescriptorSigningKeyCert: certData,
+		BlindedPubkey:            blinded.public,
 	}
 
 	err = VerifyDescriptorSignature(desc, addr)
@@ -2874,10 +2805,16 @@ func TestVerifyDescriptorSignatureSuccess(t *testing.T) {
 		Pubkey:  identityPub,
 	}
 
-	// Build a valid certificate signed by the identity key
+	// The certificate is signed by the blinded identity key
+	blinded, err := blindIdentity(identityPriv, 1, defaultPeriodLength)
+	if err != nil {
+		t.Fatalf("Failed to blind identity key: %v", err)
+	}
+
+	// Build a valid certificate signed by the blinded key
 	certData := make([]byte, 104)
-	certData[0] = 1 // Version
-	certData[1] = 4 // Type
+	certData[0] = 1                         // Version
+	certData[1] = certTypeDescriptorSigning // Type
 	// Set expiration to future
 	futureHours := uint32((time.Now().Add(24 * time.Hour).Unix()) / 3600)
 	certData[2] = byte(futureHours >> 24)
@@ -2890,16 +2827,19 @@ func TestVerifyDescriptorSignatureSuccess(t *testing.T) {
 	// n_extensions = 0
 	certData[39] = 0
 
-	// Sign the certificate data with identity key
+	// Sign the certificate data with the blinded key
 	signedPortion := certData[:40]
-	certSig := ed25519.Sign(identityPriv, signedPortion)
+	certSig, err := blinded.sign(signedPortion)
+	if err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
 	copy(certData[40:104], certSig)
 
 	// Create raw descriptor content before signature line
 	descriptorContent := "hs-descriptor 3\ndescriptor-lifetime 180\n"
 
-	// Sign the descriptor content with the signing key
-	descriptorSig := ed25519.Sign(signingPriv, []byte(descriptorContent))
+	// Sign the prefixed descriptor content with the signing key
+	descriptorSig := ed25519.Sign(signingPriv, []byte(descriptorSigPrefix+descriptorContent))
 
 	// Create full raw descriptor with signature line
 	rawDesc := descriptorContent + "signature " + base64.StdEncoding.EncodeToString(descriptorSig)
@@ -2908,6 +2848,7 @@ func TestVerifyDescriptorSignatureSuccess(t *testing.T) {
 		Signature:                descriptorSig,
 		RawDescriptor:            []byte(rawDesc),
 		DescriptorSigningKeyCert: certData,
+		BlindedPubkey:            blinded.public,
 	}
 
 	err = VerifyDescriptorSignature(desc, addr)
@@ -2935,10 +2876,14 @@ func TestVerifyDescriptorSignatureWithCertChain(t *testing.T) {
 		Pubkey:  identityPub,
 	}
 
-	// Build a valid certificate
+	// Build a valid certificate signed by the blinded key
+	blinded, err := blindIdentity(identityPriv, 1, defaultPeriodLength)
+	if err != nil {
+		t.Fatalf("Failed to blind identity key: %v", err)
+	}
 	certData := make([]byte, 104)
-	certData[0] = 1 // Version
-	certData[1] = 4 // Type
+	certData[0] = 1                         // Version
+	certData[1] = certTypeDescriptorSigning // Type
 	futureHours := uint32((time.Now().Add(24 * time.Hour).Unix()) / 3600)
 	certData[2] = byte(futureHours >> 24)
 	certData[3] = byte(futureHours >> 16)
@@ -2947,17 +2892,21 @@ func TestVerifyDescriptorSignatureWithCertChain(t *testing.T) {
 	certData[6] = 1
 	copy(certData[7:39], signingPub)
 	certData[39] = 0
-	certSig := ed25519.Sign(identityPriv, certData[:40])
+	certSig, err := blinded.sign(certData[:40])
+	if err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
 	copy(certData[40:104], certSig)
 
 	descriptorContent := "hs-descriptor 3\n"
-	descriptorSig := ed25519.Sign(signingPriv, []byte(descriptorContent))
+	descriptorSig := ed25519.Sign(signingPriv, []byte(descriptorSigPrefix+descriptorContent))
 	rawDesc := descriptorContent + "signature test"
 
 	desc := &Descriptor{
 		Signature:                descriptorSig,
 		RawDescriptor:            []byte(rawDesc),
 		DescriptorSigningKeyCert: certData,
+		BlindedPubkey:            blinded.public,
 	}
 
 	err = VerifyDescriptorSignatureWithCertChain(desc, addr)
@@ -0,0 +1,225 @@
+// Package onion - Proof-of-work defense
+// This file implements the v1 client puzzle (Equi-X) that an onion service
+// under load asks clients to solve before it answers their introductions
+// (proposal 327, hspow-spec/v1-equix.md)
+package onion
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/opd-ai/go-tor/pkg/equix"
+)
+
+const (
+	// powTypeV1 is the pow-params type for Equi-X puzzles
+	powTypeV1 = "v1"
+
+	// Puzzle fields (hspow-spec/v1-equix.md)
+	powChallengePrefix = "Tor hs intro v1\x00"
+	powSeedLen         = 32
+	powSeedHeadLen     = 4
+	powNonceLen        = 16
+
+	// INTRODUCE1 encrypted extension carrying a solution:
+	// POW_VERSION [1] | POW_NONCE [16] | POW_EFFORT [4] | POW_SEED [4] | POW_SOLUTION [16]
+	introduceExtPoW   = 0x02
+	powVersionV1      = 0x01
+	powExtensionLen   = 1 + powNonceLen + 4 + powSeedHeadLen + equix.SolutionSize
+	powExpirationTime = "2006-01-02T15:04:05"
+
+	// DefaultMaxPoWEffort caps the effort a client spends on a puzzle, as
+	// C Tor does, whatever the descriptor suggests
+	DefaultMaxPoWEffort = 10000
+)
+
+// PoWParams are the pow-params a service publishes in its descriptor: the
+// seed of the current puzzle and the effort it suggests clients solve it
+// with
+type PoWParams struct {
+	Seed            [powSeedLen]byte
+	SuggestedEffort uint32
+	Expires         time.Time // When the service stops accepting the seed
+}
+
+// encode returns the pow-params line for the encrypted descriptor layer
+func (p *PoWParams) encode() string {
+	return fmt.Sprintf("pow-params %s %s %d %s\n", powTypeV1,
+		base64.RawStdEncoding.EncodeToString(p.Seed[:]),
+		p.SuggestedEffort,
+		p.Expires.UTC().Format(powExpirationTime))
+}
+
+// parsePoWParams parses the arguments of a pow-params line. Puzzle types
+// other than v1 are reported as nil without an error.
+func parsePoWParams(args string) (*PoWParams, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("pow-params without a type")
+	}
+	if fields[0] != powTypeV1 {
+		return nil, nil
+	}
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("pow-params v1 has %d arguments, want 3", len(fields)-1)
+	}
+
+	params := &PoWParams{}
+	seed, err := decodeDescriptorBase64(fields[1])
+	if err != nil || len(seed) != powSeedLen {
+		return nil, fmt.Errorf("invalid pow-params seed")
+	}
+	copy(params.Seed[:], seed)
+	effort, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pow-params effort: %w", err)
+	}
+	params.SuggestedEffort = uint32(effort)
+	if params.Expires, err = time.Parse(powExpirationTime, fields[3]); err != nil {
+		return nil, fmt.Errorf("invalid pow-params expiration: %w", err)
+	}
+	return params, nil
+}
+
+// PoWSolution is a solved puzzle, sent to the service in the encrypted
+// part of INTRODUCE1
+type PoWSolution struct {
+	Nonce    [powNonceLen]byte
+	Effort   uint32
+	SeedHead [powSeedHeadLen]byte // First bytes of the seed it was solved for
+	Solution equix.Solution
+}
+
+// extension encodes the solution as the PoW extension field
+func (p *PoWSolution) extension() []byte {
+	field := make([]byte, 0, powExtensionLen)
+	field = append(field, powVersionV1)
+	field = append(field, p.Nonce[:]...)
+	field = binary.BigEndian.AppendUint32(field, p.Effort)
+	field = append(field, p.SeedHead[:]...)
+	return append(field, p.Solution.Bytes()...)
+}
+
+// parsePoWExtension decodes a PoW extension field
+func parsePoWExtension(field []byte) (*PoWSolution, error) {
+	if len(field) != powExtensionLen {
+		return nil, fmt.Errorf("invalid PoW extension length: %d", len(field))
+	}
+	if field[0] != powVersionV1 {
+		return nil, fmt.Errorf("unsupported PoW version %d", field[0])
+	}
+	p := &PoWSolution{}
+	offset := 1
+	offset += copy(p.Nonce[:], field[offset:])
+	p.Effort = binary.BigEndian.Uint32(field[offset:])
+	offset += 4
+	offset += copy(p.SeedHead[:], field[offset:])
+	solution, err := equix.ParseSolution(field[offset:])
+	if err != nil {
+		return nil, err
+	}
+	p.Solution = solution
+	return p, nil
+}
+
+// powChallenge returns the Equi-X challenge for a nonce and effort:
+// P || ID || C || N || INT_32(E), where ID is the service's blinded key
+func powChallenge(blindedKey []byte, seed *[powSeedLen]byte, nonce *[powNonceLen]byte, effort uint32) []byte {
+	challenge := make([]byte, 0, len(powChallengePrefix)+len(blindedKey)+powSeedLen+powNonceLen+4)
+	challenge = append(challenge, powChallengePrefix...)
+	challenge = append(challenge, blindedKey...)
+	challenge = append(challenge, seed[:]...)
+	challenge = append(challenge, nonce[:]...)
+	return binary.BigEndian.AppendUint32(challenge, effort)
+}
+
+// powMeetsEffort reports whether an Equi-X solution also meets the effort:
+// R * E must not exceed 2^32-1, where R is the 32-bit big-endian BLAKE2b
+// digest of the challenge and the solution
+func powMeetsEffort(challenge []byte, solution equix.Solution, effort uint32) bool {
+	h, err := blake2b.New(4, nil)
+	if err != nil {
+		return false
+	}
+	h.Write(challenge)
+	h.Write(solution.Bytes())
+	r := binary.BigEndian.Uint32(h.Sum(nil))
+	return uint64(r)*uint64(effort) <= math.MaxUint32
+}
+
+// SolvePoW solves the puzzle of pow-params at the given effort for the
+// service whose blinded key is blindedKey. Each nonce takes an Equi-X solve
+// and yields a solution meeting the effort with probability about 1/effort,
+// so this takes effort solves on average.
+func SolvePoW(ctx context.Context, params *PoWParams, blindedKey []byte, effort uint32) (*PoWSolution, error) {
+	if params == nil {
+		return nil, fmt.Errorf("no pow-params")
+	}
+	if len(blindedKey) != 32 {
+		return nil, fmt.Errorf("invalid blinded key length: %d", len(blindedKey))
+	}
+
+	solution := &PoWSolution{Effort: effort}
+	copy(solution.SeedHead[:], params.Seed[:])
+	if _, err := rand.Read(solution.Nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate PoW nonce: %w", err)
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		challenge := powChallenge(blindedKey, &params.Seed, &solution.Nonce, effort)
+		candidates, err := equix.Solve(challenge)
+		if err != nil && !errors.Is(err, equix.ErrProgramGeneration) {
+			return nil, err
+		}
+		for _, candidate := range candidates {
+			if powMeetsEffort(challenge, candidate, effort) {
+				solution.Solution = candidate
+				return solution, nil
+			}
+		}
+		incrementNonce(&solution.Nonce)
+	}
+}
+
+// incrementNonce adds one to a nonce read as a little-endian integer
+func incrementNonce(nonce *[powNonceLen]byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// verifyPoW checks a solution against a seed of ours
+func verifyPoW(p *PoWSolution, blindedKey []byte, seed *[powSeedLen]byte) error {
+	challenge := powChallenge(blindedKey, seed, &p.Nonce, p.Effort)
+	if !powMeetsEffort(challenge, p.Solution, p.Effort) {
+		return fmt.Errorf("PoW solution does not meet effort %d", p.Effort)
+	}
+	if err := equix.Verify(challenge, p.Solution); err != nil {
+		return fmt.Errorf("invalid PoW solution: %w", err)
+	}
+	return nil
+}
+
+// clientPoWEffort returns the effort a client puts into a descriptor's
+// puzzle, or 0 if it does not ask for one
+func clientPoWEffort(params *PoWParams, maxEffort uint32, now time.Time) uint32 {
+	if params == nil || !now.Before(params.Expires) {
+		return 0
+	}
+	return min(params.SuggestedEffort, maxEffort)
+}
@@ -0,0 +1,271 @@
+package onion
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/opd-ai/go-tor/pkg/equix"
+)
+
+func testPoWParams(effort uint32) *PoWParams {
+	params := &PoWParams{
+		SuggestedEffort: effort,
+		Expires:         time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	for i := range params.Seed {
+		params.Seed[i] = byte(i)
+	}
+	return params
+}
+
+func TestPoWParamsEncoding(t *testing.T) {
+	params := testPoWParams(1234)
+	line := params.encode()
+	want := "pow-params v1 AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8 1234 2030-01-02T03:04:05\n"
+	if line != want {
+		t.Errorf("encode() = %q, want %q", line, want)
+	}
+
+	parsed, err := parsePoWParams(strings.TrimSpace(strings.TrimPrefix(line, "pow-params")))
+	if err != nil {
+		t.Fatalf("parsePoWParams() error = %v", err)
+	}
+	if parsed.Seed != params.Seed || parsed.SuggestedEffort != 1234 || !parsed.Expires.Equal(params.Expires) {
+		t.Errorf("parsePoWParams() = %+v, want %+v", parsed, params)
+	}
+
+	// Other puzzle types are skipped
+	if parsed, err := parsePoWParams("v2 whatever"); err != nil || parsed != nil {
+		t.Errorf("parsePoWParams(v2) = %v, %v, want nil, nil", parsed, err)
+	}
+
+	for _, args := range []string{
+		"",
+		"v1 AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8 1234",
+		"v1 AAECAw 1234 2030-01-02T03:04:05",
+		"v1 AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8 -1 2030-01-02T03:04:05",
+		"v1 AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8 1234 2030-01-02",
+	} {
+		if _, err := parsePoWParams(args); err == nil {
+			t.Errorf("parsePoWParams(%q) accepted invalid arguments", args)
+		}
+	}
+}
+
+func TestPoWExtension(t *testing.T) {
+	solution := &PoWSolution{
+		Effort:   0x01020304,
+		SeedHead: [4]byte{0xAA, 0xBB, 0xCC, 0xDD},
+		Solution: equix.Solution{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	copy(solution.Nonce[:], bytes.Repeat([]byte{0x55}, powNonceLen))
+
+	field := solution.extension()
+	if len(field) != powExtensionLen {
+		t.Fatalf("Extension is %d bytes, want %d", len(field), powExtensionLen)
+	}
+	if field[0] != powVersionV1 || !bytes.Equal(field[17:21], []byte{1, 2, 3, 4}) || !bytes.Equal(field[21:25], solution.SeedHead[:]) {
+		t.Errorf("Extension fields out of place: %x", field)
+	}
+
+	parsed, err := parsePoWExtension(field)
+	if err != nil {
+		t.Fatalf("parsePoWExtension() error = %v", err)
+	}
+	if *parsed != *solution {
+		t.Errorf("parsePoWExtension() = %+v, want %+v", parsed, solution)
+	}
+
+	if _, err := parsePoWExtension(field[:40]); err == nil {
+		t.Error("parsePoWExtension() accepted a short field")
+	}
+	field[0] = 2
+	if _, err := parsePoWExtension(field); err == nil {
+		t.Error("parsePoWExtension() accepted an unknown version")
+	}
+}
+
+func TestPoWChallenge(t *testing.T) {
+	params := testPoWParams(0)
+	blindedKey := bytes.Repeat([]byte{0xB1}, 32)
+	var nonce [powNonceLen]byte
+	copy(nonce[:], bytes.Repeat([]byte{0x4E}, powNonceLen))
+
+	challenge := powChallenge(blindedKey, &params.Seed, &nonce, 500)
+	want := append([]byte("Tor hs intro v1\x00"), blindedKey...)
+	want = append(want, params.Seed[:]...)
+	want = append(want, nonce[:]...)
+	want = append(want, 0, 0, 0x01, 0xF4)
+	if !bytes.Equal(challenge, want) {
+		t.Errorf("powChallenge() = %x, want %x", challenge, want)
+	}
+}
+
+func TestPoWMeetsEffort(t *testing.T) {
+	challenge := []byte("challenge")
+	solution := equix.Solution{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// R is the 4-byte BLAKE2b digest read as a big-endian number
+	h, err := blake2b.New(4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(challenge)
+	h.Write(solution.Bytes())
+	r := uint64(binary.BigEndian.Uint32(h.Sum(nil)))
+
+	for _, effort := range []uint32{0, 1, 2, 1000, math.MaxUint32} {
+		want := r*uint64(effort) <= math.MaxUint32
+		if got := powMeetsEffort(challenge, solution, effort); got != want {
+			t.Errorf("powMeetsEffort(effort %d) = %v, want %v (R = %d)", effort, got, want, r)
+		}
+	}
+}
+
+func TestSolvePoW(t *testing.T) {
+	params := testPoWParams(4)
+	blindedKey := bytes.Repeat([]byte{0xB1}, 32)
+
+	solution, err := SolvePoW(context.Background(), params, blindedKey, 4)
+	if err != nil {
+		t.Fatalf("SolvePoW() error = %v", err)
+	}
+	if solution.Effort != 4 || !bytes.Equal(solution.SeedHead[:], params.Seed[:4]) {
+		t.Errorf("Solution has effort %d and seed head %x", solution.Effort, solution.SeedHead)
+	}
+	if err := verifyPoW(solution, blindedKey, &params.Seed); err != nil {
+		t.Fatalf("verifyPoW() error = %v", err)
+	}
+
+	// A solution only holds for its own service, seed and nonce
+	if err := verifyPoW(solution, bytes.Repeat([]byte{0xB2}, 32), &params.Seed); err == nil {
+		t.Error("Solution verified for another service")
+	}
+	otherSeed := params.Seed
+	otherSeed[31]++
+	if err := verifyPoW(solution, blindedKey, &otherSeed); err == nil {
+		t.Error("Solution verified for another seed")
+	}
+	tampered := *solution
+	incrementNonce(&tampered.Nonce)
+	if err := verifyPoW(&tampered, blindedKey, &params.Seed); err == nil {
+		t.Error("Solution verified with another nonce")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := SolvePoW(ctx, params, blindedKey, 4); err == nil {
+		t.Error("SolvePoW() ignored a cancelled context")
+	}
+	if _, err := SolvePoW(context.Background(), params, blindedKey[:31], 4); err == nil {
+		t.Error("SolvePoW() accepted a short blinded key")
+	}
+}
+
+// TestPoWVectors checks v1 puzzle solutions from tor's test_hs_pow.c: each
+// Equi-X solution holds for its seed, blinded key, nonce and effort only
+func TestPoWVectors(t *testing.T) {
+	vectors := []struct {
+		effort     uint32
+		seed       string
+		blindedKey string
+		nonce      string
+		solution   string
+	}{
+		{0, strings.Repeat("aa", 32), strings.Repeat("11", 32), strings.Repeat("55", 16), "4312f87ceab844c78e1c793a913812d7"},
+		{1, strings.Repeat("aa", 32), strings.Repeat("11", 32), strings.Repeat("55", 16), "84355542ab2b3f79532ef055144ac5ab"},
+		{1, strings.Repeat("aa", 32), strings.Repeat("11", 31) + "10", strings.Repeat("55", 16), "115e4b70da858792fc205030b8c83af9"},
+		{2, strings.Repeat("aa", 32), strings.Repeat("11", 32), strings.Repeat("55", 16), "4600a93a535ed76dc746c99942ab7de2"},
+	}
+	for _, v := range vectors {
+		var seed [powSeedLen]byte
+		hex.Decode(seed[:], []byte(v.seed))
+		blindedKey, _ := hex.DecodeString(v.blindedKey)
+		encoded, _ := hex.DecodeString(v.solution)
+		solution, err := equix.ParseSolution(encoded)
+		if err != nil {
+			t.Fatalf("ParseSolution(%s) error = %v", v.solution, err)
+		}
+		p := &PoWSolution{Effort: v.effort, Solution: solution}
+		hex.Decode(p.Nonce[:], []byte(v.nonce))
+		copy(p.SeedHead[:], seed[:])
+
+		if err := verifyPoW(p, blindedKey, &seed); err != nil {
+			t.Errorf("verifyPoW(%s) error = %v", v.solution, err)
+		}
+		// The solver finds the same solution for the nonce
+		candidates, err := equix.Solve(powChallenge(blindedKey, &seed, &p.Nonce, v.effort))
+		if err != nil || !slices.Contains(candidates, solution) {
+			t.Errorf("Solve() for effort %d found %v (%v), want %s among them", v.effort, candidates, err, v.solution)
+		}
+		p.Effort++
+		if err := verifyPoW(p, blindedKey, &seed); err == nil {
+			t.Errorf("Solution %s verified for effort %d", v.solution, p.Effort)
+		}
+	}
+}
+
+func TestIncrementNonce(t *testing.T) {
+	var nonce [powNonceLen]byte
+	nonce[0], nonce[1] = 0xFF, 0xFF
+	incrementNonce(&nonce)
+	if nonce[0] != 0 || nonce[1] != 0 || nonce[2] != 1 {
+		t.Errorf("incrementNonce() = %x, want carry into the third byte", nonce)
+	}
+}
+
+func TestClientPoWEffort(t *testing.T) {
+	now := time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		params    *PoWParams
+		maxEffort uint32
+		want      uint32
+	}{
+		{"no params", nil, DefaultMaxPoWEffort, 0},
+		{"suggested", testPoWParams(50), DefaultMaxPoWEffort, 50},
+		{"capped", testPoWParams(50000), DefaultMaxPoWEffort, DefaultMaxPoWEffort},
+		{"disabled", testPoWParams(50), 0, 0},
+		{"expired", &PoWParams{SuggestedEffort: 50, Expires: now}, DefaultMaxPoWEffort, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientPoWEffort(tt.params, tt.maxEffort, now); got != tt.want {
+				t.Errorf("clientPoWEffort() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptedLayerPoWParams(t *testing.T) {
+	params := testPoWParams(77)
+	plaintext, err := buildEncryptedPlaintext(nil, params)
+	if err != nil {
+		t.Fatalf("buildEncryptedPlaintext() error = %v", err)
+	}
+	_, parsed, err := parseEncryptedPlaintext(plaintext, nil)
+	if err != nil {
+		t.Fatalf("parseEncryptedPlaintext() error = %v", err)
+	}
+	if parsed == nil || parsed.Seed != params.Seed || parsed.SuggestedEffort != 77 {
+		t.Errorf("parseEncryptedPlaintext() pow-params = %+v, want %+v", parsed, params)
+	}
+
+	// Descriptors without the line have no puzzle
+	plaintext, err = buildEncryptedPlaintext(nil, nil)
+	if err != nil {
+		t.Fatalf("buildEncryptedPlaintext() error = %v", err)
+	}
+	if _, parsed, err = parseEncryptedPlaintext(plaintext, nil); err != nil || parsed != nil {
+		t.Errorf("parseEncryptedPlaintext() = %v, %v, want no pow-params", parsed, err)
+	}
+}
@@ -3,16 +3,25 @@
 package onion
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base32"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/circuit"
+	"github.com/opd-ai/go-tor/pkg/crypto"
 	"github.com/opd-ai/go-tor/pkg/logger"
 	"github.com/opd-ai/go-tor/pkg/security"
 )
@@ -22,25 +31,43 @@ type Service struct {
 	mu sync.RWMutex
 
 	// Identity
-	identityKey ed25519.PrivateKey // 64-byte Ed25519 private key
-	publicKey   ed25519.PublicKey  // 32-byte Ed25519 public key
-	address     *Address           // Derived .onion address
+	identityKey []byte            // 64-byte expanded Ed25519 private key (scalar | prefix)
+	publicKey   ed25519.PublicKey // 32-byte Ed25519 public key
+	address     *Address          // Derived .onion address
 
 	// Configuration
 	config *ServiceConfig
 
 	// State
-	descriptor      *Descriptor
-	introPoints     []*ServiceIntroPoint
-	publishedHSDirs []*HSDirectory
-	lastPublish     time.Time
-	running         bool
-	ctx             context.Context
-	cancel          context.CancelFunc
-	logger          *logger.Logger
+	descriptor     *Descriptor
+	descriptorRing HashRing    // Ring of the time period descriptor is blinded for
+	nextDescriptor *Descriptor // Descriptor for the next time period, only in the overlap period
+	nextRing       HashRing
+	introPoints    []*ServiceIntroPoint
+	uploads        map[hsdirUploadKey]*HSDirUpload // Last upload to each responsible HSDir
+	lastPublish    time.Time
+	running        bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	logger         *logger.Logger
 
 	// Connections
 	pendingIntros map[string]*PendingIntro // cookie -> intro
+
+	// Consensus values for the HSDir hash ring
+	params NetworkParams
+
+	// Relays of the latest consensus, the candidate HSDirs and
+	// introduction points
+	relays []*HSDirectory
+
+	// Builds circuits to rendezvous points
+	circuitBuilder   CircuitBuilder
+	activeRendezvous int // Rendezvous circuits being served
+
+	// Proof-of-work defense, if configured
+	pow          *servicePoW
+	introQueueUp sync.Once // Starts the workers answering queued introductions
 }
 
 // ServiceConfig contains configuration for hosting an onion service
@@ -58,18 +85,44 @@ type ServiceConfig struct {
 	// Descriptor lifetime (default: 3 hours)
 	DescriptorLifetime time.Duration
 
-	// Directory to store persistent state
+	// Service directory (HiddenServiceDir) holding the identity key in
+	// C-tor's format, the hostname file and authorized_clients. If empty,
+	// the identity only lasts as long as the process.
 	DataDirectory string
+
+	// x25519 public keys of the clients allowed to connect. If set, only
+	// these clients can decrypt the introduction points in the descriptor.
+	AuthorizedClients [][]byte
+
+	// Limits on INTRODUCE2 cells sent to the introduction points in
+	// ESTABLISH_INTRO. If nil, the relays apply their consensus defaults.
+	IntroDoS *IntroDoSParams
+
+	// Proof-of-work defense: the descriptor asks clients to solve puzzles
+	// and introductions are answered highest effort first. If nil, they
+	// are answered as they arrive.
+	PoW *PoWConfig
 }
 
 // ServiceIntroPoint represents an introduction point for this service
 type ServiceIntroPoint struct {
 	Relay       *HSDirectory // The relay acting as intro point
 	CircuitID   uint32       // Circuit to the intro point
-	AuthKey     []byte       // Authentication key for this intro point
-	EncKey      []byte       // Encryption key for this intro point
-	Established bool         // Whether ESTABLISH_INTRO succeeded
+	AuthKey     []byte       // Ed25519 authentication key for this intro point
+	EncKey      []byte       // Curve25519 hs-ntor encryption key for this intro point
+	Established bool         // Whether ESTABLISH_INTRO succeeded and the circuit is open
 	CreatedAt   time.Time
+	ExpiresAt   time.Time // When the point is replaced however little it was used
+
+	// Introductions counts the INTRODUCE2 cells accepted; the point is
+	// replaced once it reaches maxIntroductions
+	Introductions    int
+	maxIntroductions int
+
+	authPrivate ed25519.PrivateKey  // Signs ESTABLISH_INTRO
+	encPrivate  [32]byte            // Decrypts INTRODUCE2
+	seenClients map[string]struct{} // Client keys of accepted INTRODUCE2 cells, for replay detection
+	circ        *circuit.Circuit    // Circuit to the introduction point
 }
 
 // PendingIntro represents a pending introduction request
@@ -90,26 +143,39 @@ func NewService(config *ServiceConfig, log *logger.Logger) (*Service, error) {
 		log = logger.NewDefault()
 	}
 
-	// Generate or load identity key
-	var privateKey ed25519.PrivateKey
-	var publicKey ed25519.PublicKey
+	if config.DataDirectory != "" {
+		if err := os.MkdirAll(config.DataDirectory, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create service directory: %w", err)
+		}
+	}
 
-	if len(config.PrivateKey) > 0 {
-		// Use provided key
+	// Use the given identity key, or load it from the service directory,
+	// generating and saving one on first start
+	var identity *serviceIdentity
+	var err error
+	switch {
+	case len(config.PrivateKey) > 0:
 		if len(config.PrivateKey) != ed25519.PrivateKeySize {
 			return nil, fmt.Errorf("invalid private key size: %d, expected %d",
 				len(config.PrivateKey), ed25519.PrivateKeySize)
 		}
-		privateKey = config.PrivateKey
-		publicKey = privateKey.Public().(ed25519.PublicKey)
-	} else {
-		// Generate new identity
-		var err error
-		publicKey, privateKey, err = ed25519.GenerateKey(rand.Reader)
+		identity = identityFromPrivateKey(config.PrivateKey)
+	case config.DataDirectory != "":
+		identity, err = loadServiceIdentity(config.DataDirectory)
+		if errors.Is(err, fs.ErrNotExist) {
+			if identity, err = generateServiceIdentity(); err == nil {
+				err = identity.save(config.DataDirectory)
+			}
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate identity key: %w", err)
+			return nil, fmt.Errorf("failed to load service keys from %s: %w", config.DataDirectory, err)
+		}
+	default:
+		if identity, err = generateServiceIdentity(); err != nil {
+			return nil, err
 		}
 	}
+	publicKey := identity.public
 
 	// Derive onion address from public key
 	addr, err := addressFromPublicKey(publicKey)
@@ -136,19 +202,49 @@ func NewService(config *ServiceConfig, log *logger.Logger) (*Service, error) {
 		config.Ports = make(map[int]string)
 	}
 
+	if config.DataDirectory != "" {
+		if err := writeHostname(config.DataDirectory, addr); err != nil {
+			return nil, err
+		}
+		clients, err := loadAuthorizedClients(config.DataDirectory, log)
+		if err != nil {
+			return nil, err
+		}
+		config.AuthorizedClients = append(config.AuthorizedClients, clients...)
+	}
+
+	for i, key := range config.AuthorizedClients {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid authorized client key %d: length %d, expected 32", i, len(key))
+		}
+	}
+	if config.IntroDoS != nil {
+		if err := config.IntroDoS.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var pow *servicePoW
+	if config.PoW != nil {
+		if pow, err = newServicePoW(config.PoW); err != nil {
+			return nil, err
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	service := &Service{
-		identityKey:     privateKey,
-		publicKey:       publicKey,
-		address:         addr,
-		config:          config,
-		introPoints:     make([]*ServiceIntroPoint, 0, config.NumIntroPoints),
-		publishedHSDirs: make([]*HSDirectory, 0),
-		pendingIntros:   make(map[string]*PendingIntro),
-		ctx:             ctx,
-		cancel:          cancel,
-		logger:          log.Component("onion-service"),
+		identityKey:   identity.expanded,
+		publicKey:     publicKey,
+		address:       addr,
+		config:        config,
+		introPoints:   make([]*ServiceIntroPoint, 0, config.NumIntroPoints),
+		uploads:       make(map[hsdirUploadKey]*HSDirUpload),
+		pendingIntros: make(map[string]*PendingIntro),
+		ctx:           ctx,
+		cancel:        cancel,
+		logger:        log.Component("onion-service"),
+		pow:           pow,
 	}
 
 	return service, nil
@@ -180,6 +276,36 @@ func addressFromPublicKey(pubkey ed25519.PublicKey) (*Address, error) {
 	}, nil
 }
 
+// SetNetworkParams sets the consensus values used to place the descriptor
+// on the HSDir hash ring
+func (s *Service) SetNetworkParams(params NetworkParams) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.params = params
+}
+
+// UpdateRelays sets the relays of a new consensus, used from the next
+// publication check or introduction point rotation on
+func (s *Service) UpdateRelays(relays []*HSDirectory) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.relays = relays
+}
+
+// currentRelays returns the relays of the latest consensus
+func (s *Service) currentRelays() []*HSDirectory {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.relays
+}
+
+// SetCircuitBuilder sets the builder for circuits to rendezvous points
+func (s *Service) SetCircuitBuilder(builder CircuitBuilder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.circuitBuilder = builder
+}
+
 // GetAddress returns the onion address of this service
 func (s *Service) GetAddress() string {
 	s.mu.RLock()
@@ -195,6 +321,7 @@ func (s *Service) Start(ctx context.Context, hsdirs []*HSDirectory) error {
 		return fmt.Errorf("service already running")
 	}
 	s.running = true
+	s.relays = hsdirs
 	s.mu.Unlock()
 
 	s.logger.Info("Starting onion service",
@@ -220,7 +347,7 @@ func (s *Service) Start(ctx context.Context, hsdirs []*HSDirectory) error {
 	}
 
 	// Step 4: Start background tasks
-	go s.maintenanceLoop(ctx, hsdirs)
+	go s.maintenanceLoop(ctx)
 
 	s.logger.Info("Onion service started successfully",
 		"address", s.address.String())
@@ -242,12 +369,9 @@ func (s *Service) Stop() error {
 	// Cancel context to stop background tasks
 	s.cancel()
 
-	// Clean up introduction points
+	// Closing the circuits tears down the introduction points
 	for _, intro := range s.introPoints {
-		// In a full implementation, we would:
-		// 1. Send INTRO_ESTABLISHED teardown
-		// 2. Close circuits
-		_ = intro
+		closeIntroCircuit(intro.circ)
 	}
 
 	s.running = false
@@ -256,113 +380,63 @@ func (s *Service) Stop() error {
 	return nil
 }
 
-// establishIntroductionPoints selects and establishes circuits to introduction points
-func (s *Service) establishIntroductionPoints(ctx context.Context, hsdirs []*HSDirectory) error {
-	s.logger.Info("Establishing introduction points", "count", s.config.NumIntroPoints)
+// createDescriptor creates the onion service descriptor for the current
+// time period and, in the overlap period, the one for the next time period
+func (s *Service) createDescriptor() error {
+	s.mu.RLock()
+	ring := s.params.CurrentHashRing()
+	nextRing, overlap := s.params.NextHashRing()
+	s.mu.RUnlock()
 
-	if len(hsdirs) < s.config.NumIntroPoints {
-		return fmt.Errorf("not enough relays available: need %d, have %d",
-			s.config.NumIntroPoints, len(hsdirs))
+	desc, err := s.buildDescriptor(ring)
+	if err != nil {
+		return err
 	}
-
-	// Select introduction points (use first N relays for Phase 7.4)
-	// In production, we would:
-	// 1. Filter relays with appropriate flags
-	// 2. Randomly select from filtered set
-	// 3. Ensure geographical and network diversity
-	selectedRelays := hsdirs[:s.config.NumIntroPoints]
-
-	for i, relay := range selectedRelays {
-		intro, err := s.establishIntroductionPoint(ctx, relay)
-		if err != nil {
-			s.logger.Warn("Failed to establish introduction point",
-				"relay", relay.Fingerprint,
-				"error", err)
-			continue
+	var next *Descriptor
+	if overlap {
+		if next, err = s.buildDescriptor(nextRing); err != nil {
+			return fmt.Errorf("next time period: %w", err)
 		}
-
-		s.introPoints = append(s.introPoints, intro)
-		s.logger.Debug("Introduction point established",
-			"index", i,
-			"relay", relay.Fingerprint,
-			"circuit", intro.CircuitID)
 	}
 
-	if len(s.introPoints) == 0 {
-		return fmt.Errorf("failed to establish any introduction points")
-	}
-
-	s.logger.Info("Introduction points established", "count", len(s.introPoints))
+	s.mu.Lock()
+	s.descriptor, s.descriptorRing = desc, ring
+	s.nextDescriptor, s.nextRing = next, nextRing
+	s.mu.Unlock()
 	return nil
 }
 
-// establishIntroductionPoint establishes a single introduction point
-func (s *Service) establishIntroductionPoint(ctx context.Context, relay *HSDirectory) (*ServiceIntroPoint, error) {
-	s.logger.Debug("Establishing introduction point", "relay", relay.Fingerprint)
+// buildDescriptor creates and signs a descriptor for the time period of a
+// hash ring
+func (s *Service) buildDescriptor(ring HashRing) (*Descriptor, error) {
+	s.logger.Debug("Creating service descriptor", "time_period", ring.PeriodNum)
 
-	// Generate keys for this introduction point
-	authKey := make([]byte, 32)
-	if _, err := rand.Read(authKey); err != nil {
-		return nil, fmt.Errorf("failed to generate auth key: %w", err)
-	}
-
-	encKey := make([]byte, 32)
-	if _, err := rand.Read(encKey); err != nil {
-		return nil, fmt.Errorf("failed to generate enc key: %w", err)
-	}
-
-	// In Phase 7.4, use mock circuit ID
-	// In production, this would:
-	// 1. Build a 3-hop circuit to the relay
-	// 2. Send ESTABLISH_INTRO cell
-	// 3. Wait for INTRO_ESTABLISHED acknowledgment
-	// Safe conversion with bounds check (AUDIT-006)
-	numIntroPoints := len(s.introPoints)
-	circuitID, err := security.SafeIntToUint32(3000 + numIntroPoints)
+	// Blind the identity key for the time period
+	blinded, err := blindExpandedIdentity(s.identityKey, s.publicKey, ring.PeriodNum, ring.PeriodLength)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate circuit ID: %w", err)
+		return nil, fmt.Errorf("failed to blind identity key: %w", err)
 	}
 
-	intro := &ServiceIntroPoint{
-		Relay:       relay,
-		CircuitID:   circuitID,
-		AuthKey:     authKey,
-		EncKey:      encKey,
-		Established: true, // Mock for Phase 7.4
-		CreatedAt:   time.Now(),
-	}
-
-	s.logger.Debug("Introduction point circuit created",
-		"relay", relay.Fingerprint,
-		"circuit", circuitID)
-
-	return intro, nil
-}
-
-// createDescriptor creates the onion service descriptor
-func (s *Service) createDescriptor() error {
-	s.logger.Debug("Creating service descriptor")
-
-	// Calculate blinded public key for current time period
-	timePeriod := GetTimePeriod(time.Now())
-	blindedPubkey := ComputeBlindedPubkey(s.publicKey, timePeriod)
-	descriptorID := computeDescriptorID(blindedPubkey)
-
 	// Build introduction points list
 	introPoints := make([]IntroductionPoint, 0, len(s.introPoints))
 	for _, serviceIntro := range s.introPoints {
-		// Convert relay to link specifiers
-		linkSpecs := make([]LinkSpecifier, 0)
-		// In production, would add IPv4, IPv6, and fingerprint link specifiers
-		// For Phase 7.4, simplified
+		// Clients extend their introduction circuits to the relay with these
+		linkSpecs, err := linkSpecifiersForRelay(serviceIntro.Relay)
+		if err == nil && len(serviceIntro.Relay.NtorOnionKey) != 32 {
+			err = fmt.Errorf("relay has no ntor onion key")
+		}
+		if err != nil {
+			s.logger.Warn("Introduction point cannot be reached by clients",
+				"relay", serviceIntro.Relay.Fingerprint,
+				"error", err)
+			continue
+		}
 
 		intro := IntroductionPoint{
 			LinkSpecifiers: linkSpecs,
-			OnionKey:       make([]byte, 32), // Would be relay's ntor key
+			OnionKey:       serviceIntro.Relay.NtorOnionKey,
 			AuthKey:        serviceIntro.AuthKey,
 			EncKey:         serviceIntro.EncKey,
-			EncKeyCert:     nil, // Would be cross-certification
-			LegacyKeyID:    make([]byte, 20),
 		}
 		introPoints = append(introPoints, intro)
 	}
@@ -379,36 +453,52 @@ func (s *Service) createDescriptor() error {
 		Version:         3,
 		Address:         s.address,
 		IntroPoints:     introPoints,
-		DescriptorID:    descriptorID,
-		BlindedPubkey:   blindedPubkey,
+		DescriptorID:    blinded.public,
+		BlindedPubkey:   blinded.public,
 		RevisionCounter: revisionCounter,
 		CreatedAt:       now,
 		Lifetime:        s.config.DescriptorLifetime,
 	}
 
-	// Sign the descriptor
-	if err := s.signDescriptor(desc); err != nil {
-		return fmt.Errorf("failed to sign descriptor: %w", err)
+	if s.pow != nil {
+		if desc.PoW, err = s.pow.params(now, s.refreshInterval()); err != nil {
+			return nil, err
+		}
 	}
 
-	s.mu.Lock()
-	s.descriptor = desc
-	s.mu.Unlock()
+	// With client authorization, the introduction points are keyed with a
+	// fresh descriptor cookie that is encrypted for each authorized client
+	if len(s.config.AuthorizedClients) > 0 {
+		desc.AuthorizedClients = s.config.AuthorizedClients
+		desc.DescriptorCookie = make([]byte, descriptorCookieLen)
+		if _, err := rand.Read(desc.DescriptorCookie); err != nil {
+			return nil, fmt.Errorf("failed to generate descriptor cookie: %w", err)
+		}
+	}
+
+	// Sign the descriptor
+	if err := s.signDescriptor(desc, blinded); err != nil {
+		return nil, fmt.Errorf("failed to sign descriptor: %w", err)
+	}
 
 	s.logger.Info("Descriptor created",
-		"descriptor_id", fmt.Sprintf("%x", descriptorID[:8]),
+		"time_period", ring.PeriodNum,
+		"blinded_key", fmt.Sprintf("%x", blinded.public[:8]),
 		"intro_points", len(introPoints),
+		"authorized_clients", len(desc.AuthorizedClients),
 		"lifetime", s.config.DescriptorLifetime)
 
-	return nil
+	return desc, nil
 }
 
-// signDescriptor signs the descriptor with the service's identity key
-func (s *Service) signDescriptor(desc *Descriptor) error {
+// signDescriptor signs the descriptor through the identity key blinded for
+// its time period
+func (s *Service) signDescriptor(desc *Descriptor, blinded *blindedIdentity) error {
 	// AUDIT-002 FIX: Implement proper certificate-based signing per cert-spec.txt and rend-spec-v3.txt
 	// 1. Create a descriptor signing key (ephemeral Ed25519 key for this descriptor)
-	// 2. Create a certificate signing the signing key with the identity key
-	// 3. Sign the descriptor with the signing key
+	// 2. Create a certificate signing the signing key with the blinded key
+	// 3. Certify the introduction point keys with the signing key
+	// 4. Sign the descriptor with the signing key
 
 	// Generate descriptor signing key (ephemeral, separate from identity key)
 	descriptorSigningPub, descriptorSigningPriv, err := ed25519.GenerateKey(nil)
@@ -416,175 +506,102 @@ func (s *Service) signDescriptor(desc *Descriptor) error {
 		return fmt.Errorf("failed to generate descriptor signing key: %w", err)
 	}
 
-	// Create a certificate for the descriptor signing key
-	// Certificate type 4 = Ed25519 signing key signed with Ed25519 identity key
-	// Per cert-spec.txt section 2.1
-	cert := &Certificate{
-		Version:    1,                             // Version must be 1
-		CertType:   4,                             // Type 4 = signing key signed with identity
-		ExpiresAt:  time.Now().Add(desc.Lifetime), // Expires with descriptor
-		SigningKey: descriptorSigningPub,          // The key being certified
-	}
-
-	// Build certificate content to sign per cert-spec.txt
-	// [1 byte] version
-	// [1 byte] cert_type
-	// [4 bytes] expiration (hours since epoch)
-	// [1 byte] cert_key_type (1 = Ed25519)
-	// [32 bytes] certified_key
-	// [1 byte] n_extensions (0 for now)
-	certContent := make([]byte, 0, 40)
-	certContent = append(certContent, cert.Version)
-	certContent = append(certContent, cert.CertType)
-
-	// Expiration in hours since epoch
-	expiryHours := uint32(cert.ExpiresAt.Unix() / 3600)
-	expiryBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(expiryBytes, expiryHours)
-	certContent = append(certContent, expiryBytes...)
-
-	// Key type (1 = Ed25519)
-	certContent = append(certContent, 1)
-
-	// Certified key (descriptor signing public key)
-	certContent = append(certContent, cert.SigningKey...)
-
-	// Number of extensions (0)
-	certContent = append(certContent, 0)
-
-	// Sign the certificate with identity key
-	cert.Signature = ed25519.Sign(s.identityKey, certContent)
-	cert.SignedData = certContent
-
-	// Build complete certificate (signed data + signature)
-	completeCert := make([]byte, 0, len(certContent)+64)
-	completeCert = append(completeCert, certContent...)
-	completeCert = append(completeCert, cert.Signature...)
-
-	// Store certificate in descriptor
-	desc.DescriptorSigningKeyCert = completeCert
-
-	// Now encode descriptor (without signature) to get content to sign
-	encoded, err := EncodeDescriptor(desc)
+	// Certificates expire with the descriptor
+	expires := time.Now().Add(desc.Lifetime)
+
+	// Type 8 = descriptor signing key signed with the blinded key
+	// Per cert-spec.txt section A.1
+	certBody := certificateBody(certTypeDescriptorSigning, descriptorSigningPub, expires, blinded.public)
+	certSig, err := blinded.sign(certBody)
 	if err != nil {
-		return fmt.Errorf("failed to encode descriptor: %w", err)
+		return fmt.Errorf("failed to certify descriptor signing key: %w", err)
 	}
+	desc.DescriptorSigningKeyCert = append(certBody, certSig...)
 
-	// Sign the descriptor with the descriptor signing key (not identity key)
-	signature := ed25519.Sign(descriptorSigningPriv, encoded)
-	desc.Signature = signature
+	for i := range desc.IntroPoints {
+		intro := &desc.IntroPoints[i]
+		encKey, err := curve25519ToEd25519(intro.EncKey)
+		if err != nil {
+			return fmt.Errorf("failed to certify introduction point encryption key: %w", err)
+		}
+		intro.AuthKeyCert = newCertificate(certTypeIntroAuthKey, intro.AuthKey, expires, descriptorSigningPriv)
+		intro.EncKeyCert = newCertificate(certTypeIntroEncKey, encKey, expires, descriptorSigningPriv)
+	}
 
-	// Encode again with signature to get complete descriptor
-	encoded, err = EncodeDescriptor(desc)
+	// Encode once: the encrypted sections differ on every encoding
+	encoded, err := encodeDescriptorBody(desc)
 	if err != nil {
-		return fmt.Errorf("failed to encode descriptor with signature: %w", err)
+		return fmt.Errorf("failed to encode descriptor: %w", err)
 	}
 
+	// Sign the descriptor with the descriptor signing key (not identity key)
+	signature := ed25519.Sign(descriptorSigningPriv, append([]byte(descriptorSigPrefix), encoded...))
+	desc.Signature = signature
+
 	// Store complete raw descriptor
-	desc.RawDescriptor = encoded
+	desc.RawDescriptor = append(encoded, fmt.Sprintf("signature %s\n", base64.StdEncoding.EncodeToString(signature))...)
 
 	s.logger.Debug("Descriptor signed with certificate chain",
-		"cert_expires", cert.ExpiresAt,
+		"cert_expires", expires,
 		"signature_len", len(signature))
 
 	return nil
 }
 
-// publishDescriptor publishes the descriptor to responsible HSDirs
-func (s *Service) publishDescriptor(ctx context.Context, hsdirs []*HSDirectory) error {
-	s.logger.Info("Publishing descriptor to HSDirs")
-
-	s.mu.RLock()
-	desc := s.descriptor
-	s.mu.RUnlock()
-
-	if desc == nil {
-		return fmt.Errorf("no descriptor to publish")
-	}
-
-	// Select responsible HSDirs using HSDir protocol
-	hsdir := NewHSDir(s.logger)
-
-	// Publish to both replicas
-	published := 0
-	for replica := 0; replica < 2; replica++ {
-		selectedHSDirs := hsdir.SelectHSDirs(desc.DescriptorID, hsdirs, replica)
-
-		for _, targetHSDir := range selectedHSDirs {
-			if err := s.uploadDescriptor(ctx, targetHSDir, desc, replica); err != nil {
-				s.logger.Warn("Failed to publish to HSDir",
-					"hsdir", targetHSDir.Fingerprint,
-					"replica", replica,
-					"error", err)
-				continue
-			}
-			published++
-			s.logger.Debug("Descriptor published",
-				"hsdir", targetHSDir.Fingerprint,
-				"replica", replica)
-		}
-	}
-
-	if published == 0 {
-		return fmt.Errorf("failed to publish descriptor to any HSDir")
-	}
-
-	s.mu.Lock()
-	s.lastPublish = time.Now()
-	s.mu.Unlock()
-
-	s.logger.Info("Descriptor published successfully",
-		"hsdirs", published)
-
-	return nil
+// refreshInterval is how often the descriptor is refreshed: every hour or
+// 2/3 of its lifetime, whichever is shorter
+func (s *Service) refreshInterval() time.Duration {
+	return min(s.config.DescriptorLifetime*2/3, time.Hour)
 }
 
-// uploadDescriptor uploads a descriptor to a specific HSDir
-func (s *Service) uploadDescriptor(ctx context.Context, hsdir *HSDirectory, desc *Descriptor, replica int) error {
-	// In production, this would:
-	// 1. Build a circuit to the HSDir
-	// 2. Send an HTTP POST to /tor/hs/3/publish
-	// 3. Wait for 200 OK response
-	// 4. Handle retries and errors
-
-	// For Phase 7.4, we'll simulate successful upload
-	s.logger.Debug("Uploading descriptor to HSDir",
-		"hsdir", hsdir.Fingerprint,
-		"replica", replica,
-		"descriptor_size", len(desc.RawDescriptor))
-
-	// Simulate network delay
-	select {
-	case <-time.After(10 * time.Millisecond):
-	case <-ctx.Done():
-		return ctx.Err()
-	}
-
-	return nil
-}
+// maintenanceLoop handles periodic tasks, each with the relays of the latest
+// consensus
+func (s *Service) maintenanceLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.refreshInterval())
+	defer ticker.Stop()
+	introTicker := time.NewTicker(introPointCheckInterval)
+	defer introTicker.Stop()
+	publishTicker := time.NewTicker(publishCheckInterval)
+	defer publishTicker.Stop()
 
-// maintenanceLoop handles periodic tasks
-func (s *Service) maintenanceLoop(ctx context.Context, hsdirs []*HSDirectory) {
-	// Refresh descriptor every hour or 2/3 of lifetime, whichever is shorter
-	refreshInterval := s.config.DescriptorLifetime * 2 / 3
-	if refreshInterval > time.Hour {
-		refreshInterval = time.Hour
+	// A changed suggested effort is only seen by clients once republished
+	var powTick <-chan time.Time
+	if s.pow != nil {
+		powTicker := time.NewTicker(powUpdateInterval)
+		defer powTicker.Stop()
+		powTick = powTicker.C
 	}
 
-	ticker := time.NewTicker(refreshInterval)
-	defer ticker.Stop()
-
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-s.ctx.Done():
+			return
+		case <-introTicker.C:
+			if err := s.rotateIntroPoints(ctx, s.currentRelays()); err != nil {
+				s.logger.Error("Failed to replace introduction points", "error", err)
+			}
+		case <-publishTicker.C:
+			s.checkPublication(ctx, s.currentRelays())
+		case <-powTick:
+			if !s.pow.updateEffort() {
+				continue
+			}
+			effort, queued := s.pow.stats()
+			s.logger.Info("Suggested PoW effort changed", "effort", effort, "queued", queued)
+			if err := s.createDescriptor(); err != nil {
+				s.logger.Error("Failed to refresh descriptor", "error", err)
+			} else if err := s.publishDescriptor(ctx, s.currentRelays()); err != nil {
+				s.logger.Error("Failed to re-publish descriptor", "error", err)
+			}
 		case <-ticker.C:
 			s.logger.Debug("Running maintenance tasks")
 
 			// Re-publish descriptor
 			if err := s.createDescriptor(); err != nil {
 				s.logger.Error("Failed to refresh descriptor", "error", err)
-			} else if err := s.publishDescriptor(ctx, hsdirs); err != nil {
+			} else if err := s.publishDescriptor(ctx, s.currentRelays()); err != nil {
 				s.logger.Error("Failed to re-publish descriptor", "error", err)
 			} else {
 				s.logger.Info("Descriptor refreshed and re-published")
@@ -593,57 +610,330 @@ func (s *Service) maintenanceLoop(ctx context.Context, hsdirs []*HSDirectory) {
 	}
 }
 
-// HandleIntroduce2 handles an INTRODUCE2 cell from an introduction point
+// HandleIntroduce2 answers an INTRODUCE2 cell that arrived on the circuit
+// of one of our introduction points. It decrypts the cell, builds a circuit
+// to the client's rendezvous point and sends RENDEZVOUS1 (rend-spec-v3.txt
+// section 3.4). The client's streams on that circuit are then proxied to
+// the configured ports until it closes.
 func (s *Service) HandleIntroduce2(introCircuitID uint32, introduce2Data []byte) error {
+	intro, req, rendezvousPoint, err := s.acceptIntroduce2(introCircuitID, introduce2Data)
+	if err != nil {
+		return err
+	}
+	return s.answerIntroduce2(intro, req, rendezvousPoint)
+}
+
+// acceptIntroduce2 decrypts an INTRODUCE2 cell and checks that it is not a
+// replay and, with the proof-of-work defense on, that any solution it
+// carries is valid
+func (s *Service) acceptIntroduce2(introCircuitID uint32, introduce2Data []byte) (*ServiceIntroPoint, *introduce2Request, *HSDirectory, error) {
 	s.logger.Info("Received INTRODUCE2 cell",
 		"circuit", introCircuitID,
 		"size", len(introduce2Data))
 
-	// Parse INTRODUCE2 cell
-	// Format: RENDEZVOUS_COOKIE (20 bytes) || CLIENT_ONION_KEY (32 bytes) || LINK_SPECIFIERS || ...
-	if len(introduce2Data) < 52 {
-		return fmt.Errorf("INTRODUCE2 data too short: %d bytes", len(introduce2Data))
+	intro := s.introPointForCircuit(introCircuitID)
+	if intro == nil {
+		return nil, nil, nil, fmt.Errorf("INTRODUCE2 on unknown introduction circuit %d", introCircuitID)
+	}
+	blindedKeys := s.blindedKeys()
+	if len(blindedKeys) == 0 {
+		return nil, nil, nil, fmt.Errorf("no descriptor")
+	}
+	var req *introduce2Request
+	var blindedKey []byte
+	var err error
+	for _, blindedKey = range blindedKeys {
+		subcredential := ComputeSubcredential(s.publicKey, blindedKey)
+		if req, err = s.decryptIntroduce2(intro, introduce2Data, subcredential); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid INTRODUCE2: %w", err)
+	}
+	rendezvousPoint, err := req.RendezvousPoint()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid rendezvous point: %w", err)
+	}
+	if s.pow != nil && req.PoW != nil {
+		if err := s.pow.check(req.PoW, blindedKey); err != nil {
+			return nil, nil, nil, fmt.Errorf("rejected INTRODUCE2: %w", err)
+		}
 	}
 
-	rendezvousCookie := introduce2Data[0:20]
-	clientOnionKey := introduce2Data[20:52]
-	// Link specifiers would follow, but we'll simplify for Phase 7.4
-
-	cookieStr := fmt.Sprintf("%x", rendezvousCookie)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A client key is only ever used once, so a repeat is a replay
+	// (rend-spec-v3.txt section 3.4.1)
+	if intro.seenClients == nil {
+		intro.seenClients = make(map[string]struct{})
+	}
+	if _, seen := intro.seenClients[string(req.ClientPK)]; seen {
+		return nil, nil, nil, fmt.Errorf("replayed INTRODUCE2")
+	}
+	intro.seenClients[string(req.ClientPK)] = struct{}{}
+	intro.Introductions++
+	return intro, req, rendezvousPoint, nil
+}
 
-	// Store pending introduction
+// answerIntroduce2 joins the client of an accepted INTRODUCE2 at its
+// rendezvous point and serves the resulting circuit
+func (s *Service) answerIntroduce2(intro *ServiceIntroPoint, req *introduce2Request, rendezvousPoint *HSDirectory) error {
+	cookieStr := fmt.Sprintf("%x", req.RendezvousCookie)
 	s.mu.Lock()
 	s.pendingIntros[cookieStr] = &PendingIntro{
-		Cookie:         rendezvousCookie,
-		ClientOnionKey: clientOnionKey,
-		ReceivedAt:     time.Now(),
+		Cookie:          req.RendezvousCookie,
+		RendezvousPoint: rendezvousPoint.Fingerprint,
+		ClientOnionKey:  req.ClientPK,
+		ReceivedAt:      time.Now(),
 	}
+	builder := s.circuitBuilder
+	ctx := s.ctx
 	s.mu.Unlock()
 
-	s.logger.Debug("INTRODUCE2 parsed and stored",
-		"cookie", cookieStr[:16])
+	defer func() {
+		s.mu.Lock()
+		delete(s.pendingIntros, cookieStr)
+		s.mu.Unlock()
+	}()
+
+	rendCirc, err := s.joinRendezvous(ctx, intro, req, rendezvousPoint, builder)
+	if err != nil {
+		return fmt.Errorf("failed to join rendezvous point %s: %w", rendezvousPoint.Fingerprint, err)
+	}
 
-	// In production, we would now:
-	// 1. Build a circuit to the rendezvous point
-	// 2. Send RENDEZVOUS1 with our handshake response
-	// 3. Complete the connection
+	s.logger.Info("Joined client at rendezvous point",
+		"rendezvous_point", rendezvousPoint.Fingerprint,
+		"circuit", rendCirc.ID)
 
+	go newRendezvousSession(s, rendCirc).serve(ctx)
+	return nil
+}
+
+// introPointForCircuit returns the introduction point established on a
+// circuit
+func (s *Service) introPointForCircuit(circuitID uint32) *ServiceIntroPoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, intro := range s.introPoints {
+		if intro.CircuitID == circuitID {
+			return intro
+		}
+	}
 	return nil
 }
 
+// joinRendezvous completes the service side of hs-ntor, builds a circuit to
+// the rendezvous point and sends RENDEZVOUS1 on it. The client is then
+// added to the circuit as a virtual hop.
+func (s *Service) joinRendezvous(ctx context.Context, intro *ServiceIntroPoint, req *introduce2Request, rendezvousPoint *HSDirectory, builder CircuitBuilder) (*circuit.Circuit, error) {
+	if builder == nil {
+		return nil, fmt.Errorf("no circuit builder configured")
+	}
+
+	serverPK, auth, keyMaterial, err := crypto.HsNtorServiceHandshake(intro.encPrivate[:], intro.EncKey, intro.AuthKey, req.ClientPK)
+	if err != nil {
+		return nil, fmt.Errorf("hs-ntor handshake failed: %w", err)
+	}
+	defer security.SecureZeroMemory(keyMaterial)
+
+	rendezvous1, err := NewRendezvousProtocol(s.logger).BuildRendezvous1Cell(&Rendezvous1Request{
+		RendezvousCookie: req.RendezvousCookie,
+		HandshakeData:    append(serverPK, auth...),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build RENDEZVOUS1 cell: %w", err)
+	}
+
+	circ, err := builder.BuildCircuitToRelay(ctx, rendezvousPoint, hsCircuitBuildTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build circuit: %w", err)
+	}
+	fail := func(err error) (*circuit.Circuit, error) {
+		if closeErr := circ.Close(); closeErr != nil {
+			s.logger.Debug("Failed to close rendezvous circuit", "error", closeErr)
+		}
+		return nil, err
+	}
+
+	if err := circ.SendRelayCell(cell.NewRelayCell(0, cell.RelayRendezvous1, rendezvous1)); err != nil {
+		return fail(fmt.Errorf("failed to send RENDEZVOUS1: %w", err))
+	}
+	if err := circuit.NewExtension(circ, s.logger).AcceptRendezvous(keyMaterial); err != nil {
+		return fail(fmt.Errorf("failed to add client hop: %w", err))
+	}
+	return circ, nil
+}
+
+// introduce2Request is the content of an INTRODUCE2 cell after decryption
+type introduce2Request struct {
+	ClientPK         []byte          // Client's hs-ntor public key (X)
+	RendezvousCookie []byte          // Cookie to send back in RENDEZVOUS1
+	OnionKey         []byte          // Rendezvous point ntor onion key
+	LinkSpecifiers   []LinkSpecifier // How to reach the rendezvous point
+	PoW              *PoWSolution    // Solved puzzle, if the client sent one
+}
+
+// RendezvousPoint returns the relay the client is waiting at
+func (r *introduce2Request) RendezvousPoint() (*HSDirectory, error) {
+	relay, err := relayFromLinkSpecifiers(r.LinkSpecifiers)
+	if err != nil {
+		return nil, err
+	}
+	relay.NtorOnionKey = append([]byte(nil), r.OnionKey...)
+	return relay, nil
+}
+
+// decryptIntroduce2 verifies the MAC of an INTRODUCE2 cell that arrived
+// through intro and decrypts it with the hs-ntor keys (rend-spec-v3.txt
+// section 3.3)
+func (s *Service) decryptIntroduce2(intro *ServiceIntroPoint, data, subcredential []byte) (*introduce2Request, error) {
+	// LEGACY_KEY_ID | AUTH_KEY_TYPE | AUTH_KEY_LEN | AUTH_KEY | N_EXTENSIONS | ...
+	const authKeyOffset = 20 + 1 + 2
+	if len(data) < authKeyOffset {
+		return nil, fmt.Errorf("INTRODUCE2 too short: %d bytes", len(data))
+	}
+	authKeyLen := int(binary.BigEndian.Uint16(data[21:23]))
+	if data[20] != authKeyTypeEd25519 || len(data) < authKeyOffset+authKeyLen+1 {
+		return nil, fmt.Errorf("malformed INTRODUCE2 auth key")
+	}
+	authKey := data[authKeyOffset : authKeyOffset+authKeyLen]
+	if !bytes.Equal(authKey, intro.AuthKey) {
+		return nil, fmt.Errorf("INTRODUCE2 for a different introduction point")
+	}
+
+	rest := data[authKeyOffset+authKeyLen:]
+	extLen, err := extensionsLen(rest)
+	if err != nil {
+		return nil, err
+	}
+	encryptedStart := len(data) - len(rest) + extLen
+	if len(data) < encryptedStart+32+introduceMACLen {
+		return nil, fmt.Errorf("INTRODUCE2 encrypted section too short")
+	}
+	clientPK := data[encryptedStart : encryptedStart+32]
+	encrypted := data[encryptedStart+32 : len(data)-introduceMACLen]
+	mac := data[len(data)-introduceMACLen:]
+
+	encKey, macKey, err := crypto.HsNtorServiceIntroduceKeys(intro.encPrivate[:], intro.EncKey, intro.AuthKey, clientPK, subcredential)
+	if err != nil {
+		return nil, fmt.Errorf("hs-ntor key derivation failed: %w", err)
+	}
+	defer security.SecureZeroMemory(encKey)
+	defer security.SecureZeroMemory(macKey)
+
+	expected := crypto.HsNtorMAC(macKey, data[:len(data)-introduceMACLen])
+	if subtle.ConstantTimeCompare(mac, expected) != 1 {
+		return nil, fmt.Errorf("INTRODUCE2 MAC mismatch")
+	}
+	plaintext, err := introduceCipher(encKey, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	// RENDEZVOUS_COOKIE | N_EXTENSIONS | ONION_KEY_TYPE | ONION_KEY_LEN | ONION_KEY | NSPEC | ...
+	if len(plaintext) < 20 {
+		return nil, fmt.Errorf("INTRODUCE2 plaintext too short")
+	}
+	req := &introduce2Request{
+		ClientPK:         append([]byte(nil), clientPK...),
+		RendezvousCookie: append([]byte(nil), plaintext[:20]...),
+	}
+	extLen, err = extensionsLen(plaintext[20:])
+	if err != nil {
+		return nil, err
+	}
+	if field, ok := extensionField(plaintext[20:], introduceExtPoW); ok {
+		if req.PoW, err = parsePoWExtension(field); err != nil {
+			return nil, err
+		}
+	}
+	rest = plaintext[20+extLen:]
+	if len(rest) < 3 || rest[0] != onionKeyTypeNtor {
+		return nil, fmt.Errorf("unsupported rendezvous point onion key")
+	}
+	onionKeyLen := int(binary.BigEndian.Uint16(rest[1:3]))
+	if onionKeyLen != 32 || len(rest) < 3+onionKeyLen {
+		return nil, fmt.Errorf("invalid rendezvous point onion key length: %d", onionKeyLen)
+	}
+	req.OnionKey = append([]byte(nil), rest[3:3+onionKeyLen]...)
+	if req.LinkSpecifiers, _, err = parseLinkSpecifiers(rest[3+onionKeyLen:]); err != nil {
+		return nil, fmt.Errorf("invalid rendezvous point link specifiers: %w", err)
+	}
+	return req, nil
+}
+
+// extensionsLen returns the length of an N_EXTENSIONS-prefixed extension
+// list: N_EXTENSIONS [1 byte] then EXT_FIELD_TYPE [1] | EXT_FIELD_LEN [1] |
+// EXT_FIELD for each
+func extensionsLen(data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, fmt.Errorf("missing extension count")
+	}
+	offset := 1
+	for i := 0; i < int(data[0]); i++ {
+		if len(data) < offset+2 || len(data) < offset+2+int(data[offset+1]) {
+			return 0, fmt.Errorf("truncated extension %d", i)
+		}
+		offset += 2 + int(data[offset+1])
+	}
+	return offset, nil
+}
+
+// extensionField returns the first extension of a type from a list that
+// extensionsLen accepted
+func extensionField(data []byte, extType byte) ([]byte, bool) {
+	offset := 1
+	for i := 0; i < int(data[0]); i++ {
+		fieldLen := int(data[offset+1])
+		if data[offset] == extType {
+			return data[offset+2 : offset+2+fieldLen], true
+		}
+		offset += 2 + fieldLen
+	}
+	return nil, false
+}
+
+// blindedKeys returns the blinded keys of the published descriptors, the
+// current time period's first. Clients whose consensus is ahead of ours
+// introduce themselves with the next period's descriptor.
+func (s *Service) blindedKeys() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys [][]byte
+	for _, desc := range []*Descriptor{s.descriptor, s.nextDescriptor} {
+		if desc != nil {
+			keys = append(keys, desc.BlindedPubkey)
+		}
+	}
+	return keys
+}
+
 // GetStats returns statistics about the service
 func (s *Service) GetStats() ServiceStats {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return ServiceStats{
-		Address:         s.address.String(),
-		Running:         s.running,
-		IntroPoints:     len(s.introPoints),
-		DescriptorAge:   time.Since(s.lastPublish),
-		PendingIntros:   len(s.pendingIntros),
-		PublishedHSDirs: len(s.publishedHSDirs),
+	stats := ServiceStats{
+		Address:       s.address.String(),
+		Running:       s.running,
+		IntroPoints:   len(s.introPoints),
+		DescriptorAge: time.Since(s.lastPublish),
+		PendingIntros: len(s.pendingIntros),
+		Rendezvous:    s.activeRendezvous,
+		HSDirUploads:  make([]HSDirUpload, 0, len(s.uploads)),
+	}
+	for _, upload := range s.uploads {
+		if upload.Succeeded {
+			stats.PublishedHSDirs++
+		}
+		stats.HSDirUploads = append(stats.HSDirUploads, *upload)
 	}
+	sortHSDirUploads(stats.HSDirUploads)
+	if s.pow != nil {
+		stats.PoWSuggestedEffort, stats.PoWQueued = s.pow.stats()
+	}
+	return stats
 }
 
 // ServiceStats contains statistics about a running service
@@ -653,5 +943,11 @@ type ServiceStats struct {
 	IntroPoints     int
 	DescriptorAge   time.Duration
 	PendingIntros   int
-	PublishedHSDirs int
+	PublishedHSDirs int // HSDirs holding the latest descriptor of their time period
+	Rendezvous      int // Client connections being served
+
+	HSDirUploads []HSDirUpload // Last upload to each responsible HSDir, by time period
+
+	PoWSuggestedEffort uint32 // Effort the descriptor asks clients for
+	PoWQueued          int    // Introductions waiting for a rendezvous
 }
@@ -0,0 +1,393 @@
+// Package onion - Service introduction points
+// This file establishes the service's introduction points with
+// ESTABLISH_INTRO (rend-spec-v3.txt section 3.1), listens for INTRODUCE2 on
+// their circuits and replaces them once they are used up or expire
+package onion
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/circuit"
+	"github.com/opd-ai/go-tor/pkg/crypto"
+)
+
+const (
+	// ESTABLISH_INTRO fields (rend-spec-v3.txt section 3.1.1)
+	establishIntroSigPrefix    = "Tor establish-intro cell v1"
+	establishIntroDoSExtension = 0x01
+	dosParamRatePerSec         = 0x01 // DOS_INTRODUCE2_RATE_PER_SEC
+	dosParamBurstPerSec        = 0x02 // DOS_INTRODUCE2_BURST_PER_SEC
+
+	// introEstablishedTimeout bounds the wait for INTRO_ESTABLISHED
+	introEstablishedTimeout = 10 * time.Second
+
+	// An introduction point is replaced after a random number of
+	// introductions or a random lifetime, whichever comes first, so that
+	// neither reveals how busy the service is (as Tor does)
+	introPointMinIntroductions = 16384
+	introPointMaxIntroductions = 32768
+	introPointMinLifetime      = 18 * time.Hour
+	introPointMaxLifetime      = 24 * time.Hour
+
+	// introPointCheckInterval is how often introduction points are checked
+	// for replacement
+	introPointCheckInterval = time.Minute
+)
+
+// IntroDoSParams are the limits on INTRODUCE2 cells a service asks its
+// introduction points to enforce (rend-spec-v3.txt section 3.1.1.1). Zero
+// for both turns the defense off at the introduction point.
+type IntroDoSParams struct {
+	RatePerSec  uint32 // Sustained introductions per second
+	BurstPerSec uint32 // Introductions allowed in a burst
+}
+
+// validate applies the limits introduction points accept
+func (p *IntroDoSParams) validate() error {
+	if p.RatePerSec > math.MaxInt32 || p.BurstPerSec > math.MaxInt32 {
+		return fmt.Errorf("introduction DoS parameters above %d", math.MaxInt32)
+	}
+	if p.BurstPerSec < p.RatePerSec {
+		return fmt.Errorf("introduction DoS burst %d below rate %d", p.BurstPerSec, p.RatePerSec)
+	}
+	return nil
+}
+
+// buildEstablishIntroCell builds the body of an ESTABLISH_INTRO cell: the
+// auth key and extensions, HANDSHAKE_AUTH binding the cell to the circuit's
+// KH, and the auth key's signature over everything before it
+func buildEstablishIntroCell(authKey ed25519.PrivateKey, circuitNonce []byte, dos *IntroDoSParams) []byte {
+	public := authKey.Public().(ed25519.PublicKey)
+
+	// AUTH_KEY_TYPE | AUTH_KEY_LEN | AUTH_KEY | N_EXTENSIONS | extensions
+	body := []byte{authKeyTypeEd25519}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(public)))
+	body = append(body, public...)
+	if dos == nil {
+		body = append(body, 0)
+	} else {
+		// N_PARAMS, then PARAM_TYPE [1] | PARAM_VALUE [8] for each
+		body = append(body, 1, establishIntroDoSExtension, 1+2*9, 2, dosParamRatePerSec)
+		body = binary.BigEndian.AppendUint64(body, uint64(dos.RatePerSec))
+		body = append(body, dosParamBurstPerSec)
+		body = binary.BigEndian.AppendUint64(body, uint64(dos.BurstPerSec))
+	}
+
+	// HANDSHAKE_AUTH | SIG_LEN | SIG
+	body = append(body, crypto.HsNtorMAC(circuitNonce, body)...)
+	signature := ed25519.Sign(authKey, append([]byte(establishIntroSigPrefix), body...))
+	body = binary.BigEndian.AppendUint16(body, uint16(len(signature)))
+	return append(body, signature...)
+}
+
+// parseIntroEstablished checks the body of an INTRO_ESTABLISHED cell, which
+// only carries extensions. None are defined, so they are skipped.
+func parseIntroEstablished(data []byte) error {
+	if _, err := extensionsLen(data); err != nil {
+		return fmt.Errorf("invalid INTRO_ESTABLISHED: %w", err)
+	}
+	return nil
+}
+
+// establishIntroductionPoints establishes introduction points on the first
+// relays that accept them until the configured number are up
+func (s *Service) establishIntroductionPoints(ctx context.Context, hsdirs []*HSDirectory) error {
+	s.logger.Info("Establishing introduction points", "count", s.config.NumIntroPoints)
+
+	if len(hsdirs) < s.config.NumIntroPoints {
+		return fmt.Errorf("not enough relays available: need %d, have %d",
+			s.config.NumIntroPoints, len(hsdirs))
+	}
+
+	for _, relay := range hsdirs {
+		s.mu.RLock()
+		count := len(s.introPoints)
+		s.mu.RUnlock()
+		if count >= s.config.NumIntroPoints {
+			break
+		}
+
+		intro, err := s.establishIntroductionPoint(ctx, relay)
+		if err != nil {
+			s.logger.Warn("Failed to establish introduction point",
+				"relay", relay.Fingerprint,
+				"error", err)
+			continue
+		}
+		s.addIntroPoint(intro)
+	}
+
+	s.mu.RLock()
+	count := len(s.introPoints)
+	s.mu.RUnlock()
+	if count == 0 {
+		return fmt.Errorf("failed to establish any introduction points")
+	}
+
+	s.logger.Info("Introduction points established", "count", count)
+	return nil
+}
+
+// establishIntroductionPoint builds a circuit to relay and makes it an
+// introduction point for fresh auth and encryption keys
+func (s *Service) establishIntroductionPoint(ctx context.Context, relay *HSDirectory) (*ServiceIntroPoint, error) {
+	s.logger.Debug("Establishing introduction point", "relay", relay.Fingerprint)
+
+	s.mu.RLock()
+	builder := s.circuitBuilder
+	s.mu.RUnlock()
+	if builder == nil {
+		return nil, fmt.Errorf("no circuit builder configured")
+	}
+
+	// Generate keys for this introduction point (rend-spec-v3.txt section 1.9)
+	authKey, authPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate auth key: %w", err)
+	}
+	encKey, err := crypto.GenerateNtorKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate enc key: %w", err)
+	}
+	maxIntroductions, lifetime, err := introPointLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	circ, err := builder.BuildCircuitToRelay(ctx, relay, hsCircuitBuildTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build circuit: %w", err)
+	}
+	fail := func(err error) (*ServiceIntroPoint, error) {
+		if closeErr := circ.Close(); closeErr != nil {
+			s.logger.Debug("Failed to close introduction circuit", "error", closeErr)
+		}
+		return nil, err
+	}
+
+	nonce, err := circ.LastHopNonce()
+	if err != nil {
+		return fail(err)
+	}
+	establishIntro := buildEstablishIntroCell(authPrivate, nonce, s.config.IntroDoS)
+	if err := circ.SendRelayCell(cell.NewRelayCell(0, cell.RelayEstablishIntro, establishIntro)); err != nil {
+		return fail(fmt.Errorf("failed to send ESTABLISH_INTRO: %w", err))
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, introEstablishedTimeout)
+	defer cancel()
+	reply, err := awaitRelayCell(waitCtx, circ, cell.RelayIntroEstablished)
+	if err != nil {
+		return fail(fmt.Errorf("no INTRO_ESTABLISHED: %w", err))
+	}
+	if err := parseIntroEstablished(reply.Data); err != nil {
+		return fail(err)
+	}
+
+	now := time.Now()
+	intro := &ServiceIntroPoint{
+		Relay:            relay,
+		CircuitID:        circ.ID,
+		AuthKey:          authKey,
+		EncKey:           append([]byte(nil), encKey.Public[:]...),
+		Established:      true,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(lifetime),
+		authPrivate:      authPrivate,
+		encPrivate:       encKey.Private,
+		maxIntroductions: maxIntroductions,
+		circ:             circ,
+	}
+
+	s.logger.Debug("Introduction point established",
+		"relay", relay.Fingerprint,
+		"circuit", circ.ID)
+
+	return intro, nil
+}
+
+// introPointLimits picks how many introductions and how long a new
+// introduction point serves
+func introPointLimits() (int, time.Duration, error) {
+	extraIntroductions, err := randomIndex(introPointMaxIntroductions - introPointMinIntroductions + 1)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to pick introduction limit: %w", err)
+	}
+	extraSeconds, err := randomIndex(int((introPointMaxLifetime - introPointMinLifetime) / time.Second))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to pick introduction point lifetime: %w", err)
+	}
+	return introPointMinIntroductions + extraIntroductions,
+		introPointMinLifetime + time.Duration(extraSeconds)*time.Second, nil
+}
+
+// addIntroPoint adds an established introduction point and starts
+// listening for INTRODUCE2 on its circuit
+func (s *Service) addIntroPoint(intro *ServiceIntroPoint) {
+	s.mu.Lock()
+	s.introPoints = append(s.introPoints, intro)
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	if intro.circ != nil {
+		if s.pow != nil {
+			s.introQueueUp.Do(func() {
+				for i := 0; i < powRendezvousWorkers; i++ {
+					go s.serveIntroQueue(ctx)
+				}
+			})
+		}
+		go s.serveIntroCircuit(ctx, intro)
+	}
+}
+
+// serveIntroCircuit answers the INTRODUCE2 cells arriving on an
+// introduction circuit until it closes
+func (s *Service) serveIntroCircuit(ctx context.Context, intro *ServiceIntroPoint) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-intro.circ.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	defer func() {
+		s.mu.Lock()
+		intro.Established = false
+		s.mu.Unlock()
+	}()
+
+	for {
+		relayCell, err := intro.circ.ReceiveRelayCell(ctx)
+		if err != nil {
+			return
+		}
+		switch relayCell.Command {
+		case cell.RelayIntroduce2:
+			// With the proof-of-work defense on, introductions wait in the
+			// queue to be answered highest effort first
+			if s.pow != nil {
+				if err := s.enqueueIntroduce2(intro.CircuitID, relayCell.Data); err != nil {
+					s.logger.Warn("Failed to handle INTRODUCE2", "circuit", intro.CircuitID, "error", err)
+				}
+				continue
+			}
+			// Joining the rendezvous takes a circuit build, so it must not
+			// hold up the next introduction
+			go func(data []byte) {
+				if err := s.HandleIntroduce2(intro.CircuitID, data); err != nil {
+					s.logger.Warn("Failed to handle INTRODUCE2", "circuit", intro.CircuitID, "error", err)
+				}
+			}(relayCell.Data)
+		case cell.RelayTruncated:
+			s.logger.Warn("Introduction circuit closed by relay", "relay", intro.Relay.Fingerprint)
+			return
+		}
+	}
+}
+
+// needsReplacement reports whether an introduction point has lost its
+// circuit, served its introductions or outlived its lifetime. The caller
+// holds s.mu.
+func (intro *ServiceIntroPoint) needsReplacement(now time.Time) bool {
+	if !intro.Established {
+		return true
+	}
+	if intro.maxIntroductions > 0 && intro.Introductions >= intro.maxIntroductions {
+		return true
+	}
+	return !intro.ExpiresAt.IsZero() && !now.Before(intro.ExpiresAt)
+}
+
+// rotateIntroPoints replaces the introduction points that need it with new
+// ones on other relays and republishes the descriptor. Retired points'
+// circuits are closed once the new descriptor is out.
+func (s *Service) rotateIntroPoints(ctx context.Context, hsdirs []*HSDirectory) error {
+	now := time.Now()
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	var keep, retired []*ServiceIntroPoint
+	inUse := make(map[string]bool)
+	for _, intro := range s.introPoints {
+		inUse[intro.Relay.Fingerprint] = true
+		if intro.needsReplacement(now) {
+			retired = append(retired, intro)
+		} else {
+			keep = append(keep, intro)
+		}
+	}
+	if len(retired) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	s.introPoints = keep
+	s.mu.Unlock()
+
+	s.logger.Info("Replacing introduction points", "count", len(retired))
+
+	// Prefer relays the service is not using; fall back to any relay
+	var candidates, fallback []*HSDirectory
+	for _, relay := range hsdirs {
+		if inUse[relay.Fingerprint] {
+			fallback = append(fallback, relay)
+		} else {
+			candidates = append(candidates, relay)
+		}
+	}
+	candidates = append(candidates, fallback...)
+
+	added := 0
+	for _, relay := range candidates {
+		if added == len(retired) {
+			break
+		}
+		intro, err := s.establishIntroductionPoint(ctx, relay)
+		if err != nil {
+			s.logger.Warn("Failed to establish introduction point",
+				"relay", relay.Fingerprint,
+				"error", err)
+			continue
+		}
+		s.addIntroPoint(intro)
+		added++
+	}
+
+	var err error
+	s.mu.RLock()
+	count := len(s.introPoints)
+	s.mu.RUnlock()
+	if count == 0 {
+		err = fmt.Errorf("no introduction points left")
+	} else if err = s.createDescriptor(); err == nil {
+		err = s.publishDescriptor(ctx, hsdirs)
+	}
+
+	for _, intro := range retired {
+		closeIntroCircuit(intro.circ)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to republish after replacing introduction points: %w", err)
+	}
+	s.logger.Info("Introduction points replaced", "added", added, "retired", len(retired))
+	return nil
+}
+
+// closeIntroCircuit closes an introduction point's circuit, if it has one
+func closeIntroCircuit(circ *circuit.Circuit) {
+	if circ != nil {
+		_ = circ.Close()
+	}
+}
@@ -0,0 +1,242 @@
+package onion
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/circuit"
+	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/logger"
+	"github.com/opd-ai/go-tor/pkg/relaytest"
+)
+
+// newIntroTestNetwork starts a fake relay network and returns a circuit
+// builder over it and its relays as a service sees them
+func newIntroTestNetwork(t *testing.T, size int) (*relaytest.Network, *fakeNetworkBuilder, []*HSDirectory) {
+	t.Helper()
+	log := logger.NewDefault()
+	network, err := relaytest.NewNetwork(size, log)
+	if err != nil {
+		t.Fatalf("Failed to start fake relay network: %v", err)
+	}
+	t.Cleanup(network.Close)
+
+	var hsdirs []*HSDirectory
+	for _, relay := range network.Relays() {
+		hsdirs = append(hsdirs, hsDirectoryFor(relay))
+	}
+	return network, &fakeNetworkBuilder{network: network, builder: circuit.NewBuilder(circuit.NewManager(), log)}, hsdirs
+}
+
+func TestBuildEstablishIntroCell(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := bytes.Repeat([]byte{0x4B}, crypto.CircuitNonceLen)
+
+	tests := []struct {
+		name       string
+		dos        *IntroDoSParams
+		extensions []byte
+	}{
+		{"without DoS extension", nil, []byte{0}},
+		{
+			name: "with DoS extension",
+			dos:  &IntroDoSParams{RatePerSec: 25, BurstPerSec: 200},
+			extensions: []byte{1, 0x01, 19, 2,
+				0x01, 0, 0, 0, 0, 0, 0, 0, 25,
+				0x02, 0, 0, 0, 0, 0, 0, 0, 200},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildEstablishIntroCell(private, nonce, tt.dos)
+
+			if data[0] != authKeyTypeEd25519 || binary.BigEndian.Uint16(data[1:3]) != 32 || !bytes.Equal(data[3:35], public) {
+				t.Fatal("Cell does not start with the auth key")
+			}
+			macStart := 35 + len(tt.extensions)
+			if !bytes.Equal(data[35:macStart], tt.extensions) {
+				t.Errorf("Extensions = %x, want %x", data[35:macStart], tt.extensions)
+			}
+			if !bytes.Equal(data[macStart:macStart+32], crypto.HsNtorMAC(nonce, data[:macStart])) {
+				t.Error("HANDSHAKE_AUTH is not the MAC of the cell under the circuit nonce")
+			}
+			sigStart := macStart + 32
+			if binary.BigEndian.Uint16(data[sigStart:sigStart+2]) != ed25519.SignatureSize || len(data) != sigStart+2+ed25519.SignatureSize {
+				t.Fatalf("Unexpected signature length in %d-byte cell", len(data))
+			}
+			signed := append([]byte("Tor establish-intro cell v1"), data[:sigStart]...)
+			if !ed25519.Verify(public, signed, data[sigStart+2:]) {
+				t.Error("Signature does not verify")
+			}
+		})
+	}
+}
+
+func TestParseIntroEstablished(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"no extensions", []byte{0}, false},
+		{"unknown extension", []byte{1, 0x7F, 2, 0xAA, 0xBB}, false},
+		{"empty", nil, true},
+		{"truncated extension", []byte{1, 0x7F, 4, 0xAA}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := parseIntroEstablished(tt.data); (err != nil) != tt.wantErr {
+				t.Errorf("parseIntroEstablished() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewServiceRejectsInvalidIntroDoS(t *testing.T) {
+	tests := []struct {
+		name string
+		dos  IntroDoSParams
+	}{
+		{"burst below rate", IntroDoSParams{RatePerSec: 200, BurstPerSec: 25}},
+		{"rate above INT32_MAX", IntroDoSParams{RatePerSec: 1 << 31, BurstPerSec: 1 << 31}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dos := tt.dos
+			if _, err := NewService(&ServiceConfig{IntroDoS: &dos}, logger.NewDefault()); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestEstablishIntroductionPointWithoutBuilder(t *testing.T) {
+	service, err := NewService(&ServiceConfig{}, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	if _, err := service.establishIntroductionPoint(context.Background(), testIntroRelay("0123456789ABCDEF0123456789ABCDEF01234567")); err == nil {
+		t.Error("Expected error without a circuit builder")
+	}
+}
+
+func TestRotateIntroPoints(t *testing.T) {
+	network, builder, hsdirs := newIntroTestNetwork(t, 6)
+
+	service, err := NewService(&ServiceConfig{NumIntroPoints: 3, Ports: map[int]string{80: "localhost:8080"}}, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.SetCircuitBuilder(builder)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := service.Start(ctx, hsdirs); err != nil {
+		t.Fatalf("Failed to start service: %v", err)
+	}
+	defer service.Stop()
+
+	service.mu.Lock()
+	original := append([]*ServiceIntroPoint(nil), service.introPoints...)
+	for _, intro := range original {
+		if intro.maxIntroductions < introPointMinIntroductions || intro.maxIntroductions > introPointMaxIntroductions {
+			t.Errorf("Introduction limit %d out of range", intro.maxIntroductions)
+		}
+		if lifetime := intro.ExpiresAt.Sub(intro.CreatedAt); lifetime < introPointMinLifetime || lifetime > introPointMaxLifetime {
+			t.Errorf("Lifetime %v out of range", lifetime)
+		}
+	}
+	// One point is used up and one has expired; the third lost its circuit
+	original[0].Introductions = original[0].maxIntroductions
+	original[1].ExpiresAt = time.Now().Add(-time.Second)
+	service.mu.Unlock()
+	_ = original[2].circ.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		service.mu.RLock()
+		closed := !original[2].Established
+		service.mu.RUnlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Closing the circuit did not take down the introduction point")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := service.rotateIntroPoints(ctx, hsdirs); err != nil {
+		t.Fatalf("rotateIntroPoints failed: %v", err)
+	}
+
+	service.mu.RLock()
+	replaced := append([]*ServiceIntroPoint(nil), service.introPoints...)
+	desc := service.descriptor
+	service.mu.RUnlock()
+	if len(replaced) != 3 {
+		t.Fatalf("Got %d introduction points after rotation, want 3", len(replaced))
+	}
+	for _, intro := range replaced {
+		for _, old := range original {
+			if bytes.Equal(intro.AuthKey, old.AuthKey) {
+				t.Error("Introduction point was not replaced")
+			}
+		}
+		if !intro.Established {
+			t.Error("Replacement introduction point is not established")
+		}
+	}
+	for _, old := range original {
+		select {
+		case <-old.circ.Done():
+		case <-time.After(10 * time.Second):
+			t.Error("Retired introduction circuit was not closed")
+		}
+	}
+
+	// The new descriptor lists the new points
+	if len(desc.IntroPoints) != 3 {
+		t.Fatalf("Descriptor lists %d introduction points, want 3", len(desc.IntroPoints))
+	}
+	for i, intro := range desc.IntroPoints {
+		if !bytes.Equal(intro.AuthKey, replaced[i].AuthKey) {
+			t.Errorf("Descriptor introduction point %d has an old auth key", i)
+		}
+	}
+
+	// The relays forget the retired points once their circuits are gone
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		total := 0
+		for _, relay := range network.Relays() {
+			total += relay.IntroPointCount()
+		}
+		if total == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Relays hold %d introduction points, want 3", total)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Nothing is rotated while the points are fresh
+	if err := service.rotateIntroPoints(ctx, hsdirs); err != nil {
+		t.Fatalf("rotateIntroPoints failed: %v", err)
+	}
+	service.mu.RLock()
+	defer service.mu.RUnlock()
+	for i, intro := range service.introPoints {
+		if intro != replaced[i] {
+			t.Error("Fresh introduction point was replaced")
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Package onion - Service keys
+// This file keeps the service identity in its directory in the same files
+// as C-tor, so an existing HiddenServiceDir keeps its onion address
+package onion
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/edwards25519"
+
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+const (
+	serviceSecretKeyFile        = "hs_ed25519_secret_key"
+	servicePublicKeyFile        = "hs_ed25519_public_key"
+	serviceHostnameFile         = "hostname"
+	serviceAuthorizedClientsDir = "authorized_clients"
+
+	// Key files start with a tag padded with NULs to 32 bytes
+	keyFileTagLen = 32
+	secretKeyTag  = "== ed25519v1-secret: type0 =="
+	publicKeyTag  = "== ed25519v1-public: type0 =="
+
+	// authorizedClientSuffix marks client keys in authorized_clients
+	authorizedClientSuffix = ".auth"
+)
+
+// serviceIdentity is a service identity key. C-tor stores only the
+// expanded private key, so that is the form kept here.
+type serviceIdentity struct {
+	expanded []byte // Expanded private key: scalar | prefix (64 bytes)
+	public   ed25519.PublicKey
+}
+
+// identityFromPrivateKey returns the identity for an ed25519 private key
+func identityFromPrivateKey(key ed25519.PrivateKey) *serviceIdentity {
+	return &serviceIdentity{
+		expanded: expandPrivateKey(key),
+		public:   key.Public().(ed25519.PublicKey),
+	}
+}
+
+// generateServiceIdentity returns a new random identity
+func generateServiceIdentity() (*serviceIdentity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %w", err)
+	}
+	return identityFromPrivateKey(key), nil
+}
+
+// loadServiceIdentity reads the identity in a service directory. The error
+// wraps fs.ErrNotExist if the directory has no secret key yet.
+func loadServiceIdentity(dir string) (*serviceIdentity, error) {
+	expanded, err := readKeyFile(filepath.Join(dir, serviceSecretKeyFile), secretKeyTag, 64)
+	if err != nil {
+		return nil, err
+	}
+	scalar, err := new(edwards25519.Scalar).SetBytesWithClamping(expanded[:32])
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %w", err)
+	}
+	identity := &serviceIdentity{
+		expanded: expanded,
+		public:   new(edwards25519.Point).ScalarBaseMult(scalar).Bytes(),
+	}
+
+	// The public key file is derived data, but it must not disagree
+	public, err := readKeyFile(filepath.Join(dir, servicePublicKeyFile), publicKeyTag, 32)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	case subtle.ConstantTimeCompare(public, identity.public) != 1:
+		return nil, fmt.Errorf("%s does not match %s", servicePublicKeyFile, serviceSecretKeyFile)
+	}
+	return identity, nil
+}
+
+// save writes the identity key files to a service directory
+func (id *serviceIdentity) save(dir string) error {
+	if err := writeKeyFile(filepath.Join(dir, serviceSecretKeyFile), secretKeyTag, id.expanded); err != nil {
+		return err
+	}
+	return writeKeyFile(filepath.Join(dir, servicePublicKeyFile), publicKeyTag, id.public)
+}
+
+// readKeyFile reads a tagged key file holding a key of keyLen bytes
+func readKeyFile(path, tag string, keyLen int) ([]byte, error) {
+	data, err := os.ReadFile(path) // #nosec G304 - file in the configured service directory
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+	}
+	if len(data) != keyFileTagLen+keyLen {
+		return nil, fmt.Errorf("%s has invalid length %d", filepath.Base(path), len(data))
+	}
+	if string(bytes.TrimRight(data[:keyFileTagLen], "\x00")) != tag {
+		return nil, fmt.Errorf("%s has unexpected tag %q", filepath.Base(path), bytes.TrimRight(data[:keyFileTagLen], "\x00"))
+	}
+	return append([]byte(nil), data[keyFileTagLen:]...), nil
+}
+
+// writeKeyFile writes a tagged key file through a temporary file
+func writeKeyFile(path, tag string, key []byte) error {
+	data := make([]byte, keyFileTagLen, keyFileTagLen+len(key))
+	copy(data, tag)
+	data = append(data, key...)
+
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmpFile, path); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// writeHostname writes the service's onion address to the hostname file
+func writeHostname(dir string, addr *Address) error {
+	if err := os.WriteFile(filepath.Join(dir, serviceHostnameFile), []byte(addr.String()+"\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to write hostname: %w", err)
+	}
+	return nil
+}
+
+// loadAuthorizedClients reads the client public keys in the
+// authorized_clients directory of a service directory, one per *.auth file:
+//
+//	descriptor:x25519:<base32-encoded-public-key>
+//
+// A missing directory means the service is open to all clients. As in C tor,
+// malformed files are logged and skipped; if no file parses, the service
+// fails rather than opening to all clients.
+func loadAuthorizedClients(dir string, log *logger.Logger) ([][]byte, error) {
+	clientsDir := filepath.Join(dir, serviceAuthorizedClientsDir)
+	entries, err := os.ReadDir(clientsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized clients: %w", err)
+	}
+
+	var keys [][]byte
+	skipped := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), authorizedClientSuffix) {
+			continue
+		}
+		path := filepath.Join(clientsDir, entry.Name())
+		data, err := os.ReadFile(path) // #nosec G304 - file in the configured service directory
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		key, err := ParseAuthorizedClientLine(string(data))
+		if err != nil {
+			log.Warn("Skipping malformed authorized client file", "path", path, "error", err)
+			skipped++
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 && skipped > 0 {
+		return nil, fmt.Errorf("no valid authorized client files in %s", clientsDir)
+	}
+	return keys, nil
+}
@@ -0,0 +1,219 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+// writeCTorServiceDir lays out a service directory the way C-tor does for
+// an ed25519 key, without using the package's own writer
+func writeCTorServiceDir(t *testing.T, dir string, key ed25519.PrivateKey) {
+	t.Helper()
+
+	expanded := sha512.Sum512(key.Seed())
+	expanded[0] &= 248
+	expanded[31] &= 63
+	expanded[31] |= 64
+
+	secret := append([]byte("== ed25519v1-secret: type0 ==\x00\x00\x00"), expanded[:]...)
+	public := append([]byte("== ed25519v1-public: type0 ==\x00\x00\x00"), key.Public().(ed25519.PublicKey)...)
+	if err := os.WriteFile(filepath.Join(dir, "hs_ed25519_secret_key"), secret, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hs_ed25519_public_key"), public, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceKeysPersist(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hidden_service")
+
+	first, err := NewService(&ServiceConfig{DataDirectory: dir}, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+
+	for name, size := range map[string]int{"hs_ed25519_secret_key": 96, "hs_ed25519_public_key": 64} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if len(data) != size {
+			t.Errorf("%s has %d bytes, want %d", name, len(data), size)
+		}
+		if !bytes.HasPrefix(data, []byte("== ed25519v1-")) {
+			t.Errorf("%s is missing its tag", name)
+		}
+	}
+	hostname, err := os.ReadFile(filepath.Join(dir, "hostname"))
+	if err != nil {
+		t.Fatalf("Failed to read hostname: %v", err)
+	}
+	if string(hostname) != first.GetAddress()+"\n" {
+		t.Errorf("hostname = %q, want %q", hostname, first.GetAddress()+"\n")
+	}
+
+	second, err := NewService(&ServiceConfig{DataDirectory: dir}, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("Failed to reload service: %v", err)
+	}
+	if second.GetAddress() != first.GetAddress() {
+		t.Errorf("Address changed across restarts: %s, then %s", first.GetAddress(), second.GetAddress())
+	}
+}
+
+func TestServiceLoadsCTorDirectory(t *testing.T) {
+	dir := t.TempDir()
+	public, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCTorServiceDir(t, dir, key)
+
+	desc, service := newTestDescriptorWithConfig(t, &ServiceConfig{DataDirectory: dir})
+	want, err := addressFromPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.GetAddress() != want.String() {
+		t.Errorf("Address = %s, want %s", service.GetAddress(), want.String())
+	}
+
+	// Descriptors signed with the loaded key decrypt for the address
+	parsed, err := ParseDescriptor(desc.RawDescriptor)
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %v", err)
+	}
+	parsed.BlindedPubkey = desc.BlindedPubkey
+	if err := DecryptDescriptor(parsed, want); err != nil {
+		t.Errorf("Failed to decrypt descriptor: %v", err)
+	}
+}
+
+func TestServiceRejectsBadKeyFiles(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		setup       func(dir string)
+		errContains string
+	}{
+		{
+			name: "mismatched public key",
+			setup: func(dir string) {
+				writeCTorServiceDir(t, dir, key)
+				writeCTorServiceDirPublic(t, dir, other)
+			},
+			errContains: "does not match",
+		},
+		{
+			name: "wrong tag",
+			setup: func(dir string) {
+				writeCTorServiceDir(t, dir, key)
+				data, _ := os.ReadFile(filepath.Join(dir, "hs_ed25519_secret_key"))
+				copy(data, "== ed25519v1-public: type0 ==")
+				_ = os.WriteFile(filepath.Join(dir, "hs_ed25519_secret_key"), data, 0o600)
+			},
+			errContains: "unexpected tag",
+		},
+		{
+			name: "truncated secret key",
+			setup: func(dir string) {
+				writeCTorServiceDir(t, dir, key)
+				data, _ := os.ReadFile(filepath.Join(dir, "hs_ed25519_secret_key"))
+				_ = os.WriteFile(filepath.Join(dir, "hs_ed25519_secret_key"), data[:64], 0o600)
+			},
+			errContains: "invalid length",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.setup(dir)
+			_, err := NewService(&ServiceConfig{DataDirectory: dir}, logger.NewDefault())
+			if err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("Error message %q does not contain %q", err.Error(), tt.errContains)
+			}
+		})
+	}
+}
+
+// writeCTorServiceDirPublic rewrites only the public key file
+func writeCTorServiceDirPublic(t *testing.T, dir string, key ed25519.PrivateKey) {
+	t.Helper()
+	public := append([]byte("== ed25519v1-public: type0 ==\x00\x00\x00"), key.Public().(ed25519.PublicKey)...)
+	if err := os.WriteFile(filepath.Join(dir, "hs_ed25519_public_key"), public, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceLoadsAuthorizedClients(t *testing.T) {
+	dir := t.TempDir()
+	clientPub, clientPriv, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientsDir := filepath.Join(dir, "authorized_clients")
+	if err := os.MkdirAll(clientsDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	line := "descriptor:x25519:" + EncodeClientAuthKey(clientPub) + "\n"
+	if err := os.WriteFile(filepath.Join(clientsDir, "alice.auth"), []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, service := newTestDescriptorWithConfig(t, &ServiceConfig{DataDirectory: dir})
+	if len(service.config.AuthorizedClients) != 1 {
+		t.Fatalf("Loaded %d authorized clients, want 1", len(service.config.AuthorizedClients))
+	}
+
+	parsed, err := ParseDescriptor(desc.RawDescriptor)
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %v", err)
+	}
+	parsed.BlindedPubkey = desc.BlindedPubkey
+	if err := DecryptDescriptor(parsed, service.address); err == nil {
+		t.Error("Descriptor decrypted without client authorization")
+	}
+	if err := DecryptDescriptorWithClientAuth(parsed, service.address, clientPriv); err != nil {
+		t.Errorf("Authorized client failed to decrypt descriptor: %v", err)
+	}
+
+	// A malformed file next to a good one is skipped
+	if err := os.WriteFile(filepath.Join(clientsDir, "broken.auth"), []byte("descriptor:x25519"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	service, err = NewService(&ServiceConfig{DataDirectory: dir}, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("NewService() with a malformed authorized client file error = %v", err)
+	}
+	if len(service.config.AuthorizedClients) != 1 || !bytes.Equal(service.config.AuthorizedClients[0], clientPub) {
+		t.Errorf("Unexpected authorized clients with a malformed file %x", service.config.AuthorizedClients)
+	}
+
+	// With only malformed files the service must not open to everyone
+	if err := os.Remove(filepath.Join(clientsDir, "alice.auth")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewService(&ServiceConfig{DataDirectory: dir}, logger.NewDefault()); err == nil {
+		t.Error("Expected error when no authorized client file is valid")
+	}
+}
@@ -0,0 +1,318 @@
+// Package onion - Service proof-of-work defense
+// This file keeps the service's puzzle seeds, checks the solutions in
+// INTRODUCE2 and answers pending introductions highest effort first, raising
+// the suggested effort while the queue is overloaded (hspow-spec)
+package onion
+
+import (
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// powSeedLifetime is how long a seed is advertised; the previous seed
+	// stays valid for one more lifetime so descriptors in flight still work
+	powSeedLifetime = 2 * time.Hour
+
+	// powUpdateInterval is how often the suggested effort is recomputed
+	powUpdateInterval = 5 * time.Minute
+
+	// defaultPoWQueueSize bounds the introductions waiting for a rendezvous
+	defaultPoWQueueSize = 4096
+
+	// powRendezvousWorkers is how many rendezvous circuits are built at once
+	// while introductions are queued
+	powRendezvousWorkers = 4
+)
+
+// PoWConfig turns on the proof-of-work defense of a service
+type PoWConfig struct {
+	// Effort suggested in the descriptor until the service measures its
+	// load; 0 lets clients in without a puzzle until it is overloaded
+	SuggestedEffort uint32
+
+	// Introductions that may wait for a rendezvous (default: 4096). Beyond
+	// this the lowest-effort ones are dropped.
+	QueueSize int
+}
+
+// servicePoW is the state of a service's proof-of-work defense
+type servicePoW struct {
+	mu sync.Mutex
+
+	seed         [powSeedLen]byte
+	previousSeed *[powSeedLen]byte
+	expires      time.Time
+
+	// Nonces already used with the current and previous seeds
+	seenNonces, previousNonces map[[powNonceLen]byte]struct{}
+
+	suggestedEffort uint32
+	queue           introQueue
+	queueSize       int
+	ready           chan struct{} // Signalled when an introduction is queued
+
+	// Load since the last effort update
+	totalEffort       uint64
+	handled           uint64
+	maxTrimmedEffort  uint32
+	trimmedSinceCheck bool
+}
+
+// newServicePoW creates the defense state with a fresh seed
+func newServicePoW(config *PoWConfig) (*servicePoW, error) {
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultPoWQueueSize
+	}
+	p := &servicePoW{
+		suggestedEffort: config.SuggestedEffort,
+		queueSize:       queueSize,
+		ready:           make(chan struct{}, 1),
+	}
+	if err := p.rotateSeed(time.Now()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// rotateSeed starts a new seed, keeping the current one as the previous
+// seed. The caller holds p.mu, or is the constructor.
+func (p *servicePoW) rotateSeed(now time.Time) error {
+	var seed [powSeedLen]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return fmt.Errorf("failed to generate PoW seed: %w", err)
+	}
+	if !p.expires.IsZero() {
+		previous := p.seed
+		p.previousSeed = &previous
+	}
+	p.seed = seed
+	p.expires = now.Add(powSeedLifetime)
+	p.previousNonces = p.seenNonces
+	p.seenNonces = make(map[[powNonceLen]byte]struct{})
+	return nil
+}
+
+// params returns the pow-params for a descriptor that is refreshed every
+// refresh interval, moving to a new seed first if the current one would
+// expire before the next refresh
+func (p *servicePoW) params(now time.Time, refresh time.Duration) (*PoWParams, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Add(refresh).After(p.expires) {
+		if err := p.rotateSeed(now); err != nil {
+			return nil, err
+		}
+	}
+	return &PoWParams{
+		Seed:            p.seed,
+		SuggestedEffort: p.suggestedEffort,
+		Expires:         p.expires,
+	}, nil
+}
+
+// check verifies a solution against the current or previous seed and
+// records its nonce so that it cannot be used again
+func (p *servicePoW) check(solution *PoWSolution, blindedKey []byte) error {
+	p.mu.Lock()
+	var seed *[powSeedLen]byte
+	var seen map[[powNonceLen]byte]struct{}
+	switch {
+	case [powSeedHeadLen]byte(p.seed[:powSeedHeadLen]) == solution.SeedHead:
+		seed, seen = &p.seed, p.seenNonces
+	case p.previousSeed != nil && [powSeedHeadLen]byte(p.previousSeed[:powSeedHeadLen]) == solution.SeedHead:
+		seed, seen = p.previousSeed, p.previousNonces
+	default:
+		p.mu.Unlock()
+		return fmt.Errorf("PoW solution for an unknown seed")
+	}
+	if _, ok := seen[solution.Nonce]; ok {
+		p.mu.Unlock()
+		return fmt.Errorf("replayed PoW nonce")
+	}
+	seedCopy := *seed
+	p.mu.Unlock()
+
+	// Solutions are checked without the lock; the nonce is only recorded
+	// for valid ones so that garbage cannot fill the cache
+	if err := verifyPoW(solution, blindedKey, &seedCopy); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := seen[solution.Nonce]; ok {
+		return fmt.Errorf("replayed PoW nonce")
+	}
+	seen[solution.Nonce] = struct{}{}
+	return nil
+}
+
+// push queues an introduction, dropping the lowest-effort one if the queue
+// is full
+func (p *servicePoW) push(q *queuedIntro) {
+	p.mu.Lock()
+	heap.Push(&p.queue, q)
+	if p.queue.Len() > p.queueSize {
+		dropped := p.queue.removeLowest()
+		p.trimmedSinceCheck = true
+		p.maxTrimmedEffort = max(p.maxTrimmedEffort, dropped.effort)
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the highest-effort introduction that its client may still be
+// waiting for, or nil if there is none
+func (p *servicePoW) pop(now time.Time) *queuedIntro {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.queue.Len() > 0 {
+		q := heap.Pop(&p.queue).(*queuedIntro)
+		if now.Sub(q.receivedAt) > rendezvous2Timeout {
+			continue
+		}
+		p.totalEffort += uint64(q.effort)
+		p.handled++
+		return q
+	}
+	return nil
+}
+
+// updateEffort recomputes the suggested effort from the load since the
+// last update and reports whether it changed. While introductions queue
+// up or are dropped, the effort rises to the average of those handled (and
+// at least by one); once the queue stays empty it decays by a third.
+func (p *servicePoW) updateEffort() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	previous := p.suggestedEffort
+	overloaded := p.queue.Len() > 0 || p.maxTrimmedEffort > p.suggestedEffort
+	switch {
+	case overloaded:
+		effort := uint64(p.suggestedEffort) + 1
+		if p.handled > 0 {
+			effort = max(effort, p.totalEffort/p.handled)
+		}
+		p.suggestedEffort = uint32(min(effort, uint64(^uint32(0))))
+	case !p.trimmedSinceCheck:
+		p.suggestedEffort = p.suggestedEffort * 2 / 3
+	}
+
+	p.totalEffort, p.handled = 0, 0
+	p.maxTrimmedEffort = 0
+	p.trimmedSinceCheck = false
+	return p.suggestedEffort != previous
+}
+
+// stats returns the suggested effort and the queue length
+func (p *servicePoW) stats() (uint32, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.suggestedEffort, p.queue.Len()
+}
+
+// queuedIntro is an accepted introduction waiting for its rendezvous
+type queuedIntro struct {
+	intro           *ServiceIntroPoint
+	req             *introduce2Request
+	rendezvousPoint *HSDirectory
+	effort          uint32
+	receivedAt      time.Time
+	index           int
+}
+
+// introQueue is a heap of introductions, highest effort first and oldest
+// first among equal efforts
+type introQueue []*queuedIntro
+
+func (q introQueue) Len() int { return len(q) }
+
+func (q introQueue) Less(i, j int) bool {
+	if q[i].effort != q[j].effort {
+		return q[i].effort > q[j].effort
+	}
+	return q[i].receivedAt.Before(q[j].receivedAt)
+}
+
+func (q introQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *introQueue) Push(x any) {
+	item := x.(*queuedIntro)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *introQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// removeLowest removes the introduction that would be served last, which
+// is one of the heap's leaves
+func (q *introQueue) removeLowest() *queuedIntro {
+	items := *q
+	lowest := len(items) / 2
+	for i := lowest + 1; i < len(items); i++ {
+		if items.Less(lowest, i) {
+			lowest = i
+		}
+	}
+	return heap.Remove(q, lowest).(*queuedIntro)
+}
+
+// enqueueIntroduce2 accepts an INTRODUCE2 cell, checking its solution if it
+// has one, and queues it by effort. Cells without a solution are served
+// last.
+func (s *Service) enqueueIntroduce2(introCircuitID uint32, data []byte) error {
+	intro, req, rendezvousPoint, err := s.acceptIntroduce2(introCircuitID, data)
+	if err != nil {
+		return err
+	}
+	var effort uint32
+	if req.PoW != nil {
+		effort = req.PoW.Effort
+	}
+	s.pow.push(&queuedIntro{
+		intro:           intro,
+		req:             req,
+		rendezvousPoint: rendezvousPoint,
+		effort:          effort,
+		receivedAt:      time.Now(),
+	})
+	return nil
+}
+
+// serveIntroQueue joins queued clients at their rendezvous points until
+// the service stops
+func (s *Service) serveIntroQueue(ctx context.Context) {
+	for {
+		if q := s.pow.pop(time.Now()); q != nil {
+			if err := s.answerIntroduce2(q.intro, q.req, q.rendezvousPoint); err != nil {
+				s.logger.Warn("Failed to answer queued INTRODUCE2", "effort", q.effort, "error", err)
+			}
+			continue
+		}
+		select {
+		case <-s.pow.ready:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
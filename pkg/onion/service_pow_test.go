@@ -0,0 +1,287 @@
+package onion
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+func TestIntroQueue(t *testing.T) {
+	p, err := newServicePoW(&PoWConfig{QueueSize: 3})
+	if err != nil {
+		t.Fatalf("newServicePoW() error = %v", err)
+	}
+	now := time.Now()
+	for i, effort := range []uint32{5, 0, 20, 5} {
+		p.push(&queuedIntro{effort: effort, receivedAt: now.Add(time.Duration(i) * time.Millisecond)})
+	}
+
+	// The effort-0 introduction was dropped to make room; equal efforts are
+	// served oldest first
+	var order []uint32
+	var received []time.Time
+	for q := p.pop(now); q != nil; q = p.pop(now) {
+		order = append(order, q.effort)
+		received = append(received, q.receivedAt)
+	}
+	if len(order) != 3 || order[0] != 20 || order[1] != 5 || order[2] != 5 {
+		t.Fatalf("Served efforts %v, want [20 5 5]", order)
+	}
+	if !received[1].Before(received[2]) {
+		t.Error("Equal efforts were not served oldest first")
+	}
+
+	// Clients stop waiting after the rendezvous timeout
+	p.push(&queuedIntro{effort: 100, receivedAt: now.Add(-2 * rendezvous2Timeout)})
+	if q := p.pop(now); q != nil {
+		t.Errorf("pop() returned an introduction whose client gave up")
+	}
+}
+
+func TestServicePoWUpdateEffort(t *testing.T) {
+	p, err := newServicePoW(&PoWConfig{SuggestedEffort: 30})
+	if err != nil {
+		t.Fatalf("newServicePoW() error = %v", err)
+	}
+	now := time.Now()
+
+	// Idle: the effort decays
+	if !p.updateEffort() {
+		t.Fatal("updateEffort() reported no change while idle")
+	}
+	if effort, _ := p.stats(); effort != 20 {
+		t.Errorf("Effort after an idle period = %d, want 20", effort)
+	}
+
+	// Handled introductions averaging 100 while others keep waiting
+	for _, effort := range []uint32{50, 150, 1} {
+		p.push(&queuedIntro{effort: effort, receivedAt: now})
+	}
+	p.pop(now)
+	p.pop(now)
+	p.updateEffort()
+	if effort, queued := p.stats(); effort != 100 || queued != 1 {
+		t.Errorf("Effort under load = %d with %d queued, want 100 with 1", effort, queued)
+	}
+
+	// Still overloaded with nothing handled: up by one
+	p.updateEffort()
+	if effort, _ := p.stats(); effort != 101 {
+		t.Errorf("Effort while still overloaded = %d, want 101", effort)
+	}
+}
+
+func TestServicePoWCheck(t *testing.T) {
+	p, err := newServicePoW(&PoWConfig{SuggestedEffort: 1})
+	if err != nil {
+		t.Fatalf("newServicePoW() error = %v", err)
+	}
+	blindedKey := bytes.Repeat([]byte{0xB1}, 32)
+	now := time.Now()
+	params, err := p.params(now, time.Hour)
+	if err != nil {
+		t.Fatalf("params() error = %v", err)
+	}
+	solution, err := SolvePoW(context.Background(), params, blindedKey, 1)
+	if err != nil {
+		t.Fatalf("SolvePoW() error = %v", err)
+	}
+
+	if err := p.check(solution, blindedKey); err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	if err := p.check(solution, blindedKey); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("check() of a used nonce error = %v, want replay", err)
+	}
+
+	// After one rotation the seed is still accepted, after two it is not
+	if _, err := p.params(now.Add(powSeedLifetime), time.Hour); err != nil {
+		t.Fatalf("params() error = %v", err)
+	}
+	fresh, err := SolvePoW(context.Background(), params, blindedKey, 1)
+	if err != nil {
+		t.Fatalf("SolvePoW() error = %v", err)
+	}
+	if err := p.check(fresh, blindedKey); err != nil {
+		t.Errorf("check() with the previous seed error = %v", err)
+	}
+	if _, err := p.params(now.Add(2*powSeedLifetime), time.Hour); err != nil {
+		t.Fatalf("params() error = %v", err)
+	}
+	if err := p.check(solution, blindedKey); err == nil || !strings.Contains(err.Error(), "unknown seed") {
+		t.Errorf("check() with an expired seed error = %v, want unknown seed", err)
+	}
+}
+
+// newPoWIntroduce2Service returns a PoW-defended service whose only
+// introduction point is on circuit 3001, and an INTRODUCE2 cell for it
+// carrying a solution for the service's puzzle
+func newPoWIntroduce2Service(t *testing.T) (*Service, []byte, *PoWSolution) {
+	t.Helper()
+
+	desc, service := newTestDescriptorWithConfig(t, &ServiceConfig{
+		Ports: map[int]string{80: "localhost:8080"},
+		PoW:   &PoWConfig{SuggestedEffort: 2},
+	})
+	if desc.PoW == nil || desc.PoW.SuggestedEffort != 2 {
+		t.Fatalf("Descriptor pow-params = %+v, want suggested effort 2", desc.PoW)
+	}
+	intro := service.introPoints[0]
+	intro.CircuitID = 3001
+
+	solution, err := SolvePoW(context.Background(), desc.PoW, desc.BlindedPubkey, desc.PoW.SuggestedEffort)
+	if err != nil {
+		t.Fatalf("SolvePoW() error = %v", err)
+	}
+
+	rendezvousPoint := testIntroRelay("89ABCDEF0123456789ABCDEF0123456789ABCDEF")
+	rendezvousPoint.IdentityKey = bytes.Repeat([]byte{0x07}, 32)
+	rendezvousPoint.NtorOnionKey = bytes.Repeat([]byte{0x42}, 32)
+	handshake, err := crypto.NewHsNtorClient(intro.AuthKey, intro.EncKey, ComputeSubcredential(service.publicKey, desc.BlindedPubkey))
+	if err != nil {
+		t.Fatalf("Failed to start hs-ntor handshake: %v", err)
+	}
+	data, err := NewIntroductionProtocol(nil).BuildIntroduce1Cell(&IntroduceRequest{
+		IntroPoint:       &IntroductionPoint{AuthKey: intro.AuthKey, EncKey: intro.EncKey},
+		RendezvousCookie: []byte("test-cookie-12345678"),
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
+		PoW:              solution,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build INTRODUCE2 cell: %v", err)
+	}
+	return service, data, solution
+}
+
+func TestEnqueueIntroduce2WithPoW(t *testing.T) {
+	service, data, solution := newPoWIntroduce2Service(t)
+
+	// Without introduction circuits no workers run, so the introduction
+	// stays queued
+	if err := service.enqueueIntroduce2(3001, data); err != nil {
+		t.Fatalf("enqueueIntroduce2() error = %v", err)
+	}
+	q := service.pow.pop(time.Now())
+	if q == nil {
+		t.Fatal("Introduction was not queued")
+	}
+	if q.effort != solution.Effort || q.req.PoW == nil || q.req.PoW.Nonce != solution.Nonce {
+		t.Errorf("Queued introduction has effort %d and solution %+v, want %+v", q.effort, q.req.PoW, solution)
+	}
+	if stats := service.GetStats(); stats.PoWSuggestedEffort != 2 {
+		t.Errorf("Stats report suggested effort %d, want 2", stats.PoWSuggestedEffort)
+	}
+}
+
+func TestEnqueueIntroduce2RejectsBadPoW(t *testing.T) {
+	service, _, solution := newPoWIntroduce2Service(t)
+
+	// Re-encrypt the cell with a solution for another seed
+	intro := service.introPoints[0]
+	service.mu.RLock()
+	blindedKey := service.descriptor.BlindedPubkey
+	service.mu.RUnlock()
+	handshake, err := crypto.NewHsNtorClient(intro.AuthKey, intro.EncKey, ComputeSubcredential(service.publicKey, blindedKey))
+	if err != nil {
+		t.Fatalf("Failed to start hs-ntor handshake: %v", err)
+	}
+	rendezvousPoint := testIntroRelay("89ABCDEF0123456789ABCDEF0123456789ABCDEF")
+	rendezvousPoint.IdentityKey = bytes.Repeat([]byte{0x07}, 32)
+	rendezvousPoint.NtorOnionKey = bytes.Repeat([]byte{0x42}, 32)
+	bad := *solution
+	bad.SeedHead[0] ^= 0xFF
+	data, err := NewIntroductionProtocol(nil).BuildIntroduce1Cell(&IntroduceRequest{
+		IntroPoint:       &IntroductionPoint{AuthKey: intro.AuthKey, EncKey: intro.EncKey},
+		RendezvousCookie: []byte("test-cookie-12345678"),
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
+		PoW:              &bad,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build INTRODUCE2 cell: %v", err)
+	}
+
+	err = service.enqueueIntroduce2(3001, data)
+	if err == nil || !strings.Contains(err.Error(), "unknown seed") {
+		t.Errorf("enqueueIntroduce2() error = %v, want unknown seed", err)
+	}
+	if intro.Introductions != 0 {
+		t.Errorf("Rejected introduction was counted")
+	}
+}
+
+// TestConnectToOnionServiceWithPoW connects to a PoW-defended service over
+// a fake relay network: the client solves the descriptor's puzzle and the
+// service answers it from its queue
+func TestConnectToOnionServiceWithPoW(t *testing.T) {
+	log := logger.NewDefault()
+	_, builder, relays := newIntroTestNetwork(t, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	target, _ := startEchoTarget(t)
+	service, err := NewService(&ServiceConfig{
+		NumIntroPoints: 1,
+		Ports:          map[int]string{80: target},
+		PoW:            &PoWConfig{SuggestedEffort: 2},
+	}, log)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.SetCircuitBuilder(builder)
+	defer service.Stop()
+	if err := service.establishIntroductionPoints(ctx, relays[4:]); err != nil {
+		t.Fatalf("Failed to set up introduction point: %v", err)
+	}
+	if err := service.createDescriptor(); err != nil {
+		t.Fatalf("Failed to create descriptor: %v", err)
+	}
+
+	client := NewClient(log)
+	client.SetCircuitBuilder(builder)
+	client.UpdateHSDirs(relays[3:4])
+	service.mu.RLock()
+	raw := service.descriptor.RawDescriptor
+	service.mu.RUnlock()
+	desc, err := ParseDescriptor(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %v", err)
+	}
+	if err := DecryptDescriptor(desc, service.address); err != nil {
+		t.Fatalf("Failed to decrypt descriptor: %v", err)
+	}
+	if desc.PoW == nil || desc.PoW.SuggestedEffort != 2 {
+		t.Fatalf("Client read pow-params %+v, want suggested effort 2", desc.PoW)
+	}
+	client.CacheDescriptor(service.address, desc)
+
+	circ, err := client.ConnectToOnionService(ctx, service.address)
+	if err != nil {
+		t.Fatalf("ConnectToOnionService failed: %v", err)
+	}
+	defer circ.Close()
+
+	if err := circ.OpenStream(1, "", 80); err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	if err := circ.WriteToStream(1, []byte("hello")); err != nil {
+		t.Fatalf("WriteToStream failed: %v", err)
+	}
+	reply, err := circ.ReadFromStream(ctx, 1)
+	if err != nil {
+		t.Fatalf("ReadFromStream failed: %v", err)
+	}
+	if string(reply) != "echo: hello" {
+		t.Errorf("Reply = %q, want %q", reply, "echo: hello")
+	}
+	if stats := service.GetStats(); stats.PoWQueued != 0 {
+		t.Errorf("Stats report %d queued introductions, want 0", stats.PoWQueued)
+	}
+}
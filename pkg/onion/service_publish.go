@@ -0,0 +1,320 @@
+// Package onion - Service descriptor publication
+// This file uploads the service's descriptors to the HSDirs responsible for
+// them with HTTP POST over BEGIN_DIR streams, for the current time period
+// and, in the overlap period, the next one, and re-publishes them when the
+// time period rolls over (rend-spec-v3.txt sections 2.2.4 and 2.2.6)
+package onion
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// hsPublishPath is where HSDirs accept descriptors
+	hsPublishPath = "/tor/hs/3/publish"
+
+	// hsDirStreamID is the stream used on each upload circuit
+	hsDirStreamID = 1
+
+	// descriptorUploadAttempts is how often an upload to one HSDir is tried
+	// before it waits for the next publication check
+	descriptorUploadAttempts = 3
+
+	// descriptorUploadBackoff is the wait before the first retry of an
+	// upload, doubled for each further retry
+	descriptorUploadBackoff = time.Second
+
+	// descriptorUploadTimeout bounds one upload attempt, from building the
+	// circuit to the HSDir's response
+	descriptorUploadTimeout = time.Minute
+
+	// publishCheckInterval is how often the service checks for time period
+	// rollovers and for responsible HSDirs that lack its descriptors
+	publishCheckInterval = time.Minute
+)
+
+// HSDirUpload is the outcome of the last upload of a descriptor to an HSDir
+type HSDirUpload struct {
+	Fingerprint string
+	TimePeriod  uint64
+	Revision    uint64 // Revision counter of the descriptor uploaded
+	Attempts    int    // Attempts in the last upload, including retries
+	Succeeded   bool
+	LastAttempt time.Time
+	Error       string // Why the last attempt failed
+}
+
+// hsdirUploadKey identifies the uploads to one HSDir for one time period
+type hsdirUploadKey struct {
+	period      uint64
+	fingerprint string
+}
+
+// periodDescriptor is a descriptor and the hash ring of the time period it
+// is blinded for
+type periodDescriptor struct {
+	desc *Descriptor
+	ring HashRing
+}
+
+// publishedDescriptors returns the descriptors to upload, the current time
+// period's first
+func (s *Service) publishedDescriptors() []periodDescriptor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var descs []periodDescriptor
+	if s.descriptor != nil {
+		descs = append(descs, periodDescriptor{desc: s.descriptor, ring: s.descriptorRing})
+	}
+	if s.nextDescriptor != nil {
+		descs = append(descs, periodDescriptor{desc: s.nextDescriptor, ring: s.nextRing})
+	}
+	return descs
+}
+
+// publishDescriptor uploads the descriptors to every HSDir responsible for
+// them
+func (s *Service) publishDescriptor(ctx context.Context, hsdirs []*HSDirectory) error {
+	s.logger.Info("Publishing descriptor to HSDirs")
+	return s.uploadDescriptors(ctx, hsdirs, false)
+}
+
+// uploadDescriptors uploads each descriptor to the HSDirs responsible for
+// it on its time period's hash ring. Every HSDir is tried on its own, with
+// retries, so one that is down does not hold up the others. With
+// missingOnly, HSDirs that already accepted the descriptor are skipped.
+func (s *Service) uploadDescriptors(ctx context.Context, hsdirs []*HSDirectory, missingOnly bool) error {
+	descs := s.publishedDescriptors()
+	if len(descs) == 0 {
+		return fmt.Errorf("no descriptor to publish")
+	}
+
+	s.mu.Lock()
+	params := s.params
+	// Uploads for time periods we no longer publish are forgotten
+	for key := range s.uploads {
+		if !slices.ContainsFunc(descs, func(d periodDescriptor) bool { return d.ring.PeriodNum == key.period }) {
+			delete(s.uploads, key)
+		}
+	}
+	s.mu.Unlock()
+
+	hsdir := NewHSDir(s.logger)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	attempted, published := 0, 0
+	for _, d := range descs {
+		for _, target := range hsdir.SelectHSDirs(d.ring, d.desc.BlindedPubkey, hsdirs, params.Replicas(), params.SpreadStore()) {
+			if missingOnly && s.hasUploaded(target, d) {
+				continue
+			}
+			attempted++
+			wg.Add(1)
+			go func(target *HSDirectory, d periodDescriptor) {
+				defer wg.Done()
+				if err := s.uploadWithRetries(ctx, target, d); err != nil {
+					s.logger.Warn("Failed to publish to HSDir",
+						"hsdir", target.Fingerprint,
+						"time_period", d.ring.PeriodNum,
+						"error", err)
+					return
+				}
+				mu.Lock()
+				published++
+				mu.Unlock()
+			}(target, d)
+		}
+	}
+	wg.Wait()
+
+	if attempted == 0 {
+		return nil
+	}
+	if published == 0 {
+		return fmt.Errorf("failed to publish descriptor to any HSDir")
+	}
+
+	if !missingOnly {
+		s.mu.Lock()
+		s.lastPublish = time.Now()
+		s.mu.Unlock()
+	}
+
+	s.logger.Info("Descriptor published successfully",
+		"hsdirs", published,
+		"failed", attempted-published,
+		"time_periods", len(descs))
+
+	return nil
+}
+
+// hasUploaded reports whether an HSDir accepted the revision of a
+// descriptor
+func (s *Service) hasUploaded(hsdir *HSDirectory, d periodDescriptor) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	upload, ok := s.uploads[hsdirUploadKey{period: d.ring.PeriodNum, fingerprint: hsdir.Fingerprint}]
+	return ok && upload.Succeeded && upload.Revision == d.desc.RevisionCounter
+}
+
+// uploadWithRetries uploads a descriptor to one HSDir, backing off between
+// attempts, and records the outcome
+func (s *Service) uploadWithRetries(ctx context.Context, hsdir *HSDirectory, d periodDescriptor) error {
+	var err error
+	attempts := 0
+	for attempts < descriptorUploadAttempts {
+		if attempts > 0 {
+			backoff := descriptorUploadBackoff * time.Duration(1<<uint(attempts-1))
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				err = fmt.Errorf("context cancelled during backoff: %w", ctx.Err())
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		attempts++
+		if err = s.uploadDescriptor(ctx, hsdir, d.desc); err == nil {
+			break
+		}
+		s.logger.Debug("Descriptor upload failed",
+			"hsdir", hsdir.Fingerprint,
+			"attempt", attempts,
+			"error", err)
+	}
+
+	upload := &HSDirUpload{
+		Fingerprint: hsdir.Fingerprint,
+		TimePeriod:  d.ring.PeriodNum,
+		Revision:    d.desc.RevisionCounter,
+		Attempts:    attempts,
+		Succeeded:   err == nil,
+		LastAttempt: time.Now(),
+	}
+	if err != nil {
+		upload.Error = err.Error()
+	}
+	s.mu.Lock()
+	s.uploads[hsdirUploadKey{period: d.ring.PeriodNum, fingerprint: hsdir.Fingerprint}] = upload
+	s.mu.Unlock()
+	return err
+}
+
+// uploadDescriptor posts a descriptor to an HSDir over a BEGIN_DIR stream
+// on a circuit to it and waits for 200 OK
+func (s *Service) uploadDescriptor(ctx context.Context, hsdir *HSDirectory, desc *Descriptor) error {
+	s.mu.RLock()
+	builder := s.circuitBuilder
+	s.mu.RUnlock()
+	if builder == nil {
+		return fmt.Errorf("no circuit builder configured")
+	}
+
+	s.logger.Debug("Uploading descriptor to HSDir",
+		"hsdir", hsdir.Fingerprint,
+		"descriptor_size", len(desc.RawDescriptor))
+
+	ctx, cancel := context.WithTimeout(ctx, descriptorUploadTimeout)
+	defer cancel()
+
+	circ, err := builder.BuildCircuitToRelay(ctx, hsdir, hsCircuitBuildTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to build circuit: %w", err)
+	}
+	defer func() {
+		_ = circ.Close()
+	}()
+
+	stream, err := circ.OpenDirStream(ctx, hsDirStreamID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetReadDeadline(deadline)
+	}
+
+	// The host is not contacted: the stream ends at the HSDir's directory
+	// service whatever the request names
+	url := fmt.Sprintf("http://%s:%d%s", hsdir.Address, hsdir.DirPort, hsPublishPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(desc.RawDescriptor))
+	if err != nil {
+		return fmt.Errorf("failed to create HSDir request: %w", err)
+	}
+	req.Close = true
+	if err := req.Write(stream); err != nil {
+		return fmt.Errorf("failed to send descriptor to %s: %w", hsdir.Fingerprint, err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		return fmt.Errorf("failed to read response from %s: %w", hsdir.Fingerprint, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HSDir %s returned status %d", hsdir.Fingerprint, resp.StatusCode)
+	}
+	return nil
+}
+
+// checkPublication creates and publishes new descriptors once the time
+// period rolls over or the overlap period starts or ends. Otherwise it
+// uploads the descriptors to the responsible HSDirs that lack them, which
+// retries those that failed and reaches HSDirs that became responsible.
+func (s *Service) checkPublication(ctx context.Context, hsdirs []*HSDirectory) {
+	if s.descriptorsOutdated() {
+		s.logger.Info("Time period changed, re-publishing descriptors")
+		if err := s.createDescriptor(); err != nil {
+			s.logger.Error("Failed to refresh descriptor", "error", err)
+		} else if err := s.publishDescriptor(ctx, hsdirs); err != nil {
+			s.logger.Error("Failed to re-publish descriptor", "error", err)
+		}
+		return
+	}
+
+	if err := s.uploadDescriptors(ctx, hsdirs, true); err != nil {
+		s.logger.Warn("Failed to upload descriptor to missing HSDirs", "error", err)
+	}
+}
+
+// descriptorsOutdated reports whether the descriptors were made for other
+// hash rings than the ones the network parameters now call for
+func (s *Service) descriptorsOutdated() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.descriptor == nil {
+		return true
+	}
+	ring := s.params.CurrentHashRing()
+	nextRing, overlap := s.params.NextHashRing()
+	if ring.PeriodNum != s.descriptorRing.PeriodNum || !bytes.Equal(ring.SRV, s.descriptorRing.SRV) {
+		return true
+	}
+	if overlap != (s.nextDescriptor != nil) {
+		return true
+	}
+	return overlap && (nextRing.PeriodNum != s.nextRing.PeriodNum || !bytes.Equal(nextRing.SRV, s.nextRing.SRV))
+}
+
+// sortHSDirUploads orders uploads by time period, then HSDir
+func sortHSDirUploads(uploads []HSDirUpload) {
+	slices.SortFunc(uploads, func(a, b HSDirUpload) int {
+		if c := cmp.Compare(a.TimePeriod, b.TimePeriod); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Fingerprint, b.Fingerprint)
+	})
+}
@@ -0,0 +1,241 @@
+package onion
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/circuit"
+	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/relaytest"
+)
+
+// newPublishTestService returns a service with a descriptor and HSDirs on a
+// fake relay network of the given size
+func newPublishTestService(t *testing.T, size int, params NetworkParams) (*Service, *relaytest.Network, []*HSDirectory) {
+	t.Helper()
+	network, builder, hsdirs := newIntroTestNetwork(t, size)
+	_, service := newTestDescriptor(t)
+	service.SetCircuitBuilder(builder)
+	service.SetNetworkParams(params)
+	if err := service.createDescriptor(); err != nil {
+		t.Fatalf("Failed to create descriptor: %v", err)
+	}
+	return service, network, hsdirs
+}
+
+// uploadFor returns the recorded upload to an HSDir for a time period
+func uploadFor(stats ServiceStats, fingerprint string, period uint64) (HSDirUpload, bool) {
+	for _, upload := range stats.HSDirUploads {
+		if upload.Fingerprint == fingerprint && upload.TimePeriod == period {
+			return upload, true
+		}
+	}
+	return HSDirUpload{}, false
+}
+
+func TestPublishDescriptorOverBeginDir(t *testing.T) {
+	service, network, hsdirs := newPublishTestService(t, 4, NetworkParams{ValidAfter: time.Date(2016, 4, 13, 15, 0, 0, 0, time.UTC)})
+	if err := service.publishDescriptor(context.Background(), hsdirs); err != nil {
+		t.Fatalf("publishDescriptor() error = %v", err)
+	}
+
+	service.mu.RLock()
+	desc, ring, next := service.descriptor, service.descriptorRing, service.nextDescriptor
+	service.mu.RUnlock()
+	if next != nil {
+		t.Error("Descriptor for the next time period created outside the overlap period")
+	}
+
+	// With 4 relays every one of them is responsible and holds the
+	// descriptor exactly as signed
+	for _, relay := range network.Relays() {
+		posted := relay.HSDescriptors()
+		if len(posted) != 1 || !bytes.Equal(posted[0], desc.RawDescriptor) {
+			t.Errorf("%s holds %d descriptors, want the published one", relay.Nickname(), len(posted))
+		}
+	}
+
+	stats := service.GetStats()
+	if stats.PublishedHSDirs != 4 || len(stats.HSDirUploads) != 4 {
+		t.Fatalf("Stats report %d of %d uploads published, want 4 of 4", stats.PublishedHSDirs, len(stats.HSDirUploads))
+	}
+	for _, upload := range stats.HSDirUploads {
+		if !upload.Succeeded || upload.Attempts != 1 || upload.TimePeriod != ring.PeriodNum || upload.Revision != desc.RevisionCounter {
+			t.Errorf("Upload %+v, want one successful attempt of revision %d for period %d", upload, desc.RevisionCounter, ring.PeriodNum)
+		}
+	}
+}
+
+func TestFetchDescriptorOverBeginDir(t *testing.T) {
+	params := NetworkParams{ValidAfter: time.Date(2016, 4, 13, 15, 0, 0, 0, time.UTC)}
+	service, network, hsdirs := newPublishTestService(t, 4, params)
+	if err := service.publishDescriptor(context.Background(), hsdirs); err != nil {
+		t.Fatalf("publishDescriptor() error = %v", err)
+	}
+
+	hsdir := NewHSDir(nil)
+	hsdir.SetNetworkParams(params)
+	if _, err := hsdir.FetchDescriptor(context.Background(), service.address, hsdirs); err == nil {
+		t.Error("Expected error without a circuit builder")
+	}
+
+	hsdir.SetCircuitBuilder(&fakeNetworkBuilder{network: network, builder: circuit.NewBuilder(circuit.NewManager(), nil)})
+	desc, err := hsdir.FetchDescriptor(context.Background(), service.address, hsdirs)
+	if err != nil {
+		t.Fatalf("FetchDescriptor() error = %v", err)
+	}
+	service.mu.RLock()
+	published := service.descriptor
+	service.mu.RUnlock()
+	if desc.RevisionCounter != published.RevisionCounter || len(desc.IntroPoints) != len(service.introPoints) {
+		t.Errorf("Fetched revision %d with %d introduction points, want revision %d with %d",
+			desc.RevisionCounter, len(desc.IntroPoints), published.RevisionCounter, len(service.introPoints))
+	}
+
+	// HSDirs answer 404 for a service they hold no descriptor for
+	_, other := newTestDescriptor(t)
+	if _, err := hsdir.FetchDescriptor(context.Background(), other.address, hsdirs); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("FetchDescriptor() for an unpublished service error = %v, want status 404", err)
+	}
+}
+
+func TestPublishDescriptorRetriesEachHSDir(t *testing.T) {
+	service, network, hsdirs := newPublishTestService(t, 4, NetworkParams{ValidAfter: time.Date(2016, 4, 13, 15, 0, 0, 0, time.UTC)})
+	ring := service.descriptorRing
+	flaky, down := network.Relays()[0], network.Relays()[1]
+	flaky.RejectHSDescriptors(1)
+	down.RejectHSDescriptors(descriptorUploadAttempts)
+
+	if err := service.publishDescriptor(context.Background(), hsdirs); err != nil {
+		t.Fatalf("publishDescriptor() error = %v", err)
+	}
+	stats := service.GetStats()
+	if stats.PublishedHSDirs != 3 {
+		t.Errorf("Stats report %d HSDirs published, want 3", stats.PublishedHSDirs)
+	}
+	if upload, _ := uploadFor(stats, flaky.Fingerprint(), ring.PeriodNum); !upload.Succeeded || upload.Attempts != 2 {
+		t.Errorf("Flaky HSDir upload %+v, want success on the second attempt", upload)
+	}
+	upload, _ := uploadFor(stats, down.Fingerprint(), ring.PeriodNum)
+	if upload.Succeeded || upload.Attempts != descriptorUploadAttempts || !strings.Contains(upload.Error, "503") {
+		t.Errorf("Failing HSDir upload %+v, want %d failed attempts with status 503", upload, descriptorUploadAttempts)
+	}
+
+	// The next check only goes back to the HSDir that failed
+	service.checkPublication(context.Background(), hsdirs)
+	for _, relay := range network.Relays() {
+		if n := len(relay.HSDescriptors()); n != 1 {
+			t.Errorf("%s holds %d descriptors after the retry, want 1", relay.Nickname(), n)
+		}
+	}
+	if upload, _ := uploadFor(service.GetStats(), down.Fingerprint(), ring.PeriodNum); !upload.Succeeded || upload.Attempts != 1 {
+		t.Errorf("Retried HSDir upload %+v, want success", upload)
+	}
+}
+
+func TestCheckPublicationUsesUpdatedRelays(t *testing.T) {
+	service, network, hsdirs := newPublishTestService(t, 4, NetworkParams{ValidAfter: time.Date(2016, 4, 13, 15, 0, 0, 0, time.UTC)})
+	service.UpdateRelays(hsdirs[:2])
+	if err := service.publishDescriptor(context.Background(), service.currentRelays()); err != nil {
+		t.Fatalf("publishDescriptor() error = %v", err)
+	}
+
+	// Relays that join with a new consensus get the descriptor at the next
+	// check
+	service.UpdateRelays(hsdirs)
+	service.checkPublication(context.Background(), service.currentRelays())
+	for _, relay := range network.Relays() {
+		if n := len(relay.HSDescriptors()); n != 1 {
+			t.Errorf("%s holds %d descriptors, want 1", relay.Nickname(), n)
+		}
+	}
+}
+
+func TestPublishDescriptorInOverlapPeriod(t *testing.T) {
+	overlap := NetworkParams{
+		ValidAfter:  time.Date(2016, 4, 13, 6, 0, 0, 0, time.UTC),
+		CurrentSRV:  bytes.Repeat([]byte{0xC0}, 32),
+		PreviousSRV: bytes.Repeat([]byte{0x9E}, 32),
+	}
+	service, network, hsdirs := newPublishTestService(t, 4, overlap)
+
+	service.mu.RLock()
+	current, next, nextRing := service.descriptor, service.nextDescriptor, service.nextRing
+	service.mu.RUnlock()
+	if next == nil || nextRing.PeriodNum != service.descriptorRing.PeriodNum+1 {
+		t.Fatalf("No descriptor for the next time period in the overlap period")
+	}
+	if bytes.Equal(current.BlindedPubkey, next.BlindedPubkey) {
+		t.Error("Both time periods use the same blinded key")
+	}
+
+	if err := service.publishDescriptor(context.Background(), hsdirs); err != nil {
+		t.Fatalf("publishDescriptor() error = %v", err)
+	}
+	for _, relay := range network.Relays() {
+		if n := len(relay.HSDescriptors()); n != 2 {
+			t.Errorf("%s holds %d descriptors, want one per time period", relay.Nickname(), n)
+		}
+	}
+	if stats := service.GetStats(); stats.PublishedHSDirs != 8 {
+		t.Errorf("Stats report %d uploads published, want 8", stats.PublishedHSDirs)
+	}
+
+	// A client whose consensus is ahead introduces itself with the next
+	// period's descriptor
+	intro := service.introPoints[0]
+	intro.CircuitID = 3001
+	handshake, err := crypto.NewHsNtorClient(intro.AuthKey, intro.EncKey, ComputeSubcredential(service.publicKey, next.BlindedPubkey))
+	if err != nil {
+		t.Fatalf("Failed to start hs-ntor handshake: %v", err)
+	}
+	rendezvousPoint := testIntroRelay("89ABCDEF0123456789ABCDEF0123456789ABCDEF")
+	rendezvousPoint.IdentityKey = bytes.Repeat([]byte{0x07}, 32)
+	rendezvousPoint.NtorOnionKey = bytes.Repeat([]byte{0x42}, 32)
+	data, err := NewIntroductionProtocol(nil).BuildIntroduce1Cell(&IntroduceRequest{
+		IntroPoint:       &IntroductionPoint{AuthKey: intro.AuthKey, EncKey: intro.EncKey},
+		RendezvousCookie: []byte("test-cookie-12345678"),
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build INTRODUCE2 cell: %v", err)
+	}
+	if _, _, _, err := service.acceptIntroduce2(3001, data); err != nil {
+		t.Errorf("acceptIntroduce2() with the next period's descriptor error = %v", err)
+	}
+
+	// Once the next period starts the descriptors are rebuilt, and the
+	// uploads for the period that ended are dropped
+	if service.descriptorsOutdated() {
+		t.Error("Descriptors reported outdated before the rollover")
+	}
+	rolled := overlap
+	rolled.ValidAfter = time.Date(2016, 4, 13, 12, 0, 0, 0, time.UTC)
+	service.SetNetworkParams(rolled)
+	if !service.descriptorsOutdated() {
+		t.Fatal("Descriptors not reported outdated after the rollover")
+	}
+	service.checkPublication(context.Background(), hsdirs)
+	service.mu.RLock()
+	period, nextAfter := service.descriptorRing.PeriodNum, service.nextDescriptor
+	service.mu.RUnlock()
+	if period != nextRing.PeriodNum || nextAfter != nil {
+		t.Errorf("After the rollover the descriptor is for period %d (next: %v), want %d only", period, nextAfter != nil, nextRing.PeriodNum)
+	}
+	for _, upload := range service.GetStats().HSDirUploads {
+		if upload.TimePeriod != nextRing.PeriodNum {
+			t.Errorf("Upload for period %d kept after the rollover", upload.TimePeriod)
+		}
+	}
+}
+
+func TestUploadDescriptorWithoutBuilder(t *testing.T) {
+	desc, service := newTestDescriptor(t)
+	if err := service.uploadDescriptor(context.Background(), testHashRingRelays(1)[0], desc); err == nil {
+		t.Error("Expected error without a circuit builder")
+	}
+}
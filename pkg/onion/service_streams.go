@@ -0,0 +1,280 @@
+// Package onion - Service streams
+// This file serves the streams a client opens on a rendezvous circuit
+// (rend-spec-v3.txt section 4.2) by proxying them to the local targets in
+// ServiceConfig.Ports
+package onion
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/circuit"
+)
+
+const (
+	// RELAY_END reasons (tor-spec.txt section 6.3)
+	endReasonConnectRefused byte = 3
+	endReasonDone           byte = 6
+
+	// maxRelayDataLen is the largest RELAY_DATA payload
+	maxRelayDataLen = 498
+
+	// serviceStreamQueue bounds the DATA cells queued for a local target.
+	// It matches the stream window, so a client that respects flow control
+	// never fills it.
+	serviceStreamQueue = 500
+
+	// serviceConnectTimeout bounds connecting to a local target
+	serviceConnectTimeout = 10 * time.Second
+)
+
+// rendezvousSession is a client connection joined at a rendezvous point
+type rendezvousSession struct {
+	service *Service
+	circ    *circuit.Circuit
+
+	mu      sync.Mutex
+	streams map[uint16]*serviceStream
+}
+
+// serviceStream is a client stream proxied to a local target
+type serviceStream struct {
+	id     uint16
+	data   chan []byte   // DATA from the client; closed when the client ends the stream
+	closed chan struct{} // Closed once the local target is done
+}
+
+// newRendezvousSession returns a session for a joined rendezvous circuit
+func newRendezvousSession(service *Service, circ *circuit.Circuit) *rendezvousSession {
+	return &rendezvousSession{
+		service: service,
+		circ:    circ,
+		streams: make(map[uint16]*serviceStream),
+	}
+}
+
+// serve dispatches the cells of the rendezvous circuit to the client's
+// streams until the circuit closes or the service stops
+func (r *rendezvousSession) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.circ.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	r.service.mu.Lock()
+	r.service.activeRendezvous++
+	r.service.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		for id, stream := range r.streams {
+			close(stream.data)
+			delete(r.streams, id)
+		}
+		r.mu.Unlock()
+
+		if err := r.circ.Close(); err != nil {
+			r.service.logger.Debug("Failed to close rendezvous circuit", "error", err)
+		}
+		r.service.mu.Lock()
+		r.service.activeRendezvous--
+		r.service.mu.Unlock()
+		r.service.logger.Debug("Rendezvous circuit closed", "circuit", r.circ.ID)
+	}()
+
+	for {
+		relayCell, err := r.circ.ReceiveRelayCell(ctx)
+		if err != nil {
+			return
+		}
+
+		switch relayCell.Command {
+		case cell.RelayBegin:
+			if err := r.begin(ctx, relayCell); err != nil {
+				r.service.logger.Warn("Closing rendezvous circuit", "circuit", r.circ.ID, "error", err)
+				return
+			}
+		case cell.RelayData:
+			if err := r.deliver(relayCell); err != nil {
+				r.service.logger.Warn("Closing rendezvous circuit", "circuit", r.circ.ID, "error", err)
+				return
+			}
+		case cell.RelayEnd:
+			if relayCell.StreamID == 0 {
+				return
+			}
+			r.endFromClient(relayCell.StreamID)
+		case cell.RelayTruncated:
+			return
+		}
+	}
+}
+
+// begin opens a stream for a BEGIN cell. Like Tor, a BEGIN for a port the
+// service does not offer closes the whole circuit, so that clients cannot
+// scan for ports.
+func (r *rendezvousSession) begin(ctx context.Context, relayCell *cell.RelayCell) error {
+	port, err := parseBeginPort(relayCell.Data)
+	if err != nil {
+		return err
+	}
+	r.service.mu.RLock()
+	target, ok := r.service.config.Ports[port]
+	r.service.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("BEGIN for unconfigured port %d", port)
+	}
+
+	r.mu.Lock()
+	if _, exists := r.streams[relayCell.StreamID]; exists || relayCell.StreamID == 0 {
+		r.mu.Unlock()
+		return fmt.Errorf("BEGIN for invalid stream %d", relayCell.StreamID)
+	}
+	stream := &serviceStream{
+		id:     relayCell.StreamID,
+		data:   make(chan []byte, serviceStreamQueue),
+		closed: make(chan struct{}),
+	}
+	r.streams[stream.id] = stream
+	r.mu.Unlock()
+
+	r.service.logger.Debug("Client opened stream",
+		"circuit", r.circ.ID,
+		"stream", stream.id,
+		"port", port)
+
+	go r.proxy(ctx, stream, target)
+	return nil
+}
+
+// deliver queues the data of a DATA cell for its stream's local target
+func (r *rendezvousSession) deliver(relayCell *cell.RelayCell) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream, ok := r.streams[relayCell.StreamID]
+	if !ok {
+		return nil
+	}
+	select {
+	case stream.data <- relayCell.Data:
+		return nil
+	default:
+		return fmt.Errorf("client exceeded the window of stream %d", stream.id)
+	}
+}
+
+// endFromClient ends a stream the client closed with RELAY_END
+func (r *rendezvousSession) endFromClient(streamID uint16) {
+	r.circ.ReleaseStream(streamID)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stream, ok := r.streams[streamID]; ok {
+		delete(r.streams, streamID)
+		close(stream.data)
+	}
+}
+
+// removeStream forgets a stream that ended locally and reports whether the
+// client had not already ended it
+func (r *rendezvousSession) removeStream(stream *serviceStream) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.streams[stream.id] != stream {
+		return false
+	}
+	delete(r.streams, stream.id)
+	return true
+}
+
+// proxy connects a stream to its local target and copies data both ways.
+// The stream ends when either side closes.
+func (r *rendezvousSession) proxy(ctx context.Context, stream *serviceStream, target string) {
+	dialer := net.Dialer{Timeout: serviceConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		r.service.logger.Warn("Failed to connect to local target", "target", target, "error", err)
+		if r.removeStream(stream) {
+			_ = r.circ.EndStream(stream.id, endReasonConnectRefused)
+		}
+		return
+	}
+	defer conn.Close()
+
+	// Onion service CONNECTED cells carry no address (rend-spec-v3.txt
+	// section 4.2)
+	if err := r.circ.SendRelayCell(cell.NewRelayCell(stream.id, cell.RelayConnected, nil)); err != nil {
+		r.removeStream(stream)
+		return
+	}
+
+	// Client to target: DATA is acknowledged once the target has taken it
+	go func() {
+		defer conn.Close()
+		for {
+			select {
+			case data, ok := <-stream.data:
+				if !ok {
+					return
+				}
+				if _, err := conn.Write(data); err != nil {
+					return
+				}
+				if err := r.circ.AcknowledgeStreamData(stream.id); err != nil {
+					return
+				}
+			case <-stream.closed:
+				return
+			}
+		}
+	}()
+
+	// Target to client
+	buf := make([]byte, maxRelayDataLen)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if writeErr := r.circ.WriteToStream(stream.id, append([]byte(nil), buf[:n]...)); writeErr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(stream.closed)
+
+	if r.removeStream(stream) {
+		_ = r.circ.EndStream(stream.id, endReasonDone)
+	}
+}
+
+// parseBeginPort returns the port of a BEGIN cell: ADDRPORT is a
+// NUL-terminated "address:port" whose address is empty for onion services
+func parseBeginPort(data []byte) (int, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return 0, fmt.Errorf("BEGIN address is not NUL-terminated")
+	}
+	_, portStr, err := net.SplitHostPort(string(data[:end]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid BEGIN address: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid BEGIN port %q", portStr)
+	}
+	return port, nil
+}
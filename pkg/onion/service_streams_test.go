@@ -0,0 +1,32 @@
+package onion
+
+import "testing"
+
+func TestParseBeginPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{"onion service", []byte(":80\x00"), 80, false},
+		{"with flags", []byte(":443\x00\x00\x00\x00\x01"), 443, false},
+		{"with address", []byte("example.com:8080\x00"), 8080, false},
+		{"not terminated", []byte(":80"), 0, true},
+		{"no port", []byte("example.com\x00"), 0, true},
+		{"port zero", []byte(":0\x00"), 0, true},
+		{"port too large", []byte(":65536\x00"), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBeginPort(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBeginPort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseBeginPort() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package onion
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/opd-ai/go-tor/pkg/crypto"
 	"github.com/opd-ai/go-tor/pkg/logger"
 )
 
@@ -177,12 +180,8 @@ func TestServiceStartStop(t *testing.T) {
 		t.Fatalf("failed to create service: %v", err)
 	}
 
-	// Create mock HSDirs
-	hsdirs := []*HSDirectory{
-		{Fingerprint: "hsdir1", Address: "127.0.0.1", ORPort: 9001, DirPort: 9030, HSDir: true},
-		{Fingerprint: "hsdir2", Address: "127.0.0.1", ORPort: 9002, DirPort: 9031, HSDir: true},
-		{Fingerprint: "hsdir3", Address: "127.0.0.1", ORPort: 9003, DirPort: 9032, HSDir: true},
-	}
+	_, builder, hsdirs := newIntroTestNetwork(t, 3)
+	service.SetCircuitBuilder(builder)
 
 	ctx := context.Background()
 
@@ -237,12 +236,8 @@ func TestEstablishIntroductionPoints(t *testing.T) {
 		t.Fatalf("failed to create service: %v", err)
 	}
 
-	hsdirs := []*HSDirectory{
-		{Fingerprint: "relay1", Address: "127.0.0.1", ORPort: 9001, DirPort: 9030, HSDir: true},
-		{Fingerprint: "relay2", Address: "127.0.0.1", ORPort: 9002, DirPort: 9031, HSDir: true},
-		{Fingerprint: "relay3", Address: "127.0.0.1", ORPort: 9003, DirPort: 9032, HSDir: true},
-		{Fingerprint: "relay4", Address: "127.0.0.1", ORPort: 9004, DirPort: 9033, HSDir: true},
-	}
+	network, builder, hsdirs := newIntroTestNetwork(t, 4)
+	service.SetCircuitBuilder(builder)
 
 	ctx := context.Background()
 	if err := service.establishIntroductionPoints(ctx, hsdirs); err != nil {
@@ -271,6 +266,15 @@ func TestEstablishIntroductionPoints(t *testing.T) {
 			t.Errorf("intro point %d not marked as established", i)
 		}
 	}
+
+	// The relays accepted each ESTABLISH_INTRO
+	total := 0
+	for _, relay := range network.Relays() {
+		total += relay.IntroPointCount()
+	}
+	if total != 3 {
+		t.Errorf("relays hold %d intro points, want 3", total)
+	}
 }
 
 func TestEstablishIntroductionPointsInsufficientRelays(t *testing.T) {
@@ -316,14 +320,14 @@ func TestCreateDescriptor(t *testing.T) {
 	// Setup some intro points first
 	service.introPoints = []*ServiceIntroPoint{
 		{
-			Relay:       &HSDirectory{Fingerprint: "relay1"},
+			Relay:       testIntroRelay("0000000000000000000000000000000000000001"),
 			CircuitID:   3001,
 			AuthKey:     make([]byte, 32),
 			EncKey:      make([]byte, 32),
 			Established: true,
 		},
 		{
-			Relay:       &HSDirectory{Fingerprint: "relay2"},
+			Relay:       testIntroRelay("0000000000000000000000000000000000000002"),
 			CircuitID:   3002,
 			AuthKey:     make([]byte, 32),
 			EncKey:      make([]byte, 32),
@@ -364,6 +368,48 @@ func TestCreateDescriptor(t *testing.T) {
 	if desc.Address.String() != service.address.String() {
 		t.Error("descriptor address doesn't match service address")
 	}
+
+	// Clients can read the introduction points back from the published form
+	parsed, err := ParseDescriptor(desc.RawDescriptor)
+	if err != nil {
+		t.Fatalf("failed to parse descriptor: %v", err)
+	}
+	parsed.BlindedPubkey = desc.BlindedPubkey
+	if err := DecryptDescriptor(parsed, service.address); err != nil {
+		t.Fatalf("failed to decrypt descriptor: %v", err)
+	}
+	if len(parsed.IntroPoints) != 2 {
+		t.Errorf("expected 2 decrypted intro points, got %d", len(parsed.IntroPoints))
+	}
+}
+
+func TestCreateDescriptorSkipsUnreachableIntroPoints(t *testing.T) {
+	service, err := NewService(&ServiceConfig{Ports: map[int]string{80: "localhost:8080"}}, logger.NewDefault())
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	service.introPoints = []*ServiceIntroPoint{
+		{Relay: &HSDirectory{Fingerprint: "relay1"}, AuthKey: make([]byte, 32), EncKey: make([]byte, 32)},
+		{Relay: testIntroRelay("0000000000000000000000000000000000000002"), AuthKey: make([]byte, 32), EncKey: make([]byte, 32)},
+	}
+	if err := service.createDescriptor(); err != nil {
+		t.Fatalf("failed to create descriptor: %v", err)
+	}
+
+	if n := len(service.descriptor.IntroPoints); n != 1 {
+		t.Errorf("expected 1 intro point in descriptor, got %d", n)
+	}
+}
+
+// testIntroRelay returns a relay that clients can extend to
+func testIntroRelay(fingerprint string) *HSDirectory {
+	return &HSDirectory{
+		Fingerprint:  fingerprint,
+		Address:      "192.0.2.1",
+		ORPort:       9001,
+		NtorOnionKey: make([]byte, 32),
+	}
 }
 
 func TestSignDescriptor(t *testing.T) {
@@ -388,11 +434,26 @@ func TestSignDescriptor(t *testing.T) {
 		Lifetime:    3 * time.Hour,
 	}
 
-	// Sign it
-	if err := service.signDescriptor(desc); err != nil {
+	// Sign it through the identity key blinded for the current period
+	ring := service.params.CurrentHashRing()
+	blinded, err := blindExpandedIdentity(service.identityKey, service.publicKey, ring.PeriodNum, ring.PeriodLength)
+	if err != nil {
+		t.Fatalf("failed to blind identity: %v", err)
+	}
+	desc.BlindedPubkey = blinded.public
+	if err := service.signDescriptor(desc, blinded); err != nil {
 		t.Fatalf("failed to sign descriptor: %v", err)
 	}
 
+	// The descriptor signing key is certified by the blinded key
+	cert, err := parseCertificate(desc.DescriptorSigningKeyCert)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if cert.CertType != certTypeDescriptorSigning || !bytes.Equal(cert.SignedWithKey, blinded.public) {
+		t.Errorf("unexpected certificate type %d signed with %x", cert.CertType, cert.SignedWithKey)
+	}
+
 	// Verify signature exists
 	if len(desc.Signature) != ed25519.SignatureSize {
 		t.Errorf("invalid signature size: %d, expected %d", len(desc.Signature), ed25519.SignatureSize)
@@ -437,13 +498,9 @@ func TestPublishDescriptor(t *testing.T) {
 		t.Fatalf("failed to create descriptor: %v", err)
 	}
 
-	// Mock HSDirs
-	hsdirs := []*HSDirectory{
-		{Fingerprint: "hsdir1", Address: "127.0.0.1", ORPort: 9001, DirPort: 9030, HSDir: true},
-		{Fingerprint: "hsdir2", Address: "127.0.0.1", ORPort: 9002, DirPort: 9031, HSDir: true},
-		{Fingerprint: "hsdir3", Address: "127.0.0.1", ORPort: 9003, DirPort: 9032, HSDir: true},
-		{Fingerprint: "hsdir4", Address: "127.0.0.1", ORPort: 9004, DirPort: 9033, HSDir: true},
-	}
+	// HSDirs on a fake relay network
+	_, builder, hsdirs := newIntroTestNetwork(t, 4)
+	service.SetCircuitBuilder(builder)
 
 	ctx := context.Background()
 	if err := service.publishDescriptor(ctx, hsdirs); err != nil {
@@ -460,57 +517,82 @@ func TestPublishDescriptor(t *testing.T) {
 	}
 }
 
-func TestHandleIntroduce2(t *testing.T) {
-	config := &ServiceConfig{
-		Ports: map[int]string{
-			80: "localhost:8080",
-		},
-	}
+// newIntroduce2Service returns a service whose only introduction point is
+// on circuit 3001, and an INTRODUCE2 cell for it
+func newIntroduce2Service(t *testing.T) (*Service, []byte) {
+	t.Helper()
 
-	log := logger.NewDefault()
-	service, err := NewService(config, log)
+	desc, service := newTestDescriptor(t)
+	intro := service.introPoints[0]
+	intro.CircuitID = 3001
+
+	rendezvousPoint := testIntroRelay("89ABCDEF0123456789ABCDEF0123456789ABCDEF")
+	rendezvousPoint.IdentityKey = bytes.Repeat([]byte{0x07}, 32)
+	rendezvousPoint.NtorOnionKey = bytes.Repeat([]byte{0x42}, 32)
+
+	introPoint := &IntroductionPoint{AuthKey: intro.AuthKey, EncKey: intro.EncKey}
+	handshake, err := crypto.NewHsNtorClient(intro.AuthKey, intro.EncKey, ComputeSubcredential(service.publicKey, desc.BlindedPubkey))
 	if err != nil {
-		t.Fatalf("failed to create service: %v", err)
+		t.Fatalf("Failed to start hs-ntor handshake: %v", err)
+	}
+	data, err := NewIntroductionProtocol(nil).BuildIntroduce1Cell(&IntroduceRequest{
+		IntroPoint:       introPoint,
+		RendezvousCookie: []byte("test-cookie-12345678"),
+		RendezvousPoint:  rendezvousPoint,
+		Handshake:        handshake,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build INTRODUCE2 cell: %v", err)
 	}
+	return service, data
+}
 
-	// Create mock INTRODUCE2 data
-	introduce2Data := make([]byte, 52)
-	// Rendezvous cookie (20 bytes)
-	copy(introduce2Data[0:20], []byte("test-cookie-12345678"))
-	// Client onion key (32 bytes)
-	copy(introduce2Data[20:52], make([]byte, 32))
+func TestHandleIntroduce2(t *testing.T) {
+	service, data := newIntroduce2Service(t)
 
-	if err := service.HandleIntroduce2(3001, introduce2Data); err != nil {
-		t.Fatalf("failed to handle INTRODUCE2: %v", err)
+	// Without a circuit builder the rendezvous point cannot be reached, but
+	// the cell is accepted up to that point
+	err := service.HandleIntroduce2(3001, data)
+	if err == nil || !strings.Contains(err.Error(), "no circuit builder") {
+		t.Fatalf("HandleIntroduce2() error = %v, want missing circuit builder", err)
+	}
+	if stats := service.GetStats(); stats.PendingIntros != 0 {
+		t.Errorf("Expected no pending introductions after failure, got %d", stats.PendingIntros)
 	}
 
-	// Verify pending intro was stored
-	service.mu.RLock()
-	pending := len(service.pendingIntros)
-	service.mu.RUnlock()
-
-	if pending != 1 {
-		t.Errorf("expected 1 pending intro, got %d", pending)
+	// The same cell again is a replay
+	err = service.HandleIntroduce2(3001, data)
+	if err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("HandleIntroduce2() error = %v, want replay", err)
 	}
 }
 
-func TestHandleIntroduce2InvalidData(t *testing.T) {
-	config := &ServiceConfig{
-		Ports: map[int]string{
-			80: "localhost:8080",
-		},
-	}
+func TestHandleIntroduce2Rejects(t *testing.T) {
+	service, data := newIntroduce2Service(t)
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 0x01
 
-	log := logger.NewDefault()
-	service, err := NewService(config, log)
-	if err != nil {
-		t.Fatalf("failed to create service: %v", err)
+	tests := []struct {
+		name        string
+		circuitID   uint32
+		data        []byte
+		errContains string
+	}{
+		{"unknown circuit", 4242, data, "unknown introduction circuit"},
+		{"too short", 3001, make([]byte, 10), "too short"},
+		{"bad MAC", 3001, tampered, "MAC mismatch"},
 	}
 
-	// Too short data
-	shortData := make([]byte, 10)
-	if err := service.HandleIntroduce2(3001, shortData); err == nil {
-		t.Error("expected error with short INTRODUCE2 data")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := service.HandleIntroduce2(tt.circuitID, tt.data)
+			if err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			if !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("Error message %q does not contain %q", err.Error(), tt.errContains)
+			}
+		})
 	}
 }
 
@@ -0,0 +1,61 @@
+// Package path provides the family and subnet constraints between circuit hops.
+package path
+
+import (
+	"net"
+
+	"github.com/opd-ai/go-tor/pkg/directory"
+)
+
+// Subnet prefix lengths within which two relays may not share a circuit
+// (path-spec.txt section 2.2, EnforceDistinctSubnets)
+const (
+	ipv4SubnetBits = 16
+	ipv6SubnetBits = 32
+)
+
+// sameSubnet reports whether two relay addresses share an IPv4 /16 or an IPv6 /32
+func sameSubnet(a, b string) bool {
+	ipA := net.ParseIP(a)
+	ipB := net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return false
+	}
+
+	if v4A, v4B := ipA.To4(), ipB.To4(); v4A != nil || v4B != nil {
+		if v4A == nil || v4B == nil {
+			return false
+		}
+		mask := net.CIDRMask(ipv4SubnetBits, 32)
+		return v4A.Mask(mask).Equal(v4B.Mask(mask))
+	}
+
+	mask := net.CIDRMask(ipv6SubnetBits, 128)
+	return ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
+
+// relaysConflict reports whether two relays may not appear in the same circuit:
+// they are the same relay, are in the same declared family, or share an IPv4
+// or IPv6 subnet
+func relaysConflict(a, b *directory.Relay) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.Fingerprint == b.Fingerprint {
+		return true
+	}
+	if sameSubnet(a.Address, b.Address) || sameSubnet(a.IPv6Address, b.IPv6Address) {
+		return true
+	}
+	return a.InSameFamily(b)
+}
+
+// conflictsWithAny reports whether relay conflicts with any of the chosen hops
+func conflictsWithAny(relay *directory.Relay, chosen ...*directory.Relay) bool {
+	for _, hop := range chosen {
+		if relaysConflict(relay, hop) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package path
+
+import (
+	"testing"
+
+	"github.com/opd-ai/go-tor/pkg/directory"
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+func TestSameSubnet(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"same ipv4 /16", "10.1.2.3", "10.1.200.4", true},
+		{"different ipv4 /16", "10.1.2.3", "10.2.2.3", false},
+		{"identical ipv4", "192.0.2.1", "192.0.2.1", true},
+		{"same ipv6 /32", "2001:db8:1::1", "2001:db8:ffff::2", true},
+		{"different ipv6 /32", "2001:db8::1", "2001:db9::1", false},
+		{"ipv4 and ipv6", "10.1.2.3", "2001:db8::1", false},
+		{"ipv4-mapped ipv6 treated as ipv4", "::ffff:10.1.2.3", "10.1.9.9", true},
+		{"unparseable address", "not-an-ip", "10.1.2.3", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameSubnet(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameSubnet(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelaysConflict(t *testing.T) {
+	const (
+		fpA = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+		fpB = "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"
+	)
+
+	tests := []struct {
+		name string
+		a, b *directory.Relay
+		want bool
+	}{
+		{
+			name: "unrelated relays",
+			a:    &directory.Relay{Nickname: "A", Fingerprint: fpA, Address: "10.1.0.1"},
+			b:    &directory.Relay{Nickname: "B", Fingerprint: fpB, Address: "10.2.0.1"},
+			want: false,
+		},
+		{
+			name: "same relay",
+			a:    &directory.Relay{Nickname: "A", Fingerprint: fpA, Address: "10.1.0.1"},
+			b:    &directory.Relay{Nickname: "A", Fingerprint: fpA, Address: "10.1.0.1"},
+			want: true,
+		},
+		{
+			name: "same /16",
+			a:    &directory.Relay{Nickname: "A", Fingerprint: fpA, Address: "10.1.0.1"},
+			b:    &directory.Relay{Nickname: "B", Fingerprint: fpB, Address: "10.1.99.1"},
+			want: true,
+		},
+		{
+			name: "same ipv6 /32",
+			a:    &directory.Relay{Nickname: "A", Fingerprint: fpA, Address: "10.1.0.1", IPv6Address: "2001:db8:1::1"},
+			b:    &directory.Relay{Nickname: "B", Fingerprint: fpB, Address: "10.2.0.1", IPv6Address: "2001:db8:2::1"},
+			want: true,
+		},
+		{
+			name: "different ipv6 /32",
+			a:    &directory.Relay{Nickname: "A", Fingerprint: fpA, Address: "10.1.0.1", IPv6Address: "2001:db8::1"},
+			b:    &directory.Relay{Nickname: "B", Fingerprint: fpB, Address: "10.2.0.1", IPv6Address: "2001:db9::1"},
+			want: false,
+		},
+		{
+			name: "mutual family",
+			a:    &directory.Relay{Nickname: "A", Fingerprint: fpA, Address: "10.1.0.1", Family: []string{"$" + fpB}},
+			b:    &directory.Relay{Nickname: "B", Fingerprint: fpB, Address: "10.2.0.1", Family: []string{"$" + fpA}},
+			want: true,
+		},
+		{
+			name: "one-sided family claim",
+			a:    &directory.Relay{Nickname: "A", Fingerprint: fpA, Address: "10.1.0.1", Family: []string{"$" + fpB}},
+			b:    &directory.Relay{Nickname: "B", Fingerprint: fpB, Address: "10.2.0.1"},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relaysConflict(tt.a, tt.b); got != tt.want {
+				t.Errorf("relaysConflict() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newConstraintSelector builds a selector over the given relays with the first
+// relay as the only guard
+func newConstraintSelector(relays []*directory.Relay) *Selector {
+	selector := NewSelector(directory.NewClient(logger.NewDefault()), logger.NewDefault())
+	selector.guards = relays[:1]
+	selector.relays = relays
+	return selector
+}
+
+func TestSelectPathFamilyConstraint(t *testing.T) {
+	const (
+		fpGuard  = "1111111111111111111111111111111111111111"
+		fpFamily = "2222222222222222222222222222222222222222"
+		fpExit   = "3333333333333333333333333333333333333333"
+		fpOther  = "4444444444444444444444444444444444444444"
+	)
+
+	tests := []struct {
+		name       string
+		relays     []*directory.Relay
+		wantMiddle string
+		wantErr    bool
+	}{
+		{
+			name: "middle in guard family is skipped",
+			relays: []*directory.Relay{
+				{Nickname: "Guard", Fingerprint: fpGuard, Address: "10.1.0.1", Flags: []string{"Guard"}, Family: []string{"$" + fpFamily}},
+				{Nickname: "Exit", Fingerprint: fpExit, Address: "10.2.0.1", Flags: []string{"Exit"}},
+				{Nickname: "Sibling", Fingerprint: fpFamily, Address: "10.3.0.1", Family: []string{"$" + fpGuard}},
+				{Nickname: "Other", Fingerprint: fpOther, Address: "10.4.0.1"},
+			},
+			wantMiddle: "Other",
+		},
+		{
+			name: "middle in exit family is skipped",
+			relays: []*directory.Relay{
+				{Nickname: "Guard", Fingerprint: fpGuard, Address: "10.1.0.1", Flags: []string{"Guard"}},
+				{Nickname: "Exit", Fingerprint: fpExit, Address: "10.2.0.1", Flags: []string{"Exit"}, Family: []string{"Sibling"}},
+				{Nickname: "Sibling", Fingerprint: fpFamily, Address: "10.3.0.1", Family: []string{"Exit"}},
+				{Nickname: "Other", Fingerprint: fpOther, Address: "10.4.0.1"},
+			},
+			wantMiddle: "Other",
+		},
+		{
+			name: "one-sided family claim is ignored",
+			relays: []*directory.Relay{
+				{Nickname: "Guard", Fingerprint: fpGuard, Address: "10.1.0.1", Flags: []string{"Guard"}},
+				{Nickname: "Exit", Fingerprint: fpExit, Address: "10.2.0.1", Flags: []string{"Exit"}},
+				{Nickname: "Claimer", Fingerprint: fpFamily, Address: "10.3.0.1", Family: []string{"$" + fpGuard}},
+			},
+			wantMiddle: "Claimer",
+		},
+		{
+			name: "only family members available",
+			relays: []*directory.Relay{
+				{Nickname: "Guard", Fingerprint: fpGuard, Address: "10.1.0.1", Flags: []string{"Guard"}, Family: []string{"$" + fpFamily}},
+				{Nickname: "Exit", Fingerprint: fpExit, Address: "10.2.0.1", Flags: []string{"Exit"}},
+				{Nickname: "Sibling", Fingerprint: fpFamily, Address: "10.3.0.1", Family: []string{"$" + fpGuard}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector := newConstraintSelector(tt.relays)
+			for i := 0; i < 20; i++ {
+				p, err := selector.SelectPath(80)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatal("Expected error, got path")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("SelectPath failed: %v", err)
+				}
+				if p.Middle.Nickname != tt.wantMiddle {
+					t.Fatalf("middle = %s, want %s", p.Middle.Nickname, tt.wantMiddle)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectPathSubnetConstraint(t *testing.T) {
+	const (
+		fp1 = "1111111111111111111111111111111111111111"
+		fp2 = "2222222222222222222222222222222222222222"
+		fp3 = "3333333333333333333333333333333333333333"
+		fp4 = "4444444444444444444444444444444444444444"
+		fp5 = "5555555555555555555555555555555555555555"
+	)
+
+	tests := []struct {
+		name       string
+		relays     []*directory.Relay
+		wantExit   string
+		wantMiddle string
+		wantErr    bool
+	}{
+		{
+			name: "exit in guard /16 is skipped",
+			relays: []*directory.Relay{
+				{Nickname: "Guard", Fingerprint: fp1, Address: "10.1.0.1", Flags: []string{"Guard"}},
+				{Nickname: "NearExit", Fingerprint: fp2, Address: "10.1.5.5", Flags: []string{"Exit"}},
+				{Nickname: "FarExit", Fingerprint: fp3, Address: "10.2.0.1", Flags: []string{"Exit"}},
+				{Nickname: "Middle", Fingerprint: fp4, Address: "10.3.0.1"},
+			},
+			wantExit:   "FarExit",
+			wantMiddle: "Middle",
+		},
+		{
+			name: "middle in exit /16 is skipped",
+			relays: []*directory.Relay{
+				{Nickname: "Guard", Fingerprint: fp1, Address: "10.1.0.1", Flags: []string{"Guard"}},
+				{Nickname: "Exit", Fingerprint: fp2, Address: "10.2.0.1", Flags: []string{"Exit"}},
+				{Nickname: "NearMiddle", Fingerprint: fp3, Address: "10.2.77.1"},
+				{Nickname: "FarMiddle", Fingerprint: fp4, Address: "10.3.0.1"},
+			},
+			wantExit:   "Exit",
+			wantMiddle: "FarMiddle",
+		},
+		{
+			name: "ipv6 /32 is enforced",
+			relays: []*directory.Relay{
+				{Nickname: "Guard", Fingerprint: fp1, Address: "2001:db8::1", Flags: []string{"Guard"}},
+				{Nickname: "Exit", Fingerprint: fp2, Address: "2001:db9::1", Flags: []string{"Exit"}},
+				{Nickname: "NearMiddle", Fingerprint: fp3, Address: "2001:db8:abcd::1"},
+				{Nickname: "FarMiddle", Fingerprint: fp4, Address: "2001:dba::1"},
+			},
+			wantExit:   "Exit",
+			wantMiddle: "FarMiddle",
+		},
+		{
+			name: "all relays in one /16",
+			relays: []*directory.Relay{
+				{Nickname: "Guard", Fingerprint: fp1, Address: "10.1.0.1", Flags: []string{"Guard"}},
+				{Nickname: "Exit", Fingerprint: fp2, Address: "10.1.0.2", Flags: []string{"Exit"}},
+				{Nickname: "Middle", Fingerprint: fp3, Address: "10.1.0.3"},
+				{Nickname: "Middle2", Fingerprint: fp5, Address: "10.1.0.4"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector := newConstraintSelector(tt.relays)
+			for i := 0; i < 20; i++ {
+				p, err := selector.SelectPath(80)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatal("Expected error, got path")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("SelectPath failed: %v", err)
+				}
+				if p.Exit.Nickname != tt.wantExit {
+					t.Fatalf("exit = %s, want %s", p.Exit.Nickname, tt.wantExit)
+				}
+				if p.Middle.Nickname != tt.wantMiddle {
+					t.Fatalf("middle = %s, want %s", p.Middle.Nickname, tt.wantMiddle)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Package path provides GeoIP country lookups for {cc} node specifiers.
+package path
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// unknownCountry is the country code for addresses not in the database ({??} in node specs)
+const unknownCountry = "??"
+
+// geoipRange maps an inclusive address range to a country code
+type geoipRange struct {
+	low     net.IP // 16-byte form
+	high    net.IP // 16-byte form
+	country string
+}
+
+// GeoIP resolves IP addresses to country codes using C tor's geoip and geoip6 file formats
+type GeoIP struct {
+	ranges []geoipRange
+}
+
+// LoadGeoIP loads C tor-format geoip (IPv4) and geoip6 (IPv6) files.
+// Either path may be empty to skip that address family.
+func LoadGeoIP(ipv4Path, ipv6Path string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, p := range []string{ipv4Path, ipv6Path} {
+		if p == "" {
+			continue
+		}
+		f, err := os.Open(p) // #nosec G304 - path comes from operator configuration
+		if err != nil {
+			return nil, fmt.Errorf("failed to open GeoIP file: %w", err)
+		}
+		err = g.load(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GeoIP file %s: %w", p, err)
+		}
+	}
+	g.sort()
+	return g, nil
+}
+
+// ParseGeoIP parses GeoIP data in either the IPv4 format ("INTLOW,INTHIGH,CC")
+// or the IPv6 format ("ADDRLOW,ADDRHIGH,CC")
+func ParseGeoIP(r io.Reader) (*GeoIP, error) {
+	g := &GeoIP{}
+	if err := g.load(r); err != nil {
+		return nil, err
+	}
+	g.sort()
+	return g, nil
+}
+
+// load appends the ranges read from r
+func (g *GeoIP) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ",")
+		if len(parts) != 3 {
+			return fmt.Errorf("line %d: expected 3 fields", lineNum)
+		}
+
+		low, err := parseGeoIPAddress(parts[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		high, err := parseGeoIPAddress(parts[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if bytes.Compare(low, high) > 0 {
+			return fmt.Errorf("line %d: range start after range end", lineNum)
+		}
+
+		g.ranges = append(g.ranges, geoipRange{
+			low:     low,
+			high:    high,
+			country: strings.ToLower(strings.TrimSpace(parts[2])),
+		})
+	}
+	return scanner.Err()
+}
+
+// parseGeoIPAddress parses an integer IPv4 address or a textual IPv6 address
+func parseGeoIPAddress(s string) (net.IP, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		return net.IP(b).To16(), nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", s)
+	}
+	return ip.To16(), nil
+}
+
+// sort orders ranges by start address for binary search
+func (g *GeoIP) sort() {
+	sort.Slice(g.ranges, func(i, j int) bool {
+		return bytes.Compare(g.ranges[i].low, g.ranges[j].low) < 0
+	})
+}
+
+// Country returns the lower-case country code for ip, or "??" if unknown
+func (g *GeoIP) Country(ip net.IP) string {
+	if g == nil || ip == nil {
+		return unknownCountry
+	}
+	ip16 := ip.To16()
+
+	// Find the last range whose start is <= ip
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].low, ip16) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip16, g.ranges[i].high) > 0 {
+		return unknownCountry
+	}
+	return g.ranges[i].country
+}
+
+// Len returns the number of ranges loaded
+func (g *GeoIP) Len() int {
+	if g == nil {
+		return 0
+	}
+	return len(g.ranges)
+}
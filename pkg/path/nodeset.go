@@ -0,0 +1,274 @@
+// Package path provides node-spec matching for ExcludeNodes, EntryNodes and ExitNodes.
+package path
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/opd-ai/go-tor/pkg/directory"
+)
+
+// NodeSet matches relays against a list of torrc node specifiers.
+// Accepted forms, as in C tor's routerset:
+//   - identity fingerprints: "$ABCD...", "ABCD..." (40 hex digits)
+//   - fingerprints with a nickname: "$ABCD...~nickname" or "$ABCD...=nickname"
+//     (matched by fingerprint only)
+//   - nicknames (case-insensitive)
+//   - IPv4/IPv6 addresses and CIDR ranges: "192.0.2.1", "192.0.2.0/24", "[2001:db8::]/32"
+//   - country codes in braces: "{de}", "{??}" for unknown countries
+//
+// Entries may be given one per option line or comma-separated.
+type NodeSet struct {
+	fingerprints map[string]bool
+	nicknames    map[string]bool
+	networks     []*net.IPNet
+	countries    map[string]bool
+	geoip        *GeoIP
+}
+
+// ParseNodeSet parses torrc node specifiers into a NodeSet
+func ParseNodeSet(specs []string) (*NodeSet, error) {
+	ns := &NodeSet{
+		fingerprints: make(map[string]bool),
+		nicknames:    make(map[string]bool),
+		countries:    make(map[string]bool),
+	}
+
+	for _, spec := range specs {
+		for _, entry := range strings.Split(spec, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if err := ns.add(entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ns, nil
+}
+
+// add parses a single node specifier
+func (ns *NodeSet) add(entry string) error {
+	// Country code: {cc}
+	if strings.HasPrefix(entry, "{") && strings.HasSuffix(entry, "}") {
+		cc := strings.ToLower(entry[1 : len(entry)-1])
+		if len(cc) != 2 {
+			return fmt.Errorf("invalid country code in node spec: %s", entry)
+		}
+		ns.countries[cc] = true
+		return nil
+	}
+
+	// Fingerprint, optionally with $ prefix and ~nickname / =nickname suffix
+	if fp, ok := parseFingerprintSpec(entry); ok {
+		ns.fingerprints[fp] = true
+		return nil
+	}
+	if strings.HasPrefix(entry, "$") {
+		return fmt.Errorf("invalid fingerprint in node spec: %s", entry)
+	}
+
+	// Address or CIDR range
+	if network, ok := parseAddressSpec(entry); ok {
+		ns.networks = append(ns.networks, network)
+		return nil
+	}
+
+	// Nickname
+	if isValidNickname(entry) {
+		ns.nicknames[strings.ToLower(entry)] = true
+		return nil
+	}
+
+	return fmt.Errorf("invalid node spec: %s", entry)
+}
+
+// parseFingerprintSpec extracts an upper-case hex fingerprint from "$fp", "fp",
+// "$fp~nick" or "$fp=nick"
+func parseFingerprintSpec(entry string) (string, bool) {
+	fp := strings.TrimPrefix(entry, "$")
+	if i := strings.IndexAny(fp, "~="); i >= 0 {
+		if !isValidNickname(fp[i+1:]) {
+			return "", false
+		}
+		fp = fp[:i]
+	}
+	if len(fp) != 40 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(fp); err != nil {
+		return "", false
+	}
+	return strings.ToUpper(fp), true
+}
+
+// parseAddressSpec parses an IP address or CIDR range, with optional IPv6 brackets
+func parseAddressSpec(entry string) (*net.IPNet, bool) {
+	addr := entry
+	bits := ""
+	if i := strings.LastIndex(addr, "/"); i >= 0 {
+		addr, bits = addr[:i], addr[i:]
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, false
+	}
+
+	if bits == "" {
+		if ip.To4() != nil {
+			bits = "/32"
+		} else {
+			bits = "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(addr + bits)
+	if err != nil {
+		return nil, false
+	}
+	return network, true
+}
+
+// isValidNickname reports whether s is a legal relay nickname (1-19 alphanumerics)
+func isValidNickname(s string) bool {
+	if len(s) < 1 || len(s) > 19 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// SetGeoIP sets the database used to resolve {cc} specifiers
+func (ns *NodeSet) SetGeoIP(geoip *GeoIP) {
+	ns.geoip = geoip
+}
+
+// IsEmpty returns true if the set has no specifiers
+func (ns *NodeSet) IsEmpty() bool {
+	return ns == nil || (len(ns.fingerprints) == 0 && len(ns.nicknames) == 0 &&
+		len(ns.networks) == 0 && len(ns.countries) == 0)
+}
+
+// HasCountries returns true if the set contains {cc} specifiers
+func (ns *NodeSet) HasCountries() bool {
+	return ns != nil && len(ns.countries) > 0
+}
+
+// Contains reports whether the relay matches any specifier in the set
+func (ns *NodeSet) Contains(relay *directory.Relay) bool {
+	if ns.IsEmpty() || relay == nil {
+		return false
+	}
+
+	if len(ns.fingerprints) > 0 && ns.fingerprints[relay.HexFingerprint()] {
+		return true
+	}
+
+	if ns.nicknames[strings.ToLower(relay.Nickname)] {
+		return true
+	}
+
+	ip := net.ParseIP(relay.Address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range ns.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if len(ns.countries) > 0 && ns.geoip != nil {
+		if ns.countries[ns.geoip.Country(ip)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NodeRestrictions holds the torrc node restrictions applied during path selection.
+// Semantics follow C tor:
+//   - ExcludeNodes are never used in any position
+//   - ExcludeExitNodes are never used as exits
+//   - EntryNodes and ExitNodes, when non-empty, are the only relays used as guards and exits
+//   - StrictNodes also keeps ExcludeNodes for relays we do not choose ourselves,
+//     such as the last hop of an onion service circuit
+type NodeRestrictions struct {
+	ExcludeNodes     *NodeSet
+	ExcludeExitNodes *NodeSet
+	EntryNodes       *NodeSet
+	ExitNodes        *NodeSet
+	StrictNodes      bool
+}
+
+// NewNodeRestrictions parses node specifiers for all restriction options.
+// geoip may be nil if no {cc} specifiers are used.
+func NewNodeRestrictions(excludeNodes, excludeExitNodes, entryNodes, exitNodes []string, strictNodes bool, geoip *GeoIP) (*NodeRestrictions, error) {
+	r := &NodeRestrictions{StrictNodes: strictNodes}
+
+	sets := []struct {
+		name  string
+		specs []string
+		dst   **NodeSet
+	}{
+		{"ExcludeNodes", excludeNodes, &r.ExcludeNodes},
+		{"ExcludeExitNodes", excludeExitNodes, &r.ExcludeExitNodes},
+		{"EntryNodes", entryNodes, &r.EntryNodes},
+		{"ExitNodes", exitNodes, &r.ExitNodes},
+	}
+	for _, set := range sets {
+		ns, err := ParseNodeSet(set.specs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", set.name, err)
+		}
+		ns.SetGeoIP(geoip)
+		*set.dst = ns
+	}
+
+	return r, nil
+}
+
+// HasCountries returns true if any restriction uses {cc} specifiers
+func (r *NodeRestrictions) HasCountries() bool {
+	if r == nil {
+		return false
+	}
+	return r.ExcludeNodes.HasCountries() || r.ExcludeExitNodes.HasCountries() ||
+		r.EntryNodes.HasCountries() || r.ExitNodes.HasCountries()
+}
+
+// allows reports whether relay may be used in the given position.
+func (r *NodeRestrictions) allows(relay *directory.Relay, pos position) bool {
+	if r == nil {
+		return true
+	}
+	if r.ExcludeNodes.Contains(relay) {
+		return false
+	}
+	switch pos {
+	case positionGuard:
+		if !r.EntryNodes.IsEmpty() && !r.EntryNodes.Contains(relay) {
+			return false
+		}
+	case positionExit:
+		if r.ExcludeExitNodes.Contains(relay) {
+			return false
+		}
+		if !r.ExitNodes.IsEmpty() && !r.ExitNodes.Contains(relay) {
+			return false
+		}
+	}
+	return true
+}
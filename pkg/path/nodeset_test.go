@@ -0,0 +1,295 @@
+package path
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/opd-ai/go-tor/pkg/directory"
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+const testGeoIP = `# IPv4 ranges (integer form)
+167837696,167903231,de
+167903232,167968767,nl
+# IPv6 ranges
+2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,fr
+`
+
+func TestParseNodeSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		wantErr bool
+	}{
+		{"fingerprint with dollar", []string{"$0123456789ABCDEF0123456789ABCDEF01234567"}, false},
+		{"fingerprint without dollar", []string{"0123456789abcdef0123456789abcdef01234567"}, false},
+		{"fingerprint with nickname", []string{"$0123456789ABCDEF0123456789ABCDEF01234567~relay1"}, false},
+		{"fingerprint with equals nickname", []string{"$0123456789ABCDEF0123456789ABCDEF01234567=relay1"}, false},
+		{"nickname", []string{"MyRelay"}, false},
+		{"ipv4 address", []string{"192.0.2.1"}, false},
+		{"ipv4 cidr", []string{"192.0.2.0/24"}, false},
+		{"ipv6 cidr", []string{"[2001:db8::]/32"}, false},
+		{"country code", []string{"{de}"}, false},
+		{"unknown country", []string{"{??}"}, false},
+		{"comma separated", []string{"{de}, {nl},MyRelay"}, false},
+		{"empty", []string{}, false},
+		{"short fingerprint", []string{"$ABCD"}, true},
+		{"bad country code", []string{"{deu}"}, true},
+		{"nickname too long", []string{"ThisNicknameIsFarTooLong"}, true},
+		{"invalid characters", []string{"bad-name!"}, true},
+		{"bad cidr", []string{"192.0.2.0/99"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseNodeSet(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseNodeSet(%v) error = %v, wantErr %v", tt.specs, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNodeSetContains(t *testing.T) {
+	geoip, err := ParseGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatalf("ParseGeoIP failed: %v", err)
+	}
+
+	// Base64 of 000102...13 is the consensus form of this fingerprint
+	relay := &directory.Relay{
+		Nickname:    "TestRelay",
+		Fingerprint: "AAECAwQFBgcICQoLDA0ODxAREhM",
+		Address:     "10.1.2.3",
+	}
+	relayV6 := &directory.Relay{
+		Nickname:    "V6Relay",
+		Fingerprint: "FFFF",
+		Address:     "2001:db8::1",
+	}
+
+	tests := []struct {
+		name  string
+		specs []string
+		relay *directory.Relay
+		want  bool
+	}{
+		{"hex fingerprint", []string{"$000102030405060708090A0B0C0D0E0F10111213"}, relay, true},
+		{"lower-case fingerprint", []string{"000102030405060708090a0b0c0d0e0f10111213"}, relay, true},
+		{"fingerprint with other nickname", []string{"$000102030405060708090A0B0C0D0E0F10111213~Other"}, relay, true},
+		{"different fingerprint", []string{"$FFFF02030405060708090A0B0C0D0E0F10111213"}, relay, false},
+		{"nickname case-insensitive", []string{"testrelay"}, relay, true},
+		{"different nickname", []string{"OtherRelay"}, relay, false},
+		{"exact address", []string{"10.1.2.3"}, relay, true},
+		{"matching cidr", []string{"10.1.0.0/16"}, relay, true},
+		{"non-matching cidr", []string{"10.2.0.0/16"}, relay, false},
+		{"ipv6 cidr", []string{"[2001:db8::]/32"}, relayV6, true},
+		{"ipv4 cidr does not match ipv6", []string{"10.0.0.0/8"}, relayV6, false},
+		{"country match", []string{"{de}"}, relay, true},
+		{"country upper-case", []string{"{DE}"}, relay, true},
+		{"country mismatch", []string{"{nl}"}, relay, false},
+		{"ipv6 country", []string{"{fr}"}, relayV6, true},
+		{"one of several", []string{"OtherRelay,{nl}", "10.1.2.3"}, relay, true},
+		{"empty set", []string{}, relay, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, err := ParseNodeSet(tt.specs)
+			if err != nil {
+				t.Fatalf("ParseNodeSet failed: %v", err)
+			}
+			ns.SetGeoIP(geoip)
+			if got := ns.Contains(tt.relay); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeSetCountryWithoutGeoIP(t *testing.T) {
+	ns, err := ParseNodeSet([]string{"{de}"})
+	if err != nil {
+		t.Fatalf("ParseNodeSet failed: %v", err)
+	}
+	if !ns.HasCountries() {
+		t.Error("HasCountries() = false, want true")
+	}
+	if ns.Contains(&directory.Relay{Address: "10.1.2.3"}) {
+		t.Error("Country specs should not match without a GeoIP database")
+	}
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	geoip, err := ParseGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatalf("ParseGeoIP failed: %v", err)
+	}
+	if geoip.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", geoip.Len())
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.1.0.0", "de"},
+		{"10.1.255.255", "de"},
+		{"10.2.0.0", "nl"},
+		{"10.3.0.0", "??"},
+		{"9.255.255.255", "??"},
+		{"2001:db8::42", "fr"},
+		{"2001:db9::1", "??"},
+	}
+
+	for _, tt := range tests {
+		if got := geoip.Country(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Country(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := ParseGeoIP(strings.NewReader("1,2\n")); err == nil {
+		t.Error("Expected error for malformed GeoIP line")
+	}
+	if _, err := ParseGeoIP(strings.NewReader("5,1,de\n")); err == nil {
+		t.Error("Expected error for inverted GeoIP range")
+	}
+}
+
+// newRestrictedSelector returns a fixture selector with the given restrictions
+func newRestrictedSelector(t *testing.T, excludeNodes, excludeExitNodes, entryNodes, exitNodes []string, strict bool) *Selector {
+	t.Helper()
+
+	restrictions, err := NewNodeRestrictions(excludeNodes, excludeExitNodes, entryNodes, exitNodes, strict, nil)
+	if err != nil {
+		t.Fatalf("NewNodeRestrictions failed: %v", err)
+	}
+	selector := newFixtureSelector(t, 7)
+	selector.SetNodeRestrictions(restrictions)
+	return selector
+}
+
+func TestSelectPathHonoursExcludeNodes(t *testing.T) {
+	// Exclude GuardB by nickname and the whole 10.6.0.0/16 range (ExitA)
+	selector := newRestrictedSelector(t, []string{"GuardB, 10.6.0.0/16"}, nil, nil, nil, false)
+
+	for i := 0; i < 500; i++ {
+		p, err := selector.SelectPath(80)
+		if err != nil {
+			t.Fatalf("SelectPath failed: %v", err)
+		}
+		for _, relay := range []*directory.Relay{p.Guard, p.Middle, p.Exit} {
+			if relay.Nickname == "GuardB" || relay.Nickname == "ExitA" {
+				t.Fatalf("excluded relay %s selected", relay.Nickname)
+			}
+		}
+	}
+}
+
+func TestSelectPathHonoursExcludeExitNodes(t *testing.T) {
+	selector := newRestrictedSelector(t, nil, []string{"ExitA", "GuardExit"}, nil, nil, false)
+
+	sawExitAAsMiddle := false
+	for i := 0; i < 500; i++ {
+		p, err := selector.SelectPath(80)
+		if err != nil {
+			t.Fatalf("SelectPath failed: %v", err)
+		}
+		if p.Exit.Nickname != "ExitB" {
+			t.Fatalf("exit %s selected, want ExitB", p.Exit.Nickname)
+		}
+		if p.Middle.Nickname == "ExitA" {
+			sawExitAAsMiddle = true
+		}
+	}
+
+	// ExcludeExitNodes only restricts the exit position
+	if !sawExitAAsMiddle {
+		t.Error("ExcludeExitNodes should not prevent use as a middle relay")
+	}
+}
+
+func TestSelectPathHonoursEntryAndExitNodes(t *testing.T) {
+	selector := newRestrictedSelector(t, nil, nil, []string{"GuardA"}, []string{"10.7.0.0/16"}, false)
+
+	for i := 0; i < 200; i++ {
+		p, err := selector.SelectPath(80)
+		if err != nil {
+			t.Fatalf("SelectPath failed: %v", err)
+		}
+		if p.Guard.Nickname != "GuardA" {
+			t.Fatalf("guard %s selected, want GuardA", p.Guard.Nickname)
+		}
+		if p.Exit.Nickname != "ExitB" {
+			t.Fatalf("exit %s selected, want ExitB", p.Exit.Nickname)
+		}
+	}
+}
+
+func TestStrictNodes(t *testing.T) {
+	allGuards := []string{"GuardA", "GuardB", "GuardExit"}
+
+	// ExcludeNodes is never relaxed for relays we choose, with or without
+	// StrictNodes
+	for _, strictNodes := range []bool{false, true} {
+		selector := newRestrictedSelector(t, allGuards, nil, nil, nil, strictNodes)
+		if _, err := selector.selectGuard(); err == nil {
+			t.Errorf("Expected error when ExcludeNodes excludes every guard (StrictNodes=%v)", strictNodes)
+		}
+	}
+
+	// A target chosen by the other end is only held to ExcludeNodes with
+	// StrictNodes
+	lenient := newRestrictedSelector(t, []string{"ExitA"}, nil, nil, nil, false)
+	strict := newRestrictedSelector(t, []string{"ExitA"}, nil, nil, nil, true)
+	var target *directory.Relay
+	for _, relay := range strict.GetRelays() {
+		if relay.Nickname == "ExitA" {
+			target = relay
+		}
+	}
+	if _, err := lenient.SelectPathTo(target); err != nil {
+		t.Errorf("SelectPathTo excluded target without StrictNodes failed: %v", err)
+	}
+	if _, err := strict.SelectPathTo(target); err == nil {
+		t.Error("Expected error for an excluded target with StrictNodes")
+	}
+
+	// EntryNodes are never relaxed, with or without StrictNodes
+	noEntry := newRestrictedSelector(t, nil, nil, []string{"MiddleA"}, nil, false)
+	if _, err := noEntry.selectGuard(); err == nil {
+		t.Error("Expected error when EntryNodes contains no usable guard")
+	}
+}
+
+func TestPersistentGuardHonoursExcludeNodes(t *testing.T) {
+	log := logger.NewDefault()
+	guardMgr, err := NewGuardManager(t.TempDir(), log)
+	if err != nil {
+		t.Fatalf("NewGuardManager failed: %v", err)
+	}
+
+	selector := newRestrictedSelector(t, []string{"GuardB"}, nil, nil, nil, true)
+	selector.guardManager = guardMgr
+	if err := guardMgr.AddGuard(relayByNickname(t, selector, "GuardB")); err != nil {
+		t.Fatalf("AddGuard failed: %v", err)
+	}
+
+	guard, err := selector.selectGuard()
+	if err != nil {
+		t.Fatalf("selectGuard failed: %v", err)
+	}
+	if guard.Nickname == "GuardB" {
+		t.Error("Excluded persistent guard was selected")
+	}
+}
+
+func TestNewNodeRestrictionsInvalidSpec(t *testing.T) {
+	if _, err := NewNodeRestrictions([]string{"$BAD"}, nil, nil, nil, false, nil); err == nil {
+		t.Error("Expected error for invalid ExcludeNodes spec")
+	}
+	if _, err := NewNodeRestrictions(nil, nil, nil, []string{"{xyz}"}, false, nil); err == nil {
+		t.Error("Expected error for invalid ExitNodes spec")
+	}
+}
@@ -4,10 +4,9 @@ package path
 
 import (
 	"context"
-	"crypto/rand"
 	"fmt"
-	"math/big"
 	"sync"
+	"time"
 
 	"github.com/opd-ai/go-tor/pkg/directory"
 	"github.com/opd-ai/go-tor/pkg/logger"
@@ -28,6 +27,12 @@ type Selector struct {
 	mu           sync.RWMutex
 	guards       []*directory.Relay
 	relays       []*directory.Relay
+	consensus    *directory.Consensus
+	bwWeights    *bandwidthWeights
+	restrictions *NodeRestrictions
+
+	// randSource overrides the cryptographic random source (tests only)
+	randSource func(max int64) (int64, error)
 }
 
 // NewSelector creates a new path selector
@@ -63,11 +68,36 @@ func NewSelectorWithGuards(dirClient *directory.Client, guardMgr *GuardManager,
 func (s *Selector) UpdateConsensus(ctx context.Context) error {
 	s.logger.Info("Updating network consensus")
 
-	relays, err := s.dirClient.FetchConsensus(ctx)
+	consensus, err := s.dirClient.FetchConsensusDocument(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to fetch consensus: %w", err)
 	}
 
+	s.SetConsensus(consensus)
+	return nil
+}
+
+// LoadCachedConsensus loads the consensus cached by a previous run, if it is
+// still valid
+func (s *Selector) LoadCachedConsensus(ctx context.Context) error {
+	consensus, err := s.dirClient.LoadCachedConsensus(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.SetConsensus(consensus)
+	return nil
+}
+
+// Consensus returns the consensus currently used for path selection, or nil
+func (s *Selector) Consensus() *directory.Consensus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.consensus
+}
+
+// SetConsensus replaces the relays and bandwidth weights used for path selection
+func (s *Selector) SetConsensus(consensus *directory.Consensus) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -75,7 +105,7 @@ func (s *Selector) UpdateConsensus(ctx context.Context) error {
 	guards := make([]*directory.Relay, 0)
 	allRelays := make([]*directory.Relay, 0)
 
-	for _, relay := range relays {
+	for _, relay := range consensus.Relays {
 		if !relay.IsRunning() || !relay.IsValid() {
 			continue // Skip non-running or invalid relays
 		}
@@ -89,12 +119,47 @@ func (s *Selector) UpdateConsensus(ctx context.Context) error {
 
 	s.guards = guards
 	s.relays = allRelays
+	s.consensus = consensus
+	s.bwWeights = newBandwidthWeights(consensus)
+
+	// Declared families come from microdescriptors only
+	if consensus.Flavor != directory.FlavorMicrodesc && len(allRelays) > 0 {
+		s.logger.Warn("Consensus carries no relay families, circuits may use relays of one family (enable UseMicrodescriptors)",
+			"flavor", consensus.Flavor)
+	}
 
 	s.logger.Info("Consensus updated",
 		"total_relays", len(allRelays),
-		"guard_relays", len(guards))
+		"guard_relays", len(guards),
+		"bandwidth_weights", len(consensus.BandwidthWeights))
+}
 
-	return nil
+// SetNodeRestrictions sets the ExcludeNodes/EntryNodes/ExitNodes policy used for path selection
+func (s *Selector) SetNodeRestrictions(restrictions *NodeRestrictions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restrictions = restrictions
+}
+
+// restrict filters candidates through the node restrictions for a position.
+// ExcludeNodes is never relaxed for the circuits we choose the relays of, so
+// restrictions that leave no candidates are an error whatever StrictNodes is.
+func (s *Selector) restrict(candidates []*directory.Relay, pos position) ([]*directory.Relay, error) {
+	if s.restrictions == nil {
+		return candidates, nil
+	}
+
+	filtered := make([]*directory.Relay, 0, len(candidates))
+	for _, relay := range candidates {
+		if s.restrictions.allows(relay, pos) {
+			filtered = append(filtered, relay)
+		}
+	}
+
+	if len(filtered) == 0 && len(candidates) > 0 {
+		return nil, fmt.Errorf("node restrictions leave no usable %s relays", pos.String())
+	}
+	return filtered, nil
 }
 
 // GetRelays returns all relays from the current consensus (for event publishing)
@@ -117,6 +182,12 @@ func (s *Selector) SelectPath(exitPort int) (*Path, error) {
 		return nil, fmt.Errorf("no relays available, call UpdateConsensus first")
 	}
 
+	// Never build circuits from an expired consensus
+	if s.consensus != nil && s.consensus.IsExpired(time.Now()) {
+		return nil, fmt.Errorf("consensus expired at %s, refusing to build circuits",
+			s.consensus.ValidUntil.Format(time.RFC3339))
+	}
+
 	// Select guard
 	guard, err := s.selectGuard()
 	if err != nil {
@@ -147,8 +218,75 @@ func (s *Selector) SelectPath(exitPort int) (*Path, error) {
 	}, nil
 }
 
-// selectGuard selects a guard relay, preferring persistent guards
-func (s *Selector) selectGuard() (*directory.Relay, error) {
+// SelectPathTo selects a path whose last hop is target, as used for onion
+// service introduction and rendezvous circuits (rend-spec-v3.txt §3). The
+// guard and middle must not conflict with the target, which need not be an
+// exit. The target is chosen by the service or client at the other end, so
+// it is only held to ExcludeNodes with StrictNodes, as in C tor.
+func (s *Selector) SelectPathTo(target *directory.Relay) (*Path, error) {
+	if target == nil {
+		return nil, fmt.Errorf("target relay is nil")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.guards) == 0 || len(s.relays) == 0 {
+		return nil, fmt.Errorf("no relays available, call UpdateConsensus first")
+	}
+	if s.restrictions != nil && s.restrictions.StrictNodes && s.restrictions.ExcludeNodes.Contains(target) {
+		return nil, fmt.Errorf("target %s is in ExcludeNodes and StrictNodes is set", target.Nickname)
+	}
+	if s.consensus != nil && s.consensus.IsExpired(time.Now()) {
+		return nil, fmt.Errorf("consensus expired at %s, refusing to build circuits",
+			s.consensus.ValidUntil.Format(time.RFC3339))
+	}
+
+	// As in C tor, a guard that shares a family or subnet with the target
+	// gives way to the next one that does not
+	guard, err := s.selectGuard(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select guard for target %s: %w", target.Nickname, err)
+	}
+
+	middle, err := s.selectMiddle(guard, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select middle: %w", err)
+	}
+
+	s.logger.Info("Path selected",
+		"guard", guard.Nickname,
+		"middle", middle.Nickname,
+		"target", target.Nickname)
+
+	return &Path{
+		Guard:  guard,
+		Middle: middle,
+		Exit:   target,
+	}, nil
+}
+
+// SelectDirectoryGuard selects the relay for tunnelled directory requests.
+// As in guard-spec.txt section 4.3, directory requests use the client's
+// entry guards, so no additional relays learn that we run Tor.
+func (s *Selector) SelectDirectoryGuard() (*directory.Relay, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.guards) == 0 {
+		return nil, fmt.Errorf("no relays available, call UpdateConsensus first")
+	}
+
+	guard, err := s.selectGuard()
+	if err != nil {
+		return nil, fmt.Errorf("failed to select directory guard: %w", err)
+	}
+	return guard, nil
+}
+
+// selectGuard selects a guard relay that conflicts with none of the avoid
+// relays, preferring confirmed persistent guards, then sampled ones
+func (s *Selector) selectGuard(avoid ...*directory.Relay) (*directory.Relay, error) {
 	if len(s.guards) == 0 {
 		return nil, fmt.Errorf("no guard relays available")
 	}
@@ -158,11 +296,18 @@ func (s *Selector) selectGuard() (*directory.Relay, error) {
 		persistentGuards := s.guardManager.GetGuards()
 
 		// Try to find a persistent guard that's still in the current consensus
-		for _, pGuard := range persistentGuards {
-			for _, relay := range s.guards {
-				if relay.Fingerprint == pGuard.Fingerprint {
-					s.logger.Debug("Using persistent guard", "nickname", relay.Nickname)
-					return relay, nil
+		// and still permitted by the node restrictions
+		for _, confirmed := range []bool{true, false} {
+			for _, pGuard := range persistentGuards {
+				if pGuard.Confirmed != confirmed {
+					continue
+				}
+				for _, relay := range s.guards {
+					if relay.Fingerprint == pGuard.Fingerprint && s.restrictions.allows(relay, positionGuard) &&
+						!conflictsWithAny(relay, avoid...) {
+						s.logger.Debug("Using persistent guard", "nickname", relay.Nickname)
+						return relay, nil
+					}
 				}
 			}
 		}
@@ -171,13 +316,29 @@ func (s *Selector) selectGuard() (*directory.Relay, error) {
 		s.logger.Debug("No persistent guards available, selecting new guard")
 	}
 
-	// Select a random guard from available guards
-	idx, err := randomIndex(len(s.guards))
+	candidates, err := s.restrict(s.guards, positionGuard)
 	if err != nil {
 		return nil, err
 	}
+	usable := make([]*directory.Relay, 0, len(candidates))
+	for _, relay := range candidates {
+		if !conflictsWithAny(relay, avoid...) {
+			usable = append(usable, relay)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no guard relays satisfy node restrictions")
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("every guard shares a family or subnet with the target")
+	}
+	candidates = usable
 
-	guard := s.guards[idx]
+	// Select a bandwidth-weighted guard from available guards
+	guard, err := s.weightedChoice(candidates, positionGuard)
+	if err != nil {
+		return nil, err
+	}
 
 	// Add to persistent guards if we have a guard manager
 	if s.guardManager != nil {
@@ -204,71 +365,66 @@ func (s *Selector) ConfirmGuard(fingerprint string) {
 	}
 }
 
-// selectExit selects an exit relay that allows the specified port
+// selectExit selects an exit relay that allows the specified port and
+// shares neither family nor subnet with the guard
 func (s *Selector) selectExit(port int, avoid *directory.Relay) (*directory.Relay, error) {
-	// For now, select any exit that's not the guard
-	// In production, this would check exit policies for the port
+	// Exit policies come from microdescriptors; relays without one are not filtered
 	exits := make([]*directory.Relay, 0)
 
 	for _, relay := range s.relays {
-		if relay.IsExit() && relay.Fingerprint != avoid.Fingerprint {
+		if relay.IsExit() && relay.AllowsExitPort(port) && !conflictsWithAny(relay, avoid) {
 			exits = append(exits, relay)
 		}
 	}
+	exits, err := s.restrict(exits, positionExit)
 
 	if len(exits) == 0 {
-		// Fallback: any relay that's not the guard
+		// Fallback: any relay that doesn't conflict with the guard
 		for _, relay := range s.relays {
-			if relay.Fingerprint != avoid.Fingerprint {
+			if relay.AllowsExitPort(port) && !conflictsWithAny(relay, avoid) {
 				exits = append(exits, relay)
 			}
 		}
+		exits, err = s.restrict(exits, positionExit)
 	}
 
-	if len(exits) == 0 {
-		return nil, fmt.Errorf("no suitable exit relays available")
-	}
-
-	idx, err := randomIndex(len(exits))
 	if err != nil {
 		return nil, err
 	}
+	if len(exits) == 0 {
+		return nil, fmt.Errorf("no suitable exit relays available")
+	}
 
-	return exits[idx], nil
+	return s.weightedChoice(exits, positionExit)
 }
 
-// selectMiddle selects a middle relay that is neither guard nor exit
+// selectMiddle selects a middle relay that shares neither family nor subnet
+// with the guard or the exit
 func (s *Selector) selectMiddle(guard, exit *directory.Relay) (*directory.Relay, error) {
 	candidates := make([]*directory.Relay, 0)
 
 	for _, relay := range s.relays {
-		if relay.Fingerprint != guard.Fingerprint && relay.Fingerprint != exit.Fingerprint {
+		if !conflictsWithAny(relay, guard, exit) {
 			candidates = append(candidates, relay)
 		}
 	}
 
-	if len(candidates) == 0 {
-		return nil, fmt.Errorf("no suitable middle relays available")
-	}
-
-	idx, err := randomIndex(len(candidates))
+	candidates, err := s.restrict(candidates, positionMiddle)
 	if err != nil {
 		return nil, err
 	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no suitable middle relays available")
+	}
 
-	return candidates[idx], nil
+	return s.weightedChoice(candidates, positionMiddle)
 }
 
 // randomIndex returns a cryptographically random index in [0, max)
 func randomIndex(max int) (int, error) {
-	if max <= 0 {
-		return 0, fmt.Errorf("max must be positive")
-	}
-
-	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	n, err := cryptoRandInt(int64(max))
 	if err != nil {
-		return 0, fmt.Errorf("failed to generate random number: %w", err)
+		return 0, err
 	}
-
-	return int(n.Int64()), nil
+	return int(n), nil
 }
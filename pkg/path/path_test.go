@@ -9,7 +9,8 @@ import (
 	"github.com/opd-ai/go-tor/pkg/logger"
 )
 
-// mockDirectoryClient creates a mock directory client with test data
+// mockDirectoryClient creates a mock directory client with test data.
+// Each relay sits in its own /16 so the subnet constraint does not apply.
 type mockDirectoryClient struct {
 	relays []*directory.Relay
 }
@@ -24,49 +25,49 @@ func newMockDirectoryClient() *mockDirectoryClient {
 			{
 				Nickname:    "GuardRelay1",
 				Fingerprint: "AAAA1111",
-				Address:     "192.168.1.1",
+				Address:     "10.1.0.1",
 				ORPort:      9001,
 				Flags:       []string{"Running", "Valid", "Guard", "Stable", "Fast"},
 			},
 			{
 				Nickname:    "GuardRelay2",
 				Fingerprint: "AAAA2222",
-				Address:     "192.168.1.2",
+				Address:     "10.2.0.1",
 				ORPort:      9001,
 				Flags:       []string{"Running", "Valid", "Guard", "Stable"},
 			},
 			{
 				Nickname:    "MiddleRelay1",
 				Fingerprint: "BBBB1111",
-				Address:     "192.168.2.1",
+				Address:     "10.3.0.1",
 				ORPort:      9001,
 				Flags:       []string{"Running", "Valid", "Fast"},
 			},
 			{
 				Nickname:    "MiddleRelay2",
 				Fingerprint: "BBBB2222",
-				Address:     "192.168.2.2",
+				Address:     "10.4.0.1",
 				ORPort:      9001,
 				Flags:       []string{"Running", "Valid"},
 			},
 			{
 				Nickname:    "ExitRelay1",
 				Fingerprint: "CCCC1111",
-				Address:     "192.168.3.1",
+				Address:     "10.5.0.1",
 				ORPort:      9001,
 				Flags:       []string{"Running", "Valid", "Exit", "Fast"},
 			},
 			{
 				Nickname:    "ExitRelay2",
 				Fingerprint: "CCCC2222",
-				Address:     "192.168.3.2",
+				Address:     "10.6.0.1",
 				ORPort:      9001,
 				Flags:       []string{"Running", "Valid", "Exit"},
 			},
 			{
 				Nickname:    "InvalidRelay",
 				Fingerprint: "DDDD1111",
-				Address:     "192.168.4.1",
+				Address:     "10.7.0.1",
 				ORPort:      9001,
 				Flags:       []string{"Running"}, // Not Valid
 			},
@@ -183,6 +184,89 @@ func TestSelectPathNoRelays(t *testing.T) {
 	}
 }
 
+func TestSelectPathTo(t *testing.T) {
+	log := logger.NewDefault()
+	mockDir := newMockDirectoryClient()
+
+	selector := NewSelector(directory.NewClient(log), log)
+	selector.guards = []*directory.Relay{mockDir.relays[0]}
+	selector.relays = mockDir.relays[:6]
+
+	// A middle-only relay can end the path, as an introduction point would
+	target := mockDir.relays[3]
+	for i := 0; i < 20; i++ {
+		path, err := selector.SelectPathTo(target)
+		if err != nil {
+			t.Fatalf("SelectPathTo failed: %v", err)
+		}
+		if path.Exit != target {
+			t.Fatalf("Path ends at %s, want %s", path.Exit.Nickname, target.Nickname)
+		}
+		if path.Guard.Fingerprint == target.Fingerprint || path.Middle.Fingerprint == target.Fingerprint {
+			t.Fatal("Target appears twice in the path")
+		}
+		if path.Guard.Fingerprint == path.Middle.Fingerprint {
+			t.Fatal("Guard and middle relay are the same")
+		}
+	}
+
+	// The only guard cannot also be the target
+	if _, err := selector.SelectPathTo(mockDir.relays[0]); err == nil {
+		t.Error("Expected error when the target is the guard")
+	}
+	if _, err := selector.SelectPathTo(nil); err == nil {
+		t.Error("Expected error for nil target")
+	}
+}
+
+func TestSelectPathToSkipsConflictingGuard(t *testing.T) {
+	log := logger.NewDefault()
+	mockDir := newMockDirectoryClient()
+	guardMgr, err := NewGuardManager(t.TempDir(), log)
+	if err != nil {
+		t.Fatalf("NewGuardManager failed: %v", err)
+	}
+
+	selector := NewSelector(directory.NewClient(log), log)
+	selector.guardManager = guardMgr
+	selector.guards = mockDir.relays[:2]
+	selector.relays = mockDir.relays[:6]
+
+	// The confirmed guard shares a /16 with the target; the sampled one does not
+	conflicting, other := mockDir.relays[0], mockDir.relays[1]
+	for _, guard := range []*directory.Relay{conflicting, other} {
+		if err := guardMgr.AddGuard(guard); err != nil {
+			t.Fatalf("AddGuard failed: %v", err)
+		}
+	}
+	if err := guardMgr.ConfirmGuard(conflicting.Fingerprint); err != nil {
+		t.Fatalf("ConfirmGuard failed: %v", err)
+	}
+	target := &directory.Relay{
+		Nickname:    "Target",
+		Fingerprint: "EEEE1111",
+		Address:     "10.1.200.1",
+		ORPort:      9001,
+		Flags:       []string{"Running", "Valid"},
+	}
+
+	for i := 0; i < 10; i++ {
+		path, err := selector.SelectPathTo(target)
+		if err != nil {
+			t.Fatalf("SelectPathTo failed: %v", err)
+		}
+		if path.Guard != other {
+			t.Fatalf("Guard = %s, want %s", path.Guard.Nickname, other.Nickname)
+		}
+	}
+
+	// Without a guard outside the target's subnet there is no path
+	selector.guards = mockDir.relays[:1]
+	if _, err := selector.SelectPathTo(target); err == nil {
+		t.Error("Expected error when every guard conflicts with the target")
+	}
+}
+
 func TestSelectGuard(t *testing.T) {
 	log := logger.NewDefault()
 	mockDir := newMockDirectoryClient()
@@ -219,6 +303,25 @@ func TestSelectGuardNoGuards(t *testing.T) {
 	}
 }
 
+func TestSelectDirectoryGuard(t *testing.T) {
+	log := logger.NewDefault()
+	mockDir := newMockDirectoryClient()
+
+	selector := NewSelector(directory.NewClient(log), log)
+	if _, err := selector.SelectDirectoryGuard(); err == nil {
+		t.Error("Expected error before a consensus is loaded")
+	}
+
+	selector.guards = []*directory.Relay{mockDir.relays[0]}
+	guard, err := selector.SelectDirectoryGuard()
+	if err != nil {
+		t.Fatalf("SelectDirectoryGuard failed: %v", err)
+	}
+	if guard.Fingerprint != "AAAA1111" {
+		t.Errorf("SelectDirectoryGuard() = %s, want the entry guard AAAA1111", guard.Fingerprint)
+	}
+}
+
 func TestSelectExit(t *testing.T) {
 	log := logger.NewDefault()
 	mockDir := newMockDirectoryClient()
@@ -243,6 +346,53 @@ func TestSelectExit(t *testing.T) {
 	}
 }
 
+func TestSelectExitHonoursExitPolicy(t *testing.T) {
+	log := logger.NewDefault()
+	webOnly, err := directory.ParseExitPolicySummary("accept 80,443")
+	if err != nil {
+		t.Fatalf("ParseExitPolicySummary failed: %v", err)
+	}
+	noSMTP, err := directory.ParseExitPolicySummary("reject 25")
+	if err != nil {
+		t.Fatalf("ParseExitPolicySummary failed: %v", err)
+	}
+
+	guard := &directory.Relay{Nickname: "Guard", Fingerprint: "G", Address: "10.1.0.1", Flags: []string{"Guard"}}
+	selector := NewSelector(directory.NewClient(log), log)
+	selector.relays = []*directory.Relay{
+		guard,
+		{Nickname: "WebExit", Fingerprint: "W", Address: "10.2.0.1", Flags: []string{"Exit"}, ExitPolicy: webOnly},
+		{Nickname: "NoSMTPExit", Fingerprint: "N", Address: "10.3.0.1", Flags: []string{"Exit"}, ExitPolicy: noSMTP},
+	}
+
+	tests := []struct {
+		port     int
+		wantExit string
+		wantErr  bool
+	}{
+		{port: 22, wantExit: "NoSMTPExit"},
+		{port: 25, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			exit, err := selector.selectExit(tt.port, guard)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("port %d: expected error, got exit %s", tt.port, exit.Nickname)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("port %d: selectExit failed: %v", tt.port, err)
+			}
+			if exit.Nickname != tt.wantExit {
+				t.Fatalf("port %d: exit = %s, want %s", tt.port, exit.Nickname, tt.wantExit)
+			}
+		}
+	}
+}
+
 func TestSelectMiddle(t *testing.T) {
 	log := logger.NewDefault()
 	mockDir := newMockDirectoryClient()
@@ -392,3 +542,16 @@ func TestConcurrentAccess(t *testing.T) {
 		}
 	}
 }
+
+func TestSelectPathRefusesExpiredConsensus(t *testing.T) {
+	selector := newFixtureSelector(t, 1)
+
+	if _, err := selector.SelectPath(80); err != nil {
+		t.Fatalf("SelectPath with live consensus failed: %v", err)
+	}
+
+	selector.consensus.ValidUntil = time.Now().Add(-time.Minute)
+	if _, err := selector.SelectPath(80); err == nil {
+		t.Error("Expected error when the consensus has expired")
+	}
+}
@@ -0,0 +1,189 @@
+// Package path provides bandwidth-weighted relay selection for Tor circuits.
+package path
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/opd-ai/go-tor/pkg/directory"
+)
+
+// position identifies the hop a relay is being selected for
+type position int
+
+const (
+	positionGuard position = iota
+	positionMiddle
+	positionExit
+)
+
+// String returns the position name
+func (p position) String() string {
+	switch p {
+	case positionGuard:
+		return "guard"
+	case positionMiddle:
+		return "middle"
+	case positionExit:
+		return "exit"
+	default:
+		return "unknown"
+	}
+}
+
+// bandwidthWeights holds the consensus weights used for position-weighted
+// selection per path-spec.txt section 2.2 and dir-spec.txt section 3.8.3
+type bandwidthWeights struct {
+	weights         map[string]int64
+	scale           int64
+	maxUnmeasuredBw int64
+}
+
+// newBandwidthWeights extracts the selection weights from a consensus
+func newBandwidthWeights(consensus *directory.Consensus) *bandwidthWeights {
+	weights := make(map[string]int64, len(consensus.BandwidthWeights))
+	for k, v := range consensus.BandwidthWeights {
+		weights[k] = v
+	}
+	return &bandwidthWeights{
+		weights:         weights,
+		scale:           consensus.WeightScale(),
+		maxUnmeasuredBw: consensus.MaxUnmeasuredBandwidth(),
+	}
+}
+
+// positionWeight returns the Wxy weight for a relay in the given position.
+// If the consensus carries no bandwidth-weights, every relay gets the full
+// scale so selection degrades to plain bandwidth weighting. Without a
+// consensus there is no scale, and every relay gets 1.
+func (bw *bandwidthWeights) positionWeight(relay *directory.Relay, pos position) int64 {
+	if bw == nil {
+		return 1
+	}
+	if len(bw.weights) == 0 {
+		return bw.scale
+	}
+
+	isGuard := relay.IsGuard()
+	// BadExit relays are not used as exits, so they are weighted as non-exits
+	isExit := relay.IsExit() && !relay.HasFlag("BadExit")
+
+	var key string
+	switch pos {
+	case positionGuard:
+		switch {
+		case isGuard && isExit:
+			key = "Wgd"
+		case isGuard:
+			key = "Wgg"
+		case isExit:
+			return 0 // Exit-only relays are never weighted into the guard position
+		default:
+			key = "Wgm"
+		}
+	case positionMiddle:
+		switch {
+		case isGuard && isExit:
+			key = "Wmd"
+		case isGuard:
+			key = "Wmg"
+		case isExit:
+			key = "Wme"
+		default:
+			key = "Wmm"
+		}
+	case positionExit:
+		switch {
+		case isGuard && isExit:
+			key = "Wed"
+		case isGuard:
+			key = "Weg"
+		case isExit:
+			key = "Wee"
+		default:
+			key = "Wem"
+		}
+	}
+
+	w, ok := bw.weights[key]
+	if !ok {
+		// Missing weights default to the full scale (dir-spec.txt section 3.8.3)
+		return bw.scale
+	}
+	return w
+}
+
+// relayWeight returns the selection weight of a relay in the given position:
+// its consensus bandwidth multiplied by the position weight
+func (bw *bandwidthWeights) relayWeight(relay *directory.Relay, pos position) int64 {
+	bandwidth := relay.Bandwidth
+	if bandwidth < 0 {
+		bandwidth = 0
+	}
+	if bw != nil && relay.Unmeasured && bandwidth > bw.maxUnmeasuredBw {
+		bandwidth = bw.maxUnmeasuredBw
+	}
+	return bandwidth * bw.positionWeight(relay, pos)
+}
+
+// weightedChoice selects a relay from candidates with probability
+// proportional to its position weight. If every candidate has zero weight
+// (for example, a consensus without "w" lines), it falls back to a uniform choice.
+func (s *Selector) weightedChoice(candidates []*directory.Relay, pos position) (*directory.Relay, error) {
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no candidates for %s position", pos)
+	}
+
+	weights := make([]int64, len(candidates))
+	var total int64
+	for i, relay := range candidates {
+		weights[i] = s.bwWeights.relayWeight(relay, pos)
+		total += weights[i]
+	}
+
+	if total <= 0 {
+		idx, err := s.randInt(int64(len(candidates)))
+		if err != nil {
+			return nil, err
+		}
+		return candidates[idx], nil
+	}
+
+	target, err := s.randInt(total)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, w := range weights {
+		if target < w {
+			return candidates[i], nil
+		}
+		target -= w
+	}
+
+	// Unreachable when weights sum to total, but be defensive
+	return candidates[len(candidates)-1], nil
+}
+
+// randInt returns a random integer in [0, max) using the selector's source
+func (s *Selector) randInt(max int64) (int64, error) {
+	if s.randSource != nil {
+		return s.randSource(max)
+	}
+	return cryptoRandInt(max)
+}
+
+// cryptoRandInt returns a cryptographically random integer in [0, max)
+func cryptoRandInt(max int64) (int64, error) {
+	if max <= 0 {
+		return 0, fmt.Errorf("max must be positive")
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random number: %w", err)
+	}
+
+	return n.Int64(), nil
+}
@@ -0,0 +1,291 @@
+package path
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/opd-ai/go-tor/pkg/directory"
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+// fixtureConsensus is a small consensus with "w" lines and bandwidth-weights
+const fixtureConsensus = `network-status-version 3
+vote-status consensus
+params maxunmeasuredbw=20
+r GuardA AAAAAAAAAAAAAAAAAAAAAA BBBBBBBBBBBBB 2024-01-01 00:00:00 10.1.0.1 9001 0
+s Fast Guard Running Stable Valid
+w Bandwidth=1000
+r GuardB AAAAAAAAAAAAAAAAAAAAAB BBBBBBBBBBBBB 2024-01-01 00:00:00 10.2.0.1 9001 0
+s Fast Guard Running Stable Valid
+w Bandwidth=3000
+r GuardExit AAAAAAAAAAAAAAAAAAAAAC BBBBBBBBBBBBB 2024-01-01 00:00:00 10.3.0.1 9001 0
+s Exit Fast Guard Running Stable Valid
+w Bandwidth=2000
+r MiddleA AAAAAAAAAAAAAAAAAAAAAD BBBBBBBBBBBBB 2024-01-01 00:00:00 10.4.0.1 9001 0
+s Fast Running Valid
+w Bandwidth=500
+r MiddleB AAAAAAAAAAAAAAAAAAAAAE BBBBBBBBBBBBB 2024-01-01 00:00:00 10.5.0.1 9001 0
+s Fast Running Valid
+w Bandwidth=1500
+r ExitA AAAAAAAAAAAAAAAAAAAAAF BBBBBBBBBBBBB 2024-01-01 00:00:00 10.6.0.1 9001 0
+s Exit Fast Running Valid
+w Bandwidth=4000
+r ExitB AAAAAAAAAAAAAAAAAAAAAG BBBBBBBBBBBBB 2024-01-01 00:00:00 10.7.0.1 9001 0
+s Exit Fast Running Valid
+w Bandwidth=1000
+r Unmeasured AAAAAAAAAAAAAAAAAAAAAH BBBBBBBBBBBBB 2024-01-01 00:00:00 10.8.0.1 9001 0
+s Fast Running Valid
+w Bandwidth=900 Unmeasured=1
+directory-footer
+bandwidth-weights Wgd=2000 Wgg=6000 Wgm=6000 Wmd=2000 Wme=3000 Wmg=4000 Wmm=10000 Wed=8000 Wee=10000 Weg=0 Wem=10000
+`
+
+// newFixtureSelector returns a selector loaded with fixtureConsensus and a
+// deterministic random source
+func newFixtureSelector(t *testing.T, seed int64) *Selector {
+	t.Helper()
+
+	log := logger.NewDefault()
+	dirClient := directory.NewClient(log)
+	consensus, err := dirClient.ParseConsensus(strings.NewReader(fixtureConsensus))
+	if err != nil {
+		t.Fatalf("ParseConsensus failed: %v", err)
+	}
+
+	selector := NewSelector(dirClient, log)
+	selector.SetConsensus(consensus)
+
+	rng := rand.New(rand.NewSource(seed))
+	selector.randSource = func(max int64) (int64, error) {
+		return rng.Int63n(max), nil
+	}
+	return selector
+}
+
+// relayByNickname finds a relay in the selector's consensus
+func relayByNickname(t *testing.T, s *Selector, nickname string) *directory.Relay {
+	t.Helper()
+	for _, relay := range s.relays {
+		if relay.Nickname == nickname {
+			return relay
+		}
+	}
+	t.Fatalf("relay %s not found", nickname)
+	return nil
+}
+
+// checkDistribution compares observed selection frequencies to expected probabilities
+func checkDistribution(t *testing.T, counts map[string]int, total int, expected map[string]float64) {
+	t.Helper()
+
+	const tolerance = 0.015
+	for nickname, want := range expected {
+		got := float64(counts[nickname]) / float64(total)
+		if math.Abs(got-want) > tolerance {
+			t.Errorf("%s selected with frequency %.3f, want %.3f (±%.3f)", nickname, got, want, tolerance)
+		}
+	}
+	for nickname := range counts {
+		if _, ok := expected[nickname]; !ok {
+			t.Errorf("unexpected relay selected: %s", nickname)
+		}
+	}
+}
+
+func TestPositionWeight(t *testing.T) {
+	bw := &bandwidthWeights{
+		weights: map[string]int64{
+			"Wgd": 1, "Wgg": 2, "Wgm": 3,
+			"Wmd": 4, "Wmg": 5, "Wme": 6, "Wmm": 7,
+			"Wed": 8, "Weg": 9, "Wee": 10, "Wem": 11,
+		},
+		scale: 10000,
+	}
+
+	guardExit := &directory.Relay{Flags: []string{"Guard", "Exit"}}
+	guardOnly := &directory.Relay{Flags: []string{"Guard"}}
+	exitOnly := &directory.Relay{Flags: []string{"Exit"}}
+	badExit := &directory.Relay{Flags: []string{"Exit", "BadExit"}}
+	plain := &directory.Relay{Flags: []string{"Fast"}}
+
+	tests := []struct {
+		name  string
+		relay *directory.Relay
+		pos   position
+		want  int64
+	}{
+		{"guard+exit in guard position", guardExit, positionGuard, 1},
+		{"guard in guard position", guardOnly, positionGuard, 2},
+		{"plain in guard position", plain, positionGuard, 3},
+		{"exit in guard position", exitOnly, positionGuard, 0},
+		{"guard+exit in middle position", guardExit, positionMiddle, 4},
+		{"guard in middle position", guardOnly, positionMiddle, 5},
+		{"exit in middle position", exitOnly, positionMiddle, 6},
+		{"plain in middle position", plain, positionMiddle, 7},
+		{"guard+exit in exit position", guardExit, positionExit, 8},
+		{"guard in exit position", guardOnly, positionExit, 9},
+		{"exit in exit position", exitOnly, positionExit, 10},
+		{"plain in exit position", plain, positionExit, 11},
+		{"bad exit weighted as plain", badExit, positionExit, 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bw.positionWeight(tt.relay, tt.pos); got != tt.want {
+				t.Errorf("positionWeight() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Missing weights default to the scale
+	sparse := &bandwidthWeights{weights: map[string]int64{"Wgg": 1}, scale: 10000}
+	if got := sparse.positionWeight(plain, positionMiddle); got != 10000 {
+		t.Errorf("missing weight = %d, want scale 10000", got)
+	}
+
+	// A consensus without bandwidth-weights gives every relay the scale
+	unweighted := &bandwidthWeights{weights: map[string]int64{}, scale: 10000}
+	for _, pos := range []position{positionGuard, positionMiddle, positionExit} {
+		if got := unweighted.positionWeight(plain, pos); got != 10000 {
+			t.Errorf("%s weight without bandwidth-weights = %d, want scale 10000", pos, got)
+		}
+	}
+
+	// No consensus at all: plain bandwidth weighting
+	var none *bandwidthWeights
+	if got := none.relayWeight(&directory.Relay{Bandwidth: 42}, positionGuard); got != 42 {
+		t.Errorf("relayWeight() without weights = %d, want 42", got)
+	}
+}
+
+func TestRelayWeightUnmeasuredCap(t *testing.T) {
+	bw := &bandwidthWeights{weights: map[string]int64{"Wmm": 10000}, scale: 10000, maxUnmeasuredBw: 20}
+
+	measured := &directory.Relay{Bandwidth: 900}
+	unmeasured := &directory.Relay{Bandwidth: 900, Unmeasured: true}
+
+	if got := bw.relayWeight(measured, positionMiddle); got != 900*10000 {
+		t.Errorf("measured relayWeight() = %d, want %d", got, 900*10000)
+	}
+	if got := bw.relayWeight(unmeasured, positionMiddle); got != 20*10000 {
+		t.Errorf("unmeasured relayWeight() = %d, want %d", got, 20*10000)
+	}
+}
+
+func TestWeightedGuardDistribution(t *testing.T) {
+	selector := newFixtureSelector(t, 1)
+
+	const iterations = 20000
+	counts := make(map[string]int)
+	for i := 0; i < iterations; i++ {
+		guard, err := selector.selectGuard()
+		if err != nil {
+			t.Fatalf("selectGuard failed: %v", err)
+		}
+		counts[guard.Nickname]++
+	}
+
+	// GuardA 1000*6000, GuardB 3000*6000, GuardExit 2000*2000 (Wgd)
+	checkDistribution(t, counts, iterations, map[string]float64{
+		"GuardA":    6.0 / 28.0,
+		"GuardB":    18.0 / 28.0,
+		"GuardExit": 4.0 / 28.0,
+	})
+}
+
+func TestWeightedExitDistribution(t *testing.T) {
+	selector := newFixtureSelector(t, 2)
+	guard := relayByNickname(t, selector, "GuardA")
+
+	const iterations = 20000
+	counts := make(map[string]int)
+	for i := 0; i < iterations; i++ {
+		exit, err := selector.selectExit(80, guard)
+		if err != nil {
+			t.Fatalf("selectExit failed: %v", err)
+		}
+		counts[exit.Nickname]++
+	}
+
+	// GuardExit 2000*8000 (Wed), ExitA 4000*10000, ExitB 1000*10000 (Wee)
+	checkDistribution(t, counts, iterations, map[string]float64{
+		"GuardExit": 16.0 / 66.0,
+		"ExitA":     40.0 / 66.0,
+		"ExitB":     10.0 / 66.0,
+	})
+}
+
+func TestWeightedMiddleDistribution(t *testing.T) {
+	selector := newFixtureSelector(t, 3)
+	guard := relayByNickname(t, selector, "GuardA")
+	exit := relayByNickname(t, selector, "ExitA")
+
+	const iterations = 20000
+	counts := make(map[string]int)
+	for i := 0; i < iterations; i++ {
+		middle, err := selector.selectMiddle(guard, exit)
+		if err != nil {
+			t.Fatalf("selectMiddle failed: %v", err)
+		}
+		counts[middle.Nickname]++
+	}
+
+	// Weights in units of 1e5: GuardB 120 (Wmg), GuardExit 40 (Wmd),
+	// MiddleA 50, MiddleB 150 (Wmm), ExitB 30 (Wme), Unmeasured 2 (capped at 20)
+	const total = 392.0
+	checkDistribution(t, counts, iterations, map[string]float64{
+		"GuardB":     120 / total,
+		"GuardExit":  40 / total,
+		"MiddleA":    50 / total,
+		"MiddleB":    150 / total,
+		"ExitB":      30 / total,
+		"Unmeasured": 2 / total,
+	})
+}
+
+func TestWeightedChoiceDeterministic(t *testing.T) {
+	first := newFixtureSelector(t, 42)
+	second := newFixtureSelector(t, 42)
+
+	for i := 0; i < 100; i++ {
+		a, err := first.SelectPath(80)
+		if err != nil {
+			t.Fatalf("SelectPath failed: %v", err)
+		}
+		b, err := second.SelectPath(80)
+		if err != nil {
+			t.Fatalf("SelectPath failed: %v", err)
+		}
+		// Relays are distinct pointers per selector, so compare by name
+		if a.Guard.Nickname != b.Guard.Nickname || a.Middle.Nickname != b.Middle.Nickname ||
+			a.Exit.Nickname != b.Exit.Nickname {
+			t.Fatalf("iteration %d: same seed produced different paths", i)
+		}
+	}
+}
+
+func TestWeightedChoiceZeroBandwidthFallsBackToUniform(t *testing.T) {
+	selector := newFixtureSelector(t, 4)
+	candidates := []*directory.Relay{
+		{Nickname: "A", Flags: []string{"Running", "Valid"}},
+		{Nickname: "B", Flags: []string{"Running", "Valid"}},
+	}
+
+	counts := make(map[string]int)
+	const iterations = 10000
+	for i := 0; i < iterations; i++ {
+		relay, err := selector.weightedChoice(candidates, positionMiddle)
+		if err != nil {
+			t.Fatalf("weightedChoice failed: %v", err)
+		}
+		counts[relay.Nickname]++
+	}
+
+	checkDistribution(t, counts, iterations, map[string]float64{"A": 0.5, "B": 0.5})
+
+	if _, err := selector.weightedChoice(nil, positionMiddle); err == nil {
+		t.Error("Expected error for empty candidate list")
+	}
+}
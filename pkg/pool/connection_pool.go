@@ -11,7 +11,9 @@ import (
 	"github.com/opd-ai/go-tor/pkg/logger"
 )
 
-// ConnectionPool manages a pool of reusable connections to Tor relays
+// ConnectionPool manages a pool of reusable connections to Tor relays.
+// Circuits are not built over pooled connections yet, so link padding is
+// left to the circuit builder, which owns each guard connection.
 type ConnectionPool struct {
 	mu          sync.RWMutex
 	connections map[string]*pooledConnection
@@ -0,0 +1,368 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1" // #nosec G505 - SHA-1 relay fingerprints are defined by tor-spec.txt
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CERTS cell certificate types (tor-spec.txt section 4.2)
+const (
+	CertTypeRSALink         byte = 1 // X.509 link key certificate, signed by the RSA identity key
+	CertTypeRSAIdentity     byte = 2 // Self-signed X.509 RSA1024 identity certificate
+	CertTypeRSAAuthenticate byte = 3 // X.509 AUTHENTICATE cell link certificate
+	CertTypeEd25519Signing  byte = 4 // Ed25519 signing key, signed with the identity key
+	CertTypeEd25519Link     byte = 5 // TLS link certificate, signed with the signing key
+	CertTypeEd25519Auth     byte = 6 // Ed25519 AUTHENTICATE cell key, signed with the signing key
+	CertTypeRSAEd25519Cross byte = 7 // Ed25519 identity, signed with the RSA identity key
+)
+
+const (
+	rsaIdentityKeyBits                   = 1024
+	ed25519CertVersion                   = 1
+	ed25519CertHeaderLen                 = 40 // VERSION through N_EXTENSIONS
+	ed25519ExtSignedWithKey         byte = 4  // Extension carrying the signing Ed25519 key
+	ed25519ExtFlagAffectsValidation byte = 1  // Extension flag: unknown extensions invalidate the cert
+	authChallengeLen                     = 32
+)
+
+// Certified key types in Ed25519 certificates (cert-spec.txt section 2.1)
+const (
+	certKeyTypeEd25519   byte = 1
+	certKeyTypeSHA256TLS byte = 3
+)
+
+// rsaEd25519CrossCertPrefix is prepended to the RSA->Ed25519 cross-certificate
+// before it is hashed and signed (cert-spec.txt section 2.3)
+const rsaEd25519CrossCertPrefix = "Tor TLS RSA/Ed25519 cross-certificate"
+
+// RelayIdentity is the identity a relay proved in its CERTS cell
+type RelayIdentity struct {
+	RSAIdentity     *rsa.PublicKey
+	Fingerprint     string            // Upper-case hex SHA-1 of the RSA identity key
+	Ed25519Identity ed25519.PublicKey // nil if the relay only proved an RSA identity
+}
+
+// CheckExpected verifies that the proven identity matches the fingerprint and
+// Ed25519 identity the relay is listed with in the consensus. Empty
+// expectations are not checked. A relay that is expected to hold an Ed25519
+// identity must have proven one.
+func (id *RelayIdentity) CheckExpected(fingerprint string, edIdentity []byte) error {
+	if fingerprint != "" {
+		want := strings.ToUpper(strings.TrimPrefix(fingerprint, "$"))
+		if id.Fingerprint != want {
+			return fmt.Errorf("relay identity mismatch: expected fingerprint %s, got %s", want, id.Fingerprint)
+		}
+	}
+	if len(edIdentity) > 0 {
+		if id.Ed25519Identity == nil {
+			return fmt.Errorf("relay identity mismatch: relay did not prove an Ed25519 identity")
+		}
+		if !bytes.Equal(id.Ed25519Identity, edIdentity) {
+			return fmt.Errorf("relay identity mismatch: Ed25519 identity differs from consensus")
+		}
+	}
+	return nil
+}
+
+// ParseCertsCell parses a CERTS cell payload into certificates by type.
+// A certificate type may appear at most once.
+func ParseCertsCell(payload []byte) (map[byte][]byte, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("empty CERTS cell")
+	}
+
+	count := int(payload[0])
+	rest := payload[1:]
+	certs := make(map[byte][]byte, count)
+	for i := 0; i < count; i++ {
+		if len(rest) < 3 {
+			return nil, fmt.Errorf("truncated CERTS cell entry %d", i)
+		}
+		certType := rest[0]
+		certLen := int(binary.BigEndian.Uint16(rest[1:3]))
+		if len(rest) < 3+certLen {
+			return nil, fmt.Errorf("truncated certificate of type %d", certType)
+		}
+		if _, dup := certs[certType]; dup {
+			return nil, fmt.Errorf("duplicate certificate of type %d", certType)
+		}
+		certs[certType] = rest[3 : 3+certLen]
+		rest = rest[3+certLen:]
+	}
+	return certs, nil
+}
+
+// Ed25519Cert is a Tor Ed25519 certificate (cert-spec.txt section 2.1)
+type Ed25519Cert struct {
+	CertType     byte
+	Expiration   time.Time
+	KeyType      byte
+	CertifiedKey []byte
+	SigningKey   ed25519.PublicKey // From the signed-with-ed25519-key extension, if present
+	Signature    []byte
+
+	signed []byte // Certificate body covered by the signature
+}
+
+// ParseEd25519Cert parses an Ed25519 certificate without checking its signature
+func ParseEd25519Cert(data []byte) (*Ed25519Cert, error) {
+	if len(data) < ed25519CertHeaderLen+ed25519.SignatureSize {
+		return nil, fmt.Errorf("Ed25519 certificate too short: %d bytes", len(data))
+	}
+	if data[0] != ed25519CertVersion {
+		return nil, fmt.Errorf("unsupported Ed25519 certificate version %d", data[0])
+	}
+
+	cert := &Ed25519Cert{
+		CertType:     data[1],
+		Expiration:   time.Unix(int64(binary.BigEndian.Uint32(data[2:6]))*3600, 0),
+		KeyType:      data[6],
+		CertifiedKey: append([]byte(nil), data[7:39]...),
+	}
+
+	extCount := int(data[39])
+	rest := data[ed25519CertHeaderLen:]
+	for i := 0; i < extCount; i++ {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("truncated Ed25519 certificate extension")
+		}
+		extLen := int(binary.BigEndian.Uint16(rest[0:2]))
+		extType, extFlags := rest[2], rest[3]
+		if len(rest) < 4+extLen {
+			return nil, fmt.Errorf("truncated Ed25519 certificate extension")
+		}
+		extData := rest[4 : 4+extLen]
+		switch {
+		case extType == ed25519ExtSignedWithKey:
+			if extLen != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid signed-with-ed25519-key extension length %d", extLen)
+			}
+			cert.SigningKey = ed25519.PublicKey(append([]byte(nil), extData...))
+		case extFlags&ed25519ExtFlagAffectsValidation != 0:
+			return nil, fmt.Errorf("unknown Ed25519 certificate extension %d affects validation", extType)
+		}
+		rest = rest[4+extLen:]
+	}
+
+	if len(rest) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid Ed25519 certificate signature length %d", len(rest))
+	}
+	cert.Signature = append([]byte(nil), rest...)
+	cert.signed = data[:len(data)-ed25519.SignatureSize]
+	return cert, nil
+}
+
+// Verify checks the certificate signature with key
+func (c *Ed25519Cert) Verify(key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid Ed25519 key length %d", len(key))
+	}
+	if !ed25519.Verify(key, c.signed, c.Signature) {
+		return fmt.Errorf("invalid Ed25519 certificate signature")
+	}
+	return nil
+}
+
+// IsExpired reports whether the certificate has expired at now
+func (c *Ed25519Cert) IsExpired(now time.Time) bool {
+	return now.After(c.Expiration)
+}
+
+// verifyRSAEd25519CrossCert checks that the RSA identity key certified the
+// Ed25519 identity key (cert-spec.txt section 2.3)
+func verifyRSAEd25519CrossCert(data []byte, rsaIdentity *rsa.PublicKey, edIdentity ed25519.PublicKey, now time.Time) error {
+	if len(data) < ed25519.PublicKeySize+5 {
+		return fmt.Errorf("RSA->Ed25519 cross-certificate too short")
+	}
+
+	signedLen := ed25519.PublicKeySize + 4
+	sigLen := int(data[signedLen])
+	if len(data) != signedLen+1+sigLen {
+		return fmt.Errorf("invalid RSA->Ed25519 cross-certificate length")
+	}
+
+	if !bytes.Equal(data[:ed25519.PublicKeySize], edIdentity) {
+		return fmt.Errorf("RSA->Ed25519 cross-certificate certifies a different Ed25519 identity")
+	}
+
+	expiration := time.Unix(int64(binary.BigEndian.Uint32(data[ed25519.PublicKeySize:signedLen]))*3600, 0)
+	if now.After(expiration) {
+		return fmt.Errorf("RSA->Ed25519 cross-certificate expired at %s", expiration.UTC().Format(time.RFC3339))
+	}
+
+	digest := sha256.Sum256(append([]byte(rsaEd25519CrossCertPrefix), data[:signedLen]...))
+	if err := rsa.VerifyPKCS1v15(rsaIdentity, crypto.Hash(0), digest[:], data[signedLen+1:]); err != nil {
+		return fmt.Errorf("invalid RSA->Ed25519 cross-certificate signature: %w", err)
+	}
+	return nil
+}
+
+// parseRSAIdentityCert parses and checks the self-signed RSA1024 identity certificate
+func parseRSAIdentityCert(data []byte, now time.Time) (*x509.Certificate, *rsa.PublicKey, error) {
+	cert, err := parseValidX509(data, now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid RSA identity certificate: %w", err)
+	}
+
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || key.N.BitLen() != rsaIdentityKeyBits {
+		return nil, nil, fmt.Errorf("RSA identity certificate does not hold a %d-bit RSA key", rsaIdentityKeyBits)
+	}
+
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return nil, nil, fmt.Errorf("RSA identity certificate is not self-signed: %w", err)
+	}
+	return cert, key, nil
+}
+
+// parseValidX509 parses an X.509 certificate and checks its validity period
+func parseValidX509(data []byte, now time.Time) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("certificate not valid at %s", now.UTC().Format(time.RFC3339))
+	}
+	return cert, nil
+}
+
+// VerifyCerts authenticates a responder from its CERTS cell (tor-spec.txt
+// section 4.2). tlsCert is the DER certificate the relay presented in the TLS
+// handshake. When the cell carries Ed25519 certificates, the full
+// RSA->Ed25519 chain is verified; otherwise the legacy RSA link certificate
+// must bind the TLS key to the RSA identity.
+func VerifyCerts(certs map[byte][]byte, tlsCert []byte, now time.Time) (*RelayIdentity, error) {
+	idCertDER, ok := certs[CertTypeRSAIdentity]
+	if !ok {
+		return nil, fmt.Errorf("CERTS cell has no RSA identity certificate")
+	}
+	idCert, rsaIdentity, err := parseRSAIdentityCert(idCertDER, now)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &RelayIdentity{
+		RSAIdentity: rsaIdentity,
+		Fingerprint: rsaFingerprint(rsaIdentity),
+	}
+
+	_, hasSigning := certs[CertTypeEd25519Signing]
+	_, hasLink := certs[CertTypeEd25519Link]
+	_, hasCross := certs[CertTypeRSAEd25519Cross]
+	if !hasSigning && !hasLink && !hasCross {
+		if err := verifyRSALinkCert(certs[CertTypeRSALink], idCert, tlsCert, now); err != nil {
+			return nil, err
+		}
+		return identity, nil
+	}
+	if !hasSigning || !hasLink || !hasCross {
+		return nil, fmt.Errorf("CERTS cell has an incomplete Ed25519 certificate chain")
+	}
+
+	edIdentity, err := verifyEd25519Chain(certs, tlsCert, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyRSAEd25519CrossCert(certs[CertTypeRSAEd25519Cross], rsaIdentity, edIdentity, now); err != nil {
+		return nil, err
+	}
+
+	identity.Ed25519Identity = edIdentity
+	return identity, nil
+}
+
+// verifyEd25519Chain verifies the identity->signing->TLS link certificates
+// and returns the Ed25519 identity key
+func verifyEd25519Chain(certs map[byte][]byte, tlsCert []byte, now time.Time) (ed25519.PublicKey, error) {
+	signingCert, err := ParseEd25519Cert(certs[CertTypeEd25519Signing])
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 signing certificate: %w", err)
+	}
+	if signingCert.CertType != CertTypeEd25519Signing || signingCert.KeyType != certKeyTypeEd25519 {
+		return nil, fmt.Errorf("invalid Ed25519 signing certificate type")
+	}
+	if signingCert.SigningKey == nil {
+		return nil, fmt.Errorf("Ed25519 signing certificate does not include the identity key")
+	}
+	if signingCert.IsExpired(now) {
+		return nil, fmt.Errorf("Ed25519 signing certificate expired")
+	}
+	if err := signingCert.Verify(signingCert.SigningKey); err != nil {
+		return nil, fmt.Errorf("Ed25519 signing certificate: %w", err)
+	}
+
+	linkCert, err := ParseEd25519Cert(certs[CertTypeEd25519Link])
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 link certificate: %w", err)
+	}
+	if linkCert.CertType != CertTypeEd25519Link || linkCert.KeyType != certKeyTypeSHA256TLS {
+		return nil, fmt.Errorf("invalid Ed25519 link certificate type")
+	}
+	if linkCert.IsExpired(now) {
+		return nil, fmt.Errorf("Ed25519 link certificate expired")
+	}
+	if err := linkCert.Verify(ed25519.PublicKey(signingCert.CertifiedKey)); err != nil {
+		return nil, fmt.Errorf("Ed25519 link certificate: %w", err)
+	}
+
+	tlsDigest := sha256.Sum256(tlsCert)
+	if !bytes.Equal(linkCert.CertifiedKey, tlsDigest[:]) {
+		return nil, fmt.Errorf("Ed25519 link certificate does not match the TLS certificate")
+	}
+
+	return signingCert.SigningKey, nil
+}
+
+// verifyRSALinkCert checks the legacy RSA link certificate: it must be signed
+// by the identity key and certify the key of the TLS certificate
+func verifyRSALinkCert(linkCertDER []byte, idCert *x509.Certificate, tlsCert []byte, now time.Time) error {
+	if linkCertDER == nil {
+		return fmt.Errorf("CERTS cell has no link certificate")
+	}
+	linkCert, err := parseValidX509(linkCertDER, now)
+	if err != nil {
+		return fmt.Errorf("invalid RSA link certificate: %w", err)
+	}
+	if err := idCert.CheckSignature(linkCert.SignatureAlgorithm, linkCert.RawTBSCertificate, linkCert.Signature); err != nil {
+		return fmt.Errorf("RSA link certificate not signed by the identity key: %w", err)
+	}
+
+	tls, err := x509.ParseCertificate(tlsCert)
+	if err != nil {
+		return fmt.Errorf("invalid TLS certificate: %w", err)
+	}
+	if !bytes.Equal(linkCert.RawSubjectPublicKeyInfo, tls.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("RSA link certificate does not match the TLS key")
+	}
+	return nil
+}
+
+// rsaFingerprint returns the relay fingerprint of an RSA identity key
+func rsaFingerprint(key *rsa.PublicKey) string {
+	digest := sha1.Sum(x509.MarshalPKCS1PublicKey(key)) // #nosec G401
+	return strings.ToUpper(hex.EncodeToString(digest[:]))
+}
+
+// verifyAuthChallenge checks the format of an AUTH_CHALLENGE cell. A client
+// does not authenticate, so the challenge itself is not used.
+func verifyAuthChallenge(payload []byte) error {
+	if len(payload) < authChallengeLen+2 {
+		return fmt.Errorf("AUTH_CHALLENGE too short: %d bytes", len(payload))
+	}
+	methods := int(binary.BigEndian.Uint16(payload[authChallengeLen:]))
+	if len(payload) < authChallengeLen+2+2*methods {
+		return fmt.Errorf("AUTH_CHALLENGE truncated: %d methods in %d bytes", methods, len(payload))
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package protocol
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRelayCerts holds a generated relay key hierarchy for CERTS tests
+type testRelayCerts struct {
+	rsaKey     *rsa.PrivateKey
+	edIdentity ed25519.PrivateKey
+	edSigning  ed25519.PrivateKey
+	idCert     []byte
+	linkCert   []byte
+	tlsCert    []byte
+	now        time.Time
+}
+
+func newTestRelayCerts(t *testing.T) *testRelayCerts {
+	t.Helper()
+
+	now := time.Now()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, rsaIdentityKeyBits)
+	if err != nil {
+		t.Fatalf("failed to generate RSA identity key: %v", err)
+	}
+	tlsKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate TLS key: %v", err)
+	}
+	_, edIdentity, _ := ed25519.GenerateKey(rand.Reader)
+	_, edSigning, _ := ed25519.GenerateKey(rand.Reader)
+
+	idTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.identity.net"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+	}
+	idCert, err := x509.CreateCertificate(rand.Reader, idTemplate, idTemplate, &rsaKey.PublicKey, rsaKey)
+	if err != nil {
+		t.Fatalf("failed to create identity certificate: %v", err)
+	}
+
+	linkTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "www.link.net"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+	}
+	linkCert, err := x509.CreateCertificate(rand.Reader, linkTemplate, idTemplate, &tlsKey.PublicKey, rsaKey)
+	if err != nil {
+		t.Fatalf("failed to create link certificate: %v", err)
+	}
+	tlsCert, err := x509.CreateCertificate(rand.Reader, linkTemplate, linkTemplate, &tlsKey.PublicKey, tlsKey)
+	if err != nil {
+		t.Fatalf("failed to create TLS certificate: %v", err)
+	}
+
+	return &testRelayCerts{
+		rsaKey:     rsaKey,
+		edIdentity: edIdentity,
+		edSigning:  edSigning,
+		idCert:     idCert,
+		linkCert:   linkCert,
+		tlsCert:    tlsCert,
+		now:        now,
+	}
+}
+
+// makeEd25519Cert builds a signed Ed25519 certificate (cert-spec.txt section 2.1)
+func makeEd25519Cert(certType, keyType byte, certified []byte, signer ed25519.PrivateKey, includeSigner bool, expires time.Time) []byte {
+	body := []byte{ed25519CertVersion, certType}
+	body = binary.BigEndian.AppendUint32(body, uint32(expires.Unix()/3600))
+	body = append(body, keyType)
+	body = append(body, certified...)
+	if includeSigner {
+		body = append(body, 1, 0, ed25519.PublicKeySize, ed25519ExtSignedWithKey, 0)
+		body = append(body, signer.Public().(ed25519.PublicKey)...)
+	} else {
+		body = append(body, 0)
+	}
+	return append(body, ed25519.Sign(signer, body)...)
+}
+
+// makeCrossCert builds an RSA->Ed25519 cross-certificate
+func makeCrossCert(t *testing.T, rsaKey *rsa.PrivateKey, edIdentity ed25519.PublicKey, expires time.Time) []byte {
+	t.Helper()
+	body := append([]byte(nil), edIdentity...)
+	body = binary.BigEndian.AppendUint32(body, uint32(expires.Unix()/3600))
+	digest := sha256.Sum256(append([]byte(rsaEd25519CrossCertPrefix), body...))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.Hash(0), digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign cross-certificate: %v", err)
+	}
+	body = append(body, byte(len(sig)))
+	return append(body, sig...)
+}
+
+func (rc *testRelayCerts) ed25519Certs(t *testing.T) map[byte][]byte {
+	expires := rc.now.Add(48 * time.Hour)
+	tlsDigest := sha256.Sum256(rc.tlsCert)
+	return map[byte][]byte{
+		CertTypeRSAIdentity: rc.idCert,
+		CertTypeEd25519Signing: makeEd25519Cert(CertTypeEd25519Signing, certKeyTypeEd25519,
+			rc.edSigning.Public().(ed25519.PublicKey), rc.edIdentity, true, expires),
+		CertTypeEd25519Link: makeEd25519Cert(CertTypeEd25519Link, certKeyTypeSHA256TLS,
+			tlsDigest[:], rc.edSigning, false, expires),
+		CertTypeRSAEd25519Cross: makeCrossCert(t, rc.rsaKey, rc.edIdentity.Public().(ed25519.PublicKey), expires),
+	}
+}
+
+func encodeCertsCell(certs map[byte][]byte) []byte {
+	payload := []byte{byte(len(certs))}
+	for certType := byte(1); certType <= CertTypeRSAEd25519Cross; certType++ {
+		data, ok := certs[certType]
+		if !ok {
+			continue
+		}
+		payload = append(payload, certType)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(data)))
+		payload = append(payload, data...)
+	}
+	return payload
+}
+
+func TestParseCertsCell(t *testing.T) {
+	certs := map[byte][]byte{
+		CertTypeRSAIdentity: {1, 2, 3},
+		CertTypeRSALink:     {4, 5},
+	}
+	parsed, err := ParseCertsCell(encodeCertsCell(certs))
+	if err != nil {
+		t.Fatalf("ParseCertsCell() error = %v", err)
+	}
+	if len(parsed) != 2 || string(parsed[CertTypeRSALink]) != string([]byte{4, 5}) {
+		t.Errorf("ParseCertsCell() = %v, want %v", parsed, certs)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"truncated_header", []byte{1, CertTypeRSALink, 0}},
+		{"truncated_body", []byte{1, CertTypeRSALink, 0, 4, 1, 2}},
+		{"duplicate", []byte{2, CertTypeRSALink, 0, 1, 9, CertTypeRSALink, 0, 1, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCertsCell(tt.payload); err == nil {
+				t.Error("ParseCertsCell() expected error")
+			}
+		})
+	}
+}
+
+func TestVerifyCertsEd25519Chain(t *testing.T) {
+	rc := newTestRelayCerts(t)
+
+	certs, err := ParseCertsCell(encodeCertsCell(rc.ed25519Certs(t)))
+	if err != nil {
+		t.Fatalf("ParseCertsCell() error = %v", err)
+	}
+	identity, err := VerifyCerts(certs, rc.tlsCert, rc.now)
+	if err != nil {
+		t.Fatalf("VerifyCerts() error = %v", err)
+	}
+
+	wantFP := rsaFingerprint(&rc.rsaKey.PublicKey)
+	wantEd := rc.edIdentity.Public().(ed25519.PublicKey)
+	if identity.Fingerprint != wantFP {
+		t.Errorf("Fingerprint = %s, want %s", identity.Fingerprint, wantFP)
+	}
+	if !wantEd.Equal(identity.Ed25519Identity) {
+		t.Error("Ed25519Identity does not match the certified identity key")
+	}
+
+	if err := identity.CheckExpected("$"+strings.ToLower(wantFP), wantEd); err != nil {
+		t.Errorf("CheckExpected() error = %v", err)
+	}
+	if err := identity.CheckExpected(strings.Repeat("A", 40), nil); err == nil {
+		t.Error("CheckExpected() accepted a different fingerprint")
+	}
+	otherEd, _, _ := ed25519.GenerateKey(rand.Reader)
+	if err := identity.CheckExpected(wantFP, otherEd); err == nil {
+		t.Error("CheckExpected() accepted a different Ed25519 identity")
+	}
+}
+
+func TestVerifyCertsRSAOnly(t *testing.T) {
+	rc := newTestRelayCerts(t)
+
+	certs := map[byte][]byte{
+		CertTypeRSAIdentity: rc.idCert,
+		CertTypeRSALink:     rc.linkCert,
+	}
+	identity, err := VerifyCerts(certs, rc.tlsCert, rc.now)
+	if err != nil {
+		t.Fatalf("VerifyCerts() error = %v", err)
+	}
+	if identity.Ed25519Identity != nil {
+		t.Error("Ed25519Identity set for an RSA-only CERTS cell")
+	}
+	if err := identity.CheckExpected("", rc.edIdentity.Public().(ed25519.PublicKey)); err == nil {
+		t.Error("CheckExpected() accepted a relay that did not prove its Ed25519 identity")
+	}
+}
+
+func TestVerifyCertsRejectsInvalidChains(t *testing.T) {
+	rc := newTestRelayCerts(t)
+	expires := rc.now.Add(48 * time.Hour)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name   string
+		modify func(map[byte][]byte)
+	}{
+		{"missing_identity", func(c map[byte][]byte) { delete(c, CertTypeRSAIdentity) }},
+		{"incomplete_chain", func(c map[byte][]byte) { delete(c, CertTypeRSAEd25519Cross) }},
+		{"link_signed_by_wrong_key", func(c map[byte][]byte) {
+			tlsDigest := sha256.Sum256(rc.tlsCert)
+			c[CertTypeEd25519Link] = makeEd25519Cert(CertTypeEd25519Link, certKeyTypeSHA256TLS,
+				tlsDigest[:], otherKey, false, expires)
+		}},
+		{"link_for_other_tls_cert", func(c map[byte][]byte) {
+			c[CertTypeEd25519Link] = makeEd25519Cert(CertTypeEd25519Link, certKeyTypeSHA256TLS,
+				make([]byte, 32), rc.edSigning, false, expires)
+		}},
+		{"expired_signing_cert", func(c map[byte][]byte) {
+			c[CertTypeEd25519Signing] = makeEd25519Cert(CertTypeEd25519Signing, certKeyTypeEd25519,
+				rc.edSigning.Public().(ed25519.PublicKey), rc.edIdentity, true, rc.now.Add(-2*time.Hour))
+		}},
+		{"cross_cert_for_other_identity", func(c map[byte][]byte) {
+			c[CertTypeRSAEd25519Cross] = makeCrossCert(t, rc.rsaKey, otherKey.Public().(ed25519.PublicKey), expires)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certs := rc.ed25519Certs(t)
+			tt.modify(certs)
+			if _, err := VerifyCerts(certs, rc.tlsCert, rc.now); err == nil {
+				t.Error("VerifyCerts() expected error")
+			}
+		})
+	}
+}
+
+func TestVerifyAuthChallenge(t *testing.T) {
+	valid := make([]byte, authChallengeLen+4)
+	binary.BigEndian.PutUint16(valid[authChallengeLen:], 1)
+	if err := verifyAuthChallenge(valid); err != nil {
+		t.Errorf("verifyAuthChallenge() error = %v", err)
+	}
+	if err := verifyAuthChallenge(valid[:authChallengeLen]); err == nil {
+		t.Error("verifyAuthChallenge() accepted a short payload")
+	}
+	if err := verifyAuthChallenge(valid[:authChallengeLen+3]); err == nil {
+		t.Error("verifyAuthChallenge() accepted a truncated method list")
+	}
+}
@@ -33,6 +33,7 @@ type Handshake struct {
 	negotiatedVersion int
 	logger            *logger.Logger
 	timeout           time.Duration // Configurable handshake timeout (SEC-009)
+	peerIdentity      *RelayIdentity
 }
 
 // NewHandshake creates a new handshake instance
@@ -77,6 +78,16 @@ func (h *Handshake) PerformHandshake(ctx context.Context) error {
 		return fmt.Errorf("failed to receive VERSIONS: %w", err)
 	}
 
+	// Receive and verify CERTS (tor-spec.txt section 4.2)
+	if err := h.receiveCerts(ctx); err != nil {
+		return fmt.Errorf("failed to verify CERTS: %w", err)
+	}
+
+	// Receive AUTH_CHALLENGE; clients do not authenticate, so it is only checked
+	if err := h.receiveAuthChallenge(ctx); err != nil {
+		return fmt.Errorf("failed to receive AUTH_CHALLENGE: %w", err)
+	}
+
 	// Send NETINFO cell
 	if err := h.sendNetinfo(); err != nil {
 		return fmt.Errorf("failed to send NETINFO: %w", err)
@@ -87,7 +98,9 @@ func (h *Handshake) PerformHandshake(ctx context.Context) error {
 		return fmt.Errorf("failed to receive NETINFO: %w", err)
 	}
 
-	h.logger.Info("Protocol handshake complete", "version", h.negotiatedVersion)
+	h.logger.Info("Protocol handshake complete",
+		"version", h.negotiatedVersion,
+		"fingerprint", h.peerIdentity.Fingerprint)
 	return nil
 }
 
@@ -179,6 +192,88 @@ func (h *Handshake) selectVersion(remoteVersions []int) int {
 	return 0
 }
 
+// receiveCerts receives the responder's CERTS cell, verifies the certificate
+// chain against the TLS certificate, and binds the connection to the identity
+// expected from the consensus. A mismatch is a hard failure.
+func (h *Handshake) receiveCerts(ctx context.Context) error {
+	certsCell, err := h.receiveCell(ctx, cell.CmdCerts)
+	if err != nil {
+		return err
+	}
+
+	certs, err := ParseCertsCell(certsCell.Payload)
+	if err != nil {
+		return err
+	}
+
+	tlsCert := h.conn.PeerCertificate()
+	if tlsCert == nil {
+		return fmt.Errorf("no TLS certificate to bind CERTS to")
+	}
+
+	identity, err := VerifyCerts(certs, tlsCert, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := identity.CheckExpected(h.conn.ExpectedFingerprint(), h.conn.ExpectedIdentity()); err != nil {
+		return err
+	}
+
+	h.peerIdentity = identity
+	h.logger.Debug("Verified CERTS cell",
+		"fingerprint", identity.Fingerprint,
+		"has_ed25519", identity.Ed25519Identity != nil)
+	return nil
+}
+
+// receiveAuthChallenge receives and checks the responder's AUTH_CHALLENGE cell
+func (h *Handshake) receiveAuthChallenge(ctx context.Context) error {
+	challengeCell, err := h.receiveCell(ctx, cell.CmdAuthChallenge)
+	if err != nil {
+		return err
+	}
+	return verifyAuthChallenge(challengeCell.Payload)
+}
+
+// receiveCell receives the next handshake cell, skipping VPADDING, and checks
+// that it carries the expected command
+func (h *Handshake) receiveCell(ctx context.Context, expected cell.Command) (*cell.Cell, error) {
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+
+	cellCh := make(chan *cell.Cell, 1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		for {
+			receivedCell, err := h.conn.ReceiveCell()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if receivedCell.Command == cell.CmdVPadding {
+				continue
+			}
+			cellCh <- receivedCell
+			return
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, fmt.Errorf("timeout waiting for %s", expected)
+	case err := <-errCh:
+		return nil, err
+	case receivedCell := <-cellCh:
+		if receivedCell.Command != expected {
+			return nil, fmt.Errorf("expected %s cell, got %s", expected, receivedCell.Command)
+		}
+		return receivedCell, nil
+	}
+}
+
 // sendNetinfo sends a NETINFO cell
 func (h *Handshake) sendNetinfo() error {
 	// Simplified NETINFO cell for now
@@ -251,6 +346,12 @@ func (h *Handshake) receiveNetinfo(ctx context.Context) error {
 	}
 }
 
+// PeerIdentity returns the identity the relay proved in its CERTS cell, or
+// nil if the handshake has not completed
+func (h *Handshake) PeerIdentity() *RelayIdentity {
+	return h.peerIdentity
+}
+
 // NegotiatedVersion returns the negotiated protocol version
 func (h *Handshake) NegotiatedVersion() int {
 	return h.negotiatedVersion
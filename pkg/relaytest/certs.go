@@ -0,0 +1,105 @@
+package relaytest
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/protocol"
+)
+
+// Ed25519 certificate encoding constants (cert-spec.txt section 2.1)
+const (
+	ed25519CertVersion      = 1
+	certKeyTypeEd25519      = 1
+	certKeyTypeSHA256TLS    = 3
+	ed25519ExtSignedWithKey = 4
+	certLifetime            = 48 * time.Hour
+)
+
+// buildCertsCell builds a CERTS cell payload carrying the RSA identity
+// certificate and the full Ed25519 chain bound to the TLS certificate
+func (r *Relay) buildCertsCell(tlsCert []byte) ([]byte, error) {
+	now := time.Now()
+
+	idTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www." + r.nickname + ".net"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certLifetime),
+	}
+	idCert, err := x509.CreateCertificate(rand.Reader, idTemplate, idTemplate, &r.rsaKey.PublicKey, r.rsaKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity certificate: %w", err)
+	}
+
+	signingPub, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate Ed25519 signing key: %w", err)
+	}
+
+	expires := now.Add(certLifetime)
+	tlsDigest := sha256.Sum256(tlsCert)
+	crossCert, err := r.crossCert(expires)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []struct {
+		certType byte
+		data     []byte
+	}{
+		{protocol.CertTypeRSAIdentity, idCert},
+		{protocol.CertTypeEd25519Signing, ed25519Cert(protocol.CertTypeEd25519Signing, certKeyTypeEd25519, signingPub, r.edIdentity, true, expires)},
+		{protocol.CertTypeEd25519Link, ed25519Cert(protocol.CertTypeEd25519Link, certKeyTypeSHA256TLS, tlsDigest[:], signingKey, false, expires)},
+		{protocol.CertTypeRSAEd25519Cross, crossCert},
+	}
+
+	payload := []byte{byte(len(certs))}
+	for _, c := range certs {
+		payload = append(payload, c.certType)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(c.data)))
+		payload = append(payload, c.data...)
+	}
+	return payload, nil
+}
+
+// ed25519Cert encodes and signs an Ed25519 certificate. When includeSigner is
+// set the signing key is carried in a signed-with-ed25519-key extension.
+func ed25519Cert(certType, keyType byte, certified []byte, signer ed25519.PrivateKey, includeSigner bool, expires time.Time) []byte {
+	body := []byte{ed25519CertVersion, certType}
+	body = binary.BigEndian.AppendUint32(body, uint32(expires.Unix()/3600))
+	body = append(body, keyType)
+	body = append(body, certified...)
+	if includeSigner {
+		body = append(body, 1) // N_EXTENSIONS
+		body = binary.BigEndian.AppendUint16(body, ed25519.PublicKeySize)
+		body = append(body, ed25519ExtSignedWithKey, 0)
+		body = append(body, signer.Public().(ed25519.PublicKey)...)
+	} else {
+		body = append(body, 0)
+	}
+	return append(body, ed25519.Sign(signer, body)...)
+}
+
+// crossCert builds the RSA->Ed25519 cross-certificate (cert-spec.txt section 2.3)
+func (r *Relay) crossCert(expires time.Time) ([]byte, error) {
+	body := append([]byte(nil), r.edIdentity.Public().(ed25519.PublicKey)...)
+	body = binary.BigEndian.AppendUint32(body, uint32(expires.Unix()/3600))
+
+	digest := sha256.Sum256(append([]byte("Tor TLS RSA/Ed25519 cross-certificate"), body...))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, r.rsaKey, crypto.Hash(0), digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign cross-certificate: %w", err)
+	}
+	body = append(body, byte(len(sig)))
+	return append(body, sig...), nil
+}
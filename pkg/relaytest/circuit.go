@@ -0,0 +1,547 @@
+package relaytest
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/sha1" // #nosec G505 - SHA-1 relay digests required by tor-spec.txt §6.1
+	"crypto/subtle"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/connection"
+	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/protocol"
+)
+
+const (
+	handshakeTypeNTor     = 0x0002
+	handshakeTypeNTorV3   = 0x0003
+	keyMaterialLen        = 72 + crypto.CircuitNonceLen // Circuit keys and KH
+	destroyReasonProtocol = 1
+	destroyReasonConnect  = 6 // CONNECTFAILED
+	extendTimeout         = 10 * time.Second
+)
+
+// Circuit padding negotiation (padding-spec.txt §3.3)
+const (
+	paddingNegotiateVersion = 0
+	paddingCommandStop      = 1
+	paddingCommandStart     = 2
+	paddingResponseOK       = 1
+	paddingResponseErr      = 2
+	paddingMachineMax       = 1 // Intro and rendezvous circuit setup machines
+)
+
+// relayCircuit is the relay's half of one circuit hop. Cells arriving from
+// the client side have this hop's forward layer removed and are either
+// handled here (if recognized) or passed on to the next hop; cells from the
+// next hop have this hop's backward layer added and are passed back.
+type relayCircuit struct {
+	relay *Relay
+	prev  *link
+	id    uint32
+
+	forwardCipher cipher.Stream
+	forwardDigest hash.Hash
+
+	backMu         sync.Mutex // Guards the backward cipher and digest
+	backwardCipher cipher.Stream
+	backwardDigest hash.Hash
+
+	nonce []byte // KH, which ESTABLISH_INTRO authenticates
+
+	flowMu sync.Mutex // Guards flow, the exit's windows and echo queues
+	flow   *exitFlow
+
+	mu        sync.Mutex
+	next      *connection.Connection
+	nextID    uint32
+	joined    *relayCircuit // Circuit spliced to this one at a rendezvous point
+	created2  chan *cell.Cell
+	extending bool
+	closed    bool
+}
+
+// acceptCreate2 performs the server side of an ntor CREATE2 handshake and
+// returns the new circuit and the CREATED2 payload
+func (r *Relay) acceptCreate2(l *link, create2 *cell.Cell) (*relayCircuit, []byte, error) {
+	payload := create2.Payload
+	if len(payload) < 4 {
+		return nil, nil, fmt.Errorf("CREATE2 payload too short")
+	}
+	htype := binary.BigEndian.Uint16(payload[0:2])
+	hlen := int(binary.BigEndian.Uint16(payload[2:4]))
+	if len(payload) < 4+hlen {
+		return nil, nil, fmt.Errorf("CREATE2 handshake data truncated")
+	}
+	hdata := payload[4 : 4+hlen]
+	identity := r.edIdentity.Public().(ed25519.PublicKey)
+
+	var response, keyMaterial []byte
+	var err error
+	congestionControl := false
+	switch htype {
+	case handshakeTypeNTor:
+		// ntor identifies the relay by its RSA identity digest
+		rsaID, _ := hex.DecodeString(r.fingerprint)
+		response, keyMaterial, err = crypto.NtorServerHandshakeKeys(hdata, rsaID, r.ntorKey.Private[:], keyMaterialLen)
+	case handshakeTypeNTorV3:
+		// The only extension supported is the congestion control request,
+		// answered with our SENDME increment (prop324 §4)
+		response, keyMaterial, err = crypto.NtorV3ServerHandshake(hdata, identity, r.ntorKey.Private[:], nil,
+			keyMaterialLen, func(clientMessage []byte) []byte {
+				if !requestsCongestionControl(clientMessage) {
+					return []byte{0}
+				}
+				congestionControl = true
+				return []byte{1, ccExtensionType, 1, ccSendmeInc}
+			})
+	default:
+		err = fmt.Errorf("unsupported handshake type %d", htype)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	circ, err := newRelayCircuit(r, l, create2.CircID, keyMaterial)
+	if err != nil {
+		return nil, nil, err
+	}
+	if congestionControl {
+		circ.flow.enableCongestionControl()
+	}
+
+	r.mu.Lock()
+	r.circuits++
+	r.handshakes[htype]++
+	if congestionControl {
+		r.ccCircuits++
+	}
+	r.mu.Unlock()
+
+	reply := binary.BigEndian.AppendUint16(nil, uint16(len(response)))
+	return circ, append(reply, response...), nil
+}
+
+// requestsCongestionControl reports whether an ntor v3 client message
+// carries the congestion control request extension
+func requestsCongestionControl(message []byte) bool {
+	if len(message) == 0 {
+		return false
+	}
+	rest := message[1:]
+	for i := 0; i < int(message[0]) && len(rest) >= 2; i++ {
+		if rest[0] == ccExtensionType {
+			return true
+		}
+		if len(rest) < 2+int(rest[1]) {
+			return false
+		}
+		rest = rest[2+int(rest[1]):]
+	}
+	return false
+}
+
+// acceptCreateFast performs the relay side of CREATE_FAST and returns the new
+// circuit and the CREATED_FAST payload Y | KH (tor-spec.txt §5.1.3)
+func (r *Relay) acceptCreateFast(l *link, createFast *cell.Cell) (*relayCircuit, []byte, error) {
+	if len(createFast.Payload) < crypto.CreateFastKeyLen {
+		return nil, nil, fmt.Errorf("CREATE_FAST payload too short")
+	}
+	y, err := crypto.GenerateRandomBytes(crypto.CreateFastKeyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	kh, keyMaterial, err := crypto.CreateFastDeriveKeys(createFast.Payload[:crypto.CreateFastKeyLen], y)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	circ, err := newRelayCircuit(r, l, createFast.CircID, append(keyMaterial, kh...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.mu.Lock()
+	r.circuits++
+	r.fastCircuits++
+	r.mu.Unlock()
+
+	return circ, append(y, kh...), nil
+}
+
+// newRelayCircuit sets up hop crypto from the handshake's key material
+// (tor-spec.txt §5.2: Df | Db | Kf | Kb | KH)
+func newRelayCircuit(r *Relay, l *link, id uint32, keyMaterial []byte) (*relayCircuit, error) {
+	forwardCipher, err := newCTR(keyMaterial[40:56])
+	if err != nil {
+		return nil, err
+	}
+	backwardCipher, err := newCTR(keyMaterial[56:72])
+	if err != nil {
+		return nil, err
+	}
+
+	forwardDigest := sha1.New() // #nosec G401
+	forwardDigest.Write(keyMaterial[0:20])
+	backwardDigest := sha1.New() // #nosec G401
+	backwardDigest.Write(keyMaterial[20:40])
+
+	return &relayCircuit{
+		relay:          r,
+		prev:           l,
+		id:             id,
+		forwardCipher:  forwardCipher,
+		forwardDigest:  forwardDigest,
+		backwardCipher: backwardCipher,
+		backwardDigest: backwardDigest,
+		nonce:          append([]byte(nil), keyMaterial[72:keyMaterialLen]...),
+		flow:           newExitFlow(),
+	}, nil
+}
+
+// handleForward processes a RELAY or RELAY_EARLY cell from the client side
+func (rc *relayCircuit) handleForward(c *cell.Cell) {
+	payload := append([]byte(nil), c.Payload...)
+	rc.forwardCipher.XORKeyStream(payload, payload)
+
+	if rc.recognize(payload) {
+		relayCell, err := cell.DecodeRelayCell(payload)
+		if err != nil {
+			return
+		}
+		rc.handleRelayCell(c.Command, relayCell)
+		return
+	}
+
+	rc.mu.Lock()
+	next, nextID, joined := rc.next, rc.nextID, rc.joined
+	rc.mu.Unlock()
+	if joined != nil {
+		// End-to-end onion service cell: pass it on to the other circuit
+		_ = joined.relayBackward(payload)
+		return
+	}
+	if next == nil {
+		rc.relay.logger.Debug("Dropping unrecognized relay cell at last hop", "circuit_id", rc.id)
+		return
+	}
+	_ = next.SendCell(&cell.Cell{CircID: nextID, Command: c.Command, Payload: payload})
+}
+
+// recognize checks whether a decrypted forward cell is addressed to this hop
+// and, if so, advances the forward running digest
+func (rc *relayCircuit) recognize(payload []byte) bool {
+	if binary.BigEndian.Uint16(payload[1:3]) != 0 {
+		return false
+	}
+
+	state, err := rc.forwardDigest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return false
+	}
+	candidate := sha1.New() // #nosec G401
+	if err := candidate.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return false
+	}
+
+	zeroed := append([]byte(nil), payload...)
+	copy(zeroed[5:9], []byte{0, 0, 0, 0})
+	candidate.Write(zeroed)
+	if subtle.ConstantTimeCompare(candidate.Sum(nil)[:4], payload[5:9]) != 1 {
+		return false
+	}
+
+	rc.forwardDigest = candidate
+	return true
+}
+
+// handleRelayCell handles a relay cell addressed to this hop
+func (rc *relayCircuit) handleRelayCell(command cell.Command, relayCell *cell.RelayCell) {
+	switch relayCell.Command {
+	case cell.RelayExtend2:
+		if command != cell.CmdRelayEarly {
+			rc.relay.logger.Debug("EXTEND2 not in RELAY_EARLY", "circuit_id", rc.id)
+			_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayTruncated, []byte{destroyReasonProtocol}))
+			return
+		}
+		go rc.extend(relayCell.Data)
+	case cell.RelayBegin:
+		// Every relay is an exit that accepts any stream and echoes its data
+		_ = rc.sendBackward(cell.NewRelayCell(relayCell.StreamID, cell.RelayConnected, nil))
+	case cell.RelayBeginDir:
+		rc.beginDir(relayCell.StreamID)
+	case cell.RelayData:
+		rc.receiveData(relayCell)
+	case cell.RelaySendme:
+		rc.receiveSendme(relayCell)
+	case cell.RelayEnd:
+		rc.flowMu.Lock()
+		delete(rc.flow.streams, relayCell.StreamID)
+		rc.flowMu.Unlock()
+	case cell.RelayDrop:
+		// Long-range padding, nothing to do but count it
+		rc.relay.mu.Lock()
+		rc.relay.paddingCells++
+		rc.relay.mu.Unlock()
+	case cell.RelayPaddingNegotiate:
+		rc.negotiatePadding(relayCell.Data)
+	case cell.RelayEstablishIntro:
+		rc.establishIntro(relayCell.Data)
+	case cell.RelayIntroduce1:
+		rc.introduce(relayCell.Data)
+	case cell.RelayEstablishRendezvous:
+		rc.establishRendezvous(relayCell.Data)
+	case cell.RelayRendezvous1:
+		rc.rendezvous(relayCell.Data)
+	default:
+		rc.relay.logger.Debug("Ignoring relay cell",
+			"circuit_id", rc.id,
+			"command", cell.RelayCmdString(relayCell.Command))
+	}
+}
+
+// negotiatePadding answers PADDING_NEGOTIATE (padding-spec.txt §3.3). The
+// relay accepts the built-in circuit setup machines without running them.
+func (rc *relayCircuit) negotiatePadding(data []byte) {
+	if len(data) < 8 || data[0] != paddingNegotiateVersion {
+		return
+	}
+	command, machine := data[1], data[2]
+
+	response := byte(paddingResponseErr)
+	if machine <= paddingMachineMax && (command == paddingCommandStart || command == paddingCommandStop) {
+		response = paddingResponseOK
+		rc.relay.mu.Lock()
+		if command == paddingCommandStart {
+			rc.relay.paddingStarts++
+		} else {
+			rc.relay.paddingStops++
+		}
+		rc.relay.mu.Unlock()
+	}
+
+	negotiated := []byte{paddingNegotiateVersion, command, response, machine}
+	negotiated = append(negotiated, data[4:8]...) // machine_ctr
+	_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayPaddingNegotiated, negotiated))
+}
+
+// extend handles EXTEND2: it connects to the next relay, verifies that relay's
+// identity, forwards the handshake in CREATE2, and answers with EXTENDED2
+func (rc *relayCircuit) extend(data []byte) {
+	reply, err := rc.doExtend(data)
+	if err != nil {
+		rc.relay.logger.Debug("EXTEND2 failed", "circuit_id", rc.id, "error", err)
+		_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayTruncated, []byte{destroyReasonConnect}))
+		return
+	}
+	_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayExtended2, reply))
+}
+
+func (rc *relayCircuit) doExtend(data []byte) ([]byte, error) {
+	spec, err := parseExtend2(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.mu.Lock()
+	if rc.next != nil || rc.extending || rc.closed {
+		rc.mu.Unlock()
+		return nil, fmt.Errorf("circuit already extended")
+	}
+	rc.extending = true
+	rc.created2 = make(chan *cell.Cell, 1)
+	rc.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), extendTimeout)
+	defer cancel()
+
+	cfg := connection.DefaultConfig(spec.address)
+	cfg.ExpectedFingerprint = spec.fingerprint
+	cfg.ExpectedIdentity = spec.ed25519ID
+	conn := connection.New(cfg, rc.relay.logger)
+	if err := conn.Connect(ctx, cfg); err != nil {
+		return nil, err
+	}
+	if err := protocol.NewHandshake(conn, rc.relay.logger).PerformHandshake(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	const nextID = 1 // Each extension uses its own connection
+	rc.mu.Lock()
+	rc.next, rc.nextID = conn, nextID
+	rc.mu.Unlock()
+	go rc.readBackward(conn)
+
+	create2 := binary.BigEndian.AppendUint16(nil, spec.htype)
+	create2 = binary.BigEndian.AppendUint16(create2, uint16(len(spec.hdata)))
+	create2 = append(create2, spec.hdata...)
+	if err := conn.SendCell(&cell.Cell{CircID: nextID, Command: cell.CmdCreate2, Payload: create2}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case created2 := <-rc.created2:
+		if created2.Command != cell.CmdCreated2 {
+			return nil, fmt.Errorf("next hop refused CREATE2")
+		}
+		// EXTENDED2 carries the CREATED2 body without the cell padding
+		payload := created2.Payload
+		if len(payload) < 2 || len(payload) < 2+int(binary.BigEndian.Uint16(payload)) {
+			return nil, fmt.Errorf("truncated CREATED2")
+		}
+		return payload[:2+int(binary.BigEndian.Uint16(payload))], nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readBackward passes cells from the next hop back toward the client
+func (rc *relayCircuit) readBackward(conn *connection.Connection) {
+	for {
+		received, err := conn.ReceiveCell()
+		if err != nil {
+			return
+		}
+
+		switch received.Command {
+		case cell.CmdCreated2, cell.CmdDestroy:
+			rc.mu.Lock()
+			ch := rc.created2
+			rc.mu.Unlock()
+			select {
+			case ch <- received:
+			default:
+			}
+		case cell.CmdRelay:
+			_ = rc.relayBackward(received.Payload)
+		}
+	}
+}
+
+// relayBackward adds this hop's backward layer to a cell from further along
+// and passes it to the client
+func (rc *relayCircuit) relayBackward(payload []byte) error {
+	payload = append([]byte(nil), payload...)
+	rc.backMu.Lock()
+	defer rc.backMu.Unlock()
+	rc.backwardCipher.XORKeyStream(payload, payload)
+	return rc.prev.send(&cell.Cell{CircID: rc.id, Command: cell.CmdRelay, Payload: payload})
+}
+
+// sendBackward sends a relay cell originating at this hop to the client
+func (rc *relayCircuit) sendBackward(relayCell *cell.RelayCell) error {
+	_, err := rc.sendBackwardDigest(relayCell)
+	return err
+}
+
+// sendBackwardDigest sends a relay cell to the client and returns the running
+// backward digest including it
+func (rc *relayCircuit) sendBackwardDigest(relayCell *cell.RelayCell) ([]byte, error) {
+	payload, err := relayCell.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	rc.backMu.Lock()
+	rc.backwardDigest.Write(payload) // Digest field is still zero
+	digest := rc.backwardDigest.Sum(nil)
+	copy(payload[5:9], digest[:4])
+	rc.backwardCipher.XORKeyStream(payload, payload)
+	err = rc.prev.send(&cell.Cell{CircID: rc.id, Command: cell.CmdRelay, Payload: payload})
+	rc.backMu.Unlock()
+
+	return digest, err
+}
+
+// close tears down the circuit and its onward connection
+func (rc *relayCircuit) close() {
+	rc.mu.Lock()
+	next := rc.next
+	rc.next = nil
+	rc.closed = true
+	rc.mu.Unlock()
+
+	rc.relay.forgetOnionService(rc)
+
+	if next != nil {
+		next.Close()
+	}
+}
+
+// extend2Spec is the parsed content of an EXTEND2 cell
+type extend2Spec struct {
+	address     string
+	fingerprint string
+	ed25519ID   []byte
+	htype       uint16
+	hdata       []byte
+}
+
+// parseExtend2 parses EXTEND2 data (tor-spec.txt §5.1.2)
+func parseExtend2(data []byte) (*extend2Spec, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty EXTEND2")
+	}
+
+	spec := &extend2Spec{}
+	nspec := int(data[0])
+	rest := data[1:]
+	for i := 0; i < nspec; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, fmt.Errorf("truncated link specifier")
+		}
+		lsType, lsData := rest[0], rest[2:2+int(rest[1])]
+		rest = rest[2+len(lsData):]
+
+		switch {
+		case lsType == 0 && len(lsData) == 6:
+			port := binary.BigEndian.Uint16(lsData[4:6])
+			spec.address = net.JoinHostPort(net.IP(lsData[0:4]).String(), strconv.Itoa(int(port)))
+		case lsType == 1 && len(lsData) == 18 && spec.address == "":
+			port := binary.BigEndian.Uint16(lsData[16:18])
+			spec.address = net.JoinHostPort(net.IP(lsData[0:16]).String(), strconv.Itoa(int(port)))
+		case lsType == 2 && len(lsData) == 20:
+			spec.fingerprint = fmt.Sprintf("%X", lsData)
+		case lsType == 3 && len(lsData) == 32:
+			spec.ed25519ID = append([]byte(nil), lsData...)
+		}
+	}
+	if spec.address == "" {
+		return nil, fmt.Errorf("EXTEND2 has no address link specifier")
+	}
+	if spec.fingerprint == "" {
+		return nil, fmt.Errorf("EXTEND2 has no legacy identity link specifier")
+	}
+
+	if len(rest) < 4 {
+		return nil, fmt.Errorf("truncated EXTEND2 handshake")
+	}
+	spec.htype = binary.BigEndian.Uint16(rest[0:2])
+	hlen := int(binary.BigEndian.Uint16(rest[2:4]))
+	if len(rest) < 4+hlen {
+		return nil, fmt.Errorf("truncated EXTEND2 handshake data")
+	}
+	spec.hdata = append([]byte(nil), rest[4:4+hlen]...)
+	return spec, nil
+}
+
+// newCTR creates an AES-128-CTR stream with an all-zero IV
+func newCTR(key []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+}
@@ -0,0 +1,192 @@
+package relaytest
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+)
+
+// Flow control windows and authenticated SENDME (tor-spec.txt §7.4, prop289)
+const (
+	circuitWindowStart     = 1000
+	circuitWindowIncrement = 100
+	streamWindowStart      = 500
+	streamWindowIncrement  = 50
+	sendmeVersion1         = 1
+	sendmeDigestLen        = 20
+
+	// Congestion control negotiation (prop324 §4)
+	ccExtensionType = 2
+	ccSendmeInc     = 31
+)
+
+// exitFlow is the exit's flow control state for one circuit. Echoed data waits
+// in per-stream queues while the circuit or stream package window is
+// exhausted, and a client that sends beyond its windows or answers with a
+// SENDME that does not authenticate the acknowledged cell loses the circuit.
+// With congestion control SENDMEs cover ccSendmeInc cells in both directions,
+// the client's congestion window replaces our deliver window, and streams
+// have no windows or SENDMEs at all.
+type exitFlow struct {
+	packageWindow     int
+	deliverWindow     int
+	increment         int // Cells acknowledged by each circuit-level SENDME
+	congestionControl bool
+	received          int      // DATA cells received since our last SENDME
+	sent              int      // DATA cells sent since the last one the client acknowledges
+	digests           [][]byte // Digests of sent cells awaiting the client's SENDME
+	streams           map[uint16]*exitStream
+}
+
+// exitStream is the flow control state of one exit or directory stream
+type exitStream struct {
+	packageWindow int
+	deliverWindow int
+	pending       [][]byte // Echo data waiting for the package windows
+
+	dir          *bytes.Buffer // Request received on a BEGIN_DIR stream, nil for exit streams
+	endOnceFlush bool          // Send RELAY_END once pending is sent
+}
+
+func newExitFlow() *exitFlow {
+	return &exitFlow{
+		packageWindow: circuitWindowStart,
+		deliverWindow: circuitWindowStart,
+		increment:     circuitWindowIncrement,
+		streams:       make(map[uint16]*exitStream),
+	}
+}
+
+// enableCongestionControl switches the circuit to the negotiated SENDME
+// increment before any data flows
+func (f *exitFlow) enableCongestionControl() {
+	f.congestionControl = true
+	f.increment = ccSendmeInc
+}
+
+// stream returns the state of a stream, opening it on first use
+func (f *exitFlow) stream(id uint16) *exitStream {
+	s, ok := f.streams[id]
+	if !ok {
+		s = &exitStream{packageWindow: streamWindowStart, deliverWindow: streamWindowStart}
+		f.streams[id] = s
+	}
+	return s
+}
+
+// receiveData accounts for a DATA cell from the client, acknowledges it with
+// SENDMEs when a window increment is complete, and queues the echo. It runs on
+// the link goroutine right after the cell advanced the forward digest.
+func (rc *relayCircuit) receiveData(relayCell *cell.RelayCell) {
+	rc.flowMu.Lock()
+	defer rc.flowMu.Unlock()
+
+	f := rc.flow
+	stream := f.stream(relayCell.StreamID)
+	if !f.congestionControl {
+		f.deliverWindow--
+		stream.deliverWindow--
+	}
+	if f.deliverWindow < 0 || stream.deliverWindow < 0 {
+		rc.relay.logger.Debug("Client exceeded deliver window", "circuit_id", rc.id, "stream_id", relayCell.StreamID)
+		rc.destroy()
+		return
+	}
+
+	f.received++
+	if f.received == f.increment {
+		f.received = 0
+		if !f.congestionControl {
+			f.deliverWindow += circuitWindowIncrement
+		}
+		body := []byte{sendmeVersion1, 0, sendmeDigestLen}
+		body = append(body, rc.forwardDigest.Sum(nil)[:sendmeDigestLen]...)
+		_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelaySendme, body))
+	}
+	if !f.congestionControl && stream.deliverWindow <= streamWindowStart-streamWindowIncrement {
+		stream.deliverWindow += streamWindowIncrement
+		_ = rc.sendBackward(cell.NewRelayCell(relayCell.StreamID, cell.RelaySendme, nil))
+	}
+
+	if stream.dir != nil {
+		rc.receiveDirData(relayCell.StreamID, stream, relayCell.Data)
+	} else {
+		stream.pending = append(stream.pending, append([]byte(nil), relayCell.Data...))
+	}
+	rc.flushLocked()
+}
+
+// receiveSendme handles a SENDME from the client. Circuit-level SENDMEs must
+// be version 1 and echo the digest of the cell that completed the increment.
+func (rc *relayCircuit) receiveSendme(relayCell *cell.RelayCell) {
+	rc.flowMu.Lock()
+	defer rc.flowMu.Unlock()
+
+	f := rc.flow
+	if relayCell.StreamID != 0 {
+		if f.congestionControl {
+			rc.relay.logger.Debug("Rejecting stream SENDME with congestion control", "circuit_id", rc.id)
+			rc.destroy()
+			return
+		}
+		f.stream(relayCell.StreamID).packageWindow += streamWindowIncrement
+		rc.flushLocked()
+		return
+	}
+
+	data := relayCell.Data
+	if len(f.digests) == 0 || len(data) < 3+sendmeDigestLen || data[0] != sendmeVersion1 ||
+		binary.BigEndian.Uint16(data[1:3]) != sendmeDigestLen ||
+		subtle.ConstantTimeCompare(data[3:3+sendmeDigestLen], f.digests[0]) != 1 {
+		rc.relay.logger.Debug("Rejecting unauthenticated SENDME", "circuit_id", rc.id)
+		rc.destroy()
+		return
+	}
+	f.digests = f.digests[1:]
+	f.packageWindow += f.increment
+
+	rc.relay.mu.Lock()
+	rc.relay.sendmes++
+	rc.relay.mu.Unlock()
+
+	rc.flushLocked()
+}
+
+// flushLocked sends queued echo data while the windows allow, recording the
+// digest of every cell the client must acknowledge; rc.flowMu must be held
+func (rc *relayCircuit) flushLocked() {
+	f := rc.flow
+	for id, stream := range f.streams {
+		for len(stream.pending) > 0 && (f.congestionControl || stream.packageWindow > 0) && f.packageWindow > 0 {
+			data := stream.pending[0]
+			stream.pending = stream.pending[1:]
+			if !f.congestionControl {
+				stream.packageWindow--
+			}
+			f.packageWindow--
+
+			digest, err := rc.sendBackwardDigest(cell.NewRelayCell(id, cell.RelayData, data))
+			if err != nil {
+				return
+			}
+			f.sent++
+			if f.sent == f.increment {
+				f.sent = 0
+				f.digests = append(f.digests, digest[:sendmeDigestLen])
+			}
+		}
+		if stream.endOnceFlush && len(stream.pending) == 0 {
+			_ = rc.sendBackward(cell.NewRelayCell(id, cell.RelayEnd, []byte{endReasonDone}))
+			delete(f.streams, id)
+		}
+	}
+}
+
+// destroy tears the circuit down after a protocol violation by the client
+func (rc *relayCircuit) destroy() {
+	_ = rc.prev.send(&cell.Cell{CircID: rc.id, Command: cell.CmdDestroy, Payload: []byte{destroyReasonProtocol}})
+	rc.prev.removeCircuit(rc.id)
+	rc.close()
+}
@@ -0,0 +1,247 @@
+package relaytest
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+	"github.com/opd-ai/go-tor/pkg/crypto"
+)
+
+// Onion service relay roles (rend-spec-v3.txt §3)
+const (
+	rendCookieLen           = 20
+	introduceLegacyIDLen    = 20
+	introduceAckSuccess     = 0x0000
+	introduceAckUnknownAuth = 0x0001 // Service ID not recognized
+
+	establishIntroMACLen       = 32
+	establishIntroSigPrefix    = "Tor establish-intro cell v1"
+	establishIntroDoSExtension = 0x01
+	dosParamRatePerSec         = 0x01
+	dosParamBurstPerSec        = 0x02
+)
+
+// establishIntro handles ESTABLISH_INTRO: once its MAC over the circuit's
+// KH and its signature by the auth key check out, the circuit becomes the
+// introduction circuit for that key, replacing any earlier one, and is
+// acknowledged with INTRO_ESTABLISHED
+func (rc *relayCircuit) establishIntro(data []byte) {
+	authKey, dos, err := rc.verifyEstablishIntro(data)
+	if err != nil {
+		rc.relay.logger.Debug("Rejected ESTABLISH_INTRO", "circuit_id", rc.id, "error", err)
+		_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayTruncated, []byte{destroyReasonProtocol}))
+		return
+	}
+
+	r := rc.relay
+	r.mu.Lock()
+	r.introCircuits[hex.EncodeToString(authKey)] = rc
+	if dos != nil {
+		r.introDoS[hex.EncodeToString(authKey)] = *dos
+	}
+	r.mu.Unlock()
+
+	_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayIntroEstablished, []byte{0})) // N_EXTENSIONS
+}
+
+// verifyEstablishIntro checks an ESTABLISH_INTRO cell (rend-spec-v3.txt
+// §3.1.1) and returns its auth key and DoS parameters, if any
+func (rc *relayCircuit) verifyEstablishIntro(data []byte) ([]byte, *IntroDoSParams, error) {
+	authKey, ok := parseAuthKey(data)
+	if !ok {
+		return nil, nil, fmt.Errorf("malformed auth key")
+	}
+	offset := 3 + len(authKey)
+	if len(data) < offset+1 {
+		return nil, nil, fmt.Errorf("missing extensions")
+	}
+	var dos *IntroDoSParams
+	n := int(data[offset])
+	offset++
+	for i := 0; i < n; i++ {
+		if len(data) < offset+2 || len(data) < offset+2+int(data[offset+1]) {
+			return nil, nil, fmt.Errorf("truncated extension")
+		}
+		field := data[offset+2 : offset+2+int(data[offset+1])]
+		if data[offset] == establishIntroDoSExtension {
+			var err error
+			if dos, err = parseIntroDoSParams(field); err != nil {
+				return nil, nil, err
+			}
+		}
+		offset += 2 + len(field)
+	}
+
+	if len(data) < offset+establishIntroMACLen+2 {
+		return nil, nil, fmt.Errorf("missing HANDSHAKE_AUTH")
+	}
+	mac := crypto.HsNtorMAC(rc.nonce, data[:offset])
+	if subtle.ConstantTimeCompare(mac, data[offset:offset+establishIntroMACLen]) != 1 {
+		return nil, nil, fmt.Errorf("HANDSHAKE_AUTH does not match the circuit")
+	}
+	offset += establishIntroMACLen
+
+	sigLen := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	if sigLen != ed25519.SignatureSize || len(data) < offset+2+sigLen {
+		return nil, nil, fmt.Errorf("invalid signature length %d", sigLen)
+	}
+	signed := append([]byte(establishIntroSigPrefix), data[:offset]...)
+	if !ed25519.Verify(authKey, signed, data[offset+2:offset+2+sigLen]) {
+		return nil, nil, fmt.Errorf("invalid signature")
+	}
+	return authKey, dos, nil
+}
+
+// IntroDoSParams are the INTRODUCE2 limits a service asked an introduction
+// point to enforce
+type IntroDoSParams struct {
+	RatePerSec  uint64
+	BurstPerSec uint64
+}
+
+// parseIntroDoSParams reads the DoS extension: N_PARAMS, then PARAM_TYPE [1]
+// | PARAM_VALUE [8] for each. Like Tor, values above INT32_MAX and a burst
+// below the rate are refused.
+func parseIntroDoSParams(field []byte) (*IntroDoSParams, error) {
+	if len(field) < 1 || len(field) < 1+9*int(field[0]) {
+		return nil, fmt.Errorf("truncated DoS extension")
+	}
+	dos := &IntroDoSParams{}
+	for i := 0; i < int(field[0]); i++ {
+		param := field[1+9*i:]
+		value := binary.BigEndian.Uint64(param[1:9])
+		if value > math.MaxInt32 {
+			return nil, fmt.Errorf("DoS parameter %d out of range: %d", param[0], value)
+		}
+		switch param[0] {
+		case dosParamRatePerSec:
+			dos.RatePerSec = value
+		case dosParamBurstPerSec:
+			dos.BurstPerSec = value
+		}
+	}
+	if dos.BurstPerSec < dos.RatePerSec {
+		return nil, fmt.Errorf("DoS burst %d below rate %d", dos.BurstPerSec, dos.RatePerSec)
+	}
+	return dos, nil
+}
+
+// introduce handles INTRODUCE1 from a client: it is passed unchanged as
+// INTRODUCE2 to the introduction circuit registered for its auth key, and
+// the client gets INTRODUCE_ACK with the outcome
+func (rc *relayCircuit) introduce(data []byte) {
+	status := uint16(introduceAckUnknownAuth)
+	if len(data) > introduceLegacyIDLen {
+		if authKey, ok := parseAuthKey(data[introduceLegacyIDLen:]); ok {
+			r := rc.relay
+			r.mu.Lock()
+			service := r.introCircuits[hex.EncodeToString(authKey)]
+			r.mu.Unlock()
+
+			if service != nil && service.sendBackward(cell.NewRelayCell(0, cell.RelayIntroduce2, data)) == nil {
+				status = introduceAckSuccess
+				r.mu.Lock()
+				r.introductions++
+				r.mu.Unlock()
+			}
+		}
+	}
+
+	ack := binary.BigEndian.AppendUint16(nil, status)
+	_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayIntroduceAck, append(ack, 0))) // N_EXTENSIONS
+}
+
+// establishRendezvous handles ESTABLISH_RENDEZVOUS: the circuit waits for a
+// service to answer with RENDEZVOUS1 carrying the same cookie
+func (rc *relayCircuit) establishRendezvous(data []byte) {
+	if len(data) < rendCookieLen {
+		rc.relay.logger.Debug("Malformed ESTABLISH_RENDEZVOUS", "circuit_id", rc.id)
+		_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayTruncated, []byte{destroyReasonProtocol}))
+		return
+	}
+
+	var cookie [rendCookieLen]byte
+	copy(cookie[:], data)
+	r := rc.relay
+	r.mu.Lock()
+	r.rendCircuits[cookie] = rc
+	r.mu.Unlock()
+
+	_ = rc.sendBackward(cell.NewRelayCell(0, cell.RelayRendezvousEstablished, nil))
+}
+
+// rendezvous handles RENDEZVOUS1 from a service: the handshake reply goes to
+// the waiting client in RENDEZVOUS2 and the two circuits are joined, so that
+// every later cell on one is relayed onto the other
+func (rc *relayCircuit) rendezvous(data []byte) {
+	if len(data) < rendCookieLen {
+		return
+	}
+
+	var cookie [rendCookieLen]byte
+	copy(cookie[:], data)
+	r := rc.relay
+	r.mu.Lock()
+	client := r.rendCircuits[cookie]
+	delete(r.rendCircuits, cookie)
+	r.mu.Unlock()
+	if client == nil {
+		rc.relay.logger.Debug("RENDEZVOUS1 with unknown cookie", "circuit_id", rc.id)
+		return
+	}
+
+	// Join before answering, so that no cell from the client can arrive at
+	// an unjoined circuit once it has RENDEZVOUS2
+	client.join(rc)
+	rc.join(client)
+	if err := client.sendBackward(cell.NewRelayCell(0, cell.RelayRendezvous2, data[rendCookieLen:])); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.rendezvous++
+	r.mu.Unlock()
+}
+
+// join relays unrecognized cells on this circuit to other
+func (rc *relayCircuit) join(other *relayCircuit) {
+	rc.mu.Lock()
+	rc.joined = other
+	rc.mu.Unlock()
+}
+
+// forgetOnionService removes the circuit's introduction and rendezvous
+// registrations when it closes
+func (r *Relay) forgetOnionService(rc *relayCircuit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, circ := range r.introCircuits {
+		if circ == rc {
+			delete(r.introCircuits, key)
+			delete(r.introDoS, key)
+		}
+	}
+	for cookie, circ := range r.rendCircuits {
+		if circ == rc {
+			delete(r.rendCircuits, cookie)
+		}
+	}
+}
+
+// parseAuthKey reads AUTH_KEY_TYPE | AUTH_KEY_LEN | AUTH_KEY, accepting only
+// ed25519 keys
+func parseAuthKey(data []byte) ([]byte, bool) {
+	if len(data) < 3 || data[0] != 0x02 {
+		return nil, false
+	}
+	keyLen := int(binary.BigEndian.Uint16(data[1:3]))
+	if keyLen != 32 || len(data) < 3+keyLen {
+		return nil, false
+	}
+	return data[3 : 3+keyLen], true
+}
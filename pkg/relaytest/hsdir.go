@@ -0,0 +1,117 @@
+package relaytest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+)
+
+// Directory streams (tor-spec.txt §6.2, rend-spec-v3.txt §2.2.6)
+const (
+	hsPublishPath   = "/tor/hs/3/publish"
+	hsFetchPrefix   = "/tor/hs/3/"
+	maxRelayDataLen = 498
+	endReasonDone   = 6 // REASON_DONE
+)
+
+// beginDir answers RELAY_BEGIN_DIR: the stream's data is collected as an
+// HTTP request for the relay's directory service instead of being echoed
+func (rc *relayCircuit) beginDir(streamID uint16) {
+	rc.flowMu.Lock()
+	rc.flow.stream(streamID).dir = &bytes.Buffer{}
+	rc.flowMu.Unlock()
+	_ = rc.sendBackward(cell.NewRelayCell(streamID, cell.RelayConnected, nil))
+}
+
+// receiveDirData adds data to a directory request and, once the request is
+// complete, queues the response and the end of the stream; rc.flowMu must
+// be held
+func (rc *relayCircuit) receiveDirData(streamID uint16, stream *exitStream, data []byte) {
+	if stream.endOnceFlush {
+		return
+	}
+	stream.dir.Write(data)
+
+	status := http.StatusBadRequest
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(stream.dir.Bytes())))
+	var body, document []byte
+	if err == nil {
+		body, err = io.ReadAll(req.Body)
+	}
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return // Wait for the rest of the request
+	case err == nil:
+		status, document = rc.relay.serveDir(req, body)
+	}
+	rc.relay.logger.Debug("Answered directory request", "circuit_id", rc.id, "stream_id", streamID, "status", status)
+
+	response := []byte(fmt.Sprintf("HTTP/1.0 %d %s\r\nContent-Length: %d\r\n\r\n", status, http.StatusText(status), len(document)))
+	response = append(response, document...)
+	for len(response) > 0 {
+		n := min(len(response), maxRelayDataLen)
+		stream.pending = append(stream.pending, response[:n])
+		response = response[n:]
+	}
+	stream.endOnceFlush = true
+}
+
+// serveDir handles a directory request and returns the status and the
+// document to send. As HSDir the relay accepts every descriptor posted to it
+// without checking it, unless it was told to reject uploads, and serves the
+// last one posted for a blinded key.
+func (r *Relay) serveDir(req *http.Request, body []byte) (int, []byte) {
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == hsPublishPath:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.rejectUploads > 0 {
+			r.rejectUploads--
+			return http.StatusServiceUnavailable, nil
+		}
+		r.hsDescriptors = append(r.hsDescriptors, body)
+		return http.StatusOK, nil
+
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, hsFetchPrefix):
+		blindedKey, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(req.URL.Path, hsFetchPrefix))
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for i := len(r.hsDescriptors) - 1; i >= 0; i-- {
+			if bytes.Equal(descriptorBlindedKey(r.hsDescriptors[i]), blindedKey) {
+				return http.StatusOK, r.hsDescriptors[i]
+			}
+		}
+		return http.StatusNotFound, nil
+	}
+	return http.StatusNotFound, nil
+}
+
+// descriptorBlindedKey returns the blinded key a v3 descriptor is stored
+// under: the key that signed its descriptor-signing-key-cert, or nil
+func descriptorBlindedKey(descriptor []byte) []byte {
+	_, rest, ok := strings.Cut(string(descriptor), "descriptor-signing-key-cert\n-----BEGIN ED25519 CERT-----\n")
+	if !ok {
+		return nil
+	}
+	encoded, _, ok := strings.Cut(rest, "-----END ED25519 CERT-----")
+	if !ok {
+		return nil
+	}
+	cert, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(encoded, "\n", ""))
+	// Header, one extension header, then the extension's 32-byte key
+	const extOffset = 1 + 1 + 4 + 1 + 32 + 1
+	if err != nil || len(cert) < extOffset+4+32 || cert[extOffset+2] != ed25519ExtSignedWithKey {
+		return nil
+	}
+	return cert[extOffset+4 : extOffset+4+32]
+}
@@ -0,0 +1,191 @@
+package relaytest
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/cell"
+)
+
+// authChallengeMethod is the AUTHENTICATE method advertised in AUTH_CHALLENGE
+// (Ed25519-SHA256-RFC5705, tor-spec.txt section 4.4)
+const authChallengeMethod = 3
+
+// link is an incoming OR connection from a client or another relay
+type link struct {
+	relay *Relay
+	conn  *tls.Conn
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	circuits map[uint32]*relayCircuit
+}
+
+func newLink(r *Relay, conn *tls.Conn) *link {
+	return &link{
+		relay:    r,
+		conn:     conn,
+		circuits: make(map[uint32]*relayCircuit),
+	}
+}
+
+// serve performs the responder side of the link handshake and then handles
+// cells until the connection closes
+func (l *link) serve() {
+	defer l.close()
+
+	if err := l.handshake(); err != nil {
+		l.relay.logger.Debug("Link handshake failed", "error", err)
+		return
+	}
+
+	for {
+		received, err := cell.DecodeCell(l.conn)
+		if err != nil {
+			return
+		}
+
+		switch received.Command {
+		case cell.CmdCreate2:
+			l.handleCreate2(received)
+		case cell.CmdCreateFast:
+			l.handleCreateFast(received)
+		case cell.CmdRelay, cell.CmdRelayEarly:
+			if circ := l.circuit(received.CircID); circ != nil {
+				circ.handleForward(received)
+			}
+		case cell.CmdDestroy:
+			if circ := l.removeCircuit(received.CircID); circ != nil {
+				circ.close()
+			}
+		case cell.CmdPadding:
+			l.relay.mu.Lock()
+			l.relay.linkPadding++
+			l.relay.mu.Unlock()
+		case cell.CmdPaddingNegotiate:
+			l.relay.mu.Lock()
+			l.relay.linkNegotiate = append([]byte(nil), received.Payload[:6]...)
+			l.relay.mu.Unlock()
+		}
+	}
+}
+
+// handshake exchanges VERSIONS, CERTS, AUTH_CHALLENGE and NETINFO
+// (tor-spec.txt section 4)
+func (l *link) handshake() error {
+	if err := l.conn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	versions, err := cell.DecodeCell(l.conn)
+	if err != nil {
+		return err
+	}
+	if versions.Command != cell.CmdVersions {
+		return fmt.Errorf("expected VERSIONS, got %s", versions.Command)
+	}
+
+	challenge := make([]byte, 32, 36)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	challenge = binary.BigEndian.AppendUint16(challenge, 1)
+	challenge = binary.BigEndian.AppendUint16(challenge, authChallengeMethod)
+
+	netinfo := binary.BigEndian.AppendUint32(nil, uint32(time.Now().Unix()))
+	netinfo = append(netinfo, 0x04, 4, 0, 0, 0, 0, 0)
+
+	for _, c := range []*cell.Cell{
+		{Command: cell.CmdVersions, Payload: []byte{0x00, 0x04}},
+		{Command: cell.CmdCerts, Payload: l.relay.certs},
+		{Command: cell.CmdAuthChallenge, Payload: challenge},
+		{Command: cell.CmdNetinfo, Payload: netinfo},
+	} {
+		if err := l.send(c); err != nil {
+			return err
+		}
+	}
+
+	clientNetinfo, err := cell.DecodeCell(l.conn)
+	if err != nil {
+		return err
+	}
+	if clientNetinfo.Command != cell.CmdNetinfo {
+		return fmt.Errorf("expected NETINFO, got %s", clientNetinfo.Command)
+	}
+	return nil
+}
+
+// send writes a cell to the link
+func (l *link) send(c *cell.Cell) error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	return c.Encode(l.conn)
+}
+
+// handleCreate2 answers a CREATE2 cell with CREATED2 using the ntor handshake
+func (l *link) handleCreate2(create2 *cell.Cell) {
+	circ, reply, err := l.relay.acceptCreate2(l, create2)
+	if err != nil {
+		l.relay.logger.Debug("Rejecting CREATE2", "circuit_id", create2.CircID, "error", err)
+		_ = l.send(&cell.Cell{CircID: create2.CircID, Command: cell.CmdDestroy, Payload: []byte{destroyReasonProtocol}})
+		return
+	}
+
+	l.mu.Lock()
+	l.circuits[create2.CircID] = circ
+	l.mu.Unlock()
+
+	_ = l.send(&cell.Cell{CircID: create2.CircID, Command: cell.CmdCreated2, Payload: reply})
+}
+
+// handleCreateFast answers a CREATE_FAST cell with CREATED_FAST
+func (l *link) handleCreateFast(createFast *cell.Cell) {
+	circ, reply, err := l.relay.acceptCreateFast(l, createFast)
+	if err != nil {
+		l.relay.logger.Debug("Rejecting CREATE_FAST", "circuit_id", createFast.CircID, "error", err)
+		_ = l.send(&cell.Cell{CircID: createFast.CircID, Command: cell.CmdDestroy, Payload: []byte{destroyReasonProtocol}})
+		return
+	}
+
+	l.mu.Lock()
+	l.circuits[createFast.CircID] = circ
+	l.mu.Unlock()
+
+	_ = l.send(&cell.Cell{CircID: createFast.CircID, Command: cell.CmdCreatedFast, Payload: reply})
+}
+
+// circuit returns the circuit with the given ID on this link
+func (l *link) circuit(id uint32) *relayCircuit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.circuits[id]
+}
+
+// removeCircuit removes and returns the circuit with the given ID
+func (l *link) removeCircuit(id uint32) *relayCircuit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	circ := l.circuits[id]
+	delete(l.circuits, id)
+	return circ
+}
+
+// close closes the link and every circuit on it
+func (l *link) close() {
+	l.conn.Close()
+
+	l.mu.Lock()
+	circuits := l.circuits
+	l.circuits = make(map[uint32]*relayCircuit)
+	l.mu.Unlock()
+
+	for _, circ := range circuits {
+		circ.close()
+	}
+}
@@ -0,0 +1,390 @@
+// Package relaytest provides an in-process network of fake Tor relays for
+// end-to-end tests of link handshakes and circuit construction without
+// Internet access. Each relay listens on a loopback TLS port, proves its
+// identity with a full CERTS chain, answers CREATE2 with the ntor or ntor v3
+// handshake and CREATE_FAST for one-hop circuits, and handles EXTEND2 by
+// connecting onward to another relay. Every relay also acts as an exit that
+// accepts RELAY_BEGIN and echoes RELAY_DATA back, enforcing stream and
+// circuit windows and requiring authenticated SENDMEs from the client. Exits
+// agree to congestion control when a client requests it in ntor v3, and any
+// hop accepts the built-in circuit padding machines in PADDING_NEGOTIATE and
+// records the link padding clients send. For onion services any relay serves
+// as an introduction point, forwarding INTRODUCE1 to the circuit that sent
+// ESTABLISH_INTRO for the same auth key, and as a rendezvous point, joining
+// the client's circuit to the service's once RENDEZVOUS1 arrives, and as an
+// HSDir that stores the descriptors posted over RELAY_BEGIN_DIR streams.
+package relaytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // #nosec G505 - SHA-1 relay fingerprints are defined by tor-spec.txt
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opd-ai/go-tor/pkg/crypto"
+	"github.com/opd-ai/go-tor/pkg/directory"
+	"github.com/opd-ai/go-tor/pkg/logger"
+)
+
+// Network is a set of fake relays that can extend circuits to each other
+type Network struct {
+	relays []*Relay
+	logger *logger.Logger
+}
+
+// NewNetwork starts size fake relays on loopback addresses
+func NewNetwork(size int, log *logger.Logger) (*Network, error) {
+	if log == nil {
+		log = logger.NewDefault()
+	}
+
+	n := &Network{logger: log.Component("relaytest")}
+	for i := 0; i < size; i++ {
+		relay, err := newRelay(fmt.Sprintf("FakeRelay%d", i), n.logger)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		n.relays = append(n.relays, relay)
+	}
+	return n, nil
+}
+
+// Relays returns the relays in the network
+func (n *Network) Relays() []*Relay {
+	return n.relays
+}
+
+// Close shuts down every relay in the network
+func (n *Network) Close() {
+	for _, relay := range n.relays {
+		relay.Close()
+	}
+}
+
+// Relay is a single fake relay
+type Relay struct {
+	nickname    string
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	rsaKey      *rsa.PrivateKey
+	edIdentity  ed25519.PrivateKey
+	ntorKey     *crypto.NtorKeyPair
+	fingerprint string
+	certs       []byte // CERTS cell payload
+	logger      *logger.Logger
+
+	mu            sync.Mutex
+	links         map[*link]struct{}
+	circuits      int
+	handshakes    map[uint16]int // Accepted CREATE2 handshakes by HTYPE
+	fastCircuits  int
+	ccCircuits    int                                   // Circuits that negotiated congestion control
+	sendmes       int                                   // Authenticated circuit-level SENDMEs accepted
+	paddingCells  int                                   // RELAY_DROP cells addressed to this relay
+	paddingStarts int                                   // Padding machines started with PADDING_NEGOTIATE
+	paddingStops  int                                   // Padding machines stopped with PADDING_NEGOTIATE
+	linkPadding   int                                   // Link-level PADDING cells received
+	linkNegotiate []byte                                // Payload of the last link PADDING_NEGOTIATE
+	introCircuits map[string]*relayCircuit              // Introduction circuits by hex auth key
+	introDoS      map[string]IntroDoSParams             // DoS parameters by hex auth key
+	rendCircuits  map[[rendCookieLen]byte]*relayCircuit // Rendezvous circuits by cookie
+	introductions int                                   // INTRODUCE1 cells passed to a service
+	rendezvous    int                                   // Circuits joined by RENDEZVOUS1
+	hsDescriptors [][]byte                              // Descriptors posted to this relay as HSDir
+	rejectUploads int                                   // Descriptor uploads still to be refused
+	closed        bool
+	wg            sync.WaitGroup
+}
+
+// newRelay generates relay keys and starts listening
+func newRelay(nickname string, log *logger.Logger) (*Relay, error) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate RSA identity key: %w", err)
+	}
+	_, edIdentity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate Ed25519 identity key: %w", err)
+	}
+	ntorKey, err := crypto.GenerateNtorKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ntor key: %w", err)
+	}
+	tlsCert, err := newLinkCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Relay{
+		nickname:    nickname,
+		tlsConfig:   &tls.Config{Certificates: []tls.Certificate{tlsCert}, MinVersion: tls.VersionTLS12},
+		rsaKey:      rsaKey,
+		edIdentity:  edIdentity,
+		ntorKey:     ntorKey,
+		fingerprint: rsaFingerprint(&rsaKey.PublicKey),
+		logger:      log.With("relay", nickname),
+		links:       make(map[*link]struct{}),
+		handshakes:  make(map[uint16]int),
+
+		introCircuits: make(map[string]*relayCircuit),
+		introDoS:      make(map[string]IntroDoSParams),
+		rendCircuits:  make(map[[rendCookieLen]byte]*relayCircuit),
+	}
+	r.certs, err = r.buildCertsCell(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	r.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	r.wg.Add(1)
+	go r.acceptLoop()
+	return r, nil
+}
+
+// Nickname returns the relay's nickname
+func (r *Relay) Nickname() string {
+	return r.nickname
+}
+
+// Address returns the relay's "IP:port" OR address
+func (r *Relay) Address() string {
+	return r.listener.Addr().String()
+}
+
+// Fingerprint returns the upper-case hex RSA identity fingerprint
+func (r *Relay) Fingerprint() string {
+	return r.fingerprint
+}
+
+// Descriptor returns the relay as it would appear in a consensus, with the
+// keys a client needs to build circuits through it
+func (r *Relay) Descriptor() *directory.Relay {
+	tcpAddr := r.listener.Addr().(*net.TCPAddr)
+	return &directory.Relay{
+		Nickname:     r.nickname,
+		Fingerprint:  r.fingerprint,
+		Address:      tcpAddr.IP.String(),
+		ORPort:       tcpAddr.Port,
+		Flags:        []string{"Fast", "Guard", "Exit", "Running", "Stable", "Valid"},
+		Published:    time.Now(),
+		IdentityKey:  append([]byte(nil), r.edIdentity.Public().(ed25519.PublicKey)...),
+		NtorOnionKey: append([]byte(nil), r.ntorKey.Public[:]...),
+		Bandwidth:    1000,
+		Protocols: directory.Protocols{
+			directory.ProtoRelay:    {{Low: 1, High: directory.ProtoRelayNtorV3}},
+			directory.ProtoFlowCtrl: {{Low: 1, High: directory.ProtoFlowCtrlCongestionControl}},
+		},
+	}
+}
+
+// CircuitCount returns the number of circuits this relay has accepted
+func (r *Relay) CircuitCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.circuits
+}
+
+// HandshakeCount returns the number of circuits this relay has accepted with
+// the given CREATE2 handshake type
+func (r *Relay) HandshakeCount(htype uint16) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.handshakes[htype]
+}
+
+// CreateFastCount returns the number of circuits this relay has accepted
+// with CREATE_FAST
+func (r *Relay) CreateFastCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fastCircuits
+}
+
+// CongestionControlCount returns the number of circuits on which this relay
+// agreed to congestion control as the exit
+func (r *Relay) CongestionControlCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ccCircuits
+}
+
+// SendmeCount returns the number of authenticated circuit-level SENDMEs this
+// relay has accepted from clients
+func (r *Relay) SendmeCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sendmes
+}
+
+// PaddingCellCount returns the number of RELAY_DROP padding cells clients
+// addressed to this relay
+func (r *Relay) PaddingCellCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paddingCells
+}
+
+// PaddingNegotiationCount returns the number of padding machines clients
+// started and stopped with this relay
+func (r *Relay) PaddingNegotiationCount() (started, stopped int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paddingStarts, r.paddingStops
+}
+
+// LinkPaddingCount returns the number of link-level PADDING cells clients
+// sent this relay
+func (r *Relay) LinkPaddingCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.linkPadding
+}
+
+// LinkPaddingNegotiation returns the version, command, ito_low_ms and
+// ito_high_ms of the last link PADDING_NEGOTIATE, or nil if none arrived
+func (r *Relay) LinkPaddingNegotiation() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.linkNegotiate
+}
+
+// IntroductionCount returns the number of INTRODUCE1 cells this relay passed
+// to an onion service as introduction point
+func (r *Relay) IntroductionCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.introductions
+}
+
+// IntroPointCount returns the number of auth keys this relay is
+// introduction point for
+func (r *Relay) IntroPointCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.introCircuits)
+}
+
+// IntroDoS returns the DoS parameters sent in ESTABLISH_INTRO for an auth
+// key, if any
+func (r *Relay) IntroDoS(authKey []byte) (IntroDoSParams, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	params, ok := r.introDoS[hex.EncodeToString(authKey)]
+	return params, ok
+}
+
+// RendezvousCount returns the number of client and service circuits this
+// relay joined as rendezvous point
+func (r *Relay) RendezvousCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rendezvous
+}
+
+// HSDescriptors returns the descriptors posted to this relay as HSDir
+func (r *Relay) HSDescriptors() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.hsDescriptors...)
+}
+
+// RejectHSDescriptors makes the relay answer the next n descriptor uploads
+// with 503 Service Unavailable
+func (r *Relay) RejectHSDescriptors(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rejectUploads = n
+}
+
+// Close stops the relay and closes its connections
+func (r *Relay) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	links := make([]*link, 0, len(r.links))
+	for l := range r.links {
+		links = append(links, l)
+	}
+	r.mu.Unlock()
+
+	r.listener.Close()
+	for _, l := range links {
+		l.close()
+	}
+	r.wg.Wait()
+}
+
+// acceptLoop accepts incoming OR connections until the listener is closed
+func (r *Relay) acceptLoop() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		l := newLink(r, tls.Server(conn, r.tlsConfig))
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			l.close()
+			return
+		}
+		r.links[l] = struct{}{}
+		r.wg.Add(1)
+		r.mu.Unlock()
+
+		go func() {
+			defer r.wg.Done()
+			l.serve()
+			r.mu.Lock()
+			delete(r.links, l)
+			r.mu.Unlock()
+		}()
+	}
+}
+
+// newLinkCertificate creates a self-signed TLS certificate for the OR port
+func newLinkCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate link key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.relaytest.net"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create link certificate: %w", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// rsaFingerprint returns the relay fingerprint of an RSA identity key
+func rsaFingerprint(key *rsa.PublicKey) string {
+	digest := sha1.Sum(x509.MarshalPKCS1PublicKey(key)) // #nosec G401
+	return strings.ToUpper(hex.EncodeToString(digest[:]))
+}
@@ -154,6 +154,36 @@ func (s *Server) SetCircuitPool(pool *pool.CircuitPool) {
 	s.circuitPool = pool
 }
 
+// SetOnionCircuitBuilder sets how circuits to introduction and rendezvous
+// points are built for .onion connections
+func (s *Server) SetOnionCircuitBuilder(builder onion.CircuitBuilder) {
+	s.onionClient.SetCircuitBuilder(builder)
+}
+
+// UpdateOnionRelays sets the relays from the current consensus that can act
+// as HSDirs and rendezvous points for .onion connections
+func (s *Server) UpdateOnionRelays(relays []*onion.HSDirectory) {
+	s.onionClient.UpdateHSDirs(relays)
+}
+
+// SetOnionClientAuthKeys sets the x25519 keys, keyed by onion address, for
+// connecting to onion services that require client authorization
+func (s *Server) SetOnionClientAuthKeys(keys map[string][]byte) {
+	s.onionClient.SetClientAuthKeys(keys)
+}
+
+// SetOnionMaxPoWEffort caps the effort spent solving the proof-of-work
+// puzzles of onion services under load; 0 never solves one
+func (s *Server) SetOnionMaxPoWEffort(effort uint32) {
+	s.onionClient.SetMaxPoWEffort(effort)
+}
+
+// SetOnionNetworkParams sets the consensus values that place onion service
+// descriptors on the HSDir hash ring
+func (s *Server) SetOnionNetworkParams(params onion.NetworkParams) {
+	s.onionClient.SetNetworkParams(params)
+}
+
 // ListenAndServe starts the SOCKS5 server
 func (s *Server) ListenAndServe(ctx context.Context) error {
 	s.logger.Info("Starting SOCKS5 server", "address", s.address)
@@ -291,24 +321,20 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 		s.logger.Info("Onion service connection requested", "address", host)
 
 		// Connect to the onion service using rendezvous protocol
-		circuitID, err := s.onionClient.ConnectToOnionService(ctx, addr)
+		circ, err := s.onionClient.ConnectToOnionService(ctx, addr)
 		if err != nil {
 			s.logger.Error("Failed to connect to onion service", "address", host, "error", err)
 			s.sendReply(conn, replyHostUnreachable, nil)
 			return
 		}
+		// Rendezvous circuits serve a single connection
+		defer circ.Close()
 
 		s.logger.Info("Successfully connected to onion service",
 			"address", host,
-			"circuit_id", circuitID)
-
-		// Send success reply
-		s.sendReply(conn, replySuccess, conn.LocalAddr())
+			"circuit_id", circ.ID)
 
-		// In Phase 8, this would relay data through the rendezvous circuit
-		// For Phase 7.3.4, we just log success and close
-		s.logger.Debug("Onion service connection established (mock relay)")
-		time.Sleep(100 * time.Millisecond)
+		s.serveStream(ctx, conn, circ, targetAddr, true)
 		return
 	}
 
@@ -393,6 +419,13 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 		return
 	}
 
+	s.serveStream(ctx, conn, circ, targetAddr, false)
+}
+
+// serveStream opens a stream to targetAddr on circ and relays the SOCKS
+// connection over it. Streams to an onion service carry only the port in
+// their BEGIN cell (rend-spec-v3.txt section 4.2).
+func (s *Server) serveStream(ctx context.Context, conn net.Conn, circ *circuit.Circuit, targetAddr string, onionService bool) {
 	// Parse target address and port
 	hostStr, portStr, err := net.SplitHostPort(targetAddr)
 	if err != nil {
@@ -425,8 +458,13 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	// Update stream state
 	strm.SetState(stream.StateConnecting)
 
+	beginHost := hostStr
+	if onionService {
+		beginHost = ""
+	}
+
 	// Open the stream on the circuit (sends RELAY_BEGIN and waits for RELAY_CONNECTED)
-	if err := circ.OpenStream(strm.ID, hostStr, port); err != nil {
+	if err := circ.OpenStream(strm.ID, beginHost, port); err != nil {
 		s.logger.Error("Failed to open stream", "stream_id", strm.ID, "error", err)
 		s.sendReply(conn, replyHostUnreachable, nil)
 		return
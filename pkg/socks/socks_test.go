@@ -336,13 +336,13 @@ func TestSOCKS5OnionAddress(t *testing.T) {
 		t.Fatalf("Failed to write request: %v", err)
 	}
 
-	// Read reply - should get host unreachable since onion service protocol not fully implemented
+	// Read reply - should get host unreachable since the server has no onion circuit builder
 	reply := make([]byte, 10)
 	if _, err := io.ReadFull(conn, reply); err != nil {
 		t.Fatalf("Failed to read reply: %v", err)
 	}
 
-	// Check reply - should be host unreachable (0x04) for onion addresses (not yet implemented)
+	// Check reply - should be host unreachable (0x04) when no circuits can be built to the service
 	if reply[1] != 0x04 {
 		t.Errorf("Expected host unreachable reply (0x04) for onion address, got %d", reply[1])
 	}
@@ -12,6 +12,10 @@ import (
 	"github.com/opd-ai/go-tor/pkg/logger"
 )
 
+// MaxCellData is the largest RELAY_DATA payload (509 bytes payload - 11 bytes
+// relay header); Send splits larger writes into cells of this size
+const MaxCellData = 498
+
 // State represents the current state of a stream
 type State int
 
@@ -56,6 +60,7 @@ type Stream struct {
 	IsolationKey *circuit.IsolationKey // Isolation key for this stream
 	CreatedAt    time.Time
 	sendQueue    chan []byte
+	sendMu       sync.Mutex // keeps each Send's cells contiguous in sendQueue
 	recvQueue    chan []byte
 	closeChan    chan struct{}
 	closeOnce    sync.Once
@@ -102,20 +107,51 @@ func (s *Stream) GetState() State {
 	return s.State
 }
 
-// Send queues data to be sent on the stream
+// Send queues data to be sent on the stream, one RELAY_DATA cell's worth at
+// a time. The write is all-or-nothing: if the send queue cannot hold every
+// cell, nothing is queued and an error is returned, so the caller can retry
+// the whole write without duplicating data.
+//
+// The stream itself keeps no flow control windows: they belong to the
+// circuit, which applies them (or congestion control) as the circuit layer
+// writes the cells with Circuit.WriteToStream.
 func (s *Stream) Send(data []byte) error {
 	if s.GetState() != StateConnected {
 		return fmt.Errorf("stream not connected: state=%s", s.GetState())
 	}
 
+	chunks := cellChunks(data)
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
 	select {
-	case s.sendQueue <- data:
-		return nil
 	case <-s.closeChan:
 		return io.EOF
 	default:
-		return fmt.Errorf("send queue full")
 	}
+	if free := cap(s.sendQueue) - len(s.sendQueue); free < len(chunks) {
+		return fmt.Errorf("send queue full: need %d cells, %d free", len(chunks), free)
+	}
+	// Only the circuit layer drains sendQueue, so the free slots checked
+	// above stay free while sendMu is held.
+	for _, chunk := range chunks {
+		s.sendQueue <- chunk
+	}
+	return nil
+}
+
+// cellChunks splits data into RELAY_DATA cell payloads
+func cellChunks(data []byte) [][]byte {
+	if len(data) <= MaxCellData {
+		return [][]byte{data}
+	}
+	chunks := make([][]byte, 0, (len(data)+MaxCellData-1)/MaxCellData)
+	for len(data) > MaxCellData {
+		chunks = append(chunks, data[:MaxCellData])
+		data = data[MaxCellData:]
+	}
+	return append(chunks, data)
 }
 
 // Receive reads data from the stream
@@ -10,6 +10,7 @@ import (
 
 // SendWithContext sends data on the stream with context support for cancellation and timeout.
 // This method provides better control over send operations compared to the basic Send method.
+// Unlike Send, it waits for room in the send queue, and ctx bounds that wait.
 //
 // Example usage:
 //
@@ -21,14 +22,19 @@ func (s *Stream) SendWithContext(ctx context.Context, data []byte) error {
 		return fmt.Errorf("stream not connected: state=%s", s.GetState())
 	}
 
-	select {
-	case s.sendQueue <- data:
-		return nil
-	case <-s.closeChan:
-		return io.EOF
-	case <-ctx.Done():
-		return fmt.Errorf("send cancelled: %w", ctx.Err())
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	for _, chunk := range cellChunks(data) {
+		select {
+		case s.sendQueue <- chunk:
+		case <-s.closeChan:
+			return io.EOF
+		case <-ctx.Done():
+			return fmt.Errorf("send cancelled: %w", ctx.Err())
+		}
 	}
+	return nil
 }
 
 // ReceiveWithTimeout receives data from the stream with a timeout.
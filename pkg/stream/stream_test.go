@@ -1,11 +1,13 @@
 package stream
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"testing"
 	"time"
 
+	"github.com/opd-ai/go-tor/pkg/circuit"
 	"github.com/opd-ai/go-tor/pkg/logger"
 )
 
@@ -95,6 +97,80 @@ func TestStreamReceiveData(t *testing.T) {
 	}
 }
 
+func TestStreamSendBeyondStreamWindow(t *testing.T) {
+	stream := NewStream(1, 100, "example.com", 80, logger.NewDefault())
+	stream.SetState(StateConnected)
+
+	// Drain the send queue as the circuit layer would
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		for {
+			if _, err := stream.SendData(ctx); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The stream window is the circuit's to enforce, so the stream queues
+	// more cells than one window without waiting for a SENDME
+	for i := 0; i < circuit.StreamWindowStart+circuit.StreamWindowIncrement; i++ {
+		if err := stream.SendWithContext(ctx, []byte("cell")); err != nil {
+			t.Fatalf("SendWithContext %d failed: %v", i, err)
+		}
+	}
+}
+
+func TestStreamSendSplitsCells(t *testing.T) {
+	stream := NewStream(1, 100, "example.com", 80, logger.NewDefault())
+	stream.SetState(StateConnected)
+
+	if err := stream.Send(bytes.Repeat([]byte("x"), MaxCellData+10)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, want := range []int{MaxCellData, 10} {
+		data, err := stream.SendData(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != want {
+			t.Errorf("SendData() returned %d bytes, want %d", len(data), want)
+		}
+	}
+}
+
+func TestStreamSendAllOrNothing(t *testing.T) {
+	stream := NewStream(1, 100, "example.com", 80, logger.NewDefault())
+	stream.SetState(StateConnected)
+
+	// One cell already queued leaves room for 31 more
+	if err := stream.Send([]byte("first")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	big := bytes.Repeat([]byte("x"), 32*MaxCellData)
+	if err := stream.Send(big); err == nil {
+		t.Fatal("Send of 32 cells into 31 free slots succeeded")
+	}
+	if got := len(stream.sendQueue); got != 1 {
+		t.Fatalf("failed Send left %d cells queued, want 1", got)
+	}
+
+	// Once the queue drains, retrying the whole write sends it exactly once
+	ctx := context.Background()
+	if _, err := stream.SendData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(big); err != nil {
+		t.Fatalf("retried Send failed: %v", err)
+	}
+	if got := len(stream.sendQueue); got != 32 {
+		t.Errorf("retried Send queued %d cells, want 32", got)
+	}
+}
+
 func TestStreamSendBeforeConnected(t *testing.T) {
 	log := logger.NewDefault()
 	stream := NewStream(1, 100, "example.com", 80, log)